@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package commandv2 provides the new version of commands.
+package commandv2
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/megaease/easegress/cmd/client/general"
+	"github.com/megaease/easegress/pkg/filters/openapivalidator"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/spf13/cobra"
+)
+
+// GenerateCmd returns generate command.
+func GenerateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate",
+		Short: "Generate resource skeletons from other definitions",
+	}
+	cmd.AddCommand(generateOpenAPICmd())
+	return cmd
+}
+
+type (
+	generateOpenAPIOptions struct {
+		file             string
+		name             string
+		port             uint16
+		backends         []string
+		validateResponse bool
+	}
+
+	// generatedServer is the skeleton of an HTTPServer.
+	generatedServer struct {
+		Name           string           `json:"name"`
+		Kind           string           `json:"kind"`
+		Port           uint16           `json:"port"`
+		KeepAlive      bool             `json:"keepAlive"`
+		MaxConnections uint32           `json:"maxConnections"`
+		Rules          []*generatedRule `json:"rules"`
+	}
+
+	generatedRule struct {
+		Paths []*generatedPath `json:"paths"`
+	}
+
+	generatedPath struct {
+		Path       string   `json:"path,omitempty"`
+		PathRegexp string   `json:"pathRegexp,omitempty"`
+		Methods    []string `json:"methods"`
+		Backend    string   `json:"backend"`
+	}
+
+	// generatedPipeline is the skeleton of a Pipeline.
+	generatedPipeline struct {
+		Name    string              `json:"name"`
+		Kind    string              `json:"kind"`
+		Flow    []map[string]string `json:"flow"`
+		Filters []interface{}       `json:"filters"`
+	}
+
+	generatedValidator struct {
+		Name             string `json:"name"`
+		Kind             string `json:"kind"`
+		ValidateResponse bool   `json:"validateResponse"`
+		Document         string `json:"document"`
+	}
+
+	generatedProxy struct {
+		Name  string           `json:"name"`
+		Kind  string           `json:"kind"`
+		Pools []*generatedPool `json:"pools"`
+	}
+
+	generatedPool struct {
+		Servers     []map[string]string `json:"servers"`
+		LoadBalance map[string]string   `json:"loadBalance"`
+	}
+)
+
+var pathTemplateRegexp = regexp.MustCompile(`\{[^{}]+\}`)
+
+func generateOpenAPICmd() *cobra.Command {
+	o := &generateOpenAPIOptions{}
+
+	examples := []general.Example{
+		{
+			Desc:    "Generate an HTTPServer and a Pipeline from an OpenAPI document",
+			Command: "egctl generate openapi -f petstore.yaml --backend http://127.0.0.1:9095",
+		},
+		{
+			Desc:    "Generate the resources with a custom name and port, and create them",
+			Command: "egctl generate openapi -f petstore.yaml --name pet --port 10081 | egctl create -f -",
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:     "openapi",
+		Short:   "Generate an HTTPServer and a Pipeline which validates requests by an OpenAPI 3 document",
+		Example: createMultiExample(examples),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if o.file == "" {
+				return errors.New("requires the OpenAPI document")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := generateOpenAPI(o); err != nil {
+				general.ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&o.file, "file", "f", "", "The OpenAPI 3 document in YAML or JSON.")
+	cmd.Flags().StringVar(&o.name, "name", "", "The name prefix of the resources, the file name is used by default.")
+	cmd.Flags().Uint16Var(&o.port, "port", 10080, "The port of the HTTPServer.")
+	cmd.Flags().StringSliceVar(&o.backends, "backend", nil, "The URLs of the backend servers, the servers of the document are used by default.")
+	cmd.Flags().BoolVar(&o.validateResponse, "validate-response", false, "Validate the responses and log the violations.")
+
+	return cmd
+}
+
+func generateOpenAPI(o *generateOpenAPIOptions) error {
+	data, err := os.ReadFile(o.file)
+	if err != nil {
+		return err
+	}
+	doc, err := openapivalidator.ParseDocument(data)
+	if err != nil {
+		return fmt.Errorf("parse %s failed: %v", o.file, err)
+	}
+	if len(doc.Operations) == 0 {
+		return fmt.Errorf("no operations in %s", o.file)
+	}
+
+	name := o.name
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(o.file), filepath.Ext(o.file))
+	}
+
+	basePath := ""
+	backends := o.backends
+	for i, s := range doc.Servers {
+		u, err := url.Parse(s)
+		if err != nil {
+			continue
+		}
+		if i == 0 {
+			basePath = strings.TrimSuffix(u.Path, "/")
+		}
+		if len(o.backends) == 0 && u.Scheme != "" && u.Host != "" {
+			backends = append(backends, u.Scheme+"://"+u.Host)
+		}
+	}
+	if len(backends) == 0 {
+		return errors.New("no backend servers, please specify them by --backend")
+	}
+
+	pipelineName := name + "-pipeline"
+	server := &generatedServer{
+		Name:           name + "-server",
+		Kind:           "HTTPServer",
+		Port:           o.port,
+		KeepAlive:      true,
+		MaxConnections: 10240,
+		Rules:          []*generatedRule{{Paths: generatePaths(doc, basePath, pipelineName)}},
+	}
+
+	pool := &generatedPool{LoadBalance: map[string]string{"policy": "roundRobin"}}
+	for _, b := range backends {
+		pool.Servers = append(pool.Servers, map[string]string{"url": b})
+	}
+	pipeline := &generatedPipeline{
+		Name: pipelineName,
+		Kind: "Pipeline",
+		Flow: []map[string]string{{"filter": "validator"}, {"filter": "proxy"}},
+		Filters: []interface{}{
+			&generatedValidator{
+				Name:             "validator",
+				Kind:             openapivalidator.Kind,
+				ValidateResponse: o.validateResponse,
+				Document:         string(data),
+			},
+			&generatedProxy{
+				Name:  "proxy",
+				Kind:  "Proxy",
+				Pools: []*generatedPool{pool},
+			},
+		},
+	}
+
+	for i, v := range []interface{}{server, pipeline} {
+		y, err := codectool.MarshalYAML(v)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Print(string(y))
+	}
+	return nil
+}
+
+// generatePaths generates the paths of the HTTPServer, paths without
+// templates come first so that they are matched first.
+func generatePaths(doc *openapivalidator.Document, basePath, backend string) []*generatedPath {
+	var exact, templated []*generatedPath
+	byPath := map[string]*generatedPath{}
+
+	for _, op := range doc.Operations {
+		if p := byPath[op.Path]; p != nil {
+			p.Methods = append(p.Methods, op.Method)
+			continue
+		}
+
+		p := &generatedPath{Methods: []string{op.Method}, Backend: backend}
+		byPath[op.Path] = p
+
+		full := basePath + op.Path
+		if !pathTemplateRegexp.MatchString(full) {
+			p.Path = full
+			exact = append(exact, p)
+			continue
+		}
+
+		expr := "^"
+		last := 0
+		for _, m := range pathTemplateRegexp.FindAllStringIndex(full, -1) {
+			expr += regexp.QuoteMeta(full[last:m[0]]) + "[^/]+"
+			last = m[1]
+		}
+		p.PathRegexp = expr + regexp.QuoteMeta(full[last:]) + "$"
+		templated = append(templated, p)
+	}
+
+	return append(exact, templated...)
+}
@@ -0,0 +1,446 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package commandv2 provides the new version of commands.
+package commandv2
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/cmd/client/general"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/trafficrecord"
+	"github.com/spf13/cobra"
+)
+
+// TrafficCmd returns traffic command.
+func TrafficCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "traffic",
+		Short: "Replay traffic recorded by the Recorder filter",
+	}
+	cmd.AddCommand(trafficReplayCmd())
+	return cmd
+}
+
+type (
+	replayOptions struct {
+		file        string
+		format      string
+		target      string
+		pipeline    string
+		host        string
+		speed       float64
+		concurrency int
+		timeout     time.Duration
+		verbose     bool
+	}
+
+	// replayResult is the result of replaying one record.
+	replayResult struct {
+		Method           string        `json:"method"`
+		URL              string        `json:"url"`
+		RecordedStatus   int           `json:"recordedStatus"`
+		ReplayedStatus   int           `json:"replayedStatus"`
+		RecordedDuration time.Duration `json:"recordedDuration"`
+		ReplayedDuration time.Duration `json:"replayedDuration"`
+		Error            string        `json:"error,omitempty"`
+	}
+
+	// replayReport is the summary of a replay.
+	replayReport struct {
+		Total       int             `json:"total"`
+		Matched     int             `json:"matched"`
+		StatusDiffs int             `json:"statusDiffs"`
+		Errors      int             `json:"errors"`
+		Recorded    latencySummary  `json:"recordedLatency"`
+		Replayed    latencySummary  `json:"replayedLatency"`
+		Diffs       []*replayResult `json:"diffs,omitempty"`
+	}
+
+	latencySummary struct {
+		Avg time.Duration `json:"avg"`
+		P50 time.Duration `json:"p50"`
+		P90 time.Duration `json:"p90"`
+		P99 time.Duration `json:"p99"`
+		Max time.Duration `json:"max"`
+	}
+)
+
+func trafficReplayCmd() *cobra.Command {
+	o := &replayOptions{}
+
+	examples := []general.Example{
+		{
+			Desc:    "Replay the records against a gateway at the original speed",
+			Command: "egctl traffic replay -f records.ndjson --target http://127.0.0.1:10080",
+		},
+		{
+			Desc:    "Replay the records of a HAR file at twice the original speed",
+			Command: "egctl traffic replay -f records.har --target http://127.0.0.1:10080 --speed 2",
+		},
+		{
+			Desc:    "Replay the records against the pipeline 'pipeline-demo' of the Easegress server",
+			Command: "egctl traffic replay -f records.ndjson --pipeline pipeline-demo",
+		},
+		{
+			Desc:    "Replay the records as fast as possible and print all differences",
+			Command: "egctl traffic replay -f records.ndjson --target http://127.0.0.1:10080 --speed 0 --verbose",
+		},
+	}
+
+	cmd := &cobra.Command{
+		Use:     "replay",
+		Short:   "Replay recorded traffic against a target and report the differences",
+		Example: createMultiExample(examples),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if o.file == "" {
+				return errors.New("requires the record file")
+			}
+			if (o.target == "") == (o.pipeline == "") {
+				return errors.New("requires one and only one of the target and the pipeline")
+			}
+			if o.speed < 0 {
+				return errors.New("speed must not be negative")
+			}
+			if o.concurrency <= 0 {
+				return errors.New("concurrency must be positive")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := replay(o); err != nil {
+				general.ExitWithError(err)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&o.file, "file", "f", "", "The file of the recorded traffic.")
+	cmd.Flags().StringVar(&o.format, "format", "", "The format of the file (ndjson, har), detected by the file extension by default.")
+	cmd.Flags().StringVar(&o.target, "target", "", "The scheme, host and port of the target, for example, http://127.0.0.1:10080.")
+	cmd.Flags().StringVar(&o.pipeline, "pipeline", "", "The name of the pipeline to replay against, the requests are sent to it by the admin API of the Easegress server.")
+	cmd.Flags().StringVar(&o.host, "host", "", "Override the Host header of the requests, the recorded one is used by default.")
+	cmd.Flags().Float64Var(&o.speed, "speed", 1, "The replay speed relative to the recording, 0 means as fast as possible.")
+	cmd.Flags().IntVar(&o.concurrency, "concurrency", 10, "The maximum number of concurrent requests.")
+	cmd.Flags().DurationVar(&o.timeout, "timeout", 30*time.Second, "The timeout of each request.")
+	cmd.Flags().BoolVarP(&o.verbose, "verbose", "v", false, "Print the result of every request, not only the differences.")
+
+	return cmd
+}
+
+func replay(o *replayOptions) error {
+	send, err := newReplaySender(o)
+	if err != nil {
+		return err
+	}
+
+	format := o.format
+	if format == "" {
+		if strings.EqualFold(filepath.Ext(o.file), ".har") {
+			format = trafficrecord.FormatHAR
+		} else {
+			format = trafficrecord.FormatNDJSON
+		}
+	}
+
+	f, err := os.Open(o.file)
+	if err != nil {
+		return err
+	}
+	records, err := trafficrecord.ReadRecords(f, format)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("read %s failed: %v", o.file, err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no records in %s", o.file)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartedAt.Before(records[j].StartedAt)
+	})
+
+	results := make([]*replayResult, len(records))
+	sem := make(chan struct{}, o.concurrency)
+	wg := &sync.WaitGroup{}
+
+	start := time.Now()
+	for i, rec := range records {
+		if o.speed > 0 {
+			offset := rec.StartedAt.Sub(records[0].StartedAt)
+			wait := time.Duration(float64(offset)/o.speed) - time.Since(start)
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, rec *trafficrecord.Record) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = send(rec)
+		}(i, rec)
+	}
+	wg.Wait()
+
+	report := newReplayReport(results, o.verbose)
+	if !general.CmdGlobalFlags.DefaultFormat() {
+		body, err := codectool.MarshalJSON(report)
+		if err != nil {
+			return err
+		}
+		general.PrintBody(body)
+		return nil
+	}
+	printReplayReport(report)
+	return nil
+}
+
+// newReplaySender returns the function which replays a record against
+// the target or the pipeline of the options.
+func newReplaySender(o *replayOptions) (func(*trafficrecord.Record) *replayResult, error) {
+	if o.pipeline != "" {
+		return func(rec *trafficrecord.Record) *replayResult {
+			return replayRecordToPipeline(o.pipeline, o.host, o.timeout, rec)
+		}, nil
+	}
+
+	target, err := url.Parse(o.target)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid target %s", o.target)
+	}
+
+	client := &http.Client{
+		Timeout: o.timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: general.CmdGlobalFlags.InsecureSkipVerify,
+			},
+			MaxIdleConnsPerHost: o.concurrency,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return func(rec *trafficrecord.Record) *replayResult {
+		return replayRecord(client, target, o.host, rec)
+	}, nil
+}
+
+func newReplayResult(rec *trafficrecord.Record) *replayResult {
+	result := &replayResult{
+		Method:           rec.Request.Method,
+		URL:              rec.Request.URL,
+		RecordedDuration: rec.Latency(),
+	}
+	if rec.Response != nil {
+		result.RecordedStatus = rec.Response.StatusCode
+	}
+	return result
+}
+
+func replayRecord(client *http.Client, target *url.URL, host string, rec *trafficrecord.Record) *replayResult {
+	result := newReplayResult(rec)
+
+	u, err := url.Parse(rec.Request.URL)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	originalHost := u.Host
+	u.Scheme, u.Host = target.Scheme, target.Host
+
+	req, err := http.NewRequest(rec.Request.Method, u.String(), bytes.NewReader(rec.Request.Body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header = replayHeader(rec.Request.Header)
+	req.Host = originalHost
+	if host != "" {
+		req.Host = host
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	result.ReplayedDuration = time.Since(start)
+	result.ReplayedStatus = resp.StatusCode
+	return result
+}
+
+// replayHeader returns a copy of the recorded header without the redacted
+// values, so the placeholder is not sent as the value.
+func replayHeader(h http.Header) http.Header {
+	header := http.Header{}
+	for k, values := range h {
+		for _, v := range values {
+			if v != trafficrecord.RedactedValue {
+				header[k] = append(header[k], v)
+			}
+		}
+	}
+	return header
+}
+
+// replayRecordToPipeline sends the request of a record to a pipeline by the
+// admin API, the replayed duration is the time spent by the pipeline.
+func replayRecordToPipeline(pipeline string, host string, timeout time.Duration, rec *trafficrecord.Record) *replayResult {
+	result := newReplayResult(rec)
+
+	req := *rec.Request
+	req.Header = replayHeader(req.Header)
+	if host != "" {
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		u.Host = host
+		req.URL = u.String()
+	}
+
+	body, err := codectool.MarshalJSON(&req)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	body, err = general.HandleRequestWithTimeout(http.MethodPost, general.MakePath(general.TrafficPipelineURL, pipeline), body, timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	replayed := &trafficrecord.Record{}
+	if err = codectool.UnmarshalJSON(body, replayed); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.ReplayedDuration = replayed.Latency()
+	if replayed.Response != nil {
+		result.ReplayedStatus = replayed.Response.StatusCode
+	}
+	return result
+}
+
+func newReplayReport(results []*replayResult, verbose bool) *replayReport {
+	report := &replayReport{Total: len(results)}
+
+	var recorded, replayed []time.Duration
+	for _, r := range results {
+		recorded = append(recorded, r.RecordedDuration)
+
+		switch {
+		case r.Error != "":
+			report.Errors++
+		case r.RecordedStatus != r.ReplayedStatus:
+			report.StatusDiffs++
+		default:
+			report.Matched++
+		}
+
+		if r.Error == "" {
+			replayed = append(replayed, r.ReplayedDuration)
+		}
+		if verbose || r.Error != "" || r.RecordedStatus != r.ReplayedStatus {
+			report.Diffs = append(report.Diffs, r)
+		}
+	}
+
+	report.Recorded = summarizeLatency(recorded)
+	report.Replayed = summarizeLatency(replayed)
+	return report
+}
+
+func summarizeLatency(durations []time.Duration) latencySummary {
+	s := latencySummary{}
+	if len(durations) == 0 {
+		return s
+	}
+
+	sort.Slice(durations, func(i, j int) bool {
+		return durations[i] < durations[j]
+	})
+
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+
+	percentile := func(p float64) time.Duration {
+		return durations[int(float64(len(durations)-1)*p)]
+	}
+
+	s.Avg = total / time.Duration(len(durations))
+	s.P50 = percentile(0.5)
+	s.P90 = percentile(0.9)
+	s.P99 = percentile(0.99)
+	s.Max = durations[len(durations)-1]
+	return s
+}
+
+func printReplayReport(report *replayReport) {
+	if len(report.Diffs) > 0 {
+		table := [][]string{{"METHOD", "URL", "RECORDED", "REPLAYED", "RECORDED-LATENCY", "REPLAYED-LATENCY", "ERROR"}}
+		for _, r := range report.Diffs {
+			table = append(table, []string{
+				r.Method,
+				r.URL,
+				strconv.Itoa(r.RecordedStatus),
+				strconv.Itoa(r.ReplayedStatus),
+				r.RecordedDuration.String(),
+				r.ReplayedDuration.String(),
+				r.Error,
+			})
+		}
+		general.PrintTable(table)
+		fmt.Println()
+	}
+
+	fmt.Printf("Total: %d, Matched: %d, Status Diffs: %d, Errors: %d\n\n",
+		report.Total, report.Matched, report.StatusDiffs, report.Errors)
+
+	row := func(name string, s latencySummary) []string {
+		return []string{name, s.Avg.String(), s.P50.String(), s.P90.String(), s.P99.String(), s.Max.String()}
+	}
+	general.PrintTable([][]string{
+		{"LATENCY", "AVG", "P50", "P90", "P99", "MAX"},
+		row("recorded", report.Recorded),
+		row("replayed", report.Replayed),
+	})
+}
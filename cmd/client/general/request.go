@@ -27,6 +27,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/megaease/easegress/pkg/api"
 	"github.com/megaease/easegress/pkg/util/codectool"
@@ -125,6 +126,12 @@ func SuccessfulStatusCode(code int) bool {
 
 // HandleRequest used in cmd/client/resources. It will return the response body in yaml or json format.
 func HandleRequest(httpMethod string, path string, yamlBody []byte) (body []byte, err error) {
+	return HandleRequestWithTimeout(httpMethod, path, yamlBody, 0)
+}
+
+// HandleRequestWithTimeout is like HandleRequest, but the request fails if
+// it doesn't complete in timeout, zero means no timeout.
+func HandleRequestWithTimeout(httpMethod string, path string, yamlBody []byte, timeout time.Duration) (body []byte, err error) {
 	var jsonBody []byte
 	if yamlBody != nil {
 		var err error
@@ -142,6 +149,7 @@ func HandleRequest(httpMethod string, path string, yamlBody []byte) (body []byte
 	if err != nil {
 		return nil, err
 	}
+	client.Timeout = timeout
 	resp, body, err := doRequest(httpMethod, url, jsonBody, client)
 	if err != nil {
 		return nil, err
@@ -67,6 +67,9 @@ const (
 	// ProfileStopURL is the URL of stop profile.
 	ProfileStopURL = APIURL + "/profile/stop"
 
+	// TrafficPipelineURL is the URL of sending requests to a pipeline.
+	TrafficPipelineURL = APIURL + "/traffic/pipelines/%s"
+
 	// HTTPProtocol is prefix for HTTP protocol
 	HTTPProtocol = "http://"
 	// HTTPSProtocol is prefix for HTTPS protocol
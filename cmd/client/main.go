@@ -84,6 +84,8 @@ func main() {
 		commandv2.ProfileCmd(),
 		commandv2.APIResourcesCmd(),
 		commandv2.WasmCmd(),
+		commandv2.TrafficCmd(),
+		commandv2.GenerateCmd(),
 		commandv2.ConfigCmd(),
 	)
 
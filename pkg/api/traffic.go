@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/object/trafficcontroller"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/trafficrecord"
+)
+
+const (
+	// TrafficPipelinePrefix is the URL prefix of the API which sends
+	// requests to pipelines.
+	TrafficPipelinePrefix = "/traffic/pipelines/{name}"
+
+	maxTrafficBodySize = 4 * 1024 * 1024
+)
+
+func (s *Server) trafficAPIEntries() []*Entry {
+	return []*Entry{
+		{
+			Path:    TrafficPipelinePrefix,
+			Method:  http.MethodPost,
+			Handler: s.sendToPipeline,
+		},
+	}
+}
+
+// sendToPipeline sends a recorded request to a pipeline and returns the
+// response of the pipeline as a record, the duration of the record is the
+// time spent by the pipeline.
+func (s *Server) sendToPipeline(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("read body failed: %v", err))
+		return
+	}
+	rr := &trafficrecord.Request{}
+	if err = codectool.UnmarshalJSON(body, rr); err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("unmarshal request failed: %v", err))
+		return
+	}
+
+	handler, ok := s.getPipeline(name)
+	if !ok {
+		HandleAPIError(w, r, http.StatusNotFound, fmt.Errorf("pipeline %s not found", name))
+		return
+	}
+
+	stdr, err := http.NewRequestWithContext(r.Context(), rr.Method, rr.URL, bytes.NewReader(rr.Body))
+	if err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	if rr.Header != nil {
+		stdr.Header = rr.Header.Clone()
+	}
+
+	req, err := httpprot.NewRequest(stdr)
+	if err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	if err = req.FetchPayload(maxTrafficBodySize); err != nil {
+		HandleAPIError(w, r, http.StatusBadRequest, fmt.Errorf("read request body failed: %v", err))
+		return
+	}
+
+	ctx := context.New(tracing.NoopSpan)
+	defer ctx.Finish()
+	ctx.SetRequest(context.DefaultNamespace, req)
+
+	rec := &trafficrecord.Record{StartedAt: time.Now(), Request: rr}
+	handler.Handle(ctx)
+	rec.Duration = float64(time.Since(rec.StartedAt)) / float64(time.Millisecond)
+
+	resp, _ := ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response)
+	if resp == nil {
+		HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("pipeline %s returns no response", name))
+		return
+	}
+
+	rec.Response = &trafficrecord.Response{
+		StatusCode: resp.StatusCode(),
+		Header:     resp.HTTPHeader().Clone(),
+	}
+	if !resp.IsStream() {
+		rec.Response.Body = resp.RawPayload()
+	} else if rec.Response.Body, err = io.ReadAll(io.LimitReader(resp.GetPayload(), maxTrafficBodySize)); err != nil {
+		HandleAPIError(w, r, http.StatusInternalServerError, fmt.Errorf("read response body failed: %v", err))
+		return
+	}
+
+	WriteBody(w, r, rec)
+}
+
+func (s *Server) getPipeline(name string) (context.Handler, bool) {
+	entity, ok := s.super.GetSystemController(trafficcontroller.Kind)
+	if !ok {
+		return nil, false
+	}
+	tc := entity.Instance().(*trafficcontroller.TrafficController)
+	pipeline, ok := tc.GetPipeline(cluster.NamespaceDefault, name)
+	if !ok {
+		return nil, false
+	}
+	handler, ok := pipeline.Instance().(context.Handler)
+	return handler, ok
+}
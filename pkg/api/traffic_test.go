@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/trafficcontroller"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/trafficrecord"
+)
+
+// mockPipeline echoes the method, body and X-Token header of requests.
+type mockPipeline struct{}
+
+func init() {
+	logger.InitNop()
+	supervisor.Register(&mockPipeline{})
+}
+
+func (p *mockPipeline) Category() supervisor.ObjectCategory { return supervisor.CategoryPipeline }
+func (p *mockPipeline) Kind() string                        { return "MockPipeline" }
+func (p *mockPipeline) DefaultSpec() interface{}            { return &struct{}{} }
+func (p *mockPipeline) Status() *supervisor.Status          { return &supervisor.Status{} }
+func (p *mockPipeline) Close()                              {}
+
+func (p *mockPipeline) Init(superSpec *supervisor.Spec, muxMapper context.MuxMapper) {}
+
+func (p *mockPipeline) Inherit(superSpec *supervisor.Spec, previousGeneration supervisor.Object, muxMapper context.MuxMapper) {
+}
+
+func (p *mockPipeline) Handle(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(http.StatusCreated)
+	resp.HTTPHeader().Set("X-Token", req.HTTPHeader().Get("X-Token"))
+	resp.SetPayload(req.Method() + " " + string(req.RawPayload()))
+	ctx.SetOutputResponse(resp)
+	return ""
+}
+
+func newTrafficServer(t *testing.T) *Server {
+	assert := assert.New(t)
+
+	super := supervisor.NewDefaultMock()
+	entity, err := super.NewObjectEntityFromConfig(`
+kind: TrafficController
+name: TrafficController
+`)
+	assert.NoError(err)
+	entity.InitWithRecovery(nil)
+	super.MockSystemController(entity)
+
+	spec, err := super.NewSpec(`
+kind: MockPipeline
+name: pipeline
+`)
+	assert.NoError(err)
+	tc := entity.Instance().(*trafficcontroller.TrafficController)
+	_, err = tc.CreatePipelineForSpec(cluster.NamespaceDefault, spec)
+	assert.NoError(err)
+
+	return &Server{super: super}
+}
+
+func sendToPipeline(s *Server, name, body string) *httptest.ResponseRecorder {
+	router := chi.NewRouter()
+	for _, e := range s.trafficAPIEntries() {
+		router.Method(e.Method, e.Path, e.Handler)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, strings.Replace(TrafficPipelinePrefix, "{name}", name, 1), strings.NewReader(body))
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestSendToPipeline(t *testing.T) {
+	assert := assert.New(t)
+	s := newTrafficServer(t)
+
+	req := &trafficrecord.Request{
+		Method: http.MethodPut,
+		URL:    "http://127.0.0.1/api",
+		Header: http.Header{"X-Token": []string{"token"}},
+		Body:   []byte("hello"),
+	}
+	body := string(codectool.MustMarshalJSON(req))
+
+	w := sendToPipeline(s, "pipeline", body)
+	assert.Equal(http.StatusOK, w.Code)
+	rec := &trafficrecord.Record{}
+	assert.NoError(codectool.UnmarshalJSON(w.Body.Bytes(), rec))
+	assert.Equal(req.URL, rec.Request.URL)
+	assert.Equal(http.StatusCreated, rec.Response.StatusCode)
+	assert.Equal("token", rec.Response.Header.Get("X-Token"))
+	assert.Equal("PUT hello", string(rec.Response.Body))
+	assert.GreaterOrEqual(rec.Duration, float64(0))
+
+	w = sendToPipeline(s, "missing", body)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	w = sendToPipeline(s, "pipeline", "not json")
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = sendToPipeline(s, "pipeline", `{"method": "GET", "url": "://invalid"}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
@@ -196,7 +196,8 @@ func (s *Store) dataPrefix(kind string) string {
 	return s.DataPrefix + kind + "/"
 }
 
-func (s *Store) dataKey(kind string, id string) string {
+// DataKey returns the key of a custom data in the cluster.
+func (s *Store) DataKey(kind string, id string) string {
 	return s.dataPrefix(kind) + id
 }
 
@@ -211,7 +212,7 @@ func unmarshalData(yamlConfig []byte) (Data, error) {
 
 // GetData gets custom data by its id
 func (s *Store) GetData(kind string, id string) (Data, error) {
-	kvs, err := s.cluster.GetRaw(s.dataKey(kind, id))
+	kvs, err := s.cluster.GetRaw(s.DataKey(kind, id))
 	if err != nil {
 		return nil, err
 	}
@@ -304,7 +305,7 @@ func (s *Store) PutData(kind string, data Data, update bool) (string, error) {
 		return "", fmt.Errorf("BUG: marshal %#v to json failed: %v", data, err)
 	}
 
-	key := s.dataKey(kind, id)
+	key := s.DataKey(kind, id)
 	err = s.cluster.Put(key, string(buf))
 	if err != nil {
 		return "", err
@@ -345,7 +346,7 @@ func (s *Store) BatchUpdateData(kind string, del []string, update []Data) error
 
 	return s.cluster.STM(func(stm concurrency.STM) error {
 		for _, id := range del {
-			key := s.dataKey(kind, id)
+			key := s.DataKey(kind, id)
 			stm.Del(key)
 		}
 
@@ -355,7 +356,7 @@ func (s *Store) BatchUpdateData(kind string, del []string, update []Data) error
 			if err != nil {
 				return fmt.Errorf("BUG: marshal %#v to json failed: %v", data, err)
 			}
-			key := s.dataKey(kind, id)
+			key := s.DataKey(kind, id)
 			stm.Put(key, string(buf))
 		}
 		return nil
@@ -373,7 +374,7 @@ func (s *Store) DeleteData(kind string, id string) error {
 		return fmt.Errorf("%s not found", id)
 	}
 
-	return s.cluster.Delete(s.dataKey(kind, id))
+	return s.cluster.Delete(s.DataKey(kind, id))
 }
 
 // DeleteAllData deletes all custom data of kind 'kind'
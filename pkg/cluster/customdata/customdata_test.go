@@ -114,7 +114,7 @@ func TestNewStore(t *testing.T) {
 		t.Errorf("data prefix should be '/data/test/` instead of %q", prefix)
 	}
 
-	if key := s.dataKey("foo", "bar"); key != "/data/foo/bar" {
+	if key := s.DataKey("foo", "bar"); key != "/data/foo/bar" {
 		t.Errorf("data key should be '/data/foo/bar` instead of %q", key)
 	}
 }
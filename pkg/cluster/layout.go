@@ -41,9 +41,11 @@ const (
 	configObjectFormat        = "/config/objects/%s" // +objectName
 	configVersion             = "/config/version"
 	wasmCodeEvent             = "/wasm/code"
-	wasmDataPrefixFormat      = "/wasm/data/%s/%s/" // + pipelineName + filterName
+	wasmDataPrefixFormat      = "/wasm/data/%s/%s/"   // + pipelineName + filterName
+	scriptDataPrefixFormat    = "/script/data/%s/%s/" // + pipelineName + filterName
 	customDataKindPrefix      = "/custom-data-kinds/"
 	customDataPrefix          = "/custom-data/"
+	tlsSessionTicketSecret    = "/tls/session-ticket-secret"
 
 	// the cluster name of this eg group will be registered under this path in etcd
 	// any new member(primary or secondary ) will be rejected if it is configured a different cluster name
@@ -148,6 +150,11 @@ func (l *Layout) WasmDataPrefix(pipeline string, name string) string {
 	return fmt.Sprintf(wasmDataPrefixFormat, pipeline, name)
 }
 
+// ScriptDataPrefix returns the prefix of script data
+func (l *Layout) ScriptDataPrefix(pipeline string, name string) string {
+	return fmt.Sprintf(scriptDataPrefixFormat, pipeline, name)
+}
+
 // CustomDataPrefix returns the prefix of all custom data
 func (l *Layout) CustomDataPrefix() string {
 	return customDataPrefix
@@ -157,3 +164,9 @@ func (l *Layout) CustomDataPrefix() string {
 func (l *Layout) CustomDataKindPrefix() string {
 	return customDataKindPrefix
 }
+
+// TLSSessionTicketSecret returns the key of the secret to derive TLS session
+// ticket keys.
+func (l *Layout) TLSSessionTicketSecret() string {
+	return tlsSessionTicketSecret
+}
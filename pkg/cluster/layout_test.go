@@ -67,6 +67,7 @@ func TestLayout(t *testing.T) {
 		t.Error("WasmDataPrefix empty")
 	}
 
+	assert.Equal("/script/data/pipeline/script/", l.ScriptDataPrefix("pipeline", "script"))
 	assert.Equal(customDataPrefix, l.CustomDataPrefix())
 	assert.Equal(customDataKindPrefix, l.CustomDataKindPrefix())
 
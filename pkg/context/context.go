@@ -30,6 +30,16 @@ import (
 // DefaultNamespace is the name of the default namespace.
 const DefaultNamespace = "DEFAULT"
 
+// Keys of the resilience policies of the route, the ones of the proxies
+// are overridden by them.
+const (
+	// DataKeyRouteRetryPolicy is the key of the retry policy of the route.
+	DataKeyRouteRetryPolicy = "ROUTE_RETRY_POLICY"
+	// DataKeyRouteCircuitBreakerPolicy is the key of the circuit breaker
+	// policy of the route.
+	DataKeyRouteCircuitBreakerPolicy = "ROUTE_CIRCUIT_BREAKER_POLICY"
+)
+
 // Handler is the common interface for all traffic handlers,
 // which handle the traffic represented by ctx.
 type Handler interface {
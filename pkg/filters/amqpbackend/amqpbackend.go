@@ -0,0 +1,272 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package amqpbackend implements an AMQP 0-9-1 proxy for HTTP requests.
+package amqpbackend
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/mqhelper"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// Kind is the kind of AMQP
+	Kind = "AMQP"
+
+	resultParseErr      = "parseErr"
+	resultPublishFailed = "publishFailed"
+
+	defaultTimeout = 5 * time.Second
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "AMQP is an AMQP 0-9-1 proxy for HTTP requests",
+	Results:     []string{resultParseErr, resultPublishFailed},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &AMQP{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+// conns are shared by the filter instances with the same URL, every filter
+// instance publishes messages with its own channel.
+var conns = mqhelper.NewPool()
+
+type (
+	// AMQP is an AMQP 0-9-1 proxy for HTTP requests.
+	AMQP struct {
+		spec    *Spec
+		conn    *connection
+		timeout time.Duration
+
+		mutex   sync.Mutex
+		channel *amqp.Channel
+	}
+
+	// connection is the shared connection, it is dialed when a channel is
+	// required and the connection is not available.
+	connection struct {
+		sync.Mutex
+		url  string
+		conn *amqp.Connection
+	}
+)
+
+var _ filters.Filter = (*AMQP)(nil)
+
+func (c *connection) newChannel() (*amqp.Channel, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.conn == nil || c.conn.IsClosed() {
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	return c.conn.Channel()
+}
+
+// Close closes the connection.
+func (c *connection) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// Name returns the name of the AMQP filter instance.
+func (a *AMQP) Name() string {
+	return a.spec.Name()
+}
+
+// Kind return kind of AMQP
+func (a *AMQP) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the AMQP
+func (a *AMQP) Spec() filters.Spec {
+	return a.spec
+}
+
+// Init init AMQP
+func (a *AMQP) Init() {
+	a.timeout = defaultTimeout
+	if a.spec.Timeout != "" {
+		a.timeout, _ = time.ParseDuration(a.spec.Timeout)
+	}
+
+	conn, _ := conns.Get(a.spec.URL, func() (io.Closer, error) {
+		return &connection{url: a.spec.URL}, nil
+	})
+	a.conn = conn.(*connection)
+}
+
+// Inherit init AMQP based on previous generation
+func (a *AMQP) Inherit(previousGeneration filters.Filter) {
+	a.Init()
+}
+
+// Close close AMQP
+func (a *AMQP) Close() {
+	a.mutex.Lock()
+	if a.channel != nil && !a.channel.IsClosed() {
+		a.channel.Close()
+	}
+	a.mutex.Unlock()
+
+	if err := conns.Put(a.spec.URL); err != nil {
+		logger.Errorf("close amqp connection failed: %v", err)
+	}
+}
+
+// Status return status of AMQP
+func (a *AMQP) Status() interface{} {
+	return nil
+}
+
+// getChannel returns the channel of the filter, a new channel is opened if
+// the previous one is closed, for example, by a failure of the connection.
+func (a *AMQP) getChannel() (*amqp.Channel, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.channel != nil && !a.channel.IsClosed() {
+		return a.channel, nil
+	}
+
+	channel, err := a.conn.newChannel()
+	if err != nil {
+		return nil, err
+	}
+	if a.spec.Confirm {
+		if err := channel.Confirm(false); err != nil {
+			channel.Close()
+			return nil, err
+		}
+	}
+	a.channel = channel
+	return channel, nil
+}
+
+func (a *AMQP) newPublishing(header http.Header, body []byte) amqp.Publishing {
+	msg := amqp.Publishing{
+		Body:      body,
+		Timestamp: time.Now(),
+	}
+	if a.spec.Persistent {
+		msg.DeliveryMode = amqp.Persistent
+	}
+
+	for name, value := range mqhelper.Properties(header, a.spec.Headers) {
+		switch name {
+		case "contentType":
+			msg.ContentType = value
+		case "contentEncoding":
+			msg.ContentEncoding = value
+		case "correlationId":
+			msg.CorrelationId = value
+		case "replyTo":
+			msg.ReplyTo = value
+		case "expiration":
+			msg.Expiration = value
+		case "messageId":
+			msg.MessageId = value
+		case "type":
+			msg.Type = value
+		case "userId":
+			msg.UserId = value
+		case "appId":
+			msg.AppId = value
+		default:
+			if msg.Headers == nil {
+				msg.Headers = amqp.Table{}
+			}
+			msg.Headers[name] = value
+		}
+	}
+	return msg
+}
+
+func (a *AMQP) publish(routingKey string, msg amqp.Publishing) error {
+	channel, err := a.getChannel()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), a.timeout)
+	defer cancel()
+	confirm, err := channel.PublishWithDeferredConfirmWithContext(ctx, a.spec.Exchange, routingKey, false, false, msg)
+	if err != nil || confirm == nil {
+		return err
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("message is nacked by the server")
+	}
+	return nil
+}
+
+// Handle handles the context.
+func (a *AMQP) Handle(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	routingKey := a.spec.RoutingKey.Topic(req.HTTPHeader())
+
+	body, err := io.ReadAll(req.GetPayload())
+	if err != nil {
+		return resultParseErr
+	}
+
+	msg := a.newPublishing(req.HTTPHeader(), body)
+	if err := a.publish(routingKey, msg); err != nil {
+		logger.Errorf("publish message to amqp exchange %q with routing key %s failed: %v", a.spec.Exchange, routingKey, err)
+		resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+		if resp == nil {
+			resp, _ = httpprot.NewResponse(nil)
+		}
+		resp.SetStatusCode(http.StatusServiceUnavailable)
+		ctx.SetOutputResponse(resp)
+		return resultPublishFailed
+	}
+	return ""
+}
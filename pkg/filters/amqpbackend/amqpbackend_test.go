@@ -0,0 +1,330 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package amqpbackend
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/mqhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+type (
+	// mockServer is a minimal AMQP 0-9-1 server, which records the
+	// published messages, and acks or nacks them in confirm mode.
+	mockServer struct {
+		sync.Mutex
+		listener net.Listener
+		msgs     []*mockMsg
+		nack     bool
+		conns    int
+	}
+
+	mockMsg struct {
+		exchange    string
+		routingKey  string
+		contentType string
+		headers     map[string]string
+		size        uint64
+		body        string
+	}
+)
+
+func newMockServer(t *testing.T) *mockServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &mockServer{listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *mockServer) url() string {
+	return "amqp://guest:guest@" + s.listener.Addr().String() + "/"
+}
+
+func (s *mockServer) messages() []*mockMsg {
+	s.Lock()
+	defer s.Unlock()
+	return s.msgs
+}
+
+func readFrame(r io.Reader) (byte, uint16, []byte, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint16(header[1:]), payload[:len(payload)-1], nil
+}
+
+func writeMethod(w io.Writer, channel, class, method uint16, args ...byte) {
+	frame := []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(frame[1:], channel)
+	binary.BigEndian.PutUint32(frame[3:], uint32(4+len(args)))
+	binary.BigEndian.PutUint16(frame[7:], class)
+	binary.BigEndian.PutUint16(frame[9:], method)
+	frame = append(append(frame, args...), 0xCE)
+	w.Write(frame)
+}
+
+func readShortStr(b []byte) (string, []byte) {
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:]
+}
+
+// parseProperties parses the content type and the string headers of the
+// content header frame.
+func parseProperties(msg *mockMsg, b []byte) {
+	msg.size = binary.BigEndian.Uint64(b[4:])
+	flags := binary.BigEndian.Uint16(b[12:])
+	b = b[14:]
+	if flags&0x8000 != 0 {
+		msg.contentType, b = readShortStr(b)
+	}
+	if flags&0x4000 != 0 {
+		_, b = readShortStr(b)
+	}
+	if flags&0x2000 == 0 {
+		return
+	}
+	table := b[4 : 4+binary.BigEndian.Uint32(b)]
+	msg.headers = map[string]string{}
+	for len(table) > 0 {
+		var key string
+		key, table = readShortStr(table)
+		n := binary.BigEndian.Uint32(table[1:])
+		msg.headers[key] = string(table[5 : 5+n])
+		table = table[5+n:]
+	}
+}
+
+func (s *mockServer) serve(c net.Conn) {
+	defer c.Close()
+	s.Lock()
+	s.conns++
+	s.Unlock()
+
+	r := bufio.NewReader(c)
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		return
+	}
+	// connection.start with version 0-9, empty server properties,
+	// mechanisms PLAIN and locales en_US
+	writeMethod(c, 0, 10, 10, 0, 9, 0, 0, 0, 0, 0, 0, 0, 5, 'P', 'L', 'A', 'I', 'N', 0, 0, 0, 5, 'e', 'n', '_', 'U', 'S')
+
+	confirms := map[uint16]uint64{}
+	var msg *mockMsg
+	for {
+		typ, channel, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case 1:
+			class, method := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+			args := payload[4:]
+			switch {
+			case class == 10 && method == 11:
+				// connection.tune with channel max 2047, frame max 131072
+				// and no heartbeat
+				writeMethod(c, 0, 10, 30, 0x07, 0xFF, 0, 2, 0, 0, 0, 0)
+			case class == 10 && method == 40:
+				writeMethod(c, 0, 10, 41, 0)
+			case class == 10 && method == 50:
+				writeMethod(c, 0, 10, 51)
+				return
+			case class == 20 && method == 10:
+				writeMethod(c, channel, 20, 11, 0, 0, 0, 0)
+			case class == 20 && method == 40:
+				writeMethod(c, channel, 20, 41)
+			case class == 85 && method == 10:
+				confirms[channel] = 0
+				writeMethod(c, channel, 85, 11)
+			case class == 60 && method == 40:
+				msg = &mockMsg{}
+				msg.exchange, args = readShortStr(args[2:])
+				msg.routingKey, _ = readShortStr(args)
+			}
+			continue
+		case 2:
+			parseProperties(msg, payload)
+		case 3:
+			msg.body += string(payload)
+		default:
+			continue
+		}
+
+		if msg == nil || uint64(len(msg.body)) < msg.size {
+			continue
+		}
+
+		s.Lock()
+		nack := s.nack
+		if !nack {
+			s.msgs = append(s.msgs, msg)
+		}
+		s.Unlock()
+		msg = nil
+
+		tag, ok := confirms[channel]
+		if !ok {
+			continue
+		}
+		tag++
+		confirms[channel] = tag
+		args := binary.BigEndian.AppendUint64(nil, tag)
+		if nack {
+			writeMethod(c, channel, 60, 120, append(args, 0)...)
+		} else {
+			writeMethod(c, channel, 60, 80, append(args, 0)...)
+		}
+	}
+}
+
+func newFilter(t *testing.T, spec *Spec) *AMQP {
+	spec.BaseSpec.MetaSpec.Kind = Kind
+	spec.BaseSpec.MetaSpec.Name = "amqp"
+	filterSpec, err := filters.NewSpec(nil, "pipeline-demo", spec)
+	assert.Nil(t, err)
+	a := kind.CreateInstance(filterSpec).(*AMQP)
+	a.Init()
+	return a
+}
+
+func newContext(t *testing.T, body string, header map[string]string) *context.Context {
+	ctx := context.New(nil)
+	stdReq, err := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range header {
+		stdReq.Header.Set(k, v)
+	}
+	req, err := httpprot.NewRequest(stdReq)
+	assert.Nil(t, err)
+	assert.Nil(t, req.FetchPayload(1024*1024))
+	ctx.SetInputRequest(req)
+	return ctx
+}
+
+func TestAMQP(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newMockServer(t)
+	defer server.listener.Close()
+
+	a := newFilter(t, &Spec{
+		URL:      server.url(),
+		Exchange: "events",
+		RoutingKey: &mqhelper.TopicSpec{
+			Default: "default",
+			Dynamic: &mqhelper.DynamicSpec{Header: "X-Routing-Key"},
+		},
+		Headers: map[string]string{
+			"Content-Type": "contentType",
+			"X-Request-Id": "requestId",
+		},
+	})
+	defer a.Close()
+	assert.Equal("amqp", a.Name())
+	assert.Equal(kind, a.Kind())
+	assert.Nil(a.Status())
+
+	assert.Equal("", a.Handle(newContext(t, "hello", map[string]string{
+		"Content-Type": "text/plain",
+		"X-Request-Id": "123",
+	})))
+	assert.Equal("", a.Handle(newContext(t, "world", map[string]string{"X-Routing-Key": "others"})))
+
+	// messages are published without confirms, so wait for the server
+	assert.Eventually(func() bool { return len(server.messages()) == 2 }, time.Second*5, time.Millisecond*10)
+	msgs := server.messages()
+	assert.Equal("events", msgs[0].exchange)
+	assert.Equal("default", msgs[0].routingKey)
+	assert.Equal("text/plain", msgs[0].contentType)
+	assert.Equal(map[string]string{"requestId": "123"}, msgs[0].headers)
+	assert.Equal("hello", msgs[0].body)
+	assert.Equal("others", msgs[1].routingKey)
+	assert.Equal("world", msgs[1].body)
+
+	// filters with the same URL share the connection
+	confirm := newFilter(t, &Spec{
+		URL:        server.url(),
+		RoutingKey: &mqhelper.TopicSpec{Default: "queue"},
+		Confirm:    true,
+		Persistent: true,
+		Timeout:    "1s",
+	})
+	defer confirm.Close()
+	assert.Same(a.conn, confirm.conn)
+
+	assert.Equal("", confirm.Handle(newContext(t, "acked", nil)))
+	assert.Equal(3, len(server.messages()))
+
+	server.Lock()
+	server.nack = true
+	server.Unlock()
+	ctx := newContext(t, "nacked", nil)
+	assert.Equal(resultPublishFailed, confirm.Handle(ctx))
+	assert.Equal(http.StatusServiceUnavailable, ctx.GetOutputResponse().(*httpprot.Response).StatusCode())
+
+	server.Lock()
+	assert.Equal(1, server.conns)
+	server.nack = false
+	server.Unlock()
+
+	// the connection is dialed again after it is closed
+	assert.Nil(a.conn.Close())
+	assert.Equal("", confirm.Handle(newContext(t, "redialed", nil)))
+	server.Lock()
+	assert.Equal(2, server.conns)
+	server.Unlock()
+}
+
+func TestSpec(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil((&Spec{URL: "amqp://127.0.0.1:5672/"}).Validate())
+	assert.NotNil((&Spec{URL: "http://127.0.0.1:5672/"}).Validate())
+	assert.NotNil((&Spec{URL: "amqp://127.0.0.1:5672/", Timeout: "1"}).Validate())
+}
@@ -0,0 +1,542 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package faultinjection implements the FaultInjection filter, which
+// injects delays, aborts, bandwidth throttling and connection resets for
+// chaos testing.
+package faultinjection
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols"
+	"github.com/megaease/easegress/pkg/protocols/grpcprot"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/protocols/httpprot/httpstat"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Kind is the kind of FaultInjection.
+	Kind = "FaultInjection"
+
+	resultAborted = "aborted"
+
+	distributionUniform     = "uniform"
+	distributionNormal      = "normal"
+	distributionExponential = "exponential"
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "FaultInjection injects delays, aborts, bandwidth throttling and connection resets",
+	Results:     []string{resultAborted},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &FaultInjection{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+var fnRandom = rand.Float64
+
+type (
+	// FaultInjection is filter FaultInjection.
+	FaultInjection struct {
+		spec *Spec
+	}
+
+	// Spec describes the FaultInjection.
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+
+		Rules []*Rule `json:"rules" jsonschema:"required"`
+	}
+
+	// Rule is a fault injection rule, the faults of the first rule which
+	// matches the request are injected.
+	Rule struct {
+		Match    MatchRule     `json:"match" jsonschema:"omitempty"`
+		Delay    *DelaySpec    `json:"delay,omitempty" jsonschema:"omitempty"`
+		Abort    *AbortSpec    `json:"abort,omitempty" jsonschema:"omitempty"`
+		Throttle *ThrottleSpec `json:"throttle,omitempty" jsonschema:"omitempty"`
+		Reset    *ResetSpec    `json:"reset,omitempty" jsonschema:"omitempty"`
+	}
+
+	// MatchRule is the rule to match a request, the path is the full
+	// method for gRPC requests.
+	MatchRule struct {
+		Path            string                               `json:"path,omitempty" jsonschema:"omitempty,pattern=^/"`
+		PathPrefix      string                               `json:"pathPrefix,omitempty" jsonschema:"omitempty,pattern=^/"`
+		Headers         map[string]*stringtool.StringMatcher `json:"headers,omitempty" jsonschema:"omitempty"`
+		MatchAllHeaders bool                                 `json:"matchAllHeaders,omitempty" jsonschema:"omitempty"`
+	}
+
+	// DelaySpec describes the delay fault.
+	DelaySpec struct {
+		// Percentage is the percentage of matched requests to inject the
+		// fault into, all matched requests if not specified.
+		Percentage *float64 `json:"percentage,omitempty" jsonschema:"omitempty,minimum=0,maximum=100"`
+		// Duration is the fixed delay, or the mean delay of the
+		// distributions.
+		Duration string `json:"duration" jsonschema:"required,format=duration"`
+		// Distribution is the distribution of the delay.
+		Distribution string `json:"distribution,omitempty" jsonschema:"omitempty,enum=,enum=fixed,enum=uniform,enum=normal,enum=exponential"`
+		// Jitter is the half width of the uniform distribution, or the
+		// standard deviation of the normal distribution.
+		Jitter string `json:"jitter,omitempty" jsonschema:"omitempty,format=duration"`
+
+		duration time.Duration
+		jitter   time.Duration
+	}
+
+	// AbortSpec describes the abort fault.
+	AbortSpec struct {
+		Percentage *float64          `json:"percentage,omitempty" jsonschema:"omitempty,minimum=0,maximum=100"`
+		StatusCode int               `json:"statusCode,omitempty" jsonschema:"omitempty,format=httpcode"`
+		GRPCStatus int               `json:"grpcStatus,omitempty" jsonschema:"omitempty,minimum=1,maximum=16"`
+		Headers    map[string]string `json:"headers,omitempty" jsonschema:"omitempty"`
+		Body       string            `json:"body,omitempty" jsonschema:"omitempty"`
+	}
+
+	// ThrottleSpec describes the bandwidth throttling fault of the
+	// response body.
+	ThrottleSpec struct {
+		Percentage     *float64 `json:"percentage,omitempty" jsonschema:"omitempty,minimum=0,maximum=100"`
+		BytesPerSecond int64    `json:"bytesPerSecond" jsonschema:"required,minimum=1"`
+	}
+
+	// ResetSpec describes the connection reset fault, the connection is
+	// reset after the response header and AfterBytes of the response body
+	// are sent.
+	ResetSpec struct {
+		Percentage *float64 `json:"percentage,omitempty" jsonschema:"omitempty,minimum=0,maximum=100"`
+		AfterBytes int64    `json:"afterBytes,omitempty" jsonschema:"omitempty,minimum=0"`
+	}
+)
+
+// Validate validates the Spec.
+func (s *Spec) Validate() error {
+	for i, r := range s.Rules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Validate validates the Rule.
+func (r *Rule) Validate() error {
+	if r.Delay == nil && r.Abort == nil && r.Throttle == nil && r.Reset == nil {
+		return fmt.Errorf("no fault is specified")
+	}
+
+	if d := r.Delay; d != nil {
+		if dur, err := time.ParseDuration(d.Duration); err != nil || dur < 0 {
+			return fmt.Errorf("invalid delay duration %q", d.Duration)
+		}
+		if d.Jitter != "" {
+			if dur, err := time.ParseDuration(d.Jitter); err != nil || dur < 0 {
+				return fmt.Errorf("invalid delay jitter %q", d.Jitter)
+			}
+		}
+	}
+
+	if a := r.Abort; a != nil && a.StatusCode == 0 && a.GRPCStatus == 0 {
+		return fmt.Errorf("one of statusCode and grpcStatus of abort must be specified")
+	}
+
+	return nil
+}
+
+// HasResponseFaults returns whether the rule has faults which need to be
+// injected into the response, that's, throttle or reset.
+func (r *Rule) HasResponseFaults() bool {
+	return r.Throttle != nil || r.Reset != nil
+}
+
+// Name returns the name of the FaultInjection filter instance.
+func (fi *FaultInjection) Name() string {
+	return fi.spec.Name()
+}
+
+// Kind returns the kind of FaultInjection.
+func (fi *FaultInjection) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the FaultInjection.
+func (fi *FaultInjection) Spec() filters.Spec {
+	return fi.spec
+}
+
+// Init initializes FaultInjection.
+func (fi *FaultInjection) Init() {
+	fi.reload()
+}
+
+// Inherit inherits previous generation of FaultInjection.
+func (fi *FaultInjection) Inherit(previousGeneration filters.Filter) {
+	fi.reload()
+}
+
+func (fi *FaultInjection) reload() {
+	for _, r := range fi.spec.Rules {
+		if r.Delay == nil {
+			continue
+		}
+		r.Delay.duration, _ = time.ParseDuration(r.Delay.Duration)
+		if r.Delay.Jitter != "" {
+			r.Delay.jitter, _ = time.ParseDuration(r.Delay.Jitter)
+		}
+	}
+}
+
+func hit(percentage *float64) bool {
+	if percentage == nil || *percentage >= 100 {
+		return true
+	}
+	return fnRandom()*100 < *percentage
+}
+
+// Handle injects faults into the request or the response.
+//
+// Delay and abort are injected if there's no response yet, that's, the
+// filter is placed before the one which generates the response; throttle
+// and reset are injected into an existing response, that's, the filter
+// is placed after the one which generates the response. A filter can be
+// referenced twice in the flow to inject both kinds of faults.
+func (fi *FaultInjection) Handle(ctx *context.Context) string {
+	rule := fi.match(ctx.GetInputRequest())
+	if rule == nil {
+		return ""
+	}
+
+	if ctx.GetOutputResponse() == nil {
+		if rule.Delay != nil && hit(rule.Delay.Percentage) {
+			fi.delay(ctx, rule.Delay)
+		}
+		if rule.Abort != nil && hit(rule.Abort.Percentage) {
+			fi.abort(ctx, rule.Abort)
+			ctx.AddTag("faultInjection: aborted")
+			return resultAborted
+		}
+		return ""
+	}
+
+	resp, ok := ctx.GetOutputResponse().(*httpprot.Response)
+	if !ok {
+		return ""
+	}
+
+	if rule.Throttle != nil && hit(rule.Throttle.Percentage) {
+		fi.throttle(ctx, resp, rule.Throttle)
+	}
+	if rule.Reset != nil && hit(rule.Reset.Percentage) {
+		fi.reset(ctx, resp, rule.Reset)
+		ctx.AddTag("faultInjection: reset")
+		return resultAborted
+	}
+
+	return ""
+}
+
+func (fi *FaultInjection) match(req protocols.Request) *Rule {
+	var (
+		path      string
+		getHeader func(key string) []string
+	)
+
+	switch r := req.(type) {
+	case *httpprot.Request:
+		path = r.Path()
+		getHeader = r.HTTPHeader().Values
+	case *grpcprot.Request:
+		path = r.FullMethod()
+		getHeader = func(key string) []string {
+			return r.RawHeader().RawGet(strings.ToLower(key))
+		}
+	default:
+		return nil
+	}
+
+	for _, rule := range fi.spec.Rules {
+		if rule.Match.matchPath(path) && rule.Match.matchHeaders(getHeader) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (mr *MatchRule) matchPath(path string) bool {
+	if mr.Path == "" && mr.PathPrefix == "" {
+		return true
+	}
+	if mr.Path == path {
+		return true
+	}
+	return mr.PathPrefix != "" && strings.HasPrefix(path, mr.PathPrefix)
+}
+
+func (mr *MatchRule) matchHeaders(getHeader func(key string) []string) bool {
+	if len(mr.Headers) == 0 {
+		return true
+	}
+
+	matchOne := func(key string, sm *stringtool.StringMatcher) bool {
+		values := getHeader(key)
+		if len(values) == 0 {
+			return sm.Empty
+		}
+		if sm.Empty {
+			return false
+		}
+		for _, v := range values {
+			if sm.Match(v) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for key, sm := range mr.Headers {
+		matched := matchOne(key, sm)
+		if matched && !mr.MatchAllHeaders {
+			return true
+		}
+		if !matched && mr.MatchAllHeaders {
+			return false
+		}
+	}
+
+	return mr.MatchAllHeaders
+}
+
+// delayDuration returns the delay duration according to the distribution.
+func (d *DelaySpec) delayDuration() time.Duration {
+	var dur float64
+	mean, jitter := float64(d.duration), float64(d.jitter)
+
+	switch d.Distribution {
+	case distributionUniform:
+		dur = mean - jitter + 2*jitter*fnRandom()
+	case distributionNormal:
+		dur = mean + jitter*rand.NormFloat64()
+	case distributionExponential:
+		dur = -mean * math.Log(1-fnRandom())
+	default: // fixed
+		dur = mean
+	}
+
+	if dur < 0 {
+		return 0
+	}
+	return time.Duration(dur)
+}
+
+func requestContext(req protocols.Request) stdcontext.Context {
+	switch r := req.(type) {
+	case *httpprot.Request:
+		return r.Context()
+	case *grpcprot.Request:
+		return r.Context()
+	}
+	return stdcontext.Background()
+}
+
+func (fi *FaultInjection) delay(ctx *context.Context, spec *DelaySpec) {
+	dur := spec.delayDuration()
+	if dur <= 0 {
+		return
+	}
+
+	ctx.AddTag(fmt.Sprintf("faultInjection: delayed %v", dur))
+
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+
+	select {
+	case <-requestContext(ctx.GetInputRequest()).Done():
+		logger.Debugf("%s: request cancelled in the middle of delay injection", fi.Name())
+	case <-timer.C:
+	}
+}
+
+// httpStatusToGRPCCode maps an HTTP status code to a gRPC status code, see
+// https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func httpStatusToGRPCCode(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
+
+func (fi *FaultInjection) abort(ctx *context.Context, spec *AbortSpec) {
+	if _, ok := ctx.GetInputRequest().(*grpcprot.Request); ok {
+		code := codes.Code(spec.GRPCStatus)
+		if spec.GRPCStatus == 0 {
+			code = httpStatusToGRPCCode(spec.StatusCode)
+		}
+
+		resp := grpcprot.NewResponse()
+		for k, v := range spec.Headers {
+			resp.RawHeader().RawSet(strings.ToLower(k), v)
+		}
+		msg := spec.Body
+		if msg == "" {
+			msg = "fault injected by " + fi.Name()
+		}
+		resp.SetStatus(status.New(code, msg))
+		ctx.SetOutputResponse(resp)
+		return
+	}
+
+	resp, _ := httpprot.NewResponse(nil)
+	for k, v := range spec.Headers {
+		resp.Std().Header.Set(k, v)
+	}
+
+	if spec.GRPCStatus != 0 {
+		// a trailers-only gRPC response.
+		resp.SetStatusCode(http.StatusOK)
+		resp.Std().Header.Set("Content-Type", "application/grpc")
+		resp.Std().Header.Set("Grpc-Status", strconv.Itoa(spec.GRPCStatus))
+		if spec.Body != "" {
+			resp.Std().Header.Set("Grpc-Message", spec.Body)
+		}
+	} else {
+		resp.SetStatusCode(spec.StatusCode)
+		resp.SetPayload([]byte(spec.Body))
+	}
+
+	ctx.SetOutputResponse(resp)
+}
+
+func (fi *FaultInjection) throttle(ctx *context.Context, resp *httpprot.Response, spec *ThrottleSpec) {
+	reqCtx := requestContext(ctx.GetInputRequest())
+	resp.SetPayload(newThrottleReader(reqCtx, resp.GetPayload(), spec.BytesPerSecond))
+	ctx.AddTag(fmt.Sprintf("faultInjection: throttled to %d bytes/s", spec.BytesPerSecond))
+}
+
+// reset sends the response header and the first bytes of the response
+// body, and then resets the connection.
+func (fi *FaultInjection) reset(ctx *context.Context, resp *httpprot.Response, spec *ResetSpec) {
+	stdw, _ := ctx.GetData("HTTP_RESPONSE_WRITER").(http.ResponseWriter)
+	hijacker, ok := stdw.(http.Hijacker)
+	if !ok {
+		// Hijacking is not supported, e.g. HTTP/2, the best we can do is
+		// truncating the body, the client gets an unexpected EOF as the
+		// content length is not changed.
+		resp.SetPayload(newTruncateReader(resp.GetPayload(), spec.AfterBytes))
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		// nothing is written yet, fail the request as the connection
+		// can't be reset.
+		logger.Errorf("%s: failed to hijack connection: %v", fi.Name(), err)
+		errResp, _ := httpprot.NewResponse(nil)
+		errResp.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetOutputResponse(errResp)
+		return
+	}
+
+	// the response is written here, tell HTTPServer not to send it again.
+	metric := setMetric(ctx, resp.StatusCode(), 0)
+
+	// the connection is hijacked, so the response is written in the wire
+	// format. The body is chunked if its length is unknown, the client
+	// gets an unexpected EOF in both cases.
+	header := stdw.Header().Clone()
+	for k, v := range resp.HTTPHeader() {
+		header[k] = v
+	}
+	chunked := header.Get("Content-Length") == ""
+	if chunked {
+		header.Set("Transfer-Encoding", "chunked")
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 %03d %s\r\n", resp.StatusCode(), http.StatusText(resp.StatusCode()))
+	header.Write(rw)
+	rw.WriteString("\r\n")
+	var w io.Writer = rw
+	if chunked {
+		// the chunked writer is not closed to omit the last chunk.
+		w = httputil.NewChunkedWriter(rw)
+	}
+	n, _ := copyN(w, resp.GetPayload(), spec.AfterBytes)
+	metric.RespSize = uint64(n)
+	rw.Flush()
+
+	// set linger to 0 to send a RST instead of a FIN.
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func setMetric(ctx *context.Context, statusCode int, bodySize int64) *httpstat.Metric {
+	metric := &httpstat.Metric{
+		StatusCode: statusCode,
+		RespSize:   uint64(bodySize),
+	}
+	ctx.SetData("HTTP_METRIC", metric)
+	return metric
+}
+
+// Status returns status.
+func (fi *FaultInjection) Status() interface{} {
+	return nil
+}
+
+// Close closes FaultInjection.
+func (fi *FaultInjection) Close() {
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package faultinjection
+
+import (
+	"bufio"
+	stdcontext "context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/grpcprot"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newTestFaultInjection(yamlConfig string, assert *assert.Assertions) *FaultInjection {
+	rawSpec := make(map[string]interface{})
+	err := codectool.Unmarshal([]byte(yamlConfig), &rawSpec)
+	assert.NoError(err)
+
+	spec, err := filters.NewSpec(nil, "", rawSpec)
+	assert.NoError(err)
+
+	fi := kind.CreateInstance(spec).(*FaultInjection)
+	fi.Init()
+
+	assert.Equal(kind, fi.Kind())
+	assert.Equal(spec, fi.Spec())
+	assert.Nil(fi.Status())
+	return fi
+}
+
+func newContext(path string, header http.Header) *context.Context {
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com"+path, nil)
+	for k, v := range header {
+		stdr.Header[k] = v
+	}
+	req, _ := httpprot.NewRequest(stdr)
+
+	ctx := context.New(tracing.NoopSpan)
+	ctx.SetRequest(context.DefaultNamespace, req)
+	return ctx
+}
+
+func TestSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{Rules: []*Rule{{}}}
+	assert.Error(spec.Validate())
+
+	spec.Rules[0].Delay = &DelaySpec{Duration: "invalid"}
+	assert.Error(spec.Validate())
+
+	spec.Rules[0].Delay = &DelaySpec{Duration: "10ms", Jitter: "-1s"}
+	assert.Error(spec.Validate())
+
+	spec.Rules[0].Delay = &DelaySpec{Duration: "10ms", Jitter: "1ms"}
+	assert.NoError(spec.Validate())
+
+	spec.Rules[0].Abort = &AbortSpec{}
+	assert.Error(spec.Validate())
+
+	spec.Rules[0].Abort.GRPCStatus = int(codes.Unavailable)
+	assert.NoError(spec.Validate())
+	assert.False(spec.Rules[0].HasResponseFaults())
+
+	spec.Rules[0].Reset = &ResetSpec{}
+	assert.True(spec.Rules[0].HasResponseFaults())
+}
+
+func TestDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+kind: FaultInjection
+name: fi
+rules:
+- match:
+    pathPrefix: /delay
+  delay:
+    duration: 50ms
+`
+	fi := newTestFaultInjection(yamlConfig, assert)
+	defer fi.Close()
+
+	start := time.Now()
+	assert.Equal("", fi.Handle(newContext("/delay", nil)))
+	assert.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+
+	start = time.Now()
+	assert.Equal("", fi.Handle(newContext("/other", nil)))
+	assert.Less(time.Since(start), 50*time.Millisecond)
+
+	// cancelled request.
+	ctx := newContext("/delay", nil)
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	stdctx, cancel := stdcontext.WithCancel(req.Context())
+	req.SetContext(stdctx)
+	cancel()
+	start = time.Now()
+	fi.Handle(ctx)
+	assert.Less(time.Since(start), 50*time.Millisecond)
+}
+
+func TestDelayDistribution(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func() { fnRandom = rand.Float64 }()
+	fnRandom = func() float64 { return 0 }
+
+	d := &DelaySpec{duration: 100 * time.Millisecond, jitter: 20 * time.Millisecond}
+	assert.Equal(100*time.Millisecond, d.delayDuration())
+
+	d.Distribution = distributionUniform
+	assert.Equal(80*time.Millisecond, d.delayDuration())
+
+	d.Distribution = distributionExponential
+	assert.Equal(time.Duration(0), d.delayDuration())
+
+	d.Distribution = distributionNormal
+	assert.GreaterOrEqual(d.delayDuration(), time.Duration(0))
+}
+
+func TestAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+kind: FaultInjection
+name: fi
+rules:
+- match:
+    headers:
+      X-Fault:
+        exact: abort
+  abort:
+    statusCode: 503
+    headers:
+      X-Fault-Injected: "true"
+    body: injected
+- match:
+    path: /grpc
+  abort:
+    grpcStatus: 14
+    body: unavailable
+- match:
+    path: /never
+  abort:
+    percentage: 0
+    statusCode: 500
+`
+	fi := newTestFaultInjection(yamlConfig, assert)
+
+	ctx := newContext("/", http.Header{"X-Fault": []string{"abort"}})
+	assert.Equal(resultAborted, fi.Handle(ctx))
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode())
+	assert.Equal("true", resp.HTTPHeader().Get("X-Fault-Injected"))
+	assert.Equal("injected", string(resp.RawPayload()))
+
+	ctx = newContext("/", nil)
+	assert.Equal("", fi.Handle(ctx))
+	assert.Nil(ctx.GetOutputResponse())
+
+	ctx = newContext("/grpc", nil)
+	assert.Equal(resultAborted, fi.Handle(ctx))
+	resp = ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusOK, resp.StatusCode())
+	assert.Equal("14", resp.HTTPHeader().Get("Grpc-Status"))
+	assert.Equal("unavailable", resp.HTTPHeader().Get("Grpc-Message"))
+
+	ctx = newContext("/never", nil)
+	assert.Equal("", fi.Handle(ctx))
+
+	// gRPC requests
+	greq := grpcprot.NewRequestWithContext(stdcontext.Background())
+	greq.SetFullMethod("/grpc")
+	ctx = context.New(tracing.NoopSpan)
+	ctx.SetRequest(context.DefaultNamespace, greq)
+	assert.Equal(resultAborted, fi.Handle(ctx))
+	gresp := ctx.GetOutputResponse().(*grpcprot.Response)
+	assert.Equal(codes.Unavailable, gresp.GetStatus().Code())
+	assert.Equal("unavailable", gresp.GetStatus().Message())
+
+	greq = grpcprot.NewRequestWithContext(stdcontext.Background())
+	greq.RawHeader().RawSet("x-fault", "abort")
+	ctx = context.New(tracing.NoopSpan)
+	ctx.SetRequest(context.DefaultNamespace, greq)
+	assert.Equal(resultAborted, fi.Handle(ctx))
+	gresp = ctx.GetOutputResponse().(*grpcprot.Response)
+	assert.Equal(codes.Unavailable, gresp.GetStatus().Code())
+	assert.Equal("true", gresp.RawHeader().GetFirst("x-fault-injected"))
+}
+
+func TestThrottle(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+kind: FaultInjection
+name: fi
+rules:
+- throttle:
+    bytesPerSecond: 1000
+`
+	fi := newTestFaultInjection(yamlConfig, assert)
+
+	// no response, throttle is not injected.
+	ctx := newContext("/", nil)
+	assert.Equal("", fi.Handle(ctx))
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetPayload(strings.Repeat("a", 300))
+	ctx.SetOutputResponse(resp)
+	assert.Equal("", fi.Handle(ctx))
+
+	start := time.Now()
+	data, err := io.ReadAll(resp.GetPayload())
+	assert.NoError(err)
+	assert.Len(data, 300)
+	assert.GreaterOrEqual(time.Since(start), 200*time.Millisecond)
+}
+
+func TestReset(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+kind: FaultInjection
+name: fi
+rules:
+- reset:
+    afterBytes: 5
+`
+	fi := newTestFaultInjection(yamlConfig, assert)
+
+	var result string
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := httpprot.NewRequest(r)
+		ctx := context.New(tracing.NoopSpan)
+		ctx.SetRequest(context.DefaultNamespace, req)
+		ctx.SetData("HTTP_RESPONSE_WRITER", w)
+
+		resp, _ := httpprot.NewResponse(nil)
+		if r.URL.Query().Get("chunked") == "" {
+			resp.HTTPHeader().Set("Content-Length", "11")
+		}
+		resp.SetPayload("hello world")
+		ctx.SetOutputResponse(resp)
+
+		result = fi.Handle(ctx)
+		assert.NotNil(ctx.GetData("HTTP_METRIC"))
+	}))
+	defer svr.Close()
+
+	for _, url := range []string{svr.URL, svr.URL + "?chunked=1"} {
+		resp, err := http.Get(url)
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		data, err := io.ReadAll(resp.Body)
+		assert.Equal("hello", string(data))
+		assert.Error(err)
+		resp.Body.Close()
+		assert.Equal(resultAborted, result)
+	}
+
+	// hijacking is not supported, the body is truncated.
+	ctx := newContext("/", nil)
+	r, _ := httpprot.NewResponse(nil)
+	r.SetPayload("hello world")
+	ctx.SetOutputResponse(r)
+	assert.Equal(resultAborted, fi.Handle(ctx))
+	data, err := io.ReadAll(r.GetPayload())
+	assert.Equal("hello", string(data))
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+
+	// hijacking fails, the response is replaced by an error.
+	w := &failedHijacker{ResponseRecorder: httptest.NewRecorder()}
+	ctx = newContext("/", nil)
+	ctx.SetData("HTTP_RESPONSE_WRITER", w)
+	r, _ = httpprot.NewResponse(nil)
+	r.SetPayload("hello world")
+	ctx.SetOutputResponse(r)
+	assert.Equal(resultAborted, fi.Handle(ctx))
+	assert.Nil(ctx.GetData("HTTP_METRIC"))
+	assert.Equal(http.StatusInternalServerError, ctx.GetOutputResponse().(*httpprot.Response).StatusCode())
+	assert.Equal(0, w.Body.Len())
+}
+
+type failedHijacker struct {
+	*httptest.ResponseRecorder
+}
+
+func (h *failedHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package faultinjection
+
+import (
+	stdcontext "context"
+	"io"
+	"time"
+)
+
+// throttleInterval is the interval of the throttle reader to release data.
+const throttleInterval = 100 * time.Millisecond
+
+// throttleReader limits the reading speed of the underlying reader.
+type throttleReader struct {
+	ctx            stdcontext.Context
+	r              io.Reader
+	bytesPerSecond int64
+
+	start time.Time
+	read  int64
+}
+
+func newThrottleReader(ctx stdcontext.Context, r io.Reader, bytesPerSecond int64) *throttleReader {
+	return &throttleReader{
+		ctx:            ctx,
+		r:              r,
+		bytesPerSecond: bytesPerSecond,
+	}
+}
+
+func (tr *throttleReader) Read(p []byte) (int, error) {
+	if tr.start.IsZero() {
+		tr.start = time.Now()
+	}
+
+	// read at most the data of one interval at a time, so that the data is
+	// sent smoothly.
+	chunk := tr.bytesPerSecond * int64(throttleInterval) / int64(time.Second)
+	if chunk <= 0 {
+		chunk = 1
+	}
+	if int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+
+	// wait until the data read so far is allowed by the speed limit.
+	expected := time.Duration(tr.read * int64(time.Second) / tr.bytesPerSecond)
+	if wait := expected - time.Since(tr.start); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-tr.ctx.Done():
+			timer.Stop()
+			return 0, tr.ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	n, err := tr.r.Read(p)
+	tr.read += int64(n)
+	return n, err
+}
+
+// Close closes the underlying reader if it is an io.Closer.
+func (tr *throttleReader) Close() error {
+	if c, ok := tr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// truncateReader returns io.ErrUnexpectedEOF after n bytes are read.
+type truncateReader struct {
+	r io.Reader
+	n int64
+}
+
+func newTruncateReader(r io.Reader, n int64) *truncateReader {
+	return &truncateReader{r: r, n: n}
+}
+
+func (tr *truncateReader) Read(p []byte) (int, error) {
+	if tr.n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > tr.n {
+		p = p[:tr.n]
+	}
+	n, err := tr.r.Read(p)
+	tr.n -= int64(n)
+	return n, err
+}
+
+// Close closes the underlying reader if it is an io.Closer.
+func (tr *truncateReader) Close() error {
+	if c, ok := tr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// copyN is like io.CopyN, but it does not return io.EOF when the source
+// has less than n bytes.
+func copyN(w io.Writer, r io.Reader, n int64) (int64, error) {
+	written, err := io.CopyN(w, r, n)
+	if err == io.EOF {
+		err = nil
+	}
+	return written, err
+}
@@ -0,0 +1,308 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpctranscoder
+
+import (
+	stdcontext "context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type (
+	// descriptors holds the protobuf descriptors of the services and the
+	// bindings of their methods.
+	descriptors struct {
+		files    *protoregistry.Files
+		types    *typeResolver
+		bindings []*binding
+	}
+
+	// fileResolver resolves the descriptors from the files, and then the
+	// global registry, so the descriptor sets need not to include the
+	// well known files.
+	fileResolver struct {
+		files *protoregistry.Files
+	}
+
+	// typeResolver resolves the message types for google.protobuf.Any
+	// from the files, and then the global registry.
+	typeResolver struct {
+		*protoregistry.Types
+	}
+)
+
+func (r fileResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r fileResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
+
+func (r *typeResolver) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	if mt, err := r.Types.FindMessageByName(name); err == nil {
+		return mt, nil
+	}
+	return protoregistry.GlobalTypes.FindMessageByName(name)
+}
+
+func (r *typeResolver) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	if mt, err := r.Types.FindMessageByURL(url); err == nil {
+		return mt, nil
+	}
+	return protoregistry.GlobalTypes.FindMessageByURL(url)
+}
+
+func (r *typeResolver) FindExtensionByName(name protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByName(name)
+}
+
+func (r *typeResolver) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+}
+
+// parseDescriptorSet parses a FileDescriptorSet in binary format, which
+// could be base64 encoded.
+func parseDescriptorSet(data []byte) (*descriptors, error) {
+	if decoded, err := base64.StdEncoding.DecodeString(string(data)); err == nil {
+		data = decoded
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("invalid file descriptor set: %v", err)
+	}
+	return newDescriptors(set.File)
+}
+
+// newDescriptors builds the descriptors from the files, and binds all
+// the methods of the services in them, except the client streaming ones.
+func newDescriptors(fdps []*descriptorpb.FileDescriptorProto) (*descriptors, error) {
+	d := &descriptors{
+		files: &protoregistry.Files{},
+		types: &typeResolver{Types: &protoregistry.Types{}},
+	}
+
+	byName := make(map[string]*descriptorpb.FileDescriptorProto, len(fdps))
+	for _, fdp := range fdps {
+		byName[fdp.GetName()] = fdp
+	}
+
+	var build func(name string, visiting map[string]bool) error
+	build = func(name string, visiting map[string]bool) error {
+		if _, err := d.files.FindFileByPath(name); err == nil {
+			return nil
+		}
+		fdp := byName[name]
+		if fdp == nil {
+			if _, err := protoregistry.GlobalFiles.FindFileByPath(name); err == nil {
+				return nil
+			}
+			return fmt.Errorf("file %s not found", name)
+		}
+		if visiting[name] {
+			return fmt.Errorf("import cycle in file %s", name)
+		}
+		visiting[name] = true
+
+		for _, dep := range fdp.GetDependency() {
+			if err := build(dep, visiting); err != nil {
+				return err
+			}
+		}
+		fd, err := protodesc.NewFile(fdp, fileResolver{d.files})
+		if err != nil {
+			return fmt.Errorf("file %s: %v", name, err)
+		}
+		return d.files.RegisterFile(fd)
+	}
+
+	for _, fdp := range fdps {
+		if err := build(fdp.GetName(), map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+
+	// bind the methods in the order of the files to make it deterministic.
+	for _, fdp := range fdps {
+		fd, _ := d.files.FindFileByPath(fdp.GetName())
+		registerMessages(d.types.Types, fd.Messages())
+
+		services := fd.Services()
+		for i := 0; i < services.Len(); i++ {
+			methods := services.Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				if err := d.bindMethod(methods.Get(j)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	sortBindings(d.bindings)
+	return d, nil
+}
+
+func registerMessages(types *protoregistry.Types, messages protoreflect.MessageDescriptors) {
+	for i := 0; i < messages.Len(); i++ {
+		md := messages.Get(i)
+		if md.IsMapEntry() {
+			continue
+		}
+		// conflicts are ignored, the first one wins.
+		types.RegisterMessage(dynamicpb.NewMessageType(md))
+		registerMessages(types, md.Messages())
+	}
+}
+
+func (d *descriptors) bindMethod(method protoreflect.MethodDescriptor) error {
+	// there's no way to map an HTTP request to a stream of messages.
+	if method.IsStreamingClient() {
+		return nil
+	}
+
+	var rule *annotations.HttpRule
+	if opts, ok := method.Options().(*descriptorpb.MethodOptions); ok && proto.HasExtension(opts, annotations.E_Http) {
+		rule = proto.GetExtension(opts, annotations.E_Http).(*annotations.HttpRule)
+	}
+
+	bindings, err := newBindings(method, rule)
+	if err != nil {
+		return err
+	}
+	d.bindings = append(d.bindings, bindings...)
+	return nil
+}
+
+// loadFromReflection loads the descriptors of the services from the gRPC
+// server reflection service.
+func loadFromReflection(ctx stdcontext.Context, conn *grpc.ClientConn) (*descriptors, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	call := func(req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, fmt.Errorf("reflection error %d: %s", e.ErrorCode, e.ErrorMessage)
+		}
+		return resp, nil
+	}
+
+	fdps := map[string]*descriptorpb.FileDescriptorProto{}
+	addFiles := func(resp *rpb.ServerReflectionResponse) error {
+		for _, data := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fdp := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(data, fdp); err != nil {
+				return fmt.Errorf("invalid file descriptor: %v", err)
+			}
+			fdps[fdp.GetName()] = fdp
+		}
+		return nil
+	}
+
+	resp, err := call(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		if svc.Name == "grpc.reflection.v1alpha.ServerReflection" || svc.Name == "grpc.reflection.v1.ServerReflection" {
+			continue
+		}
+		resp, err = call(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc.Name},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("get file of service %s: %v", svc.Name, err)
+		}
+		if err = addFiles(resp); err != nil {
+			return nil, err
+		}
+	}
+
+	// fetch the dependencies which are not returned by the server.
+	for {
+		var missing []string
+		for _, fdp := range fdps {
+			for _, dep := range fdp.GetDependency() {
+				if fdps[dep] != nil {
+					continue
+				}
+				if _, err := protoregistry.GlobalFiles.FindFileByPath(dep); err == nil {
+					continue
+				}
+				missing = append(missing, dep)
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		for _, name := range missing {
+			resp, err = call(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+			})
+			if err != nil {
+				return nil, fmt.Errorf("get file %s: %v", name, err)
+			}
+			if err = addFiles(resp); err != nil {
+				return nil, err
+			}
+			if fdps[name] == nil {
+				return nil, fmt.Errorf("file %s not returned", name)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(fdps))
+	for name := range fdps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*descriptorpb.FileDescriptorProto, 0, len(fdps))
+	for _, name := range names {
+		files = append(files, fdps[name])
+	}
+	return newDescriptors(files)
+}
@@ -0,0 +1,525 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package grpctranscoder provides the GRPCTranscoder filter, which
+// transcodes HTTP/JSON requests to gRPC requests.
+package grpctranscoder
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/cluster/customdata"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/filters/proxies/grpcproxy"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// Kind is the kind of GRPCTranscoder.
+	Kind = "GRPCTranscoder"
+
+	resultNotFound       = "notFound"
+	resultInvalidRequest = "invalidRequest"
+	resultGRPCError      = "grpcError"
+
+	// metadataHeaderPrefix is the prefix of the response headers which
+	// are converted from the gRPC response metadata.
+	metadataHeaderPrefix = "Grpc-Metadata-"
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "GRPCTranscoder transcodes HTTP/JSON requests to gRPC requests.",
+	Results:     []string{resultNotFound, resultInvalidRequest, resultGRPCError},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &GRPCTranscoder{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+// skippedHeaders are the request headers which are not forwarded to the
+// gRPC server as metadata.
+var skippedHeaders = map[string]bool{
+	"host":              true,
+	"connection":        true,
+	"content-length":    true,
+	"content-type":      true,
+	"accept-encoding":   true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"te":                true,
+	"trailer":           true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+type (
+	// GRPCTranscoder is filter GRPCTranscoder.
+	GRPCTranscoder struct {
+		spec *Spec
+
+		conn        *grpc.ClientConn
+		timeout     time.Duration
+		marshalOpts protojson.MarshalOptions
+		descriptors atomic.Value
+		cluster     cluster.Cluster
+		stopCtx     stdcontext.Context
+		cancel      stdcontext.CancelFunc
+	}
+
+	// Spec describes the GRPCTranscoder.
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+
+		// Endpoint is the address of the gRPC server, e.g. 127.0.0.1:9090.
+		Endpoint string             `json:"endpoint" jsonschema:"required"`
+		TLS      *grpcproxy.TLSSpec `json:"tls,omitempty" jsonschema:"omitempty"`
+		Timeout  string             `json:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+
+		// DescriptorSet is the base64 encoded FileDescriptorSet of the
+		// services, which is generated by protoc with --include_imports
+		// and --descriptor_set_out.
+		DescriptorSet string `json:"descriptorSet,omitempty" jsonschema:"omitempty,format=base64"`
+		// DescriptorFile is the path of the FileDescriptorSet file.
+		DescriptorFile string `json:"descriptorFile,omitempty" jsonschema:"omitempty"`
+		// CustomData refers to the custom data which holds the base64
+		// encoded FileDescriptorSet.
+		CustomData *CustomDataRef `json:"customData,omitempty" jsonschema:"omitempty"`
+		// Reflection loads the descriptors from the gRPC server reflection
+		// service of the endpoint.
+		Reflection bool `json:"reflection,omitempty" jsonschema:"omitempty"`
+
+		// UseProtoNames uses the proto field names instead of the lower
+		// camel case names in the response JSON.
+		UseProtoNames bool `json:"useProtoNames,omitempty" jsonschema:"omitempty"`
+		// EmitUnpopulated emits the fields with zero values in the
+		// response JSON.
+		EmitUnpopulated bool `json:"emitUnpopulated,omitempty" jsonschema:"omitempty"`
+	}
+
+	// CustomDataRef refers to a custom data.
+	CustomDataRef struct {
+		Kind string `json:"kind" jsonschema:"required"`
+		ID   string `json:"id" jsonschema:"required"`
+		// Field is the field which holds the descriptor set.
+		Field string `json:"field" jsonschema:"required"`
+	}
+)
+
+var _ filters.Filter = (*GRPCTranscoder)(nil)
+
+// Validate validates the Spec.
+func (s *Spec) Validate() error {
+	sources := 0
+	for _, ok := range []bool{s.DescriptorSet != "", s.DescriptorFile != "", s.CustomData != nil, s.Reflection} {
+		if ok {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("one and only one of descriptorSet, descriptorFile, customData and reflection must be specified")
+	}
+
+	if s.Timeout != "" {
+		if _, err := time.ParseDuration(s.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		}
+	}
+	if s.TLS != nil {
+		if err := s.TLS.Validate(); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+	if s.DescriptorSet != "" {
+		if _, err := parseDescriptorSet([]byte(s.DescriptorSet)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the GRPCTranscoder filter instance.
+func (t *GRPCTranscoder) Name() string {
+	return t.spec.Name()
+}
+
+// Kind returns the kind of GRPCTranscoder.
+func (t *GRPCTranscoder) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the GRPCTranscoder
+func (t *GRPCTranscoder) Spec() filters.Spec {
+	return t.spec
+}
+
+// Init initializes GRPCTranscoder.
+func (t *GRPCTranscoder) Init() {
+	t.reload()
+}
+
+// Inherit inherits previous generation of GRPCTranscoder.
+func (t *GRPCTranscoder) Inherit(previousGeneration filters.Filter) {
+	t.reload()
+	previousGeneration.Close()
+}
+
+func (t *GRPCTranscoder) reload() {
+	spec := t.spec
+	t.stopCtx, t.cancel = stdcontext.WithCancel(stdcontext.Background())
+
+	if spec.Timeout != "" {
+		t.timeout, _ = time.ParseDuration(spec.Timeout)
+	}
+	t.marshalOpts = protojson.MarshalOptions{
+		UseProtoNames:   spec.UseProtoNames,
+		EmitUnpopulated: spec.EmitUnpopulated,
+	}
+
+	creds := insecure.NewCredentials()
+	if spec.TLS != nil {
+		// the spec is validated, so the error is ignored.
+		tlsConf, _ := spec.TLS.TLSConfig()
+		creds = credentials.NewTLS(tlsConf)
+	}
+	// the connection is established in background.
+	conn, err := grpc.Dial(spec.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		logger.Errorf("%s: dial %s failed: %v", t.Name(), spec.Endpoint, err)
+		return
+	}
+	t.conn = conn
+
+	switch {
+	case spec.DescriptorSet != "":
+		t.loadDescriptors("descriptorSet", []byte(spec.DescriptorSet))
+	case spec.DescriptorFile != "":
+		data, err := os.ReadFile(spec.DescriptorFile)
+		if err != nil {
+			logger.Errorf("%s: read descriptor file failed: %v", t.Name(), err)
+			return
+		}
+		t.loadDescriptors("descriptorFile", data)
+	case spec.CustomData != nil:
+		if t.cluster == nil && spec.Super() != nil {
+			t.cluster = spec.Super().Cluster()
+		}
+		if t.cluster == nil {
+			logger.Errorf("%s: cluster is not available to load the custom data", t.Name())
+			return
+		}
+		go t.watchCustomData()
+	case spec.Reflection:
+		go t.loadFromReflection()
+	}
+}
+
+func (t *GRPCTranscoder) loadDescriptors(source string, data []byte) {
+	d, err := parseDescriptorSet(data)
+	if err != nil {
+		logger.Errorf("%s: load descriptors from %s failed: %v", t.Name(), source, err)
+		return
+	}
+	logger.Infof("%s: %d methods bindings loaded from %s", t.Name(), len(d.bindings), source)
+	t.descriptors.Store(d)
+}
+
+// loadFromReflection loads the descriptors from the server reflection
+// service, and retries until succeeded.
+func (t *GRPCTranscoder) loadFromReflection() {
+	for {
+		ctx, cancel := stdcontext.WithTimeout(t.stopCtx, 10*time.Second)
+		d, err := loadFromReflection(ctx, t.conn)
+		cancel()
+		if err == nil {
+			logger.Infof("%s: %d methods bindings loaded from server reflection", t.Name(), len(d.bindings))
+			t.descriptors.Store(d)
+			return
+		}
+		logger.Errorf("%s: load descriptors from server reflection failed: %v", t.Name(), err)
+
+		select {
+		case <-time.After(10 * time.Second):
+		case <-t.stopCtx.Done():
+			return
+		}
+	}
+}
+
+// watchCustomData loads the descriptors from the custom data, and reloads
+// them on changes.
+func (t *GRPCTranscoder) watchCustomData() {
+	ref := t.spec.CustomData
+	layout := t.cluster.Layout()
+	store := customdata.NewStore(t.cluster, layout.CustomDataKindPrefix(), layout.CustomDataPrefix())
+	key := store.DataKey(ref.Kind, ref.ID)
+
+	var (
+		syncer cluster.Syncer
+		err    error
+		ch     <-chan *string
+	)
+
+	for {
+		syncer, err = t.cluster.Syncer(10 * time.Minute)
+		if err != nil {
+			logger.Errorf("%s: failed to create syncer: %v", t.Name(), err)
+		} else if ch, err = syncer.Sync(key); err != nil {
+			logger.Errorf("%s: failed to sync custom data %s: %v", t.Name(), key, err)
+			syncer.Close()
+		} else {
+			break
+		}
+
+		select {
+		case <-time.After(10 * time.Second):
+		case <-t.stopCtx.Done():
+			return
+		}
+	}
+
+	defer syncer.Close()
+	for {
+		select {
+		case <-t.stopCtx.Done():
+			return
+		case value := <-ch:
+			if value == nil {
+				logger.Errorf("%s: custom data %s/%s not found", t.Name(), ref.Kind, ref.ID)
+				continue
+			}
+			data := customdata.Data{}
+			if err := codectool.Unmarshal([]byte(*value), &data); err != nil {
+				logger.Errorf("%s: parse custom data %s/%s failed: %v", t.Name(), ref.Kind, ref.ID, err)
+				continue
+			}
+			set, ok := data[ref.Field].(string)
+			if !ok {
+				logger.Errorf("%s: field %s of custom data %s/%s is not a string", t.Name(), ref.Field, ref.Kind, ref.ID)
+				continue
+			}
+			t.loadDescriptors(fmt.Sprintf("custom data %s/%s", ref.Kind, ref.ID), []byte(set))
+		}
+	}
+}
+
+// Handle transcodes the HTTP request in the context to a gRPC request,
+// calls the gRPC server, and transcodes the response back.
+func (t *GRPCTranscoder) Handle(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+
+	d, _ := t.descriptors.Load().(*descriptors)
+	if d == nil {
+		st := status.New(codes.Unavailable, "the protobuf descriptors are not loaded")
+		return t.errorResponse(ctx, d, st, resultGRPCError)
+	}
+
+	b, pathValues := findBinding(d.bindings, req.Method(), req.Std().URL.EscapedPath())
+	if b == nil {
+		st := status.New(codes.NotFound, "no method matches the request")
+		return t.errorResponse(ctx, d, st, resultNotFound)
+	}
+
+	body, err := io.ReadAll(req.GetPayload())
+	if err != nil {
+		st := status.Newf(codes.InvalidArgument, "read body failed: %v", err)
+		return t.errorResponse(ctx, d, st, resultInvalidRequest)
+	}
+	msg, err := d.newRequestMessage(b, pathValues, req.Std().URL.Query(), body)
+	if err != nil {
+		st := status.New(codes.InvalidArgument, err.Error())
+		return t.errorResponse(ctx, d, st, resultInvalidRequest)
+	}
+
+	var (
+		callCtx stdcontext.Context
+		cancel  stdcontext.CancelFunc
+	)
+	if t.timeout > 0 {
+		callCtx, cancel = stdcontext.WithTimeout(req.Context(), t.timeout)
+	} else {
+		callCtx, cancel = stdcontext.WithCancel(req.Context())
+	}
+	callCtx = metadata.NewOutgoingContext(callCtx, requestMetadata(req.HTTPHeader()))
+
+	fullMethod := fmt.Sprintf("/%s/%s", b.method.Parent().FullName(), b.method.Name())
+	if b.method.IsStreamingServer() {
+		return t.handleServerStreaming(ctx, d, b, callCtx, cancel, fullMethod, msg)
+	}
+	defer cancel()
+
+	var header metadata.MD
+	out := dynamicpb.NewMessage(b.method.Output())
+	if err = t.conn.Invoke(callCtx, fullMethod, msg, out, grpc.Header(&header)); err != nil {
+		return t.errorResponse(ctx, d, status.Convert(err), resultGRPCError)
+	}
+
+	data, err := d.marshalResponse(b, out, t.marshalOpts)
+	if err != nil {
+		st := status.Newf(codes.Internal, "marshal response failed: %v", err)
+		return t.errorResponse(ctx, d, st, resultGRPCError)
+	}
+
+	resp := outputResponse(ctx)
+	setResponseMetadata(resp, header)
+	resp.HTTPHeader().Set("Content-Type", "application/json")
+	resp.SetStatusCode(http.StatusOK)
+	resp.SetPayload(data)
+	return ""
+}
+
+func (t *GRPCTranscoder) handleServerStreaming(ctx *context.Context, d *descriptors, b *binding,
+	callCtx stdcontext.Context, cancel stdcontext.CancelFunc, fullMethod string, msg *dynamicpb.Message) string {
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	stream, err := t.conn.NewStream(callCtx, desc, fullMethod)
+	if err == nil {
+		err = stream.SendMsg(msg)
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err != nil {
+		cancel()
+		return t.errorResponse(ctx, d, status.Convert(err), resultGRPCError)
+	}
+
+	// receive the first message before sending the response header, so
+	// that the errors of the call are returned with proper status codes.
+	r := &streamReader{d: d, b: b, stream: stream, opts: t.marshalOpts, cancel: cancel}
+	first := dynamicpb.NewMessage(b.method.Output())
+	err = stream.RecvMsg(first)
+	if err == io.EOF {
+		r.done = true
+	} else if err != nil {
+		cancel()
+		return t.errorResponse(ctx, d, status.Convert(err), resultGRPCError)
+	} else if r.buf, err = d.marshalResponse(b, first, t.marshalOpts); err != nil {
+		cancel()
+		st := status.Newf(codes.Internal, "marshal response failed: %v", err)
+		return t.errorResponse(ctx, d, st, resultGRPCError)
+	} else {
+		r.buf = append(r.buf, '\n')
+	}
+
+	// the call is canceled when the request is finished.
+	ctx.OnFinish(cancel)
+	if stdw, ok := ctx.GetData("HTTP_RESPONSE_WRITER").(http.ResponseWriter); ok {
+		r.flusher, _ = stdw.(http.Flusher)
+	}
+
+	header, _ := stream.Header()
+	resp := outputResponse(ctx)
+	setResponseMetadata(resp, header)
+	resp.HTTPHeader().Set("Content-Type", "application/x-ndjson")
+	resp.SetStatusCode(http.StatusOK)
+	resp.SetPayload(r)
+	return ""
+}
+
+func (t *GRPCTranscoder) errorResponse(ctx *context.Context, d *descriptors, st *status.Status, result string) string {
+	resp := outputResponse(ctx)
+	resp.HTTPHeader().Set("Content-Type", "application/json")
+	resp.SetStatusCode(httpStatusFromCode(st.Code()))
+	resp.SetPayload(d.marshalStatus(st))
+
+	ctx.AddTag(fmt.Sprintf("grpcTranscoder: %s: %s", st.Code(), st.Message()))
+	return result
+}
+
+func outputResponse(ctx *context.Context) *httpprot.Response {
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil {
+		resp, _ = httpprot.NewResponse(nil)
+		ctx.SetOutputResponse(resp)
+	}
+	return resp
+}
+
+// requestMetadata converts the request headers to gRPC metadata.
+func requestMetadata(header http.Header) metadata.MD {
+	md := metadata.MD{}
+	for k, values := range header {
+		k = strings.ToLower(k)
+		if skippedHeaders[k] || strings.HasPrefix(k, "grpc-") || !validMetadataKey(k) {
+			continue
+		}
+		md[k] = values
+	}
+	return md
+}
+
+// validMetadataKey checks the key of gRPC metadata, only 0-9 a-z - _ .
+// are allowed.
+func validMetadataKey(k string) bool {
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '_' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// setResponseMetadata converts the gRPC response metadata to headers.
+func setResponseMetadata(resp *httpprot.Response, md metadata.MD) {
+	for k, values := range md {
+		if k == "content-type" || strings.HasPrefix(k, "grpc-") {
+			continue
+		}
+		for _, v := range values {
+			resp.HTTPHeader().Add(metadataHeaderPrefix+k, v)
+		}
+	}
+}
+
+// Status returns status.
+func (t *GRPCTranscoder) Status() interface{} { return nil }
+
+// Close closes GRPCTranscoder.
+func (t *GRPCTranscoder) Close() {
+	if t.cancel != nil {
+		t.cancel()
+	}
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
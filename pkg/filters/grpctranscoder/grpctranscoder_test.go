@@ -0,0 +1,600 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpctranscoder
+
+import (
+	stdcontext "context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+// testFile is the descriptor of:
+//
+//	syntax = "proto3";
+//	package test;
+//	import "google/api/annotations.proto";
+//
+//	message Inner { string value = 1; }
+//	enum Level { LOW = 0; HIGH = 1; }
+//	message EchoRequest {
+//	  string name = 1;
+//	  int32 count = 2;
+//	  repeated string tags = 3;
+//	  Inner inner = 4;
+//	  Level level = 5;
+//	}
+//	message EchoResponse {
+//	  string message = 1;
+//	  Inner inner = 2;
+//	}
+//	service Echo {
+//	  rpc Get(EchoRequest) returns (EchoResponse) {
+//	    option (google.api.http) = {
+//	      get: "/v1/echo/{name}"
+//	      additional_bindings { get: "/v1/echo/{inner.value}/inner" }
+//	    };
+//	  }
+//	  rpc Create(EchoRequest) returns (EchoResponse) {
+//	    option (google.api.http) = {
+//	      post: "/v1/echo" body: "inner" response_body: "inner"
+//	    };
+//	  }
+//	  rpc List(EchoRequest) returns (stream EchoResponse) {
+//	    option (google.api.http) = { get: "/v1/echo/{name}:list" };
+//	  }
+//	  rpc Fail(EchoRequest) returns (EchoResponse);
+//	  rpc Upload(stream EchoRequest) returns (EchoResponse);
+//	}
+func testFile() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string, repeated bool) *descriptorpb.FieldDescriptorProto {
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     typ.Enum(),
+			Label:    label.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	method := func(name string, rule *annotations.HttpRule, clientStreaming, serverStreaming bool) *descriptorpb.MethodDescriptorProto {
+		m := &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(name),
+			InputType:       proto.String(".test.EchoRequest"),
+			OutputType:      proto.String(".test.EchoResponse"),
+			ClientStreaming: proto.Bool(clientStreaming),
+			ServerStreaming: proto.Bool(serverStreaming),
+		}
+		if rule != nil {
+			m.Options = &descriptorpb.MethodOptions{}
+			proto.SetExtension(m.Options, annotations.E_Http, rule)
+		}
+		return m
+	}
+
+	const (
+		typeString  = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		typeInt32   = descriptorpb.FieldDescriptorProto_TYPE_INT32
+		typeMessage = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+		typeEnum    = descriptorpb.FieldDescriptorProto_TYPE_ENUM
+	)
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test/echo.proto"),
+		Package:    proto.String("test"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/api/annotations.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name:  proto.String("Inner"),
+			Field: []*descriptorpb.FieldDescriptorProto{field("value", 1, typeString, "", false)},
+		}, {
+			Name: proto.String("EchoRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, typeString, "", false),
+				field("count", 2, typeInt32, "", false),
+				field("tags", 3, typeString, "", true),
+				field("inner", 4, typeMessage, ".test.Inner", false),
+				field("level", 5, typeEnum, ".test.Level", false),
+			},
+		}, {
+			Name: proto.String("EchoResponse"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("message", 1, typeString, "", false),
+				field("inner", 2, typeMessage, ".test.Inner", false),
+			},
+		}},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Level"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("LOW"), Number: proto.Int32(0)},
+				{Name: proto.String("HIGH"), Number: proto.Int32(1)},
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("Get", &annotations.HttpRule{
+					Pattern: &annotations.HttpRule_Get{Get: "/v1/echo/{name}"},
+					AdditionalBindings: []*annotations.HttpRule{{
+						Pattern: &annotations.HttpRule_Get{Get: "/v1/echo/{inner.value}/inner"},
+					}},
+				}, false, false),
+				method("Create", &annotations.HttpRule{
+					Pattern:      &annotations.HttpRule_Post{Post: "/v1/echo"},
+					Body:         "inner",
+					ResponseBody: "inner",
+				}, false, false),
+				method("List", &annotations.HttpRule{
+					Pattern: &annotations.HttpRule_Get{Get: "/v1/echo/{name}:list"},
+				}, false, true),
+				method("Fail", nil, false, false),
+				method("Upload", nil, true, false),
+			},
+		}},
+	}
+}
+
+func testDescriptorSet(assert *assert.Assertions) string {
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{testFile()}})
+	assert.NoError(err)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// startTestServer starts a gRPC server which implements the Echo service
+// and the server reflection service.
+func startTestServer(assert *assert.Assertions) (*grpc.Server, string) {
+	files := &protoregistry.Files{}
+	fd, err := protodesc.NewFile(testFile(), fileResolver{files})
+	assert.NoError(err)
+	assert.NoError(files.RegisterFile(fd))
+
+	svc := fd.Services().Get(0)
+	input, output := svc.Methods().Get(0).Input(), svc.Methods().Get(0).Output()
+	str := func(m protoreflect.Message, name string) string {
+		return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name))).String()
+	}
+	newResponse := func(message string, inner protoreflect.Value) *dynamicpb.Message {
+		resp := dynamicpb.NewMessage(output)
+		resp.Set(output.Fields().ByName("message"), protoreflect.ValueOfString(message))
+		if inner.IsValid() {
+			resp.Set(output.Fields().ByName("inner"), inner)
+		}
+		return resp
+	}
+
+	unary := func(fn func(ctx stdcontext.Context, req *dynamicpb.Message) (*dynamicpb.Message, error)) func(interface{}, stdcontext.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+		return func(_ interface{}, ctx stdcontext.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := dynamicpb.NewMessage(input)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			return fn(ctx, req)
+		}
+	}
+
+	desc := &grpc.ServiceDesc{
+		ServiceName: "test.Echo",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Get",
+			Handler: unary(func(ctx stdcontext.Context, req *dynamicpb.Message) (*dynamicpb.Message, error) {
+				md, _ := metadata.FromIncomingContext(ctx)
+				grpc.SetHeader(ctx, metadata.Pairs("x-user", strings.Join(md.Get("x-user"), ",")))
+
+				fields := input.Fields()
+				tags := req.Get(fields.ByName("tags")).List()
+				var tagValues []string
+				for i := 0; i < tags.Len(); i++ {
+					tagValues = append(tagValues, tags.Get(i).String())
+				}
+				inner := req.Get(fields.ByName("inner")).Message()
+				msg := fmt.Sprintf("name=%s count=%d tags=%s inner=%s level=%d", str(req, "name"),
+					req.Get(fields.ByName("count")).Int(), strings.Join(tagValues, ","), str(inner, "value"),
+					req.Get(fields.ByName("level")).Enum())
+				return newResponse(msg, protoreflect.Value{}), nil
+			}),
+		}, {
+			MethodName: "Create",
+			Handler: unary(func(ctx stdcontext.Context, req *dynamicpb.Message) (*dynamicpb.Message, error) {
+				return newResponse("created", req.Get(input.Fields().ByName("inner"))), nil
+			}),
+		}, {
+			MethodName: "Fail",
+			Handler: unary(func(ctx stdcontext.Context, req *dynamicpb.Message) (*dynamicpb.Message, error) {
+				return nil, status.Errorf(codes.NotFound, "%s not found", str(req, "name"))
+			}),
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "List",
+			ServerStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				req := dynamicpb.NewMessage(input)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				count := int(req.Get(input.Fields().ByName("count")).Int())
+				if count < 0 {
+					return status.Error(codes.InvalidArgument, "negative count")
+				}
+				for i := 0; i < count; i++ {
+					msg := fmt.Sprintf("%s-%d", str(req, "name"), i)
+					if err := stream.SendMsg(newResponse(msg, protoreflect.Value{})); err != nil {
+						return err
+					}
+				}
+				if str(req, "name") == "abort" {
+					return status.Error(codes.Aborted, "aborted")
+				}
+				return nil
+			},
+		}, {
+			StreamName:    "Upload",
+			ClientStreams: true,
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				return status.Error(codes.Unimplemented, "unimplemented")
+			},
+		}},
+		Metadata: "test/echo.proto",
+	}
+
+	server := grpc.NewServer()
+	server.RegisterService(desc, nil)
+	rpb.RegisterServerReflectionServer(server, reflection.NewServer(reflection.ServerOptions{
+		Services:           server,
+		DescriptorResolver: fileResolver{files},
+	}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	go server.Serve(l)
+	return server, l.Addr().String()
+}
+
+func newTestTranscoder(yamlConfig string, cls cluster.Cluster, assert *assert.Assertions) *GRPCTranscoder {
+	rawSpec := make(map[string]interface{})
+	err := codectool.Unmarshal([]byte(yamlConfig), &rawSpec)
+	assert.NoError(err)
+
+	spec, err := filters.NewSpec(nil, "", rawSpec)
+	assert.NoError(err)
+
+	t := kind.CreateInstance(spec).(*GRPCTranscoder)
+	t.cluster = cls
+	t.Init()
+
+	assert.Equal(kind, t.Kind())
+	assert.Equal(spec, t.Spec())
+	assert.Nil(t.Status())
+	return t
+}
+
+func newContext(method, url string, header http.Header, body string) *context.Context {
+	stdr, _ := http.NewRequest(method, url, strings.NewReader(body))
+	for k, v := range header {
+		stdr.Header[k] = v
+	}
+	req, _ := httpprot.NewRequest(stdr)
+	req.FetchPayload(0)
+
+	ctx := context.New(tracing.NoopSpan)
+	ctx.SetRequest(context.DefaultNamespace, req)
+	return ctx
+}
+
+func responseOf(ctx *context.Context) (*httpprot.Response, string) {
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	body, _ := io.ReadAll(resp.GetPayload())
+	return resp, string(body)
+}
+
+func TestSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	newSpec := func(yamlConfig string) error {
+		rawSpec := make(map[string]interface{})
+		assert.NoError(codectool.Unmarshal([]byte(yamlConfig), &rawSpec))
+		_, err := filters.NewSpec(nil, "", rawSpec)
+		return err
+	}
+
+	assert.Error(newSpec(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: 127.0.0.1:9090
+`))
+	assert.Error(newSpec(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: 127.0.0.1:9090
+reflection: true
+descriptorFile: /tmp/set.pb
+`))
+	assert.Error(newSpec(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: 127.0.0.1:9090
+descriptorSet: aW52YWxpZA==
+`))
+	assert.Error(newSpec(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: 127.0.0.1:9090
+reflection: true
+timeout: 1
+`))
+	assert.NoError(newSpec(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: 127.0.0.1:9090
+descriptorSet: ` + testDescriptorSet(assert)))
+}
+
+func TestTranscode(t *testing.T) {
+	assert := assert.New(t)
+
+	server, addr := startTestServer(assert)
+	defer server.Stop()
+
+	tc := newTestTranscoder(fmt.Sprintf(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: %s
+timeout: 5s
+descriptorSet: %s
+`, addr, testDescriptorSet(assert)), nil, assert)
+	defer tc.Close()
+
+	// path, query and headers
+	header := http.Header{"X-User": []string{"alice"}}
+	ctx := newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob?count=3&tags=a&tags=b&inner.value=x&level=HIGH", header, "")
+	assert.Equal("", tc.Handle(ctx))
+	resp, body := responseOf(ctx)
+	assert.Equal(http.StatusOK, resp.StatusCode())
+	assert.Equal("application/json", resp.HTTPHeader().Get("Content-Type"))
+	assert.Equal("alice", resp.HTTPHeader().Get("Grpc-Metadata-X-User"))
+	assert.JSONEq(`{"message": "name=bob count=3 tags=a,b inner=x level=1"}`, body)
+
+	// additional bindings
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/echo/y/inner?name=z", nil, "")
+	assert.Equal("", tc.Handle(ctx))
+	_, body = responseOf(ctx)
+	assert.JSONEq(`{"message": "name=z count=0 tags= inner=y level=0"}`, body)
+
+	// body and response body
+	ctx = newContext(http.MethodPost, "http://127.0.0.1/v1/echo", nil, `{"value": "v"}`)
+	assert.Equal("", tc.Handle(ctx))
+	_, body = responseOf(ctx)
+	assert.JSONEq(`{"value": "v"}`, body)
+
+	// default binding of methods without http rules, and errors
+	ctx = newContext(http.MethodPost, "http://127.0.0.1/test.Echo/Fail", nil, `{"name": "bob"}`)
+	assert.Equal(resultGRPCError, tc.Handle(ctx))
+	resp, body = responseOf(ctx)
+	assert.Equal(http.StatusNotFound, resp.StatusCode())
+	assert.JSONEq(`{"code": 5, "message": "bob not found"}`, body)
+
+	// client streaming methods are not bound
+	ctx = newContext(http.MethodPost, "http://127.0.0.1/test.Echo/Upload", nil, `{}`)
+	assert.Equal(resultNotFound, tc.Handle(ctx))
+	resp, _ = responseOf(ctx)
+	assert.Equal(http.StatusNotFound, resp.StatusCode())
+
+	// invalid requests
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob?count=x", nil, "")
+	assert.Equal(resultInvalidRequest, tc.Handle(ctx))
+	resp, _ = responseOf(ctx)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode())
+
+	ctx = newContext(http.MethodPost, "http://127.0.0.1/v1/echo", nil, `{"unknown": 1}`)
+	assert.Equal(resultInvalidRequest, tc.Handle(ctx))
+}
+
+func TestServerStreaming(t *testing.T) {
+	assert := assert.New(t)
+
+	server, addr := startTestServer(assert)
+	defer server.Stop()
+
+	tc := newTestTranscoder(fmt.Sprintf(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: %s
+descriptorSet: %s
+`, addr, testDescriptorSet(assert)), nil, assert)
+	defer tc.Close()
+
+	ctx := newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob:list?count=3", nil, "")
+	assert.Equal("", tc.Handle(ctx))
+	resp, body := responseOf(ctx)
+	assert.Equal(http.StatusOK, resp.StatusCode())
+	assert.Equal("application/x-ndjson", resp.HTTPHeader().Get("Content-Type"))
+	assert.Equal("{\"message\":\"bob-0\"}\n{\"message\":\"bob-1\"}\n{\"message\":\"bob-2\"}\n", strings.ReplaceAll(body, " ", ""))
+	ctx.Finish()
+
+	// no messages
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob:list", nil, "")
+	assert.Equal("", tc.Handle(ctx))
+	_, body = responseOf(ctx)
+	assert.Equal("", body)
+	ctx.Finish()
+
+	// fails before the first message
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob:list?count=-1", nil, "")
+	assert.Equal(resultGRPCError, tc.Handle(ctx))
+	resp, _ = responseOf(ctx)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode())
+
+	// fails after the first message
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/echo/abort:list?count=1", nil, "")
+	assert.Equal("", tc.Handle(ctx))
+	_, body = responseOf(ctx)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	assert.Len(lines, 2)
+	assert.JSONEq(`{"error": {"code": 10, "message": "aborted"}}`, lines[1])
+	ctx.Finish()
+}
+
+func TestReflection(t *testing.T) {
+	assert := assert.New(t)
+
+	server, addr := startTestServer(assert)
+	defer server.Stop()
+
+	tc := newTestTranscoder(fmt.Sprintf(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: %s
+reflection: true
+useProtoNames: true
+emitUnpopulated: true
+`, addr), nil, assert)
+	defer tc.Close()
+
+	assert.Eventually(func() bool {
+		return tc.descriptors.Load() != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx := newContext(http.MethodPost, "http://127.0.0.1/v1/echo", nil, `{"value": "v"}`)
+	assert.Equal("", tc.Handle(ctx))
+	_, body := responseOf(ctx)
+	assert.JSONEq(`{"value": "v"}`, body)
+
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob", nil, "")
+	assert.Equal("", tc.Handle(ctx))
+	_, body = responseOf(ctx)
+	assert.JSONEq(`{"message": "name=bob count=0 tags= inner= level=0", "inner": null}`, body)
+}
+
+func TestDescriptorSources(t *testing.T) {
+	assert := assert.New(t)
+
+	server, addr := startTestServer(assert)
+	defer server.Stop()
+
+	// descriptors are not loaded
+	tc := newTestTranscoder(fmt.Sprintf(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: %s
+descriptorFile: /not/exist
+`, addr), nil, assert)
+	ctx := newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob", nil, "")
+	assert.Equal(resultGRPCError, tc.Handle(ctx))
+	resp, _ := responseOf(ctx)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode())
+	tc.Close()
+
+	// descriptor file
+	set, _ := base64.StdEncoding.DecodeString(testDescriptorSet(assert))
+	path := filepath.Join(t.TempDir(), "set.pb")
+	assert.NoError(os.WriteFile(path, set, 0o644))
+	tc = newTestTranscoder(fmt.Sprintf(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: %s
+descriptorFile: %s
+`, addr, path), nil, assert)
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob", nil, "")
+	assert.Equal("", tc.Handle(ctx))
+
+	// custom data, and inherit
+	cls := clustertest.NewMockedCluster()
+	syncer := clustertest.NewMockedSyncer()
+	cls.MockedSyncer = func(time.Duration) (cluster.Syncer, error) {
+		return syncer, nil
+	}
+	var key string
+	ch := make(chan *string)
+	syncer.MockedSync = func(k string) (<-chan *string, error) {
+		key = k
+		return ch, nil
+	}
+
+	rawSpec := make(map[string]interface{})
+	assert.NoError(codectool.Unmarshal([]byte(fmt.Sprintf(`
+kind: GRPCTranscoder
+name: transcoder
+endpoint: %s
+customData:
+  kind: grpc
+  id: echo
+  field: descriptorSet
+`, addr)), &rawSpec))
+	spec, err := filters.NewSpec(nil, "", rawSpec)
+	assert.NoError(err)
+	prev := tc
+	tc = kind.CreateInstance(spec).(*GRPCTranscoder)
+	tc.cluster = cls
+	tc.Inherit(prev)
+	defer tc.Close()
+
+	data := string(codectool.MustMarshalJSON(map[string]interface{}{
+		"name":          "echo",
+		"descriptorSet": testDescriptorSet(assert),
+	}))
+	ch <- &data
+	// send again to make sure the previous value is processed.
+	ch <- &data
+	assert.Equal("/custom-data/grpc/echo", key)
+
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/echo/bob", nil, "")
+	assert.Equal("", tc.Handle(ctx))
+}
@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpctranscoder
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	segmentLiteral = iota
+	segmentWildcard
+	segmentDoubleWildcard
+)
+
+type (
+	// pathTemplate is a parsed path template of google.api.http, the
+	// syntax is:
+	//
+	//	Template = "/" Segments [ Verb ] ;
+	//	Segments = Segment { "/" Segment } ;
+	//	Segment  = "*" | "**" | LITERAL | Variable ;
+	//	Variable = "{" FieldPath [ "=" Segments ] "}" ;
+	//	FieldPath = IDENT { "." IDENT } ;
+	//	Verb     = ":" LITERAL ;
+	pathTemplate struct {
+		segments  []segment
+		variables []variable
+		verb      string
+	}
+
+	segment struct {
+		kind    int
+		literal string
+	}
+
+	// variable binds the path segments in [start, end) to a field.
+	variable struct {
+		fieldPath []string
+		start     int
+		end       int
+	}
+
+	// binding binds an HTTP method and path template to a gRPC method.
+	binding struct {
+		httpMethod   string
+		template     *pathTemplate
+		method       protoreflect.MethodDescriptor
+		body         string
+		responseBody string
+	}
+)
+
+func parsePathTemplate(tmpl string) (*pathTemplate, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, fmt.Errorf("path template %q does not start with /", tmpl)
+	}
+
+	pt := &pathTemplate{}
+	s := tmpl[1:]
+
+	// the verb is after the last ':' which is not in a variable.
+	if i := strings.LastIndex(s, ":"); i >= 0 && !strings.Contains(s[i:], "}") && !strings.Contains(s[i:], "/") {
+		pt.verb, s = s[i+1:], s[:i]
+		if pt.verb == "" {
+			return nil, fmt.Errorf("path template %q has an empty verb", tmpl)
+		}
+	}
+
+	for s != "" {
+		if s[0] == '{' {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("path template %q has an unclosed variable", tmpl)
+			}
+			v, err := pt.parseVariable(s[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("path template %q: %v", tmpl, err)
+			}
+			pt.variables = append(pt.variables, *v)
+			s = s[end+1:]
+		} else {
+			end := strings.IndexByte(s, '/')
+			if end < 0 {
+				end = len(s)
+			}
+			if err := pt.addSegment(s[:end]); err != nil {
+				return nil, fmt.Errorf("path template %q: %v", tmpl, err)
+			}
+			s = s[end:]
+		}
+
+		if s == "" {
+			break
+		}
+		if s[0] != '/' || len(s) == 1 {
+			return nil, fmt.Errorf("path template %q is invalid", tmpl)
+		}
+		s = s[1:]
+	}
+
+	if len(pt.segments) == 0 {
+		return nil, fmt.Errorf("path template %q has no segments", tmpl)
+	}
+	for i, seg := range pt.segments {
+		if seg.kind == segmentDoubleWildcard && i != len(pt.segments)-1 {
+			return nil, fmt.Errorf("path template %q: ** must be the last segment", tmpl)
+		}
+	}
+	return pt, nil
+}
+
+func (pt *pathTemplate) parseVariable(s string) (*variable, error) {
+	fieldPath, segments, found := strings.Cut(s, "=")
+	if !found {
+		segments = "*"
+	}
+	if fieldPath == "" {
+		return nil, fmt.Errorf("variable has an empty field path")
+	}
+
+	v := &variable{fieldPath: strings.Split(fieldPath, "."), start: len(pt.segments)}
+	for _, seg := range strings.Split(segments, "/") {
+		if strings.ContainsAny(seg, "{}") {
+			return nil, fmt.Errorf("nested variable is not allowed")
+		}
+		if err := pt.addSegment(seg); err != nil {
+			return nil, err
+		}
+	}
+	v.end = len(pt.segments)
+	return v, nil
+}
+
+func (pt *pathTemplate) addSegment(s string) error {
+	switch s {
+	case "":
+		return fmt.Errorf("empty segment")
+	case "*":
+		pt.segments = append(pt.segments, segment{kind: segmentWildcard})
+	case "**":
+		pt.segments = append(pt.segments, segment{kind: segmentDoubleWildcard})
+	default:
+		if strings.ContainsAny(s, "{}") {
+			return fmt.Errorf("invalid segment %q", s)
+		}
+		pt.segments = append(pt.segments, segment{kind: segmentLiteral, literal: s})
+	}
+	return nil
+}
+
+// match matches the escaped path against the template, and returns the
+// values of the variables if matched.
+func (pt *pathTemplate) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+
+	if pt.verb != "" {
+		if !strings.HasSuffix(path, ":"+pt.verb) {
+			return nil, false
+		}
+		path = path[:len(path)-len(pt.verb)-1]
+	}
+
+	parts := strings.Split(path, "/")
+	n := len(pt.segments)
+	if pt.segments[n-1].kind == segmentDoubleWildcard {
+		if len(parts) < n-1 {
+			return nil, false
+		}
+	} else if len(parts) != n {
+		return nil, false
+	}
+
+	for i, seg := range pt.segments {
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.literal {
+				return nil, false
+			}
+		case segmentWildcard:
+			if parts[i] == "" {
+				return nil, false
+			}
+		}
+	}
+
+	values := make(map[string]string, len(pt.variables))
+	for _, v := range pt.variables {
+		end := v.end
+		if end == n && pt.segments[n-1].kind == segmentDoubleWildcard {
+			end = len(parts)
+		}
+		values[strings.Join(v.fieldPath, ".")] = unescapeSegments(parts[v.start:end])
+	}
+	return values, true
+}
+
+// unescapeSegments unescapes and joins the path segments, '/' is not
+// unescaped if there are multiple segments, as required by google.api.http.
+func unescapeSegments(parts []string) string {
+	if len(parts) == 1 {
+		s, err := url.PathUnescape(parts[0])
+		if err != nil {
+			return parts[0]
+		}
+		return s
+	}
+
+	for i, p := range parts {
+		p = strings.ReplaceAll(strings.ReplaceAll(p, "%2F", "%252F"), "%2f", "%252f")
+		if s, err := url.PathUnescape(p); err == nil {
+			parts[i] = s
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// moreSpecific reports whether pt should be matched before other: literal
+// segments are more specific than wildcards.
+func (pt *pathTemplate) moreSpecific(other *pathTemplate) bool {
+	for i := 0; i < len(pt.segments) && i < len(other.segments); i++ {
+		if pt.segments[i].kind != other.segments[i].kind {
+			return pt.segments[i].kind < other.segments[i].kind
+		}
+	}
+	if len(pt.segments) != len(other.segments) {
+		return len(pt.segments) > len(other.segments)
+	}
+	return pt.verb != "" && other.verb == ""
+}
+
+// newBindings creates the bindings of a method from its google.api.http
+// rule, the method is bound to "POST /package.Service/Method" with body
+// "*" if it has no rule.
+func newBindings(method protoreflect.MethodDescriptor, rule *annotations.HttpRule) ([]*binding, error) {
+	if rule == nil {
+		path := fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name())
+		rule = &annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: path}, Body: "*"}
+	}
+
+	var bindings []*binding
+	rules := append([]*annotations.HttpRule{rule}, rule.AdditionalBindings...)
+	for _, r := range rules {
+		b, err := newBinding(method, r)
+		if err != nil {
+			return nil, fmt.Errorf("method %s: %v", method.FullName(), err)
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+func newBinding(method protoreflect.MethodDescriptor, rule *annotations.HttpRule) (*binding, error) {
+	b := &binding{method: method, body: rule.Body, responseBody: rule.ResponseBody}
+
+	var path string
+	switch p := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		b.httpMethod, path = "GET", p.Get
+	case *annotations.HttpRule_Put:
+		b.httpMethod, path = "PUT", p.Put
+	case *annotations.HttpRule_Post:
+		b.httpMethod, path = "POST", p.Post
+	case *annotations.HttpRule_Delete:
+		b.httpMethod, path = "DELETE", p.Delete
+	case *annotations.HttpRule_Patch:
+		b.httpMethod, path = "PATCH", p.Patch
+	case *annotations.HttpRule_Custom:
+		b.httpMethod, path = p.Custom.Kind, p.Custom.Path
+	default:
+		return nil, fmt.Errorf("http rule has no pattern")
+	}
+
+	tmpl, err := parsePathTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	b.template = tmpl
+
+	input := method.Input()
+	for _, v := range tmpl.variables {
+		if _, err := findFieldPath(input, v.fieldPath); err != nil {
+			return nil, err
+		}
+	}
+	if b.body != "" && b.body != "*" && input.Fields().ByName(protoreflect.Name(b.body)) == nil {
+		return nil, fmt.Errorf("body field %s not found in %s", b.body, input.FullName())
+	}
+	if b.responseBody != "" && method.Output().Fields().ByName(protoreflect.Name(b.responseBody)) == nil {
+		return nil, fmt.Errorf("response body field %s not found in %s", b.responseBody, method.Output().FullName())
+	}
+	return b, nil
+}
+
+// sortBindings sorts the bindings to match more specific templates first,
+// the order of the definitions is kept for the others.
+func sortBindings(bindings []*binding) {
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return bindings[i].template.moreSpecific(bindings[j].template)
+	})
+}
+
+// findBinding finds the binding of the request, and returns the values of
+// the path variables.
+func findBinding(bindings []*binding, method, path string) (*binding, map[string]string) {
+	for _, b := range bindings {
+		if b.httpMethod != method {
+			continue
+		}
+		if values, ok := b.template.match(path); ok {
+			return b, values
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpctranscoder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tmpl := range []string{
+		"/v1/messages",
+		"/v1/messages/{id}",
+		"/v1/{name=shelves/*/books/*}",
+		"/v1/{name=files/**}",
+		"/v1/messages/{id}:cancel",
+		"/v1/*/messages/{msg.id}",
+	} {
+		_, err := parsePathTemplate(tmpl)
+		assert.NoError(err, tmpl)
+	}
+
+	for _, tmpl := range []string{
+		"v1/messages",
+		"/",
+		"/v1//messages",
+		"/v1/messages/",
+		"/v1/{id",
+		"/v1/{=*}",
+		"/v1/{a={b}}",
+		"/v1/**/messages",
+		"/v1/messages:",
+		"/v1/mess}ages",
+	} {
+		_, err := parsePathTemplate(tmpl)
+		assert.Error(err, tmpl)
+	}
+}
+
+func TestPathTemplateMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		tmpl   string
+		path   string
+		values map[string]string
+	}{
+		{"/v1/messages", "/v1/messages", map[string]string{}},
+		{"/v1/messages", "/v1/messages/1", nil},
+		{"/v1/messages/{id}", "/v1/messages/1", map[string]string{"id": "1"}},
+		{"/v1/messages/{id}", "/v1/messages/a%20b", map[string]string{"id": "a b"}},
+		{"/v1/messages/{id}", "/v1/messages/", nil},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/2", map[string]string{"name": "shelves/1/books/2"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books", nil},
+		{"/v1/{name=files/**}", "/v1/files/a/b%2Fc", map[string]string{"name": "files/a/b%2Fc"}},
+		{"/v1/{name=files/**}", "/v1/files", map[string]string{"name": "files"}},
+		{"/v1/messages/{id}:cancel", "/v1/messages/1:cancel", map[string]string{"id": "1"}},
+		{"/v1/messages/{id}:cancel", "/v1/messages/1", nil},
+		{"/v1/*/messages/{msg.id}", "/v1/x/messages/2", map[string]string{"msg.id": "2"}},
+	}
+
+	for _, c := range cases {
+		pt, err := parsePathTemplate(c.tmpl)
+		assert.NoError(err)
+		values, ok := pt.match(c.path)
+		assert.Equal(c.values != nil, ok, c.path)
+		if ok {
+			assert.Equal(c.values, values, c.path)
+		}
+	}
+}
+
+func TestMoreSpecific(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(tmpl string) *pathTemplate {
+		pt, err := parsePathTemplate(tmpl)
+		assert.NoError(err)
+		return pt
+	}
+
+	assert.True(parse("/v1/messages/search").moreSpecific(parse("/v1/messages/{id}")))
+	assert.False(parse("/v1/messages/{id}").moreSpecific(parse("/v1/messages/search")))
+	assert.True(parse("/v1/messages/{id}").moreSpecific(parse("/v1/{name=**}")))
+	assert.True(parse("/v1/messages/{id}:cancel").moreSpecific(parse("/v1/messages/{id}")))
+}
@@ -0,0 +1,358 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpctranscoder
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// newRequestMessage creates the request message of the binding from the
+// path variables, the query parameters and the body of the HTTP request.
+func (d *descriptors) newRequestMessage(b *binding, pathValues map[string]string, query url.Values, body []byte) (*dynamicpb.Message, error) {
+	input := b.method.Input()
+	msg := dynamicpb.NewMessage(input)
+	opts := protojson.UnmarshalOptions{Resolver: d.types}
+
+	switch {
+	case len(body) == 0:
+	case b.body == "*":
+		if err := opts.Unmarshal(body, msg); err != nil {
+			return nil, fmt.Errorf("invalid body: %v", err)
+		}
+	case b.body != "":
+		// unmarshal the body as the value of the field in a temporary
+		// message, this works for all types of fields.
+		fd := input.Fields().ByName(protoreflect.Name(b.body))
+		data := make([]byte, 0, len(body)+len(fd.JSONName())+8)
+		data = append(data, `{"`+fd.JSONName()+`":`...)
+		data = append(append(data, body...), '}')
+		tmp := dynamicpb.NewMessage(input)
+		if err := opts.Unmarshal(data, tmp); err != nil {
+			return nil, fmt.Errorf("invalid body: %v", err)
+		}
+		msg.Set(fd, tmp.Get(fd))
+	}
+
+	for path, value := range pathValues {
+		if err := d.setField(msg, strings.Split(path, "."), []string{value}); err != nil {
+			return nil, fmt.Errorf("invalid path parameter %s: %v", path, err)
+		}
+	}
+
+	// query parameters are ignored if the whole body is mapped to the
+	// request message.
+	if b.body == "*" {
+		return msg, nil
+	}
+	for key, values := range query {
+		if _, ok := pathValues[key]; ok {
+			continue
+		}
+		fieldPath := strings.Split(key, ".")
+		if b.body != "" && fieldPath[0] == b.body {
+			continue
+		}
+		if _, err := findFieldPath(input, fieldPath); err != nil {
+			// unknown query parameters are ignored.
+			continue
+		}
+		if err := d.setField(msg, fieldPath, values); err != nil {
+			return nil, fmt.Errorf("invalid query parameter %s: %v", key, err)
+		}
+	}
+
+	return msg, nil
+}
+
+// findFieldPath finds the fields of the path, the names in the path could
+// be either the proto names or the JSON names.
+func findFieldPath(md protoreflect.MessageDescriptor, path []string) ([]protoreflect.FieldDescriptor, error) {
+	fields := make([]protoreflect.FieldDescriptor, 0, len(path))
+	for i, name := range path {
+		if md == nil {
+			return nil, fmt.Errorf("field %s is not a message", strings.Join(path[:i], "."))
+		}
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("field %s not found in %s", name, md.FullName())
+		}
+		if i < len(path)-1 && (fd.IsList() || fd.IsMap()) {
+			return nil, fmt.Errorf("repeated field %s is not allowed in field path", name)
+		}
+		fields = append(fields, fd)
+		md = fd.Message()
+	}
+	return fields, nil
+}
+
+func (d *descriptors) setField(msg protoreflect.Message, path []string, values []string) error {
+	fields, err := findFieldPath(msg.Descriptor(), path)
+	if err != nil {
+		return err
+	}
+
+	for _, fd := range fields[:len(fields)-1] {
+		msg = msg.Mutable(fd).Message()
+	}
+
+	fd := fields[len(fields)-1]
+	if fd.IsMap() {
+		return fmt.Errorf("map field is not supported")
+	}
+	if !fd.IsList() {
+		v, err := d.parseValue(msg, fd, values[len(values)-1])
+		if err != nil {
+			return err
+		}
+		msg.Set(fd, v)
+		return nil
+	}
+
+	list := msg.Mutable(fd).List()
+	for _, s := range values {
+		v, err := d.parseValue(msg, fd, s)
+		if err != nil {
+			return err
+		}
+		list.Append(v)
+	}
+	return nil
+}
+
+func (d *descriptors) parseValue(msg protoreflect.Message, fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("invalid enum value %s", s)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), nil
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		// well known types like google.protobuf.Timestamp could be
+		// unmarshaled from JSON strings.
+		var v protoreflect.Message
+		if fd.IsList() {
+			v = msg.Mutable(fd).List().NewElement().Message()
+		} else {
+			v = msg.NewField(fd).Message()
+		}
+		opts := protojson.UnmarshalOptions{Resolver: d.types}
+		if err := opts.Unmarshal([]byte(strconv.Quote(s)), v.Interface()); err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfMessage(v), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported field type %s", fd.Kind())
+}
+
+// marshalResponse marshals the response message, or the response body
+// field of it, to JSON.
+func (d *descriptors) marshalResponse(b *binding, msg *dynamicpb.Message, opts protojson.MarshalOptions) ([]byte, error) {
+	opts.Resolver = d.types
+	if b.responseBody == "" {
+		return opts.Marshal(msg)
+	}
+
+	// marshal the field in a temporary message, and pick the field from
+	// the result, this works for all types of fields.
+	fd := msg.Descriptor().Fields().ByName(protoreflect.Name(b.responseBody))
+	tmp := dynamicpb.NewMessage(msg.Descriptor())
+	if msg.Has(fd) {
+		tmp.Set(fd, msg.Get(fd))
+	}
+	data, err := opts.Marshal(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	name := fd.JSONName()
+	if opts.UseProtoNames {
+		name = string(fd.Name())
+	}
+	if field, ok := fields[name]; ok {
+		return field, nil
+	}
+	return []byte("null"), nil
+}
+
+// marshalStatus marshals the gRPC status to JSON in the format of
+// google.rpc.Status, d could be nil if the descriptors are not loaded.
+func (d *descriptors) marshalStatus(st *status.Status) []byte {
+	opts := protojson.MarshalOptions{}
+	if d != nil {
+		opts.Resolver = d.types
+	}
+	data, err := opts.Marshal(st.Proto())
+	if err != nil {
+		// the details could not be marshaled.
+		data, _ = opts.Marshal(status.New(st.Code(), st.Message()).Proto())
+	}
+	return data
+}
+
+// httpStatusFromCode maps gRPC status codes to HTTP status codes, see
+// https://github.com/googleapis/googleapis/blob/master/google/rpc/code.proto
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.Unknown:
+		return http.StatusInternalServerError
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Aborted:
+		return http.StatusConflict
+	case codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Internal:
+		return http.StatusInternalServerError
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DataLoss:
+		return http.StatusInternalServerError
+	}
+	return http.StatusInternalServerError
+}
+
+// streamReader reads the messages of a server streaming call as NDJSON,
+// every message is a line. If the call fails after the response header
+// is sent, the status is written as the last line in the format of
+// {"error": <google.rpc.Status>}.
+type streamReader struct {
+	d       *descriptors
+	b       *binding
+	stream  grpc.ClientStream
+	opts    protojson.MarshalOptions
+	flusher http.Flusher
+	cancel  func()
+
+	buf  []byte
+	done bool
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		// flush the messages already read to the client before waiting
+		// for the next one.
+		if r.flusher != nil {
+			r.flusher.Flush()
+		}
+
+		r.buf = r.next()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *streamReader) next() []byte {
+	msg := dynamicpb.NewMessage(r.b.method.Output())
+	err := r.stream.RecvMsg(msg)
+	if err == io.EOF {
+		r.done = true
+		return nil
+	}
+
+	var data []byte
+	if err == nil {
+		data, err = r.d.marshalResponse(r.b, msg, r.opts)
+	}
+	if err != nil {
+		r.done = true
+		r.cancel()
+		data = append([]byte(`{"error":`), r.d.marshalStatus(status.Convert(err))...)
+		data = append(data, '}')
+	}
+	return append(data, '\n')
+}
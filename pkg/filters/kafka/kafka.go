@@ -26,6 +26,7 @@ import (
 	"github.com/megaease/easegress/pkg/filters"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/protocols/mqttprot"
+	"github.com/megaease/easegress/pkg/util/kafkahelper"
 )
 
 const (
@@ -33,12 +34,13 @@ const (
 	Kind = "KafkaMQTT"
 
 	resultGetDataFailed = "getDataFailed"
+	resultProduceFailed = "produceFailed"
 )
 
 var kind = &filters.Kind{
 	Name:        Kind,
 	Description: "Kafka is a kafka proxy for MQTT requests",
-	Results:     []string{resultGetDataFailed},
+	Results:     []string{resultGetDataFailed, resultProduceFailed},
 	DefaultSpec: func() filters.Spec {
 		return &Spec{}
 	},
@@ -54,14 +56,16 @@ func init() {
 type (
 	// Kafka is a kafka proxy for MQTT requests.
 	Kafka struct {
-		spec     *Spec
-		producer sarama.AsyncProducer
-		done     chan struct{}
+		spec         *Spec
+		producer     sarama.AsyncProducer
+		syncProducer sarama.SyncProducer
+		done         chan struct{}
 
 		defaultTopic string
 		topicKey     string
 		headerKey    string
 		payloadKey   string
+		key          *Key
 	}
 )
 
@@ -92,14 +96,29 @@ func (k *Kafka) setKV() {
 	if k.spec.Topic != nil {
 		k.defaultTopic = k.spec.Topic.Default
 	}
+	k.key = k.spec.Key
 }
 
-var newAsyncProducer = sarama.NewAsyncProducer
+var (
+	newAsyncProducer = sarama.NewAsyncProducer
+	newSyncProducer  = sarama.NewSyncProducer
+)
 
 func (k *Kafka) setProducer() {
-	config := sarama.NewConfig()
-	config.ClientID = k.spec.Name()
-	config.Version = sarama.V1_0_0_0
+	config, err := k.spec.ProducerSpec.NewConfig(k.spec.Name())
+	if err != nil {
+		panic(fmt.Errorf("create sarama config failed: %v", err))
+	}
+
+	if k.spec.Sync {
+		producer, err := newSyncProducer(k.spec.Backend, config)
+		if err != nil {
+			panic(fmt.Errorf("start sarama producer with address %v failed: %v", k.spec.Backend, err))
+		}
+		k.syncProducer = producer
+		return
+	}
+
 	producer, err := newAsyncProducer(k.spec.Backend, config)
 	if err != nil {
 		panic(fmt.Errorf("start sarama producer with address %v failed: %v", k.spec.Backend, err))
@@ -140,6 +159,11 @@ func (k *Kafka) Inherit(previousGeneration filters.Filter) {
 // Close close Kafka
 func (k *Kafka) Close() {
 	close(k.done)
+	if k.syncProducer != nil {
+		if err := k.syncProducer.Close(); err != nil {
+			logger.Errorf("close kafka producer failed: %v", err)
+		}
+	}
 }
 
 // Status return status of Kafka
@@ -198,12 +222,51 @@ func (k *Kafka) Handle(ctx *context.Context) string {
 	for k, v := range headers {
 		kafkaHeaders = append(kafkaHeaders, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
 	}
+	// user properties of MQTT 5 are sent as headers too
+	for _, p := range req.UserProperties() {
+		kafkaHeaders = append(kafkaHeaders, sarama.RecordHeader{Key: []byte(p.Key), Value: []byte(p.Value)})
+	}
 
 	msg := &sarama.ProducerMessage{
 		Topic:   topic,
 		Headers: kafkaHeaders,
 		Value:   sarama.ByteEncoder(payload),
 	}
-	k.producer.Input() <- msg
+	if key := k.getKey(req, headers, payload); key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+
+	if k.syncProducer == nil {
+		k.producer.Input() <- msg
+		return ""
+	}
+	if _, _, err := k.syncProducer.SendMessage(msg); err != nil {
+		logger.SpanErrorf(nil, "sarama producer failed: %v", err)
+		return resultProduceFailed
+	}
+	return ""
+}
+
+// getKey returns the key of the message, an empty key means the message
+// has no key.
+func (k *Kafka) getKey(req *mqttprot.Request, headers map[string]string, payload []byte) string {
+	switch {
+	case k.key == nil:
+		return ""
+	case k.key.ClientID:
+		return req.Client().ClientID()
+	case k.key.JSONField != "":
+		key, _ := kafkahelper.JSONField(payload, k.key.JSONField)
+		return key
+	case k.key.Header != "":
+		if key, ok := headers[k.key.Header]; ok {
+			return key
+		}
+		for _, p := range req.UserProperties() {
+			if p.Key == k.key.Header {
+				return p.Value
+			}
+		}
+	}
 	return ""
 }
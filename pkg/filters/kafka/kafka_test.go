@@ -178,6 +178,28 @@ func TestKafkaWithKVMap(t *testing.T) {
 	assert.Equal("text", string(value))
 }
 
+func TestKafkaWithUserProperties(t *testing.T) {
+	assert := assert.New(t)
+
+	kafka := Kafka{
+		spec:     &Spec{Backend: []string{"localhost:1234"}},
+		producer: newMockAsyncProducer(),
+		done:     make(chan struct{}),
+	}
+	defer kafka.Close()
+
+	mqttCtx := newContext("test", "a/b/c", []byte("text"))
+	req := mqttCtx.GetInputRequest().(*mqttprot.Request)
+	req.SetUserProperties([]mqttprot.UserProperty{{Key: "k1", Value: "v1"}, {Key: "k1", Value: "v2"}})
+
+	kafka.Handle(mqttCtx)
+	msg := <-kafka.producer.(*mockAsyncProducer).ch
+	assert.Equal([]sarama.RecordHeader{
+		{Key: []byte("k1"), Value: []byte("v1")},
+		{Key: []byte("k1"), Value: []byte("v2")},
+	}, msg.Headers)
+}
+
 func TestKafka2(t *testing.T) {
 	assert := assert.New(t)
 
@@ -209,3 +231,85 @@ func TestKafka2(t *testing.T) {
 	}
 	assert.Equal(int32(1), atomic.LoadInt32(&p.closed))
 }
+
+type mockSyncProducer struct {
+	sarama.SyncProducer
+	msgs []*sarama.ProducerMessage
+	err  error
+}
+
+func (m *mockSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	m.msgs = append(m.msgs, msg)
+	return 0, 0, m.err
+}
+
+func (m *mockSyncProducer) Close() error {
+	return nil
+}
+
+func TestKafkaKey(t *testing.T) {
+	assert := assert.New(t)
+
+	getKey := func(key *Key, setup func(ctx *context.Context)) sarama.Encoder {
+		spec := &Spec{
+			Backend: []string{"localhost:1234"},
+			KVMap:   &KVMap{HeaderKey: "headers"},
+			Key:     key,
+		}
+		kafka := Kafka{
+			spec:     spec,
+			producer: newMockAsyncProducer(),
+			done:     make(chan struct{}),
+		}
+		kafka.setKV()
+		defer kafka.Close()
+
+		mqttCtx := newContext("client1", "a/b/c", []byte(`{"device": {"id": "d1"}}`))
+		mqttCtx.SetData("headers", map[string]string{"h1": "v1"})
+		if setup != nil {
+			setup(mqttCtx)
+		}
+		assert.Equal("", kafka.Handle(mqttCtx))
+		msg := <-kafka.producer.(*mockAsyncProducer).ch
+		return msg.Key
+	}
+
+	assert.Nil(getKey(nil, nil))
+	assert.Equal(sarama.StringEncoder("client1"), getKey(&Key{ClientID: true}, nil))
+	assert.Equal(sarama.StringEncoder("d1"), getKey(&Key{JSONField: "device.id"}, nil))
+	assert.Nil(getKey(&Key{JSONField: "device.name"}, nil))
+	assert.Equal(sarama.StringEncoder("v1"), getKey(&Key{Header: "h1"}, nil))
+	assert.Equal(sarama.StringEncoder("v2"), getKey(&Key{Header: "h2"}, func(ctx *context.Context) {
+		req := ctx.GetInputRequest().(*mqttprot.Request)
+		req.SetUserProperties([]mqttprot.UserProperty{{Key: "h2", Value: "v2"}})
+	}))
+
+	assert.Nil((&Spec{Key: &Key{ClientID: true}}).Validate())
+	assert.NotNil((&Spec{Key: &Key{}}).Validate())
+	assert.NotNil((&Spec{Key: &Key{ClientID: true, Header: "h1"}}).Validate())
+}
+
+func TestKafkaSync(t *testing.T) {
+	assert := assert.New(t)
+
+	producer := &mockSyncProducer{}
+	newSyncProducer = func(addrs []string, conf *sarama.Config) (sarama.SyncProducer, error) {
+		assert.True(conf.Producer.Return.Successes)
+		return producer, nil
+	}
+	defer func() { newSyncProducer = sarama.NewSyncProducer }()
+
+	spec := &Spec{Backend: []string{"localhost:1234"}}
+	spec.Sync = true
+	kafka := Kafka{spec: spec}
+	kafka.Init()
+	defer kafka.Close()
+	assert.Nil(kafka.producer)
+
+	assert.Equal("", kafka.Handle(newContext("test", "a/b/c", []byte("text"))))
+	assert.Equal(1, len(producer.msgs))
+	assert.Equal("a/b/c", producer.msgs[0].Topic)
+
+	producer.err = fmt.Errorf("mock produce failed")
+	assert.Equal(resultProduceFailed, kafka.Handle(newContext("test", "a/b/c", []byte("text"))))
+}
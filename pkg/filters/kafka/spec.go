@@ -17,16 +17,23 @@
 
 package kafka
 
-import "github.com/megaease/easegress/pkg/filters"
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/util/kafkahelper"
+)
 
 type (
 	// Spec is spec of Kafka
 	Spec struct {
-		filters.BaseSpec `json:",inline"`
+		filters.BaseSpec         `json:",inline"`
+		kafkahelper.ProducerSpec `json:",inline"`
 
 		Backend []string `json:"backend" jsonschema:"required,uniqueItems=true"`
 		Topic   *Topic   `json:"topic" jsonschema:"required"`
 		KVMap   *KVMap   `json:"mqtt" jsonschema:"required"`
+		Key     *Key     `json:"key,omitempty" jsonschema:"omitempty"`
 	}
 
 	// Topic defined ways to get Kafka topic
@@ -40,4 +47,38 @@ type (
 		HeaderKey  string `json:"headerKey" jsonschema:"required"`
 		PayloadKey string `json:"payloadKey" jsonschema:"required"`
 	}
+
+	// Key defines ways to get the key of Kafka messages, messages with
+	// the same key are sent to the same partition. Only one of them
+	// should be set.
+	Key struct {
+		// Header is the name of a header in the kv map or a user property
+		// of MQTT 5.
+		Header    string `json:"header,omitempty" jsonschema:"omitempty"`
+		JSONField string `json:"jsonField,omitempty" jsonschema:"omitempty"`
+		ClientID  bool   `json:"clientID,omitempty" jsonschema:"omitempty"`
+	}
 )
+
+// Validate validates the Spec.
+func (spec *Spec) Validate() error {
+	if err := spec.ProducerSpec.Validate(); err != nil {
+		return err
+	}
+	if spec.Key != nil {
+		n := 0
+		if spec.Key.Header != "" {
+			n++
+		}
+		if spec.Key.JSONField != "" {
+			n++
+		}
+		if spec.Key.ClientID {
+			n++
+		}
+		if n != 1 {
+			return fmt.Errorf("exactly one of header, jsonField and clientID should be set in key")
+		}
+	}
+	return nil
+}
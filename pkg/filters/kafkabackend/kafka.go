@@ -28,19 +28,21 @@ import (
 	"github.com/megaease/easegress/pkg/filters"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/kafkahelper"
 )
 
 const (
 	// Kind is the kind of Kafka
 	Kind = "Kafka"
 
-	resultParseErr = "parseErr"
+	resultParseErr      = "parseErr"
+	resultProduceFailed = "produceFailed"
 )
 
 var kind = &filters.Kind{
 	Name:        Kind,
 	Description: "Kafka is a kafka proxy for HTTP requests",
-	Results:     []string{resultParseErr},
+	Results:     []string{resultParseErr, resultProduceFailed},
 	DefaultSpec: func() filters.Spec {
 		return &Spec{}
 	},
@@ -56,10 +58,12 @@ func init() {
 type (
 	// Kafka is a kafka proxy for HTTP requests.
 	Kafka struct {
-		spec     *Spec
-		producer sarama.AsyncProducer
-		done     chan struct{}
-		header   string
+		spec         *Spec
+		producer     sarama.AsyncProducer
+		syncProducer sarama.SyncProducer
+		done         chan struct{}
+		header       string
+		keyHeader    string
 	}
 )
 
@@ -87,6 +91,9 @@ func (k *Kafka) setHeader(spec *Spec) {
 			panic("empty header")
 		}
 	}
+	if k.spec.Key != nil && k.spec.Key.Header != "" {
+		k.keyHeader = http.CanonicalHeaderKey(k.spec.Key.Header)
+	}
 }
 
 // Init init Kafka
@@ -95,9 +102,20 @@ func (k *Kafka) Init() {
 	k.done = make(chan struct{})
 	k.setHeader(k.spec)
 
-	config := sarama.NewConfig()
-	config.ClientID = spec.Name()
-	config.Version = sarama.V1_0_0_0
+	config, err := spec.ProducerSpec.NewConfig(spec.Name())
+	if err != nil {
+		panic(fmt.Errorf("create sarama config failed: %v", err))
+	}
+
+	if spec.Sync {
+		producer, err := sarama.NewSyncProducer(k.spec.Backend, config)
+		if err != nil {
+			panic(fmt.Errorf("start sarama producer with address %v failed: %v", k.spec.Backend, err))
+		}
+		k.syncProducer = producer
+		return
+	}
+
 	producer, err := sarama.NewAsyncProducer(k.spec.Backend, config)
 	if err != nil {
 		panic(fmt.Errorf("start sarama producer with address %v failed: %v", k.spec.Backend, err))
@@ -133,6 +151,11 @@ func (k *Kafka) Inherit(previousGeneration filters.Filter) {
 // Close close Kafka
 func (k *Kafka) Close() {
 	close(k.done)
+	if k.syncProducer != nil {
+		if err := k.syncProducer.Close(); err != nil {
+			logger.Errorf("close kafka producer failed: %v", err)
+		}
+	}
 }
 
 // Status return status of Kafka
@@ -151,6 +174,19 @@ func (k *Kafka) getTopic(req *httpprot.Request) string {
 	return topic
 }
 
+// getKey returns the key of the message, an empty key means the message
+// has no key.
+func (k *Kafka) getKey(req *httpprot.Request, body []byte) string {
+	if k.keyHeader != "" {
+		return req.Std().Header.Get(k.keyHeader)
+	}
+	if k.spec.Key != nil && k.spec.Key.JSONField != "" {
+		key, _ := kafkahelper.JSONField(body, k.spec.Key.JSONField)
+		return key
+	}
+	return ""
+}
+
 // Handle handles the context.
 func (k *Kafka) Handle(ctx *context.Context) (result string) {
 	req := ctx.GetInputRequest().(*httpprot.Request)
@@ -165,6 +201,23 @@ func (k *Kafka) Handle(ctx *context.Context) (result string) {
 		Topic: topic,
 		Value: sarama.ByteEncoder(body),
 	}
-	k.producer.Input() <- msg
+	if key := k.getKey(req, body); key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+
+	if k.syncProducer == nil {
+		k.producer.Input() <- msg
+		return ""
+	}
+	if _, _, err := k.syncProducer.SendMessage(msg); err != nil {
+		logger.Errorf("sarama producer failed: %v", err)
+		resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+		if resp == nil {
+			resp, _ = httpprot.NewResponse(nil)
+		}
+		resp.SetStatusCode(http.StatusServiceUnavailable)
+		ctx.SetOutputResponse(resp)
+		return resultProduceFailed
+	}
 	return ""
 }
@@ -174,3 +174,78 @@ func TestHandleHTTP(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal("text", string(value))
 }
+
+type mockSyncProducer struct {
+	sarama.SyncProducer
+	msgs []*sarama.ProducerMessage
+	err  error
+}
+
+func (m *mockSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	m.msgs = append(m.msgs, msg)
+	return 0, 0, m.err
+}
+
+func (m *mockSyncProducer) Close() error {
+	return nil
+}
+
+func TestHandleHTTPKey(t *testing.T) {
+	assert := assert.New(t)
+
+	getKey := func(key *Key) sarama.Encoder {
+		kafka := Kafka{
+			spec: &Spec{
+				Topic: &Topic{Default: "default-topic"},
+				Key:   key,
+			},
+			producer: newMockAsyncProducer(),
+			done:     make(chan struct{}),
+		}
+		kafka.setHeader(kafka.spec)
+
+		ctx := context.New(nil)
+		req, err := http.NewRequest(http.MethodPost, "127.0.0.1", strings.NewReader(`{"user": {"id": 42}}`))
+		assert.Nil(err)
+		req.Header.Add("x-kafka-key", "key1")
+		setRequest(t, ctx, req)
+
+		assert.Equal("", kafka.Handle(ctx))
+		msg := <-kafka.producer.(*mockAsyncProducer).ch
+		return msg.Key
+	}
+
+	assert.Nil(getKey(nil))
+	assert.Equal(sarama.StringEncoder("key1"), getKey(&Key{Header: "x-kafka-key"}))
+	assert.Nil(getKey(&Key{Header: "x-other-key"}))
+	assert.Equal(sarama.StringEncoder("42"), getKey(&Key{JSONField: "user.id"}))
+
+	assert.Nil((&Spec{Key: &Key{Header: "x-kafka-key"}}).Validate())
+	assert.NotNil((&Spec{Key: &Key{}}).Validate())
+	assert.NotNil((&Spec{Key: &Key{Header: "x-kafka-key", JSONField: "id"}}).Validate())
+}
+
+func TestHandleHTTPSync(t *testing.T) {
+	assert := assert.New(t)
+
+	producer := &mockSyncProducer{}
+	kafka := Kafka{
+		spec:         &Spec{Topic: &Topic{Default: "default-topic"}},
+		syncProducer: producer,
+		done:         make(chan struct{}),
+	}
+	defer kafka.Close()
+
+	ctx := context.New(nil)
+	req, err := http.NewRequest(http.MethodPost, "127.0.0.1", strings.NewReader("text"))
+	assert.Nil(err)
+	setRequest(t, ctx, req)
+	assert.Equal("", kafka.Handle(ctx))
+	assert.Equal(1, len(producer.msgs))
+	assert.Nil(ctx.GetOutputResponse())
+
+	producer.err = fmt.Errorf("mock produce failed")
+	assert.Equal(resultProduceFailed, kafka.Handle(ctx))
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode())
+}
@@ -17,15 +17,22 @@
 
 package kafka
 
-import "github.com/megaease/easegress/pkg/filters"
+import (
+	"fmt"
+
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/util/kafkahelper"
+)
 
 type (
 	// Spec is spec of Kafka
 	Spec struct {
-		filters.BaseSpec `json:",inline"`
+		filters.BaseSpec         `json:",inline"`
+		kafkahelper.ProducerSpec `json:",inline"`
 
 		Backend []string `json:"backend" jsonschema:"required,uniqueItems=true"`
 		Topic   *Topic   `json:"topic" jsonschema:"required"`
+		Key     *Key     `json:"key,omitempty" jsonschema:"omitempty"`
 	}
 
 	// Topic defined ways to get Kafka topic
@@ -38,4 +45,23 @@ type (
 	Dynamic struct {
 		Header string `json:"header" jsonschema:"omitempty"`
 	}
+
+	// Key defines ways to get the key of Kafka messages from http request,
+	// messages with the same key are sent to the same partition. Only one
+	// of them should be set.
+	Key struct {
+		Header    string `json:"header,omitempty" jsonschema:"omitempty"`
+		JSONField string `json:"jsonField,omitempty" jsonschema:"omitempty"`
+	}
 )
+
+// Validate validates the Spec.
+func (spec *Spec) Validate() error {
+	if err := spec.ProducerSpec.Validate(); err != nil {
+		return err
+	}
+	if spec.Key != nil && (spec.Key.Header == "") == (spec.Key.JSONField == "") {
+		return fmt.Errorf("exactly one of header and jsonField should be set in key")
+	}
+	return nil
+}
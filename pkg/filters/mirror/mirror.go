@@ -0,0 +1,544 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mirror implements the Mirror filter, which copies requests to
+// another pipeline or an arbitrary URL asynchronously.
+package mirror
+
+import (
+	"bytes"
+	stdcontext "context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/trafficcontroller"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/protocols/httpprot/httpheader"
+	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/prometheushelper"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Kind is the kind of Mirror.
+	Kind = "Mirror"
+
+	// namespace is the namespace of the pipelines defined in the static
+	// configuration.
+	namespace = "default"
+
+	defaultMaxBodySize = 1024 * 1024
+	defaultQueueSize   = 1024
+	defaultWorkers     = 4
+	defaultTimeout     = 30 * time.Second
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "Mirror copies requests to another pipeline or an arbitrary URL asynchronously",
+	Results:     []string{},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{
+			Percentage:  100,
+			MaxBodySize: defaultMaxBodySize,
+			QueueSize:   defaultQueueSize,
+			Workers:     defaultWorkers,
+		}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &Mirror{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+// All Mirror instances use one globalClient in order to reuse some
+// resources such as keepalive connections.
+var globalClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 60 * time.Second,
+		}).DialContext,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		MaxIdleConns:          10240,
+		MaxIdleConnsPerHost:   512,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var fnSendRequest = func(r *http.Request) (*http.Response, error) {
+	return globalClient.Do(r)
+}
+
+var fnGetPipeline = func(super *supervisor.Supervisor, name string) (context.Handler, bool) {
+	entity, ok := super.GetSystemController(trafficcontroller.Kind)
+	if !ok {
+		return nil, false
+	}
+	tc := entity.Instance().(*trafficcontroller.TrafficController)
+	pipeline, ok := tc.GetPipeline(namespace, name)
+	if !ok {
+		return nil, false
+	}
+	handler, ok := pipeline.Instance().(context.Handler)
+	return handler, ok
+}
+
+type (
+	// Mirror is filter Mirror.
+	Mirror struct {
+		spec    *Spec
+		timeout time.Duration
+
+		tasks   chan *task
+		done    chan struct{}
+		wg      sync.WaitGroup
+		metrics *metrics
+
+		accepted  uint64
+		dropped   uint64
+		skipped   uint64
+		failed    uint64
+		compared  uint64
+		diffs     uint64
+		statusErr uint64
+		headerErr uint64
+		bodyErr   uint64
+	}
+
+	// Spec describes the Mirror.
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+
+		TargetPipeline string                `json:"pipeline,omitempty" jsonschema:"omitempty"`
+		URL            string                `json:"url,omitempty" jsonschema:"omitempty,format=uri"`
+		Percentage     float64               `json:"percentage" jsonschema:"omitempty,minimum=0,maximum=100"`
+		MaxBodySize    int64                 `json:"maxBodySize" jsonschema:"omitempty,minimum=1"`
+		QueueSize      int                   `json:"queueSize" jsonschema:"omitempty,minimum=1"`
+		Workers        int                   `json:"workers" jsonschema:"omitempty,minimum=1"`
+		Timeout        string                `json:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+		Header         *httpheader.AdaptSpec `json:"header,omitempty" jsonschema:"omitempty"`
+		Compare        *CompareSpec          `json:"compare,omitempty" jsonschema:"omitempty"`
+	}
+
+	// CompareSpec describes how to compare the response of the mirrored
+	// request with the primary response. The status code is always
+	// compared.
+	CompareSpec struct {
+		Headers []string `json:"headers,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		Body    bool     `json:"body" jsonschema:"omitempty"`
+	}
+
+	// Status is the status of Mirror.
+	Status struct {
+		Accepted uint64 `json:"accepted"`
+		Dropped  uint64 `json:"dropped"`
+		Skipped  uint64 `json:"skipped"`
+		Failed   uint64 `json:"failed"`
+		Compared uint64 `json:"compared"`
+		Diffs    uint64 `json:"diffs"`
+
+		StatusCodeDiffs uint64 `json:"statusCodeDiffs"`
+		HeaderDiffs     uint64 `json:"headerDiffs"`
+		BodyDiffs       uint64 `json:"bodyDiffs"`
+	}
+
+	// task is a snapshot of a request to be mirrored.
+	task struct {
+		method   string
+		host     string
+		path     string
+		rawQuery string
+		header   http.Header
+		body     []byte
+
+		// primary is nil if there's no need to compare.
+		primary *response
+	}
+
+	// response is a snapshot of a response.
+	response struct {
+		statusCode int
+		header     http.Header
+		body       []byte
+	}
+)
+
+// Validate validates the Spec.
+func (s *Spec) Validate() error {
+	if (s.TargetPipeline == "") == (s.URL == "") {
+		return fmt.Errorf("one and only one of pipeline and url must be specified")
+	}
+	return nil
+}
+
+// Name returns the name of the Mirror filter instance.
+func (m *Mirror) Name() string {
+	return m.spec.Name()
+}
+
+// Kind returns the kind of Mirror.
+func (m *Mirror) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the Mirror.
+func (m *Mirror) Spec() filters.Spec {
+	return m.spec
+}
+
+// Init initializes Mirror.
+func (m *Mirror) Init() {
+	m.reload()
+}
+
+// Inherit inherits previous generation of Mirror.
+func (m *Mirror) Inherit(previousGeneration filters.Filter) {
+	m.reload()
+}
+
+func (m *Mirror) reload() {
+	m.timeout = defaultTimeout
+	if m.spec.Timeout != "" {
+		m.timeout, _ = time.ParseDuration(m.spec.Timeout)
+	}
+	if m.spec.MaxBodySize <= 0 {
+		m.spec.MaxBodySize = defaultMaxBodySize
+	}
+	if m.spec.QueueSize <= 0 {
+		m.spec.QueueSize = defaultQueueSize
+	}
+	if m.spec.Workers <= 0 {
+		m.spec.Workers = defaultWorkers
+	}
+
+	m.metrics = m.newMetrics()
+	m.tasks = make(chan *task, m.spec.QueueSize)
+	m.done = make(chan struct{})
+
+	for i := 0; i < m.spec.Workers; i++ {
+		m.wg.Add(1)
+		go m.run()
+	}
+}
+
+func (m *Mirror) run() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-m.done:
+			return
+		case t := <-m.tasks:
+			m.mirror(t)
+		}
+	}
+}
+
+func (m *Mirror) sample() bool {
+	if m.spec.Percentage >= 100 {
+		return true
+	}
+	return rand.Float64()*100 < m.spec.Percentage
+}
+
+// Handle copies the request and put it into the queue, it never changes
+// the request or the response, and always returns an empty result.
+func (m *Mirror) Handle(ctx *context.Context) string {
+	if !m.sample() {
+		return ""
+	}
+
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	if req.IsStream() || req.PayloadSize() > m.spec.MaxBodySize {
+		atomic.AddUint64(&m.skipped, 1)
+		m.metrics.inc("skipped")
+		return ""
+	}
+
+	t := &task{
+		method:   req.Method(),
+		host:     req.Host(),
+		path:     req.Path(),
+		rawQuery: req.URL().RawQuery,
+		header:   req.HTTPHeader().Clone(),
+		body:     req.RawPayload(),
+	}
+	if m.spec.Header != nil {
+		httpheader.New(t.header).Adapt(m.spec.Header)
+	}
+
+	if m.spec.Compare != nil {
+		t.primary = m.snapshotPrimary(ctx)
+	}
+
+	select {
+	case m.tasks <- t:
+		atomic.AddUint64(&m.accepted, 1)
+		m.metrics.inc("accepted")
+	default:
+		atomic.AddUint64(&m.dropped, 1)
+		m.metrics.inc("dropped")
+	}
+
+	return ""
+}
+
+// snapshotPrimary takes a snapshot of the primary response, it returns
+// nil if the response is not available, that's, the filter is not placed
+// after the one which generates the response.
+func (m *Mirror) snapshotPrimary(ctx *context.Context) *response {
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil || resp.IsStream() {
+		return nil
+	}
+
+	return &response{
+		statusCode: resp.StatusCode(),
+		header:     resp.HTTPHeader().Clone(),
+		body:       resp.RawPayload(),
+	}
+}
+
+func (m *Mirror) newRequest(ctx stdcontext.Context, t *task, url string) (*http.Request, error) {
+	stdr, err := http.NewRequestWithContext(ctx, t.method, url, bytes.NewReader(t.body))
+	if err != nil {
+		return nil, err
+	}
+	stdr.Header = t.header
+	return stdr, nil
+}
+
+func (m *Mirror) mirror(t *task) {
+	var (
+		resp *response
+		err  error
+	)
+
+	if m.spec.TargetPipeline != "" {
+		resp, err = m.mirrorToPipeline(t)
+	} else {
+		resp, err = m.mirrorToURL(t)
+	}
+
+	if err != nil {
+		logger.Debugf("%s: failed to mirror request: %v", m.Name(), err)
+		atomic.AddUint64(&m.failed, 1)
+		m.metrics.inc("failed")
+		return
+	}
+
+	if t.primary != nil {
+		m.compare(t.primary, resp)
+	}
+}
+
+func (m *Mirror) mirrorToURL(t *task) (*response, error) {
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), m.timeout)
+	defer cancel()
+
+	url := m.spec.URL + t.path
+	if t.rawQuery != "" {
+		url += "?" + t.rawQuery
+	}
+
+	stdr, err := m.newRequest(ctx, t, url)
+	if err != nil {
+		return nil, err
+	}
+
+	stdResp, err := fnSendRequest(stdr)
+	if err != nil {
+		return nil, err
+	}
+	defer stdResp.Body.Close()
+
+	resp := &response{
+		statusCode: stdResp.StatusCode,
+		header:     stdResp.Header,
+	}
+
+	if m.spec.Compare != nil && m.spec.Compare.Body {
+		resp.body, err = io.ReadAll(io.LimitReader(stdResp.Body, m.spec.MaxBodySize))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// drain off the body to reuse the connection.
+	io.Copy(io.Discard, stdResp.Body)
+	return resp, nil
+}
+
+func (m *Mirror) mirrorToPipeline(t *task) (*response, error) {
+	handler, ok := fnGetPipeline(m.spec.Super(), m.spec.TargetPipeline)
+	if !ok {
+		return nil, fmt.Errorf("pipeline %s not found", m.spec.TargetPipeline)
+	}
+
+	stdctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), m.timeout)
+	defer cancel()
+
+	url := "http://" + t.host + t.path
+	if t.rawQuery != "" {
+		url += "?" + t.rawQuery
+	}
+
+	stdr, err := m.newRequest(stdctx, t, url)
+	if err != nil {
+		return nil, err
+	}
+	stdr.Host = t.host
+
+	req, _ := httpprot.NewRequest(stdr)
+	if err = req.FetchPayload(m.spec.MaxBodySize); err != nil {
+		return nil, err
+	}
+
+	ctx := context.New(tracing.NoopSpan)
+	defer ctx.Finish()
+
+	ctx.SetRequest(context.DefaultNamespace, req)
+	handler.Handle(ctx)
+
+	r, _ := ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response)
+	if r == nil {
+		return nil, fmt.Errorf("pipeline %s returns no response", m.spec.TargetPipeline)
+	}
+
+	resp := &response{
+		statusCode: r.StatusCode(),
+		header:     r.HTTPHeader().Clone(),
+	}
+	if !r.IsStream() {
+		resp.body = r.RawPayload()
+	}
+	return resp, nil
+}
+
+func (m *Mirror) compare(primary, mirrored *response) {
+	atomic.AddUint64(&m.compared, 1)
+	m.metrics.inc("compared")
+
+	diff := false
+
+	if primary.statusCode != mirrored.statusCode {
+		diff = true
+		atomic.AddUint64(&m.statusErr, 1)
+		m.metrics.diff("statusCode")
+	}
+
+	for _, key := range m.spec.Compare.Headers {
+		if primary.header.Get(key) != mirrored.header.Get(key) {
+			diff = true
+			atomic.AddUint64(&m.headerErr, 1)
+			m.metrics.diff("header")
+			break
+		}
+	}
+
+	if m.spec.Compare.Body && !bytes.Equal(primary.body, mirrored.body) {
+		diff = true
+		atomic.AddUint64(&m.bodyErr, 1)
+		m.metrics.diff("body")
+	}
+
+	if diff {
+		atomic.AddUint64(&m.diffs, 1)
+	}
+}
+
+// Status returns status.
+func (m *Mirror) Status() interface{} {
+	return &Status{
+		Accepted:        atomic.LoadUint64(&m.accepted),
+		Dropped:         atomic.LoadUint64(&m.dropped),
+		Skipped:         atomic.LoadUint64(&m.skipped),
+		Failed:          atomic.LoadUint64(&m.failed),
+		Compared:        atomic.LoadUint64(&m.compared),
+		Diffs:           atomic.LoadUint64(&m.diffs),
+		StatusCodeDiffs: atomic.LoadUint64(&m.statusErr),
+		HeaderDiffs:     atomic.LoadUint64(&m.headerErr),
+		BodyDiffs:       atomic.LoadUint64(&m.bodyErr),
+	}
+}
+
+// Close closes Mirror, requests in the queue are discarded.
+func (m *Mirror) Close() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+type metrics struct {
+	Requests *prometheus.CounterVec
+	Diffs    *prometheus.CounterVec
+}
+
+func (m *Mirror) newMetrics() *metrics {
+	commonLabels := prometheus.Labels{
+		"filterName":   m.Name(),
+		"kind":         Kind,
+		"clusterName":  "",
+		"clusterRole":  "",
+		"instanceName": "",
+	}
+	if super := m.spec.Super(); super != nil {
+		commonLabels["clusterName"] = super.Options().ClusterName
+		commonLabels["clusterRole"] = super.Options().ClusterRole
+		commonLabels["instanceName"] = super.Options().Name
+	}
+
+	labels := []string{"clusterName", "clusterRole", "instanceName", "filterName", "kind"}
+	return &metrics{
+		Requests: prometheushelper.NewCounter("mirror_requests_total",
+			"the total count of mirrored requests by result",
+			append(labels, "result")).MustCurryWith(commonLabels),
+		Diffs: prometheushelper.NewCounter("mirror_diffs_total",
+			"the total count of differences between mirrored and primary responses by field",
+			append(labels, "field")).MustCurryWith(commonLabels),
+	}
+}
+
+func (mt *metrics) inc(result string) {
+	mt.Requests.With(prometheus.Labels{"result": result}).Inc()
+}
+
+func (mt *metrics) diff(field string) {
+	mt.Diffs.With(prometheus.Labels{"field": field}).Inc()
+}
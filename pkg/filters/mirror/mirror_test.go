@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/context/contexttest"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newTestMirror(yamlConfig string, assert *assert.Assertions) *Mirror {
+	rawSpec := make(map[string]interface{})
+	err := codectool.Unmarshal([]byte(yamlConfig), &rawSpec)
+	assert.NoError(err)
+
+	spec, err := filters.NewSpec(nil, "", rawSpec)
+	assert.NoError(err)
+
+	m := kind.CreateInstance(spec).(*Mirror)
+	m.Init()
+
+	assert.Equal(kind, m.Kind())
+	assert.Equal(spec, m.Spec())
+	return m
+}
+
+func newContext(body string) *context.Context {
+	stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/foo?a=b", strings.NewReader(body))
+	stdr.Header.Set("X-Foo", "foo")
+	req, _ := httpprot.NewRequest(stdr)
+	req.FetchPayload(0)
+
+	ctx := context.New(tracing.NoopSpan)
+	ctx.SetRequest(context.DefaultNamespace, req)
+	return ctx
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{}
+	assert.Error(spec.Validate())
+
+	spec.TargetPipeline = "pipeline"
+	assert.NoError(spec.Validate())
+
+	spec.URL = "http://127.0.0.1:8080"
+	assert.Error(spec.Validate())
+
+	spec.TargetPipeline = ""
+	assert.NoError(spec.Validate())
+}
+
+func TestMirrorToURL(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+kind: Mirror
+name: mirror
+url: http://127.0.0.1:8080
+maxBodySize: 10
+header:
+  set:
+    X-Mirror: "true"
+compare:
+  headers: ["X-Version"]
+  body: true
+`
+	m := newTestMirror(yamlConfig, assert)
+	defer m.Close()
+
+	requests := make(chan *http.Request, 10)
+	fnSendRequest = func(r *http.Request) (*http.Response, error) {
+		requests <- r
+		rw := httptest.NewRecorder()
+		rw.Header().Set("X-Version", "v2")
+		rw.WriteString("mirrored")
+		return rw.Result(), nil
+	}
+
+	ctx := newContext("hello")
+	resp, _ := httpprot.NewResponse(nil)
+	resp.HTTPHeader().Set("X-Version", "v1")
+	resp.SetPayload("primary")
+	ctx.SetResponse(context.DefaultNamespace, resp)
+
+	assert.Equal("", m.Handle(ctx))
+
+	r := <-requests
+	assert.Equal("http://127.0.0.1:8080/foo?a=b", r.URL.String())
+	assert.Equal("true", r.Header.Get("X-Mirror"))
+	assert.Equal("foo", r.Header.Get("X-Foo"))
+	body, _ := io.ReadAll(r.Body)
+	assert.Equal("hello", string(body))
+
+	assert.True(waitFor(func() bool {
+		return m.Status().(*Status).Compared == 1
+	}))
+	status := m.Status().(*Status)
+	assert.EqualValues(1, status.Accepted)
+	assert.EqualValues(1, status.Diffs)
+	assert.EqualValues(0, status.StatusCodeDiffs)
+	assert.EqualValues(1, status.HeaderDiffs)
+	assert.EqualValues(1, status.BodyDiffs)
+
+	// the original request is not modified.
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	assert.Equal("", req.HTTPHeader().Get("X-Mirror"))
+
+	// body too large
+	ctx = newContext("hello world")
+	m.Handle(ctx)
+	assert.EqualValues(1, m.Status().(*Status).Skipped)
+}
+
+func TestMirrorToPipeline(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+kind: Mirror
+name: mirror
+pipeline: shadow
+percentage: 100
+compare: {}
+`
+	m := newTestMirror(yamlConfig, assert)
+	defer m.Close()
+
+	bodies := make(chan string, 10)
+	fnGetPipeline = func(super *supervisor.Supervisor, name string) (context.Handler, bool) {
+		if name != "shadow" {
+			return nil, false
+		}
+		return &contexttest.MockedHandler{
+			MockedHandle: func(ctx *context.Context) string {
+				req := ctx.GetInputRequest().(*httpprot.Request)
+				bodies <- string(req.RawPayload())
+				resp, _ := httpprot.NewResponse(nil)
+				resp.SetStatusCode(http.StatusInternalServerError)
+				ctx.SetOutputResponse(resp)
+				return ""
+			},
+		}, true
+	}
+
+	ctx := newContext("hello")
+	resp, _ := httpprot.NewResponse(nil)
+	ctx.SetResponse(context.DefaultNamespace, resp)
+	m.Handle(ctx)
+
+	assert.Equal("hello", <-bodies)
+	assert.True(waitFor(func() bool {
+		return m.Status().(*Status).StatusCodeDiffs == 1
+	}))
+
+	// pipeline not found
+	m.spec.TargetPipeline = "notfound"
+	m.Handle(newContext("hello"))
+	assert.True(waitFor(func() bool {
+		return m.Status().(*Status).Failed == 1
+	}))
+}
+
+func TestMirrorQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	const yamlConfig = `
+kind: Mirror
+name: mirror
+url: http://127.0.0.1:8080
+queueSize: 1
+workers: 1
+`
+	m := newTestMirror(yamlConfig, assert)
+
+	block := make(chan struct{})
+	fnSendRequest = func(r *http.Request) (*http.Response, error) {
+		<-block
+		return httptest.NewRecorder().Result(), nil
+	}
+
+	for i := 0; i < 10; i++ {
+		m.Handle(newContext("hello"))
+	}
+	status := m.Status().(*Status)
+	assert.EqualValues(10, status.Accepted+status.Dropped)
+	assert.NotZero(status.Dropped)
+
+	close(block)
+	m.Close()
+}
+
+func TestSample(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &Mirror{spec: &Spec{Percentage: 0}}
+	for i := 0; i < 100; i++ {
+		assert.False(m.sample())
+	}
+
+	m.spec.Percentage = 100
+	for i := 0; i < 100; i++ {
+		assert.True(m.sample())
+	}
+}
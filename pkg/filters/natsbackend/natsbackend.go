@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package natsbackend implements a NATS proxy for HTTP requests.
+package natsbackend
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/mqhelper"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Kind is the kind of NATS
+	Kind = "NATS"
+
+	resultParseErr      = "parseErr"
+	resultPublishFailed = "publishFailed"
+
+	defaultTimeout = 5 * time.Second
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "NATS is a NATS proxy for HTTP requests",
+	Results:     []string{resultParseErr, resultPublishFailed},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &NATS{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+// conns are shared by the filter instances with the same configuration.
+var conns = mqhelper.NewPool()
+
+type (
+	// NATS is a NATS proxy for HTTP requests.
+	NATS struct {
+		spec    *Spec
+		conn    *nats.Conn
+		js      nats.JetStreamContext
+		key     string
+		timeout time.Duration
+	}
+
+	// conn wraps nats.Conn to be an io.Closer.
+	conn struct {
+		*nats.Conn
+	}
+)
+
+var _ filters.Filter = (*NATS)(nil)
+
+func (c conn) Close() error {
+	c.Conn.Close()
+	return nil
+}
+
+// Name returns the name of the NATS filter instance.
+func (n *NATS) Name() string {
+	return n.spec.Name()
+}
+
+// Kind return kind of NATS
+func (n *NATS) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the NATS
+func (n *NATS) Spec() filters.Spec {
+	return n.spec
+}
+
+// Init init NATS
+func (n *NATS) Init() {
+	spec := n.spec
+	n.timeout = defaultTimeout
+	if spec.Timeout != "" {
+		n.timeout, _ = time.ParseDuration(spec.Timeout)
+	}
+
+	n.key = fmt.Sprintf("%s/%s/%s/%s", spec.URL, spec.Username, spec.Password, spec.Token)
+	c, err := conns.Get(n.key, func() (io.Closer, error) {
+		opts := []nats.Option{
+			nats.Name("easegress"),
+			// the connection is established in background if the servers
+			// are not available now.
+			nats.RetryOnFailedConnect(true),
+			nats.MaxReconnects(-1),
+		}
+		if spec.Username != "" {
+			opts = append(opts, nats.UserInfo(spec.Username, spec.Password))
+		}
+		if spec.Token != "" {
+			opts = append(opts, nats.Token(spec.Token))
+		}
+		nc, err := nats.Connect(spec.URL, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return conn{nc}, nil
+	})
+	if err != nil {
+		panic(fmt.Errorf("connect to nats %s failed: %v", spec.URL, err))
+	}
+	n.conn = c.(conn).Conn
+
+	if spec.JetStream {
+		js, err := n.conn.JetStream()
+		if err != nil {
+			panic(fmt.Errorf("create jetstream context failed: %v", err))
+		}
+		n.js = js
+	}
+}
+
+// Inherit init NATS based on previous generation
+func (n *NATS) Inherit(previousGeneration filters.Filter) {
+	n.Init()
+}
+
+// Close close NATS
+func (n *NATS) Close() {
+	if err := conns.Put(n.key); err != nil {
+		logger.Errorf("close nats connection failed: %v", err)
+	}
+}
+
+// Status return status of NATS
+func (n *NATS) Status() interface{} {
+	return nil
+}
+
+// Handle handles the context.
+func (n *NATS) Handle(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	subject := n.spec.Subject.Topic(req.HTTPHeader())
+
+	body, err := io.ReadAll(req.GetPayload())
+	if err != nil {
+		return resultParseErr
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Data = body
+	for k, v := range mqhelper.Properties(req.HTTPHeader(), n.spec.Headers) {
+		msg.Header.Set(k, v)
+	}
+
+	if n.js == nil {
+		err = n.conn.PublishMsg(msg)
+	} else {
+		timeoutCtx, cancel := stdcontext.WithTimeout(stdcontext.Background(), n.timeout)
+		defer cancel()
+		_, err = n.js.PublishMsg(msg, nats.Context(timeoutCtx))
+	}
+	if err != nil {
+		logger.Errorf("publish message to nats subject %s failed: %v", subject, err)
+		resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+		if resp == nil {
+			resp, _ = httpprot.NewResponse(nil)
+		}
+		resp.SetStatusCode(http.StatusServiceUnavailable)
+		ctx.SetOutputResponse(resp)
+		return resultPublishFailed
+	}
+	return ""
+}
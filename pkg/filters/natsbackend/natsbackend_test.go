@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package natsbackend
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/mqhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+type (
+	// mockServer is a minimal NATS server, which records the published
+	// messages, and acks the messages published with a reply subject like
+	// JetStream.
+	mockServer struct {
+		sync.Mutex
+		listener net.Listener
+		msgs     []*mockMsg
+		ackErr   string
+		conns    int
+	}
+
+	mockMsg struct {
+		subject string
+		header  string
+		data    string
+	}
+)
+
+func newMockServer(t *testing.T) *mockServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &mockServer{listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *mockServer) url() string {
+	return "nats://" + s.listener.Addr().String()
+}
+
+func (s *mockServer) messages() []*mockMsg {
+	s.Lock()
+	defer s.Unlock()
+	return s.msgs
+}
+
+func (s *mockServer) serve(c net.Conn) {
+	defer c.Close()
+	s.Lock()
+	s.conns++
+	s.Unlock()
+
+	fmt.Fprintf(c, "INFO {\"server_id\":\"mock\",\"version\":\"2.9.0\",\"proto\":1,\"headers\":true,\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(c)
+	sids := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			fmt.Fprintf(c, "PONG\r\n")
+		case "SUB":
+			// SUB <subject> [queue] <sid>, the subject is a wildcard inbox
+			sids[strings.TrimSuffix(fields[1], "*")] = fields[len(fields)-1]
+		case "PUB", "HPUB":
+			msg := &mockMsg{subject: fields[1]}
+			reply := ""
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			headerSize := 0
+			if fields[0] == "HPUB" {
+				headerSize, _ = strconv.Atoi(fields[len(fields)-2])
+				if len(fields) == 5 {
+					reply = fields[2]
+				}
+			} else if len(fields) == 4 {
+				reply = fields[2]
+			}
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			msg.header, msg.data = string(buf[:headerSize]), string(buf[headerSize:size])
+
+			s.Lock()
+			ackErr := s.ackErr
+			if ackErr == "" {
+				s.msgs = append(s.msgs, msg)
+			}
+			s.Unlock()
+
+			if reply == "" {
+				continue
+			}
+			ack := `{"stream":"events","seq":1}`
+			if ackErr != "" {
+				ack = fmt.Sprintf(`{"error":{"code":500,"err_code":10000,"description":%q}}`, ackErr)
+			}
+			for prefix, sid := range sids {
+				if strings.HasPrefix(reply, prefix) {
+					fmt.Fprintf(c, "MSG %s %s %d\r\n%s\r\n", reply, sid, len(ack), ack)
+				}
+			}
+		}
+	}
+}
+
+func newFilter(t *testing.T, spec *Spec) *NATS {
+	spec.BaseSpec.MetaSpec.Kind = Kind
+	spec.BaseSpec.MetaSpec.Name = "nats"
+	filterSpec, err := filters.NewSpec(nil, "pipeline-demo", spec)
+	assert.Nil(t, err)
+	n := kind.CreateInstance(filterSpec).(*NATS)
+	n.Init()
+	return n
+}
+
+func newContext(t *testing.T, body string, header map[string]string) *context.Context {
+	ctx := context.New(nil)
+	stdReq, err := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range header {
+		stdReq.Header.Set(k, v)
+	}
+	req, err := httpprot.NewRequest(stdReq)
+	assert.Nil(t, err)
+	assert.Nil(t, req.FetchPayload(1024*1024))
+	ctx.SetInputRequest(req)
+	return ctx
+}
+
+func TestNATS(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newMockServer(t)
+	defer server.listener.Close()
+
+	n := newFilter(t, &Spec{
+		URL: server.url(),
+		Subject: &mqhelper.TopicSpec{
+			Default: "events",
+			Dynamic: &mqhelper.DynamicSpec{Header: "X-Subject"},
+		},
+		Headers: map[string]string{"X-Request-Id": "Request-Id"},
+	})
+	defer n.Close()
+	assert.Equal("nats", n.Name())
+	assert.Equal(kind, n.Kind())
+	assert.Nil(n.Status())
+	assert.Eventually(n.conn.IsConnected, 5*time.Second, 10*time.Millisecond)
+
+	assert.Equal("", n.Handle(newContext(t, "hello", map[string]string{"X-Request-Id": "123"})))
+	assert.Equal("", n.Handle(newContext(t, "world", map[string]string{"X-Subject": "others"})))
+	assert.Nil(n.conn.Flush())
+
+	msgs := server.messages()
+	assert.Equal(2, len(msgs))
+	assert.Equal("events", msgs[0].subject)
+	assert.Equal("hello", msgs[0].data)
+	assert.Contains(msgs[0].header, "Request-Id: 123")
+	assert.Equal("others", msgs[1].subject)
+	assert.Equal("world", msgs[1].data)
+
+	// filters with the same configuration share the connection
+	js := newFilter(t, &Spec{
+		URL:       server.url(),
+		Subject:   &mqhelper.TopicSpec{Default: "events"},
+		JetStream: true,
+		Timeout:   "1s",
+	})
+	defer js.Close()
+	assert.Same(n.conn, js.conn)
+
+	assert.Equal("", js.Handle(newContext(t, "acked", nil)))
+	assert.Equal(3, len(server.messages()))
+
+	server.Lock()
+	server.ackErr = "mock error"
+	server.Unlock()
+	ctx := newContext(t, "failed", nil)
+	assert.Equal(resultPublishFailed, js.Handle(ctx))
+	assert.Equal(http.StatusServiceUnavailable, ctx.GetOutputResponse().(*httpprot.Response).StatusCode())
+
+	server.Lock()
+	assert.Equal(1, server.conns)
+	server.Unlock()
+}
+
+func TestSpec(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil((&Spec{Timeout: "1s"}).Validate())
+	assert.NotNil((&Spec{Timeout: "1"}).Validate())
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package natsbackend
+
+import (
+	"time"
+
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/util/mqhelper"
+)
+
+type (
+	// Spec is spec of NATS
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+
+		// URL is the URL of NATS servers, separated by commas.
+		URL      string `json:"url" jsonschema:"required"`
+		Username string `json:"username,omitempty" jsonschema:"omitempty"`
+		Password string `json:"password,omitempty" jsonschema:"omitempty"`
+		Token    string `json:"token,omitempty" jsonschema:"omitempty"`
+
+		Subject *mqhelper.TopicSpec `json:"subject" jsonschema:"required"`
+		// Headers maps HTTP headers to NATS headers.
+		Headers map[string]string `json:"headers,omitempty" jsonschema:"omitempty"`
+		// JetStream waits for the acks of JetStream, and the failures are
+		// returned to the pipeline.
+		JetStream bool   `json:"jetStream,omitempty" jsonschema:"omitempty"`
+		Timeout   string `json:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+)
+
+// Validate validates the Spec.
+func (spec *Spec) Validate() error {
+	if spec.Timeout != "" {
+		if _, err := time.ParseDuration(spec.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,650 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package openapivalidator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// maxRefDepth is the maximum depth of following references, to avoid
+// infinite loops caused by circular references.
+const maxRefDepth = 32
+
+// methods are the methods of the operations in a path item.
+var methods = []string{
+	http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete,
+	http.MethodOptions, http.MethodHead, http.MethodPatch, http.MethodTrace,
+}
+
+var pathParamRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+
+type (
+	// Document is a parsed OpenAPI 3.0 or 3.1 document.
+	Document struct {
+		// Version is the OpenAPI version of the document.
+		Version string
+		// Title is the title of the API.
+		Title string
+		// Servers are the URLs of the servers, the variables are replaced
+		// by their default values.
+		Servers []string
+		// Operations are the operations of the document, sorted by path.
+		Operations []*Operation
+
+		raw map[string]interface{}
+		// v31 is true for OpenAPI 3.1 documents, whose schemas are JSON
+		// schema 2020-12.
+		v31       bool
+		basePaths []string
+		routes    []*Operation
+	}
+
+	// Operation is an operation of the OpenAPI document.
+	Operation struct {
+		Method      string
+		Path        string
+		OperationID string
+
+		pathRegexp *regexp.Regexp
+		pathParams []string
+		params     []*parameter
+		body       *requestBody
+		responses  map[string]content
+	}
+
+	parameter struct {
+		name     string
+		in       string
+		required bool
+		explode  bool
+		typ      string
+		itemType string
+		schema   schema
+	}
+
+	requestBody struct {
+		required bool
+		content  content
+	}
+
+	// content maps media types to their schemas, the schema is nil if it
+	// is not specified.
+	content map[string]schema
+
+	// schema is a compiled JSON schema of the document.
+	schema interface {
+		// validate validates a value decoded from JSON, and returns the
+		// violations.
+		validate(v interface{}) []*schemaError
+	}
+
+	// schemaError is a violation of a schema, field is empty if the
+	// violation is of the root value.
+	schemaError struct {
+		field  string
+		reason string
+	}
+
+	// draft4Schema is a schema of OpenAPI 3.0, which is validated as a
+	// JSON schema draft 4.
+	draft4Schema struct {
+		s *gojsonschema.Schema
+	}
+
+	// draft2020Schema is a schema of OpenAPI 3.1, which is a JSON schema
+	// 2020-12.
+	draft2020Schema struct {
+		s *jsonschema.Schema
+	}
+)
+
+// ParseDocument parses an OpenAPI 3.0 or 3.1 document in YAML or JSON.
+func ParseDocument(data []byte) (*Document, error) {
+	raw := map[string]interface{}{}
+	if err := codectool.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unmarshal document failed: %v", err)
+	}
+
+	d := &Document{raw: raw}
+	d.Version, _ = raw["openapi"].(string)
+	switch {
+	case strings.HasPrefix(d.Version, "3.0."):
+	case strings.HasPrefix(d.Version, "3.1."):
+		d.v31 = true
+	default:
+		return nil, fmt.Errorf("unsupported OpenAPI version %q, only 3.0.x and 3.1.x are supported", d.Version)
+	}
+	if info, ok := raw["info"].(map[string]interface{}); ok {
+		d.Title, _ = info["title"].(string)
+	}
+
+	if components, ok := raw["components"].(map[string]interface{}); ok && !d.v31 {
+		normalizeSchema(components["schemas"])
+	}
+
+	if err := d.parseServers(); err != nil {
+		return nil, err
+	}
+	if err := d.parsePaths(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Document) parseServers() error {
+	servers, _ := d.raw["servers"].([]interface{})
+	for _, s := range servers {
+		server, err := d.resolve(s)
+		if err != nil {
+			return err
+		}
+
+		u, _ := server["url"].(string)
+		vars, _ := server["variables"].(map[string]interface{})
+		for name, v := range vars {
+			v, _ := v.(map[string]interface{})
+			def := fmt.Sprint(v["default"])
+			u = strings.ReplaceAll(u, "{"+name+"}", def)
+		}
+		d.Servers = append(d.Servers, u)
+
+		pu, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid server url %q: %v", u, err)
+		}
+		d.basePaths = append(d.basePaths, strings.TrimSuffix(pu.Path, "/"))
+	}
+
+	if len(d.basePaths) == 0 {
+		d.basePaths = []string{""}
+	}
+	// try longer base paths first.
+	sort.SliceStable(d.basePaths, func(i, j int) bool {
+		return len(d.basePaths[i]) > len(d.basePaths[j])
+	})
+	return nil
+}
+
+func (d *Document) parsePaths() error {
+	paths, _ := d.raw["paths"].(map[string]interface{})
+
+	keys := make([]string, 0, len(paths))
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, path := range keys {
+		item, err := d.resolve(paths[path])
+		if err != nil {
+			return fmt.Errorf("path %s: %v", path, err)
+		}
+
+		for _, method := range methods {
+			op, ok := item[strings.ToLower(method)].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			o, err := d.parseOperation(method, path, item, op)
+			if err != nil {
+				return fmt.Errorf("operation %s %s: %v", method, path, err)
+			}
+			d.Operations = append(d.Operations, o)
+		}
+	}
+
+	// paths without templates must be matched before templated ones,
+	// for example, /pets/mine before /pets/{id}.
+	d.routes = append([]*Operation(nil), d.Operations...)
+	sort.SliceStable(d.routes, func(i, j int) bool {
+		return len(d.routes[i].pathParams) < len(d.routes[j].pathParams)
+	})
+	return nil
+}
+
+func (d *Document) parseOperation(method, path string, item, op map[string]interface{}) (*Operation, error) {
+	o := &Operation{Method: method, Path: path}
+	o.OperationID, _ = op["operationId"].(string)
+
+	expr := "^"
+	last := 0
+	for _, m := range pathParamRegexp.FindAllStringSubmatchIndex(path, -1) {
+		expr += regexp.QuoteMeta(path[last:m[0]]) + "([^/]+)"
+		o.pathParams = append(o.pathParams, path[m[2]:m[3]])
+		last = m[1]
+	}
+	expr += regexp.QuoteMeta(path[last:]) + "$"
+	o.pathRegexp = regexp.MustCompile(expr)
+
+	// parameters of the operation override the ones of the path item.
+	var params []*parameter
+	for _, list := range []interface{}{item["parameters"], op["parameters"]} {
+		list, _ := list.([]interface{})
+		for _, p := range list {
+			param, err := d.parseParameter(p)
+			if err != nil {
+				return nil, err
+			}
+			for i, prev := range params {
+				if prev.in == param.in && prev.name == param.name {
+					params = append(params[:i], params[i+1:]...)
+					break
+				}
+			}
+			params = append(params, param)
+		}
+	}
+	o.params = params
+
+	if rb, ok := op["requestBody"]; ok {
+		rb, err := d.resolve(rb)
+		if err != nil {
+			return nil, err
+		}
+		o.body = &requestBody{}
+		o.body.required, _ = rb["required"].(bool)
+		if o.body.content, err = d.parseContent(rb["content"]); err != nil {
+			return nil, fmt.Errorf("request body: %v", err)
+		}
+	}
+
+	responses, _ := op["responses"].(map[string]interface{})
+	o.responses = make(map[string]content, len(responses))
+	for code, r := range responses {
+		r, err := d.resolve(r)
+		if err != nil {
+			return nil, err
+		}
+		c, err := d.parseContent(r["content"])
+		if err != nil {
+			return nil, fmt.Errorf("response %s: %v", code, err)
+		}
+		o.responses[strings.ToUpper(code)] = c
+	}
+
+	return o, nil
+}
+
+func (d *Document) parseParameter(node interface{}) (*parameter, error) {
+	p, err := d.resolve(node)
+	if err != nil {
+		return nil, err
+	}
+
+	param := &parameter{}
+	param.name, _ = p["name"].(string)
+	param.in, _ = p["in"].(string)
+	param.required, _ = p["required"].(bool)
+	if param.name == "" || param.in == "" {
+		return nil, fmt.Errorf("name and in of parameters are required")
+	}
+	if param.in == "header" {
+		param.name = http.CanonicalHeaderKey(param.name)
+	}
+
+	style, _ := p["style"].(string)
+	if explode, ok := p["explode"].(bool); ok {
+		param.explode = explode
+	} else {
+		param.explode = style == "" && (param.in == "query" || param.in == "cookie") || style == "form"
+	}
+
+	schema, ok := p["schema"]
+	if !ok {
+		return param, nil
+	}
+
+	s, err := d.resolve(schema)
+	if err != nil {
+		return nil, err
+	}
+	param.typ = schemaType(s)
+	if items, ok := s["items"]; ok {
+		items, err := d.resolve(items)
+		if err != nil {
+			return nil, err
+		}
+		param.itemType = schemaType(items)
+	}
+
+	if param.schema, err = d.compileSchema(schema); err != nil {
+		return nil, fmt.Errorf("parameter %s: %v", param.name, err)
+	}
+	return param, nil
+}
+
+func (d *Document) parseContent(node interface{}) (content, error) {
+	m, _ := node.(map[string]interface{})
+	c := make(content, len(m))
+	for mediaType, mt := range m {
+		mt, err := d.resolve(mt)
+		if err != nil {
+			return nil, err
+		}
+
+		var schema schema
+		if s, ok := mt["schema"]; ok {
+			if schema, err = d.compileSchema(s); err != nil {
+				return nil, fmt.Errorf("media type %s: %v", mediaType, err)
+			}
+		}
+		c[strings.ToLower(mediaType)] = schema
+	}
+	return c, nil
+}
+
+// compileSchema compiles a schema of the document, the components of the
+// document are put into the root of the schema, so that references to them
+// can be resolved.
+func (d *Document) compileSchema(s interface{}) (schema, error) {
+	root := s
+	if m, ok := s.(map[string]interface{}); ok {
+		r := make(map[string]interface{}, len(m)+1)
+		for k, v := range m {
+			r[k] = v
+		}
+		if components, ok := d.raw["components"]; ok {
+			r["components"] = components
+		}
+		root = r
+	}
+
+	if d.v31 {
+		return compileDraft2020Schema(root)
+	}
+
+	normalizeSchema(root)
+	gs, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(root))
+	if err != nil {
+		return nil, err
+	}
+	return &draft4Schema{s: gs}, nil
+}
+
+// schemaURL is the URL of the schemas of OpenAPI 3.1 documents, it is only
+// used to identify the schemas, nothing is loaded from it.
+const schemaURL = "mem:///openapi/schema.json"
+
+func compileDraft2020Schema(root interface{}) (schema, error) {
+	data, err := json.Marshal(root)
+	if err != nil {
+		return nil, err
+	}
+
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	c.AssertFormat = true
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external reference %s is not supported", s)
+	}
+	if err = c.AddResource(schemaURL, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	js, err := c.Compile(schemaURL)
+	if err != nil {
+		return nil, err
+	}
+	return &draft2020Schema{s: js}, nil
+}
+
+func (s *draft4Schema) validate(v interface{}) []*schemaError {
+	result, err := s.s.Validate(gojsonschema.NewGoLoader(v))
+	if err != nil {
+		return []*schemaError{{reason: err.Error()}}
+	}
+
+	var errs []*schemaError
+	for _, e := range result.Errors() {
+		se := &schemaError{reason: e.Description()}
+		if field := e.Field(); field != gojsonschema.STRING_CONTEXT_ROOT {
+			se.field = field
+		}
+		errs = append(errs, se)
+	}
+	return errs
+}
+
+func (s *draft2020Schema) validate(v interface{}) []*schemaError {
+	err := s.s.Validate(v)
+	if err == nil {
+		return nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []*schemaError{{reason: err.Error()}}
+	}
+
+	// only the leaves are reported, the others just say which subschema
+	// is failed.
+	var errs []*schemaError
+	var walk func(ve *jsonschema.ValidationError)
+	walk = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) > 0 {
+			for _, c := range ve.Causes {
+				walk(c)
+			}
+			return
+		}
+		field := strings.ReplaceAll(strings.TrimPrefix(ve.InstanceLocation, "/"), "/", ".")
+		errs = append(errs, &schemaError{field: field, reason: ve.Message})
+	}
+	walk(ve)
+	return errs
+}
+
+// resolve follows the references of a node until it gets an object.
+func (d *Document) resolve(node interface{}) (map[string]interface{}, error) {
+	for i := 0; i < maxRefDepth; i++ {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid object: %v", node)
+		}
+
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return m, nil
+		}
+		if !strings.HasPrefix(ref, "#/") {
+			return nil, fmt.Errorf("external reference %s is not supported", ref)
+		}
+
+		node = d.raw
+		for _, token := range strings.Split(ref[2:], "/") {
+			token, _ = url.PathUnescape(token)
+			token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+			switch n := node.(type) {
+			case map[string]interface{}:
+				node = n[token]
+			case []interface{}:
+				idx, err := strconv.Atoi(token)
+				if err != nil || idx < 0 || idx >= len(n) {
+					return nil, fmt.Errorf("invalid reference %s", ref)
+				}
+				node = n[idx]
+			default:
+				return nil, fmt.Errorf("invalid reference %s", ref)
+			}
+		}
+		if node == nil {
+			return nil, fmt.Errorf("invalid reference %s", ref)
+		}
+	}
+	return nil, fmt.Errorf("too many levels of references")
+}
+
+// normalizeSchema converts the OpenAPI 3.0 specific keyword 'nullable' to
+// the JSON schema equivalent in place.
+func normalizeSchema(node interface{}) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if nullable, ok := n["nullable"].(bool); ok {
+			delete(n, "nullable")
+			if typ, ok := n["type"].(string); ok && nullable {
+				n["type"] = []interface{}{typ, "null"}
+			}
+			if enum, ok := n["enum"].([]interface{}); ok && nullable {
+				n["enum"] = append(enum, nil)
+			}
+		}
+		for _, v := range n {
+			normalizeSchema(v)
+		}
+	case []interface{}:
+		for _, v := range n {
+			normalizeSchema(v)
+		}
+	}
+}
+
+// schemaType returns the type of a schema, the 'null' type is ignored if
+// there are multiple types.
+func schemaType(schema map[string]interface{}) string {
+	switch t := schema["type"].(type) {
+	case string:
+		return t
+	case []interface{}:
+		for _, v := range t {
+			if s, _ := v.(string); s != "null" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// findOperation finds the operation matching the method and path, it also
+// returns the values of the path parameters. If there is no matched
+// operation, it returns the allowed methods of the path.
+func (d *Document) findOperation(method, path string) (*Operation, map[string]string, []string) {
+	var allowed []string
+	for _, base := range d.basePaths {
+		if !strings.HasPrefix(path, base) {
+			continue
+		}
+		p := path[len(base):]
+		if p == "" {
+			p = "/"
+		} else if p[0] != '/' {
+			continue
+		}
+
+		for _, op := range d.routes {
+			match := op.pathRegexp.FindStringSubmatch(p)
+			if match == nil {
+				continue
+			}
+			if op.Method != method {
+				if !stringtool.StrInSlice(op.Method, allowed) {
+					allowed = append(allowed, op.Method)
+				}
+				continue
+			}
+
+			values := make(map[string]string, len(op.pathParams))
+			for i, name := range op.pathParams {
+				values[name], _ = url.PathUnescape(match[i+1])
+			}
+			return op, values, nil
+		}
+	}
+	return nil, nil, allowed
+}
+
+// find finds the schema of a content type, it returns false if the content
+// type is not allowed.
+func (c content) find(contentType string) (schema, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+
+	candidates := []string{mediaType}
+	if idx := strings.IndexByte(mediaType, '/'); idx > 0 {
+		candidates = append(candidates, mediaType[:idx]+"/*")
+	}
+	candidates = append(candidates, "*/*")
+
+	for _, mt := range candidates {
+		if schema, ok := c[mt]; ok {
+			return schema, true
+		}
+	}
+	return nil, false
+}
+
+// isJSON returns whether the content type is JSON.
+func isJSON(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// convert converts the string values of the parameter to the type of its
+// schema, values which can not be converted are kept as strings, so that
+// they are reported by the schema validation.
+func (p *parameter) convert(values []string) interface{} {
+	if p.typ != "array" {
+		return convertValue(values[0], p.typ)
+	}
+
+	if !p.explode || p.in != "query" {
+		var splitted []string
+		for _, v := range values {
+			splitted = append(splitted, strings.Split(v, ",")...)
+		}
+		values = splitted
+	}
+
+	result := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		result = append(result, convertValue(v, p.itemType))
+	}
+	return result
+}
+
+func convertValue(v string, typ string) interface{} {
+	switch typ {
+	case "integer":
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i
+		}
+	case "number":
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return v
+}
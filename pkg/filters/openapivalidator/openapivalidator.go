@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package openapivalidator provides the OpenAPIValidator filter, which
+// validates requests and responses against an OpenAPI 3 document.
+package openapivalidator
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/cluster/customdata"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/codectool"
+)
+
+const (
+	// Kind is the kind of OpenAPIValidator.
+	Kind = "OpenAPIValidator"
+
+	resultInvalid = "invalid"
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "OpenAPIValidator validates requests and responses against an OpenAPI 3 document.",
+	Results:     []string{resultInvalid},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &OpenAPIValidator{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+type (
+	// OpenAPIValidator is filter OpenAPIValidator.
+	OpenAPIValidator struct {
+		spec *Spec
+
+		cluster cluster.Cluster
+		doc     atomic.Value
+		stopCtx stdcontext.Context
+		cancel  stdcontext.CancelFunc
+	}
+
+	// Spec describes the OpenAPIValidator.
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+
+		// Document is the OpenAPI document in YAML or JSON.
+		Document string `json:"document,omitempty" jsonschema:"omitempty"`
+		// CustomData refers to the custom data which holds the document.
+		CustomData *CustomDataRef `json:"customData,omitempty" jsonschema:"omitempty"`
+		// ValidateResponse validates responses too, but violations are
+		// only logged.
+		ValidateResponse bool `json:"validateResponse,omitempty" jsonschema:"omitempty"`
+		// AllowUnknownOperations lets requests which do not match any
+		// operation of the document pass.
+		AllowUnknownOperations bool `json:"allowUnknownOperations,omitempty" jsonschema:"omitempty"`
+	}
+
+	// CustomDataRef refers to a custom data.
+	CustomDataRef struct {
+		Kind string `json:"kind" jsonschema:"required"`
+		ID   string `json:"id" jsonschema:"required"`
+		// Field is the field which holds the document, either as a string
+		// or an object, the custom data itself is the document if empty.
+		Field string `json:"field,omitempty" jsonschema:"omitempty"`
+	}
+)
+
+// Validate validates the Spec.
+func (s *Spec) Validate() error {
+	if (s.Document == "") == (s.CustomData == nil) {
+		return fmt.Errorf("one and only one of document and customData must be specified")
+	}
+	if s.Document != "" {
+		if _, err := ParseDocument([]byte(s.Document)); err != nil {
+			return fmt.Errorf("invalid document: %v", err)
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the OpenAPIValidator filter instance.
+func (v *OpenAPIValidator) Name() string {
+	return v.spec.Name()
+}
+
+// Kind returns the kind of OpenAPIValidator.
+func (v *OpenAPIValidator) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the OpenAPIValidator
+func (v *OpenAPIValidator) Spec() filters.Spec {
+	return v.spec
+}
+
+// Init initializes OpenAPIValidator.
+func (v *OpenAPIValidator) Init() {
+	v.reload()
+}
+
+// Inherit inherits previous generation of OpenAPIValidator.
+func (v *OpenAPIValidator) Inherit(previousGeneration filters.Filter) {
+	// keep serving the document of the previous generation until the
+	// watcher delivers a new one.
+	prev := previousGeneration.(*OpenAPIValidator)
+	if v.spec.CustomData != nil && prev.spec.CustomData != nil &&
+		*v.spec.CustomData == *prev.spec.CustomData {
+		if doc := prev.doc.Load(); doc != nil {
+			v.doc.Store(doc)
+		}
+	}
+	v.reload()
+}
+
+func (v *OpenAPIValidator) reload() {
+	v.stopCtx, v.cancel = stdcontext.WithCancel(stdcontext.Background())
+
+	if v.spec.Document != "" {
+		doc, err := ParseDocument([]byte(v.spec.Document))
+		if err != nil {
+			logger.Errorf("%s: parse document failed: %v", v.Name(), err)
+			return
+		}
+		v.doc.Store(doc)
+		return
+	}
+
+	if v.cluster == nil && v.spec.Super() != nil {
+		v.cluster = v.spec.Super().Cluster()
+	}
+	if v.cluster == nil {
+		logger.Errorf("%s: cluster is not available to load the custom data", v.Name())
+		return
+	}
+	go v.watchCustomData()
+}
+
+// watchCustomData loads the document from the custom data, and reloads
+// it on changes.
+func (v *OpenAPIValidator) watchCustomData() {
+	ref := v.spec.CustomData
+	layout := v.cluster.Layout()
+	store := customdata.NewStore(v.cluster, layout.CustomDataKindPrefix(), layout.CustomDataPrefix())
+	key := store.DataKey(ref.Kind, ref.ID)
+
+	var (
+		syncer cluster.Syncer
+		err    error
+		ch     <-chan *string
+	)
+
+	for {
+		syncer, err = v.cluster.Syncer(10 * time.Minute)
+		if err != nil {
+			logger.Errorf("%s: failed to create syncer: %v", v.Name(), err)
+		} else if ch, err = syncer.Sync(key); err != nil {
+			logger.Errorf("%s: failed to sync custom data %s: %v", v.Name(), key, err)
+			syncer.Close()
+		} else {
+			break
+		}
+
+		select {
+		case <-time.After(10 * time.Second):
+		case <-v.stopCtx.Done():
+			return
+		}
+	}
+
+	defer syncer.Close()
+	for {
+		select {
+		case <-v.stopCtx.Done():
+			return
+		case value := <-ch:
+			if value == nil {
+				logger.Errorf("%s: custom data %s/%s not found", v.Name(), ref.Kind, ref.ID)
+				continue
+			}
+			doc, err := parseCustomData([]byte(*value), ref.Field)
+			if err != nil {
+				logger.Errorf("%s: parse document in custom data %s/%s failed: %v", v.Name(), ref.Kind, ref.ID, err)
+				continue
+			}
+			logger.Infof("%s: document in custom data %s/%s loaded", v.Name(), ref.Kind, ref.ID)
+			v.doc.Store(doc)
+		}
+	}
+}
+
+func parseCustomData(value []byte, field string) (*Document, error) {
+	if field == "" {
+		return ParseDocument(value)
+	}
+
+	data := customdata.Data{}
+	if err := codectool.Unmarshal(value, &data); err != nil {
+		return nil, err
+	}
+
+	switch doc := data[field].(type) {
+	case string:
+		return ParseDocument([]byte(doc))
+	case map[string]interface{}:
+		return ParseDocument(codectool.MustMarshalJSON(doc))
+	default:
+		return nil, fmt.Errorf("field %s is not a string or an object", field)
+	}
+}
+
+// Handle validates the request in the context.
+func (v *OpenAPIValidator) Handle(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+
+	doc, _ := v.doc.Load().(*Document)
+	if doc == nil {
+		return v.reject(ctx, newProblem(http.StatusInternalServerError, "the OpenAPI document is not loaded"), nil)
+	}
+
+	op, pathValues, allowed := doc.findOperation(req.Method(), req.Path())
+	if op == nil {
+		if v.spec.AllowUnknownOperations {
+			return ""
+		}
+		if len(allowed) == 0 {
+			return v.reject(ctx, newProblem(http.StatusNotFound, "no operation matches the request"), nil)
+		}
+		header := http.Header{"Allow": []string{strings.Join(allowed, ", ")}}
+		return v.reject(ctx, newProblem(http.StatusMethodNotAllowed, "method is not allowed"), header)
+	}
+
+	if p := op.validateRequest(req, pathValues); p != nil {
+		return v.reject(ctx, p, nil)
+	}
+
+	if v.spec.ValidateResponse {
+		ctx.OnFinish(func() {
+			resp, _ := ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response)
+			if resp == nil {
+				return
+			}
+			if invalidParams := op.validateResponse(resp); len(invalidParams) > 0 {
+				p := &problem{Detail: "response validation failed", InvalidParams: invalidParams}
+				logger.Warnf("%s: %s %s: %s", v.Name(), op.Method, op.Path, p)
+			}
+		})
+	}
+
+	return ""
+}
+
+func (v *OpenAPIValidator) reject(ctx *context.Context, p *problem, header http.Header) string {
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil {
+		resp, _ = httpprot.NewResponse(nil)
+	}
+
+	for k, values := range header {
+		resp.HTTPHeader()[k] = values
+	}
+	resp.HTTPHeader().Set("Content-Type", contentTypeProblem)
+	resp.SetStatusCode(p.Status)
+	resp.SetPayload(codectool.MustMarshalJSON(p))
+	ctx.SetOutputResponse(resp)
+
+	ctx.AddTag("openAPIValidator: " + p.String())
+	return resultInvalid
+}
+
+// Status returns status.
+func (v *OpenAPIValidator) Status() interface{} { return nil }
+
+// Close closes OpenAPIValidator.
+func (v *OpenAPIValidator) Close() {
+	if v.cancel != nil {
+		v.cancel()
+	}
+}
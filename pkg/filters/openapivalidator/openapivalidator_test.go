@@ -0,0 +1,559 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package openapivalidator
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/stretchr/testify/assert"
+)
+
+const petstore = `
+openapi: 3.0.3
+info:
+  title: Petstore
+  version: 1.0.0
+servers:
+- url: http://petstore.example.com/{version}
+  variables:
+    version:
+      default: v1
+paths:
+  /pets:
+    get:
+      operationId: listPets
+      parameters:
+      - name: limit
+        in: query
+        schema:
+          type: integer
+          maximum: 100
+      - name: tags
+        in: query
+        explode: false
+        schema:
+          type: array
+          items:
+            type: string
+            enum: [cat, dog]
+      responses:
+        "200":
+          description: pets
+          content:
+            application/json:
+              schema:
+                type: array
+                items:
+                  $ref: '#/components/schemas/Pet'
+    post:
+      operationId: createPet
+      parameters:
+      - $ref: '#/components/parameters/RequestID'
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/Pet'
+      responses:
+        "201":
+          description: created
+        default:
+          description: error
+          content:
+            application/problem+json: {}
+  /pets/mine:
+    get:
+      operationId: listMyPets
+      responses:
+        2XX:
+          description: pets
+  /pets/{petId}:
+    parameters:
+    - name: petId
+      in: path
+      required: true
+      schema:
+        type: integer
+    get:
+      operationId: getPet
+      responses:
+        "200":
+          description: pet
+components:
+  parameters:
+    RequestID:
+      name: x-request-id
+      in: header
+      required: true
+      schema:
+        type: string
+        format: uuid
+  schemas:
+    Pet:
+      type: object
+      required: [name]
+      properties:
+        name:
+          type: string
+          minLength: 1
+        tag:
+          type: string
+          nullable: true
+        owner:
+          $ref: '#/components/schemas/Owner'
+    Owner:
+      type: object
+      properties:
+        age:
+          type: integer
+          minimum: 0
+`
+
+// petstore31 uses the JSON schema 2020-12 keywords of OpenAPI 3.1.
+const petstore31 = `
+openapi: 3.1.0
+info:
+  title: Petstore
+  version: 1.0.0
+paths:
+  /pets/{petId}:
+    parameters:
+    - name: petId
+      in: path
+      required: true
+      schema:
+        type: integer
+        exclusiveMinimum: 0
+    put:
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/Pet'
+      responses:
+        "200":
+          description: pet
+components:
+  schemas:
+    Pet:
+      type: object
+      required: [name, kind]
+      properties:
+        name:
+          type: string
+        kind:
+          const: pet
+        tag:
+          type: [string, "null"]
+        location:
+          type: array
+          prefixItems:
+          - type: number
+          - type: number
+          items: false
+      unevaluatedProperties: false
+`
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newTestValidator(yamlConfig string, cls cluster.Cluster, assert *assert.Assertions) *OpenAPIValidator {
+	rawSpec := make(map[string]interface{})
+	err := codectool.Unmarshal([]byte(yamlConfig), &rawSpec)
+	assert.NoError(err)
+
+	spec, err := filters.NewSpec(nil, "", rawSpec)
+	assert.NoError(err)
+
+	v := kind.CreateInstance(spec).(*OpenAPIValidator)
+	v.cluster = cls
+	v.Init()
+
+	assert.Equal(kind, v.Kind())
+	assert.Equal(spec, v.Spec())
+	assert.Nil(v.Status())
+	return v
+}
+
+func indent(s string) string {
+	return strings.ReplaceAll(s, "\n", "\n  ")
+}
+
+func newContext(method, url string, header http.Header, body string) *context.Context {
+	stdr, _ := http.NewRequest(method, url, strings.NewReader(body))
+	for k, v := range header {
+		stdr.Header[k] = v
+	}
+	req, _ := httpprot.NewRequest(stdr)
+	req.FetchPayload(0)
+
+	ctx := context.New(tracing.NoopSpan)
+	ctx.SetRequest(context.DefaultNamespace, req)
+	return ctx
+}
+
+func problemOf(ctx *context.Context, assert *assert.Assertions) *problem {
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(contentTypeProblem, resp.HTTPHeader().Get("Content-Type"))
+
+	p := &problem{}
+	assert.NoError(codectool.UnmarshalJSON(resp.RawPayload(), p))
+	assert.Equal(resp.StatusCode(), p.Status)
+	return p
+}
+
+func TestParseDocument(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ParseDocument([]byte(`swagger: "2.0"`))
+	assert.Error(err)
+
+	_, err = ParseDocument([]byte(`
+openapi: 3.0.0
+paths:
+  /pets:
+    get:
+      parameters:
+      - $ref: 'common.yaml#/parameters/limit'
+`))
+	assert.Error(err)
+
+	doc, err := ParseDocument([]byte(petstore))
+	assert.NoError(err)
+	assert.Equal("Petstore", doc.Title)
+	assert.Equal([]string{"http://petstore.example.com/v1"}, doc.Servers)
+	assert.Len(doc.Operations, 4)
+	assert.Equal("/pets", doc.Operations[0].Path)
+	assert.Equal(http.MethodGet, doc.Operations[0].Method)
+	assert.Equal("listPets", doc.Operations[0].OperationID)
+
+	op, values, _ := doc.findOperation(http.MethodGet, "/v1/pets/mine")
+	assert.Equal("listMyPets", op.OperationID)
+	assert.Empty(values)
+
+	op, values, _ = doc.findOperation(http.MethodGet, "/v1/pets/12")
+	assert.Equal("getPet", op.OperationID)
+	assert.Equal(map[string]string{"petId": "12"}, values)
+
+	op, _, allowed := doc.findOperation(http.MethodDelete, "/v1/pets")
+	assert.Nil(op)
+	assert.Equal([]string{http.MethodGet, http.MethodPost}, allowed)
+
+	op, _, allowed = doc.findOperation(http.MethodGet, "/pets")
+	assert.Nil(op)
+	assert.Empty(allowed)
+}
+
+func TestSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{}
+	assert.Error(spec.Validate())
+
+	spec.Document = "openapi: 2.0"
+	assert.Error(spec.Validate())
+
+	spec.Document = strings.Replace(petstore, "openapi: 3.0.3", "openapi: 3.2.0", 1)
+	assert.Error(spec.Validate())
+
+	spec.Document = petstore31
+	assert.NoError(spec.Validate())
+
+	spec.Document = petstore
+	assert.NoError(spec.Validate())
+
+	spec.CustomData = &CustomDataRef{Kind: "openapi", ID: "petstore"}
+	assert.Error(spec.Validate())
+}
+
+func TestValidateRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: OpenAPIValidator
+name: validator
+document: |
+  ` + indent(petstore)
+	v := newTestValidator(yamlConfig, nil, assert)
+	defer v.Close()
+
+	const base = "http://127.0.0.1/v1"
+	jsonHeader := http.Header{
+		"Content-Type": []string{"application/json"},
+		"X-Request-Id": []string{"0a6b6e9e-3a1c-4f6e-9d61-8b4a3f0c9e11"},
+	}
+
+	// valid requests
+	for _, ctx := range []*context.Context{
+		newContext(http.MethodGet, base+"/pets?limit=10&tags=cat,dog", nil, ""),
+		newContext(http.MethodGet, base+"/pets/12", nil, ""),
+		newContext(http.MethodPost, base+"/pets", jsonHeader, `{"name": "kitty", "tag": null, "owner": {"age": 3}}`),
+	} {
+		assert.Equal("", v.Handle(ctx))
+		assert.Nil(ctx.GetOutputResponse())
+	}
+
+	ctx := newContext(http.MethodGet, base+"/pets?limit=abc&tags=cat,fish", nil, "")
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	p := problemOf(ctx, assert)
+	assert.Equal(http.StatusBadRequest, p.Status)
+	assert.Len(p.InvalidParams, 2)
+	assert.Equal("query", p.InvalidParams[0].In)
+	assert.Equal("limit", p.InvalidParams[0].Name)
+	assert.Equal("tags", p.InvalidParams[1].Name)
+
+	ctx = newContext(http.MethodGet, base+"/pets/abc", nil, "")
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	p = problemOf(ctx, assert)
+	assert.Equal("path", p.InvalidParams[0].In)
+	assert.Equal("petId", p.InvalidParams[0].Name)
+
+	// invalid body and missing header
+	ctx = newContext(http.MethodPost, base+"/pets", http.Header{"Content-Type": []string{"application/json"}}, `{"owner": {"age": -1}}`)
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	p = problemOf(ctx, assert)
+	assert.Equal(http.StatusBadRequest, p.Status)
+	assert.Len(p.InvalidParams, 3)
+	assert.Equal(&invalidParam{In: "header", Name: "X-Request-Id", Reason: "is required"}, p.InvalidParams[0])
+	names := []string{p.InvalidParams[1].Name, p.InvalidParams[2].Name}
+	assert.ElementsMatch([]string{"", "owner.age"}, names)
+
+	ctx = newContext(http.MethodPost, base+"/pets", jsonHeader, `{"name": `)
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	p = problemOf(ctx, assert)
+	assert.Equal("body", p.InvalidParams[0].In)
+
+	ctx = newContext(http.MethodPost, base+"/pets", jsonHeader, "")
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	p = problemOf(ctx, assert)
+	assert.Equal(&invalidParam{In: "body", Reason: "is required"}, p.InvalidParams[0])
+
+	header := jsonHeader.Clone()
+	header.Set("Content-Type", "text/plain")
+	ctx = newContext(http.MethodPost, base+"/pets", header, "kitty")
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	assert.Equal(http.StatusUnsupportedMediaType, problemOf(ctx, assert).Status)
+
+	// unknown operations
+	ctx = newContext(http.MethodDelete, base+"/pets", nil, "")
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	assert.Equal(http.StatusMethodNotAllowed, problemOf(ctx, assert).Status)
+	assert.Equal("GET, POST", ctx.GetOutputResponse().(*httpprot.Response).HTTPHeader().Get("Allow"))
+
+	ctx = newContext(http.MethodGet, base+"/users", nil, "")
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	assert.Equal(http.StatusNotFound, problemOf(ctx, assert).Status)
+
+	v.spec.AllowUnknownOperations = true
+	ctx = newContext(http.MethodGet, base+"/users", nil, "")
+	assert.Equal("", v.Handle(ctx))
+}
+
+func TestValidateRequest31(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+kind: OpenAPIValidator
+name: validator
+document: |
+  ` + indent(petstore31)
+	v := newTestValidator(yamlConfig, nil, assert)
+	defer v.Close()
+
+	header := http.Header{"Content-Type": []string{"application/json"}}
+
+	ctx := newContext(http.MethodPut, "http://127.0.0.1/pets/1", header, `{"name": "kitty", "kind": "pet", "tag": null, "location": [1.5, 2]}`)
+	assert.Equal("", v.Handle(ctx))
+	assert.Nil(ctx.GetOutputResponse())
+
+	ctx = newContext(http.MethodPut, "http://127.0.0.1/pets/0", header, `{"name": "kitty", "kind": "pet"}`)
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	p := problemOf(ctx, assert)
+	assert.Len(p.InvalidParams, 1)
+	assert.Equal("path", p.InvalidParams[0].In)
+	assert.Equal("petId", p.InvalidParams[0].Name)
+
+	ctx = newContext(http.MethodPut, "http://127.0.0.1/pets/1", header, `{"name": "kitty", "kind": "toy", "tag": 1, "location": [1, 2, 3], "age": 3}`)
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	p = problemOf(ctx, assert)
+	names := make([]string, 0, len(p.InvalidParams))
+	for _, ip := range p.InvalidParams {
+		assert.Equal("body", ip.In)
+		names = append(names, ip.Name)
+	}
+	assert.Subset(names, []string{"kind", "tag", "location.2"})
+	assert.Contains(p.String(), "age")
+}
+
+func TestValidateResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	doc, err := ParseDocument([]byte(petstore))
+	assert.NoError(err)
+
+	newResponse := func(code int, contentType, body string) *httpprot.Response {
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetStatusCode(code)
+		if contentType != "" {
+			resp.HTTPHeader().Set("Content-Type", contentType)
+		}
+		resp.SetPayload(body)
+		return resp
+	}
+
+	listPets, _, _ := doc.findOperation(http.MethodGet, "/v1/pets")
+	assert.Empty(listPets.validateResponse(newResponse(http.StatusOK, "application/json", `[{"name": "kitty"}]`)))
+
+	invalidParams := listPets.validateResponse(newResponse(http.StatusOK, "application/json", `[{"tag": 1}]`))
+	assert.Len(invalidParams, 2)
+
+	invalidParams = listPets.validateResponse(newResponse(http.StatusOK, "text/plain", "kitty"))
+	assert.Equal("Content-Type", invalidParams[0].Name)
+
+	invalidParams = listPets.validateResponse(newResponse(http.StatusNotFound, "", ""))
+	assert.Equal("status", invalidParams[0].In)
+
+	createPet, _, _ := doc.findOperation(http.MethodPost, "/v1/pets")
+	assert.Empty(createPet.validateResponse(newResponse(http.StatusCreated, "", "")))
+	assert.Empty(createPet.validateResponse(newResponse(http.StatusBadRequest, contentTypeProblem, "{}")))
+
+	listMyPets, _, _ := doc.findOperation(http.MethodGet, "/v1/pets/mine")
+	assert.Empty(listMyPets.validateResponse(newResponse(http.StatusNoContent, "", "")))
+
+	// response validation is log only.
+	yamlConfig := `
+kind: OpenAPIValidator
+name: validator
+validateResponse: true
+document: |
+  ` + indent(petstore)
+	v := newTestValidator(yamlConfig, nil, assert)
+	defer v.Close()
+
+	ctx := newContext(http.MethodGet, "http://127.0.0.1/v1/pets", nil, "")
+	assert.Equal("", v.Handle(ctx))
+	ctx.SetResponse(context.DefaultNamespace, newResponse(http.StatusOK, "application/json", `[{"tag": 1}]`))
+	ctx.Finish()
+}
+
+func TestCustomData(t *testing.T) {
+	assert := assert.New(t)
+
+	cls := clustertest.NewMockedCluster()
+	syncer := clustertest.NewMockedSyncer()
+	cls.MockedSyncer = func(time.Duration) (cluster.Syncer, error) {
+		return syncer, nil
+	}
+
+	var key string
+	ch := make(chan *string)
+	syncer.MockedSync = func(k string) (<-chan *string, error) {
+		key = k
+		return ch, nil
+	}
+
+	const yamlConfig = `
+kind: OpenAPIValidator
+name: validator
+customData:
+  kind: openapi
+  id: petstore
+  field: document
+`
+	v := newTestValidator(yamlConfig, cls, assert)
+	defer v.Close()
+
+	// the document is not loaded yet.
+	ctx := newContext(http.MethodGet, "http://127.0.0.1/v1/pets/12", nil, "")
+	assert.Equal(resultInvalid, v.Handle(ctx))
+	assert.Equal(http.StatusInternalServerError, problemOf(ctx, assert).Status)
+
+	data := string(codectool.MustMarshalJSON(map[string]interface{}{
+		"name":     "petstore",
+		"document": petstore,
+	}))
+	ch <- &data
+	// send again to make sure the previous value is processed.
+	ch <- &data
+	assert.Equal("/custom-data/openapi/petstore", key)
+
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/pets/12", nil, "")
+	assert.Equal("", v.Handle(ctx))
+
+	// invalid document does not replace the loaded one.
+	invalid := `{"name": "petstore", "document": "openapi: 2.0"}`
+	ch <- &invalid
+	ch <- nil
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/pets/12", nil, "")
+	assert.Equal("", v.Handle(ctx))
+
+	// the next generation keeps the document until a new one is delivered.
+	syncer.MockedSync = func(k string) (<-chan *string, error) {
+		return make(chan *string), nil
+	}
+	newGeneration := func(yamlConfig string) *OpenAPIValidator {
+		rawSpec := make(map[string]interface{})
+		codectool.MustUnmarshal([]byte(yamlConfig), &rawSpec)
+		spec, err := filters.NewSpec(nil, "", rawSpec)
+		assert.NoError(err)
+		v2 := kind.CreateInstance(spec).(*OpenAPIValidator)
+		v2.cluster = cls
+		v2.Inherit(v)
+		return v2
+	}
+	v2 := newGeneration(yamlConfig)
+	defer v2.Close()
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/pets/12", nil, "")
+	assert.Equal("", v2.Handle(ctx))
+
+	// but not when it refers to another custom data.
+	v3 := newGeneration(strings.Replace(yamlConfig, "petstore", "petstore2", 1))
+	defer v3.Close()
+	ctx = newContext(http.MethodGet, "http://127.0.0.1/v1/pets/12", nil, "")
+	assert.Equal(resultInvalid, v3.Handle(ctx))
+
+	doc, err := parseCustomData([]byte(data), "")
+	assert.Nil(doc)
+	assert.Error(err)
+
+	_, err = parseCustomData([]byte(`{"document": 1}`), "document")
+	assert.Error(err)
+
+	obj := map[string]interface{}{}
+	codectool.MustUnmarshal([]byte(petstore), &obj)
+	doc, err = parseCustomData(codectool.MustMarshalJSON(map[string]interface{}{"document": obj}), "document")
+	assert.NoError(err)
+	assert.Equal("Petstore", doc.Title)
+}
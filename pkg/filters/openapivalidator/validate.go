@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package openapivalidator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+// contentTypeProblem is the content type of problem details.
+const contentTypeProblem = "application/problem+json"
+
+type (
+	// problem is the problem details defined by RFC 7807.
+	problem struct {
+		Type          string          `json:"type"`
+		Title         string          `json:"title"`
+		Status        int             `json:"status"`
+		Detail        string          `json:"detail,omitempty"`
+		InvalidParams []*invalidParam `json:"invalid-params,omitempty"`
+	}
+
+	// invalidParam is a violation of the OpenAPI document.
+	invalidParam struct {
+		In     string `json:"in"`
+		Name   string `json:"name,omitempty"`
+		Reason string `json:"reason"`
+	}
+)
+
+func newProblem(status int, detail string) *problem {
+	return &problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// String returns the violations as a single line string for tags and logs.
+func (p *problem) String() string {
+	if len(p.InvalidParams) == 0 {
+		return p.Detail
+	}
+
+	msgs := make([]string, 0, len(p.InvalidParams))
+	for _, ip := range p.InvalidParams {
+		msgs = append(msgs, ip.String())
+	}
+	return p.Detail + ": " + strings.Join(msgs, "; ")
+}
+
+func (ip *invalidParam) String() string {
+	if ip.Name == "" {
+		return ip.In + ": " + ip.Reason
+	}
+	return ip.In + "." + ip.Name + ": " + ip.Reason
+}
+
+// validateRequest validates the request against the operation, it returns
+// nil if the request is valid.
+func (op *Operation) validateRequest(req *httpprot.Request, pathValues map[string]string) *problem {
+	var invalidParams []*invalidParam
+
+	for _, p := range op.params {
+		values, ok := p.values(req, pathValues)
+		if !ok {
+			if p.required {
+				invalidParams = append(invalidParams, &invalidParam{In: p.in, Name: p.name, Reason: "is required"})
+			}
+			continue
+		}
+		if p.schema == nil {
+			continue
+		}
+
+		for _, e := range p.schema.validate(p.convert(values)) {
+			invalidParams = append(invalidParams, &invalidParam{In: p.in, Name: p.name, Reason: e.reason})
+		}
+	}
+
+	if op.body != nil && !req.IsStream() {
+		p, body := op.validateRequestBody(req)
+		if p != nil {
+			return p
+		}
+		invalidParams = append(invalidParams, body...)
+	}
+
+	if len(invalidParams) == 0 {
+		return nil
+	}
+	p := newProblem(http.StatusBadRequest, "request validation failed")
+	p.InvalidParams = invalidParams
+	return p
+}
+
+func (op *Operation) validateRequestBody(req *httpprot.Request) (*problem, []*invalidParam) {
+	body := req.RawPayload()
+	if len(body) == 0 {
+		if op.body.required {
+			return nil, []*invalidParam{{In: "body", Reason: "is required"}}
+		}
+		return nil, nil
+	}
+
+	contentType := req.HTTPHeader().Get("Content-Type")
+	schema, ok := op.body.content.find(contentType)
+	if !ok {
+		return newProblem(http.StatusUnsupportedMediaType, fmt.Sprintf("content type %q is not supported", contentType)), nil
+	}
+	if schema == nil || !isJSON(contentType) {
+		return nil, nil
+	}
+	return nil, validateJSON(schema, body)
+}
+
+// validateResponse validates the response against the operation, it
+// returns the violations.
+func (op *Operation) validateResponse(resp *httpprot.Response) []*invalidParam {
+	code := strconv.Itoa(resp.StatusCode())
+	c, ok := op.responses[code]
+	if !ok {
+		c, ok = op.responses[code[:1]+"XX"]
+	}
+	if !ok {
+		c, ok = op.responses["DEFAULT"]
+	}
+	if !ok {
+		return []*invalidParam{{In: "status", Reason: fmt.Sprintf("status code %s is not documented", code)}}
+	}
+
+	if resp.IsStream() || len(resp.RawPayload()) == 0 {
+		return nil
+	}
+
+	contentType := resp.HTTPHeader().Get("Content-Type")
+	schema, ok := c.find(contentType)
+	if !ok {
+		return []*invalidParam{{In: "header", Name: "Content-Type", Reason: fmt.Sprintf("content type %q is not documented", contentType)}}
+	}
+	if schema == nil || !isJSON(contentType) {
+		return nil
+	}
+	return validateJSON(schema, resp.RawPayload())
+}
+
+func validateJSON(schema schema, data []byte) []*invalidParam {
+	// numbers are decoded as json.Number to keep their precision.
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return []*invalidParam{{In: "body", Reason: fmt.Sprintf("invalid JSON: %v", err)}}
+	}
+
+	var invalidParams []*invalidParam
+	for _, e := range schema.validate(v) {
+		invalidParams = append(invalidParams, &invalidParam{In: "body", Name: e.field, Reason: e.reason})
+	}
+	return invalidParams
+}
+
+// values returns the values of the parameter in the request.
+func (p *parameter) values(req *httpprot.Request, pathValues map[string]string) ([]string, bool) {
+	switch p.in {
+	case "path":
+		v, ok := pathValues[p.name]
+		return []string{v}, ok
+	case "query":
+		values, ok := req.Std().URL.Query()[p.name]
+		return values, ok && len(values) > 0
+	case "header":
+		values := req.HTTPHeader().Values(p.name)
+		return values, len(values) > 0
+	case "cookie":
+		c, err := req.Cookie(p.name)
+		if err != nil {
+			return nil, false
+		}
+		return []string{c.Value}, true
+	}
+	return nil, false
+}
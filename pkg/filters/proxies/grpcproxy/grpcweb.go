@@ -0,0 +1,424 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcproxy
+
+import (
+	"bytes"
+	stdcontext "context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/grpcprot"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/protocols/httpprot/httpstat"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// frameTrailer is the flag of the frame which carries the trailers,
+	// it is the most significant bit of the first byte of a frame.
+	frameTrailer = 0x80
+)
+
+// hopHeaders are the request headers which are not forwarded to the gRPC
+// servers as metadata.
+var hopHeaders = map[string]bool{
+	"connection":        true,
+	"content-length":    true,
+	"content-type":      true,
+	"host":              true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"te":                true,
+	"trailer":           true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+	"accept-encoding":   true,
+}
+
+type (
+	// webStream implements grpc.ServerStream on a gRPC-Web request, so
+	// that the request can be proxied to gRPC servers as a native one.
+	webStream struct {
+		ctx         stdcontext.Context
+		body        io.Reader
+		w           http.ResponseWriter
+		contentType string
+		text        bool
+		extraHeader http.Header
+
+		mu         sync.Mutex
+		header     metadata.MD
+		trailer    metadata.MD
+		headerSent bool
+		closed     bool
+		respSize   uint64
+	}
+
+	// webTransportStream implements grpc.ServerTransportStream, which is
+	// required to get the method of the request from the context.
+	webTransportStream struct {
+		ws     *webStream
+		method string
+	}
+)
+
+var _ grpc.ServerStream = (*webStream)(nil)
+var _ grpc.ServerTransportStream = (*webTransportStream)(nil)
+
+// isGRPCWeb returns whether the content type is a gRPC-Web one.
+func isGRPCWeb(contentType string) bool {
+	return strings.HasPrefix(contentType, grpcWebContentType)
+}
+
+func (ts *webTransportStream) Method() string {
+	return ts.method
+}
+
+func (ts *webTransportStream) SetHeader(md metadata.MD) error {
+	return ts.ws.SetHeader(md)
+}
+
+func (ts *webTransportStream) SendHeader(md metadata.MD) error {
+	return ts.ws.SendHeader(md)
+}
+
+func (ts *webTransportStream) SetTrailer(md metadata.MD) error {
+	ts.ws.SetTrailer(md)
+	return nil
+}
+
+func (ws *webStream) Context() stdcontext.Context {
+	return ws.ctx
+}
+
+func (ws *webStream) SetHeader(md metadata.MD) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.headerSent {
+		return fmt.Errorf("header already sent")
+	}
+	ws.header = metadata.Join(ws.header, md)
+	return nil
+}
+
+func (ws *webStream) SendHeader(md metadata.MD) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.headerSent {
+		return fmt.Errorf("header already sent")
+	}
+	ws.header = metadata.Join(ws.header, md)
+	ws.writeHeader()
+	return nil
+}
+
+// writeHeader writes the response header, ws.mu must be held.
+func (ws *webStream) writeHeader() {
+	h := ws.w.Header()
+	for k, v := range ws.extraHeader {
+		h[k] = v
+	}
+	for k, v := range ws.header {
+		if strings.HasPrefix(k, ":") || k == "content-type" || k == "content-length" {
+			continue
+		}
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+	h.Set("Content-Type", ws.contentType)
+	h.Del("Content-Length")
+	ws.w.WriteHeader(http.StatusOK)
+	ws.headerSent = true
+}
+
+func (ws *webStream) SetTrailer(md metadata.MD) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.trailer = metadata.Join(ws.trailer, md)
+}
+
+// SendMsg writes a message frame to the client.
+func (ws *webStream) SendMsg(m interface{}) error {
+	data, err := GrpcCodec{}.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return io.ErrClosedPipe
+	}
+	if !ws.headerSent {
+		ws.writeHeader()
+	}
+	return ws.writeFrame(0, data)
+}
+
+// writeFrame writes a frame and flushes it to the client, ws.mu must be
+// held.
+func (ws *webStream) writeFrame(flag byte, data []byte) error {
+	frame := make([]byte, 5+len(data))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	copy(frame[5:], data)
+
+	// every frame is encoded separately in text mode, which is allowed by
+	// the protocol.
+	if ws.text {
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(frame)))
+		base64.StdEncoding.Encode(encoded, frame)
+		frame = encoded
+	}
+
+	n, err := ws.w.Write(frame)
+	ws.respSize += uint64(n)
+	if err != nil {
+		return err
+	}
+	if f, ok := ws.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// RecvMsg reads a message frame from the request body.
+func (ws *webStream) RecvMsg(m interface{}) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(ws.body, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated gRPC-Web frame")
+		}
+		return err
+	}
+	if prefix[0]&frameTrailer != 0 {
+		// trailers are not expected in requests, treat it as the end.
+		return io.EOF
+	}
+	if prefix[0] != 0 {
+		return fmt.Errorf("compressed gRPC-Web frames are not supported")
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(ws.body, data); err != nil {
+		return fmt.Errorf("truncated gRPC-Web frame")
+	}
+	return GrpcCodec{}.Unmarshal(data, m)
+}
+
+// finish writes the status and the trailers as the trailer frame, no
+// message is sent to the client after it.
+func (ws *webStream) finish(code codes.Code, msg string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return
+	}
+	ws.closed = true
+	if !ws.headerSent {
+		ws.writeHeader()
+	}
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "grpc-status: %d\r\n", code)
+	if msg != "" {
+		fmt.Fprintf(&buf, "grpc-message: %s\r\n", encodeGRPCMessage(msg))
+	}
+	for k, values := range ws.trailer {
+		if k == "grpc-status" || k == "grpc-message" {
+			continue
+		}
+		for _, v := range values {
+			fmt.Fprintf(&buf, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+	ws.writeFrame(frameTrailer, buf.Bytes())
+}
+
+// encodeGRPCMessage percent encodes the grpc-message as required by the
+// gRPC protocol.
+func encodeGRPCMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// decodeGRPCWebText decodes the body of a grpc-web-text request, which
+// could be the concatenation of several padded base64 strings.
+func decodeGRPCWebText(data []byte) ([]byte, error) {
+	data = bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, data)
+	if len(data)%4 != 0 {
+		return nil, fmt.Errorf("invalid base64 body")
+	}
+
+	out := make([]byte, 0, base64.StdEncoding.DecodedLen(len(data)))
+	var quantum [3]byte
+	for i := 0; i < len(data); i += 4 {
+		n, err := base64.StdEncoding.Decode(quantum[:], data[i:i+4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 body: %v", err)
+		}
+		out = append(out, quantum[:n]...)
+	}
+	return out, nil
+}
+
+// newGRPCWebRequest creates a gRPC request from the gRPC-Web request, the
+// response is written to stdw directly.
+func newGRPCWebRequest(req *httpprot.Request, stdw http.ResponseWriter, extraHeader http.Header) (*grpcprot.Request, *webStream, error) {
+	contentType := req.HTTPHeader().Get("Content-Type")
+	ws := &webStream{
+		w:           stdw,
+		contentType: contentType,
+		text:        strings.HasPrefix(contentType, grpcWebTextContentType),
+		extraHeader: extraHeader,
+		body:        req.GetPayload(),
+	}
+	if ws.text {
+		data, err := io.ReadAll(req.GetPayload())
+		if err != nil {
+			return nil, nil, err
+		}
+		if data, err = decodeGRPCWebText(data); err != nil {
+			return nil, nil, err
+		}
+		ws.body = bytes.NewReader(data)
+	}
+
+	md := metadata.MD{}
+	for k, v := range req.HTTPHeader() {
+		k = strings.ToLower(k)
+		if !hopHeaders[k] {
+			md[k] = v
+		}
+	}
+	md.Set("content-type", "application/grpc")
+	md.Set(grpcprot.Authority, req.Host())
+
+	method, err := url.PathUnescape(req.Path())
+	if err != nil {
+		method = req.Path()
+	}
+
+	ctx := req.Context()
+	ctx = grpc.NewContextWithServerTransportStream(ctx, &webTransportStream{ws: ws, method: method})
+	ctx = metadata.NewIncomingContext(ctx, md)
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: remoteAddr(req.Std().RemoteAddr)})
+	ws.ctx = ctx
+
+	grpcReq := grpcprot.NewRequestWithServerStream(ws)
+	grpcReq.SetRealIP(req.RealIP())
+	return grpcReq, ws, nil
+}
+
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+var _ net.Addr = remoteAddr("")
+
+// handleGRPCWeb proxies a gRPC-Web request from an HTTPServer to the gRPC
+// servers, the response is written to the client directly.
+func (p *Proxy) handleGRPCWeb(ctx *context.Context, req *httpprot.Request) string {
+	buildFailure := func(code int) {
+		resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+		if resp == nil {
+			resp, _ = httpprot.NewResponse(nil)
+		}
+		resp.SetStatusCode(code)
+		ctx.SetOutputResponse(resp)
+	}
+
+	if !isGRPCWeb(req.HTTPHeader().Get("Content-Type")) {
+		logger.Debugf("%s: unsupported content type %q", p.Name(), req.HTTPHeader().Get("Content-Type"))
+		buildFailure(http.StatusUnsupportedMediaType)
+		return resultClientError
+	}
+
+	stdw, _ := ctx.GetData("HTTP_RESPONSE_WRITER").(http.ResponseWriter)
+	if stdw == nil {
+		logger.Errorf("%s: cannot get response writer from context", p.Name())
+		buildFailure(http.StatusInternalServerError)
+		return resultInternalError
+	}
+
+	// headers set by the previous filters, e.g. the CORS headers set by
+	// CORSAdaptor, are sent to the client too.
+	var extraHeader http.Header
+	if resp, _ := ctx.GetOutputResponse().(*httpprot.Response); resp != nil {
+		extraHeader = resp.HTTPHeader()
+	}
+
+	grpcReq, ws, err := newGRPCWebRequest(req, stdw, extraHeader)
+	if err != nil {
+		logger.Debugf("%s: invalid gRPC-Web request: %v", p.Name(), err)
+		buildFailure(http.StatusBadRequest)
+		return resultClientError
+	}
+
+	result := p.choosePool(grpcReq).handle(ctx, grpcReq)
+
+	code, msg := codes.OK, ""
+	if resp, ok := ctx.GetOutputResponse().(*grpcprot.Response); ok && resp.GetStatus() != nil {
+		code, msg = resp.GetStatus().Code(), resp.GetStatus().Message()
+	}
+	ws.finish(code, msg)
+
+	// the response has been sent, replace the gRPC response with an HTTP
+	// one for the following filters, and tell HTTPServer not to send it
+	// again.
+	resp, _ := httpprot.NewResponse(nil)
+	for k, v := range stdw.Header() {
+		resp.HTTPHeader()[k] = v
+	}
+	ctx.SetOutputResponse(resp)
+	ctx.SetData("HTTP_METRIC", &httpstat.Metric{
+		StatusCode: http.StatusOK,
+		ReqSize:    uint64(req.MetaSize()) + uint64(req.PayloadSize()),
+		RespSize:   ws.respSize,
+	})
+	return result
+}
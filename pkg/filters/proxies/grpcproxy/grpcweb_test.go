@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// startEchoServer starts a gRPC server which echoes the request message
+// back for 'count' times, count is from the 'x-count' metadata.
+func startEchoServer(at *assert.Assertions) (string, func()) {
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ := grpc.MethodFromServerStream(stream)
+		md, _ := metadata.FromIncomingContext(stream.Context())
+
+		m := &emptypb.Empty{}
+		if err := stream.RecvMsg(m); err != nil {
+			return err
+		}
+		if method == "/test.Echo/Fail" {
+			return status.Error(codes.NotFound, "not found: 你好")
+		}
+
+		stream.SetHeader(metadata.Pairs("x-header", "header"))
+		stream.SetTrailer(metadata.Pairs("x-trailer", "trailer"))
+		count := 1
+		if v := md.Get("x-count"); len(v) > 0 {
+			fmt.Sscanf(v[0], "%d", &count)
+		}
+		for i := 0; i < count; i++ {
+			if err := stream.SendMsg(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	server := grpc.NewServer(grpc.UnknownServiceHandler(handler))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	at.NoError(err)
+	go server.Serve(l)
+	return l.Addr().String(), server.Stop
+}
+
+func encodeFrame(flag byte, data []byte) []byte {
+	frame := make([]byte, 5+len(data))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	copy(frame[5:], data)
+	return frame
+}
+
+// decodeFrames decodes the response body to messages and trailers.
+func decodeFrames(at *assert.Assertions, body []byte) ([][]byte, string) {
+	var msgs [][]byte
+	var trailer string
+	for len(body) > 0 {
+		at.GreaterOrEqual(len(body), 5)
+		size := binary.BigEndian.Uint32(body[1:5])
+		data := body[5 : 5+size]
+		if body[0]&frameTrailer != 0 {
+			trailer = string(data)
+		} else {
+			msgs = append(msgs, data)
+		}
+		body = body[5+size:]
+	}
+	return msgs, trailer
+}
+
+func TestGRPCWeb(t *testing.T) {
+	at := assert.New(t)
+
+	addr, stop := startEchoServer(at)
+	defer stop()
+
+	p := newTestProxy(fmt.Sprintf(`
+kind: GRPCProxy
+name: grpcweb
+pools:
+- servers:
+  - url: http://%s
+  loadBalance:
+    policy: roundRobin
+maxIdleConnsPerHost: 2
+initConnsPerHost: 1
+connectTimeout: 1s
+borrowTimeout: 1s
+`, addr), at)
+	defer p.Close()
+
+	// the payload of the message, which is field 1 with value "hello"
+	payload := []byte{0x0a, 0x05, 'h', 'e', 'l', 'l', 'o'}
+
+	call := func(method, contentType string, body []byte, header http.Header) (*httptest.ResponseRecorder, string) {
+		stdr := httptest.NewRequest(http.MethodPost, method, bytes.NewReader(body))
+		stdr.Header.Set("Content-Type", contentType)
+		for k, v := range header {
+			stdr.Header[k] = v
+		}
+		req, err := httpprot.NewRequest(stdr)
+		at.NoError(err)
+		at.NoError(req.FetchPayload(0))
+
+		ctx := context.New(nil)
+		ctx.SetInputRequest(req)
+		resp, _ := httpprot.NewResponse(nil)
+		resp.Header().Set("Access-Control-Allow-Origin", "*")
+		ctx.SetOutputResponse(resp)
+
+		w := httptest.NewRecorder()
+		ctx.SetData("HTTP_RESPONSE_WRITER", http.ResponseWriter(w))
+		result := p.Handle(ctx)
+		if result != resultClientError {
+			// the response is sent to the client by the proxy.
+			at.NotNil(ctx.GetData("HTTP_METRIC"))
+		}
+		return w, result
+	}
+
+	// unary
+	w, result := call("/test.Echo/Unary", grpcWebContentType+"+proto", encodeFrame(0, payload), nil)
+	at.Empty(result)
+	at.Equal(http.StatusOK, w.Code)
+	at.Equal(grpcWebContentType+"+proto", w.Header().Get("Content-Type"))
+	at.Equal("*", w.Header().Get("Access-Control-Allow-Origin"))
+	at.Equal("header", w.Header().Get("X-Header"))
+	msgs, trailer := decodeFrames(at, w.Body.Bytes())
+	at.Equal([][]byte{payload}, msgs)
+	at.Contains(trailer, "grpc-status: 0\r\n")
+	at.Contains(trailer, "x-trailer: trailer\r\n")
+
+	// server streaming
+	w, result = call("/test.Echo/Stream", grpcWebContentType, encodeFrame(0, payload), http.Header{"X-Count": {"3"}})
+	at.Empty(result)
+	msgs, trailer = decodeFrames(at, w.Body.Bytes())
+	at.Len(msgs, 3)
+	at.Contains(trailer, "grpc-status: 0\r\n")
+
+	// text mode, the body is split into padded base64 chunks.
+	frame := encodeFrame(0, payload)
+	body := base64.StdEncoding.EncodeToString(frame[:4]) + base64.StdEncoding.EncodeToString(frame[4:])
+	w, result = call("/test.Echo/Unary", grpcWebTextContentType, []byte(body), nil)
+	at.Empty(result)
+	at.Equal(grpcWebTextContentType, w.Header().Get("Content-Type"))
+	var decoded []byte
+	for _, chunk := range splitBase64(w.Body.String()) {
+		data, err := base64.StdEncoding.DecodeString(chunk)
+		at.NoError(err)
+		decoded = append(decoded, data...)
+	}
+	msgs, trailer = decodeFrames(at, decoded)
+	at.Equal([][]byte{payload}, msgs)
+	at.Contains(trailer, "grpc-status: 0\r\n")
+
+	// error
+	w, result = call("/test.Echo/Fail", grpcWebContentType, encodeFrame(0, payload), nil)
+	at.Equal(resultServerError, result)
+	at.Equal(http.StatusOK, w.Code)
+	msgs, trailer = decodeFrames(at, w.Body.Bytes())
+	at.Empty(msgs)
+	at.Contains(trailer, fmt.Sprintf("grpc-status: %d\r\n", codes.NotFound))
+	at.Contains(trailer, "grpc-message: not found: %E4%BD%A0%E5%A5%BD\r\n")
+
+	// invalid base64
+	w, result = call("/test.Echo/Unary", grpcWebTextContentType, []byte("abc"), nil)
+	at.Equal(resultClientError, result)
+	at.Zero(w.Body.Len())
+
+	// not a gRPC-Web request
+	_, result = callNotGRPCWeb(p, at)
+	at.Equal(resultClientError, result)
+}
+
+func callNotGRPCWeb(p *Proxy, at *assert.Assertions) (*httpprot.Response, string) {
+	stdr := httptest.NewRequest(http.MethodPost, "/test.Echo/Unary", strings.NewReader("{}"))
+	stdr.Header.Set("Content-Type", "application/json")
+	req, err := httpprot.NewRequest(stdr)
+	at.NoError(err)
+	ctx := context.New(nil)
+	ctx.SetInputRequest(req)
+	result := p.Handle(ctx)
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	at.Equal(http.StatusUnsupportedMediaType, resp.StatusCode())
+	return resp, result
+}
+
+// splitBase64 splits concatenated padded base64 strings.
+func splitBase64(s string) []string {
+	var chunks []string
+	for len(s) > 0 {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			return append(chunks, s)
+		}
+		for i < len(s) && s[i] == '=' {
+			i++
+		}
+		chunks = append(chunks, s[:i])
+		s = s[i:]
+	}
+	return chunks
+}
+
+func TestDecodeGRPCWebText(t *testing.T) {
+	at := assert.New(t)
+
+	data, err := decodeGRPCWebText([]byte("aGVsbG8=IHdvcmxk\r\n"))
+	at.NoError(err)
+	at.Equal("hello world", string(data))
+
+	_, err = decodeGRPCWebText([]byte("aGVsbG8"))
+	at.Error(err)
+	_, err = decodeGRPCWebText([]byte("a!!!"))
+	at.Error(err)
+
+	at.Equal("a%25b%0A", encodeGRPCMessage("a%b\n"))
+}
@@ -19,13 +19,19 @@ package grpcproxy
 
 import (
 	stdcontext "context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/filters/proxies"
 	"github.com/megaease/easegress/pkg/protocols/grpcprot"
 	"github.com/megaease/easegress/pkg/util/objectpool"
+	"github.com/megaease/easegress/pkg/util/tlsutil"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -131,6 +137,12 @@ type ServerPool struct {
 
 	filter                RequestMatcher
 	circuitBreakerWrapper resilience.Wrapper
+
+	// dialOpts are the options to dial the servers, and connKey identifies
+	// the options in the keys of the connection pool, so that connections
+	// are not shared by pools with different TLS configurations.
+	dialOpts []grpc.DialOption
+	connKey  string
 }
 
 // ServerPoolSpec is the spec for a server pool.
@@ -140,6 +152,69 @@ type ServerPoolSpec struct {
 	SpanName             string              `json:"spanName" jsonschema:"omitempty"`
 	Filter               *RequestMatcherSpec `json:"filter" jsonschema:"omitempty"`
 	CircuitBreakerPolicy string              `json:"circuitBreakerPolicy" jsonschema:"omitempty"`
+	TLS                  *TLSSpec            `json:"tls,omitempty" jsonschema:"omitempty"`
+}
+
+// TLSSpec is the spec of the TLS connections to the servers.
+type TLSSpec struct {
+	// CACertBase64 is the CA bundle to verify the server certificates,
+	// the system CAs are used if it is empty.
+	CACertBase64 string `json:"caCertBase64,omitempty" jsonschema:"omitempty,format=base64"`
+	// CertBase64 and KeyBase64 are the client certificate and key for mTLS.
+	CertBase64         string `json:"certBase64,omitempty" jsonschema:"omitempty,format=base64"`
+	KeyBase64          string `json:"keyBase64,omitempty" jsonschema:"omitempty,format=base64"`
+	ServerName         string `json:"serverName,omitempty" jsonschema:"omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty" jsonschema:"omitempty"`
+}
+
+// Validate validates TLSSpec.
+func (spec *TLSSpec) Validate() error {
+	if (spec.CertBase64 == "") != (spec.KeyBase64 == "") {
+		return fmt.Errorf("certBase64 and keyBase64 must be specified together")
+	}
+	_, err := spec.TLSConfig()
+	return err
+}
+
+// TLSConfig creates the TLS configuration from the spec.
+func (spec *TLSSpec) TLSConfig() (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         spec.ServerName,
+		InsecureSkipVerify: spec.InsecureSkipVerify,
+	}
+
+	if spec.CACertBase64 != "" {
+		pool, err := tlsutil.CertPool(spec.CACertBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid caCertBase64: %v", err)
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	if spec.CertBase64 != "" {
+		certs, err := tlsutil.LoadCertificates(spec.CertBase64, spec.KeyBase64, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = certs
+	}
+
+	return tlsConf, nil
+}
+
+// newDialOpts returns the options to dial the servers, the connections
+// are insecure if tlsSpec is nil.
+func newDialOpts(tlsSpec *TLSSpec) []grpc.DialOption {
+	if tlsSpec == nil {
+		return defaultDialOpts
+	}
+	// the spec is validated, so the error is ignored.
+	tlsConf, _ := tlsSpec.TLSConfig()
+	return []grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)),
+		grpc.WithCodec(&GrpcCodec{}),
+		grpc.WithBlock(),
+	}
 }
 
 // Validate validates ServerPoolSpec.
@@ -158,6 +233,12 @@ func (sps *ServerPoolSpec) Validate() error {
 		msgFmt := "not all servers have weight(%d/%d)"
 		return fmt.Errorf(msgFmt, serversGotWeight, len(sps.Servers))
 	}
+
+	if sps.TLS != nil {
+		if err := sps.TLS.Validate(); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -172,6 +253,13 @@ func NewServerPool(proxy *Proxy, spec *ServerPoolSpec, name string) *ServerPool
 		sp.filter = NewRequestMatcher(spec.Filter)
 	}
 
+	sp.dialOpts = newDialOpts(spec.TLS)
+	if spec.TLS != nil {
+		data, _ := json.Marshal(spec.TLS)
+		sum := sha256.Sum256(data)
+		sp.connKey = hex.EncodeToString(sum[:8])
+	}
+
 	sp.BaseServerPool.Init(sp, proxy.super, name, &spec.BaseServerPoolSpec)
 
 	return sp
@@ -204,8 +292,7 @@ func (sp *ServerPool) InjectResiliencePolicy(policies map[string]resilience.Poli
 	}
 }
 
-func (sp *ServerPool) handle(ctx *context.Context) string {
-	req := ctx.GetInputRequest().(*grpcprot.Request)
+func (sp *ServerPool) handle(ctx *context.Context, req *grpcprot.Request) string {
 	spCtx := &serverPoolContext{
 		Context: ctx,
 		req:     grpcprot.NewRequestWithContext(req.Context()),
@@ -305,13 +392,17 @@ func (sp *ServerPool) doHandle(ctx stdcontext.Context, spCtx *serverPoolContext)
 		borrowCtx, cancel = stdcontext.WithTimeout(borrowCtx, sp.proxy.borrowTimeout)
 	}
 	defer cancel()
-	conn, err := sp.proxy.connectionPool.Get(target, borrowCtx, func() (objectpool.PoolObject, error) {
+	connKey := target
+	if sp.connKey != "" {
+		connKey = target + "#" + sp.connKey
+	}
+	conn, err := sp.proxy.connectionPool.Get(connKey, borrowCtx, func() (objectpool.PoolObject, error) {
 		dialCtx, dialCancel := stdcontext.WithCancel(stdcontext.Background())
 		if sp.proxy.connectTimeout != 0 {
 			dialCtx, dialCancel = stdcontext.WithTimeout(dialCtx, sp.proxy.connectTimeout)
 		}
 		defer dialCancel()
-		conn, err := grpc.DialContext(dialCtx, target, defaultDialOpts...)
+		conn, err := grpc.DialContext(dialCtx, target, sp.dialOpts...)
 		if err != nil {
 			logger.Infof("create new grpc client connection for %s fail %v", target, err)
 			return nil, err
@@ -327,7 +418,7 @@ func (sp *ServerPool) doHandle(ctx stdcontext.Context, spCtx *serverPoolContext)
 	defer cancelContext()
 
 	proxyAsClientStream, err := conn.(*clientConnWrapper).NewStream(send2ProviderCtx, desc, fullMethodName)
-	sp.proxy.connectionPool.Put(target, conn)
+	sp.proxy.connectionPool.Put(connKey, conn)
 	if err != nil {
 		logger.Infof("create new stream fail %s for source addr %s, target addr %s, path %s",
 			err.Error(), spCtx.req.SourceHost(), target, fullMethodName)
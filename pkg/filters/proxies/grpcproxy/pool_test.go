@@ -19,15 +19,22 @@ package grpcproxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/megaease/easegress/pkg/protocols/grpcprot"
 	"math/rand"
+	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/megaease/easegress/pkg/filters/proxies"
 	"github.com/megaease/easegress/pkg/util/objectpool"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 )
 
@@ -215,3 +222,73 @@ name: grpcforwardproxy
 	request.Header().Set("targetAddress", "192.168.1.1")
 	at.Equal("", proxy.mainPool.getTarget(proxy.mainPool.LoadBalancer().ChooseServer(request).URL))
 }
+
+func TestTLSSpecValidate(t *testing.T) {
+	at := assert.New(t)
+	certs := tlsutiltest.NewCerts()
+
+	spec := &TLSSpec{}
+	at.NoError(spec.Validate())
+
+	spec.CertBase64 = tlsutiltest.Base64(certs.ClientCert)
+	at.Error(spec.Validate())
+
+	spec.KeyBase64 = tlsutiltest.Base64(certs.ClientKey)
+	at.NoError(spec.Validate())
+
+	spec.KeyBase64 = tlsutiltest.Base64(certs.ServerKey)
+	at.Error(spec.Validate())
+
+	spec.KeyBase64 = tlsutiltest.Base64(certs.ClientKey)
+	spec.CACertBase64 = "invalid"
+	at.Error(spec.Validate())
+
+	spec.CACertBase64 = tlsutiltest.Base64(certs.CACert)
+	at.NoError(spec.Validate())
+}
+
+func TestTLSDial(t *testing.T) {
+	at := assert.New(t)
+	certs := tlsutiltest.NewCerts()
+
+	serverCert, err := tls.X509KeyPair(certs.ServerCert, certs.ServerKey)
+	at.NoError(err)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certs.CACert)
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	at.NoError(err)
+	go server.Serve(l)
+	defer server.Stop()
+
+	dial := func(spec *TLSSpec) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, l.Addr().String(), newDialOpts(spec)...)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// mTLS
+	at.NoError(dial(&TLSSpec{
+		CACertBase64: tlsutiltest.Base64(certs.CACert),
+		CertBase64:   tlsutiltest.Base64(certs.ClientCert),
+		KeyBase64:    tlsutiltest.Base64(certs.ClientKey),
+		ServerName:   "localhost",
+	}))
+
+	// server certificate is not trusted
+	at.Error(dial(&TLSSpec{
+		CertBase64: tlsutiltest.Base64(certs.ClientCert),
+		KeyBase64:  tlsutiltest.Base64(certs.ClientKey),
+	}))
+
+	// plaintext
+	at.Error(dial(nil))
+}
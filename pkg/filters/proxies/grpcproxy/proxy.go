@@ -24,6 +24,7 @@ import (
 	"github.com/megaease/easegress/pkg/filters"
 	"github.com/megaease/easegress/pkg/filters/proxies"
 	"github.com/megaease/easegress/pkg/protocols/grpcprot"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
 	"github.com/megaease/easegress/pkg/resilience"
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/util/objectpool"
@@ -246,6 +247,17 @@ func (p *Proxy) Status() interface{} {
 	return nil
 }
 
+// Healthy returns whether the main pool of the proxy has healthy servers,
+// the main pool handles all the requests not matched by candidate pools.
+func (p *Proxy) Healthy() bool {
+	lb := p.mainPool.LoadBalancer()
+	if lb == nil {
+		return false
+	}
+	hc, ok := lb.(interface{ Healthy() bool })
+	return !ok || hc.Healthy()
+}
+
 // Close closes Proxy.
 func (p *Proxy) Close() {
 	p.mainPool.Close()
@@ -258,16 +270,22 @@ func (p *Proxy) Close() {
 
 // Handle handles GRPCContext.
 func (p *Proxy) Handle(ctx *context.Context) (result string) {
+	// gRPC-Web requests come from HTTPServer.
+	if req, ok := ctx.GetInputRequest().(*httpprot.Request); ok {
+		return p.handleGRPCWeb(ctx, req)
+	}
+
 	req := ctx.GetInputRequest().(*grpcprot.Request)
-	sp := p.mainPool
+	return p.choosePool(req).handle(ctx, req)
+}
+
+func (p *Proxy) choosePool(req *grpcprot.Request) *ServerPool {
 	for _, v := range p.candidatePools {
 		if v.filter.Match(req) {
-			sp = v
-			break
+			return v
 		}
 	}
-
-	return sp.handle(ctx)
+	return p.mainPool
 }
 
 // InjectResiliencePolicy injects resilience policies to the proxy.
@@ -205,5 +205,6 @@ name: grpcforwardproxy
 	assert.NotEmpty(t, result)
 
 	assert.Nil(t, p.Status())
+	assert.True(t, p.Healthy())
 	p.Close()
 }
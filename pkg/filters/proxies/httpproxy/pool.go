@@ -19,11 +19,13 @@ package httpproxy
 
 import (
 	stdcontext "context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net/http"
 	"net/textproto"
 	"strings"
+	"sync"
 	"time"
 
 	gohttpstat "github.com/tcnksm/go-httpstat"
@@ -39,6 +41,7 @@ import (
 	"github.com/megaease/easegress/pkg/util/prometheushelper"
 	"github.com/megaease/easegress/pkg/util/readers"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/quic-go/quic-go/http3"
 )
 
 // serverPoolError is the error returned by handler function of
@@ -172,9 +175,21 @@ type ServerPool struct {
 	retryWrapper          resilience.Wrapper
 	circuitBreakerWrapper resilience.Wrapper
 
+	// policies and the wrappers created from them are used when the
+	// route of a request overrides the resilience policies.
+	policies      map[string]resilience.Policy
+	routeWrappers map[string]resilience.Wrapper
+	lock          sync.Mutex
+
 	httpStat    *httpstat.HTTPStat
 	memoryCache *MemoryCache
 	metrics     *metrics
+
+	// http3 is the transport of HTTP/3, and client uses it if not nil,
+	// otherwise, client uses transport.
+	http3     *http3.RoundTripper
+	transport *poolTransport
+	client    *http.Client
 }
 
 // ServerPoolSpec is the spec for a server pool.
@@ -188,14 +203,67 @@ type ServerPoolSpec struct {
 	RetryPolicy          string              `json:"retryPolicy" jsonschema:"omitempty"`
 	CircuitBreakerPolicy string              `json:"circuitBreakerPolicy" jsonschema:"omitempty"`
 	MemoryCache          *MemoryCacheSpec    `json:"memoryCache,omitempty" jsonschema:"omitempty"`
+	Transport            *TransportSpec      `json:"transport,omitempty" jsonschema:"omitempty"`
+	TLS                  *TLSSpec            `json:"tls,omitempty" jsonschema:"omitempty"`
+
+	// HTTP3 sends requests to the servers with HTTP/3, which requires the
+	// servers to use https.
+	HTTP3 bool `json:"http3,omitempty" jsonschema:"omitempty"`
 
 	// FailureCodes would be 5xx if it isn't assigned any value.
 	FailureCodes []int `json:"failureCodes" jsonschema:"omitempty,uniqueItems=true"`
 }
 
+// Validate validates ServerPoolSpec.
+func (sps *ServerPoolSpec) Validate() error {
+	if err := sps.BaseServerPoolSpec.Validate(); err != nil {
+		return err
+	}
+
+	if sps.Transport != nil {
+		if sps.HTTP3 {
+			return fmt.Errorf("transport is not supported by http3")
+		}
+		if err := sps.Transport.Validate(); err != nil {
+			return fmt.Errorf("transport: %v", err)
+		}
+	}
+
+	if sps.TLS != nil {
+		if err := sps.TLS.Validate(); err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+
+	if sps.Transport != nil && sps.Transport.HTTP2 == "h2c" {
+		if err := sps.Transport.validateH2C(); err != nil {
+			return err
+		}
+		if sps.TLS != nil {
+			return fmt.Errorf("tls is not supported by h2c")
+		}
+		for _, s := range sps.Servers {
+			if !strings.HasPrefix(s.URL, "http://") {
+				return fmt.Errorf("h2c requires http, but the url of server is %s", s.URL)
+			}
+		}
+	}
+
+	if sps.HTTP3 {
+		for _, s := range sps.Servers {
+			if !strings.HasPrefix(s.URL, "https://") {
+				return fmt.Errorf("http3 requires https, but the url of server is %s", s.URL)
+			}
+		}
+	}
+
+	return nil
+}
+
 // ServerPoolStatus is the status of Pool.
 type ServerPoolStatus struct {
-	Stat *httpstat.Status `json:"stat"`
+	Stat        *httpstat.Status  `json:"stat"`
+	Connections *ConnectionStatus `json:"connections,omitempty"`
 }
 
 // NewServerPool creates a new server pool according to spec.
@@ -224,10 +292,53 @@ func NewServerPool(proxy *Proxy, spec *ServerPoolSpec, name string) *ServerPool
 		sp.failureCodes[code] = struct{}{}
 	}
 
+	tlsCfg, err := sp.tlsConfig()
+	if err != nil {
+		logger.Errorf("%s: failed to create tls config: %v", name, err)
+	}
+	if spec.HTTP3 {
+		sp.http3 = &http3.RoundTripper{TLSClientConfig: tlsCfg}
+		sp.client = &http.Client{
+			Transport: sp.http3,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	} else {
+		maxIdleConns, maxIdleConnsPerHost := proxy.spec.MaxIdleConns, proxy.spec.MaxIdleConnsPerHost
+		sp.transport = newPoolTransport(spec.Transport, tlsCfg, maxIdleConns, maxIdleConnsPerHost)
+		sp.client = sp.transport.client
+	}
+
 	sp.metrics = sp.newMetrics(name)
 	return sp
 }
 
+// Close closes the server pool.
+func (sp *ServerPool) Close() {
+	sp.BaseServerPool.Close()
+	if sp.http3 != nil {
+		sp.http3.Close()
+	}
+	if sp.transport != nil {
+		sp.transport.close()
+	}
+}
+
+// tlsConfig returns the TLS config of the pool, which falls back to the
+// one of the proxy.
+func (sp *ServerPool) tlsConfig() (*tls.Config, error) {
+	if sp.spec.TLS == nil {
+		return sp.proxy.tlsConfig()
+	}
+	return sp.spec.TLS.tlsConfig()
+}
+
+// httpClient returns the client to send requests to the servers.
+func (sp *ServerPool) httpClient() *http.Client {
+	return sp.client
+}
+
 // CreateLoadBalancer creates a load balancer according to spec.
 func (sp *ServerPool) CreateLoadBalancer(spec *LoadBalanceSpec, servers []*Server) LoadBalancer {
 	lb := proxies.NewGeneralLoadBalancer(spec, servers)
@@ -237,11 +348,19 @@ func (sp *ServerPool) CreateLoadBalancer(spec *LoadBalanceSpec, servers []*Serve
 
 func (sp *ServerPool) status() *ServerPoolStatus {
 	s := &ServerPoolStatus{Stat: sp.httpStat.Status()}
+	if sp.transport != nil {
+		s.Connections = sp.transport.status()
+	}
 	return s
 }
 
 // InjectResiliencePolicy injects resilience policies to the server pool.
 func (sp *ServerPool) InjectResiliencePolicy(policies map[string]resilience.Policy) {
+	sp.lock.Lock()
+	sp.policies = policies
+	sp.routeWrappers = map[string]resilience.Wrapper{}
+	sp.lock.Unlock()
+
 	name := sp.spec.RetryPolicy
 	if name != "" {
 		p := policies[name]
@@ -269,6 +388,55 @@ func (sp *ServerPool) InjectResiliencePolicy(policies map[string]resilience.Poli
 	}
 }
 
+// routeWrapper returns the wrapper of the resilience policy which is set
+// to the context data of key by the route of the request, it returns nil
+// if the route does not override the policy or the policy is invalid.
+func (sp *ServerPool) routeWrapper(ctx *context.Context, key string, isValid func(resilience.Policy) bool) resilience.Wrapper {
+	name, _ := ctx.GetData(key).(string)
+	if name == "" {
+		return nil
+	}
+
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	p := sp.policies[name]
+	if p == nil || !isValid(p) {
+		logger.Warnf("%s: resilience policy %s of the route not found or has a wrong kind", sp.Name, name)
+		return nil
+	}
+
+	if w := sp.routeWrappers[name]; w != nil {
+		return w
+	}
+
+	w := p.CreateWrapper()
+	sp.routeWrappers[name] = w
+	return w
+}
+
+// resilienceWrappers returns the retry wrapper and the circuit breaker
+// wrapper for the request, the ones of the route take precedence.
+func (sp *ServerPool) resilienceWrappers(ctx *context.Context) (retry, circuitBreaker resilience.Wrapper) {
+	retry = sp.routeWrapper(ctx, context.DataKeyRouteRetryPolicy, func(p resilience.Policy) bool {
+		_, ok := p.(*resilience.RetryPolicy)
+		return ok
+	})
+	if retry == nil {
+		retry = sp.retryWrapper
+	}
+
+	circuitBreaker = sp.routeWrapper(ctx, context.DataKeyRouteCircuitBreakerPolicy, func(p resilience.Policy) bool {
+		_, ok := p.(*resilience.CircuitBreakerPolicy)
+		return ok
+	})
+	if circuitBreaker == nil {
+		circuitBreaker = sp.circuitBreakerWrapper
+	}
+
+	return
+}
+
 func (sp *ServerPool) collectMetrics(spCtx *serverPoolContext) {
 	metric := &httpstat.Metric{}
 
@@ -322,7 +490,7 @@ func (sp *ServerPool) handleMirror(spCtx *serverPoolContext) {
 		return
 	}
 
-	resp, err := fnSendRequest(spCtx.stdReq, sp.proxy.client)
+	resp, err := fnSendRequest(spCtx.stdReq, sp.httpClient())
 	if err != nil {
 		return
 	}
@@ -380,11 +548,12 @@ func (sp *ServerPool) handle(ctx *context.Context, mirror bool) string {
 
 	// resilience wrappers, note that it is impossible to retry a stream
 	// request as its body can only be read once.
-	if sp.retryWrapper != nil && !spCtx.req.IsStream() {
-		handler = sp.retryWrapper.Wrap(handler)
+	retryWrapper, circuitBreakerWrapper := sp.resilienceWrappers(ctx)
+	if retryWrapper != nil && !spCtx.req.IsStream() {
+		handler = retryWrapper.Wrap(handler)
 	}
-	if sp.circuitBreakerWrapper != nil {
-		handler = sp.circuitBreakerWrapper.Wrap(handler)
+	if circuitBreakerWrapper != nil {
+		handler = circuitBreakerWrapper.Wrap(handler)
 	}
 
 	// call the handler.
@@ -432,7 +601,7 @@ func (sp *ServerPool) doHandle(stdctx stdcontext.Context, spCtx *serverPoolConte
 		return serverPoolError{http.StatusInternalServerError, resultInternalError}
 	}
 
-	resp, err := fnSendRequest(spCtx.stdReq, sp.proxy.client)
+	resp, err := fnSendRequest(spCtx.stdReq, sp.httpClient())
 	if err != nil {
 		logger.Errorf("%s: failed to send request: %v", sp.Name, err)
 
@@ -444,6 +613,11 @@ func (sp *ServerPool) doHandle(stdctx stdcontext.Context, spCtx *serverPoolConte
 		if err := spCtx.stdReq.Context().Err(); err == nil {
 			return serverPoolError{http.StatusServiceUnavailable, resultServerError}
 		} else if err == stdcontext.DeadlineExceeded {
+			// the deadline of the whole request, which is set by the
+			// route, is exceeded.
+			if spCtx.req.Context().Err() == stdcontext.DeadlineExceeded {
+				return serverPoolError{http.StatusGatewayTimeout, resultDeadlineExceeded}
+			}
 			return serverPoolError{http.StatusRequestTimeout, resultTimeout}
 		}
 
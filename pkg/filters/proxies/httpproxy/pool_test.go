@@ -29,6 +29,7 @@ import (
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/tracing"
 	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -92,7 +93,7 @@ servers:
 	assert.NoError(err)
 	assert.NoError(spec.Validate())
 
-	p := &Proxy{}
+	p := &Proxy{spec: &Spec{}}
 	p.super = supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
 		nil, false, nil, nil)
 	sp := NewServerPool(p, spec, "test")
@@ -116,6 +117,53 @@ servers:
 	assert.NotNil(sp.circuitBreakerWrapper)
 }
 
+func TestRouteResilience(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `spanName: test
+retryPolicy: retry
+servers:
+- url: http://192.168.1.1
+`
+	spec := &ServerPoolSpec{}
+	err := codectool.Unmarshal([]byte(yamlConfig), spec)
+	assert.NoError(err)
+
+	p := &Proxy{spec: &Spec{}}
+	p.super = supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
+		nil, false, nil, nil)
+	sp := NewServerPool(p, spec, "test")
+
+	policies := map[string]resilience.Policy{
+		"retry":          &resilience.RetryPolicy{},
+		"routeRetry":     &resilience.RetryPolicy{},
+		"circuitBreaker": &resilience.CircuitBreakerPolicy{},
+	}
+	sp.InjectResiliencePolicy(policies)
+
+	ctx := context.New(tracing.NoopSpan)
+	retry, circuitBreaker := sp.resilienceWrappers(ctx)
+	assert.Equal(sp.retryWrapper, retry)
+	assert.Nil(circuitBreaker)
+
+	ctx.SetData(context.DataKeyRouteRetryPolicy, "routeRetry")
+	ctx.SetData(context.DataKeyRouteCircuitBreakerPolicy, "circuitBreaker")
+	retry, circuitBreaker = sp.resilienceWrappers(ctx)
+	assert.Equal(policies["routeRetry"], retry)
+	assert.NotNil(circuitBreaker)
+
+	// the wrapper is created only once.
+	_, circuitBreaker2 := sp.resilienceWrappers(ctx)
+	assert.Equal(circuitBreaker, circuitBreaker2)
+
+	// wrong kind or not found, fallback to the policy of the pool.
+	ctx.SetData(context.DataKeyRouteRetryPolicy, "circuitBreaker")
+	ctx.SetData(context.DataKeyRouteCircuitBreakerPolicy, "notFound")
+	retry, circuitBreaker = sp.resilienceWrappers(ctx)
+	assert.Equal(sp.retryWrapper, retry)
+	assert.Nil(circuitBreaker)
+}
+
 func TestBuildResponseFromCache(t *testing.T) {
 	assert := assert.New(t)
 
@@ -134,7 +182,7 @@ servers:
 	assert.NoError(err)
 	assert.NoError(spec.Validate())
 
-	p := &Proxy{}
+	p := &Proxy{spec: &Spec{}}
 	p.super = supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
 		nil, false, nil, nil)
 	sp := NewServerPool(p, spec, "test")
@@ -177,7 +225,7 @@ func TestCopyCORSHeaders(t *testing.T) {
 	src.Add("X-Src", "src")
 	dst.Add("X-Dst", "dst")
 
-	p := &Proxy{}
+	p := &Proxy{spec: &Spec{}}
 	p.super = supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
 		nil, false, nil, nil)
 	sp := NewServerPool(p, &ServerPoolSpec{}, "test")
@@ -222,3 +270,39 @@ func TestInFailureCodes(t *testing.T) {
 	assert.False(sp.inFailureCodes(500))
 	assert.True(sp.inFailureCodes(400))
 }
+
+func TestServerPoolHTTP3(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `spanName: test
+http3: true
+servers:
+- url: http://192.168.1.1
+`
+	spec := &ServerPoolSpec{}
+	err := codectool.Unmarshal([]byte(yamlConfig), spec)
+	assert.NoError(err)
+	assert.ErrorContains(spec.Validate(), "http3 requires https")
+
+	spec.Servers[0].URL = "https://192.168.1.1"
+	assert.NoError(spec.Validate())
+
+	p := &Proxy{spec: &Spec{}}
+	p.super = supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
+		nil, false, nil, nil)
+
+	sp := NewServerPool(p, spec, "test")
+	rt, ok := sp.httpClient().Transport.(*http3.RoundTripper)
+	if assert.True(ok) {
+		assert.True(rt.TLSClientConfig.InsecureSkipVerify)
+	}
+	assert.Nil(sp.status().Connections)
+	sp.Close()
+
+	spec.HTTP3 = false
+	sp = NewServerPool(p, spec, "test")
+	_, ok = sp.httpClient().Transport.(*countedRoundTripper)
+	assert.True(ok)
+	assert.NotNil(sp.status().Connections)
+	sp.Close()
+}
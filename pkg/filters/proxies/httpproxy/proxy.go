@@ -49,6 +49,9 @@ const (
 	// result for resilience
 	resultTimeout        = "timeout"
 	resultShortCircuited = "shortCircuited"
+
+	// result for the timeout of the route
+	resultDeadlineExceeded = "deadlineExceeded"
 )
 
 var kind = &filters.Kind{
@@ -61,6 +64,7 @@ var kind = &filters.Kind{
 		resultFailureCode,
 		resultTimeout,
 		resultShortCircuited,
+		resultDeadlineExceeded,
 	},
 	DefaultSpec: func() filters.Spec {
 		return &Spec{
@@ -97,8 +101,6 @@ type (
 		candidatePools []*ServerPool
 		mirrorPool     *ServerPool
 
-		client *http.Client
-
 		compression *compression
 	}
 
@@ -279,9 +281,6 @@ func (p *Proxy) reload() {
 	if p.spec.Compression != nil {
 		p.compression = newCompression(p.spec.Compression)
 	}
-
-	tlsCfg, _ := p.tlsConfig()
-	p.client = HTTPClient(tlsCfg, p.spec.MaxIdleConns, p.spec.MaxIdleConnsPerHost, 0)
 }
 
 // Status returns Proxy status.
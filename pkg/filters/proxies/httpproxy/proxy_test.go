@@ -18,6 +18,7 @@
 package httpproxy
 
 import (
+	stdcontext "context"
 	"fmt"
 	"io"
 	"net/http"
@@ -219,6 +220,16 @@ compression:
 		assert.NotEqual("", proxy.Handle(ctx))
 	}
 
+	{
+		stdctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 10*time.Millisecond)
+		defer cancel()
+		stdr, _ := http.NewRequestWithContext(stdctx, http.MethodGet, "https://www.megaease.com", nil)
+		ctx := getCtx(stdr)
+		assert.Equal(resultDeadlineExceeded, proxy.Handle(ctx))
+		resp := ctx.GetOutputResponse().(*httpprot.Response)
+		assert.Equal(http.StatusGatewayTimeout, resp.StatusCode())
+	}
+
 	atomic.StoreInt32(&fnKind, 3)
 	{
 		stdr, _ := http.NewRequest(http.MethodGet, "https://www.megaease.com", nil)
@@ -0,0 +1,425 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpproxy
+
+import (
+	stdctx "context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultConnectTimeout      = 30 * time.Second
+	defaultKeepAlive           = 60 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+type (
+	// TransportSpec is the spec of the connections from a server pool to
+	// its servers.
+	TransportSpec struct {
+		ConnectTimeout        string `json:"connectTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		TLSHandshakeTimeout   string `json:"tlsHandshakeTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		IdleConnTimeout       string `json:"idleConnTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		ResponseHeaderTimeout string `json:"responseHeaderTimeout,omitempty" jsonschema:"omitempty,format=duration"`
+		KeepAlive             string `json:"keepAlive,omitempty" jsonschema:"omitempty,format=duration"`
+		DNSRefreshInterval    string `json:"dnsRefreshInterval,omitempty" jsonschema:"omitempty,format=duration"`
+		MaxIdleConns          int    `json:"maxIdleConns,omitempty" jsonschema:"omitempty,minimum=0"`
+		MaxIdleConnsPerHost   int    `json:"maxIdleConnsPerHost,omitempty" jsonschema:"omitempty,minimum=0"`
+		MaxConnsPerHost       int    `json:"maxConnsPerHost,omitempty" jsonschema:"omitempty,minimum=0"`
+
+		// HTTP2 is h2 to negotiate HTTP/2 with the servers by ALPN, or
+		// h2c to send HTTP/2 to the servers over cleartext with prior
+		// knowledge.
+		HTTP2 string `json:"http2,omitempty" jsonschema:"omitempty,enum=,enum=h2,enum=h2c"`
+	}
+
+	// TLSSpec is the TLS config of the connections from a server pool to
+	// its servers.
+	TLSSpec struct {
+		CACertBase64       string `json:"caCertBase64,omitempty" jsonschema:"omitempty,format=base64"`
+		ServerName         string `json:"serverName,omitempty" jsonschema:"omitempty"`
+		CertBase64         string `json:"certBase64,omitempty" jsonschema:"omitempty,format=base64"`
+		KeyBase64          string `json:"keyBase64,omitempty" jsonschema:"omitempty,format=base64"`
+		InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty" jsonschema:"omitempty"`
+	}
+
+	// ConnectionStatus is the status of the connections of a server pool.
+	ConnectionStatus struct {
+		Active     int64  `json:"active"`
+		Idle       int64  `json:"idle"`
+		Dials      uint64 `json:"dials"`
+		DialErrors uint64 `json:"dialErrors"`
+	}
+
+	// poolTransport is the transport of a server pool, it counts the dials
+	// and the connections.
+	poolTransport struct {
+		client     *http.Client
+		closeIdles func()
+		done       chan struct{}
+
+		lock       sync.Mutex
+		open       int64
+		active     int64
+		dials      uint64
+		dialErrors uint64
+	}
+
+	// countedConn is a connection of a poolTransport, it is active while
+	// there are requests using it.
+	countedConn struct {
+		net.Conn
+		pt     *poolTransport
+		busy   int
+		closed bool
+	}
+
+	// countedRoundTripper marks the connections used by requests as active
+	// until the responses are done.
+	countedRoundTripper struct {
+		next http.RoundTripper
+	}
+
+	// countedBody releases the connection when the body is read to the end
+	// or closed.
+	countedBody struct {
+		io.ReadCloser
+		once    sync.Once
+		release func()
+	}
+)
+
+func parseDuration(s string, dflt time.Duration) time.Duration {
+	if s == "" {
+		return dflt
+	}
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+// Validate validates TransportSpec.
+func (ts *TransportSpec) Validate() error {
+	durations := []struct {
+		name  string
+		value string
+	}{
+		{"connectTimeout", ts.ConnectTimeout},
+		{"tlsHandshakeTimeout", ts.TLSHandshakeTimeout},
+		{"idleConnTimeout", ts.IdleConnTimeout},
+		{"responseHeaderTimeout", ts.ResponseHeaderTimeout},
+		{"keepAlive", ts.KeepAlive},
+	}
+	for _, d := range durations {
+		if d.value != "" && parseDuration(d.value, 0) <= 0 {
+			return fmt.Errorf("%s must be positive", d.name)
+		}
+	}
+
+	if ts.DNSRefreshInterval != "" && parseDuration(ts.DNSRefreshInterval, 0) < time.Second {
+		return fmt.Errorf("dnsRefreshInterval must be at least 1s")
+	}
+
+	return nil
+}
+
+// validateH2C validates the options when h2c is used, only connectTimeout,
+// keepAlive and dnsRefreshInterval are applied to h2c.
+func (ts *TransportSpec) validateH2C() error {
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"tlsHandshakeTimeout", ts.TLSHandshakeTimeout != ""},
+		{"idleConnTimeout", ts.IdleConnTimeout != ""},
+		{"responseHeaderTimeout", ts.ResponseHeaderTimeout != ""},
+		{"maxIdleConns", ts.MaxIdleConns > 0},
+		{"maxIdleConnsPerHost", ts.MaxIdleConnsPerHost > 0},
+		{"maxConnsPerHost", ts.MaxConnsPerHost > 0},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			return fmt.Errorf("%s is not supported by h2c", u.name)
+		}
+	}
+	return nil
+}
+
+// Validate validates TLSSpec.
+func (ts *TLSSpec) Validate() error {
+	if (ts.CertBase64 == "") != (ts.KeyBase64 == "") {
+		return fmt.Errorf("certBase64 and keyBase64 must be both set or both empty")
+	}
+	if ts.InsecureSkipVerify && ts.CACertBase64 != "" {
+		return fmt.Errorf("caCertBase64 is useless when insecureSkipVerify is true")
+	}
+	_, err := ts.tlsConfig()
+	return err
+}
+
+func (ts *TLSSpec) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         ts.ServerName,
+		InsecureSkipVerify: ts.InsecureSkipVerify,
+	}
+
+	if ts.CACertBase64 != "" {
+		caPem, _ := base64.StdEncoding.DecodeString(ts.CACertBase64)
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate found in caCertBase64")
+		}
+		cfg.RootCAs = pool
+	}
+
+	if ts.CertBase64 != "" {
+		certPem, _ := base64.StdEncoding.DecodeString(ts.CertBase64)
+		keyPem, _ := base64.StdEncoding.DecodeString(ts.KeyBase64)
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// newPoolTransport creates the transport of a server pool, maxIdleConns
+// and maxIdleConnsPerHost are used if they are not set in spec.
+func newPoolTransport(spec *TransportSpec, tlsCfg *tls.Config, maxIdleConns, maxIdleConnsPerHost int) *poolTransport {
+	if spec == nil {
+		spec = &TransportSpec{}
+	}
+	if spec.MaxIdleConns > 0 {
+		maxIdleConns = spec.MaxIdleConns
+	}
+	if spec.MaxIdleConnsPerHost > 0 {
+		maxIdleConnsPerHost = spec.MaxIdleConnsPerHost
+	}
+
+	pt := &poolTransport{done: make(chan struct{})}
+
+	dialer := &net.Dialer{
+		Timeout:   parseDuration(spec.ConnectTimeout, defaultConnectTimeout),
+		KeepAlive: parseDuration(spec.KeepAlive, defaultKeepAlive),
+	}
+	dial := func(ctx stdctx.Context, network, addr string) (net.Conn, error) {
+		return pt.dial(ctx, dialer, network, addr)
+	}
+
+	var rt http.RoundTripper
+	if spec.HTTP2 == "h2c" {
+		t := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx stdctx.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}
+		pt.closeIdles = t.CloseIdleConnections
+		rt = t
+	} else {
+		t := &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dial,
+			TLSClientConfig:       tlsCfg,
+			MaxIdleConns:          maxIdleConns,
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+			MaxConnsPerHost:       spec.MaxConnsPerHost,
+			IdleConnTimeout:       parseDuration(spec.IdleConnTimeout, defaultIdleConnTimeout),
+			TLSHandshakeTimeout:   parseDuration(spec.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+			ResponseHeaderTimeout: parseDuration(spec.ResponseHeaderTimeout, 0),
+			ExpectContinueTimeout: 1 * time.Second,
+		}
+		if spec.HTTP2 == "h2" {
+			// the error is returned only if t has been configured.
+			http2.ConfigureTransports(t)
+		}
+		pt.closeIdles = t.CloseIdleConnections
+		rt = t
+	}
+
+	pt.client = &http.Client{
+		Transport: &countedRoundTripper{next: rt},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	// Go does not cache the result of name resolution, so closing the idle
+	// connections makes the new connections resolve the names again.
+	if interval := parseDuration(spec.DNSRefreshInterval, 0); interval > 0 {
+		go pt.refreshDNS(interval)
+	}
+
+	return pt
+}
+
+func (pt *poolTransport) dial(ctx stdctx.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, addr)
+
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	pt.dials++
+	if err != nil {
+		pt.dialErrors++
+		return nil, err
+	}
+
+	pt.open++
+	return &countedConn{Conn: conn, pt: pt}, nil
+}
+
+func (pt *poolTransport) refreshDNS(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pt.done:
+			return
+		case <-ticker.C:
+			pt.closeIdles()
+		}
+	}
+}
+
+func (pt *poolTransport) status() *ConnectionStatus {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+
+	return &ConnectionStatus{
+		Active:     pt.active,
+		Idle:       pt.open - pt.active,
+		Dials:      pt.dials,
+		DialErrors: pt.dialErrors,
+	}
+}
+
+func (pt *poolTransport) close() {
+	close(pt.done)
+	pt.closeIdles()
+}
+
+func (c *countedConn) acquire() {
+	c.pt.lock.Lock()
+	defer c.pt.lock.Unlock()
+
+	c.busy++
+	if c.busy == 1 && !c.closed {
+		c.pt.active++
+	}
+}
+
+func (c *countedConn) release() {
+	c.pt.lock.Lock()
+	defer c.pt.lock.Unlock()
+
+	if c.busy == 0 {
+		return
+	}
+	c.busy--
+	if c.busy == 0 && !c.closed {
+		c.pt.active--
+	}
+}
+
+// Close closes the connection.
+func (c *countedConn) Close() error {
+	c.pt.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		c.pt.open--
+		if c.busy > 0 {
+			c.pt.active--
+		}
+	}
+	c.pt.lock.Unlock()
+
+	return c.Conn.Close()
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *countedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *countedConn
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := info.Conn
+			if tc, ok := c.(*tls.Conn); ok {
+				c = tc.NetConn()
+			}
+			// a request may get another connection on retry.
+			if conn != nil {
+				conn.release()
+			}
+			conn, _ = c.(*countedConn)
+			if conn != nil {
+				conn.acquire()
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := rt.next.RoundTrip(req)
+	if conn == nil {
+		return resp, err
+	}
+
+	if err != nil {
+		conn.release()
+		return resp, err
+	}
+
+	// the connection is taken over by the caller after switching
+	// protocols, and it is active until closed.
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return resp, nil
+	}
+
+	resp.Body = &countedBody{ReadCloser: resp.Body, release: conn.release}
+	return resp, nil
+}
+
+// Read reads from the body.
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+// Close closes the body.
+func (b *countedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package httpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestTransportSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &TransportSpec{}
+	assert.NoError(spec.Validate())
+
+	spec = &TransportSpec{ConnectTimeout: "0s"}
+	assert.ErrorContains(spec.Validate(), "connectTimeout")
+
+	spec = &TransportSpec{ResponseHeaderTimeout: "5s", DNSRefreshInterval: "100ms"}
+	assert.ErrorContains(spec.Validate(), "dnsRefreshInterval")
+
+	spec = &TransportSpec{ResponseHeaderTimeout: "5s", DNSRefreshInterval: "30s"}
+	assert.NoError(spec.Validate())
+
+	yamlConfig := `
+servers:
+- url: https://127.0.0.1:9095
+transport:
+  http2: h2c
+`
+	poolSpec := &ServerPoolSpec{}
+	assert.NoError(codectool.Unmarshal([]byte(yamlConfig), poolSpec))
+	assert.ErrorContains(poolSpec.Validate(), "h2c requires http")
+
+	poolSpec.Servers[0].URL = "http://127.0.0.1:9095"
+	assert.NoError(poolSpec.Validate())
+
+	poolSpec.Transport.MaxConnsPerHost = 10
+	assert.ErrorContains(poolSpec.Validate(), "maxConnsPerHost is not supported by h2c")
+	poolSpec.Transport.MaxConnsPerHost = 0
+	poolSpec.Transport.ResponseHeaderTimeout = "10s"
+	assert.ErrorContains(poolSpec.Validate(), "responseHeaderTimeout is not supported by h2c")
+	poolSpec.Transport.ResponseHeaderTimeout = ""
+	poolSpec.TLS = &TLSSpec{InsecureSkipVerify: true}
+	assert.ErrorContains(poolSpec.Validate(), "tls is not supported by h2c")
+	poolSpec.TLS = nil
+
+	poolSpec.HTTP3 = true
+	assert.ErrorContains(poolSpec.Validate(), "not supported by http3")
+}
+
+func TestTLSSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+	certs := tlsutiltest.NewCerts()
+
+	spec := &TLSSpec{CertBase64: tlsutiltest.Base64(certs.ClientCert)}
+	assert.Error(spec.Validate())
+
+	spec.KeyBase64 = tlsutiltest.Base64(certs.ServerKey)
+	assert.Error(spec.Validate())
+
+	spec.KeyBase64 = tlsutiltest.Base64(certs.ClientKey)
+	assert.NoError(spec.Validate())
+
+	spec.CACertBase64 = tlsutiltest.Base64([]byte("not a certificate"))
+	assert.Error(spec.Validate())
+
+	spec.CACertBase64 = tlsutiltest.Base64(certs.CACert)
+	assert.NoError(spec.Validate())
+
+	spec.InsecureSkipVerify = true
+	assert.Error(spec.Validate())
+}
+
+func TestPoolTransportStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer svr.Close()
+
+	pt := newPoolTransport(nil, nil, 10, 10)
+	defer pt.close()
+
+	resp, err := pt.client.Get(svr.URL)
+	assert.NoError(err)
+	assert.Equal(&ConnectionStatus{Active: 1, Dials: 1}, pt.status())
+
+	// the transport puts the connection back to the idle pool
+	// asynchronously after the body is closed.
+	idle := func() bool {
+		return *pt.status() == ConnectionStatus{Idle: 1, Dials: 1}
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal("hello", string(body))
+	assert.Eventually(idle, time.Second, 10*time.Millisecond)
+
+	// the idle connection is reused.
+	resp, err = pt.client.Get(svr.URL)
+	assert.NoError(err)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Eventually(idle, time.Second, 10*time.Millisecond)
+
+	assert.Eventually(func() bool {
+		pt.closeIdles()
+		return pt.status().Idle == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(&ConnectionStatus{Dials: 1}, pt.status())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = pt.client.Get("http://" + addr)
+	assert.Error(err)
+	assert.Equal(&ConnectionStatus{Dials: 2, DialErrors: 1}, pt.status())
+}
+
+func TestPoolTransportH2C(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	svr := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer svr.Close()
+
+	pt := newPoolTransport(&TransportSpec{HTTP2: "h2c"}, nil, 10, 10)
+	defer pt.close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := pt.client.Get(svr.URL)
+		assert.NoError(err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal("HTTP/2.0", string(body))
+	}
+	assert.Equal(&ConnectionStatus{Idle: 1, Dials: 1}, pt.status())
+}
+
+func TestPoolTransportTLS(t *testing.T) {
+	assert := assert.New(t)
+	certs := tlsutiltest.NewCerts("backend.example.com")
+
+	cert, err := tls.X509KeyPair(certs.ServerCert, certs.ServerKey)
+	assert.NoError(err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(certs.CACert)
+
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName + " " + r.Proto))
+	}))
+	svr.EnableHTTP2 = true
+	svr.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	svr.StartTLS()
+	defer svr.Close()
+
+	tlsSpec := &TLSSpec{
+		CACertBase64: tlsutiltest.Base64(certs.CACert),
+		ServerName:   "backend.example.com",
+		CertBase64:   tlsutiltest.Base64(certs.ClientCert),
+		KeyBase64:    tlsutiltest.Base64(certs.ClientKey),
+	}
+	tlsCfg, err := tlsSpec.tlsConfig()
+	assert.NoError(err)
+
+	pt := newPoolTransport(&TransportSpec{HTTP2: "h2"}, tlsCfg, 10, 10)
+	defer pt.close()
+
+	resp, err := pt.client.Get(svr.URL)
+	assert.NoError(err)
+	assert.Equal(&ConnectionStatus{Active: 1, Dials: 1}, pt.status())
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal("backend.example.com HTTP/2.0", string(body))
+	assert.Equal(&ConnectionStatus{Idle: 1, Dials: 1}, pt.status())
+
+	// the certificate is not trusted without the CA.
+	tlsSpec.CACertBase64 = ""
+	tlsCfg, err = tlsSpec.tlsConfig()
+	assert.NoError(err)
+	pt2 := newPoolTransport(nil, tlsCfg, 10, 10)
+	defer pt2.close()
+	_, err = pt2.client.Get(svr.URL)
+	assert.Error(err)
+}
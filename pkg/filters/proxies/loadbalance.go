@@ -216,6 +216,12 @@ func (glb *GeneralLoadBalancer) ChooseServer(req protocols.Request) *Server {
 	return glb.lbp.ChooseServer(req, sg)
 }
 
+// Healthy returns whether the load balancer has at least one healthy server.
+func (glb *GeneralLoadBalancer) Healthy() bool {
+	sg := glb.healthyServers.Load()
+	return sg != nil && len(sg.Servers) > 0
+}
+
 // ReturnServer returns a server to the load balancer.
 func (glb *GeneralLoadBalancer) ReturnServer(server *Server, req protocols.Request, resp protocols.Response) {
 	if glb.ss != nil {
@@ -187,3 +187,13 @@ func TestHeaderHashLoadBalancePolicy(t *testing.T) {
 		assert.GreaterOrEqual(t, counter[i], 1)
 	}
 }
+
+func TestGeneralLoadBalancerHealthy(t *testing.T) {
+	lb := NewGeneralLoadBalancer(&LoadBalanceSpec{}, prepareServers(2))
+	lb.Init(nil, nil, nil)
+	assert.True(t, lb.Healthy())
+
+	lb = NewGeneralLoadBalancer(&LoadBalanceSpec{}, nil)
+	lb.Init(nil, nil, nil)
+	assert.False(t, lb.Healthy())
+}
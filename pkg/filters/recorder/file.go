@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/trafficrecord"
+)
+
+const backupTimeFormat = "20060102T150405.000"
+
+// recordFile is a file of records which is rotated when its size exceeds
+// the limit. It is not goroutine safe.
+type recordFile struct {
+	filename   string
+	format     string
+	maxSize    int64
+	maxBackups int
+
+	file    *os.File
+	size    int64
+	entries int
+}
+
+func newRecordFile(filename, format string, maxSize int64, maxBackups int) (*recordFile, error) {
+	rf := &recordFile{
+		filename:   filename,
+		format:     format,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return nil, err
+	}
+
+	// A HAR file is a single JSON document, so an existing one can not
+	// be appended to and is rotated.
+	if fi, err := os.Stat(filename); err == nil && fi.Size() > 0 {
+		if format == trafficrecord.FormatHAR {
+			if err = rf.backup(); err != nil {
+				return nil, err
+			}
+		} else {
+			rf.size = fi.Size()
+		}
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *recordFile) open() error {
+	f, err := os.OpenFile(rf.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	rf.file = f
+	rf.entries = 0
+
+	if rf.format == trafficrecord.FormatHAR {
+		header := trafficrecord.HARHeader()
+		if _, err = f.WriteString(header); err != nil {
+			f.Close()
+			return err
+		}
+		rf.size = int64(len(header))
+	}
+
+	return nil
+}
+
+func (rf *recordFile) close() error {
+	if rf.format == trafficrecord.FormatHAR {
+		if _, err := rf.file.WriteString(trafficrecord.HARFooter); err != nil {
+			rf.file.Close()
+			return err
+		}
+	}
+	return rf.file.Close()
+}
+
+// backupName returns the name of the backup file, for example, the backup
+// of 'records.ndjson' is 'records-20221019T150405.000.ndjson'.
+func (rf *recordFile) backupName(t time.Time) string {
+	ext := filepath.Ext(rf.filename)
+	prefix := strings.TrimSuffix(rf.filename, ext)
+	return prefix + "-" + t.Format(backupTimeFormat) + ext
+}
+
+// backup renames the current file to a backup file and removes the
+// oldest backups if there are too many.
+func (rf *recordFile) backup() error {
+	if err := os.Rename(rf.filename, rf.backupName(time.Now())); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(rf.filename)
+	pattern := strings.TrimSuffix(rf.filename, ext) + "-*" + ext
+	backups, err := filepath.Glob(pattern)
+	if err != nil || len(backups) <= rf.maxBackups {
+		return nil
+	}
+
+	// the time format makes sure the lexical order is the same as the
+	// chronological order.
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-rf.maxBackups] {
+		os.Remove(name)
+	}
+	return nil
+}
+
+func (rf *recordFile) rotate() error {
+	if err := rf.close(); err != nil {
+		return err
+	}
+	if err := rf.backup(); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// write writes a record to the file, data is the record which has already
+// been marshaled, and it must not contain any newline characters.
+func (rf *recordFile) write(data []byte) error {
+	if rf.size > 0 && rf.size+int64(len(data))+2 > rf.maxSize && rf.entries > 0 {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if rf.format == trafficrecord.FormatHAR && rf.entries > 0 {
+		data = append([]byte(",\n"), data...)
+	} else if rf.format != trafficrecord.FormatHAR {
+		data = append(data, '\n')
+	}
+
+	n, err := rf.file.Write(data)
+	rf.size += int64(n)
+	rf.entries++
+	return err
+}
@@ -0,0 +1,433 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package recorder implements the Recorder filter, which records sampled
+// request/response exchanges into local files for later replay.
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/trafficrecord"
+)
+
+const (
+	// Kind is the kind of Recorder.
+	Kind = "Recorder"
+
+	defaultMaxBodySize = 1024 * 1024
+	defaultMaxFileSize = 100
+	defaultMaxBackups  = 5
+	defaultQueueSize   = 1024
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "Recorder records sampled request/response exchanges into local files",
+	Results:     []string{},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{
+			Format:      trafficrecord.FormatNDJSON,
+			Percentage:  100,
+			MaxBodySize: defaultMaxBodySize,
+			MaxFileSize: defaultMaxFileSize,
+			MaxBackups:  defaultMaxBackups,
+			QueueSize:   defaultQueueSize,
+		}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &Recorder{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+type (
+	// Recorder is filter Recorder.
+	Recorder struct {
+		spec   *Spec
+		writer *recordWriter
+		// inherited is true if the writer is taken over by the next
+		// generation.
+		inherited bool
+
+		redactHeaders []string
+	}
+
+	// recordWriter writes records to the file in the background, it is
+	// shared by the generations of a Recorder if the output settings are
+	// not changed, so the file is kept open and the counters are kept.
+	recordWriter struct {
+		recorded uint64
+		dropped  uint64
+		skipped  uint64
+		failed   uint64
+
+		name    string
+		format  string
+		file    *recordFile
+		records chan *trafficrecord.Record
+		done    chan struct{}
+		wg      sync.WaitGroup
+	}
+
+	// Spec describes the Recorder.
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+
+		File        string      `json:"file" jsonschema:"required"`
+		Format      string      `json:"format" jsonschema:"omitempty,enum=ndjson,enum=har"`
+		Percentage  float64     `json:"percentage" jsonschema:"omitempty,minimum=0,maximum=100"`
+		MaxBodySize int64       `json:"maxBodySize" jsonschema:"omitempty,minimum=1"`
+		MaxFileSize int64       `json:"maxFileSize" jsonschema:"omitempty,minimum=1"`
+		MaxBackups  int         `json:"maxBackups" jsonschema:"omitempty,minimum=0"`
+		QueueSize   int         `json:"queueSize" jsonschema:"omitempty,minimum=1"`
+		Redact      *RedactSpec `json:"redact,omitempty" jsonschema:"omitempty"`
+	}
+
+	// RedactSpec describes the sensitive data to be redacted.
+	RedactSpec struct {
+		// Headers are the names of the headers to redact, in both the
+		// request and the response.
+		Headers []string `json:"headers,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		// BodyFields are the dot separated paths of the fields to redact
+		// in JSON bodies, for example, 'user.password'.
+		BodyFields []string `json:"bodyFields,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	}
+
+	// Status is the status of Recorder.
+	Status struct {
+		Recorded uint64 `json:"recorded"`
+		Dropped  uint64 `json:"dropped"`
+		Skipped  uint64 `json:"skipped"`
+		Failed   uint64 `json:"failed"`
+	}
+)
+
+// Validate validates the Spec.
+func (s *Spec) Validate() error {
+	switch s.Format {
+	case "", trafficrecord.FormatNDJSON, trafficrecord.FormatHAR:
+	default:
+		return fmt.Errorf("unknown format %s", s.Format)
+	}
+	return nil
+}
+
+// Name returns the name of the Recorder filter instance.
+func (r *Recorder) Name() string {
+	return r.spec.Name()
+}
+
+// Kind returns the kind of Recorder.
+func (r *Recorder) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the Recorder.
+func (r *Recorder) Spec() filters.Spec {
+	return r.spec
+}
+
+// Init initializes Recorder.
+func (r *Recorder) Init() {
+	r.reload(nil)
+}
+
+// Inherit inherits previous generation of Recorder.
+func (r *Recorder) Inherit(previousGeneration filters.Filter) {
+	r.reload(previousGeneration.(*Recorder))
+}
+
+// sameOutput returns whether the output settings of two specs are the same.
+func sameOutput(s1, s2 *Spec) bool {
+	return s1.File == s2.File && s1.Format == s2.Format &&
+		s1.MaxFileSize == s2.MaxFileSize && s1.MaxBackups == s2.MaxBackups &&
+		s1.QueueSize == s2.QueueSize
+}
+
+func (r *Recorder) reload(previousGeneration *Recorder) {
+	if r.spec.Format == "" {
+		r.spec.Format = trafficrecord.FormatNDJSON
+	}
+	if r.spec.MaxBodySize <= 0 {
+		r.spec.MaxBodySize = defaultMaxBodySize
+	}
+	if r.spec.MaxFileSize <= 0 {
+		r.spec.MaxFileSize = defaultMaxFileSize
+	}
+	if r.spec.QueueSize <= 0 {
+		r.spec.QueueSize = defaultQueueSize
+	}
+
+	if r.spec.Redact != nil {
+		for _, h := range r.spec.Redact.Headers {
+			r.redactHeaders = append(r.redactHeaders, http.CanonicalHeaderKey(h))
+		}
+	}
+
+	// keep writing to the file of the previous generation, otherwise,
+	// a HAR file would be rotated on every update of the pipeline.
+	prev := previousGeneration
+	if prev != nil && prev.writer != nil && sameOutput(prev.spec, r.spec) {
+		r.writer = prev.writer
+		prev.inherited = true
+		return
+	}
+
+	maxSize := r.spec.MaxFileSize * 1024 * 1024
+	file, err := newRecordFile(r.spec.File, r.spec.Format, maxSize, r.spec.MaxBackups)
+	if err != nil {
+		logger.Errorf("%s: failed to open record file %s: %v", r.Name(), r.spec.File, err)
+		return
+	}
+
+	r.writer = &recordWriter{
+		name:    r.Name(),
+		format:  r.spec.Format,
+		file:    file,
+		records: make(chan *trafficrecord.Record, r.spec.QueueSize),
+		done:    make(chan struct{}),
+	}
+	r.writer.wg.Add(1)
+	go r.writer.run()
+}
+
+func (w *recordWriter) run() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-w.done:
+			// write the remaining records before exit.
+			for {
+				select {
+				case rec := <-w.records:
+					w.write(rec)
+				default:
+					if err := w.file.close(); err != nil {
+						logger.Errorf("%s: failed to close record file: %v", w.name, err)
+					}
+					return
+				}
+			}
+		case rec := <-w.records:
+			w.write(rec)
+		}
+	}
+}
+
+func (w *recordWriter) write(rec *trafficrecord.Record) {
+	data, err := trafficrecord.Marshal(rec, w.format)
+	if err == nil {
+		err = w.file.write(data)
+	}
+
+	if err != nil {
+		logger.Errorf("%s: failed to write record: %v", w.name, err)
+		atomic.AddUint64(&w.failed, 1)
+		return
+	}
+	atomic.AddUint64(&w.recorded, 1)
+}
+
+func (w *recordWriter) close() {
+	close(w.done)
+	w.wg.Wait()
+}
+
+func (r *Recorder) sample() bool {
+	if r.spec.Percentage >= 100 {
+		return true
+	}
+	return rand.Float64()*100 < r.spec.Percentage
+}
+
+// Handle takes a snapshot of the request, and records it together with
+// the response when the request is finished. The Recorder should be the
+// first filter of the pipeline to record the original request and the
+// full processing time. It never changes the request or the response,
+// and always returns an empty result.
+func (r *Recorder) Handle(ctx *context.Context) string {
+	if r.writer == nil || !r.sample() {
+		return ""
+	}
+
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	if req.IsStream() || req.PayloadSize() > r.spec.MaxBodySize {
+		atomic.AddUint64(&r.writer.skipped, 1)
+		return ""
+	}
+
+	// the URL of a server request usually contains only the path and
+	// query, complete it so that the record is self-contained.
+	u := *req.URL()
+	if u.Host == "" {
+		u.Scheme = req.Scheme()
+		u.Host = req.Host()
+	}
+
+	rec := &trafficrecord.Record{
+		StartedAt: time.Now(),
+		Request: &trafficrecord.Request{
+			Method: req.Method(),
+			URL:    u.String(),
+			Proto:  req.Proto(),
+			Header: req.HTTPHeader().Clone(),
+			Body:   req.RawPayload(),
+		},
+	}
+	ctx.OnFinish(func() {
+		r.finish(ctx, rec)
+	})
+
+	return ""
+}
+
+// finish fills the response of the record and puts it into the queue.
+func (r *Recorder) finish(ctx *context.Context, rec *trafficrecord.Record) {
+	rec.Duration = float64(time.Now().Sub(rec.StartedAt)) / float64(time.Millisecond)
+
+	if resp, _ := ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response); resp != nil {
+		rec.Response = &trafficrecord.Response{
+			StatusCode: resp.StatusCode(),
+			Header:     resp.HTTPHeader().Clone(),
+		}
+		if resp.IsStream() || int64(len(resp.RawPayload())) > r.spec.MaxBodySize {
+			rec.Response.BodyOmitted = true
+		} else {
+			rec.Response.Body = resp.RawPayload()
+		}
+	}
+
+	r.redact(rec)
+
+	select {
+	case r.writer.records <- rec:
+	default:
+		atomic.AddUint64(&r.writer.dropped, 1)
+	}
+}
+
+func (r *Recorder) redact(rec *trafficrecord.Record) {
+	if r.spec.Redact == nil {
+		return
+	}
+
+	for _, h := range r.redactHeaders {
+		redactHeader(rec.Request.Header, h)
+		if rec.Response != nil {
+			redactHeader(rec.Response.Header, h)
+		}
+	}
+
+	if len(r.spec.Redact.BodyFields) == 0 {
+		return
+	}
+	rec.Request.Body = redactBody(rec.Request.Body, r.spec.Redact.BodyFields)
+	if rec.Response != nil {
+		rec.Response.Body = redactBody(rec.Response.Body, r.spec.Redact.BodyFields)
+	}
+}
+
+func redactHeader(h http.Header, key string) {
+	values := h[key]
+	for i := range values {
+		values[i] = trafficrecord.RedactedValue
+	}
+}
+
+// redactBody redacts the fields in a JSON body, the body is returned as
+// is if it is not a valid JSON.
+func redactBody(body []byte, fields []string) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+
+	for _, f := range fields {
+		redactField(v, strings.Split(f, "."))
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return data
+}
+
+// redactField redacts the field at path in v, all elements are checked
+// if there are arrays on the path.
+func redactField(v interface{}, path []string) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		child, ok := val[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			val[path[0]] = trafficrecord.RedactedValue
+			return
+		}
+		redactField(child, path[1:])
+	case []interface{}:
+		for _, e := range val {
+			redactField(e, path)
+		}
+	}
+}
+
+// Status returns status.
+func (r *Recorder) Status() interface{} {
+	w := r.writer
+	if w == nil {
+		return &Status{}
+	}
+	return &Status{
+		Recorded: atomic.LoadUint64(&w.recorded),
+		Dropped:  atomic.LoadUint64(&w.dropped),
+		Skipped:  atomic.LoadUint64(&w.skipped),
+		Failed:   atomic.LoadUint64(&w.failed),
+	}
+}
+
+// Close closes Recorder, the records in the queue are written to the
+// file before it is closed. The file is kept open if it is inherited by
+// the next generation.
+func (r *Recorder) Close() {
+	if r.writer == nil || r.inherited {
+		return
+	}
+	r.writer.close()
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package recorder
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/trafficrecord"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func newTestRecorder(yamlConfig string, assert *assert.Assertions) *Recorder {
+	rawSpec := make(map[string]interface{})
+	err := codectool.Unmarshal([]byte(yamlConfig), &rawSpec)
+	assert.NoError(err)
+
+	spec, err := filters.NewSpec(nil, "", rawSpec)
+	assert.NoError(err)
+
+	r := kind.CreateInstance(spec).(*Recorder)
+	r.Init()
+
+	assert.Equal(kind, r.Kind())
+	assert.Equal(spec, r.Spec())
+	return r
+}
+
+func handle(r *Recorder, body string) {
+	stdr, _ := http.NewRequest(http.MethodPost, "http://www.megaease.com/foo?a=b", strings.NewReader(body))
+	stdr.Header.Set("Authorization", "secret")
+	stdr.Header.Set("X-Foo", "foo")
+	req, _ := httpprot.NewRequest(stdr)
+	req.FetchPayload(0)
+
+	ctx := context.New(tracing.NoopSpan)
+	ctx.SetRequest(context.DefaultNamespace, req)
+
+	r.Handle(ctx)
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(http.StatusCreated)
+	resp.HTTPHeader().Set("Set-Cookie", "session=secret")
+	resp.SetPayload(`{"id": 1, "token": "secret"}`)
+	ctx.SetResponse(context.DefaultNamespace, resp)
+
+	ctx.Finish()
+}
+
+func readFile(filename, format string, assert *assert.Assertions) []*trafficrecord.Record {
+	f, err := os.Open(filename)
+	assert.NoError(err)
+	defer f.Close()
+
+	records, err := trafficrecord.ReadRecords(f, format)
+	assert.NoError(err)
+	return records
+}
+
+func TestSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{}
+	assert.NoError(spec.Validate())
+
+	spec.Format = trafficrecord.FormatHAR
+	assert.NoError(spec.Validate())
+
+	spec.Format = "xml"
+	assert.Error(spec.Validate())
+}
+
+func TestRecorder(t *testing.T) {
+	for _, format := range []string{trafficrecord.FormatNDJSON, trafficrecord.FormatHAR} {
+		t.Run(format, func(t *testing.T) {
+			assert := assert.New(t)
+
+			filename := filepath.Join(t.TempDir(), "records."+format)
+			yamlConfig := fmt.Sprintf(`
+kind: Recorder
+name: recorder
+file: %s
+format: %s
+maxBodySize: 60
+redact:
+  headers: ["authorization", "Set-Cookie"]
+  bodyFields: ["token", "user.password"]
+`, filename, format)
+			r := newTestRecorder(yamlConfig, assert)
+
+			handle(r, `{"user": {"name": "alice", "password": "123"}}`)
+			handle(r, `{"user": [{"password": "123"}, {"password": "456"}]}`)
+			handle(r, "this body is too large to be recorded by the recorder, it is skipped")
+			r.Close()
+
+			status := r.Status().(*Status)
+			assert.EqualValues(2, status.Recorded)
+			assert.EqualValues(1, status.Skipped)
+
+			records := readFile(filename, format, assert)
+			assert.Len(records, 2)
+
+			rec := records[0]
+			assert.Equal(http.MethodPost, rec.Request.Method)
+			assert.Equal("http://www.megaease.com/foo?a=b", rec.Request.URL)
+			assert.Equal(trafficrecord.RedactedValue, rec.Request.Header.Get("Authorization"))
+			assert.Equal("foo", rec.Request.Header.Get("X-Foo"))
+			assert.JSONEq(`{"user": {"name": "alice", "password": "[REDACTED]"}}`, string(rec.Request.Body))
+			assert.Equal(http.StatusCreated, rec.Response.StatusCode)
+			assert.Equal(trafficrecord.RedactedValue, rec.Response.Header.Get("Set-Cookie"))
+			assert.JSONEq(`{"id": 1, "token": "[REDACTED]"}`, string(rec.Response.Body))
+
+			rec = records[1]
+			assert.JSONEq(`{"user": [{"password": "[REDACTED]"}, {"password": "[REDACTED]"}]}`, string(rec.Request.Body))
+		})
+	}
+}
+
+func TestInherit(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "records.har")
+	yamlConfig := `
+kind: Recorder
+name: recorder
+file: %s
+format: har
+maxBodySize: %d
+`
+	newRecorder := func(filename string, maxBodySize int) *Recorder {
+		rawSpec := make(map[string]interface{})
+		err := codectool.Unmarshal([]byte(fmt.Sprintf(yamlConfig, filename, maxBodySize)), &rawSpec)
+		assert.NoError(err)
+		spec, err := filters.NewSpec(nil, "", rawSpec)
+		assert.NoError(err)
+		return kind.CreateInstance(spec).(*Recorder)
+	}
+
+	r1 := newRecorder(filename, 1024)
+	r1.Init()
+	handle(r1, "{}")
+
+	// the output settings are not changed, the file is kept.
+	r2 := newRecorder(filename, 2048)
+	r2.Inherit(r1)
+	r1.Close()
+	handle(r2, "{}")
+	assert.Eventually(func() bool {
+		return r2.Status().(*Status).Recorded == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// the file is changed, the previous one is closed.
+	r3 := newRecorder(filepath.Join(dir, "records2.har"), 2048)
+	r3.Inherit(r2)
+	r2.Close()
+	handle(r3, "{}")
+	r3.Close()
+	assert.EqualValues(1, r3.Status().(*Status).Recorded)
+
+	assert.Len(readFile(filename, trafficrecord.FormatHAR, assert), 2)
+	backups, _ := filepath.Glob(filepath.Join(dir, "records-*.har"))
+	assert.Empty(backups)
+}
+
+func TestRecordFileRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "records.har")
+
+	rf, err := newRecordFile(filename, trafficrecord.FormatHAR, 200, 1)
+	assert.NoError(err)
+
+	rec := &trafficrecord.Record{Request: &trafficrecord.Request{Method: http.MethodGet, URL: "http://127.0.0.1/", Header: http.Header{}}}
+	data, err := trafficrecord.Marshal(rec, trafficrecord.FormatHAR)
+	assert.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(rf.write(data))
+	}
+
+	// the file is still being written, but it is readable.
+	records := readFile(filename, trafficrecord.FormatHAR, assert)
+	assert.Len(records, 1)
+	assert.Equal("http://127.0.0.1/", records[0].Request.URL)
+
+	assert.NoError(rf.close())
+
+	backups, _ := filepath.Glob(filepath.Join(dir, "records-*.har"))
+	assert.Len(backups, 1)
+	assert.Len(readFile(backups[0], trafficrecord.FormatHAR, assert), 1)
+
+	// the existing HAR file is rotated on open.
+	rf, err = newRecordFile(filename, trafficrecord.FormatHAR, 200, 1)
+	assert.NoError(err)
+	assert.NoError(rf.close())
+	backups, _ = filepath.Glob(filepath.Join(dir, "records-*.har"))
+	assert.Len(backups, 1)
+}
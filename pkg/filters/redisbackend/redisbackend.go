@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package redisbackend implements a Redis Streams proxy for HTTP requests.
+package redisbackend
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/mqhelper"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Kind is the kind of RedisStream
+	Kind = "RedisStream"
+
+	resultParseErr      = "parseErr"
+	resultPublishFailed = "publishFailed"
+
+	defaultPayloadField = "payload"
+	defaultTimeout      = 5 * time.Second
+)
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "RedisStream is a Redis Streams proxy for HTTP requests",
+	Results:     []string{resultParseErr, resultPublishFailed},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &RedisStream{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	filters.Register(kind)
+}
+
+// clients are shared by the filter instances with the same configuration.
+var clients = mqhelper.NewPool()
+
+type (
+	// RedisStream is a Redis Streams proxy for HTTP requests.
+	RedisStream struct {
+		spec    *Spec
+		client  *redis.Client
+		key     string
+		timeout time.Duration
+	}
+)
+
+var _ filters.Filter = (*RedisStream)(nil)
+
+// Name returns the name of the RedisStream filter instance.
+func (r *RedisStream) Name() string {
+	return r.spec.Name()
+}
+
+// Kind return kind of RedisStream
+func (r *RedisStream) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the RedisStream
+func (r *RedisStream) Spec() filters.Spec {
+	return r.spec
+}
+
+// Init init RedisStream
+func (r *RedisStream) Init() {
+	spec := r.spec
+	r.timeout = defaultTimeout
+	if spec.Timeout != "" {
+		r.timeout, _ = time.ParseDuration(spec.Timeout)
+	}
+
+	r.key = fmt.Sprintf("%s/%s/%s/%d", spec.Address, spec.Username, spec.Password, spec.DB)
+	client, err := clients.Get(r.key, func() (io.Closer, error) {
+		return redis.NewClient(&redis.Options{
+			Addr:     spec.Address,
+			Username: spec.Username,
+			Password: spec.Password,
+			DB:       spec.DB,
+		}), nil
+	})
+	if err != nil {
+		panic(fmt.Errorf("create redis client with address %s failed: %v", spec.Address, err))
+	}
+	r.client = client.(*redis.Client)
+}
+
+// Inherit init RedisStream based on previous generation
+func (r *RedisStream) Inherit(previousGeneration filters.Filter) {
+	r.Init()
+}
+
+// Close close RedisStream
+func (r *RedisStream) Close() {
+	if err := clients.Put(r.key); err != nil {
+		logger.Errorf("close redis client failed: %v", err)
+	}
+}
+
+// Status return status of RedisStream
+func (r *RedisStream) Status() interface{} {
+	return nil
+}
+
+// Handle handles the context.
+func (r *RedisStream) Handle(ctx *context.Context) string {
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	stream := r.spec.Stream.Topic(req.HTTPHeader())
+
+	body, err := io.ReadAll(req.GetPayload())
+	if err != nil {
+		return resultParseErr
+	}
+
+	values := map[string]interface{}{}
+	for field, value := range mqhelper.Properties(req.HTTPHeader(), r.spec.Headers) {
+		values[field] = value
+	}
+	values[r.spec.payloadField()] = body
+
+	args := &redis.XAddArgs{
+		Stream: stream,
+		Values: values,
+	}
+	if r.spec.MaxLen > 0 {
+		args.MaxLen = r.spec.MaxLen
+		args.Approx = true
+	}
+
+	timeoutCtx, cancel := stdcontext.WithTimeout(stdcontext.Background(), r.timeout)
+	defer cancel()
+	if err := r.client.XAdd(timeoutCtx, args).Err(); err != nil {
+		logger.Errorf("add message to redis stream %s failed: %v", stream, err)
+		resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+		if resp == nil {
+			resp, _ = httpprot.NewResponse(nil)
+		}
+		resp.SetStatusCode(http.StatusServiceUnavailable)
+		ctx.SetOutputResponse(resp)
+		return resultPublishFailed
+	}
+	return ""
+}
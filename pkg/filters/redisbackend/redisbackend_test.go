@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisbackend
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/mqhelper"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+func newFilter(t *testing.T, spec *Spec) *RedisStream {
+	spec.BaseSpec.MetaSpec.Kind = Kind
+	spec.BaseSpec.MetaSpec.Name = "redis"
+	filterSpec, err := filters.NewSpec(nil, "pipeline-demo", spec)
+	assert.Nil(t, err)
+	r := kind.CreateInstance(filterSpec).(*RedisStream)
+	r.Init()
+	return r
+}
+
+func newContext(t *testing.T, body string, header map[string]string) *context.Context {
+	ctx := context.New(nil)
+	stdReq, err := http.NewRequest(http.MethodPost, "http://127.0.0.1/", strings.NewReader(body))
+	assert.Nil(t, err)
+	for k, v := range header {
+		stdReq.Header.Set(k, v)
+	}
+	req, err := httpprot.NewRequest(stdReq)
+	assert.Nil(t, err)
+	assert.Nil(t, req.FetchPayload(1024*1024))
+	ctx.SetInputRequest(req)
+	return ctx
+}
+
+func TestRedisStream(t *testing.T) {
+	assert := assert.New(t)
+
+	server := miniredis.RunT(t)
+	r := newFilter(t, &Spec{
+		Address: server.Addr(),
+		Stream: &mqhelper.TopicSpec{
+			Default: "events",
+			Dynamic: &mqhelper.DynamicSpec{Header: "X-Stream"},
+		},
+		Headers: map[string]string{"X-Request-Id": "requestID"},
+		MaxLen:  100,
+	})
+	assert.Equal("redis", r.Name())
+	assert.Equal(kind, r.Kind())
+	assert.Nil(r.Status())
+
+	// filters with the same configuration share the client
+	r2 := newFilter(t, &Spec{Address: server.Addr(), Stream: &mqhelper.TopicSpec{Default: "events"}})
+	assert.Same(r.client, r2.client)
+	r2.Close()
+
+	ctx := newContext(t, "hello", map[string]string{"X-Request-Id": "123"})
+	assert.Equal("", r.Handle(ctx))
+	ctx = newContext(t, "world", map[string]string{"X-Stream": "others"})
+	assert.Equal("", r.Handle(ctx))
+
+	entries, err := server.Stream("events")
+	assert.Nil(err)
+	assert.Equal(1, len(entries))
+	assert.ElementsMatch([]string{"requestID", "123", "payload", "hello"}, entries[0].Values)
+
+	entries, err = server.Stream("others")
+	assert.Nil(err)
+	assert.Equal(1, len(entries))
+	assert.Equal([]string{"payload", "world"}, entries[0].Values)
+
+	// failed to add the entry
+	server.SetError("mock error")
+	ctx = newContext(t, "hello", nil)
+	assert.Equal(resultPublishFailed, r.Handle(ctx))
+	assert.Equal(http.StatusServiceUnavailable, ctx.GetOutputResponse().(*httpprot.Response).StatusCode())
+	server.SetError("")
+
+	newR := kind.CreateInstance(r.spec).(*RedisStream)
+	newR.Inherit(r)
+	r.Close()
+	assert.Same(r.client, newR.client)
+	assert.Equal("", newR.Handle(newContext(t, "again", nil)))
+	newR.Close()
+}
+
+func TestSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil((&Spec{Timeout: "1s", Headers: map[string]string{"X-Id": "id"}}).Validate())
+	assert.NotNil((&Spec{Timeout: "1"}).Validate())
+	assert.NotNil((&Spec{Headers: map[string]string{"X-Id": "payload"}}).Validate())
+	assert.NotNil((&Spec{PayloadField: "body", Headers: map[string]string{"X-Id": "body"}}).Validate())
+}
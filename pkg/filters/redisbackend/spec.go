@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redisbackend
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/util/mqhelper"
+)
+
+type (
+	// Spec is spec of RedisStream
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+
+		Address  string `json:"address" jsonschema:"required"`
+		Username string `json:"username,omitempty" jsonschema:"omitempty"`
+		Password string `json:"password,omitempty" jsonschema:"omitempty"`
+		DB       int    `json:"db,omitempty" jsonschema:"omitempty,minimum=0"`
+
+		Stream *mqhelper.TopicSpec `json:"stream" jsonschema:"required"`
+		// PayloadField is the field of the entry which holds the HTTP body,
+		// default is payload.
+		PayloadField string `json:"payloadField,omitempty" jsonschema:"omitempty"`
+		// Headers maps HTTP headers to fields of the entry.
+		Headers map[string]string `json:"headers,omitempty" jsonschema:"omitempty"`
+		// MaxLen trims the stream to about MaxLen entries, zero means no
+		// trimming.
+		MaxLen  int64  `json:"maxLen,omitempty" jsonschema:"omitempty,minimum=0"`
+		Timeout string `json:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+)
+
+// Validate validates the Spec.
+func (spec *Spec) Validate() error {
+	if spec.Timeout != "" {
+		if _, err := time.ParseDuration(spec.Timeout); err != nil {
+			return err
+		}
+	}
+	for _, field := range spec.Headers {
+		if field == spec.payloadField() {
+			return fmt.Errorf("header field %s conflicts with the payload field", field)
+		}
+	}
+	return nil
+}
+
+func (spec *Spec) payloadField() string {
+	if spec.PayloadField == "" {
+		return defaultPayloadField
+	}
+	return spec.PayloadField
+}
@@ -0,0 +1,382 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package script
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+// newAPI creates the 'eg' table, which contains the functions for scripts
+// to interoperate with Easegress. The functions mirror the host functions
+// of WasmHost.
+func (v *vm) newAPI() *lua.LTable {
+	return v.ls.SetFuncs(v.ls.NewTable(), map[string]lua.LGFunction{
+		// request functions
+		"req_get_real_ip":      v.requestGetter(func(r *httpprot.Request) string { return r.RealIP() }),
+		"req_get_scheme":       v.requestGetter(func(r *httpprot.Request) string { return r.Scheme() }),
+		"req_get_proto":        v.requestGetter(func(r *httpprot.Request) string { return r.Proto() }),
+		"req_get_method":       v.requestGetter(func(r *httpprot.Request) string { return r.Method() }),
+		"req_set_method":       v.requestSetter(func(r *httpprot.Request, s string) { r.SetMethod(s) }),
+		"req_get_host":         v.requestGetter(func(r *httpprot.Request) string { return r.Host() }),
+		"req_set_host":         v.requestSetter(func(r *httpprot.Request, s string) { r.SetHost(s) }),
+		"req_get_path":         v.requestGetter(func(r *httpprot.Request) string { return r.Path() }),
+		"req_set_path":         v.requestSetter(func(r *httpprot.Request, s string) { r.SetPath(s) }),
+		"req_get_escaped_path": v.requestGetter(func(r *httpprot.Request) string { return r.Std().URL.EscapedPath() }),
+		"req_get_query":        v.requestGetter(func(r *httpprot.Request) string { return r.Std().URL.RawQuery }),
+		"req_set_query":        v.requestSetter(func(r *httpprot.Request, s string) { r.Std().URL.RawQuery = s }),
+		"req_get_fragment":     v.requestGetter(func(r *httpprot.Request) string { return r.Std().URL.Fragment }),
+		"req_get_header":       v.requestGetHeader,
+		"req_get_all_header":   v.requestGetAllHeader,
+		"req_set_header":       v.requestSetHeader,
+		"req_add_header":       v.requestAddHeader,
+		"req_del_header":       v.requestDelHeader,
+		"req_get_cookie":       v.requestGetCookie,
+		"req_get_body":         v.requestGetBody,
+		"req_set_body":         v.requestSetBody,
+
+		// response functions
+		"resp_get_status_code": v.responseGetStatusCode,
+		"resp_set_status_code": v.responseSetStatusCode,
+		"resp_get_header":      v.responseGetHeader,
+		"resp_get_all_header":  v.responseGetAllHeader,
+		"resp_set_header":      v.responseSetHeader,
+		"resp_add_header":      v.responseAddHeader,
+		"resp_del_header":      v.responseDelHeader,
+		"resp_set_cookie":      v.responseSetCookie,
+		"resp_get_body":        v.responseGetBody,
+		"resp_set_body":        v.responseSetBody,
+
+		// context data functions
+		"ctx_get_data": v.contextGetData,
+		"ctx_set_data": v.contextSetData,
+
+		// cluster data functions
+		"cluster_get":       v.clusterGet,
+		"cluster_put":       v.clusterPut,
+		"cluster_add":       v.clusterAdd,
+		"cluster_count_key": v.clusterCountKey,
+
+		// misc functions
+		"add_tag":             v.addTag,
+		"log":                 v.log,
+		"get_unix_time_in_ms": v.getUnixTimeInMs,
+		"rand":                v.rand,
+	})
+}
+
+func (v *vm) request() *httpprot.Request {
+	return v.ctx.GetInputRequest().(*httpprot.Request)
+}
+
+func (v *vm) response() *httpprot.Response {
+	return v.ctx.GetOutputResponse().(*httpprot.Response)
+}
+
+func (v *vm) requestGetter(fn func(r *httpprot.Request) string) lua.LGFunction {
+	return func(ls *lua.LState) int {
+		ls.Push(lua.LString(fn(v.request())))
+		return 1
+	}
+}
+
+func (v *vm) requestSetter(fn func(r *httpprot.Request, s string)) lua.LGFunction {
+	return func(ls *lua.LState) int {
+		fn(v.request(), ls.CheckString(1))
+		return 0
+	}
+}
+
+func headerToTable(ls *lua.LState, h http.Header) *lua.LTable {
+	t := ls.NewTable()
+	for k, values := range h {
+		vt := ls.CreateTable(len(values), 0)
+		for _, val := range values {
+			vt.Append(lua.LString(val))
+		}
+		t.RawSetString(k, vt)
+	}
+	return t
+}
+
+// payload is the payload of requests and responses.
+type payload interface {
+	IsStream() bool
+	GetPayload() io.Reader
+	SetPayload(payload interface{})
+}
+
+func setPayload(p payload, body string) {
+	if p.IsStream() {
+		if c, ok := p.GetPayload().(io.Closer); ok {
+			c.Close()
+		}
+	}
+	p.SetPayload([]byte(body))
+}
+
+// request functions
+
+func (v *vm) requestGetHeader(ls *lua.LState) int {
+	ls.Push(lua.LString(v.request().HTTPHeader().Get(ls.CheckString(1))))
+	return 1
+}
+
+func (v *vm) requestGetAllHeader(ls *lua.LState) int {
+	ls.Push(headerToTable(ls, v.request().HTTPHeader()))
+	return 1
+}
+
+func (v *vm) requestSetHeader(ls *lua.LState) int {
+	v.request().Header().Set(ls.CheckString(1), ls.CheckString(2))
+	return 0
+}
+
+func (v *vm) requestAddHeader(ls *lua.LState) int {
+	v.request().Header().Add(ls.CheckString(1), ls.CheckString(2))
+	return 0
+}
+
+func (v *vm) requestDelHeader(ls *lua.LState) int {
+	v.request().Header().Del(ls.CheckString(1))
+	return 0
+}
+
+func (v *vm) requestGetCookie(ls *lua.LState) int {
+	c, err := v.request().Cookie(ls.CheckString(1))
+	if err != nil {
+		ls.Push(lua.LNil)
+	} else {
+		ls.Push(lua.LString(c.Value))
+	}
+	return 1
+}
+
+func (v *vm) requestGetBody(ls *lua.LState) int {
+	ls.Push(lua.LString(v.request().RawPayload()))
+	return 1
+}
+
+func (v *vm) requestSetBody(ls *lua.LState) int {
+	setPayload(v.request(), ls.CheckString(1))
+	return 0
+}
+
+// response functions
+
+func (v *vm) responseGetStatusCode(ls *lua.LState) int {
+	ls.Push(lua.LNumber(v.response().StatusCode()))
+	return 1
+}
+
+func (v *vm) responseSetStatusCode(ls *lua.LState) int {
+	v.response().SetStatusCode(ls.CheckInt(1))
+	return 0
+}
+
+func (v *vm) responseGetHeader(ls *lua.LState) int {
+	ls.Push(lua.LString(v.response().HTTPHeader().Get(ls.CheckString(1))))
+	return 1
+}
+
+func (v *vm) responseGetAllHeader(ls *lua.LState) int {
+	ls.Push(headerToTable(ls, v.response().HTTPHeader()))
+	return 1
+}
+
+func (v *vm) responseSetHeader(ls *lua.LState) int {
+	v.response().Header().Set(ls.CheckString(1), ls.CheckString(2))
+	return 0
+}
+
+func (v *vm) responseAddHeader(ls *lua.LState) int {
+	v.response().Header().Add(ls.CheckString(1), ls.CheckString(2))
+	return 0
+}
+
+func (v *vm) responseDelHeader(ls *lua.LState) int {
+	v.response().Header().Del(ls.CheckString(1))
+	return 0
+}
+
+func (v *vm) responseSetCookie(ls *lua.LState) int {
+	h := http.Header{}
+	h.Add("Set-Cookie", ls.CheckString(1))
+	r := http.Response{Header: h}
+	for _, c := range r.Cookies() {
+		v.response().SetCookie(c)
+	}
+	return 0
+}
+
+func (v *vm) responseGetBody(ls *lua.LState) int {
+	ls.Push(lua.LString(v.response().RawPayload()))
+	return 1
+}
+
+func (v *vm) responseSetBody(ls *lua.LState) int {
+	setPayload(v.response(), ls.CheckString(1))
+	return 0
+}
+
+// context data functions
+
+// contextDataToLua converts context data to Lua values, data other than
+// strings, bytes, numbers and booleans are encoded in JSON.
+func contextDataToLua(val interface{}) lua.LValue {
+	switch val := val.(type) {
+	case nil:
+		return lua.LNil
+	case string:
+		return lua.LString(val)
+	case []byte:
+		return lua.LString(val)
+	case bool:
+		return lua.LBool(val)
+	case int:
+		return lua.LNumber(val)
+	case int64:
+		return lua.LNumber(val)
+	case float64:
+		return lua.LNumber(val)
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return lua.LNil
+	}
+	return lua.LString(data)
+}
+
+func (v *vm) contextGetData(ls *lua.LState) int {
+	ls.Push(contextDataToLua(v.ctx.GetData(ls.CheckString(1))))
+	return 1
+}
+
+func (v *vm) contextSetData(ls *lua.LState) int {
+	key := ls.CheckString(1)
+	switch val := ls.Get(2).(type) {
+	case lua.LString:
+		v.ctx.SetData(key, string(val))
+	case lua.LNumber:
+		v.ctx.SetData(key, float64(val))
+	case lua.LBool:
+		v.ctx.SetData(key, bool(val))
+	case *lua.LNilType:
+		v.ctx.SetData(key, nil)
+	default:
+		ls.ArgError(2, "string, number, boolean or nil expected")
+	}
+	return 0
+}
+
+// cluster data functions
+
+func (v *vm) clusterKey(ls *lua.LState) string {
+	return v.script.dataPrefix + ls.CheckString(1)
+}
+
+func (v *vm) clusterGet(ls *lua.LState) int {
+	if kv := v.script.Data()[v.clusterKey(ls)]; kv != nil {
+		ls.Push(lua.LString(kv.Value))
+	} else {
+		ls.Push(lua.LNil)
+	}
+	return 1
+}
+
+func (v *vm) clusterPut(ls *lua.LState) int {
+	key := v.clusterKey(ls)
+	if err := v.script.Cluster().Put(key, ls.CheckString(2)); err != nil {
+		ls.RaiseError("failed to put cluster data: %v", err)
+	}
+	return 0
+}
+
+func (v *vm) clusterAdd(ls *lua.LState) int {
+	key := v.clusterKey(ls)
+	addend := float64(ls.CheckNumber(2))
+	result := float64(0)
+
+	addFunc := func(stm concurrency.STM) error {
+		result, _ = strconv.ParseFloat(stm.Get(key), 64)
+		result += addend
+		stm.Put(key, strconv.FormatFloat(result, 'g', -1, 64))
+		return nil
+	}
+	if err := v.script.Cluster().STM(addFunc); err != nil {
+		ls.RaiseError("failed to add cluster data: %v", err)
+	}
+
+	ls.Push(lua.LNumber(result))
+	return 1
+}
+
+func (v *vm) clusterCountKey(ls *lua.LState) int {
+	prefix := v.clusterKey(ls)
+	count := 0
+	for k := range v.script.Data() {
+		if strings.HasPrefix(k, prefix) {
+			count++
+		}
+	}
+	ls.Push(lua.LNumber(count))
+	return 1
+}
+
+// misc functions
+
+func (v *vm) addTag(ls *lua.LState) int {
+	v.ctx.AddTag(ls.CheckString(1))
+	return 0
+}
+
+func (v *vm) log(ls *lua.LState) int {
+	level, msg := ls.CheckInt(1), ls.CheckString(2)
+	switch level {
+	case 0:
+		logger.Debugf("%s", msg)
+	case 1:
+		logger.Infof("%s", msg)
+	case 2:
+		logger.Warnf("%s", msg)
+	case 3:
+		logger.Errorf("%s", msg)
+	}
+	return 0
+}
+
+func (v *vm) getUnixTimeInMs(ls *lua.LState) int {
+	ls.Push(lua.LNumber(time.Now().UnixNano() / 1e6))
+	return 1
+}
+
+func (v *vm) rand(ls *lua.LState) int {
+	ls.Push(lua.LNumber(rand.Float64()))
+	return 1
+}
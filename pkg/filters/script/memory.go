@@ -0,0 +1,513 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package script
+
+import (
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+// The memory allocated by a script for a request is counted, and the
+// execution is interrupted when it exceeds the limit. A single operation
+// can create a huge string, so the strings created by the '..' operator
+// and the string and table libraries are counted before they are created.
+// Tables are counted by table constructors and assignments to new fields.
+const (
+	concatFuncName   = "@concat"
+	setTableFuncName = "@settable"
+	newTableFuncName = "@newtable"
+
+	// valueSize and tableSize are the estimated sizes of a value and an
+	// empty table.
+	valueSize = 16
+	tableSize = 64
+)
+
+// limitMemory rewrites the chunk to call the host functions which count
+// the memory. The host functions are passed to the chunk as its arguments
+// and kept in local variables whose names are not valid identifiers, so
+// scripts can't replace them.
+func limitMemory(chunk []ast.Stmt) []ast.Stmt {
+	decl := &ast.LocalAssignStmt{
+		Names: []string{concatFuncName, setTableFuncName, newTableFuncName},
+		Exprs: []ast.Expr{&ast.Comma3Expr{}},
+	}
+	return append([]ast.Stmt{decl}, rewriteStmts(chunk)...)
+}
+
+func rewriteStmts(stmts []ast.Stmt) []ast.Stmt {
+	for i, stmt := range stmts {
+		stmts[i] = rewriteStmt(stmt)
+	}
+	return stmts
+}
+
+func rewriteExprs(exprs []ast.Expr) []ast.Expr {
+	for i, expr := range exprs {
+		exprs[i] = rewriteExpr(expr)
+	}
+	return exprs
+}
+
+func rewriteStmt(stmt ast.Stmt) ast.Stmt {
+	switch st := stmt.(type) {
+	case *ast.AssignStmt:
+		rewriteExprs(st.Rhs)
+		for _, lhs := range st.Lhs {
+			if attr, ok := lhs.(*ast.AttrGetExpr); ok {
+				attr.Object = rewriteExpr(attr.Object)
+				attr.Key = rewriteExpr(attr.Key)
+			}
+		}
+		return rewriteAssign(st)
+	case *ast.LocalAssignStmt:
+		rewriteExprs(st.Exprs)
+	case *ast.FuncCallStmt:
+		st.Expr = rewriteExpr(st.Expr)
+	case *ast.DoBlockStmt:
+		rewriteStmts(st.Stmts)
+	case *ast.WhileStmt:
+		st.Condition = rewriteExpr(st.Condition)
+		rewriteStmts(st.Stmts)
+	case *ast.RepeatStmt:
+		st.Condition = rewriteExpr(st.Condition)
+		rewriteStmts(st.Stmts)
+	case *ast.IfStmt:
+		st.Condition = rewriteExpr(st.Condition)
+		rewriteStmts(st.Then)
+		rewriteStmts(st.Else)
+	case *ast.NumberForStmt:
+		st.Init = rewriteExpr(st.Init)
+		st.Limit = rewriteExpr(st.Limit)
+		st.Step = rewriteExpr(st.Step)
+		rewriteStmts(st.Stmts)
+	case *ast.GenericForStmt:
+		rewriteExprs(st.Exprs)
+		rewriteStmts(st.Stmts)
+	case *ast.FuncDefStmt:
+		rewriteStmts(st.Func.Stmts)
+	case *ast.ReturnStmt:
+		rewriteExprs(st.Exprs)
+	}
+	return stmt
+}
+
+func rewriteExpr(expr ast.Expr) ast.Expr {
+	switch ex := expr.(type) {
+	case *ast.StringConcatOpExpr:
+		return hostCall(concatFuncName, ex, rewriteExprs(concatOperands(ex, nil))...)
+	case *ast.TableExpr:
+		for _, field := range ex.Fields {
+			field.Key = rewriteExpr(field.Key)
+			field.Value = rewriteExpr(field.Value)
+		}
+		return hostCall(newTableFuncName, ex, ex)
+	case *ast.AttrGetExpr:
+		ex.Object = rewriteExpr(ex.Object)
+		ex.Key = rewriteExpr(ex.Key)
+	case *ast.FuncCallExpr:
+		ex.Func = rewriteExpr(ex.Func)
+		ex.Receiver = rewriteExpr(ex.Receiver)
+		rewriteExprs(ex.Args)
+	case *ast.LogicalOpExpr:
+		ex.Lhs = rewriteExpr(ex.Lhs)
+		ex.Rhs = rewriteExpr(ex.Rhs)
+	case *ast.RelationalOpExpr:
+		ex.Lhs = rewriteExpr(ex.Lhs)
+		ex.Rhs = rewriteExpr(ex.Rhs)
+	case *ast.ArithmeticOpExpr:
+		ex.Lhs = rewriteExpr(ex.Lhs)
+		ex.Rhs = rewriteExpr(ex.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		ex.Expr = rewriteExpr(ex.Expr)
+	case *ast.UnaryNotOpExpr:
+		ex.Expr = rewriteExpr(ex.Expr)
+	case *ast.UnaryLenOpExpr:
+		ex.Expr = rewriteExpr(ex.Expr)
+	case *ast.FunctionExpr:
+		rewriteStmts(ex.Stmts)
+	}
+	return expr
+}
+
+// concatOperands flattens 'a .. b .. c' to its operands, so they are
+// joined at once.
+func concatOperands(expr ast.Expr, operands []ast.Expr) []ast.Expr {
+	if ex, ok := expr.(*ast.StringConcatOpExpr); ok {
+		operands = concatOperands(ex.Lhs, operands)
+		return concatOperands(ex.Rhs, operands)
+	}
+	return append(operands, expr)
+}
+
+// rewriteAssign rewrites assignments to table fields to calls of the host
+// function. Like Lua, all expressions are evaluated before the
+// assignments in a multiple assignment.
+func rewriteAssign(st *ast.AssignStmt) ast.Stmt {
+	hasField := false
+	for _, lhs := range st.Lhs {
+		if _, ok := lhs.(*ast.AttrGetExpr); ok {
+			hasField = true
+		}
+	}
+	if !hasField {
+		return st
+	}
+
+	if len(st.Lhs) == 1 && len(st.Rhs) == 1 {
+		attr := st.Lhs[0].(*ast.AttrGetExpr)
+		return hostCallStmt(st, hostCall(setTableFuncName, st, attr.Object, attr.Key, st.Rhs[0]))
+	}
+
+	keys := &ast.LocalAssignStmt{}
+	values := &ast.LocalAssignStmt{Exprs: st.Rhs}
+	var assigns []ast.Stmt
+	for i, lhs := range st.Lhs {
+		value := tempIdent("@v", i, st)
+		values.Names = append(values.Names, value.Value)
+
+		attr, ok := lhs.(*ast.AttrGetExpr)
+		if !ok {
+			assign := &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Rhs: []ast.Expr{value}}
+			assign.SetLine(st.Line())
+			assigns = append(assigns, assign)
+			continue
+		}
+
+		obj, key := tempIdent("@o", i, st), tempIdent("@k", i, st)
+		keys.Names = append(keys.Names, obj.Value, key.Value)
+		keys.Exprs = append(keys.Exprs, attr.Object, attr.Key)
+		assigns = append(assigns, hostCallStmt(st, hostCall(setTableFuncName, st, obj, key, value)))
+	}
+
+	block := &ast.DoBlockStmt{Stmts: append([]ast.Stmt{keys, values}, assigns...)}
+	block.SetLine(st.Line())
+	block.SetLastLine(st.LastLine())
+	return block
+}
+
+func tempIdent(prefix string, i int, pos ast.PositionHolder) *ast.IdentExpr {
+	ident := &ast.IdentExpr{Value: prefix + strconv.Itoa(i)}
+	ident.SetLine(pos.Line())
+	return ident
+}
+
+// hostCall creates a call of the host function, the arguments are
+// truncated to one value like the operands of operators.
+func hostCall(name string, pos ast.PositionHolder, args ...ast.Expr) ast.Expr {
+	for _, arg := range args {
+		switch a := arg.(type) {
+		case *ast.FuncCallExpr:
+			a.AdjustRet = true
+		case *ast.Comma3Expr:
+			a.AdjustRet = true
+		}
+	}
+
+	fn := &ast.IdentExpr{Value: name}
+	fn.SetLine(pos.Line())
+	call := &ast.FuncCallExpr{Func: fn, Args: args}
+	call.SetLine(pos.Line())
+	call.SetLastLine(pos.LastLine())
+	return call
+}
+
+func hostCallStmt(pos ast.PositionHolder, call ast.Expr) ast.Stmt {
+	stmt := &ast.FuncCallStmt{Expr: call}
+	stmt.SetLine(pos.Line())
+	stmt.SetLastLine(pos.LastLine())
+	return stmt
+}
+
+// alloc counts the memory allocated by the script, it raises an error if
+// the memory exceeds the limit.
+func (v *vm) alloc(n int64) {
+	v.memory += n
+	if v.memory > v.maxMemory {
+		v.ls.RaiseError("memory limit of %d bytes exceeded", v.maxMemory)
+	}
+}
+
+// concat implements the '..' operator.
+func (v *vm) concat(ls *lua.LState) int {
+	top := ls.GetTop()
+	rhs := ls.Get(top)
+	for i := top - 1; i > 0; {
+		lhs := ls.Get(i)
+		if lua.LVCanConvToString(lhs) && lua.LVCanConvToString(rhs) {
+			// join all the operands which are strings or numbers.
+			j := i
+			for j > 0 && lua.LVCanConvToString(ls.Get(j)) {
+				j--
+			}
+			parts := make([]string, 0, i-j+1)
+			size := int64(0)
+			for k := j + 1; k <= i; k++ {
+				s := lua.LVAsString(ls.Get(k))
+				parts = append(parts, s)
+				size += int64(len(s))
+			}
+			s := lua.LVAsString(rhs)
+			parts = append(parts, s)
+			v.alloc(size + int64(len(s)))
+			rhs = lua.LString(strings.Join(parts, ""))
+			i = j
+			continue
+		}
+
+		fn := ls.GetMetaField(lhs, "__concat")
+		if fn == lua.LNil {
+			fn = ls.GetMetaField(rhs, "__concat")
+		}
+		if fn.Type() != lua.LTFunction {
+			ls.RaiseError("cannot perform concat operation between %v and %v", lhs.Type(), rhs.Type())
+		}
+		ls.Push(fn)
+		ls.Push(lhs)
+		ls.Push(rhs)
+		ls.Call(2, 1)
+		rhs = ls.Get(-1)
+		ls.Pop(1)
+		i--
+	}
+	ls.Push(rhs)
+	return 1
+}
+
+// allocField counts the memory of a new field of the table.
+func (v *vm) allocField(obj, key, value lua.LValue) {
+	if t, ok := obj.(*lua.LTable); ok && value != lua.LNil && t.RawGet(key) == lua.LNil {
+		v.alloc(2 * valueSize)
+	}
+}
+
+// setTable implements assignments to table fields.
+func (v *vm) setTable(ls *lua.LState) int {
+	obj, key, value := ls.Get(1), ls.Get(2), ls.Get(3)
+	v.allocField(obj, key, value)
+	ls.SetTable(obj, key, value)
+	return 0
+}
+
+// newTable counts the memory of tables created by table constructors.
+func (v *vm) newTable(ls *lua.LState) int {
+	t := ls.CheckTable(1)
+	n := int64(0)
+	t.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	v.alloc(tableSize + 2*valueSize*n)
+	return 1
+}
+
+// limitLibs wraps the library functions which allocate memory.
+func (v *vm) limitLibs() {
+	ls := v.ls
+	wrap := func(lib, name string, wrapper func(fn lua.LGFunction) lua.LGFunction) {
+		t := ls.G.Global
+		if lib != lua.BaseLibName {
+			t = ls.GetGlobal(lib).(*lua.LTable)
+		}
+		fn := t.RawGetString(name).(*lua.LFunction).GFunction
+		t.RawSetString(name, ls.NewFunction(wrapper(fn)))
+	}
+
+	for _, name := range []string{"char", "lower", "upper", "reverse"} {
+		wrap(lua.StringLibName, name, v.countResult)
+	}
+	wrap(lua.StringLibName, "rep", v.limitRep)
+	wrap(lua.StringLibName, "format", v.limitFormat)
+	wrap(lua.StringLibName, "gsub", v.limitGsub)
+	wrap(lua.TabLibName, "concat", v.limitTableConcat)
+	wrap(lua.TabLibName, "insert", func(fn lua.LGFunction) lua.LGFunction {
+		return func(ls *lua.LState) int {
+			v.alloc(valueSize)
+			return fn(ls)
+		}
+	})
+	wrap(lua.BaseLibName, "rawset", func(fn lua.LGFunction) lua.LGFunction {
+		return func(ls *lua.LState) int {
+			v.allocField(ls.Get(1), ls.Get(2), ls.Get(3))
+			return fn(ls)
+		}
+	})
+}
+
+// countResult counts the string returned by fn, whose size is bounded by
+// its arguments.
+func (v *vm) countResult(fn lua.LGFunction) lua.LGFunction {
+	return func(ls *lua.LState) int {
+		n := fn(ls)
+		if s, ok := ls.Get(-1).(lua.LString); ok {
+			v.alloc(int64(len(s)))
+		}
+		return n
+	}
+}
+
+func (v *vm) limitRep(fn lua.LGFunction) lua.LGFunction {
+	return func(ls *lua.LState) int {
+		s, n := ls.CheckString(1), ls.CheckInt(2)
+		if n > 0 {
+			v.alloc(int64(len(s)) * int64(n))
+		}
+		return fn(ls)
+	}
+}
+
+// limitFormat counts the max size of the result, which is the sum of the
+// widths, precisions and arguments of the verbs.
+func (v *vm) limitFormat(fn lua.LGFunction) lua.LGFunction {
+	const maxDigits = 1 << 24
+
+	return func(ls *lua.LState) int {
+		format := ls.CheckString(1)
+		size := int64(len(format))
+		arg := 2
+		for i := 0; i < len(format); i++ {
+			if format[i] != '%' {
+				continue
+			}
+			if i++; i < len(format) && format[i] == '%' {
+				continue
+			}
+			for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+				i++
+			}
+			n := int64(0)
+			for ; i < len(format) && (format[i] >= '0' && format[i] <= '9' || format[i] == '.'); i++ {
+				if format[i] == '.' {
+					size += n
+					n = 0
+				} else if n < maxDigits {
+					n = n*10 + int64(format[i]-'0')
+				}
+			}
+			size += n + 32
+			if s, ok := ls.Get(arg).(lua.LString); ok {
+				// %q escapes the string.
+				size += 2 * int64(len(s))
+			}
+			arg++
+		}
+		v.alloc(size)
+		return fn(ls)
+	}
+}
+
+// limitGsub counts the size of the result when the replacement is a
+// string, otherwise it counts the replacements returned by the table or
+// function.
+func (v *vm) limitGsub(fn lua.LGFunction) lua.LGFunction {
+	return func(ls *lua.LState) int {
+		s, pattern := ls.CheckString(1), ls.CheckString(2)
+
+		switch repl := ls.Get(3).(type) {
+		case lua.LString:
+			matches, err := pm.Find(pattern, []byte(s), 0, ls.OptInt(4, -1))
+			if err != nil {
+				// the error is raised by gsub.
+				break
+			}
+			size := int64(len(s))
+			for _, m := range matches {
+				size += gsubReplSize(string(repl), m) - int64(m.Capture(1)-m.Capture(0))
+			}
+			v.alloc(size)
+		case *lua.LTable:
+			ls.Replace(3, ls.NewFunction(func(ls *lua.LState) int {
+				value := ls.GetTable(repl, ls.Get(1))
+				v.countRepl(value)
+				ls.Push(value)
+				return 1
+			}))
+		case *lua.LFunction:
+			ls.Replace(3, ls.NewFunction(func(ls *lua.LState) int {
+				top := ls.GetTop()
+				ls.Push(repl)
+				for i := 1; i <= top; i++ {
+					ls.Push(ls.Get(i))
+				}
+				ls.Call(top, 1)
+				v.countRepl(ls.Get(-1))
+				return 1
+			}))
+		}
+		return fn(ls)
+	}
+}
+
+func (v *vm) countRepl(value lua.LValue) {
+	if lua.LVCanConvToString(value) {
+		v.alloc(int64(len(lua.LVAsString(value))))
+	}
+}
+
+// gsubReplSize returns the size of the replacement string of the match.
+func gsubReplSize(repl string, m *pm.MatchData) int64 {
+	size := int64(0)
+	for i := 0; i < len(repl); i++ {
+		if repl[i] != '%' || i+1 == len(repl) {
+			size++
+			continue
+		}
+		i++
+		if repl[i] < '0' || repl[i] > '9' {
+			size += 2
+			continue
+		}
+		idx := 2 * int(repl[i]-'0')
+		if idx >= m.CaptureLength() {
+			// the whole match, invalid indexes are reported by gsub.
+			idx = 0
+		}
+		if m.IsPosCapture(idx) {
+			size += 20
+		} else {
+			size += int64(m.Capture(idx+1) - m.Capture(idx))
+		}
+	}
+	return size
+}
+
+func (v *vm) limitTableConcat(fn lua.LGFunction) lua.LGFunction {
+	return func(ls *lua.LState) int {
+		t := ls.CheckTable(1)
+		sep := ls.OptString(2, "")
+		start, end := ls.OptInt(3, 1), ls.OptInt(4, t.Len())
+		if start < 1 {
+			start = 1
+		}
+		if end > t.Len() {
+			end = t.Len()
+		}
+		size := int64(0)
+		for i := start; i <= end; i++ {
+			value := t.RawGetInt(i)
+			if !lua.LVCanConvToString(value) {
+				// the error is raised by concat.
+				break
+			}
+			size += int64(len(lua.LVAsString(value)) + len(sep))
+		}
+		v.alloc(size)
+		return fn(ls)
+	}
+}
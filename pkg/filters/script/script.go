@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package script implements the Script filter which runs Lua scripts.
+package script
+
+import (
+	stdcontext "context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+)
+
+const (
+	// Kind is the kind of Script.
+	Kind            = "Script"
+	maxScriptResult = 9
+
+	resultOutOfVM      = "outOfVM"
+	resultScriptError  = "scriptError"
+	defaultCallStack   = 256
+	defaultMaxRegistry = 256 * 1024
+	defaultMaxMemory   = 32 * 1024 * 1024
+)
+
+func scriptResultToFilterResult(r int) string {
+	if r == 0 {
+		return ""
+	}
+	return fmt.Sprintf("scriptResult%d", r)
+}
+
+var kind = &filters.Kind{
+	Name:        Kind,
+	Description: "Script runs Lua scripts to process requests and responses",
+	Results:     []string{resultOutOfVM, resultScriptError},
+	DefaultSpec: func() filters.Spec {
+		return &Spec{
+			MaxConcurrency: 10,
+			Timeout:        "100ms",
+		}
+	},
+	CreateInstance: func(spec filters.Spec) filters.Filter {
+		return &Script{spec: spec.(*Spec)}
+	},
+}
+
+func init() {
+	for i := 1; i <= maxScriptResult; i++ {
+		kind.Results = append(kind.Results, scriptResultToFilterResult(i))
+	}
+	filters.Register(kind)
+}
+
+type (
+	// Spec is the spec of Script.
+	Spec struct {
+		filters.BaseSpec `json:",inline"`
+
+		MaxConcurrency   int32             `json:"maxConcurrency" jsonschema:"required,minimum=1"`
+		Code             string            `json:"code" jsonschema:"required"`
+		Timeout          string            `json:"timeout" jsonschema:"required,format=duration"`
+		Parameters       map[string]string `json:"parameters,omitempty" jsonschema:"omitempty"`
+		MaxCallStackSize int               `json:"maxCallStackSize,omitempty" jsonschema:"omitempty,minimum=16"`
+		MaxDataStackSize int               `json:"maxDataStackSize,omitempty" jsonschema:"omitempty,minimum=1024"`
+		MaxMemorySize    int64             `json:"maxMemorySize,omitempty" jsonschema:"omitempty,minimum=1048576"`
+		timeout          time.Duration
+	}
+
+	// Script is the filter which runs Lua scripts.
+	Script struct {
+		spec *Spec
+
+		proto      *lua.FunctionProto
+		dataPrefix string
+		data       atomic.Value
+		vmPool     *vmPool
+		chStop     chan struct{}
+
+		numOfRequest     int64
+		numOfScriptError int64
+	}
+
+	// Status is the status of Script.
+	Status struct {
+		Health           string `json:"health"`
+		NumOfRequest     int64  `json:"numOfRequest"`
+		NumOfScriptError int64  `json:"numOfScriptError"`
+	}
+)
+
+func compile(name, code string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(code), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(limitMemory(chunk), name)
+}
+
+// Validate validates the Spec.
+func (spec *Spec) Validate() error {
+	proto, err := compile(spec.Name(), spec.Code)
+	if err != nil {
+		return err
+	}
+
+	// run the script in a scratch VM to make sure it defines the handle
+	// function.
+	v, err := newVM(&Script{spec: spec, proto: proto})
+	if err != nil {
+		return err
+	}
+	v.close()
+	return nil
+}
+
+// Name returns the name of the Script filter instance.
+func (s *Script) Name() string {
+	return s.spec.Name()
+}
+
+// Kind returns the kind of Script.
+func (s *Script) Kind() *filters.Kind {
+	return kind
+}
+
+// Spec returns the spec used by the Script.
+func (s *Script) Spec() filters.Spec {
+	return s.spec
+}
+
+// Cluster returns the cluster.
+func (s *Script) Cluster() cluster.Cluster {
+	return s.spec.Super().Cluster()
+}
+
+// Data returns the shared data.
+func (s *Script) Data() map[string]*mvccpb.KeyValue {
+	d := s.data.Load()
+	if d == nil {
+		return map[string]*mvccpb.KeyValue{}
+	}
+	return d.(map[string]*mvccpb.KeyValue)
+}
+
+func (s *Script) watchData() {
+	var (
+		ch     <-chan map[string]*mvccpb.KeyValue
+		syncer cluster.Syncer
+		err    error
+	)
+
+	for {
+		c := s.Cluster()
+		syncer, err = c.Syncer(time.Minute)
+		if err == nil {
+			ch, err = syncer.SyncRawPrefix(s.dataPrefix)
+			if err == nil {
+				break
+			}
+		}
+		logger.Errorf("failed to watch script data: %v", err)
+		select {
+		case <-time.After(10 * time.Second):
+		case <-s.chStop:
+			return
+		}
+	}
+
+	for {
+		select {
+		case data := <-ch:
+			s.data.Store(data)
+		case <-s.chStop:
+			syncer.Close()
+			return
+		}
+	}
+}
+
+func (s *Script) reload() {
+	spec := s.spec
+	spec.timeout, _ = time.ParseDuration(spec.Timeout)
+	s.chStop = make(chan struct{})
+
+	proto, err := compile(spec.Name(), spec.Code)
+	if err != nil {
+		logger.Errorf("failed to compile script: %v", err)
+	} else {
+		s.proto = proto
+		s.vmPool = newVMPool(s)
+	}
+
+	s.dataPrefix = s.Cluster().Layout().ScriptDataPrefix(spec.Pipeline(), spec.Name())
+	go s.watchData()
+}
+
+// Init initializes Script.
+func (s *Script) Init() {
+	s.reload()
+}
+
+// Inherit inherits previous generation of Script.
+func (s *Script) Inherit(previousGeneration filters.Filter) {
+	s.reload()
+}
+
+// Handle runs the script to handle the request.
+func (s *Script) Handle(ctx *context.Context) (result string) {
+	if s.vmPool == nil {
+		ctx.AddTag("script VM pool is not initialized")
+		return resultOutOfVM
+	}
+
+	vm := s.vmPool.get()
+	if vm == nil {
+		ctx.AddTag("failed to get a script VM")
+		return resultOutOfVM
+	}
+	atomic.AddInt64(&s.numOfRequest, 1)
+
+	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
+	if resp == nil {
+		resp, _ = httpprot.NewResponse(nil)
+	}
+	ctx.SetOutputResponse(resp)
+
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	runCtx, cancel := stdcontext.WithTimeout(req.Context(), s.spec.timeout)
+	defer cancel()
+
+	r, err := vm.run(runCtx, ctx)
+	if err != nil {
+		// the VM may be in an inconsistent state after an error, discard
+		// it and a new VM will be created later.
+		logger.Errorf("script %s failed: %v", s.Name(), err)
+		msg := strings.SplitN(err.Error(), "\n", 2)[0]
+		ctx.AddTag(fmt.Sprintf("script error: %s", msg))
+		atomic.AddInt64(&s.numOfScriptError, 1)
+		vm.close()
+		s.vmPool.put(nil)
+		return resultScriptError
+	}
+
+	s.vmPool.put(vm)
+	return scriptResultToFilterResult(r)
+}
+
+// Status returns Status generated by the filter.
+func (s *Script) Status() interface{} {
+	st := &Status{Health: "ready"}
+	if s.vmPool == nil {
+		st.Health = "VM pool is not initialized"
+	}
+	st.NumOfRequest = atomic.LoadInt64(&s.numOfRequest)
+	st.NumOfScriptError = atomic.LoadInt64(&s.numOfScriptError)
+	return st
+}
+
+// Close closes Script.
+func (s *Script) Close() {
+	close(s.chStop)
+	if s.vmPool != nil {
+		s.vmPool.close()
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package script
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+func newSpec(code string) *Spec {
+	spec := &Spec{
+		MaxConcurrency: 2,
+		Code:           code,
+		Timeout:        "100ms",
+		Parameters:     map[string]string{"greeting": "hello"},
+	}
+	spec.timeout = 100 * time.Millisecond
+	return spec
+}
+
+func newScript(t *testing.T, code string) *Script {
+	spec := newSpec(code)
+	assert.Nil(t, spec.Validate())
+	return newScriptWithSpec(spec)
+}
+
+func newScriptWithSpec(spec *Spec) *Script {
+	s := kind.CreateInstance(spec).(*Script)
+	s.proto, _ = compile("test", spec.Code)
+	s.dataPrefix = "/script/data/pipeline/script/"
+	s.vmPool = newVMPool(s)
+	return s
+}
+
+func newContext(t *testing.T, body string) *context.Context {
+	ctx := context.New(nil)
+	stdReq, err := http.NewRequest(http.MethodPost, "http://127.0.0.1/api?a=1", strings.NewReader(body))
+	assert.Nil(t, err)
+	stdReq.Header.Set("X-User", "megaease")
+	stdReq.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	req, err := httpprot.NewRequest(stdReq)
+	assert.Nil(t, err)
+	assert.Nil(t, req.FetchPayload(0))
+	ctx.SetInputRequest(req)
+	return ctx
+}
+
+func TestKind(t *testing.T) {
+	assert := assert.New(t)
+	assert.NotNil(filters.GetKind(Kind))
+	assert.Contains(kind.Results, "scriptResult9")
+	assert.NotNil((&Spec{Code: "function handle("}).Validate())
+
+	// the script must define the handle function.
+	assert.ErrorContains(newSpec(`local a = 1`).Validate(), "function 'handle'")
+	assert.ErrorContains(newSpec(`handle = 1`).Validate(), "function 'handle'")
+	assert.ErrorContains(newSpec(`error("failed")`).Validate(), "failed")
+	assert.ErrorContains(newSpec(`while true do end`).Validate(), "context deadline exceeded")
+}
+
+func TestHandle(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newScript(t, `
+local count = 0
+
+function handle()
+  count = count + 1
+  local path = eg.req_get_path()
+  eg.req_set_header("X-Greeting", params.greeting .. " " .. eg.req_get_header("X-User"))
+  eg.req_set_path(path .. "/v2")
+  eg.ctx_set_data("count", count)
+  eg.add_tag("script")
+
+  local h = eg.req_get_all_header()
+  eg.resp_set_status_code(201)
+  eg.resp_set_header("X-Count", tostring(#h["X-User"]))
+  eg.resp_set_body(string.upper(eg.req_get_body()) .. eg.req_get_cookie("session"))
+  eg.req_set_body(eg.req_get_body() .. "!")
+  eg.resp_add_header("X-Body", eg.req_get_body())
+
+  if eg.req_get_query() == "a=1" then
+    return 2
+  end
+end
+`)
+	ctx := newContext(t, "body")
+	assert.Equal("scriptResult2", s.Handle(ctx))
+
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	assert.Equal("hello megaease", req.HTTPHeader().Get("X-Greeting"))
+	assert.Equal("/api/v2", req.Path())
+	assert.Equal(float64(1), ctx.GetData("count"))
+	assert.Equal("body!", string(req.RawPayload()))
+
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusCreated, resp.StatusCode())
+	assert.Equal("1", resp.HTTPHeader().Get("X-Count"))
+	assert.Equal("body!", resp.HTTPHeader().Get("X-Body"))
+	assert.Equal("BODYabc", string(resp.RawPayload()))
+
+	status := s.Status().(*Status)
+	assert.Equal(int64(1), status.NumOfRequest)
+	assert.Equal(int64(0), status.NumOfScriptError)
+}
+
+func TestSandbox(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, code := range []string{
+		`function handle() os.exit(1) end`,
+		`function handle() io.open("/etc/passwd") end`,
+		`function handle() dofile("/etc/passwd") end`,
+		`function handle() loadstring("return 1")() end`,
+		`function handle() return "result" end`,
+		`function handle() return 10 end`,
+	} {
+		s := newScript(t, code)
+		assert.Equal(resultScriptError, s.Handle(newContext(t, "")), code)
+		assert.Equal(int64(1), s.Status().(*Status).NumOfScriptError)
+	}
+
+	// VM is created again after an error
+	s := newScript(t, `
+function handle()
+  if eg.req_get_body() == "error" then
+    error("failed")
+  end
+end`)
+	assert.Equal(resultScriptError, s.Handle(newContext(t, "error")))
+	assert.Equal("", s.Handle(newContext(t, "")))
+	assert.Equal("", s.Handle(newContext(t, "")))
+
+	// missing handle function
+	s = newScriptWithSpec(newSpec(`local a = 1`))
+	assert.Equal(resultOutOfVM, s.Handle(newContext(t, "")))
+}
+
+func TestLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	// cpu time
+	s := newScript(t, `function handle() while true do end end`)
+	start := time.Now()
+	ctx := newContext(t, "")
+	assert.Equal(resultScriptError, s.Handle(ctx))
+	assert.Contains(ctx.Tags(), "context deadline exceeded")
+	assert.Less(time.Since(start), time.Second)
+
+	// call stack
+	s = newScript(t, `
+local function f(n) return 1 + f(n + 1) end
+function handle() f(1) end`)
+	ctx = newContext(t, "")
+	assert.Equal(resultScriptError, s.Handle(ctx))
+	assert.Contains(ctx.Tags(), "stack overflow")
+
+	// data stack
+	s = newScript(t, `
+function handle()
+  local t = {}
+  for i = 1, 300000 do t[i] = i end
+  return select("#", unpack(t))
+end`)
+	s.spec.timeout = time.Second
+	ctx = newContext(t, "")
+	assert.Equal(resultScriptError, s.Handle(ctx))
+	assert.Contains(ctx.Tags(), "registry overflow")
+
+	// memory
+	for _, code := range []string{
+		`function handle() local s = string.rep("x", 1e9) end`,
+		`function handle() local s = "x" for i = 1, 40 do s = s .. s end end`,
+		`function handle() local s = string.rep("x", 1e6) s = s:gsub("x+", string.rep("%0", 40)) end`,
+		`function handle() local s = string.rep("x", 1e6) s = s:gsub("x", function(c) return s end) end`,
+		`function handle() local s = string.format(string.rep("%999999s", 100), string.rep("", 100)) end`,
+		`function handle() local t = {} for i = 1, 1e7 do t[i] = i end end`,
+		`function handle() local t = {} for i = 1, 1e7 do t = {t} end end`,
+		`function handle() local t = {} for i = 1, 1e5 do t[i] = "x" end table.concat(t, string.rep("x", 1000)) end`,
+	} {
+		s = newScript(t, code)
+		s.spec.timeout = 10 * time.Second
+		ctx = newContext(t, "")
+		assert.Equal(resultScriptError, s.Handle(ctx), code)
+		assert.Contains(ctx.Tags(), "memory limit", code)
+	}
+
+	// the memory is counted per request
+	s = newScript(t, `function handle() local s = string.rep("x", 20 * 1024 * 1024) end`)
+	assert.Equal("", s.Handle(newContext(t, "")))
+	assert.Equal("", s.Handle(newContext(t, "")))
+}
+
+func TestMemoryRewrite(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newScript(t, `
+local mt = {__concat = function(a, b) return "mt" end}
+local function two() return "a", "b" end
+
+function handle()
+  local t = {1, 2, x = 3, two()}
+  assert(#t == 4 and t.x == 3 and t[4] == "b")
+  assert(1 .. "a" .. 2.5 == "1a2.5")
+  assert("a" .. two() == "aa")
+  assert(setmetatable({}, mt) .. "b" .. "c" == "mt")
+
+  local i = 1
+  i, t[i] = i + 1, 10
+  assert(i == 2 and t[1] == 10)
+  t.y, t.z = two()
+  assert(t.y == "a" and t.z == "b")
+
+  local p = setmetatable({}, {__newindex = function(t, k, v) rawset(t, k, v * 2) end})
+  p.a = 1
+  assert(p.a == 2)
+
+  assert(("abc"):gsub("%w", "%0%0") == "aabbcc")
+  assert(("abc"):gsub("(%w)", {a = "x"}) == "xbc")
+  assert(("abc"):gsub("%w", function(c) return c:upper() end) == "ABC")
+  assert(string.format("%5s|%.2f|%d", "a", 1.5, 3) == "    a|1.50|3")
+  assert(table.concat({1, 2, 3}, ",") == "1,2,3")
+  assert(string.rep("ab", 3) == "ababab")
+end`)
+	ctx := newContext(t, "")
+	assert.Equal("", s.Handle(ctx), ctx.Tags())
+}
+
+func TestClusterData(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newScript(t, `
+function handle()
+  eg.resp_set_header("X-Value", eg.cluster_get("key") or "nil")
+  eg.resp_set_header("X-Missing", eg.cluster_get("missing") or "nil")
+  eg.resp_set_header("X-Count", tostring(eg.cluster_count_key("k")))
+end`)
+	s.data.Store(map[string]*mvccpb.KeyValue{
+		s.dataPrefix + "key":  {Value: []byte("value")},
+		s.dataPrefix + "key2": {Value: []byte("value2")},
+	})
+
+	ctx := newContext(t, "")
+	assert.Equal("", s.Handle(ctx))
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal("value", resp.HTTPHeader().Get("X-Value"))
+	assert.Equal("nil", resp.HTTPHeader().Get("X-Missing"))
+	assert.Equal("2", resp.HTTPHeader().Get("X-Count"))
+}
+
+func TestContextDataToLua(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("nil", contextDataToLua(nil).String())
+	assert.Equal("abc", contextDataToLua([]byte("abc")).String())
+	assert.Equal("true", contextDataToLua(true).String())
+	assert.Equal("3", contextDataToLua(3).String())
+	assert.Equal(`{"a":1}`, contextDataToLua(map[string]int{"a": 1}).String())
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newScript(t, `function handle() end`)
+	s.chStop = make(chan struct{})
+
+	// take the VMs out to check them after closing, a nil VM is put back
+	// in place of a failed one.
+	vms := []*vm{s.vmPool.get(), s.vmPool.get()}
+	s.vmPool.put(vms[0])
+	s.vmPool.put(nil)
+	vms[1].close()
+
+	s.Close()
+	assert.True(vms[0].ls.IsClosed())
+}
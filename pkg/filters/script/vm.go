@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package script
+
+import (
+	stdcontext "context"
+	"fmt"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const handleFuncName = "handle"
+
+// unsafeBaseFuncs are the functions of the base library which are removed
+// from the sandbox, as they access the file system, load code dynamically
+// or write to the standard output.
+var unsafeBaseFuncs = []string{
+	"dofile", "loadfile", "load", "loadstring", "module", "require",
+	"print", "collectgarbage", "getfenv", "setfenv",
+}
+
+// vm is a Lua VM which runs the script.
+type vm struct {
+	script *Script
+	ls     *lua.LState
+	ctx    *context.Context
+	handle *lua.LFunction
+
+	// memory is the memory allocated by the current execution.
+	memory    int64
+	maxMemory int64
+}
+
+func newVM(s *Script) (*vm, error) {
+	spec := s.spec
+	opts := lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   spec.MaxCallStackSize,
+		RegistryMaxSize: spec.MaxDataStackSize,
+		// grow the data stack in large steps, small steps make the
+		// growing expensive as the stack is copied every time.
+		RegistryGrowStep: lua.RegistrySize,
+	}
+	if opts.CallStackSize == 0 {
+		opts.CallStackSize = defaultCallStack
+	}
+	if opts.RegistryMaxSize == 0 {
+		opts.RegistryMaxSize = defaultMaxRegistry
+	}
+
+	ls := lua.NewState(opts)
+	v := &vm{script: s, ls: ls, maxMemory: spec.MaxMemorySize}
+	if v.maxMemory == 0 {
+		v.maxMemory = defaultMaxMemory
+	}
+	if err := v.init(); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *vm) init() error {
+	ls := v.ls
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		if err := ls.CallByParam(lua.P{Fn: ls.NewFunction(lib.fn), Protect: true}, lua.LString(lib.name)); err != nil {
+			return err
+		}
+	}
+	for _, name := range unsafeBaseFuncs {
+		ls.SetGlobal(name, lua.LNil)
+	}
+	v.limitLibs()
+
+	params := ls.NewTable()
+	for k, val := range v.script.spec.Parameters {
+		params.RawSetString(k, lua.LString(val))
+	}
+	ls.SetGlobal("params", params)
+	ls.SetGlobal("eg", v.newAPI())
+
+	// run the script to define the handle function, which is also
+	// interrupted after the timeout.
+	if timeout, _ := time.ParseDuration(v.script.spec.Timeout); timeout > 0 {
+		runCtx, cancel := stdcontext.WithTimeout(stdcontext.Background(), timeout)
+		defer cancel()
+		ls.SetContext(runCtx)
+		defer ls.RemoveContext()
+	}
+	// the host functions used by the rewritten script, see limitMemory.
+	v.memory = 0
+	ls.Push(ls.NewFunctionFromProto(v.script.proto))
+	ls.Push(ls.NewFunction(v.concat))
+	ls.Push(ls.NewFunction(v.setTable))
+	ls.Push(ls.NewFunction(v.newTable))
+	if err := ls.PCall(3, 0, nil); err != nil {
+		return err
+	}
+
+	fn, ok := ls.GetGlobal(handleFuncName).(*lua.LFunction)
+	if !ok {
+		return fmt.Errorf("script doesn't define function '%s'", handleFuncName)
+	}
+	v.handle = fn
+	return nil
+}
+
+// run calls the handle function of the script, the execution is
+// interrupted when runCtx is done.
+func (v *vm) run(runCtx stdcontext.Context, ctx *context.Context) (int, error) {
+	ls := v.ls
+	v.ctx = ctx
+	v.memory = 0
+	ls.SetContext(runCtx)
+	defer func() {
+		ls.RemoveContext()
+		ls.SetTop(0)
+		v.ctx = nil
+	}()
+
+	if err := ls.CallByParam(lua.P{Fn: v.handle, NRet: 1, Protect: true}); err != nil {
+		return 0, err
+	}
+
+	switch r := ls.Get(-1).(type) {
+	case *lua.LNilType:
+		return 0, nil
+	case lua.LNumber:
+		n := int(r)
+		if lua.LNumber(n) == r && n >= 0 && n <= maxScriptResult {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid script result: %v", ls.Get(-1))
+}
+
+func (v *vm) close() {
+	v.ls.Close()
+}
+
+// vmPool is a pool of Lua VMs, all VMs share the same compiled script.
+type vmPool struct {
+	script *Script
+	chVM   chan *vm
+}
+
+func newVMPool(s *Script) *vmPool {
+	p := &vmPool{script: s, chVM: make(chan *vm, s.spec.MaxConcurrency)}
+	for i := int32(0); i < s.spec.MaxConcurrency; i++ {
+		v, err := newVM(s)
+		if err != nil {
+			logger.Errorf("failed to create script VM: %v", err)
+		}
+		p.chVM <- v
+	}
+	return p
+}
+
+// get gets a VM from the pool, a new VM is created if the VM in the pool
+// is nil.
+func (p *vmPool) get() *vm {
+	v := <-p.chVM
+	if v != nil {
+		return v
+	}
+
+	v, err := newVM(p.script)
+	if err != nil {
+		p.chVM <- nil
+		logger.Errorf("failed to create script VM: %v", err)
+		return nil
+	}
+	return v
+}
+
+// put puts a VM to the pool, putting a nil VM is allowed.
+func (p *vmPool) put(v *vm) {
+	p.chVM <- v
+}
+
+// close closes the VMs in the pool, it waits for the VMs in use to be put
+// back, which takes at most the timeout of the script.
+func (p *vmPool) close() {
+	for i := int32(0); i < p.script.spec.MaxConcurrency; i++ {
+		if v := <-p.chVM; v != nil {
+			v.close()
+		}
+	}
+}
@@ -34,6 +34,8 @@ type (
 	SetKV struct {
 		Topic   string `json:"topic" jsonschema:"topic"`
 		Headers string `json:"headers" jsonschema:"headers"`
+		// UserProperties appends the headers to the user properties of MQTT 5 packet
+		UserProperties bool `json:"userProperties,omitempty"`
 	}
 
 	// PolicyRe to match right policy to do topic map
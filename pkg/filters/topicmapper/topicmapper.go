@@ -19,6 +19,8 @@
 package topicmapper
 
 import (
+	"sort"
+
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/filters"
 	"github.com/megaease/easegress/pkg/logger"
@@ -111,5 +113,17 @@ func (k *TopicMapper) Handle(ctx *context.Context) string {
 	}
 	ctx.SetData(k.spec.SetKV.Topic, topic)
 	ctx.SetData(k.spec.SetKV.Headers, headers)
+	if k.spec.SetKV.UserProperties {
+		props := req.UserProperties()
+		keys := make([]string, 0, len(headers))
+		for key := range headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			props = append(props, mqttprot.UserProperty{Key: key, Value: headers[key]})
+		}
+		req.SetUserProperties(props)
+	}
 	return ""
 }
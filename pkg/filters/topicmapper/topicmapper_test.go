@@ -82,3 +82,24 @@ func TestTopicMapper(t *testing.T) {
 		assert.Equal(t, tt.headers, ctx.GetData("headers").(map[string]string))
 	}
 }
+
+func TestTopicMapperUserProperties(t *testing.T) {
+	spec := getDefaultSpec()
+	spec.SetKV.UserProperties = true
+	topicMapper := kind.CreateInstance(spec)
+	topicMapper.Init()
+	defer topicMapper.Close()
+
+	ctx := newContext("client", "/d2s/abc/phone/123/raw")
+	req := ctx.GetInputRequest().(*mqttprot.Request)
+	req.SetUserProperties([]mqttprot.UserProperty{{Key: "origin", Value: "device"}})
+	topicMapper.Handle(ctx)
+	assert.Equal(t, []mqttprot.UserProperty{
+		{Key: "origin", Value: "device"},
+		{Key: "d2s", Value: "d2s"},
+		{Key: "device_type", Value: "phone"},
+		{Key: "event", Value: "raw"},
+		{Key: "tenant", Value: "abc"},
+		{Key: "things_id", Value: "123"},
+	}, req.UserProperties())
+}
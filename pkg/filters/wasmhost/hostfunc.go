@@ -25,6 +25,8 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
@@ -501,6 +503,100 @@ func (vm *WasmVM) hostClusterCountKey(prefixAddr int32) int32 {
 	return count
 }
 
+// outbound HTTP call functions
+
+func (vm *WasmVM) hostHTTPCall(pipelineAddr, methodAddr, urlAddr, headerAddr, bodyAddr, timeoutMs int32) int32 {
+	pipeline := vm.readStringFromWasm(pipelineAddr)
+	method := vm.readStringFromWasm(methodAddr)
+	url := vm.readStringFromWasm(urlAddr)
+	header := vm.readHeaderFromWasm(headerAddr)
+	body := vm.readDataFromWasm(bodyAddr)
+
+	// relative URLs are sent with the host of the current request
+	if !strings.Contains(url, "://") {
+		url = "http://" + vm.ctx.GetInputRequest().(*httpprot.Request).Host() + url
+	}
+	req, e := http.NewRequest(method, url, bytes.NewReader(body))
+	if e != nil {
+		panic(e)
+	}
+	req.Header = header
+
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	return vm.addHTTPCall(vm.host.startHTTPCall(pipeline, req, timeout))
+}
+
+func (vm *WasmVM) getHTTPCall(id int32) *httpCall {
+	call := vm.calls[id]
+	if call == nil {
+		panic(fmt.Errorf("http call %d not found", id))
+	}
+	call.wait()
+	return call
+}
+
+// hostHTTPCallWait waits for the call and returns the status code, -1 is
+// returned if the call failed.
+func (vm *WasmVM) hostHTTPCallWait(id int32) int32 {
+	call := vm.getHTTPCall(id)
+	if call.err != nil {
+		logger.Errorf("wasm http call failed: %v", call.err)
+		return -1
+	}
+	return int32(call.statusCode)
+}
+
+func (vm *WasmVM) hostHTTPCallGetHeader(id int32) int32 {
+	return vm.writeHeaderToWasm(vm.getHTTPCall(id).header)
+}
+
+func (vm *WasmVM) hostHTTPCallGetBody(id int32) int32 {
+	return vm.writeDataToWasm(vm.getHTTPCall(id).body)
+}
+
+// context data functions
+
+// contextDataToString converts context data to string, data other than
+// string and bytes are encoded in JSON, like the data of pipelines.
+func contextDataToString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	data, e := json.Marshal(v)
+	if e != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (vm *WasmVM) hostContextGetData(addr int32) int32 {
+	key := vm.readStringFromWasm(addr)
+	return vm.writeStringToWasm(contextDataToString(vm.ctx.GetData(key)))
+}
+
+func (vm *WasmVM) hostContextSetData(keyAddr, valAddr int32) {
+	key := vm.readStringFromWasm(keyAddr)
+	val := vm.readStringFromWasm(valAddr)
+	vm.ctx.SetData(key, val)
+}
+
+// metric functions
+
+func (vm *WasmVM) hostMetricCounterAdd(nameAddr int32, value float64) {
+	name := vm.readStringFromWasm(nameAddr)
+	vm.host.metrics.addCounter(name, value)
+}
+
+func (vm *WasmVM) hostMetricHistogramObserve(nameAddr int32, value float64) {
+	name := vm.readStringFromWasm(nameAddr)
+	vm.host.metrics.observeHistogram(name, value)
+}
+
 // misc functions
 
 func (vm *WasmVM) hostAddTag(addr int32) {
@@ -604,6 +700,20 @@ func (vm *WasmVM) importHostFuncs(linker *wasmtime.Linker) {
 
 	defineFunc("host_cluster_count_key", vm.hostClusterCountKey)
 
+	// outbound HTTP call functions
+	defineFunc("host_http_call", vm.hostHTTPCall)
+	defineFunc("host_http_call_wait", vm.hostHTTPCallWait)
+	defineFunc("host_http_call_get_header", vm.hostHTTPCallGetHeader)
+	defineFunc("host_http_call_get_body", vm.hostHTTPCallGetBody)
+
+	// context data functions
+	defineFunc("host_ctx_get_data", vm.hostContextGetData)
+	defineFunc("host_ctx_set_data", vm.hostContextSetData)
+
+	// metric functions
+	defineFunc("host_metric_counter_add", vm.hostMetricCounterAdd)
+	defineFunc("host_metric_histogram_observe", vm.hostMetricHistogramObserve)
+
 	// misc functions
 	defineFunc("host_add_tag", vm.hostAddTag)
 	defineFunc("host_log", vm.hostLog)
@@ -0,0 +1,126 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/object/trafficcontroller"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/tracing"
+)
+
+const (
+	// namespace is the namespace of the pipelines defined in the static
+	// configuration.
+	namespace = "default"
+
+	defaultHTTPCallTimeout = 5 * time.Second
+	maxHTTPCallBodySize    = 4 * 1024 * 1024
+)
+
+var fnGetPipeline = func(super *supervisor.Supervisor, name string) (context.Handler, bool) {
+	entity, ok := super.GetSystemController(trafficcontroller.Kind)
+	if !ok {
+		return nil, false
+	}
+	tc := entity.Instance().(*trafficcontroller.TrafficController)
+	pipeline, ok := tc.GetPipeline(namespace, name)
+	if !ok {
+		return nil, false
+	}
+	handler, ok := pipeline.Instance().(context.Handler)
+	return handler, ok
+}
+
+// httpCall is an outbound HTTP call issued by wasm code. The call is sent
+// to a pipeline asynchronously, so the proxies of the pipeline are used, and
+// wasm code could issue several calls before waiting for their responses.
+type httpCall struct {
+	done       chan struct{}
+	statusCode int
+	header     http.Header
+	body       []byte
+	err        error
+}
+
+// startHTTPCall sends req to the pipeline in a new goroutine.
+func (wh *WasmHost) startHTTPCall(pipeline string, req *http.Request, timeout time.Duration) *httpCall {
+	if timeout <= 0 {
+		timeout = defaultHTTPCallTimeout
+	}
+
+	call := &httpCall{done: make(chan struct{})}
+	go func() {
+		defer close(call.done)
+		call.err = wh.doHTTPCall(call, pipeline, req, timeout)
+	}()
+	return call
+}
+
+func (wh *WasmHost) doHTTPCall(call *httpCall, pipeline string, stdr *http.Request, timeout time.Duration) error {
+	handler, ok := fnGetPipeline(wh.spec.Super(), pipeline)
+	if !ok {
+		return fmt.Errorf("pipeline %s not found", pipeline)
+	}
+
+	stdctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), timeout)
+	defer cancel()
+
+	req, err := httpprot.NewRequest(stdr.WithContext(stdctx))
+	if err != nil {
+		return err
+	}
+	if err = req.FetchPayload(maxHTTPCallBodySize); err != nil {
+		return err
+	}
+
+	ctx := context.New(tracing.NoopSpan)
+	defer ctx.Finish()
+
+	ctx.SetRequest(context.DefaultNamespace, req)
+	handler.Handle(ctx)
+
+	resp, _ := ctx.GetResponse(context.DefaultNamespace).(*httpprot.Response)
+	if resp == nil {
+		return fmt.Errorf("pipeline %s returns no response", pipeline)
+	}
+
+	call.statusCode = resp.StatusCode()
+	call.header = resp.HTTPHeader().Clone()
+	if !resp.IsStream() {
+		call.body = resp.RawPayload()
+		return nil
+	}
+	call.body, err = io.ReadAll(io.LimitReader(resp.GetPayload(), maxHTTPCallBodySize))
+	return err
+}
+
+// wait waits for the completion of the call.
+func (c *httpCall) wait() {
+	<-c.done
+}
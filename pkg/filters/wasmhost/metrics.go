@@ -0,0 +1,160 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/megaease/easegress/pkg/util/prometheushelper"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metric types defined by proxy-wasm
+const (
+	metricTypeCounter int32 = iota
+	metricTypeGauge
+	metricTypeHistogram
+)
+
+type (
+	// metrics are the custom metrics emitted by wasm code, metrics are
+	// distinguished by the 'name' label.
+	metrics struct {
+		Counters   *prometheus.CounterVec
+		Gauges     *prometheus.GaugeVec
+		Histograms *prometheus.HistogramVec
+
+		// metrics defined by proxy_define_metric, the id of a metric is
+		// its index plus one, so they are shared by all VMs.
+		mutex   sync.Mutex
+		defined []*customMetric
+		ids     map[string]int32
+	}
+
+	customMetric struct {
+		typ  int32
+		name string
+		// value is the value of counters and gauges, which is required
+		// by proxy_get_metric.
+		value int64
+	}
+)
+
+func (wh *WasmHost) newMetrics() *metrics {
+	commonLabels := prometheus.Labels{
+		"filterName":   wh.Name(),
+		"kind":         Kind,
+		"clusterName":  "",
+		"clusterRole":  "",
+		"instanceName": "",
+	}
+	if super := wh.spec.Super(); super != nil {
+		commonLabels["clusterName"] = super.Options().ClusterName
+		commonLabels["clusterRole"] = super.Options().ClusterRole
+		commonLabels["instanceName"] = super.Options().Name
+	}
+
+	labels := []string{"clusterName", "clusterRole", "instanceName", "filterName", "kind", "name"}
+	histogramOpts := prometheus.HistogramOpts{
+		Name: "wasmhost_custom_histogram",
+		Help: "the custom histograms of wasm code",
+	}
+	return &metrics{
+		Counters: prometheushelper.NewCounter("wasmhost_custom_counter_total",
+			"the custom counters of wasm code", labels).MustCurryWith(commonLabels),
+		Gauges: prometheushelper.NewGauge("wasmhost_custom_gauge",
+			"the custom gauges of wasm code", labels).MustCurryWith(commonLabels),
+		Histograms: prometheushelper.NewHistogram(histogramOpts, labels).MustCurryWith(commonLabels).(*prometheus.HistogramVec),
+		ids:        map[string]int32{},
+	}
+}
+
+func (m *metrics) addCounter(name string, value float64) {
+	m.Counters.With(prometheus.Labels{"name": name}).Add(value)
+}
+
+func (m *metrics) observeHistogram(name string, value float64) {
+	m.Histograms.With(prometheus.Labels{"name": name}).Observe(value)
+}
+
+// define defines a metric and returns its id, the id of an existing metric
+// is returned if the metric is already defined.
+func (m *metrics) define(typ int32, name string) (int32, error) {
+	if typ < metricTypeCounter || typ > metricTypeHistogram {
+		return 0, fmt.Errorf("unknown metric type %d", typ)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := fmt.Sprintf("%d/%s", typ, name)
+	if id, ok := m.ids[key]; ok {
+		return id, nil
+	}
+	m.defined = append(m.defined, &customMetric{typ: typ, name: name})
+	id := int32(len(m.defined))
+	m.ids[key] = id
+	return id, nil
+}
+
+func (m *metrics) get(id int32) *customMetric {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if id <= 0 || int(id) > len(m.defined) {
+		return nil
+	}
+	return m.defined[id-1]
+}
+
+// increment increments a counter or a gauge.
+func (m *metrics) increment(cm *customMetric, offset int64) error {
+	labels := prometheus.Labels{"name": cm.name}
+	switch cm.typ {
+	case metricTypeCounter:
+		if offset < 0 {
+			return fmt.Errorf("counter %s cannot decrease", cm.name)
+		}
+		m.Counters.With(labels).Add(float64(offset))
+	case metricTypeGauge:
+		m.Gauges.With(labels).Add(float64(offset))
+	default:
+		return fmt.Errorf("histogram %s cannot be incremented", cm.name)
+	}
+	atomic.AddInt64(&cm.value, offset)
+	return nil
+}
+
+// record sets the value of a gauge, or observes a value for a histogram.
+func (m *metrics) record(cm *customMetric, value int64) error {
+	labels := prometheus.Labels{"name": cm.name}
+	switch cm.typ {
+	case metricTypeGauge:
+		m.Gauges.With(labels).Set(float64(value))
+		atomic.StoreInt64(&cm.value, value)
+	case metricTypeHistogram:
+		m.Histograms.With(labels).Observe(float64(value))
+	default:
+		return fmt.Errorf("counter %s cannot be recorded", cm.name)
+	}
+	return nil
+}
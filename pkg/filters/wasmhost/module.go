@@ -0,0 +1,297 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const (
+	digestPrefix = "sha256:"
+
+	// maxModuleSize is the max size of a wasm module to download.
+	maxModuleSize = 64 * 1024 * 1024
+
+	moduleFetchTimeout = time.Minute
+)
+
+type (
+	// ModuleSpec is the spec of a version of the wasm module, which is
+	// downloaded from URL and pinned by Digest.
+	ModuleSpec struct {
+		URL       string `json:"url" jsonschema:"required"`
+		Digest    string `json:"digest" jsonschema:"required,pattern=^sha256:[0-9a-f]{64}$"`
+		Signature string `json:"signature,omitempty" jsonschema:"omitempty"`
+		Weight    int    `json:"weight,omitempty" jsonschema:"omitempty,minimum=0,maximum=100"`
+		Insecure  bool   `json:"insecure,omitempty" jsonschema:"omitempty"`
+	}
+
+	// moduleVersion is a loaded version of the wasm module.
+	moduleVersion struct {
+		url          string
+		digest       string
+		weight       int
+		pool         *WasmVMPool
+		numOfRequest int64
+	}
+
+	// ModuleStatus is the status of a loaded version of the wasm module.
+	ModuleStatus struct {
+		URL          string `json:"url,omitempty"`
+		Digest       string `json:"digest"`
+		Weight       int    `json:"weight"`
+		NumOfRequest int64  `json:"numOfRequest"`
+	}
+)
+
+var moduleClient = &http.Client{Timeout: moduleFetchTimeout}
+
+func codeDigest(code []byte) string {
+	sum := sha256.Sum256(code)
+	return digestPrefix + hex.EncodeToString(sum[:])
+}
+
+func parsePublicKey(key string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM encoded public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// verifySignature verifies the base64 encoded signature of code, the
+// signature is compatible with the one created by 'cosign sign-blob'.
+func verifySignature(pub crypto.PublicKey, code []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+
+	sum := sha256.Sum256(code)
+	ok := false
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(key, sum[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, code, sig)
+	}
+	if !ok {
+		return fmt.Errorf("signature verification failed")
+	}
+	return nil
+}
+
+// cacheFile returns the path of the cache file of the module with the
+// digest, or an empty string if caching is disabled.
+func (wh *WasmHost) cacheFile(digest string) string {
+	if wh.cacheDir == "" {
+		return ""
+	}
+	return filepath.Join(wh.cacheDir, strings.TrimPrefix(digest, digestPrefix)+".wasm")
+}
+
+func (wh *WasmHost) readModuleCache(digest string) []byte {
+	path := wh.cacheFile(digest)
+	if path == "" {
+		return nil
+	}
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	if codeDigest(code) != digest {
+		logger.Warnf("wasm module cache %s is corrupted, remove it", path)
+		os.Remove(path)
+		return nil
+	}
+	return code
+}
+
+func (wh *WasmHost) writeModuleCache(digest string, code []byte) {
+	path := wh.cacheFile(digest)
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(wh.cacheDir, 0o755); err != nil {
+		logger.Errorf("failed to create wasm module cache directory: %v", err)
+		return
+	}
+
+	// write to a temporary file first to avoid partial cache files.
+	tmp, err := os.CreateTemp(wh.cacheDir, "module-*.tmp")
+	if err != nil {
+		logger.Errorf("failed to create wasm module cache file: %v", err)
+		return
+	}
+	_, err = tmp.Write(code)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		logger.Errorf("failed to write wasm module cache file: %v", err)
+		os.Remove(tmp.Name())
+	}
+}
+
+func fetchModule(spec *ModuleSpec) ([]byte, error) {
+	url := spec.URL
+	if isOCIReference(url) {
+		return fetchOCIBlob(url, spec.Digest, spec.Insecure)
+	}
+
+	resp, err := moduleClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: status code %d", url, resp.StatusCode)
+	}
+	return readModule(resp.Body)
+}
+
+func readModule(r io.Reader) ([]byte, error) {
+	code, err := io.ReadAll(io.LimitReader(r, maxModuleSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(code) > maxModuleSize {
+		return nil, fmt.Errorf("wasm module is larger than %d bytes", maxModuleSize)
+	}
+	return code, nil
+}
+
+// loadModule loads the code of a module from the cache, or downloads it
+// if it is not cached. The digest and signature of the code are always
+// verified.
+func (wh *WasmHost) loadModule(spec *ModuleSpec) ([]byte, error) {
+	code := wh.readModuleCache(spec.Digest)
+	if code == nil {
+		var err error
+		if code, err = fetchModule(spec); err != nil {
+			return nil, err
+		}
+		if digest := codeDigest(code); digest != spec.Digest {
+			return nil, fmt.Errorf("digest mismatch of %s: expected %s, got %s", spec.URL, spec.Digest, digest)
+		}
+		wh.writeModuleCache(spec.Digest, code)
+	}
+
+	if wh.publicKey != nil {
+		if err := verifySignature(wh.publicKey, code, spec.Signature); err != nil {
+			return nil, fmt.Errorf("failed to verify %s: %v", spec.URL, err)
+		}
+	}
+	return code, nil
+}
+
+// loadModules loads the module versions in spec, the VM pools of the
+// versions which have already been loaded are reused.
+func (wh *WasmHost) loadModules() error {
+	loaded := map[string]*moduleVersion{}
+	for _, v := range wh.moduleVersions() {
+		loaded[v.digest] = v
+	}
+
+	versions := make([]*moduleVersion, 0, len(wh.spec.Modules))
+	for _, m := range wh.spec.Modules {
+		v := &moduleVersion{url: m.URL, digest: m.Digest, weight: m.Weight}
+		if len(wh.spec.Modules) == 1 {
+			v.weight = 100
+		}
+
+		if old := loaded[m.Digest]; old != nil {
+			v.pool = old.pool
+			v.numOfRequest = atomic.LoadInt64(&old.numOfRequest)
+			versions = append(versions, v)
+			continue
+		}
+
+		code, err := wh.loadModule(m)
+		if err != nil {
+			logger.Errorf("failed to load wasm module: %v", err)
+			return err
+		}
+		if v.pool, err = NewWasmVMPool(wh, code); err != nil {
+			logger.Errorf("failed to create wasm VM pool: %v", err)
+			return err
+		}
+		versions = append(versions, v)
+	}
+
+	wh.versions.Store(versions)
+	return nil
+}
+
+func (wh *WasmHost) moduleVersions() []*moduleVersion {
+	if v := wh.versions.Load(); v != nil {
+		return v.([]*moduleVersion)
+	}
+	return nil
+}
+
+// pickVersion picks a module version according to the weights.
+func pickVersion(versions []*moduleVersion) *moduleVersion {
+	if len(versions) == 1 {
+		return versions[0]
+	}
+	n := rand.Intn(100)
+	for _, v := range versions {
+		if n < v.weight {
+			return v
+		}
+		n -= v.weight
+	}
+	return versions[len(versions)-1]
+}
@@ -0,0 +1,190 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func resultWasm(t *testing.T, result int) []byte {
+	wat := fmt.Sprintf(`
+(module
+  (memory (export "memory") 1)
+  (func (export "wasm_alloc") (param i32) (result i32) (i32.const 1024))
+  (func (export "wasm_free") (param i32))
+  (func (export "wasm_run") (result i32) (i32.const %d)))
+`, result)
+	code, err := wasmtime.Wat2Wasm(wat)
+	assert.Nil(t, err)
+	return code
+}
+
+func signModule(t *testing.T, key *ecdsa.PrivateKey, code []byte) string {
+	sum := sha256.Sum256(code)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	assert.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func newModuleHost(t *testing.T, spec *Spec) *WasmHost {
+	assert.Nil(t, spec.Validate())
+	spec.MaxConcurrency = 1
+	spec.timeout = time.Second
+	wh := &WasmHost{spec: spec, chStop: make(chan struct{}), cacheDir: spec.CacheDir}
+	wh.metrics = wh.newMetrics()
+	if spec.PublicKey != "" {
+		wh.publicKey, _ = parsePublicKey(spec.PublicKey)
+	}
+	return wh
+}
+
+func TestModules(t *testing.T) {
+	assert := assert.New(t)
+
+	v1, v2 := resultWasm(t, 1), resultWasm(t, 2)
+	d1, d2 := codeDigest(v1), codeDigest(v2)
+
+	// v1 is served by an http server, v2 is served by an OCI registry
+	// requires bearer tokens.
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	mux.HandleFunc("/v1.wasm", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(v1)
+	})
+	mux.HandleFunc("/v2/filters/auth/blobs/"+d2, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:filters/auth:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write(v2)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("repository:filters/auth:pull", r.URL.Query().Get("scope"))
+		w.Write([]byte(`{"token": "token"}`))
+	})
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(err)
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	cacheDir := t.TempDir()
+	newSpec := func() *Spec {
+		return &Spec{
+			Modules: []*ModuleSpec{
+				{URL: srv.URL + "/v1.wasm", Digest: d1, Signature: signModule(t, key, v1), Weight: 30},
+				{URL: "oci://" + strings.TrimPrefix(srv.URL, "http://") + "/filters/auth:v2", Digest: d2, Signature: signModule(t, key, v2), Weight: 70, Insecure: true},
+			},
+			PublicKey: publicKey,
+			CacheDir:  cacheDir,
+		}
+	}
+
+	wh := newModuleHost(t, newSpec())
+	assert.Nil(wh.loadWasmCode())
+
+	counts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		counts[wh.Handle(newContext(t, nil))]++
+	}
+	assert.Equal(200, counts["wasmResult1"]+counts["wasmResult2"])
+	assert.Greater(counts["wasmResult1"], 0)
+	assert.Greater(counts["wasmResult2"], counts["wasmResult1"])
+
+	status := wh.Status().(*Status)
+	assert.Equal(2, len(status.Modules))
+	assert.Equal(d1, status.Modules[0].Digest)
+	assert.Equal(30, status.Modules[0].Weight)
+	assert.Equal(int64(counts["wasmResult1"]), status.Modules[0].NumOfRequest)
+	assert.Equal(d2, status.Modules[1].Digest)
+
+	// the pools are reused when reloading
+	pool := wh.moduleVersions()[0].pool
+	assert.Nil(wh.loadWasmCode())
+	assert.Same(pool, wh.moduleVersions()[0].pool)
+	assert.Equal(int64(200), wh.Status().(*Status).Modules[0].NumOfRequest+wh.Status().(*Status).Modules[1].NumOfRequest)
+
+	// modules are loaded from the cache after the server is closed
+	srv.Close()
+	wh = newModuleHost(t, newSpec())
+	assert.Nil(wh.loadWasmCode())
+	assert.Equal(2, len(wh.moduleVersions()))
+
+	// invalid signature
+	spec := newSpec()
+	spec.Modules[1].Signature = spec.Modules[0].Signature
+	wh = newModuleHost(t, spec)
+	assert.NotNil(wh.loadWasmCode())
+	assert.Empty(wh.moduleVersions())
+
+	// digest mismatch
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(v1)
+	}))
+	defer srv.Close()
+	spec = &Spec{Modules: []*ModuleSpec{{URL: srv.URL + "/v2.wasm", Digest: d2}}, CacheDir: t.TempDir()}
+	wh = newModuleHost(t, spec)
+	assert.NotNil(wh.loadWasmCode())
+}
+
+func TestSpecValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	digest := codeDigest([]byte("wasm"))
+	module := &ModuleSpec{URL: "oci://localhost:5000/filters/auth:v1", Digest: digest}
+
+	assert.NotNil((&Spec{}).Validate())
+	assert.NotNil((&Spec{Code: "code", Modules: []*ModuleSpec{module}}).Validate())
+	assert.Nil((&Spec{Modules: []*ModuleSpec{module}}).Validate())
+	assert.NotNil((&Spec{Modules: []*ModuleSpec{{URL: "/wasm/auth.wasm", Digest: digest}}}).Validate())
+	assert.NotNil((&Spec{Modules: []*ModuleSpec{module, module}}).Validate())
+	assert.NotNil((&Spec{Modules: []*ModuleSpec{module}, PublicKey: "key"}).Validate())
+
+	other := &ModuleSpec{URL: "http://localhost/auth.wasm", Digest: codeDigest(nil), Weight: 20}
+	module.Weight = 80
+	assert.Nil((&Spec{Modules: []*ModuleSpec{module, other}}).Validate())
+	other.Weight = 30
+	assert.NotNil((&Spec{Modules: []*ModuleSpec{module, other}}).Validate())
+
+	registry, repo, err := parseOCIReference("oci://localhost:5000/filters/auth@" + digest)
+	assert.Nil(err)
+	assert.Equal("localhost:5000", registry)
+	assert.Equal("filters/auth", repo)
+	_, _, err = parseOCIReference("oci://localhost:5000/")
+	assert.NotNil(err)
+}
@@ -0,0 +1,154 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const ociScheme = "oci://"
+
+func isOCIReference(str string) bool {
+	return strings.HasPrefix(strings.ToLower(str), ociScheme)
+}
+
+// parseOCIReference parses references like 'oci://registry/repo:tag' or
+// 'oci://registry/repo@sha256:...' to registry and repository, the tag or
+// digest is ignored as the blob is always fetched by the pinned digest.
+func parseOCIReference(ref string) (registry, repo string, err error) {
+	ref = ref[len(ociScheme):]
+	i := strings.IndexByte(ref, '/')
+	if i <= 0 || i == len(ref)-1 {
+		return "", "", fmt.Errorf("invalid OCI reference %s", ref)
+	}
+	registry, repo = ref[:i], ref[i+1:]
+
+	if i = strings.IndexByte(repo, '@'); i >= 0 {
+		repo = repo[:i]
+	} else if i = strings.LastIndexByte(repo, ':'); i >= 0 {
+		repo = repo[:i]
+	}
+	if repo == "" {
+		return "", "", fmt.Errorf("invalid OCI reference %s", ref)
+	}
+	return registry, repo, nil
+}
+
+// fetchOCIBlob downloads the wasm module, which is a layer of an OCI
+// artifact, from the registry by its digest. The anonymous bearer token
+// is requested if the registry requires one.
+func fetchOCIBlob(ref, digest string, insecure bool) ([]byte, error) {
+	registry, repo, err := parseOCIReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	blobURL := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", scheme, registry, repo, digest)
+
+	resp, err := moduleClient.Get(blobURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("Www-Authenticate")
+		resp.Body.Close()
+
+		token, err := fetchOCIToken(challenge)
+		if err != nil {
+			return nil, err
+		}
+		req, _ := http.NewRequest(http.MethodGet, blobURL, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if resp, err = moduleClient.Do(req); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: status code %d", blobURL, resp.StatusCode)
+	}
+	return readModule(resp.Body)
+}
+
+// fetchOCIToken requests an anonymous token according to the bearer
+// challenge, like: Bearer realm="https://auth/token",service="registry",
+// scope="repository:repo:pull".
+func fetchOCIToken(challenge string) (string, error) {
+	const prefix = "bearer "
+	if len(challenge) < len(prefix) || !strings.EqualFold(challenge[:len(prefix)], prefix) {
+		return "", fmt.Errorf("unsupported authentication challenge: %s", challenge)
+	}
+
+	params := map[string]string{}
+	for _, p := range strings.Split(challenge[len(prefix):], ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if ok {
+			params[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("no realm in authentication challenge: %s", challenge)
+	}
+
+	query := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if v := params[k]; v != "" {
+			query.Set(k, v)
+		}
+	}
+	tokenURL := realm
+	if len(query) > 0 {
+		tokenURL += "?" + query.Encode()
+	}
+
+	resp, err := moduleClient.Get(tokenURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request token from %s: status code %d", realm, resp.StatusCode)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token in the response of %s", realm)
+}
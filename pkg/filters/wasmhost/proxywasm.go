@@ -0,0 +1,1124 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// This file implements the proxy-wasm ABI (v0.2.1), so that filters built
+// with the proxy-wasm SDKs for Envoy run in Easegress unchanged. See
+// https://github.com/proxy-wasm/spec for the specification of the ABI.
+
+// proxyWasmRootContextID is the id of the root context, every VM has only
+// one root context, and ids of HTTP contexts start from it plus one.
+const proxyWasmRootContextID int32 = 1
+
+// results of the proxy-wasm host functions
+const (
+	proxyResultOK                   int32 = 0
+	proxyResultNotFound             int32 = 1
+	proxyResultBadArgument          int32 = 2
+	proxyResultSerializationFailure int32 = 3
+	proxyResultInvalidMemoryAccess  int32 = 6
+	proxyResultCasMismatch          int32 = 8
+	proxyResultInternalFailure      int32 = 10
+	proxyResultUnimplemented        int32 = 12
+)
+
+// proxyActionPause is returned by callbacks to pause the stream.
+const proxyActionPause int32 = 1
+
+// header map types
+const (
+	proxyMapRequestHeaders           int32 = 0
+	proxyMapRequestTrailers          int32 = 1
+	proxyMapResponseHeaders          int32 = 2
+	proxyMapResponseTrailers         int32 = 3
+	proxyMapHTTPCallResponseHeaders  int32 = 6
+	proxyMapHTTPCallResponseTrailers int32 = 7
+)
+
+// buffer types
+const (
+	proxyBufferRequestBody          int32 = 0
+	proxyBufferResponseBody         int32 = 1
+	proxyBufferHTTPCallResponseBody int32 = 4
+	proxyBufferVMConfiguration      int32 = 6
+	proxyBufferPluginConfiguration  int32 = 7
+)
+
+type (
+	// proxyWasm is the proxy-wasm state of a VM.
+	proxyWasm struct {
+		fnMalloc      *wasmtime.Func
+		fns           map[string]*wasmtime.Func
+		nextContextID int32
+		stream        *proxyWasmStream
+	}
+
+	// proxyWasmStream is the HTTP context of the request being handled.
+	proxyWasmStream struct {
+		id            int32
+		continued     bool
+		localResponse bool
+		// callResp is the outbound call whose response is being
+		// dispatched to proxy_on_http_call_response.
+		callResp *httpCall
+	}
+)
+
+// helper functions
+
+func (vm *WasmVM) memory() []byte {
+	return vm.inst.GetExport(vm.store, wasmMemory).Memory().UnsafeData(vm.store)
+}
+
+func (vm *WasmVM) proxyRead(addr, size int32) ([]byte, bool) {
+	mem := vm.memory()
+	start := uint64(uint32(addr))
+	end := start + uint64(uint32(size))
+	if end > uint64(len(mem)) {
+		return nil, false
+	}
+	data := make([]byte, end-start)
+	copy(data, mem[start:end])
+	return data, true
+}
+
+func (vm *WasmVM) proxyReadString(addr, size int32) (string, bool) {
+	data, ok := vm.proxyRead(addr, size)
+	return string(data), ok
+}
+
+func (vm *WasmVM) proxyWriteUint32(addr int32, v uint32) bool {
+	mem := vm.memory()
+	if uint64(uint32(addr))+4 > uint64(len(mem)) {
+		return false
+	}
+	binary.LittleEndian.PutUint32(mem[uint32(addr):], v)
+	return true
+}
+
+func (vm *WasmVM) proxyWriteUint64(addr int32, v uint64) bool {
+	mem := vm.memory()
+	if uint64(uint32(addr))+8 > uint64(len(mem)) {
+		return false
+	}
+	binary.LittleEndian.PutUint64(mem[uint32(addr):], v)
+	return true
+}
+
+// proxyWriteData copies data to the memory allocated by the wasm code, and
+// writes the address and the size of the memory to addrPtr and sizePtr.
+func (vm *WasmVM) proxyWriteData(data []byte, addrPtr, sizePtr int32) int32 {
+	addr := int32(0)
+	if len(data) > 0 {
+		v, e := vm.pw.fnMalloc.Call(vm.store, int32(len(data)))
+		if e != nil {
+			panic(e)
+		}
+		addr = v.(int32)
+
+		// the memory may grow in the allocation, so get it after that
+		mem := vm.memory()
+		if uint64(uint32(addr))+uint64(len(data)) > uint64(len(mem)) {
+			return proxyResultInvalidMemoryAccess
+		}
+		copy(mem[uint32(addr):], data)
+	}
+
+	if !vm.proxyWriteUint32(addrPtr, uint32(addr)) || !vm.proxyWriteUint32(sizePtr, uint32(len(data))) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return proxyResultOK
+}
+
+// encodeProxyPairs serializes header pairs as: the number of pairs, the
+// sizes of the names and values, and then the names and values, each is
+// followed by a trailing zero. The numbers are 32 bit little endian.
+func encodeProxyPairs(pairs [][2]string) []byte {
+	size := 4
+	for _, p := range pairs {
+		size += 8 + len(p[0]) + 1 + len(p[1]) + 1
+	}
+
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data, uint32(len(pairs)))
+	pos := 4
+	for _, p := range pairs {
+		binary.LittleEndian.PutUint32(data[pos:], uint32(len(p[0])))
+		binary.LittleEndian.PutUint32(data[pos+4:], uint32(len(p[1])))
+		pos += 8
+	}
+	for _, p := range pairs {
+		pos += copy(data[pos:], p[0]) + 1
+		pos += copy(data[pos:], p[1]) + 1
+	}
+	return data
+}
+
+func decodeProxyPairs(data []byte) ([][2]string, bool) {
+	if len(data) == 0 {
+		return nil, true
+	}
+	if len(data) < 4 {
+		return nil, false
+	}
+
+	n := int(binary.LittleEndian.Uint32(data))
+	pos := 4 + n*8
+	if n < 0 || pos > len(data) {
+		return nil, false
+	}
+
+	pairs := make([][2]string, 0, n)
+	for i := 0; i < n; i++ {
+		nameSize := int(binary.LittleEndian.Uint32(data[4+i*8:]))
+		valueSize := int(binary.LittleEndian.Uint32(data[8+i*8:]))
+		if nameSize < 0 || valueSize < 0 || pos+nameSize+valueSize+2 > len(data) {
+			return nil, false
+		}
+		name := string(data[pos : pos+nameSize])
+		pos += nameSize + 1
+		value := string(data[pos : pos+valueSize])
+		pos += valueSize + 1
+		pairs = append(pairs, [2]string{name, value})
+	}
+	return pairs, true
+}
+
+// proxyHeader returns the header of the header map, trailers are always
+// empty as they are not supported.
+func (vm *WasmVM) proxyHeader(mapType int32) http.Header {
+	if vm.ctx == nil {
+		return nil
+	}
+
+	switch mapType {
+	case proxyMapRequestHeaders:
+		return vm.ctx.GetOutputRequest().(*httpprot.Request).Std().Header
+	case proxyMapResponseHeaders:
+		if resp, _ := vm.ctx.GetOutputResponse().(*httpprot.Response); resp != nil {
+			return resp.Std().Header
+		}
+	case proxyMapHTTPCallResponseHeaders:
+		if s := vm.pw.stream; s != nil && s.callResp != nil {
+			return s.callResp.header
+		}
+	case proxyMapRequestTrailers, proxyMapResponseTrailers, proxyMapHTTPCallResponseTrailers:
+		return http.Header{}
+	}
+	return nil
+}
+
+// proxyPseudoHeaders returns the HTTP/2 style pseudo headers of the header
+// map, which are used by the proxy-wasm SDKs to access request lines and
+// status codes.
+func (vm *WasmVM) proxyPseudoHeaders(mapType int32) [][2]string {
+	switch mapType {
+	case proxyMapRequestHeaders:
+		req := vm.ctx.GetOutputRequest().(*httpprot.Request)
+		return [][2]string{
+			{":authority", req.Host()},
+			{":method", req.Method()},
+			{":path", req.Std().URL.RequestURI()},
+			{":scheme", req.Scheme()},
+		}
+	case proxyMapResponseHeaders:
+		resp := vm.ctx.GetOutputResponse().(*httpprot.Response)
+		return [][2]string{{":status", strconv.Itoa(resp.StatusCode())}}
+	case proxyMapHTTPCallResponseHeaders:
+		return [][2]string{{":status", strconv.Itoa(vm.pw.stream.callResp.statusCode)}}
+	}
+	return nil
+}
+
+func (vm *WasmVM) setProxyPseudoHeader(mapType int32, name, value string) int32 {
+	switch mapType {
+	case proxyMapRequestHeaders:
+		req := vm.ctx.GetOutputRequest().(*httpprot.Request)
+		switch name {
+		case ":authority":
+			req.SetHost(value)
+		case ":method":
+			req.SetMethod(value)
+		case ":path":
+			path, query, _ := strings.Cut(value, "?")
+			req.SetPath(path)
+			req.Std().URL.RawQuery = query
+		case ":scheme":
+			// the scheme is decided by the proxies
+		default:
+			return proxyResultBadArgument
+		}
+	case proxyMapResponseHeaders:
+		code, e := strconv.Atoi(value)
+		if name != ":status" || e != nil {
+			return proxyResultBadArgument
+		}
+		vm.ctx.GetOutputResponse().(*httpprot.Response).SetStatusCode(code)
+	default:
+		return proxyResultBadArgument
+	}
+	return proxyResultOK
+}
+
+// proxyHeaderPairs returns all pairs of the header map, pseudo headers come
+// first and names are in lower case.
+func (vm *WasmVM) proxyHeaderPairs(mapType int32) ([][2]string, bool) {
+	h := vm.proxyHeader(mapType)
+	if h == nil {
+		return nil, false
+	}
+
+	pairs := vm.proxyPseudoHeaders(mapType)
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			pairs = append(pairs, [2]string{strings.ToLower(name), v})
+		}
+	}
+	return pairs, true
+}
+
+// proxyBuffer returns the data of the buffer, bodies of streams are not
+// available.
+func (vm *WasmVM) proxyBuffer(bufferType int32) ([]byte, bool) {
+	switch bufferType {
+	case proxyBufferVMConfiguration:
+		return []byte(vm.host.spec.ProxyWasm.VMConfiguration), true
+	case proxyBufferPluginConfiguration:
+		return []byte(vm.host.spec.ProxyWasm.PluginConfiguration), true
+	}
+
+	if vm.ctx == nil {
+		return nil, false
+	}
+	switch bufferType {
+	case proxyBufferRequestBody:
+		return rawPayload(vm.ctx.GetOutputRequest()), true
+	case proxyBufferResponseBody:
+		if resp := vm.ctx.GetOutputResponse(); resp != nil {
+			return rawPayload(resp), true
+		}
+	case proxyBufferHTTPCallResponseBody:
+		if s := vm.pw.stream; s != nil && s.callResp != nil {
+			return s.callResp.body, true
+		}
+	}
+	return nil, false
+}
+
+// payloadHolder is the common interface of requests and responses to
+// access their payloads.
+type payloadHolder interface {
+	IsStream() bool
+	GetPayload() io.Reader
+	RawPayload() []byte
+	SetPayload(payload interface{})
+}
+
+func rawPayload(p payloadHolder) []byte {
+	if p.IsStream() {
+		return nil
+	}
+	return p.RawPayload()
+}
+
+func setPayload(p payloadHolder, data []byte) {
+	if p.IsStream() {
+		if c, ok := p.GetPayload().(io.Closer); ok {
+			c.Close()
+		}
+	}
+	p.SetPayload(data)
+}
+
+// proxyGetPropertyValue returns the value of the property, paths of properties
+// are the same as Envoy, and context data can be accessed by 'data.<key>'.
+func (vm *WasmVM) proxyGetPropertyValue(path []string) ([]byte, bool) {
+	switch strings.Join(path, ".") {
+	case "plugin_name":
+		return []byte(vm.host.Name()), true
+	case "plugin_root_id":
+		return []byte(vm.host.spec.ProxyWasm.RootID), true
+	}
+
+	if vm.ctx == nil {
+		return nil, false
+	}
+	req := vm.ctx.GetInputRequest().(*httpprot.Request)
+	switch strings.Join(path, ".") {
+	case "request.path":
+		return []byte(req.Std().URL.RequestURI()), true
+	case "request.url_path":
+		return []byte(req.Path()), true
+	case "request.host":
+		return []byte(req.Host()), true
+	case "request.scheme":
+		return []byte(req.Scheme()), true
+	case "request.method":
+		return []byte(req.Method()), true
+	case "request.protocol":
+		return []byte(req.Proto()), true
+	case "request.query":
+		return []byte(req.Std().URL.RawQuery), true
+	case "source.address":
+		return []byte(req.RealIP()), true
+	case "response.code":
+		resp, _ := vm.ctx.GetInputResponse().(*httpprot.Response)
+		if resp == nil {
+			return nil, false
+		}
+		// integers are 64 bit little endian, the same as Envoy
+		return binary.LittleEndian.AppendUint64(nil, uint64(resp.StatusCode())), true
+	}
+
+	if len(path) == 2 && path[0] == "data" {
+		v := vm.ctx.GetData(path[1])
+		if v == nil {
+			return nil, false
+		}
+		return []byte(contextDataToString(v)), true
+	}
+	return nil, false
+}
+
+// proxy-wasm host functions
+
+func (vm *WasmVM) proxyLog(level, addr, size int32) int32 {
+	msg, ok := vm.proxyReadString(addr, size)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	switch level {
+	case 0, 1:
+		logger.Debugf("%s", msg)
+	case 2:
+		logger.Infof("%s", msg)
+	case 3:
+		logger.Warnf("%s", msg)
+	default:
+		logger.Errorf("%s", msg)
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyGetLogLevel(levelPtr int32) int32 {
+	// debug, the messages are filtered by the logger of Easegress
+	if !vm.proxyWriteUint32(levelPtr, 1) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyGetCurrentTimeNanoseconds(timePtr int32) int32 {
+	if !vm.proxyWriteUint64(timePtr, uint64(time.Now().UnixNano())) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxySetTickPeriodMilliseconds(period int32) int32 {
+	// ticks are not supported, but the SDKs treat failures as fatal errors
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyGetProperty(pathAddr, pathSize, valueAddrPtr, valueSizePtr int32) int32 {
+	path, ok := vm.proxyReadString(pathAddr, pathSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	value, ok := vm.proxyGetPropertyValue(strings.Split(strings.TrimRight(path, "\x00"), "\x00"))
+	if !ok {
+		return proxyResultNotFound
+	}
+	return vm.proxyWriteData(value, valueAddrPtr, valueSizePtr)
+}
+
+func (vm *WasmVM) proxySetProperty(pathAddr, pathSize, valueAddr, valueSize int32) int32 {
+	path, ok := vm.proxyReadString(pathAddr, pathSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	value, ok := vm.proxyReadString(valueAddr, valueSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+
+	parts := strings.Split(strings.TrimRight(path, "\x00"), "\x00")
+	if vm.ctx == nil || len(parts) != 2 || parts[0] != "data" {
+		return proxyResultNotFound
+	}
+	vm.ctx.SetData(parts[1], value)
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyGetHeaderMapValue(mapType, keyAddr, keySize, valueAddrPtr, valueSizePtr int32) int32 {
+	key, ok := vm.proxyReadString(keyAddr, keySize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	h := vm.proxyHeader(mapType)
+	if h == nil {
+		return proxyResultNotFound
+	}
+
+	if strings.HasPrefix(key, ":") {
+		for _, p := range vm.proxyPseudoHeaders(mapType) {
+			if p[0] == key {
+				return vm.proxyWriteData([]byte(p[1]), valueAddrPtr, valueSizePtr)
+			}
+		}
+		return proxyResultNotFound
+	}
+
+	values := h.Values(key)
+	if len(values) == 0 {
+		return proxyResultNotFound
+	}
+	return vm.proxyWriteData([]byte(strings.Join(values, ",")), valueAddrPtr, valueSizePtr)
+}
+
+func (vm *WasmVM) proxyGetHeaderMapPairs(mapType, dataAddrPtr, dataSizePtr int32) int32 {
+	pairs, ok := vm.proxyHeaderPairs(mapType)
+	if !ok {
+		return proxyResultNotFound
+	}
+	return vm.proxyWriteData(encodeProxyPairs(pairs), dataAddrPtr, dataSizePtr)
+}
+
+func (vm *WasmVM) proxyGetHeaderMapSize(mapType, sizePtr int32) int32 {
+	pairs, ok := vm.proxyHeaderPairs(mapType)
+	if !ok {
+		return proxyResultNotFound
+	}
+	if !vm.proxyWriteUint32(sizePtr, uint32(len(encodeProxyPairs(pairs)))) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxySetHeaderMapPairs(mapType, dataAddr, dataSize int32) int32 {
+	data, ok := vm.proxyRead(dataAddr, dataSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	pairs, ok := decodeProxyPairs(data)
+	if !ok {
+		return proxyResultSerializationFailure
+	}
+	h := vm.proxyHeader(mapType)
+	if h == nil {
+		return proxyResultNotFound
+	}
+
+	for name := range h {
+		delete(h, name)
+	}
+	for _, p := range pairs {
+		if strings.HasPrefix(p[0], ":") {
+			if r := vm.setProxyPseudoHeader(mapType, p[0], p[1]); r != proxyResultOK {
+				return r
+			}
+			continue
+		}
+		h.Add(p[0], p[1])
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) modifyProxyHeaderMap(mapType, keyAddr, keySize, valueAddr, valueSize int32, fn func(h http.Header, key, value string)) int32 {
+	key, ok := vm.proxyReadString(keyAddr, keySize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	value, ok := vm.proxyReadString(valueAddr, valueSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	h := vm.proxyHeader(mapType)
+	if h == nil {
+		return proxyResultNotFound
+	}
+
+	if strings.HasPrefix(key, ":") {
+		return vm.setProxyPseudoHeader(mapType, key, value)
+	}
+	fn(h, key, value)
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyAddHeaderMapValue(mapType, keyAddr, keySize, valueAddr, valueSize int32) int32 {
+	return vm.modifyProxyHeaderMap(mapType, keyAddr, keySize, valueAddr, valueSize, http.Header.Add)
+}
+
+func (vm *WasmVM) proxyReplaceHeaderMapValue(mapType, keyAddr, keySize, valueAddr, valueSize int32) int32 {
+	return vm.modifyProxyHeaderMap(mapType, keyAddr, keySize, valueAddr, valueSize, http.Header.Set)
+}
+
+func (vm *WasmVM) proxyRemoveHeaderMapValue(mapType, keyAddr, keySize int32) int32 {
+	key, ok := vm.proxyReadString(keyAddr, keySize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	h := vm.proxyHeader(mapType)
+	if h == nil {
+		return proxyResultNotFound
+	}
+	if !strings.HasPrefix(key, ":") {
+		h.Del(key)
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyGetBufferBytes(bufferType, start, maxSize, dataAddrPtr, dataSizePtr int32) int32 {
+	data, ok := vm.proxyBuffer(bufferType)
+	if !ok {
+		return proxyResultNotFound
+	}
+
+	begin := uint64(uint32(start))
+	if begin > uint64(len(data)) {
+		return proxyResultBadArgument
+	}
+	end := begin + uint64(uint32(maxSize))
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+	return vm.proxyWriteData(data[begin:end], dataAddrPtr, dataSizePtr)
+}
+
+func (vm *WasmVM) proxyGetBufferStatus(bufferType, sizePtr, flagsPtr int32) int32 {
+	data, ok := vm.proxyBuffer(bufferType)
+	if !ok {
+		return proxyResultNotFound
+	}
+	if !vm.proxyWriteUint32(sizePtr, uint32(len(data))) || !vm.proxyWriteUint32(flagsPtr, 0) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return proxyResultOK
+}
+
+// proxySetBufferBytes replaces size bytes from start of the buffer with
+// the data.
+func (vm *WasmVM) proxySetBufferBytes(bufferType, start, size, dataAddr, dataSize int32) int32 {
+	value, ok := vm.proxyRead(dataAddr, dataSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+
+	var p payloadHolder
+	switch bufferType {
+	case proxyBufferRequestBody:
+		if vm.ctx != nil {
+			p = vm.ctx.GetOutputRequest()
+		}
+	case proxyBufferResponseBody:
+		if vm.ctx != nil && vm.ctx.GetOutputResponse() != nil {
+			p = vm.ctx.GetOutputResponse()
+		}
+	default:
+		return proxyResultBadArgument
+	}
+	if p == nil {
+		return proxyResultNotFound
+	}
+
+	data := rawPayload(p)
+	begin := uint64(uint32(start))
+	if begin > uint64(len(data)) {
+		begin = uint64(len(data))
+	}
+	end := begin + uint64(uint32(size))
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+
+	body := make([]byte, 0, len(data)-int(end-begin)+len(value))
+	body = append(body, data[:begin]...)
+	body = append(body, value...)
+	body = append(body, data[end:]...)
+	setPayload(p, body)
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxySendLocalResponse(statusCode, detailsAddr, detailsSize, bodyAddr, bodySize, headersAddr, headersSize, grpcStatus int32) int32 {
+	s := vm.pw.stream
+	if s == nil {
+		return proxyResultBadArgument
+	}
+	body, ok := vm.proxyRead(bodyAddr, bodySize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	data, ok := vm.proxyRead(headersAddr, headersSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	pairs, ok := decodeProxyPairs(data)
+	if !ok {
+		return proxyResultSerializationFailure
+	}
+
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(int(statusCode))
+	for _, p := range pairs {
+		if !strings.HasPrefix(p[0], ":") {
+			resp.Std().Header.Add(p[0], p[1])
+		}
+	}
+	resp.SetPayload(body)
+	vm.ctx.SetOutputResponse(resp)
+	s.localResponse = true
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyContinueStream(streamType int32) int32 {
+	if s := vm.pw.stream; s != nil {
+		s.continued = true
+	}
+	return proxyResultOK
+}
+
+// proxyContinue is proxy_continue_request and proxy_continue_response of
+// ABI 0.2.0.
+func (vm *WasmVM) proxyContinue() int32 {
+	return vm.proxyContinueStream(0)
+}
+
+// proxyHTTPCall sends an outbound call to the pipeline named by the
+// upstream, the response is dispatched to proxy_on_http_call_response when
+// the stream is paused.
+func (vm *WasmVM) proxyHTTPCall(upstreamAddr, upstreamSize, headersAddr, headersSize, bodyAddr, bodySize, trailersAddr, trailersSize, timeoutMs, tokenPtr int32) int32 {
+	if vm.pw.stream == nil {
+		// there's no stream to wait for the response
+		return proxyResultBadArgument
+	}
+
+	upstream, ok := vm.proxyReadString(upstreamAddr, upstreamSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	data, ok := vm.proxyRead(headersAddr, headersSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	body, ok := vm.proxyRead(bodyAddr, bodySize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	pairs, ok := decodeProxyPairs(data)
+	if !ok {
+		return proxyResultSerializationFailure
+	}
+
+	method, path, authority := http.MethodGet, "/", upstream
+	header := http.Header{}
+	for _, p := range pairs {
+		switch p[0] {
+		case ":method":
+			method = p[1]
+		case ":path":
+			path = p[1]
+		case ":authority":
+			authority = p[1]
+		default:
+			if !strings.HasPrefix(p[0], ":") {
+				header.Add(p[0], p[1])
+			}
+		}
+	}
+
+	req, e := http.NewRequest(method, "http://"+authority+path, bytes.NewReader(body))
+	if e != nil {
+		return proxyResultBadArgument
+	}
+	req.Header = header
+
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	token := vm.addHTTPCall(vm.host.startHTTPCall(upstream, req, timeout))
+	if !vm.proxyWriteUint32(tokenPtr, uint32(token)) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return proxyResultOK
+}
+
+// proxyGetSharedData gets data from the cluster, the same as the cluster
+// data functions, the mod revision of the data is used as the CAS value.
+func (vm *WasmVM) proxyGetSharedData(keyAddr, keySize, valueAddrPtr, valueSizePtr, casPtr int32) int32 {
+	key, ok := vm.proxyReadString(keyAddr, keySize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	kv := vm.host.Data()[vm.host.dataPrefix+key]
+	if kv == nil {
+		return proxyResultNotFound
+	}
+	if !vm.proxyWriteUint32(casPtr, uint32(kv.ModRevision)) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return vm.proxyWriteData(kv.Value, valueAddrPtr, valueSizePtr)
+}
+
+func (vm *WasmVM) proxySetSharedData(keyAddr, keySize, valueAddr, valueSize, cas int32) int32 {
+	key, ok := vm.proxyReadString(keyAddr, keySize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	value, ok := vm.proxyReadString(valueAddr, valueSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+
+	key = vm.host.dataPrefix + key
+	c := vm.host.Cluster()
+	if cas == 0 {
+		if e := c.Put(key, value); e != nil {
+			logger.Errorf("failed to set shared data %s: %v", key, e)
+			return proxyResultInternalFailure
+		}
+		return proxyResultOK
+	}
+
+	mismatch := false
+	e := c.STM(func(stm concurrency.STM) error {
+		mismatch = uint32(stm.Rev(key)) != uint32(cas)
+		if !mismatch {
+			stm.Put(key, value)
+		}
+		return nil
+	})
+	if e != nil {
+		logger.Errorf("failed to set shared data %s: %v", key, e)
+		return proxyResultInternalFailure
+	}
+	if mismatch {
+		return proxyResultCasMismatch
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyDefineMetric(metricType, nameAddr, nameSize, idPtr int32) int32 {
+	name, ok := vm.proxyReadString(nameAddr, nameSize)
+	if !ok {
+		return proxyResultInvalidMemoryAccess
+	}
+	id, e := vm.host.metrics.define(metricType, name)
+	if e != nil {
+		return proxyResultBadArgument
+	}
+	if !vm.proxyWriteUint32(idPtr, uint32(id)) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyIncrementMetric(id int32, offset int64) int32 {
+	m := vm.host.metrics.get(id)
+	if m == nil {
+		return proxyResultNotFound
+	}
+	if e := vm.host.metrics.increment(m, offset); e != nil {
+		return proxyResultBadArgument
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyRecordMetric(id int32, value int64) int32 {
+	m := vm.host.metrics.get(id)
+	if m == nil {
+		return proxyResultNotFound
+	}
+	if e := vm.host.metrics.record(m, value); e != nil {
+		return proxyResultBadArgument
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyGetMetric(id, valuePtr int32) int32 {
+	m := vm.host.metrics.get(id)
+	if m == nil {
+		return proxyResultNotFound
+	}
+	if m.typ == metricTypeHistogram {
+		return proxyResultBadArgument
+	}
+	if !vm.proxyWriteUint64(valuePtr, uint64(atomic.LoadInt64(&m.value))) {
+		return proxyResultInvalidMemoryAccess
+	}
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxySetEffectiveContext(contextID int32) int32 {
+	// there's only one stream at a time
+	return proxyResultOK
+}
+
+func (vm *WasmVM) proxyDone() int32 {
+	return proxyResultOK
+}
+
+// importProxyWasmFuncs imports the proxy-wasm host functions into wasm.
+func (vm *WasmVM) importProxyWasmFuncs(linker *wasmtime.Linker, module *wasmtime.Module) {
+	defineFunc := func(name string, fn interface{}) {
+		if e := linker.DefineFunc(vm.store, "env", name, fn); e != nil {
+			panic(e) // should never happen
+		}
+	}
+
+	defineFunc("proxy_log", vm.proxyLog)
+	defineFunc("proxy_get_log_level", vm.proxyGetLogLevel)
+	defineFunc("proxy_get_current_time_nanoseconds", vm.proxyGetCurrentTimeNanoseconds)
+	defineFunc("proxy_set_tick_period_milliseconds", vm.proxySetTickPeriodMilliseconds)
+
+	defineFunc("proxy_get_property", vm.proxyGetProperty)
+	defineFunc("proxy_set_property", vm.proxySetProperty)
+
+	defineFunc("proxy_get_header_map_value", vm.proxyGetHeaderMapValue)
+	defineFunc("proxy_get_header_map_pairs", vm.proxyGetHeaderMapPairs)
+	defineFunc("proxy_get_header_map_size", vm.proxyGetHeaderMapSize)
+	defineFunc("proxy_set_header_map_pairs", vm.proxySetHeaderMapPairs)
+	defineFunc("proxy_add_header_map_value", vm.proxyAddHeaderMapValue)
+	defineFunc("proxy_replace_header_map_value", vm.proxyReplaceHeaderMapValue)
+	defineFunc("proxy_remove_header_map_value", vm.proxyRemoveHeaderMapValue)
+
+	defineFunc("proxy_get_buffer_bytes", vm.proxyGetBufferBytes)
+	defineFunc("proxy_get_buffer_status", vm.proxyGetBufferStatus)
+	defineFunc("proxy_set_buffer_bytes", vm.proxySetBufferBytes)
+
+	defineFunc("proxy_send_local_response", vm.proxySendLocalResponse)
+	defineFunc("proxy_continue_stream", vm.proxyContinueStream)
+	defineFunc("proxy_continue_request", vm.proxyContinue)
+	defineFunc("proxy_continue_response", vm.proxyContinue)
+	defineFunc("proxy_http_call", vm.proxyHTTPCall)
+
+	defineFunc("proxy_get_shared_data", vm.proxyGetSharedData)
+	defineFunc("proxy_set_shared_data", vm.proxySetSharedData)
+
+	defineFunc("proxy_define_metric", vm.proxyDefineMetric)
+	defineFunc("proxy_increment_metric", vm.proxyIncrementMetric)
+	defineFunc("proxy_record_metric", vm.proxyRecordMetric)
+	defineFunc("proxy_get_metric", vm.proxyGetMetric)
+
+	defineFunc("proxy_set_effective_context", vm.proxySetEffectiveContext)
+	defineFunc("proxy_done", vm.proxyDone)
+
+	// other functions imported by the wasm code, like gRPC calls and shared
+	// queues, are not supported, they return Unimplemented.
+	for _, imp := range module.Imports() {
+		name := imp.Name()
+		if imp.Module() != "env" || name == nil || !strings.HasPrefix(*name, "proxy_") {
+			continue
+		}
+		ft := imp.Type().FuncType()
+		if ft == nil || linker.Get(vm.store, "env", *name) != nil {
+			continue
+		}
+
+		results := ft.Results()
+		fnName := *name
+		e := linker.FuncNew("env", fnName, ft, func(*wasmtime.Caller, []wasmtime.Val) ([]wasmtime.Val, *wasmtime.Trap) {
+			if len(results) == 1 && results[0].Kind() == wasmtime.KindI32 {
+				return []wasmtime.Val{wasmtime.ValI32(proxyResultUnimplemented)}, nil
+			}
+			return nil, wasmtime.NewTrap(fmt.Sprintf("%s is not supported", fnName))
+		})
+		if e != nil {
+			panic(e) // should never happen
+		}
+	}
+}
+
+// proxy-wasm callbacks
+
+func (vm *WasmVM) proxyFunc(name string) *wasmtime.Func {
+	fn, ok := vm.pw.fns[name]
+	if !ok {
+		fn = vm.inst.GetFunc(vm.store, name)
+		vm.pw.fns[name] = fn
+	}
+	return fn
+}
+
+// callProxyWasm calls the exported function, 0 is returned if the function
+// is not exported.
+func (vm *WasmVM) callProxyWasm(name string, args ...interface{}) int32 {
+	fn := vm.proxyFunc(name)
+	if fn == nil {
+		return 0
+	}
+	r, e := fn.Call(vm.store, args...)
+	if e != nil {
+		panic(e)
+	}
+	n, _ := r.(int32)
+	return n
+}
+
+// initProxyWasm starts the VM and creates the root context.
+func (vm *WasmVM) initProxyWasm() (err error) {
+	if vm.inst.GetFunc(vm.store, "proxy_abi_version_0_2_1") == nil &&
+		vm.inst.GetFunc(vm.store, "proxy_abi_version_0_2_0") == nil {
+		return fmt.Errorf("wasm code doesn't support proxy-wasm ABI 0.2.1")
+	}
+
+	fnMalloc := vm.inst.GetFunc(vm.store, "proxy_on_memory_allocate")
+	if fnMalloc == nil {
+		fnMalloc = vm.inst.GetFunc(vm.store, "malloc")
+	}
+	if fnMalloc == nil {
+		return fmt.Errorf("wasm code hasn't export function 'proxy_on_memory_allocate' or 'malloc'")
+	}
+	vm.pw = &proxyWasm{
+		fnMalloc:      fnMalloc,
+		fns:           map[string]*wasmtime.Func{},
+		nextContextID: proxyWasmRootContextID,
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = e.(error)
+		}
+	}()
+
+	// reactors export _initialize, while commands (like TinyGo) export _start
+	for _, name := range []string{"_initialize", "_start"} {
+		if vm.proxyFunc(name) != nil {
+			vm.callProxyWasm(name)
+			break
+		}
+	}
+
+	spec := vm.host.spec.ProxyWasm
+	vm.callProxyWasm("proxy_on_context_create", proxyWasmRootContextID, int32(0))
+	if vm.proxyFunc("proxy_on_vm_start") != nil {
+		if vm.callProxyWasm("proxy_on_vm_start", proxyWasmRootContextID, int32(len(spec.VMConfiguration))) == 0 {
+			return fmt.Errorf("proxy_on_vm_start failed")
+		}
+	}
+	if vm.proxyFunc("proxy_on_configure") != nil {
+		if vm.callProxyWasm("proxy_on_configure", proxyWasmRootContextID, int32(len(spec.PluginConfiguration))) == 0 {
+			return fmt.Errorf("proxy_on_configure failed")
+		}
+	}
+	return nil
+}
+
+// runProxyWasm runs the callbacks of a new HTTP context, the response
+// callbacks are used if there's a response, otherwise the request ones.
+func (vm *WasmVM) runProxyWasm() string {
+	pw := vm.pw
+	pw.nextContextID++
+	s := &proxyWasmStream{id: pw.nextContextID}
+	pw.stream = s
+	defer func() {
+		pw.stream = nil
+	}()
+
+	vm.callProxyWasm("proxy_on_context_create", s.id, proxyWasmRootContextID)
+	if resp := vm.ctx.GetInputResponse(); resp == nil {
+		body := rawPayload(vm.ctx.GetInputRequest())
+		vm.runProxyWasmPhase("proxy_on_request_headers", "proxy_on_request_body", proxyMapRequestHeaders, len(body))
+	} else {
+		body := rawPayload(resp)
+		vm.runProxyWasmPhase("proxy_on_response_headers", "proxy_on_response_body", proxyMapResponseHeaders, len(body))
+	}
+	vm.callProxyWasm("proxy_on_done", s.id)
+	vm.callProxyWasm("proxy_on_log", s.id)
+	vm.callProxyWasm("proxy_on_delete", s.id)
+
+	if s.localResponse {
+		return resultLocalResponse
+	}
+	return ""
+}
+
+func (vm *WasmVM) runProxyWasmPhase(onHeaders, onBody string, mapType int32, bodySize int) {
+	s := vm.pw.stream
+	pairs, _ := vm.proxyHeaderPairs(mapType)
+	endOfStream := int32(0)
+	if bodySize == 0 {
+		endOfStream = 1
+	}
+
+	action := vm.callProxyWasm(onHeaders, s.id, int32(len(pairs)), endOfStream)
+	vm.waitProxyWasmStream(action)
+	if s.localResponse || bodySize == 0 {
+		return
+	}
+
+	action = vm.callProxyWasm(onBody, s.id, int32(bodySize), int32(1))
+	vm.waitProxyWasmStream(action)
+}
+
+// waitProxyWasmStream dispatches the responses of outbound calls to the
+// wasm code in the order of the calls while the stream is paused, until the
+// stream is continued, a local response is sent or no calls are pending.
+func (vm *WasmVM) waitProxyWasmStream(action int32) {
+	s := vm.pw.stream
+	s.continued = false
+
+	for action == proxyActionPause && !s.continued && !s.localResponse && len(vm.calls) > 0 {
+		token := int32(-1)
+		for id := range vm.calls {
+			if token == -1 || id < token {
+				token = id
+			}
+		}
+		call := vm.calls[token]
+		delete(vm.calls, token)
+		call.wait()
+
+		numHeaders, bodySize := 0, 0
+		if call.err != nil {
+			logger.Errorf("proxy-wasm http call failed: %v", call.err)
+		} else {
+			s.callResp = call
+			pairs, _ := vm.proxyHeaderPairs(proxyMapHTTPCallResponseHeaders)
+			numHeaders, bodySize = len(pairs), len(call.body)
+		}
+
+		// responses are dispatched to the root context, which tracks
+		// the tokens of the calls
+		vm.callProxyWasm("proxy_on_http_call_response", proxyWasmRootContextID, token, int32(numHeaders), int32(bodySize), int32(0))
+		s.callResp = nil
+	}
+}
@@ -37,6 +37,13 @@ type WasmVM struct {
 	fnRun   *wasmtime.Func
 	fnAlloc *wasmtime.Func
 	fnFree  *wasmtime.Func
+
+	// outbound HTTP calls of the current request
+	calls      map[int32]*httpCall
+	nextCallID int32
+
+	// pw is not nil if the VM runs proxy-wasm code
+	pw *proxyWasm
 }
 
 // Interrupt interrupts the execution of wasm code
@@ -53,6 +60,15 @@ func (vm *WasmVM) Run() interface{} {
 	return r
 }
 
+func (vm *WasmVM) addHTTPCall(call *httpCall) int32 {
+	if vm.calls == nil {
+		vm.calls = make(map[int32]*httpCall)
+	}
+	vm.nextCallID++
+	vm.calls[vm.nextCallID] = call
+	return vm.nextCallID
+}
+
 func (vm *WasmVM) exportWasmFuncs() error {
 	if extern := vm.inst.GetExport(vm.store, "wasm_run"); extern == nil {
 		return fmt.Errorf("wasm code hasn't export function 'wasm_run'")
@@ -108,7 +124,12 @@ func newWasmVM(host *WasmHost, engine *wasmtime.Engine, module *wasmtime.Module,
 	vm := &WasmVM{host: host, store: store}
 
 	linker := wasmtime.NewLinker(engine)
-	vm.importHostFuncs(linker)
+	if host.spec.ProxyWasm != nil {
+		store.SetWasi(wasmtime.NewWasiConfig())
+		vm.importProxyWasmFuncs(linker, module)
+	} else {
+		vm.importHostFuncs(linker)
+	}
 
 	e := linker.DefineWasi()
 	if e != nil {
@@ -121,6 +142,13 @@ func newWasmVM(host *WasmHost, engine *wasmtime.Engine, module *wasmtime.Module,
 	}
 	vm.inst = inst
 
+	if host.spec.ProxyWasm != nil {
+		if e = vm.initProxyWasm(); e != nil {
+			return nil, e
+		}
+		return vm, nil
+	}
+
 	if e = vm.exportWasmFuncs(); e != nil {
 		return nil, e
 	}
@@ -21,12 +21,13 @@
 package wasmhost
 
 import (
-	"bytes"
+	"crypto"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -49,7 +50,10 @@ const (
 var (
 	resultOutOfVM   = "outOfVM"
 	resultWasmError = "wasmError"
-	results         = []string{resultOutOfVM, resultWasmError}
+	// resultLocalResponse is returned when proxy-wasm code sends a local
+	// response.
+	resultLocalResponse = "localResponse"
+	results             = []string{resultOutOfVM, resultWasmError, resultLocalResponse}
 )
 
 func wasmResultToFilterResult(r int32) string {
@@ -89,21 +93,35 @@ type (
 		filters.BaseSpec `json:",inline"`
 
 		MaxConcurrency int32             `json:"maxConcurrency" jsonschema:"required,minimum=1"`
-		Code           string            `json:"code" jsonschema:"required"`
+		Code           string            `json:"code,omitempty" jsonschema:"omitempty"`
+		Modules        []*ModuleSpec     `json:"modules,omitempty" jsonschema:"omitempty"`
+		PublicKey      string            `json:"publicKey,omitempty" jsonschema:"omitempty"`
+		CacheDir       string            `json:"cacheDir,omitempty" jsonschema:"omitempty"`
 		Timeout        string            `json:"timeout" jsonschema:"required,format=duration"`
 		Parameters     map[string]string `json:"parameters" jsonschema:"omitempty"`
+		ProxyWasm      *ProxyWasmSpec    `json:"proxyWasm,omitempty" jsonschema:"omitempty"`
 		timeout        time.Duration
 	}
 
+	// ProxyWasmSpec is the spec of the proxy-wasm ABI, the wasm code is
+	// run as a proxy-wasm filter if it is not nil.
+	ProxyWasmSpec struct {
+		RootID              string `json:"rootID,omitempty" jsonschema:"omitempty"`
+		VMConfiguration     string `json:"vmConfiguration,omitempty" jsonschema:"omitempty"`
+		PluginConfiguration string `json:"pluginConfiguration,omitempty" jsonschema:"omitempty"`
+	}
+
 	// WasmHost is the WebAssembly filter
 	WasmHost struct {
 		spec *Spec
 
-		code       []byte
 		dataPrefix string
 		data       atomic.Value
-		vmPool     atomic.Value
+		versions   atomic.Value
 		chStop     chan struct{}
+		metrics    *metrics
+		cacheDir   string
+		publicKey  crypto.PublicKey
 
 		numOfRequest   int64
 		numOfWasmError int64
@@ -111,12 +129,50 @@ type (
 
 	// Status is the status of WasmHost
 	Status struct {
-		Health         string `json:"health"`
-		NumOfRequest   int64  `json:"numOfRequest"`
-		NumOfWasmError int64  `json:"numOfWasmError"`
+		Health         string          `json:"health"`
+		NumOfRequest   int64           `json:"numOfRequest"`
+		NumOfWasmError int64           `json:"numOfWasmError"`
+		Modules        []*ModuleStatus `json:"modules,omitempty"`
 	}
 )
 
+// Validate validates the Spec.
+func (spec *Spec) Validate() error {
+	if (spec.Code == "") == (len(spec.Modules) == 0) {
+		return fmt.Errorf("one and only one of code and modules must be specified")
+	}
+
+	if spec.PublicKey != "" {
+		if len(spec.Modules) == 0 {
+			return fmt.Errorf("publicKey can only be used with modules")
+		}
+		if _, err := parsePublicKey(spec.PublicKey); err != nil {
+			return fmt.Errorf("invalid publicKey: %v", err)
+		}
+	}
+
+	digests := map[string]bool{}
+	weight := 0
+	for _, m := range spec.Modules {
+		if !isURL(m.URL) && !isOCIReference(m.URL) {
+			return fmt.Errorf("invalid module url %s, must be an http(s) url or an oci reference", m.URL)
+		}
+		if digests[m.Digest] {
+			return fmt.Errorf("duplicated module digest %s", m.Digest)
+		}
+		digests[m.Digest] = true
+		if spec.PublicKey != "" && m.Signature == "" {
+			return fmt.Errorf("signature of module %s is required", m.URL)
+		}
+		weight += m.Weight
+	}
+	if len(spec.Modules) > 1 && weight != 100 {
+		return fmt.Errorf("sum of module weights must be 100")
+	}
+
+	return nil
+}
+
 // Name returns the name of the WasmHost filter instance.
 func (wh *WasmHost) Name() string {
 	return wh.spec.Name()
@@ -179,13 +235,18 @@ func (wh *WasmHost) readWasmCode() ([]byte, error) {
 }
 
 func (wh *WasmHost) loadWasmCode() error {
+	if len(wh.spec.Modules) > 0 {
+		return wh.loadModules()
+	}
+
 	code, e := wh.readWasmCode()
 	if e != nil {
 		logger.Errorf("failed to load wasm code: %v", e)
 		return e
 	}
 
-	if len(wh.code) > 0 && bytes.Equal(wh.code, code) {
+	digest := codeDigest(code)
+	if versions := wh.moduleVersions(); len(versions) > 0 && versions[0].digest == digest {
 		return nil
 	}
 
@@ -194,9 +255,8 @@ func (wh *WasmHost) loadWasmCode() error {
 		logger.Errorf("failed to create wasm VM pool: %v", e)
 		return e
 	}
-	wh.code = code
 
-	wh.vmPool.Store(p)
+	wh.versions.Store([]*moduleVersion{{digest: digest, weight: 100, pool: p}})
 	return nil
 }
 
@@ -230,7 +290,7 @@ func (wh *WasmHost) watchWasmCode() {
 			err = wh.loadWasmCode()
 
 		case <-time.After(30 * time.Second):
-			if err != nil || len(wh.code) == 0 {
+			if err != nil || len(wh.moduleVersions()) == 0 {
 				err = wh.loadWasmCode()
 			}
 
@@ -282,6 +342,15 @@ func (wh *WasmHost) reload() {
 
 	wh.spec.timeout, _ = time.ParseDuration(wh.spec.Timeout)
 	wh.chStop = make(chan struct{})
+	wh.metrics = wh.newMetrics()
+
+	wh.cacheDir = spec.CacheDir
+	if wh.cacheDir == "" {
+		wh.cacheDir = filepath.Join(spec.Super().Options().AbsDataDir, "wasm")
+	}
+	if spec.PublicKey != "" {
+		wh.publicKey, _ = parsePublicKey(spec.PublicKey)
+	}
 
 	wh.loadWasmCode()
 	go wh.watchWasmCode()
@@ -302,13 +371,14 @@ func (wh *WasmHost) Inherit(previousGeneration filters.Filter) {
 func (wh *WasmHost) Handle(ctx *context.Context) (result string) {
 	// we must save the pool to a local variable for later use as it will be
 	// replaced when updating the wasm code
-	var pool *WasmVMPool
-	if p := wh.vmPool.Load(); p == nil {
+	versions := wh.moduleVersions()
+	if len(versions) == 0 {
 		ctx.AddTag("wasm VM pool is not initialized")
 		return resultOutOfVM
-	} else {
-		pool = p.(*WasmVMPool)
 	}
+	version := pickVersion(versions)
+	pool := version.pool
+	atomic.AddInt64(&version.numOfRequest, 1)
 
 	// get a free wasm VM and attach the ctx to it
 	vm := pool.Get()
@@ -317,6 +387,7 @@ func (wh *WasmHost) Handle(ctx *context.Context) (result string) {
 		return resultOutOfVM
 	}
 	vm.ctx = ctx
+	vm.calls = nil
 	atomic.AddInt64(&wh.numOfRequest, 1)
 
 	var wg sync.WaitGroup
@@ -362,6 +433,10 @@ func (wh *WasmHost) Handle(ctx *context.Context) (result string) {
 		}
 	}()
 
+	if vm.pw != nil {
+		return vm.runProxyWasm()
+	}
+
 	resp, _ := ctx.GetOutputResponse().(*httpprot.Response)
 	if resp == nil {
 		resp, _ = httpprot.NewResponse(nil)
@@ -379,14 +454,23 @@ func (wh *WasmHost) Handle(ctx *context.Context) (result string) {
 
 // Status returns Status generated by the filter.
 func (wh *WasmHost) Status() interface{} {
-	p := wh.vmPool.Load()
+	versions := wh.moduleVersions()
 	s := &Status{}
-	if p == nil {
+	if len(versions) == 0 {
 		s.Health = "VM pool is not initialized"
 	} else {
 		s.Health = "ready"
 	}
 
+	for _, v := range versions {
+		s.Modules = append(s.Modules, &ModuleStatus{
+			URL:          v.url,
+			Digest:       v.digest,
+			Weight:       v.weight,
+			NumOfRequest: atomic.LoadInt64(&v.numOfRequest),
+		})
+	}
+
 	s.NumOfRequest = atomic.LoadInt64(&wh.numOfRequest)
 	s.NumOfWasmError = atomic.LoadInt64(&wh.numOfWasmError)
 	return s
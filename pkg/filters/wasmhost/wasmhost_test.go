@@ -0,0 +1,253 @@
+//go:build wasmhost
+// +build wasmhost
+
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package wasmhost
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+// mockPipeline responds the outbound calls of wasm code.
+type mockPipeline struct {
+	path string
+}
+
+func (p *mockPipeline) Handle(ctx *context.Context) string {
+	p.path = ctx.GetInputRequest().(*httpprot.Request).Path()
+	resp, _ := httpprot.NewResponse(nil)
+	resp.SetStatusCode(http.StatusCreated)
+	resp.SetPayload([]byte("authorized"))
+	ctx.SetOutputResponse(resp)
+	return ""
+}
+
+func mockGetPipeline(t *testing.T, name string, p *mockPipeline) {
+	old := fnGetPipeline
+	fnGetPipeline = func(super *supervisor.Supervisor, n string) (context.Handler, bool) {
+		return p, n == name
+	}
+	t.Cleanup(func() {
+		fnGetPipeline = old
+	})
+}
+
+func newWasmHost(t *testing.T, wat string, proxyWasm *ProxyWasmSpec) *WasmHost {
+	code, err := wasmtime.Wat2Wasm(wat)
+	assert.Nil(t, err)
+
+	spec := &Spec{MaxConcurrency: 1, Timeout: "1s", ProxyWasm: proxyWasm}
+	spec.timeout = time.Second
+	wh := &WasmHost{spec: spec, chStop: make(chan struct{})}
+	wh.metrics = wh.newMetrics()
+
+	p, err := NewWasmVMPool(wh, code)
+	assert.Nil(t, err)
+	wh.versions.Store([]*moduleVersion{{digest: codeDigest(code), weight: 100, pool: p}})
+	return wh
+}
+
+func newContext(t *testing.T, header map[string]string) *context.Context {
+	ctx := context.New(nil)
+	stdReq, err := http.NewRequest(http.MethodGet, "http://127.0.0.1/api", nil)
+	assert.Nil(t, err)
+	for k, v := range header {
+		stdReq.Header.Set(k, v)
+	}
+	req, err := httpprot.NewRequest(stdReq)
+	assert.Nil(t, err)
+	assert.Nil(t, req.FetchPayload(0))
+	ctx.SetInputRequest(req)
+	return ctx
+}
+
+// strings are 4 byte length (including the trailing zero) + content + zero,
+// and data are 4 byte length + content.
+const easegressWat = `
+(module
+  (import "easegress" "host_ctx_set_data" (func $set_data (param i32 i32)))
+  (import "easegress" "host_metric_counter_add" (func $counter_add (param i32 f64)))
+  (import "easegress" "host_http_call" (func $http_call (param i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "easegress" "host_http_call_wait" (func $http_call_wait (param i32) (result i32)))
+  (import "easegress" "host_http_call_get_body" (func $http_call_get_body (param i32) (result i32)))
+  (import "easegress" "host_resp_set_status_code" (func $set_status_code (param i32)))
+  (import "easegress" "host_resp_set_body" (func $set_body (param i32)))
+  (memory (export "memory") 1)
+  (global $heap (mut i32) (i32.const 4096))
+  (data (i32.const 16) "\04\00\00\00key\00")
+  (data (i32.const 32) "\06\00\00\00value\00")
+  (data (i32.const 48) "\09\00\00\00requests\00")
+  (data (i32.const 64) "\05\00\00\00auth\00")
+  (data (i32.const 80) "\04\00\00\00GET\00")
+  (data (i32.const 96) "\06\00\00\00/auth\00")
+  (data (i32.const 112) "\01\00\00\00\00")
+  (data (i32.const 128) "\00\00\00\00")
+  (func (export "wasm_alloc") (param $size i32) (result i32)
+    (local $addr i32)
+    (local.set $addr (global.get $heap))
+    (global.set $heap (i32.add (global.get $heap) (local.get $size)))
+    (local.get $addr))
+  (func (export "wasm_free") (param i32))
+  (func (export "wasm_run") (result i32)
+    (local $id i32)
+    (call $set_data (i32.const 16) (i32.const 32))
+    (call $counter_add (i32.const 48) (f64.const 1))
+    (local.set $id (call $http_call (i32.const 64) (i32.const 80) (i32.const 96) (i32.const 112) (i32.const 128) (i32.const 0)))
+    (call $set_status_code (call $http_call_wait (local.get $id)))
+    (call $set_body (call $http_call_get_body (local.get $id)))
+    (i32.const 0)))
+`
+
+func TestEasegressABI(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &mockPipeline{}
+	mockGetPipeline(t, "auth", p)
+	wh := newWasmHost(t, easegressWat, nil)
+
+	ctx := newContext(t, nil)
+	assert.Equal("", wh.Handle(ctx))
+	assert.Equal("value", ctx.GetData("key"))
+	assert.Equal("/auth", p.path)
+
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusCreated, resp.StatusCode())
+	assert.Equal("authorized", string(resp.RawPayload()))
+}
+
+func TestContextDataToString(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("", contextDataToString(nil))
+	assert.Equal("abc", contextDataToString("abc"))
+	assert.Equal("abc", contextDataToString([]byte("abc")))
+	assert.Equal(`{"a":1}`, contextDataToString(map[string]interface{}{"a": 1}))
+}
+
+const proxyWasmWat = `
+(module
+  (import "env" "proxy_get_header_map_value" (func $get_header (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "proxy_add_header_map_value" (func $add_header (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "proxy_send_local_response" (func $send_local_response (param i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "proxy_http_call" (func $http_call (param i32 i32 i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "proxy_get_buffer_bytes" (func $get_buffer (param i32 i32 i32 i32 i32) (result i32)))
+  (import "env" "proxy_continue_stream" (func $continue_stream (param i32) (result i32)))
+  (import "env" "proxy_grpc_cancel" (func $grpc_cancel (param i32) (result i32)))
+  (memory (export "memory") 1)
+  (global $heap (mut i32) (i32.const 4096))
+  (data (i32.const 100) "x-deny")
+  (data (i32.const 110) "denied")
+  (data (i32.const 120) "x-wasm")
+  (data (i32.const 130) "proxy")
+  (data (i32.const 140) "x-call")
+  (data (i32.const 150) "auth")
+  (data (i32.const 160) "x-auth")
+  ;; pairs of the call: :path=/auth, :method=GET
+  (data (i32.const 300) "\02\00\00\00\05\00\00\00\05\00\00\00\07\00\00\00\03\00\00\00:path\00/auth\00:method\00GET\00")
+  (func (export "proxy_abi_version_0_2_1"))
+  (func (export "proxy_on_memory_allocate") (param $size i32) (result i32)
+    (local $addr i32)
+    (local.set $addr (global.get $heap))
+    (global.set $heap (i32.add (global.get $heap) (local.get $size)))
+    (local.get $addr))
+  (func (export "proxy_on_context_create") (param i32 i32))
+  ;; unsupported functions return Unimplemented
+  (func (export "proxy_on_vm_start") (param i32 i32) (result i32)
+    (i32.eq (call $grpc_cancel (i32.const 0)) (i32.const 12)))
+  (func (export "proxy_on_request_headers") (param i32 i32 i32) (result i32)
+    (if (i32.eqz (call $get_header (i32.const 0) (i32.const 100) (i32.const 6) (i32.const 200) (i32.const 204)))
+      (then
+        (drop (call $send_local_response (i32.const 403) (i32.const 0) (i32.const 0) (i32.const 110) (i32.const 6) (i32.const 0) (i32.const 0) (i32.const -1)))
+        (return (i32.const 0))))
+    (drop (call $add_header (i32.const 0) (i32.const 120) (i32.const 6) (i32.const 130) (i32.const 5)))
+    (if (i32.eqz (call $get_header (i32.const 0) (i32.const 140) (i32.const 6) (i32.const 200) (i32.const 204)))
+      (then
+        (drop (call $http_call (i32.const 150) (i32.const 4) (i32.const 300) (i32.const 44) (i32.const 0) (i32.const 0) (i32.const 0) (i32.const 0) (i32.const 1000) (i32.const 208)))
+        (return (i32.const 1))))
+    (i32.const 0))
+  (func (export "proxy_on_http_call_response") (param i32 i32 i32 i32 i32)
+    (drop (call $get_buffer (i32.const 4) (i32.const 0) (local.get 3) (i32.const 200) (i32.const 204)))
+    (drop (call $add_header (i32.const 0) (i32.const 160) (i32.const 6) (i32.load (i32.const 200)) (i32.load (i32.const 204))))
+    (drop (call $continue_stream (i32.const 0)))))
+`
+
+func TestProxyWasm(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &mockPipeline{}
+	mockGetPipeline(t, "auth", p)
+	wh := newWasmHost(t, proxyWasmWat, &ProxyWasmSpec{})
+
+	// local response
+	ctx := newContext(t, map[string]string{"X-Deny": "true"})
+	assert.Equal(resultLocalResponse, wh.Handle(ctx))
+	resp := ctx.GetOutputResponse().(*httpprot.Response)
+	assert.Equal(http.StatusForbidden, resp.StatusCode())
+	assert.Equal("denied", string(resp.RawPayload()))
+
+	// modify headers
+	ctx = newContext(t, nil)
+	assert.Equal("", wh.Handle(ctx))
+	req := ctx.GetInputRequest().(*httpprot.Request)
+	assert.Equal("proxy", req.HTTPHeader().Get("X-Wasm"))
+	assert.Equal("", req.HTTPHeader().Get("X-Auth"))
+
+	// the stream is paused until the response of the call is dispatched
+	ctx = newContext(t, map[string]string{"X-Call": "true"})
+	assert.Equal("", wh.Handle(ctx))
+	req = ctx.GetInputRequest().(*httpprot.Request)
+	assert.Equal("proxy", req.HTTPHeader().Get("X-Wasm"))
+	assert.Equal("authorized", req.HTTPHeader().Get("X-Auth"))
+	assert.Equal("/auth", p.path)
+
+	assert.Equal(int64(3), wh.Status().(*Status).NumOfRequest)
+	assert.Equal(int64(0), wh.Status().(*Status).NumOfWasmError)
+}
+
+func TestProxyWasmPairs(t *testing.T) {
+	assert := assert.New(t)
+
+	pairs := [][2]string{{":path", "/auth"}, {":method", "GET"}}
+	data := encodeProxyPairs(pairs)
+	assert.Equal(44, len(data))
+	assert.True(strings.HasSuffix(string(data), ":path\x00/auth\x00:method\x00GET\x00"))
+
+	decoded, ok := decodeProxyPairs(data)
+	assert.True(ok)
+	assert.Equal(pairs, decoded)
+
+	_, ok = decodeProxyPairs(data[:20])
+	assert.False(ok)
+	decoded, ok = decodeProxyPairs(nil)
+	assert.True(ok)
+	assert.Empty(decoded)
+}
@@ -0,0 +1,1088 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package acmetest provides an in-memory ACME server for testing. It
+// implements the subset of RFC 8555 used by AutoCertManager, verifies the
+// JWS signatures and external account bindings of requests, and validates
+// challenges for real, so issuance and renewal can be tested without the
+// internet.
+package acmetest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/stringtool"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	statusPending     = "pending"
+	statusProcessing  = "processing"
+	statusReady       = "ready"
+	statusValid       = "valid"
+	statusInvalid     = "invalid"
+	statusDeactivated = "deactivated"
+
+	errorPrefix = "urn:ietf:params:acme:error:"
+)
+
+// idPeACMEIdentifier is the OID of the acmeIdentifier extension of the
+// TLS-ALPN-01 challenge certificate, see RFC 8737.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+type (
+	// Options are the options of Server.
+	Options struct {
+		// EAB are the external account binding HMAC keys indexed by key
+		// IDs. New accounts must be bound to one of them if it is not
+		// empty, and each key can only be used once.
+		EAB map[string][]byte
+		// CertLifetime is the lifetime of the issued certificates, it is
+		// 90 days if zero.
+		CertLifetime time.Duration
+		// HTTP01Address is the address to send HTTP-01 validation requests
+		// to, HTTP-01 challenges are not offered if it is empty.
+		HTTP01Address string
+		// TLSALPN01Address is the address to send TLS-ALPN-01 validation
+		// requests to, TLS-ALPN-01 challenges are not offered if it is
+		// empty.
+		TLSALPN01Address string
+		// DNS01Validator validates a DNS-01 challenge by checking whether
+		// value is the TXT record of _acme-challenge.<domain>, DNS-01
+		// challenges are not offered if it is nil.
+		DNS01Validator func(domain, value string) error
+	}
+
+	// Server is an in-memory ACME server.
+	Server struct {
+		opts *Options
+		ts   *httptest.Server
+		ca   *tlsutiltest.CA
+
+		mu            sync.Mutex
+		nextID        int
+		nonces        map[string]struct{}
+		usedEAB       map[string]bool
+		accounts      map[string]*account
+		accountsByKey map[string]*account
+		orders        map[string]*order
+		authzs        map[string]*authz
+		challenges    map[string]*challenge
+		certs         map[string][]byte
+		issued        int
+	}
+
+	account struct {
+		id         string
+		key        crypto.PublicKey
+		thumbprint string
+		contact    []string
+	}
+
+	identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+
+	order struct {
+		id          string
+		accountID   string
+		status      string
+		expires     time.Time
+		identifiers []identifier
+		authzs      []*authz
+		certID      string
+	}
+
+	authz struct {
+		id         string
+		accountID  string
+		status     string
+		expires    time.Time
+		identifier identifier
+		wildcard   bool
+		challenges []*challenge
+	}
+
+	challenge struct {
+		id        string
+		typ       string
+		token     string
+		status    string
+		validated time.Time
+		err       *problem
+		authz     *authz
+	}
+
+	problem struct {
+		Type   string `json:"type"`
+		Detail string `json:"detail"`
+		Status int    `json:"status"`
+	}
+
+	request struct {
+		id      string
+		account *account
+		key     crypto.PublicKey
+		payload []byte
+	}
+
+	response struct {
+		status      int
+		location    string
+		contentType string
+		body        interface{}
+	}
+
+	handler func(req *request) (*response, *problem)
+)
+
+func newProblem(typ string, status int, format string, args ...interface{}) *problem {
+	return &problem{
+		Type:   errorPrefix + typ,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
+
+// NewServer creates and starts a Server, it listens on a random port of
+// 127.0.0.1 and serves HTTPS with a self-signed certificate, see
+// ServerCertPEM.
+func NewServer(opts *Options) *Server {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.CertLifetime == 0 {
+		opts.CertLifetime = 90 * 24 * time.Hour
+	}
+
+	s := &Server{
+		opts:          opts,
+		ca:            tlsutiltest.NewCA("Easegress ACME Test CA"),
+		nonces:        map[string]struct{}{},
+		usedEAB:       map[string]bool{},
+		accounts:      map[string]*account{},
+		accountsByKey: map[string]*account{},
+		orders:        map[string]*order{},
+		authzs:        map[string]*authz{},
+		challenges:    map[string]*challenge{},
+		certs:         map[string][]byte{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", s.handleDirectory)
+	mux.HandleFunc("/nonce", s.handleNonce)
+	mux.HandleFunc("/account", s.post(true, s.newAccount))
+	mux.HandleFunc("/account/", s.post(false, s.getAccount))
+	mux.HandleFunc("/order", s.post(false, s.newOrder))
+	mux.HandleFunc("/order/", s.post(false, s.getOrder))
+	mux.HandleFunc("/finalize/", s.post(false, s.finalize))
+	mux.HandleFunc("/authz/", s.post(false, s.authorization))
+	mux.HandleFunc("/chall/", s.post(false, s.challenge))
+	mux.HandleFunc("/cert/", s.post(false, s.certificate))
+	s.ts = httptest.NewTLSServer(mux)
+
+	return s
+}
+
+// DirectoryURL returns the directory URL of the server.
+func (s *Server) DirectoryURL() string {
+	return s.ts.URL + "/directory"
+}
+
+// ServerCertPEM returns the PEM encoded certificate of the HTTPS server,
+// clients need to trust it to access the server.
+func (s *Server) ServerCertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.ts.Certificate().Raw})
+}
+
+// Client returns an HTTP client which trusts the server.
+func (s *Server) Client() *http.Client {
+	return s.ts.Client()
+}
+
+// IssuerCert returns the CA certificate which issues certificates.
+func (s *Server) IssuerCert() *x509.Certificate {
+	return s.ca.Cert()
+}
+
+// Accounts returns the number of registered accounts.
+func (s *Server) Accounts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.accounts)
+}
+
+// Issued returns the number of issued certificates.
+func (s *Server) Issued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issued
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.ts.Close()
+}
+
+func (s *Server) url(path string) string {
+	return s.ts.URL + path
+}
+
+// newID must be called with s.mu held.
+func (s *Server) newID() string {
+	s.nextID++
+	return strconv.Itoa(s.nextID)
+}
+
+func (s *Server) newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+
+	s.mu.Lock()
+	s.nonces[nonce] = struct{}{}
+	s.mu.Unlock()
+
+	return nonce
+}
+
+func writeJSON(w http.ResponseWriter, status int, contentType string, v interface{}) {
+	data, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	dir := map[string]interface{}{
+		"newNonce":   s.url("/nonce"),
+		"newAccount": s.url("/account"),
+		"newOrder":   s.url("/order"),
+		"revokeCert": s.url("/revoke"),
+		"keyChange":  s.url("/key-change"),
+		"meta": map[string]interface{}{
+			"externalAccountRequired": len(s.opts.EAB) > 0,
+		},
+	}
+	writeJSON(w, http.StatusOK, "application/json", dir)
+}
+
+func (s *Server) handleNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// post wraps h to handle a JWS signed POST request. The request must be
+// signed by an embedded JWK if jwk is true, or by a registered account
+// otherwise.
+func (s *Server) post(jwk bool, h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", s.newNonce())
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.Method != http.MethodPost {
+			p := newProblem("malformed", http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+			writeJSON(w, p.Status, "application/problem+json", p)
+			return
+		}
+
+		s.mu.Lock()
+		req, p := s.parseJWS(r, jwk)
+		var resp *response
+		if p == nil {
+			resp, p = h(req)
+		}
+		s.mu.Unlock()
+
+		if p != nil {
+			writeJSON(w, p.Status, "application/problem+json", p)
+			return
+		}
+
+		if resp.location != "" {
+			w.Header().Set("Location", resp.location)
+		}
+		if data, ok := resp.body.([]byte); ok {
+			w.Header().Set("Content-Type", resp.contentType)
+			w.WriteHeader(resp.status)
+			w.Write(data)
+			return
+		}
+		writeJSON(w, resp.status, "application/json", resp.body)
+	}
+}
+
+// parseJWS parses and verifies the JWS in the body of r, it must be called
+// with s.mu held.
+func (s *Server) parseJWS(r *http.Request, jwk bool) (*request, *problem) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, newProblem("malformed", http.StatusBadRequest, "failed to read body: %v", err)
+	}
+	if err = json.Unmarshal(body, &jws); err != nil {
+		return nil, newProblem("malformed", http.StatusBadRequest, "invalid JWS: %v", err)
+	}
+
+	var header struct {
+		Alg   string          `json:"alg"`
+		Nonce string          `json:"nonce"`
+		URL   string          `json:"url"`
+		JWK   json.RawMessage `json:"jwk"`
+		KID   string          `json:"kid"`
+	}
+	if err = decodeJSON(jws.Protected, &header); err != nil {
+		return nil, newProblem("malformed", http.StatusBadRequest, "invalid protected header: %v", err)
+	}
+
+	if header.URL != s.url(r.URL.Path) {
+		return nil, newProblem("unauthorized", http.StatusUnauthorized, "url %q does not match the request", header.URL)
+	}
+	if _, ok := s.nonces[header.Nonce]; !ok {
+		return nil, newProblem("badNonce", http.StatusBadRequest, "invalid nonce %q", header.Nonce)
+	}
+	delete(s.nonces, header.Nonce)
+
+	req := &request{id: r.URL.Path[strings.LastIndexByte(r.URL.Path, '/')+1:]}
+	if jwk {
+		if header.KID != "" || len(header.JWK) == 0 {
+			return nil, newProblem("malformed", http.StatusBadRequest, "the request must be signed by a JWK")
+		}
+		if req.key, err = parseJWK(header.JWK); err != nil {
+			return nil, newProblem("badPublicKey", http.StatusBadRequest, "%v", err)
+		}
+	} else {
+		if header.KID == "" || len(header.JWK) != 0 {
+			return nil, newProblem("malformed", http.StatusBadRequest, "the request must be signed by an account")
+		}
+		acct := s.accounts[strings.TrimPrefix(header.KID, s.url("/account/"))]
+		if acct == nil {
+			return nil, newProblem("accountDoesNotExist", http.StatusBadRequest, "account %q does not exist", header.KID)
+		}
+		req.account = acct
+		req.key = acct.key
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return nil, newProblem("malformed", http.StatusBadRequest, "invalid signature: %v", err)
+	}
+	if err = verify(req.key, header.Alg, []byte(jws.Protected+"."+jws.Payload), sig); err != nil {
+		return nil, newProblem("unauthorized", http.StatusUnauthorized, "%v", err)
+	}
+
+	if req.payload, err = base64.RawURLEncoding.DecodeString(jws.Payload); err != nil {
+		return nil, newProblem("malformed", http.StatusBadRequest, "invalid payload: %v", err)
+	}
+	return req, nil
+}
+
+func decodeJSON(b64 string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(b64 string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func parseJWK(data []byte) (crypto.PublicKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	}
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, fmt.Errorf("invalid JWK: %v", err)
+	}
+
+	switch jwk.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK: %v", err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("invalid JWK: point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK: %v", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid JWK: invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+func verify(key crypto.PublicKey, alg string, signed, sig []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %q does not match the RSA key", alg)
+		}
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case alg == "ES256" && key.Curve == elliptic.P256():
+			d := sha256.Sum256(signed)
+			digest = d[:]
+		case alg == "ES384" && key.Curve == elliptic.P384():
+			d := sha512.Sum384(signed)
+			digest = d[:]
+		case alg == "ES512" && key.Curve == elliptic.P521():
+			d := sha512.Sum512(signed)
+			digest = d[:]
+		default:
+			return fmt.Errorf("algorithm %q does not match the ECDSA key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type")
+}
+
+// verifyEAB verifies the external account binding of a new account, and
+// returns the key ID, see RFC 8555 section 7.3.4.
+func (s *Server) verifyEAB(raw json.RawMessage, key crypto.PublicKey) (string, *problem) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(raw, &jws); err != nil {
+		return "", newProblem("malformed", http.StatusBadRequest, "invalid external account binding: %v", err)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		KID string `json:"kid"`
+		URL string `json:"url"`
+	}
+	if err := decodeJSON(jws.Protected, &header); err != nil {
+		return "", newProblem("malformed", http.StatusBadRequest, "invalid external account binding: %v", err)
+	}
+	if header.Alg != "HS256" || header.URL != s.url("/account") {
+		return "", newProblem("malformed", http.StatusBadRequest, "invalid external account binding header")
+	}
+
+	hmacKey, ok := s.opts.EAB[header.KID]
+	if !ok {
+		return "", newProblem("unauthorized", http.StatusUnauthorized, "unknown external account %q", header.KID)
+	}
+	if s.usedEAB[header.KID] {
+		return "", newProblem("unauthorized", http.StatusUnauthorized, "external account %q is already bound", header.KID)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return "", newProblem("malformed", http.StatusBadRequest, "invalid external account binding signature")
+	}
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(jws.Protected + "." + jws.Payload))
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return "", newProblem("unauthorized", http.StatusUnauthorized, "external account binding signature mismatch")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return "", newProblem("malformed", http.StatusBadRequest, "invalid external account binding payload")
+	}
+	bound, err := parseJWK(payload)
+	if err != nil {
+		return "", newProblem("malformed", http.StatusBadRequest, "invalid external account binding payload: %v", err)
+	}
+	tp1, _ := acme.JWKThumbprint(bound)
+	tp2, _ := acme.JWKThumbprint(key)
+	if tp1 != tp2 {
+		return "", newProblem("unauthorized", http.StatusUnauthorized, "external account binding key mismatch")
+	}
+
+	return header.KID, nil
+}
+
+func (s *Server) accountJSON(acct *account) interface{} {
+	return map[string]interface{}{
+		"status":  statusValid,
+		"contact": acct.contact,
+		"orders":  s.url("/account/" + acct.id + "/orders"),
+	}
+}
+
+func (s *Server) newAccount(req *request) (*response, *problem) {
+	var payload struct {
+		Contact              []string        `json:"contact"`
+		TermsOfServiceAgreed bool            `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool            `json:"onlyReturnExisting"`
+		EAB                  json.RawMessage `json:"externalAccountBinding"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return nil, newProblem("malformed", http.StatusBadRequest, "invalid payload: %v", err)
+	}
+
+	thumbprint, err := acme.JWKThumbprint(req.key)
+	if err != nil {
+		return nil, newProblem("badPublicKey", http.StatusBadRequest, "%v", err)
+	}
+	if acct := s.accountsByKey[thumbprint]; acct != nil {
+		return &response{
+			status:   http.StatusOK,
+			location: s.url("/account/" + acct.id),
+			body:     s.accountJSON(acct),
+		}, nil
+	}
+	if payload.OnlyReturnExisting {
+		return nil, newProblem("accountDoesNotExist", http.StatusBadRequest, "account does not exist")
+	}
+
+	if len(s.opts.EAB) > 0 {
+		if len(payload.EAB) == 0 {
+			return nil, newProblem("externalAccountRequired", http.StatusUnauthorized, "external account binding is required")
+		}
+		kid, p := s.verifyEAB(payload.EAB, req.key)
+		if p != nil {
+			return nil, p
+		}
+		s.usedEAB[kid] = true
+	}
+
+	acct := &account{
+		id:         s.newID(),
+		key:        req.key,
+		thumbprint: thumbprint,
+		contact:    payload.Contact,
+	}
+	s.accounts[acct.id] = acct
+	s.accountsByKey[thumbprint] = acct
+
+	return &response{
+		status:   http.StatusCreated,
+		location: s.url("/account/" + acct.id),
+		body:     s.accountJSON(acct),
+	}, nil
+}
+
+func (s *Server) getAccount(req *request) (*response, *problem) {
+	if req.id != req.account.id {
+		return nil, newProblem("unauthorized", http.StatusUnauthorized, "account mismatch")
+	}
+	return &response{status: http.StatusOK, body: s.accountJSON(req.account)}, nil
+}
+
+// newAuthz creates an authorization for id, it must be called with s.mu
+// held.
+func (s *Server) newAuthz(accountID string, id identifier) (*authz, *problem) {
+	a := &authz{
+		id:         s.newID(),
+		accountID:  accountID,
+		status:     statusPending,
+		expires:    time.Now().Add(time.Hour),
+		identifier: id,
+	}
+	if strings.HasPrefix(id.Value, "*.") {
+		a.identifier.Value = id.Value[2:]
+		a.wildcard = true
+	}
+
+	var types []string
+	if s.opts.HTTP01Address != "" && !a.wildcard {
+		types = append(types, "http-01")
+	}
+	if s.opts.TLSALPN01Address != "" && !a.wildcard {
+		types = append(types, "tls-alpn-01")
+	}
+	if s.opts.DNS01Validator != nil {
+		types = append(types, "dns-01")
+	}
+	if len(types) == 0 {
+		return nil, newProblem("rejectedIdentifier", http.StatusBadRequest, "no challenge is available for %q", id.Value)
+	}
+
+	for _, typ := range types {
+		token := make([]byte, 16)
+		rand.Read(token)
+		c := &challenge{
+			id:     s.newID(),
+			typ:    typ,
+			token:  base64.RawURLEncoding.EncodeToString(token),
+			status: statusPending,
+			authz:  a,
+		}
+		a.challenges = append(a.challenges, c)
+		s.challenges[c.id] = c
+	}
+
+	s.authzs[a.id] = a
+	return a, nil
+}
+
+func (s *Server) orderJSON(o *order) interface{} {
+	o.updateStatus()
+
+	authzs := make([]string, 0, len(o.authzs))
+	for _, a := range o.authzs {
+		authzs = append(authzs, s.url("/authz/"+a.id))
+	}
+	v := map[string]interface{}{
+		"status":         o.status,
+		"expires":        o.expires,
+		"identifiers":    o.identifiers,
+		"authorizations": authzs,
+		"finalize":       s.url("/finalize/" + o.id),
+	}
+	if o.certID != "" {
+		v["certificate"] = s.url("/cert/" + o.certID)
+	}
+	return v
+}
+
+// updateStatus updates the status of a pending order according to the
+// status of its authorizations.
+func (o *order) updateStatus() {
+	if o.status != statusPending {
+		return
+	}
+	ready := true
+	for _, a := range o.authzs {
+		switch a.status {
+		case statusValid:
+		case statusPending:
+			ready = false
+		default:
+			o.status = statusInvalid
+			return
+		}
+	}
+	if ready {
+		o.status = statusReady
+	}
+}
+
+func (s *Server) newOrder(req *request) (*response, *problem) {
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return nil, newProblem("malformed", http.StatusBadRequest, "invalid payload: %v", err)
+	}
+	if len(payload.Identifiers) == 0 {
+		return nil, newProblem("malformed", http.StatusBadRequest, "no identifier")
+	}
+
+	o := &order{
+		id:          s.newID(),
+		accountID:   req.account.id,
+		status:      statusPending,
+		expires:     time.Now().Add(time.Hour),
+		identifiers: payload.Identifiers,
+	}
+	for _, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			return nil, newProblem("unsupportedIdentifier", http.StatusBadRequest, "unsupported identifier type %q", id.Type)
+		}
+		a, p := s.newAuthz(req.account.id, id)
+		if p != nil {
+			return nil, p
+		}
+		o.authzs = append(o.authzs, a)
+	}
+	s.orders[o.id] = o
+
+	return &response{
+		status:   http.StatusCreated,
+		location: s.url("/order/" + o.id),
+		body:     s.orderJSON(o),
+	}, nil
+}
+
+func (s *Server) findOrder(req *request) (*order, *problem) {
+	o := s.orders[req.id]
+	if o == nil {
+		return nil, newProblem("malformed", http.StatusNotFound, "order %q does not exist", req.id)
+	}
+	if o.accountID != req.account.id {
+		return nil, newProblem("unauthorized", http.StatusUnauthorized, "account mismatch")
+	}
+	return o, nil
+}
+
+func (s *Server) getOrder(req *request) (*response, *problem) {
+	o, p := s.findOrder(req)
+	if p != nil {
+		return nil, p
+	}
+	return &response{
+		status:   http.StatusOK,
+		location: s.url("/order/" + o.id),
+		body:     s.orderJSON(o),
+	}, nil
+}
+
+func (s *Server) finalize(req *request) (*response, *problem) {
+	o, p := s.findOrder(req)
+	if p != nil {
+		return nil, p
+	}
+	if o.updateStatus(); o.status != statusReady {
+		return nil, newProblem("orderNotReady", http.StatusForbidden, "order is %s", o.status)
+	}
+
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		return nil, newProblem("malformed", http.StatusBadRequest, "invalid payload: %v", err)
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		return nil, newProblem("badCSR", http.StatusBadRequest, "invalid CSR: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		return nil, newProblem("badCSR", http.StatusBadRequest, "invalid CSR: %v", err)
+	}
+
+	names := append([]string(nil), csr.DNSNames...)
+	if csr.Subject.CommonName != "" && !stringtool.StrInSlice(csr.Subject.CommonName, names) {
+		names = append(names, csr.Subject.CommonName)
+	}
+	var expected []string
+	for _, id := range o.identifiers {
+		expected = append(expected, id.Value)
+	}
+	sort.Strings(names)
+	sort.Strings(expected)
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		return nil, newProblem("badCSR", http.StatusBadRequest, "CSR names %v do not match the order", names)
+	}
+
+	chain, err := s.issue(csr, expected)
+	if err != nil {
+		return nil, newProblem("serverInternal", http.StatusInternalServerError, "failed to issue certificate: %v", err)
+	}
+
+	o.status = statusValid
+	o.certID = s.newID()
+	s.certs[o.certID] = chain
+	s.issued++
+
+	return &response{
+		status:   http.StatusOK,
+		location: s.url("/order/" + o.id),
+		body:     s.orderJSON(o),
+	}, nil
+}
+
+// issue issues a certificate for the public key in csr, and returns the
+// PEM encoded certificate chain.
+func (s *Server) issue(csr *x509.CertificateRequest, names []string) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(s.opts.CertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.ca.Cert(), csr.PublicKey, s.ca.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, s.ca.CertPEM()...), nil
+}
+
+func (s *Server) certificate(req *request) (*response, *problem) {
+	chain := s.certs[req.id]
+	if chain == nil {
+		return nil, newProblem("malformed", http.StatusNotFound, "certificate %q does not exist", req.id)
+	}
+	return &response{
+		status:      http.StatusOK,
+		contentType: "application/pem-certificate-chain",
+		body:        chain,
+	}, nil
+}
+
+func (s *Server) authzJSON(a *authz) interface{} {
+	challenges := make([]interface{}, 0, len(a.challenges))
+	for _, c := range a.challenges {
+		challenges = append(challenges, s.challengeJSON(c))
+	}
+	return map[string]interface{}{
+		"status":     a.status,
+		"expires":    a.expires,
+		"identifier": a.identifier,
+		"wildcard":   a.wildcard,
+		"challenges": challenges,
+	}
+}
+
+func (s *Server) authorization(req *request) (*response, *problem) {
+	a := s.authzs[req.id]
+	if a == nil {
+		return nil, newProblem("malformed", http.StatusNotFound, "authorization %q does not exist", req.id)
+	}
+	if a.accountID != req.account.id {
+		return nil, newProblem("unauthorized", http.StatusUnauthorized, "account mismatch")
+	}
+
+	if len(req.payload) > 0 {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			return nil, newProblem("malformed", http.StatusBadRequest, "invalid payload: %v", err)
+		}
+		if payload.Status != statusDeactivated {
+			return nil, newProblem("malformed", http.StatusBadRequest, "invalid status %q", payload.Status)
+		}
+		if a.status == statusPending || a.status == statusValid {
+			a.status = statusDeactivated
+		}
+	}
+
+	return &response{status: http.StatusOK, body: s.authzJSON(a)}, nil
+}
+
+func (s *Server) challengeJSON(c *challenge) interface{} {
+	v := map[string]interface{}{
+		"type":   c.typ,
+		"url":    s.url("/chall/" + c.id),
+		"token":  c.token,
+		"status": c.status,
+	}
+	if !c.validated.IsZero() {
+		v["validated"] = c.validated
+	}
+	if c.err != nil {
+		v["error"] = c.err
+	}
+	return v
+}
+
+// challenge handles a challenge request, the validation is performed
+// before responding, with s.mu released.
+func (s *Server) challenge(req *request) (*response, *problem) {
+	c := s.challenges[req.id]
+	if c == nil {
+		return nil, newProblem("malformed", http.StatusNotFound, "challenge %q does not exist", req.id)
+	}
+	a := c.authz
+	if a.accountID != req.account.id {
+		return nil, newProblem("unauthorized", http.StatusUnauthorized, "account mismatch")
+	}
+
+	// an empty payload is a POST-as-GET request.
+	if len(req.payload) == 0 || c.status != statusPending || a.status != statusPending {
+		return &response{status: http.StatusOK, body: s.challengeJSON(c)}, nil
+	}
+
+	c.status = statusProcessing
+	keyAuth := c.token + "." + req.account.thumbprint
+	domain := a.identifier.Value
+
+	s.mu.Unlock()
+	err := s.validate(c.typ, domain, c.token, keyAuth)
+	s.mu.Lock()
+
+	if err != nil {
+		c.status = statusInvalid
+		c.err = newProblem("unauthorized", http.StatusForbidden, "%v", err)
+		if a.status == statusPending {
+			a.status = statusInvalid
+		}
+	} else {
+		c.status = statusValid
+		c.validated = time.Now()
+		if a.status == statusPending {
+			a.status = statusValid
+		}
+	}
+
+	return &response{status: http.StatusOK, body: s.challengeJSON(c)}, nil
+}
+
+func (s *Server) validate(typ, domain, token, keyAuth string) error {
+	switch typ {
+	case "http-01":
+		return s.validateHTTP01(domain, token, keyAuth)
+	case "tls-alpn-01":
+		return s.validateTLSALPN01(domain, keyAuth)
+	case "dns-01":
+		digest := sha256.Sum256([]byte(keyAuth))
+		return s.opts.DNS01Validator(domain, base64.RawURLEncoding.EncodeToString(digest[:]))
+	}
+	return fmt.Errorf("unknown challenge type %q", typ)
+}
+
+func (s *Server) validateHTTP01(domain, token, keyAuth string) error {
+	url := "http://" + s.opts.HTTP01Address + "/.well-known/acme-challenge/" + token
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = domain
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP-01 validation of %s got status code %d", domain, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(body)) != keyAuth {
+		return fmt.Errorf("HTTP-01 validation of %s got wrong key authorization", domain)
+	}
+	return nil
+}
+
+func (s *Server) validateTLSALPN01(domain, keyAuth string) error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", s.opts.TLSALPN01Address, &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{acme.ALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acme.ALPNProto {
+		return fmt.Errorf("TLS-ALPN-01 validation of %s negotiated protocol %q", domain, state.NegotiatedProtocol)
+	}
+	leaf := state.PeerCertificates[0]
+	if err = leaf.VerifyHostname(domain); err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(keyAuth))
+	for _, ext := range leaf.Extensions {
+		if !ext.Id.Equal(idPeACMEIdentifier) {
+			continue
+		}
+		var value []byte
+		if _, err = asn1.Unmarshal(ext.Value, &value); err != nil {
+			return err
+		}
+		if !ext.Critical || !bytes.Equal(value, digest[:]) {
+			return fmt.Errorf("TLS-ALPN-01 validation of %s got wrong acmeIdentifier", domain)
+		}
+		return nil
+	}
+	return fmt.Errorf("TLS-ALPN-01 validation of %s found no acmeIdentifier", domain)
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package acmetest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme"
+)
+
+type challengeServer struct {
+	mu         sync.Mutex
+	httpTokens map[string]string
+	txtRecords map[string]string
+	alpnCert   *tls.Certificate
+}
+
+func (cs *challengeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if v, ok := cs.httpTokens[r.URL.Path]; ok {
+		w.Write([]byte(v))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (cs *challengeServer) validateDNS01(domain, value string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.txtRecords[domain] != value {
+		return fmt.Errorf("TXT record mismatch")
+	}
+	return nil
+}
+
+func (cs *challengeServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.alpnCert, nil
+}
+
+func newChallengeServer(t *testing.T) (*challengeServer, string, string) {
+	cs := &challengeServer{
+		httpTokens: map[string]string{},
+		txtRecords: map[string]string{},
+	}
+
+	hs := httptest.NewServer(cs)
+	t.Cleanup(hs.Close)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		NextProtos:     []string{acme.ALPNProto},
+		GetCertificate: cs.getCertificate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}(conn)
+		}
+	}()
+
+	return cs, hs.Listener.Addr().String(), ln.Addr().String()
+}
+
+func (cs *challengeServer) fulfill(client *acme.Client, z *acme.Authorization, chal *acme.Challenge) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	switch chal.Type {
+	case "http-01":
+		resp, _ := client.HTTP01ChallengeResponse(chal.Token)
+		cs.httpTokens[client.HTTP01ChallengePath(chal.Token)] = resp
+	case "tls-alpn-01":
+		cert, _ := client.TLSALPN01ChallengeCert(chal.Token, z.Identifier.Value)
+		cs.alpnCert = &cert
+	case "dns-01":
+		cs.txtRecords[z.Identifier.Value], _ = client.DNS01ChallengeRecord(chal.Token)
+	}
+}
+
+func issue(ctx context.Context, client *acme.Client, cs *challengeServer, domain string) ([][]byte, error) {
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		chal := z.Challenges[0]
+
+		// leave the challenge unfulfilled if cs is nil.
+		if cs != nil {
+			cs.fulfill(client, z, chal)
+		}
+		if _, err = client.Accept(ctx, chal); err != nil {
+			return nil, err
+		}
+		if _, err = client.WaitAuthorization(ctx, z.URI); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, key)
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	return der, err
+}
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		opts func(cs *challengeServer, httpAddr, alpnAddr string) *Options
+	}{
+		{"http-01", func(cs *challengeServer, httpAddr, alpnAddr string) *Options {
+			return &Options{HTTP01Address: httpAddr}
+		}},
+		{"tls-alpn-01", func(cs *challengeServer, httpAddr, alpnAddr string) *Options {
+			return &Options{TLSALPN01Address: alpnAddr}
+		}},
+		{"dns-01", func(cs *challengeServer, httpAddr, alpnAddr string) *Options {
+			return &Options{DNS01Validator: cs.validateDNS01}
+		}},
+	}
+
+	for _, tc := range tests {
+		cs, httpAddr, alpnAddr := newChallengeServer(t)
+		opts := tc.opts(cs, httpAddr, alpnAddr)
+		opts.CertLifetime = time.Hour
+		s := NewServer(opts)
+
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		client := &acme.Client{Key: key, DirectoryURL: s.DirectoryURL(), HTTPClient: s.Client()}
+		_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+		assert.NoError(err, tc.name)
+
+		der, err := issue(ctx, client, cs, "www.example.com")
+		assert.NoError(err, tc.name)
+		assert.Len(der, 2, tc.name)
+
+		leaf, err := x509.ParseCertificate(der[0])
+		assert.NoError(err)
+		assert.NoError(leaf.CheckSignatureFrom(s.IssuerCert()))
+		assert.NoError(leaf.VerifyHostname("www.example.com"))
+		assert.WithinDuration(time.Now().Add(time.Hour), leaf.NotAfter, time.Minute)
+		assert.Equal(1, s.Issued())
+
+		// the challenge is not fulfilled for this domain.
+		_, err = issue(ctx, client, nil, "api.example.com")
+		assert.Error(err, tc.name)
+		assert.Equal(1, s.Issued())
+
+		s.Close()
+	}
+}
+
+func TestEAB(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	s := NewServer(&Options{
+		EAB:            map[string][]byte{"kid-1": []byte("secret-1")},
+		DNS01Validator: func(domain, value string) error { return nil },
+	})
+	defer s.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	client := &acme.Client{Key: key, DirectoryURL: s.DirectoryURL(), HTTPClient: s.Client()}
+
+	// external account binding is required.
+	_, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS)
+	assert.Error(err)
+
+	// wrong HMAC key.
+	acct := &acme.Account{ExternalAccountBinding: &acme.ExternalAccountBinding{KID: "kid-1", Key: []byte("wrong")}}
+	_, err = client.Register(ctx, acct, acme.AcceptTOS)
+	assert.Error(err)
+
+	acct.ExternalAccountBinding.Key = []byte("secret-1")
+	_, err = client.Register(ctx, acct, acme.AcceptTOS)
+	assert.NoError(err)
+	assert.Equal(1, s.Accounts())
+
+	// the same account key is accepted as an existing account.
+	_, err = client.Register(ctx, acct, acme.AcceptTOS)
+	assert.Equal(acme.ErrAccountAlreadyExists, err)
+
+	// but the EAB key can only be used once.
+	key2, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client2 := &acme.Client{Key: key2, DirectoryURL: s.DirectoryURL(), HTTPClient: s.Client()}
+	_, err = client2.Register(ctx, acct, acme.AcceptTOS)
+	assert.Error(err)
+	assert.Equal(1, s.Accounts())
+
+	// unregistered accounts are rejected.
+	_, err = client2.AuthorizeOrder(ctx, acme.DomainIDs("www.example.com"))
+	assert.Error(err)
+
+	// wildcard domains are validated with DNS-01.
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs("*.example.com"))
+	assert.NoError(err)
+	z, err := client.GetAuthorization(ctx, order.AuthzURLs[0])
+	assert.NoError(err)
+	assert.Equal("example.com", z.Identifier.Value)
+	assert.True(z.Wildcard)
+	assert.Len(z.Challenges, 1)
+	assert.Equal("dns-01", z.Challenges[0].Type)
+}
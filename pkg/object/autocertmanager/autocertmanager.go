@@ -20,19 +20,22 @@ package autocertmanager
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/megaease/easegress/pkg/api"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/tlsutil"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/net/idna"
 )
@@ -44,6 +47,17 @@ const (
 
 	// Kind is the kind of AutoCertManager.
 	Kind = "AutoCertManager"
+
+	keyTypeECDSA256 = "ecdsa256"
+	keyTypeECDSA384 = "ecdsa384"
+	keyTypeRSA2048  = "rsa2048"
+	keyTypeRSA4096  = "rsa4096"
+
+	eventTypeIssue = "issue"
+	eventTypeRenew = "renew"
+
+	// maxEvents is the maximum number of events kept in the status.
+	maxEvents = 32
 )
 
 var aliases = []string{
@@ -75,6 +89,9 @@ type (
 
 		renewBefore time.Duration
 		domains     []Domain
+
+		eventsLock sync.Mutex
+		events     []*Event
 	}
 
 	// Spec describes AutoCertManager.
@@ -85,13 +102,26 @@ type (
 		EnableHTTP01    bool         `json:"enableHTTP01"`
 		EnableTLSALPN01 bool         `json:"enableTLSALPN01"`
 		EnableDNS01     bool         `json:"enableDNS01"`
+		EAB             *EABSpec     `json:"eab,omitempty" jsonschema:"omitempty"`
+		KeyType         string       `json:"keyType,omitempty" jsonschema:"omitempty,enum=,enum=ecdsa256,enum=ecdsa384,enum=rsa2048,enum=rsa4096"`
+		CACerts         []string     `json:"caCerts,omitempty" jsonschema:"omitempty"`
 		Domains         []DomainSpec `json:"domains" jsonschema:"required"`
 	}
 
+	// EABSpec is the External Account Binding spec, which is required by
+	// CAs like ZeroSSL and Google Trust Services to bind the ACME account
+	// to an account of the CA.
+	EABSpec struct {
+		KeyID string `json:"keyID" jsonschema:"required"`
+		// HMACKey is the base64url encoded HMAC key.
+		HMACKey string `json:"hmacKey" jsonschema:"required"`
+	}
+
 	// DomainSpec is the automated certificate management spec for a domain.
 	DomainSpec struct {
 		Name        string            `json:"name" jsonschema:"required"`
 		DNSProvider map[string]string `json:"dnsProvider" jsonschema:"omitempty"`
+		KeyType     string            `json:"keyType,omitempty" jsonschema:"omitempty,enum=,enum=ecdsa256,enum=ecdsa384,enum=rsa2048,enum=rsa4096"`
 	}
 
 	// CertificateStatus is the certificate status of a domain.
@@ -100,9 +130,21 @@ type (
 		ExpireTime time.Time `json:"expireTime"`
 	}
 
+	// Event is an issuance or renewal event of a certificate, ExpireTime
+	// is the expire time of the new certificate if it succeeded.
+	Event struct {
+		Time       time.Time `json:"time"`
+		Domain     string    `json:"domain"`
+		Type       string    `json:"type"`
+		KeyType    string    `json:"keyType"`
+		ExpireTime time.Time `json:"expireTime"`
+		Error      string    `json:"error,omitempty"`
+	}
+
 	// Status is the status of AutoCertManager.
 	Status struct {
 		Domains []CertificateStatus `json:"domains"`
+		Events  []*Event            `json:"events,omitempty"`
 	}
 )
 
@@ -140,9 +182,53 @@ func (spec *Spec) Validate() error {
 			return fmt.Errorf("DNS provider configuration is invalid: %v", err)
 		}
 	}
+
+	if spec.EAB != nil {
+		if _, err := spec.EAB.hmacKey(); err != nil {
+			return fmt.Errorf("invalid EAB HMAC key: %v", err)
+		}
+	}
+
+	if _, err := spec.certPool(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// hmacKey decodes the HMAC key, CAs provide it in base64url encoding, but
+// we also accept it with paddings.
+func (spec *EABSpec) hmacKey() ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(spec.HMACKey, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	return key, nil
+}
+
+// certPool returns the certificate pool to verify the ACME server, which
+// contains the system roots and the CA certificates in the spec. It
+// returns nil if no CA certificate is configured.
+func (spec *Spec) certPool() (*x509.CertPool, error) {
+	if len(spec.CACerts) == 0 {
+		return nil, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for i, c := range spec.CACerts {
+		if !pool.AppendCertsFromPEM(tlsutil.DecodePEM(c)) {
+			return nil, fmt.Errorf("caCerts[%d] contains no valid certificate", i)
+		}
+	}
+	return pool, nil
+}
+
 // Zone returns the zone the domain belongs to.
 func (spec *DomainSpec) Zone() string {
 	if spec.DNSProvider != nil {
@@ -192,8 +278,11 @@ func (acm *AutoCertManager) Inherit(superSpec *supervisor.Spec, previousGenerati
 	acm.spec = superSpec.ObjectSpec().(*Spec)
 	acm.super = superSpec.Super()
 
+	prev := previousGeneration.(*AutoCertManager)
+	acm.events = prev.eventsSnapshot()
+
 	acm.reload()
-	previousGeneration.(*AutoCertManager).Close()
+	prev.Close()
 }
 
 func (acm *AutoCertManager) findDomain(name string, exactMatch bool) *Domain {
@@ -258,9 +347,48 @@ func (acm *AutoCertManager) Status() *supervisor.Status {
 			ExpireTime: d.certExpireTime(),
 		})
 	}
+	status.Events = acm.eventsSnapshot()
 	return &supervisor.Status{ObjectStatus: status}
 }
 
+func (acm *AutoCertManager) eventsSnapshot() []*Event {
+	acm.eventsLock.Lock()
+	defer acm.eventsLock.Unlock()
+	return append([]*Event(nil), acm.events...)
+}
+
+func (acm *AutoCertManager) addEvent(d *Domain, typ string, err error) {
+	e := &Event{
+		Time:    time.Now(),
+		Domain:  d.Name,
+		Type:    typ,
+		KeyType: acm.keyType(d),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.ExpireTime = d.certExpireTime()
+	}
+
+	acm.eventsLock.Lock()
+	defer acm.eventsLock.Unlock()
+	if len(acm.events) >= maxEvents {
+		acm.events = append(acm.events[:0:0], acm.events[len(acm.events)-maxEvents+1:]...)
+	}
+	acm.events = append(acm.events, e)
+}
+
+// keyType returns the key type of the certificate of a domain.
+func (acm *AutoCertManager) keyType(d *Domain) string {
+	if d.KeyType != "" {
+		return d.KeyType
+	}
+	if acm.spec.KeyType != "" {
+		return acm.spec.KeyType
+	}
+	return keyTypeECDSA256
+}
+
 // Close closes AutoCertManager.
 func (acm *AutoCertManager) Close() {
 	acm.cancel()
@@ -284,32 +412,65 @@ func (acm *AutoCertManager) renew() bool {
 		}
 
 		d := &acm.domains[i]
-		if d.certExpireTime().After(deadline) {
+		// the certificate also needs to be renewed if the key type is
+		// changed.
+		if d.certExpireTime().After(deadline) && d.certKeyType() == acm.keyType(d) {
 			continue
 		}
 
+		typ := eventTypeRenew
+		if d.cert() == nil {
+			typ = eventTypeIssue
+		}
+
 		logger.Infof("begin renew certificate for domain %s", d.Name)
-		if err := d.renewCert(acm); err == nil {
+		err := d.renewCert(acm)
+		if err == nil {
 			logger.Infof("certificate for domain %s has been renewed", d.Name)
 		} else {
 			logger.Errorf("failed to renew certificate for domain %s: %v", d.Name, err)
 			allSucc = false
 		}
+		acm.addEvent(d, typ, err)
 	}
 
 	return allSucc
 }
 
+// accountID returns the ID of the ACME account, which identifies the
+// account key in the storage.
+func (acm *AutoCertManager) accountID() string {
+	sum := sha256.Sum256([]byte(acm.spec.DirectoryURL + "\n" + acm.spec.Email))
+	return hex.EncodeToString(sum[:16])
+}
+
 func (acm *AutoCertManager) createAcmeClient() error {
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// the account key is shared by all members and generations, because
+	// some CAs only allow to use an EAB key once.
+	key, err := acm.storage.getAccountKey(acm.accountID())
 	if err != nil {
-		logger.Errorf("failed to generate new account: %v", err)
+		logger.Errorf("failed to get account key: %v", err)
 		return err
 	}
 
 	cl := &acme.Client{Key: key, DirectoryURL: acm.spec.DirectoryURL}
+	if pool, _ := acm.spec.certPool(); pool != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		cl.HTTPClient = &http.Client{Transport: transport}
+	}
+
 	acct := &acme.Account{Contact: []string{"mailto:" + acm.spec.Email}}
-	if _, err := cl.Register(acm.stopCtx, acct, acme.AcceptTOS); err != nil {
+	if acm.spec.EAB != nil {
+		hmacKey, _ := acm.spec.EAB.hmacKey()
+		acct.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: acm.spec.EAB.KeyID,
+			Key: hmacKey,
+		}
+	}
+
+	_, err = cl.Register(acm.stopCtx, acct, acme.AcceptTOS)
+	if err != nil && err != acme.ErrAccountAlreadyExists {
 		logger.Errorf("failed to register: %v", err)
 		return err
 	}
@@ -44,9 +44,11 @@ import (
 	"github.com/libdns/libdns"
 	cluster "github.com/megaease/easegress/pkg/cluster"
 	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/autocertmanager/acmetest"
 	"github.com/megaease/easegress/pkg/option"
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
 	"golang.org/x/crypto/acme"
 )
 
@@ -808,7 +810,7 @@ func TestCertificateHelpers(t *testing.T) {
 	}
 
 	id := acme.AuthzID{Value: "dnsName"}
-	csr, certkey, err := newCSR(id)
+	csr, certkey, err := newCSR(id, keyTypeECDSA256)
 	if err != nil {
 		t.Errorf("newCSR failed %v", err)
 	}
@@ -913,3 +915,133 @@ func TestDomain(t *testing.T) {
 		}
 	})
 }
+
+func TestAutoCertManagerWithACMETestServer(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(HandleHTTP01Challenge))
+	defer hs.Close()
+
+	s := acmetest.NewServer(&acmetest.Options{
+		EAB:           map[string][]byte{"kid-1": []byte("secret-1")},
+		CertLifetime:  24 * time.Hour,
+		HTTP01Address: hs.Listener.Addr().String(),
+	})
+	defer s.Close()
+
+	yamlConfig := fmt.Sprintf(`
+name: autocert
+kind: AutoCertManager
+email: someone@megaease.com
+renewBefore: 720h
+enableHTTP01: true
+enableTLSALPN01: false
+enableDNS01: false
+keyType: rsa2048
+eab:
+  keyID: kid-1
+  hmacKey: %s
+caCerts:
+  - %s
+domains:
+  - name: www.example.com
+  - name: api.example.com
+    keyType: ecdsa384
+directoryURL: %s
+`, base64.RawURLEncoding.EncodeToString([]byte("secret-1")), tlsutiltest.Base64(s.ServerCertPEM()), s.DirectoryURL())
+
+	etcdDirName, err := os.MkdirTemp("", "autocertmanager-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(etcdDirName)
+
+	cls := cluster.CreateClusterForTest(etcdDirName)
+	supervisor.MustNew(&option.Options{}, cls)
+	spec, err := supervisor.NewSpec(yamlConfig)
+	if err != nil {
+		t.Fatalf("spec creation should have succeeded: %v", err)
+	}
+
+	waitEvents := func(acm *AutoCertManager, n int) []*Event {
+		for i := 0; i < 300; i++ {
+			if events := acm.eventsSnapshot(); len(events) >= n {
+				return events
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("timeout waiting for %d events", n)
+		return nil
+	}
+	checkEvents := func(events []*Event, typ string) {
+		for _, e := range events {
+			if e.Type != typ || e.Error != "" || e.ExpireTime.IsZero() {
+				t.Errorf("unexpected event: %+v", e)
+			}
+		}
+	}
+
+	acm := &AutoCertManager{}
+	acm.Init(spec)
+
+	// certificates are issued with the configured key types.
+	checkEvents(waitEvents(acm, 2), eventTypeIssue)
+	if key, ok := acm.domains[0].cert().PrivateKey.(*rsa.PrivateKey); !ok || key.N.BitLen() != 2048 {
+		t.Errorf("certificate of www.example.com should use a RSA 2048 key")
+	}
+	if key, ok := acm.domains[1].cert().PrivateKey.(*ecdsa.PrivateKey); !ok || key.Curve != elliptic.P384() {
+		t.Errorf("certificate of api.example.com should use an ECDSA P-384 key")
+	}
+	if err = acm.domains[0].cert().Leaf.CheckSignatureFrom(s.IssuerCert()); err != nil {
+		t.Errorf("certificate should be issued by the ACME server: %v", err)
+	}
+	if s.Issued() != 2 || s.Accounts() != 1 {
+		t.Errorf("unexpected server state: issued %d, accounts %d", s.Issued(), s.Accounts())
+	}
+
+	// the certificates expire within renewBefore, so they are renewed.
+	acm.renew()
+	events := acm.Status().ObjectStatus.(*Status).Events
+	if len(events) != 4 {
+		t.Fatalf("expect 4 events, got %d", len(events))
+	}
+	checkEvents(events[2:], eventTypeRenew)
+
+	// a new generation inherits the events, and reuses the account whose
+	// EAB key can only be used once.
+	acm2 := &AutoCertManager{}
+	acm2.Inherit(spec, acm)
+	checkEvents(waitEvents(acm2, 6)[4:], eventTypeRenew)
+	if s.Issued() != 6 || s.Accounts() != 1 {
+		t.Errorf("unexpected server state: issued %d, accounts %d", s.Issued(), s.Accounts())
+	}
+	acm2.Close()
+
+	closeWG := &sync.WaitGroup{}
+	closeWG.Add(1)
+	cls.CloseServer(closeWG)
+	closeWG.Wait()
+}
+
+func TestEABAndCACertsValidate(t *testing.T) {
+	spec := &Spec{
+		EnableHTTP01: true,
+		EAB:          &EABSpec{KeyID: "kid", HMACKey: "not base64url!"},
+	}
+	if err := spec.Validate(); err == nil {
+		t.Errorf("validation should fail for invalid HMAC key")
+	}
+
+	spec.EAB.HMACKey = base64.URLEncoding.EncodeToString([]byte("secret"))
+	if err := spec.Validate(); err != nil {
+		t.Errorf("validation should succeed: %v", err)
+	}
+
+	spec.CACerts = []string{"invalid certificate"}
+	if err := spec.Validate(); err == nil {
+		t.Errorf("validation should fail for invalid CA certificate")
+	}
+
+	spec.CACerts = []string{string(tlsutiltest.NewCA("test").CertPEM())}
+	if err := spec.Validate(); err != nil {
+		t.Errorf("validation should succeed: %v", err)
+	}
+}
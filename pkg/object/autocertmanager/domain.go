@@ -23,6 +23,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -65,6 +66,21 @@ func (d *Domain) certExpireTime() time.Time {
 	return cert.Leaf.NotAfter
 }
 
+// certKeyType returns the key type of the certificate of the domain.
+func (d *Domain) certKeyType() string {
+	cert := d.cert()
+	if cert == nil {
+		return ""
+	}
+	switch pub := cert.Leaf.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ecdsa%d", pub.Curve.Params().BitSize)
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", pub.N.BitLen())
+	}
+	return ""
+}
+
 func (d *Domain) updateCert(cert *tls.Certificate) {
 	for {
 		oldCert := d.cert()
@@ -224,11 +240,24 @@ func (d *Domain) runDNS01(acm *AutoCertManager, chal *acme.Challenge) error {
 	return err
 }
 
-func newCSR(id acme.AuthzID) ([]byte, crypto.Signer, error) {
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case keyTypeECDSA384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case keyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case keyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+}
+
+func newCSR(id acme.AuthzID, keyType string) ([]byte, crypto.Signer, error) {
 	var csr x509.CertificateRequest
 
 	csr.DNSNames = append(csr.DNSNames, id.Value)
-	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	k, err := generateKey(keyType)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -326,7 +355,7 @@ func (d *Domain) renewCert(acm *AutoCertManager) error {
 		return err
 	}
 
-	csr, certkey, err := newCSR(ids[0])
+	csr, certkey, err := newCSR(ids[0], acm.keyType(d))
 	if err != nil {
 		logger.Errorf("newCSR(%q): %v", ids[0], err)
 		return err
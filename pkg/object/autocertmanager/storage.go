@@ -22,6 +22,8 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
@@ -33,6 +35,7 @@ import (
 	"github.com/megaease/easegress/pkg/cluster"
 	"github.com/megaease/easegress/pkg/logger"
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3/concurrency"
 )
 
 const (
@@ -40,6 +43,7 @@ const (
 	autoCertManagerCert        = "autocert/cert/%s"
 	autoCertManagerHTTPToken   = "autocert/http/%s/%s"
 	autoCertManagerTLSALPNCert = "autocert/tlsalpn/%s"
+	autoCertManagerAccountKey  = "autocert/account/%s"
 )
 
 type storage struct {
@@ -58,6 +62,10 @@ func domainTLSALPNCert(name string) string {
 	return fmt.Sprintf(autoCertManagerTLSALPNCert, name)
 }
 
+func accountKey(id string) string {
+	return fmt.Sprintf(autoCertManagerAccountKey, id)
+}
+
 func encodeCertificate(cert *tls.Certificate) ([]byte, error) {
 	// contains PEM-encoded data
 	var buf bytes.Buffer
@@ -241,6 +249,39 @@ func (s *storage) putCert(domain string, cert *tls.Certificate) error {
 	return s.cls.Put(key, string(value))
 }
 
+// getAccountKey returns the ACME account key of id, the key is created if
+// it does not exist.
+func (s *storage) getAccountKey(id string) (crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	newValue := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	var value string
+	err = s.cls.STM(func(stm concurrency.STM) error {
+		value = stm.Get(accountKey(id))
+		if value == "" {
+			value = string(newValue)
+			stm.Put(accountKey(id), value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		return nil, fmt.Errorf("invalid account key")
+	}
+	return parsePrivateKey(block.Bytes)
+}
+
 func (s *storage) getHTTPToken(domain, path string) ([]byte, error) {
 	key := domainHTTPToken(domain, path)
 	kv, err := s.cls.GetRaw(key)
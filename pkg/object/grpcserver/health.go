@@ -0,0 +1,104 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcserver
+
+import (
+	stdcontext "context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const healthWatchInterval = 5 * time.Second
+
+// healthServer implements grpc.health.v1.Health, the health of a service
+// is aggregated from the health of the backends which the service could be
+// routed to.
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+
+	mux *mux
+	// local are the services served by the gRPC server itself, which
+	// are always serving.
+	local    map[string]bool
+	interval time.Duration
+	done     chan struct{}
+}
+
+func newHealthServer(m *mux) *healthServer {
+	return &healthServer{
+		mux:      m,
+		local:    map[string]bool{},
+		interval: healthWatchInterval,
+		done:     make(chan struct{}),
+	}
+}
+
+func (hs *healthServer) serviceHealth(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	if hs.local[service] {
+		return healthpb.HealthCheckResponse_SERVING, true
+	}
+	return hs.mux.inst.Load().(*muxInstance).serviceHealth(service)
+}
+
+// Check implements healthpb.HealthServer.
+func (hs *healthServer) Check(ctx stdcontext.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	s, ok := hs.serviceHealth(req.Service)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+	return &healthpb.HealthCheckResponse{Status: s}, nil
+}
+
+// Watch implements healthpb.HealthServer, it checks the health
+// periodically and sends the status to the client when it changes.
+func (hs *healthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ticker := time.NewTicker(hs.interval)
+	defer ticker.Stop()
+
+	last := healthpb.HealthCheckResponse_ServingStatus(-1)
+	for {
+		s, ok := hs.serviceHealth(req.Service)
+		if !ok {
+			s = healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+		}
+		if s != last {
+			if err := stream.Send(&healthpb.HealthCheckResponse{Status: s}); err != nil {
+				return err
+			}
+			last = s
+		}
+
+		select {
+		case <-ticker.C:
+		case <-hs.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// shutdown stops all the watches, it must be called before the gRPC server
+// is stopped gracefully, otherwise, the server waits for the watches
+// forever.
+func (hs *healthServer) shutdown() {
+	close(hs.done)
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcserver
+
+import (
+	stdcontext "context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/megaease/easegress/pkg/protocols/grpcprot/grpcstat"
+	"github.com/megaease/easegress/pkg/util/prometheushelper"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// unknownMethod is the method name in the statistics of requests which are
+// not routed, to avoid too many methods from malicious clients.
+const unknownMethod = "unknown"
+
+type (
+	metrics struct {
+		Health            *prometheus.GaugeVec
+		TotalRequests     *prometheus.CounterVec
+		RequestsDuration  prometheus.ObserverVec
+		RequestSizeBytes  prometheus.ObserverVec
+		ResponseSizeBytes prometheus.ObserverVec
+	}
+
+	// statsHandler implements stats.Handler to collect the statistics of
+	// all RPCs.
+	statsHandler struct {
+		r *runtime
+		// local are the services served by the gRPC server itself.
+		local map[string]bool
+	}
+
+	rpcStatsKey struct{}
+
+	// rpcStats is the statistics of an RPC.
+	rpcStats struct {
+		method   string
+		routed   int32
+		reqSize  uint64
+		respSize uint64
+	}
+)
+
+// newMetrics creates the metrics of GRPCServer.
+func (r *runtime) newMetrics(name string) *metrics {
+	commonLabels := prometheus.Labels{
+		"grpcServerName": name,
+		"kind":           Kind,
+		"clusterName":    "",
+		"clusterRole":    "",
+		"instanceName":   "",
+	}
+	if super := r.superSpec.Super(); super != nil {
+		commonLabels["clusterName"] = super.Options().ClusterName
+		commonLabels["clusterRole"] = super.Options().ClusterRole
+		commonLabels["instanceName"] = super.Options().Name
+	}
+	grpcserverLabels := []string{"clusterName", "clusterRole",
+		"instanceName", "grpcServerName", "kind", "method", "code"}
+
+	return &metrics{
+		Health: prometheushelper.NewGauge(
+			"grpcserver_health",
+			"show the status for the gRPC server: 1 for ready, 0 for down",
+			grpcserverLabels[:5]).MustCurryWith(commonLabels),
+		TotalRequests: prometheushelper.NewCounter(
+			"grpcserver_total_requests",
+			"the total count of gRPC requests",
+			grpcserverLabels).MustCurryWith(commonLabels),
+		RequestsDuration: prometheushelper.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "grpcserver_requests_duration",
+				Help:    "request processing duration histogram of a method",
+				Buckets: prometheushelper.DefaultDurationBuckets(),
+			},
+			grpcserverLabels[:6]).MustCurryWith(commonLabels),
+		RequestSizeBytes: prometheushelper.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "grpcserver_requests_size_bytes",
+				Help:    "a histogram of the total size of the request messages of a method",
+				Buckets: prometheushelper.DefaultBodySizeBuckets(),
+			},
+			grpcserverLabels[:6]).MustCurryWith(commonLabels),
+		ResponseSizeBytes: prometheushelper.NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "grpcserver_responses_size_bytes",
+				Help:    "a histogram of the total size of the response messages of a method",
+				Buckets: prometheushelper.DefaultBodySizeBuckets(),
+			},
+			grpcserverLabels[:6]).MustCurryWith(commonLabels),
+	}
+}
+
+func (r *runtime) exportState(state stateType) {
+	if state == stateRunning {
+		r.metrics.Health.WithLabelValues().Set(1)
+	} else {
+		r.metrics.Health.WithLabelValues().Set(0)
+	}
+}
+
+func (r *runtime) exportPrometheusMetrics(method string, m *grpcstat.Metric) {
+	labels := prometheus.Labels{"method": method}
+	r.metrics.RequestsDuration.With(labels).Observe(float64(m.Duration.Milliseconds()))
+	r.metrics.RequestSizeBytes.With(labels).Observe(float64(m.ReqSize))
+	r.metrics.ResponseSizeBytes.With(labels).Observe(float64(m.RespSize))
+	labels["code"] = m.Code.String()
+	r.metrics.TotalRequests.With(labels).Inc()
+}
+
+// markRouted marks the RPC of the context is routed to a backend.
+func markRouted(ctx stdcontext.Context) {
+	if rs, ok := ctx.Value(rpcStatsKey{}).(*rpcStats); ok {
+		atomic.StoreInt32(&rs.routed, 1)
+	}
+}
+
+// TagRPC implements stats.Handler.
+func (sh *statsHandler) TagRPC(ctx stdcontext.Context, info *stats.RPCTagInfo) stdcontext.Context {
+	return stdcontext.WithValue(ctx, rpcStatsKey{}, &rpcStats{method: info.FullMethodName})
+}
+
+// HandleRPC implements stats.Handler.
+func (sh *statsHandler) HandleRPC(ctx stdcontext.Context, s stats.RPCStats) {
+	rs, ok := ctx.Value(rpcStatsKey{}).(*rpcStats)
+	if !ok {
+		return
+	}
+
+	switch s := s.(type) {
+	case *stats.InPayload:
+		atomic.AddUint64(&rs.reqSize, uint64(s.WireLength))
+	case *stats.OutPayload:
+		atomic.AddUint64(&rs.respSize, uint64(s.WireLength))
+	case *stats.End:
+		method := rs.method
+		if atomic.LoadInt32(&rs.routed) == 0 && !sh.isLocal(method) {
+			method = unknownMethod
+		}
+		m := &grpcstat.Metric{
+			Code:     status.Code(s.Error),
+			Duration: s.EndTime.Sub(s.BeginTime),
+			ReqSize:  atomic.LoadUint64(&rs.reqSize),
+			RespSize: atomic.LoadUint64(&rs.respSize),
+		}
+		sh.r.grpcStat.Stat(m)
+		sh.r.topN.Stat(method).Stat(m)
+		sh.r.exportPrometheusMetrics(method, m)
+	}
+}
+
+// isLocal returns whether the method is served by the gRPC server itself.
+func (sh *statsHandler) isLocal(method string) bool {
+	// method is in format of "/service/method".
+	i := strings.LastIndexByte(method, '/')
+	return i > 0 && sh.local[method[1:i]]
+}
+
+// TagConn implements stats.Handler.
+func (sh *statsHandler) TagConn(ctx stdcontext.Context, info *stats.ConnTagInfo) stdcontext.Context {
+	return ctx
+}
+
+// HandleConn implements stats.Handler.
+func (sh *statsHandler) HandleConn(ctx stdcontext.Context, s stats.ConnStats) {
+}
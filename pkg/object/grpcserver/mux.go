@@ -25,6 +25,7 @@ import (
 	"github.com/megaease/easegress/pkg/util/fasttime"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 
 	"regexp"
@@ -194,6 +195,30 @@ func (mm *MuxMethod) matchMethod(method string) bool {
 	return false
 }
 
+// matchService returns whether the method could match methods of the
+// service, prefix is the method prefix of the service, i.e. "/pkg.Service/".
+func (mm *MuxMethod) matchService(prefix string) bool {
+	if mm.method == "" && mm.methodPrefix == "" && mm.methodRE == nil {
+		return true
+	}
+
+	if mm.method != "" && strings.HasPrefix(mm.method, prefix) {
+		return true
+	}
+	if mm.methodPrefix != "" && (strings.HasPrefix(prefix, mm.methodPrefix) || strings.HasPrefix(mm.methodPrefix, prefix)) {
+		return true
+	}
+	if mm.methodRE != nil {
+		if mm.methodRE.MatchString(prefix) {
+			return true
+		}
+		literal, _ := mm.methodRE.LiteralPrefix()
+		return literal != "" && (strings.HasPrefix(prefix, literal) || strings.HasPrefix(literal, prefix))
+	}
+
+	return false
+}
+
 func matchHeader(header string, h *Header) bool {
 	if stringtool.StrInSlice(header, h.Values) {
 		return true
@@ -348,6 +373,8 @@ func (mi *muxInstance) handler(request *grpcprot.Request) (result error) {
 		return
 	}
 
+	markRouted(request.Context())
+
 	if mi.spec.XForwardedFor {
 		appendXForwardedFor(request)
 	}
@@ -363,6 +390,43 @@ func (mi *muxInstance) handler(request *grpcprot.Request) (result error) {
 	return
 }
 
+// serviceHealth returns the health of the service, which is aggregated
+// from the backends of all methods which could route the requests of the
+// service. The empty service stands for the whole server. The second
+// return value is false if requests of the service are not routed.
+func (mi *muxInstance) serviceHealth(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	prefix := "/" + service + "/"
+	found := service == ""
+
+	for _, rule := range mi.rules {
+		for _, method := range rule.methods {
+			if service != "" && !method.matchService(prefix) {
+				continue
+			}
+			found = true
+			if !mi.backendHealthy(method.backend) {
+				return healthpb.HealthCheckResponse_NOT_SERVING, true
+			}
+		}
+	}
+
+	if !found {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	return healthpb.HealthCheckResponse_SERVING, true
+}
+
+// backendHealthy returns whether the backend exists and is healthy,
+// backends which don't report their health are considered healthy.
+func (mi *muxInstance) backendHealthy(backend string) bool {
+	handler, ok := mi.muxMapper.GetHandler(backend)
+	if !ok {
+		return false
+	}
+	hc, ok := handler.(interface{ Healthy() bool })
+	return !ok || hc.Healthy()
+}
+
 func (mi *muxInstance) search(request *grpcprot.Request) *route {
 	headerMismatch := false
 	ip := request.RealIP()
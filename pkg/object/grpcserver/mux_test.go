@@ -28,6 +28,7 @@ import (
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -263,6 +264,78 @@ func TestMuxMethodMatchMethod(t *testing.T) {
 	assert.True(t, m.matchMethod("POST"))
 }
 
+func TestMuxMethodMatchService(t *testing.T) {
+	at := assert.New(t)
+	prefix := "/pkg.Service/"
+
+	at.True(newMuxMethod(nil, &Method{}).matchService(prefix))
+	at.True(newMuxMethod(nil, &Method{Method: "/pkg.Service/Get"}).matchService(prefix))
+	at.False(newMuxMethod(nil, &Method{Method: "/pkg.Other/Get"}).matchService(prefix))
+	at.True(newMuxMethod(nil, &Method{MethodPrefix: "/pkg."}).matchService(prefix))
+	at.True(newMuxMethod(nil, &Method{MethodPrefix: "/pkg.Service/G"}).matchService(prefix))
+	at.False(newMuxMethod(nil, &Method{MethodPrefix: "/pkg.Other"}).matchService(prefix))
+	at.True(newMuxMethod(nil, &Method{MethodRegexp: "Service"}).matchService(prefix))
+	at.True(newMuxMethod(nil, &Method{MethodRegexp: "^/pkg\\.Service/(Get|List)$"}).matchService(prefix))
+	at.False(newMuxMethod(nil, &Method{MethodRegexp: "^/pkg\\.Other/.*"}).matchService(prefix))
+}
+
+type healthyHandler struct {
+	contexttest.MockedHandler
+	healthy bool
+}
+
+func (h *healthyHandler) Healthy() bool {
+	return h.healthy
+}
+
+func TestServiceHealth(t *testing.T) {
+	at := assert.New(t)
+
+	_, mi := newTestMux(`
+kind: GRPCServer
+port: 8850
+name: server-grpc
+rules:
+- methods:
+  - methodPrefix: /pkg.A/
+    backend: pipeline-a
+  - methodPrefix: /pkg.B/
+    backend: pipeline-b
+  - methodPrefix: /pkg.C/
+    backend: pipeline-c
+`, at)
+
+	handlerA := &healthyHandler{healthy: true}
+	handlerB := &healthyHandler{healthy: false}
+	mi.muxMapper = &contexttest.MockedMuxMapper{
+		MockedGetHandler: func(name string) (context.Handler, bool) {
+			switch name {
+			case "pipeline-a":
+				return handlerA, true
+			case "pipeline-b":
+				return handlerB, true
+			}
+			return nil, false
+		},
+	}
+
+	s, ok := mi.serviceHealth("pkg.A")
+	at.True(ok)
+	at.Equal(healthpb.HealthCheckResponse_SERVING, s)
+	s, ok = mi.serviceHealth("pkg.B")
+	at.True(ok)
+	at.Equal(healthpb.HealthCheckResponse_NOT_SERVING, s)
+	s, ok = mi.serviceHealth("pkg.C")
+	at.True(ok)
+	at.Equal(healthpb.HealthCheckResponse_NOT_SERVING, s)
+	_, ok = mi.serviceHealth("pkg.D")
+	at.False(ok)
+
+	s, ok = mi.serviceHealth("")
+	at.True(ok)
+	at.Equal(healthpb.HealthCheckResponse_NOT_SERVING, s)
+}
+
 func TestMuxMethodMatchHeaders(t *testing.T) {
 	method := &Method{}
 
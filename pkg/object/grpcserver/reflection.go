@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcserver
+
+import (
+	"io"
+	"sort"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+type (
+	// reflectionServer implements the reflection service by merging the
+	// reflection services of the gRPC servers.
+	reflectionServer struct {
+		rpb.UnimplementedServerReflectionServer
+
+		conns []*grpc.ClientConn
+		// local are the services served by the gRPC server itself.
+		local []string
+		// localFiles are the files of the local services and their
+		// dependencies.
+		localFiles map[string]bool
+	}
+
+	// reflectionStreams are the streams to the gRPC servers for a client
+	// stream, a nil stream is created on demand.
+	reflectionStreams []rpb.ServerReflection_ServerReflectionInfoClient
+)
+
+func newReflectionServer(spec *ReflectionSpec) (*reflectionServer, error) {
+	creds := insecure.NewCredentials()
+	if spec.TLS != nil {
+		tlsConfig, err := spec.TLS.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	rs := &reflectionServer{localFiles: map[string]bool{}}
+	for _, server := range spec.Servers {
+		conn, err := grpc.Dial(server, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			rs.close()
+			return nil, err
+		}
+		rs.conns = append(rs.conns, conn)
+	}
+	return rs, nil
+}
+
+// setLocalServices sets the services served by the gRPC server itself, it
+// must be called before the server starts serving.
+func (rs *reflectionServer) setLocalServices(services []string) {
+	rs.local = services
+
+	var addFile func(fd protoreflect.FileDescriptor)
+	addFile = func(fd protoreflect.FileDescriptor) {
+		if rs.localFiles[fd.Path()] {
+			return
+		}
+		rs.localFiles[fd.Path()] = true
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			addFile(imports.Get(i).FileDescriptor)
+		}
+	}
+	for _, service := range services {
+		d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+		if err == nil {
+			addFile(d.ParentFile())
+		}
+	}
+}
+
+func (rs *reflectionServer) close() {
+	for _, conn := range rs.conns {
+		conn.Close()
+	}
+}
+
+// ServerReflectionInfo implements rpb.ServerReflectionServer.
+func (rs *reflectionServer) ServerReflectionInfo(stream rpb.ServerReflection_ServerReflectionInfoServer) error {
+	streams := make(reflectionStreams, len(rs.conns))
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		resp := rs.handle(stream, streams, req)
+		resp.ValidHost = req.Host
+		resp.OriginalRequest = req
+		if err = stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// query sends the request to the i-th gRPC server and returns its response.
+func (rs *reflectionServer) query(stream rpb.ServerReflection_ServerReflectionInfoServer,
+	streams reflectionStreams, i int, req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+	if streams[i] == nil {
+		s, err := rpb.NewServerReflectionClient(rs.conns[i]).ServerReflectionInfo(stream.Context())
+		if err != nil {
+			return nil, err
+		}
+		streams[i] = s
+	}
+
+	err := streams[i].Send(req)
+	if err == nil {
+		var resp *rpb.ServerReflectionResponse
+		if resp, err = streams[i].Recv(); err == nil {
+			return resp, nil
+		}
+	}
+
+	// the stream is broken, create a new one for the next request.
+	streams[i] = nil
+	return nil, err
+}
+
+func (rs *reflectionServer) handle(stream rpb.ServerReflection_ServerReflectionInfoServer,
+	streams reflectionStreams, req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+	if _, ok := req.MessageRequest.(*rpb.ServerReflectionRequest_ListServices); ok {
+		return rs.listServices(stream, streams, req)
+	}
+
+	// the first successful response wins.
+	var errResp *rpb.ServerReflectionResponse
+	for i := range streams {
+		resp, err := rs.query(stream, streams, i, req)
+		if err != nil {
+			logger.Debugf("query reflection of %s failed: %v", rs.conns[i].Target(), err)
+			continue
+		}
+		if resp.GetErrorResponse() == nil {
+			return resp
+		}
+		errResp = resp
+	}
+
+	if resp := rs.localFile(req); resp != nil {
+		return resp
+	}
+	if errResp != nil {
+		return errResp
+	}
+	return newReflectionError(codes.NotFound, "not found")
+}
+
+func (rs *reflectionServer) listServices(stream rpb.ServerReflection_ServerReflectionInfoServer,
+	streams reflectionStreams, req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+	names := map[string]bool{}
+	for _, name := range rs.local {
+		names[name] = true
+	}
+
+	for i := range streams {
+		resp, err := rs.query(stream, streams, i, req)
+		if err != nil {
+			logger.Debugf("query reflection of %s failed: %v", rs.conns[i].Target(), err)
+			continue
+		}
+		for _, service := range resp.GetListServicesResponse().GetService() {
+			names[service.Name] = true
+		}
+	}
+
+	services := make([]*rpb.ServiceResponse, 0, len(names))
+	for name := range names {
+		services = append(services, &rpb.ServiceResponse{Name: name})
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	return &rpb.ServerReflectionResponse{
+		MessageResponse: &rpb.ServerReflectionResponse_ListServicesResponse{
+			ListServicesResponse: &rpb.ListServiceResponse{Service: services},
+		},
+	}
+}
+
+// localFile answers the file requests of the local services.
+func (rs *reflectionServer) localFile(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+	var fd protoreflect.FileDescriptor
+
+	switch r := req.MessageRequest.(type) {
+	case *rpb.ServerReflectionRequest_FileByFilename:
+		fd, _ = protoregistry.GlobalFiles.FindFileByPath(r.FileByFilename)
+	case *rpb.ServerReflectionRequest_FileContainingSymbol:
+		d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(r.FileContainingSymbol))
+		if err == nil {
+			fd = d.ParentFile()
+		}
+	}
+	if fd == nil || !rs.localFiles[fd.Path()] {
+		return nil
+	}
+
+	// the file is followed by its dependencies.
+	var files [][]byte
+	sent := map[string]bool{}
+	var addFile func(fd protoreflect.FileDescriptor)
+	addFile = func(fd protoreflect.FileDescriptor) {
+		if sent[fd.Path()] {
+			return
+		}
+		sent[fd.Path()] = true
+		data, err := proto.Marshal(protodesc.ToFileDescriptorProto(fd))
+		if err != nil {
+			logger.Errorf("BUG: marshal file descriptor %s failed: %v", fd.Path(), err)
+			return
+		}
+		files = append(files, data)
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			addFile(imports.Get(i).FileDescriptor)
+		}
+	}
+	addFile(fd)
+
+	return &rpb.ServerReflectionResponse{
+		MessageResponse: &rpb.ServerReflectionResponse_FileDescriptorResponse{
+			FileDescriptorResponse: &rpb.FileDescriptorResponse{FileDescriptorProto: files},
+		},
+	}
+}
+
+func newReflectionError(code codes.Code, msg string) *rpb.ServerReflectionResponse {
+	return &rpb.ServerReflectionResponse{
+		MessageResponse: &rpb.ServerReflectionResponse_ErrorResponse{
+			ErrorResponse: &rpb.ErrorResponse{
+				ErrorCode:    int32(code),
+				ErrorMessage: msg,
+			},
+		},
+	}
+}
@@ -23,14 +23,21 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/megaease/easegress/pkg/cluster"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/filters/proxies/grpcproxy"
 	"github.com/megaease/easegress/pkg/graceupdate"
 	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/grpcprot/grpcstat"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/easemonitor"
 	"github.com/megaease/easegress/pkg/util/limitlistener"
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/keepalive"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
 )
 
 const (
@@ -40,6 +47,8 @@ const (
 	stateClosed  stateType = "closed"
 
 	checkFailedTimeout = 10 * time.Second
+
+	topNum = 10
 )
 
 var (
@@ -66,6 +75,9 @@ type (
 		spec      *Spec
 		s         *grpc.Server
 		mux       *mux
+		health    *healthServer
+		reflect   *reflectionServer
+		tlsPolicy *tlspolicy.Policy
 		roundNum  uint64
 		eventChan chan interface{}
 
@@ -74,12 +86,19 @@ type (
 		err   atomic.Value // error
 
 		limitListener *limitlistener.LimitListener
+
+		grpcStat *grpcstat.GRPCStat
+		topN     *grpcstat.TopN
+		metrics  *metrics
 	}
 	// Status contains all status generated by runtime, for displaying to users.
 	Status struct {
 		Health bool      `json:"health"`
 		State  stateType `json:"state"`
 		Error  string    `json:"error,omitempty"`
+
+		*grpcstat.Status
+		TopN []*grpcstat.Item `json:"topN"`
 	}
 )
 
@@ -88,7 +107,10 @@ func newRuntime(superSpec *supervisor.Spec, muxMapper context.MuxMapper) *runtim
 		superSpec: superSpec,
 		mux:       newMux(muxMapper),
 		eventChan: make(chan interface{}, 10),
+		grpcStat:  grpcstat.New(),
+		topN:      grpcstat.NewTopN(topNum),
 	}
+	r.metrics = r.newMetrics(superSpec.Name())
 	r.setError(errNil)
 	r.setState(stateNil)
 	go r.fsm()
@@ -110,6 +132,8 @@ func (r *runtime) Status() *Status {
 		Health: err.Error() == errNil.Error(),
 		Error:  err.Error(),
 		State:  r.getState(),
+		Status: r.grpcStat.Status(),
+		TopN:   r.topN.Status(),
 	}
 }
 
@@ -172,6 +196,7 @@ func (r *runtime) reload(nextSuperSpec *supervisor.Spec, muxMapper context.MuxMa
 
 func (r *runtime) setState(state stateType) {
 	r.state.Store(state)
+	r.exportState(state)
 }
 
 func (r *runtime) getState() stateType {
@@ -219,7 +244,28 @@ func (r *runtime) startServer() {
 		r.setError(err)
 		return
 	}
-	opts := []grpc.ServerOption{grpc.UnknownServiceHandler(r.mux.handler), grpc.CustomCodec(&grpcproxy.GrpcCodec{})}
+	sh := &statsHandler{r: r, local: map[string]bool{}}
+	opts := []grpc.ServerOption{
+		grpc.UnknownServiceHandler(r.mux.handler),
+		grpc.CustomCodec(&grpcproxy.GrpcCodec{}),
+		grpc.StatsHandler(sh),
+	}
+	if r.spec.TLS {
+		tlsConf, err := r.spec.tlsConfig()
+		if err != nil {
+			listen.Close()
+			r.setState(stateFailed)
+			r.setError(err)
+			return
+		}
+		var cls cluster.Cluster
+		if super := r.superSpec.Super(); super != nil {
+			cls = super.Cluster()
+		}
+		r.tlsPolicy = tlspolicy.New(r.spec.TLSPolicy, r.superSpec.Name(), cls)
+		r.tlsPolicy.Apply(tlsConf)
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+	}
 	keepaliveOpts := r.buildServerKeepaliveOpt()
 
 	if len(keepaliveOpts) != 0 {
@@ -230,6 +276,34 @@ func (r *runtime) startServer() {
 	r.limitListener = limitListener
 
 	r.s = grpc.NewServer(opts...)
+	if r.spec.HealthCheck {
+		r.health = newHealthServer(r.mux)
+		healthpb.RegisterHealthServer(r.s, r.health)
+	}
+	if r.spec.Reflection != nil {
+		r.reflect, err = newReflectionServer(r.spec.Reflection)
+		if err != nil {
+			// the reflection spec has been validated, the error is
+			// not expected, but it should not stop the server.
+			logger.Errorf("%s: create reflection server failed: %v", r.superSpec.Name(), err)
+		} else {
+			rpb.RegisterServerReflectionServer(r.s, r.reflect)
+		}
+	}
+
+	// services registered above are served by the server itself.
+	var local []string
+	for name := range r.s.GetServiceInfo() {
+		local = append(local, name)
+		sh.local[name] = true
+	}
+	if r.health != nil {
+		r.health.local = sh.local
+	}
+	if r.reflect != nil {
+		r.reflect.setLocalServices(local)
+	}
+
 	// avoid data race
 	srv := r.s
 	go func() {
@@ -280,9 +354,19 @@ func (r *runtime) buildServerKeepaliveOpt() []grpc.ServerOption {
 }
 
 func (r *runtime) closeServer() {
+	if r.health != nil {
+		r.health.shutdown()
+		r.health = nil
+	}
 	if r.s != nil {
 		r.s.GracefulStop()
 	}
+	if r.reflect != nil {
+		r.reflect.close()
+		r.reflect = nil
+	}
+	r.tlsPolicy.Close()
+	r.tlsPolicy = nil
 }
 
 func (r *runtime) checkFailed(timeout time.Duration) {
@@ -323,3 +407,26 @@ func (r *runtime) handleEventClose(e *eventClose) {
 	r.mux.close()
 	close(e.done)
 }
+
+// ToMetrics implements easemonitor.Metricer.
+func (s *Status) ToMetrics(service string) []*easemonitor.Metrics {
+	var results []*easemonitor.Metrics
+
+	if s.Status != nil {
+		results = s.Status.ToMetrics(service)
+		for _, m := range results {
+			m.Resource = "SERVER"
+		}
+	}
+
+	for _, item := range s.TopN {
+		metrics := item.ToMetrics(service)
+		for _, m := range metrics {
+			m.Resource = "SERVER_TOPN"
+			m.URL = item.Method
+		}
+		results = append(results, metrics...)
+	}
+
+	return results
+}
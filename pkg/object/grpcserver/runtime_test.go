@@ -18,13 +18,31 @@
 package grpcserver
 
 import (
+	stdcontext "context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/context/contexttest"
+	"github.com/megaease/easegress/pkg/protocols/grpcprot/grpcstat"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	channelzsvc "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 func TestNormal(t *testing.T) {
@@ -94,3 +112,175 @@ func TestBuildServerKeepaliveOpt(t *testing.T) {
 	opts := r.buildServerKeepaliveOpt()
 	assert.Equal(t, 2, len(opts))
 }
+
+func TestTLS(t *testing.T) {
+	at := assert.New(t)
+	certs := tlsutiltest.NewCerts()
+
+	s := fmt.Sprintf(`
+kind: GRPCServer
+port: 8851
+name: server-grpc-tls
+tls: true
+caCertBase64: %s
+certs:
+  localhost: %s
+keys:
+  localhost: %s
+`, tlsutiltest.Base64(certs.CACert), tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ServerKey))
+	spec, err := supervisor.NewSpec(s)
+	at.NoError(err)
+
+	r := newRuntime(spec, &contexttest.MockedMuxMapper{})
+	defer r.Close()
+	r.spec = nil
+	r.reload(spec, &contexttest.MockedMuxMapper{})
+	at.Equal(stateRunning, r.getState())
+	time.Sleep(200 * time.Millisecond)
+
+	invoke := func(tlsConf *tls.Config) codes.Code {
+		ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 3*time.Second)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, "localhost:8851", grpc.WithTransportCredentials(credentials.NewTLS(tlsConf)))
+		at.NoError(err)
+		defer conn.Close()
+		err = conn.Invoke(ctx, "/test.Service/Method", &emptypb.Empty{}, &emptypb.Empty{})
+		return status.Code(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certs.CACert)
+	clientCert, err := tls.X509KeyPair(certs.ClientCert, certs.ClientKey)
+	at.NoError(err)
+
+	// mTLS handshake succeeds, the request is handled by the mux.
+	code := invoke(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}})
+	at.NotEqual(codes.Unavailable, code)
+
+	// client certificate is required.
+	code = invoke(&tls.Config{RootCAs: pool})
+	at.Equal(codes.Unavailable, code)
+}
+
+func TestHealthReflectionAndStat(t *testing.T) {
+	at := assert.New(t)
+
+	// the backend serves channelz and the reflection service.
+	backend := grpc.NewServer()
+	channelzsvc.RegisterChannelzServiceToServer(backend)
+	reflection.Register(backend)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	at.NoError(err)
+	go backend.Serve(l)
+	defer backend.Stop()
+
+	s := fmt.Sprintf(`
+kind: GRPCServer
+port: 8852
+name: server-grpc-health
+healthCheck: true
+reflection:
+  servers: [%s]
+rules:
+- methods:
+  - methodPrefix: /grpc.channelz.v1.Channelz/
+    backend: pipeline-channelz
+`, l.Addr().String())
+	spec, err := supervisor.NewSpec(s)
+	at.NoError(err)
+
+	handler := &healthyHandler{healthy: false}
+	mapper := &contexttest.MockedMuxMapper{
+		MockedGetHandler: func(name string) (context.Handler, bool) {
+			return handler, name == "pipeline-channelz"
+		},
+	}
+	r := newRuntime(spec, mapper)
+	defer r.Close()
+	r.spec = nil
+	r.reload(spec, mapper)
+	at.Equal(stateRunning, r.getState())
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "127.0.0.1:8852", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	at.NoError(err)
+	defer conn.Close()
+
+	// health
+	hc := healthpb.NewHealthClient(conn)
+	check := func(service string) (healthpb.HealthCheckResponse_ServingStatus, codes.Code) {
+		resp, err := hc.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		return resp.GetStatus(), status.Code(err)
+	}
+	st, code := check("grpc.channelz.v1.Channelz")
+	at.Equal(codes.OK, code)
+	at.Equal(healthpb.HealthCheckResponse_NOT_SERVING, st)
+	handler.healthy = true
+	st, _ = check("grpc.channelz.v1.Channelz")
+	at.Equal(healthpb.HealthCheckResponse_SERVING, st)
+	st, _ = check("")
+	at.Equal(healthpb.HealthCheckResponse_SERVING, st)
+	st, _ = check("grpc.health.v1.Health")
+	at.Equal(healthpb.HealthCheckResponse_SERVING, st)
+	_, code = check("pkg.Unknown")
+	at.Equal(codes.NotFound, code)
+
+	watch, err := hc.Watch(ctx, &healthpb.HealthCheckRequest{Service: "pkg.Unknown"})
+	at.NoError(err)
+	resp, err := watch.Recv()
+	at.NoError(err)
+	at.Equal(healthpb.HealthCheckResponse_SERVICE_UNKNOWN, resp.Status)
+
+	// reflection
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	at.NoError(err)
+	query := func(req *rpb.ServerReflectionRequest) *rpb.ServerReflectionResponse {
+		at.NoError(stream.Send(req))
+		resp, err := stream.Recv()
+		at.NoError(err)
+		return resp
+	}
+
+	resp2 := query(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	})
+	var names []string
+	for _, s := range resp2.GetListServicesResponse().GetService() {
+		names = append(names, s.Name)
+	}
+	at.Equal([]string{
+		"grpc.channelz.v1.Channelz",
+		"grpc.health.v1.Health",
+		"grpc.reflection.v1alpha.ServerReflection",
+	}, names)
+
+	for _, symbol := range []string{"grpc.channelz.v1.Channelz", "grpc.health.v1.Health"} {
+		resp2 = query(&rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+		})
+		at.NotEmpty(resp2.GetFileDescriptorResponse().GetFileDescriptorProto(), symbol)
+	}
+
+	resp2 = query(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "pkg.Unknown"},
+	})
+	at.NotNil(resp2.GetErrorResponse())
+	stream.CloseSend()
+
+	// statistics, requests not routed are counted as unknown.
+	conn.Invoke(ctx, "/pkg.Unknown/Method", &emptypb.Empty{}, &emptypb.Empty{})
+	time.Sleep(100 * time.Millisecond)
+
+	stat := r.Status()
+	at.NotNil(stat.Status)
+	at.GreaterOrEqual(stat.Count, uint64(6))
+	methods := map[string]*grpcstat.Item{}
+	for _, item := range stat.TopN {
+		methods[item.Method] = item
+	}
+	at.Equal(uint64(5), methods["/grpc.health.v1.Health/Check"].Count)
+	at.Equal(uint64(1), methods[unknownMethod].Codes["NotFound"])
+	at.NotEmpty(stat.ToMetrics("test"))
+}
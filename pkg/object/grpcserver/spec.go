@@ -18,10 +18,17 @@
 package grpcserver
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"regexp"
 
+	"github.com/megaease/easegress/pkg/filters/proxies/grpcproxy"
+	"github.com/megaease/easegress/pkg/object/autocertmanager"
 	"github.com/megaease/easegress/pkg/util/ipfilter"
+	"github.com/megaease/easegress/pkg/util/stringtool"
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
+	"github.com/megaease/easegress/pkg/util/tlsutil"
 )
 
 type (
@@ -50,6 +57,33 @@ type (
 		CacheSize     uint32         `json:"cacheSize" jsonschema:"omitempty"`
 		GlobalFilter  string         `json:"globalFilter,omitempty" jsonschema:"omitempty"`
 		XForwardedFor bool           `json:"xForwardedFor" jsonschema:"omitempty"`
+
+		TLS      bool `json:"tls,omitempty" jsonschema:"omitempty"`
+		AutoCert bool `json:"autoCert,omitempty" jsonschema:"omitempty"`
+		// CaCertBase64 is the CA to verify client certificates, client
+		// certificates are required if it is not empty.
+		CaCertBase64 string `json:"caCertBase64,omitempty" jsonschema:"omitempty,format=base64"`
+		// Certs saved as map, key is domain name, value is cert
+		Certs map[string]string `json:"certs,omitempty" jsonschema:"omitempty"`
+		// Keys saved as map, key is domain name, value is secret
+		Keys map[string]string `json:"keys,omitempty" jsonschema:"omitempty"`
+		// TLSPolicy controls the TLS versions, cipher suites, curves,
+		// session tickets and OCSP stapling.
+		TLSPolicy *tlspolicy.Spec `json:"tlsPolicy,omitempty" jsonschema:"omitempty"`
+
+		// HealthCheck makes the server answer grpc.health.v1.Health itself
+		// instead of routing it to backends.
+		HealthCheck bool `json:"healthCheck,omitempty" jsonschema:"omitempty"`
+		// Reflection makes the server answer the reflection service itself
+		// by merging the reflection services of the gRPC servers.
+		Reflection *ReflectionSpec `json:"reflection,omitempty" jsonschema:"omitempty"`
+	}
+
+	// ReflectionSpec describes the gRPC servers whose reflection services
+	// are merged.
+	ReflectionSpec struct {
+		Servers []string           `json:"servers" jsonschema:"required,minItems=1"`
+		TLS     *grpcproxy.TLSSpec `json:"tls,omitempty" jsonschema:"omitempty"`
 	}
 
 	// Rule is first level entry of router.
@@ -90,6 +124,83 @@ type (
 	}
 )
 
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	if spec.Reflection != nil {
+		if err := spec.Reflection.Validate(); err != nil {
+			return fmt.Errorf("invalid reflection: %v", err)
+		}
+	}
+
+	if !spec.TLS {
+		if spec.TLSPolicy != nil {
+			return fmt.Errorf("tls is disabled when tlsPolicy configured")
+		}
+		return nil
+	}
+	if len(spec.Certs) == 0 && !spec.AutoCert {
+		return fmt.Errorf("certs are empty and autoCert is disabled when tls enabled")
+	}
+	if p := spec.TLSPolicy; p != nil {
+		if err := p.ValidateHTTP2(); err != nil {
+			return err
+		}
+		// gRPC is served over HTTP/2 only.
+		if p.DisablesHTTP2() {
+			return fmt.Errorf("h2 is required in alpn of tlsPolicy")
+		}
+		for _, sni := range p.SNI {
+			if len(sni.ALPN) > 0 && !stringtool.StrInSlice("h2", sni.ALPN) {
+				return fmt.Errorf("h2 is required in alpn of tlsPolicy sni %v", sni.ServerNames)
+			}
+		}
+	}
+	_, err := spec.tlsConfig()
+	return err
+}
+
+func (spec *Spec) tlsConfig() (*tls.Config, error) {
+	certificates, err := tlsutil.LoadCertificates("", "", spec.Certs, spec.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	// like HTTPServer, all gRPC servers handle the TLS-ALPN-01 challenges
+	// of AutoCertManager, but only the token certificate requests are
+	// handled if autoCert is disabled.
+	tlsConf := &tls.Config{
+		Certificates: certificates,
+		NextProtos:   []string{"h2", "acme-tls/1"},
+	}
+	tlsConf.GetCertificate = func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return autocertmanager.GetCertificate(chi, !spec.AutoCert /* tokenOnly */)
+	}
+
+	if spec.CaCertBase64 != "" {
+		pool, err := tlsutil.CertPool(spec.CaCertBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid caCertBase64: %v", err)
+		}
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConf.ClientCAs = pool
+	}
+
+	return tlsConf, nil
+}
+
+// Validate validates ReflectionSpec.
+func (spec *ReflectionSpec) Validate() error {
+	for _, server := range spec.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("invalid server %q: %v", server, err)
+		}
+	}
+	if spec.TLS != nil {
+		return spec.TLS.Validate()
+	}
+	return nil
+}
+
 func (h *Header) initHeaderRoute() {
 	h.headerRE = regexp.MustCompile(h.Regexp)
 }
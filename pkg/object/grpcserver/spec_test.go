@@ -20,7 +20,10 @@ package grpcserver
 import (
 	"testing"
 
+	"github.com/megaease/easegress/pkg/filters/proxies/grpcproxy"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -80,3 +83,61 @@ func TestHeaderValidate(t *testing.T) {
 	h.Values = []string{"a"}
 	assert.NoError(t, h.Validate())
 }
+
+func TestTLSValidate(t *testing.T) {
+	assert := assert.New(t)
+	certs := tlsutiltest.NewCerts()
+
+	spec := &Spec{TLS: true}
+	assert.Error(spec.Validate())
+
+	spec.Certs = map[string]string{"localhost": tlsutiltest.Base64(certs.ServerCert)}
+	assert.Error(spec.Validate())
+
+	spec.Keys = map[string]string{"localhost": string(certs.ServerKey)}
+	assert.NoError(spec.Validate())
+
+	spec.CaCertBase64 = "invalid"
+	assert.Error(spec.Validate())
+
+	spec.CaCertBase64 = tlsutiltest.Base64(certs.CACert)
+	assert.NoError(spec.Validate())
+
+	spec = &Spec{TLS: true, AutoCert: true}
+	assert.NoError(spec.Validate())
+}
+
+func TestTLSPolicyValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := &tlspolicy.Spec{Options: tlspolicy.Options{MinVersion: "TLS1.3"}}
+	spec := &Spec{TLSPolicy: policy}
+	assert.Error(spec.Validate())
+
+	spec = &Spec{TLS: true, AutoCert: true, TLSPolicy: policy}
+	assert.NoError(spec.Validate())
+
+	policy.ALPN = []string{"http/1.1"}
+	assert.Error(spec.Validate())
+
+	policy.ALPN = nil
+	policy.SNI = []*tlspolicy.SNISpec{{
+		ServerNames: []string{"example.com"},
+		Options:     tlspolicy.Options{ALPN: []string{"http/1.1"}},
+	}}
+	assert.Error(spec.Validate())
+}
+
+func TestReflectionValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{Reflection: &ReflectionSpec{Servers: []string{"127.0.0.1:9095"}}}
+	assert.NoError(spec.Validate())
+
+	spec.Reflection.Servers = append(spec.Reflection.Servers, "127.0.0.1")
+	assert.Error(spec.Validate())
+
+	spec.Reflection.Servers = []string{"127.0.0.1:9095"}
+	spec.Reflection.TLS = &grpcproxy.TLSSpec{CACertBase64: "invalid"}
+	assert.Error(spec.Validate())
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package httpserver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/stringtool"
+	"github.com/quic-go/quic-go"
+)
+
+// quicConfig creates the QUIC config of the HTTP/3 server.
+func (spec *Spec) quicConfig(keepAliveTimeout time.Duration) *quic.Config {
+	conf := &quic.Config{
+		MaxIdleTimeout: keepAliveTimeout,
+	}
+	if spec.KeepAlive {
+		conf.KeepAlivePeriod = keepAliveTimeout
+	}
+
+	if q := spec.QUIC; q != nil {
+		conf.MaxIncomingStreams = q.MaxIncomingStreams
+		conf.MaxIncomingUniStreams = q.MaxIncomingUniStreams
+		conf.InitialStreamReceiveWindow = q.InitialStreamReceiveWindow
+		conf.MaxStreamReceiveWindow = q.MaxStreamReceiveWindow
+		conf.InitialConnectionReceiveWindow = q.InitialConnectionReceiveWindow
+		conf.MaxConnectionReceiveWindow = q.MaxConnectionReceiveWindow
+		conf.Allow0RTT = q.Allow0RTT
+	}
+
+	return conf
+}
+
+// earlyDataHandler rejects the requests in 0-RTT early data with 425 (Too
+// Early) unless their methods are allowed, the client retries them after
+// the handshake completes, see RFC 8470.
+type earlyDataHandler struct {
+	next    http.Handler
+	methods []string
+}
+
+func newEarlyDataHandler(next http.Handler, methods []string) *earlyDataHandler {
+	return &earlyDataHandler{next: next, methods: methods}
+}
+
+func (h *earlyDataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the handshake is not complete if the request is in early data.
+	if r.TLS != nil && !r.TLS.HandshakeComplete && !stringtool.StrInSlice(r.Method, h.methods) {
+		w.WriteHeader(http.StatusTooEarly)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package httpserver
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQUICConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{KeepAlive: true}
+	conf := spec.quicConfig(time.Minute)
+	assert.Equal(time.Minute, conf.MaxIdleTimeout)
+	assert.Equal(time.Minute, conf.KeepAlivePeriod)
+	assert.False(conf.Allow0RTT)
+
+	spec = &Spec{QUIC: &QUICSpec{
+		MaxIncomingStreams:             10,
+		MaxIncomingUniStreams:          5,
+		InitialStreamReceiveWindow:     1024,
+		MaxStreamReceiveWindow:         2048,
+		InitialConnectionReceiveWindow: 4096,
+		MaxConnectionReceiveWindow:     8192,
+		Allow0RTT:                      true,
+	}}
+	conf = spec.quicConfig(time.Minute)
+	assert.Zero(conf.KeepAlivePeriod)
+	assert.Equal(int64(10), conf.MaxIncomingStreams)
+	assert.Equal(int64(5), conf.MaxIncomingUniStreams)
+	assert.Equal(uint64(1024), conf.InitialStreamReceiveWindow)
+	assert.Equal(uint64(2048), conf.MaxStreamReceiveWindow)
+	assert.Equal(uint64(4096), conf.InitialConnectionReceiveWindow)
+	assert.Equal(uint64(8192), conf.MaxConnectionReceiveWindow)
+	assert.True(conf.Allow0RTT)
+}
+
+func TestEarlyDataHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newEarlyDataHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), defaultAllow0RTTMethods)
+
+	serve := func(method string, handshakeComplete bool) int {
+		req := httptest.NewRequest(method, "https://example.com/", nil)
+		req.TLS = &tls.ConnectionState{HandshakeComplete: handshakeComplete}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// requests in early data.
+	assert.Equal(http.StatusOK, serve(http.MethodGet, false))
+	assert.Equal(http.StatusOK, serve(http.MethodHead, false))
+	assert.Equal(http.StatusTooEarly, serve(http.MethodPost, false))
+	assert.Equal(http.StatusTooEarly, serve(http.MethodDelete, false))
+
+	// requests after the handshake.
+	assert.Equal(http.StatusOK, serve(http.MethodPost, true))
+	assert.Equal(http.StatusOK, serve(http.MethodDelete, true))
+}
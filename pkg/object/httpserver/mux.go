@@ -19,6 +19,7 @@ package httpserver
 
 import (
 	"bytes"
+	stdcontext "context"
 	"fmt"
 	"io"
 	"net/http"
@@ -41,6 +42,7 @@ import (
 	"github.com/megaease/easegress/pkg/protocols/httpprot/httpstat"
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/clientauth"
 	"github.com/megaease/easegress/pkg/util/fasttime"
 	"github.com/megaease/easegress/pkg/util/ipfilter"
 	"github.com/megaease/easegress/pkg/util/readers"
@@ -72,8 +74,13 @@ type (
 
 		cache *lru.ARCCache
 
-		tracer   *tracing.Tracer
-		ipFilter *ipfilter.IPFilter
+		tracer     *tracing.Tracer
+		ipFilter   *ipfilter.IPFilter
+		clientAuth *clientauth.ClientAuth
+		// hsts is the value of the Strict-Transport-Security header.
+		hsts string
+		// altSvc is the value of the Alt-Svc header.
+		altSvc string
 
 		router routers.Router
 	}
@@ -101,6 +108,10 @@ type (
 		ReqHeaders  string
 		RespHeaders string
 		Tags        string
+
+		ClientCertSubject     string
+		ClientCertSPIFFEID    string
+		ClientCertFingerprint string
 	}
 )
 
@@ -182,9 +193,16 @@ func (m *mux) reload(superSpec *supervisor.Spec, muxMapper context.MuxMapper) {
 		topN:               m.topN,
 		metrics:            oldInst.metrics,
 		ipFilter:           ipfilter.New(spec.IPFilter),
+		clientAuth:         clientauth.New(spec.ClientAuth),
 		tracer:             tracer,
 		accessLogFormatter: newAccessLogFormatter(spec.AccessLogFormat),
 	}
+	if spec.HTTPS && spec.HSTS != nil {
+		inst.hsts = spec.HSTS.headerValue()
+	}
+	if spec.altSvcEnabled() {
+		inst.altSvc = spec.AltSvc.headerValue(spec.Port)
+	}
 	spec.Rules.Init()
 	inst.router = routers.Create(routerKind, spec.Rules)
 
@@ -255,6 +273,15 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 	ctx := context.New(span)
 	ctx.SetData("HTTP_RESPONSE_WRITER", stdw)
 
+	// the header is overridden if it is in the response of the backend.
+	if mi.hsts != "" && stdr.TLS != nil {
+		stdw.Header().Set("Strict-Transport-Security", mi.hsts)
+	}
+	// advertise HTTP/3 in the responses of HTTP/1.1 and HTTP/2.
+	if mi.altSvc != "" && stdr.ProtoMajor < 3 {
+		stdw.Header().Set("Alt-Svc", mi.altSvc)
+	}
+
 	// httpprot.NewRequest never returns an error.
 	req, _ := httpprot.NewRequest(stdr)
 
@@ -268,6 +295,7 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 	routeCtx := routers.NewContext(req)
 	route := mi.search(routeCtx)
 	var respHeader http.Header
+	var identity *clientauth.Identity
 
 	defer func() {
 		metric, _ := ctx.GetData("HTTP_METRIC").(*httpstat.Metric)
@@ -316,6 +344,11 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 				ReqHeaders:  printHeader(stdr.Header),
 				RespHeaders: printHeader(respHeader),
 			}
+			if identity != nil {
+				log.ClientCertSubject = identity.Subject
+				log.ClientCertSPIFFEID = identity.SPIFFEID
+				log.ClientCertFingerprint = identity.Fingerprint
+			}
 			return mi.accessLogFormatter.format(log)
 		})
 	}()
@@ -326,6 +359,24 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 		return
 	}
 
+	clientAuth := route.route.GetClientAuth()
+	if clientAuth == nil {
+		clientAuth = mi.clientAuth
+	}
+	identity, err := clientAuth.Authenticate(req.Context(), stdr.TLS)
+	if err != nil {
+		logger.Errorf("%s: client certificate authentication for [%s %s] failed: %v", mi.superSpec.Name(), req.Method(), req.RequestURI, err)
+		code := http.StatusForbidden
+		if err == clientauth.ErrNoCertificate {
+			code = http.StatusUnauthorized
+		}
+		buildFailureResponse(ctx, code)
+		return
+	}
+	if identity != nil {
+		ctx.SetData("CLIENT_CERT_IDENTITY", identity)
+	}
+
 	backend := route.route.GetBackend()
 	handler, ok := mi.muxMapper.GetHandler(backend)
 	if !ok {
@@ -335,6 +386,25 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 	}
 	logger.Debugf("%s: the matched backend(Pipeline) for [%s %s] is %q", mi.superSpec.Name(), req.Method(), req.RequestURI, backend)
 
+	// The timeout of the route is the deadline of the whole request, the
+	// cancel function is called when the context finishes, that's, after
+	// the response has been sent.
+	timeout := route.route.GetTimeout()
+	if timeout > 0 {
+		stdctx, cancel := stdcontext.WithTimeout(req.Context(), timeout)
+		ctx.OnFinish(cancel)
+		req.SetContext(stdctx)
+	}
+
+	// The resilience policies of the route override the ones of proxies.
+	retry, circuitBreaker := route.route.GetResiliencePolicy()
+	if retry != "" {
+		ctx.SetData(context.DataKeyRouteRetryPolicy, retry)
+	}
+	if circuitBreaker != "" {
+		ctx.SetData(context.DataKeyRouteCircuitBreakerPolicy, circuitBreaker)
+	}
+
 	route.route.Rewrite(routeCtx)
 	if mi.spec.XForwardedFor {
 		appendXForwardedFor(req)
@@ -344,7 +414,7 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 	if maxBodySize == 0 {
 		maxBodySize = mi.spec.ClientMaxBodySize
 	}
-	err := req.FetchPayload(maxBodySize)
+	err = req.FetchPayload(maxBodySize)
 	if err == httpprot.ErrRequestEntityTooLarge {
 		logger.Errorf("%s: %s, you may need to increase 'clientMaxBodySize' or set it to -1", mi.superSpec.Name(), err.Error())
 		buildFailureResponse(ctx, http.StatusRequestEntityTooLarge)
@@ -363,6 +433,14 @@ func (mi *muxInstance) serveHTTP(stdw http.ResponseWriter, stdr *http.Request) {
 	} else {
 		globalFilter.Handle(ctx, handler)
 	}
+
+	if timeout > 0 && req.Context().Err() == stdcontext.DeadlineExceeded {
+		logger.Errorf("%s: [%s %s] exceeded the route timeout %s", mi.superSpec.Name(), req.Method(), req.RequestURI, timeout)
+		ctx.AddTag("route timeout")
+		if ctx.GetResponse(context.DefaultNamespace) == nil {
+			buildFailureResponse(ctx, http.StatusGatewayTimeout)
+		}
+	}
 }
 
 func (mi *muxInstance) search(context *routers.RouteContext) *cachedRoute {
@@ -18,6 +18,9 @@
 package httpserver
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -37,6 +40,8 @@ import (
 	"github.com/megaease/easegress/pkg/protocols/httpprot/httpstat"
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/clientauth"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -214,6 +219,148 @@ rules:
 	assert.Equal(http.StatusBadRequest, stdw.Code)
 }
 
+func TestServeHTTPRouteTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	mm := &contexttest.MockedMuxMapper{}
+	m := newMux(httpstat.New(), httpstat.NewTopN(10), newMockMetrics(), mm)
+
+	yamlConfig := `
+kind: HTTPServer
+name: test
+port: 8080
+rules:
+- paths:
+  - path: /search
+    backend: search-pipeline
+    timeout: 10ms
+    retryPolicy: retry
+    circuitBreakerPolicy: circuitBreaker
+`
+	superSpec, err := supervisor.NewSpec(yamlConfig)
+	assert.NoError(err)
+	assert.NotPanics(func() { m.reload(superSpec, mm) })
+
+	mm.MockedGetHandler = func(name string) (context.Handler, bool) {
+		return &contexttest.MockedHandler{
+			MockedHandle: func(ctx *context.Context) string {
+				assert.Equal("retry", ctx.GetData(context.DataKeyRouteRetryPolicy))
+				assert.Equal("circuitBreaker", ctx.GetData(context.DataKeyRouteCircuitBreakerPolicy))
+
+				req := ctx.GetInputRequest().(*httpprot.Request)
+				_, ok := req.Context().Deadline()
+				assert.True(ok)
+				<-req.Context().Done()
+				return ""
+			},
+		}, true
+	}
+
+	stdr, _ := http.NewRequest(http.MethodGet, "http://www.megaease.com/search", http.NoBody)
+	stdw := httptest.NewRecorder()
+	m.ServeHTTP(stdw, stdr)
+	assert.Equal(http.StatusGatewayTimeout, stdw.Code)
+}
+
+func TestServeHTTPClientAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	mm := &contexttest.MockedMuxMapper{}
+	m := newMux(httpstat.New(), httpstat.NewTopN(10), newMockMetrics(), mm)
+
+	certs := tlsutiltest.NewCerts()
+	ca := tlsutiltest.NewCA("partner CA")
+	yamlConfig := fmt.Sprintf(`
+kind: HTTPServer
+name: test
+port: 8080
+https: true
+certBase64: %s
+keyBase64: %s
+clientAuth:
+  mode: verifyIfGiven
+  caCerts: [%s]
+rules:
+- host: partner.example.com
+  clientAuth:
+    mode: required
+    caCerts: [%s]
+    rules:
+    - spiffeIDs: ["spiffe://partner.example.com/*"]
+  paths:
+  - path: /public
+    backend: public
+    clientAuth:
+      mode: none
+  - path: /api
+    backend: api
+- paths:
+  - path: /api
+    backend: api
+`, tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ServerKey),
+		tlsutiltest.Base64(ca.CertPEM()), tlsutiltest.Base64(ca.CertPEM()))
+	superSpec, err := supervisor.NewSpec(yamlConfig)
+	assert.NoError(err)
+	assert.True(superSpec.ObjectSpec().(*Spec).clientAuthActive())
+	assert.NotPanics(func() { m.reload(superSpec, mm) })
+
+	var identity *clientauth.Identity
+	mm.MockedGetHandler = func(name string) (context.Handler, bool) {
+		return &contexttest.MockedHandler{
+			MockedHandle: func(ctx *context.Context) string {
+				identity, _ = ctx.GetData("CLIENT_CERT_IDENTITY").(*clientauth.Identity)
+				resp, _ := httpprot.NewResponse(nil)
+				ctx.SetResponse(context.DefaultNamespace, resp)
+				return ""
+			},
+		}, true
+	}
+
+	issue := func(ca *tlsutiltest.CA, spiffeID string) *x509.Certificate {
+		u, _ := url.Parse(spiffeID)
+		cert, _, _ := ca.Issue(&x509.Certificate{
+			Subject:     pkix.Name{CommonName: "partner"},
+			URIs:        []*url.URL{u},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		return cert
+	}
+	partner := issue(ca, "spiffe://partner.example.com/billing")
+	other := issue(ca, "spiffe://other.example.com/billing")
+	untrusted := issue(tlsutiltest.NewCA("untrusted"), "spiffe://partner.example.com/billing")
+
+	serve := func(url string, cert *x509.Certificate) int {
+		identity = nil
+		stdr, _ := http.NewRequest(http.MethodGet, url, http.NoBody)
+		stdr.TLS = &tls.ConnectionState{}
+		if cert != nil {
+			stdr.TLS.PeerCertificates = []*x509.Certificate{cert}
+		}
+		stdw := httptest.NewRecorder()
+		m.ServeHTTP(stdw, stdr)
+		return stdw.Code
+	}
+
+	assert.Equal(http.StatusUnauthorized, serve("https://partner.example.com/api", nil))
+	assert.Equal(http.StatusForbidden, serve("https://partner.example.com/api", other))
+	assert.Equal(http.StatusForbidden, serve("https://partner.example.com/api", untrusted))
+	assert.Equal(http.StatusOK, serve("https://partner.example.com/api", partner))
+	if assert.NotNil(identity) {
+		assert.Equal("spiffe://partner.example.com/billing", identity.SPIFFEID)
+	}
+
+	assert.Equal(http.StatusOK, serve("https://partner.example.com/public", nil))
+	assert.Equal(http.StatusOK, serve("https://partner.example.com/public", untrusted))
+	assert.Nil(identity)
+
+	assert.Equal(http.StatusOK, serve("https://www.example.com/api", nil))
+	assert.Nil(identity)
+	assert.Equal(http.StatusOK, serve("https://www.example.com/api", other))
+	assert.NotNil(identity)
+	assert.Equal(http.StatusForbidden, serve("https://www.example.com/api", untrusted))
+}
+
 func TestMuxInstanceSearch(t *testing.T) {
 	assert := assert.New(t)
 
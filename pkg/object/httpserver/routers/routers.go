@@ -24,8 +24,10 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/util/clientauth"
 )
 
 type (
@@ -55,6 +57,15 @@ type (
 		GetBackend() string
 		// GetClientMaxBodySize is used to get the clientMaxBodySize corresponding to the route.
 		GetClientMaxBodySize() int64
+		// GetTimeout is used to get the timeout of the whole request, zero
+		// means no timeout.
+		GetTimeout() time.Duration
+		// GetResiliencePolicy is used to get the names of the resilience
+		// policies which override the ones of the proxies.
+		GetResiliencePolicy() (retry, circuitBreaker string)
+		// GetClientAuth is used to get the client certificate
+		// authentication, nil means to use the one of the server.
+		GetClientAuth() *clientauth.ClientAuth
 	}
 
 	// Params are used to store the variables in the search path and their corresponding values.
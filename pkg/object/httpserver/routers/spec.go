@@ -22,8 +22,10 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"time"
 
 	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/clientauth"
 	"github.com/megaease/easegress/pkg/util/ipfilter"
 	"github.com/megaease/easegress/pkg/util/stringtool"
 )
@@ -56,7 +58,12 @@ type Rule struct {
 	Hosts        []Host         `json:"hosts" jsonschema:"omitempty"`
 	Paths        Paths          `json:"paths" jsonschema:"omitempty"`
 
-	ipFilter *ipfilter.IPFilter
+	// ClientAuthSpec is the client certificate authentication of the
+	// hosts, it is inherited by the paths which don't have one.
+	ClientAuthSpec *clientauth.Spec `json:"clientAuth,omitempty" jsonschema:"omitempty"`
+
+	ipFilter   *ipfilter.IPFilter
+	clientAuth *clientauth.ClientAuth
 }
 
 // Path is second level entry of router.
@@ -74,7 +81,19 @@ type Path struct {
 	MatchAllHeader    bool           `json:"matchAllHeader" jsonschema:"omitempty"`
 	MatchAllQuery     bool           `json:"matchAllQuery" jsonschema:"omitempty"`
 
+	// Timeout is the deadline of the whole request, it is propagated to
+	// all filters and upstream calls through the request context.
+	Timeout string `json:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+	// RetryPolicy and CircuitBreakerPolicy override the resilience
+	// policies of the proxies in the backend pipeline.
+	RetryPolicy          string `json:"retryPolicy,omitempty" jsonschema:"omitempty"`
+	CircuitBreakerPolicy string `json:"circuitBreakerPolicy,omitempty" jsonschema:"omitempty"`
+
+	ClientAuthSpec *clientauth.Spec `json:"clientAuth,omitempty" jsonschema:"omitempty"`
+
+	timeout              time.Duration
 	ipFilter             *ipfilter.IPFilter
+	clientAuth           *clientauth.ClientAuth
 	method               MethodType
 	cacheable, matchable bool
 }
@@ -134,11 +153,31 @@ func (rule *Rule) Init() {
 	}
 
 	rule.ipFilter = ipfilter.New(rule.IPFilterSpec)
+	rule.clientAuth = clientauth.New(rule.ClientAuthSpec)
 	for _, p := range rule.Paths {
 		p.Init(rule.ipFilter)
+		if p.clientAuth == nil {
+			p.clientAuth = rule.clientAuth
+		}
 	}
 }
 
+// ClientAuthActive returns whether any host or path of the rules
+// requires client certificates.
+func (rules Rules) ClientAuthActive() bool {
+	for _, rule := range rules {
+		if rule.ClientAuthSpec.Active() {
+			return true
+		}
+		for _, p := range rule.Paths {
+			if p.ClientAuthSpec.Active() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // MatchHost matches the host of the request to the rule.
 func (rule *Rule) MatchHost(ctx *RouteContext) bool {
 	if len(rule.Hosts) == 0 {
@@ -168,6 +207,7 @@ func (rule *Rule) AllowIP(ip string) bool {
 // Init is the initialization portal for Path
 func (p *Path) Init(parentIPFilter *ipfilter.IPFilter) {
 	p.ipFilter = ipfilter.New(p.IPFilterSpec)
+	p.clientAuth = clientauth.New(p.ClientAuthSpec)
 
 	p.Headers.init()
 	p.Queries.init()
@@ -183,6 +223,10 @@ func (p *Path) Init(parentIPFilter *ipfilter.IPFilter) {
 	p.method = method
 	p.matchable = true
 
+	if p.Timeout != "" {
+		p.timeout, _ = time.ParseDuration(p.Timeout)
+	}
+
 	if len(p.Headers) == 0 && len(p.Queries) == 0 && p.ipFilter == nil {
 		if parentIPFilter == nil {
 			p.cacheable = true
@@ -199,6 +243,14 @@ func (p *Path) Validate() error {
 		return fmt.Errorf("rewriteTarget is specified but path is empty")
 	}
 
+	if p.Timeout != "" {
+		if d, err := time.ParseDuration(p.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		} else if d <= 0 {
+			return fmt.Errorf("timeout must be positive")
+		}
+	}
+
 	return nil
 }
 
@@ -252,6 +304,24 @@ func (p *Path) GetClientMaxBodySize() int64 {
 	return p.ClientMaxBodySize
 }
 
+// GetTimeout is used to get the timeout of the whole request corresponding
+// to the route.
+func (p *Path) GetTimeout() time.Duration {
+	return p.timeout
+}
+
+// GetResiliencePolicy is used to get the names of the resilience policies
+// which override the ones of the proxies.
+func (p *Path) GetResiliencePolicy() (retry, circuitBreaker string) {
+	return p.RetryPolicy, p.CircuitBreakerPolicy
+}
+
+// GetClientAuth is used to get the client certificate authentication of
+// the route.
+func (p *Path) GetClientAuth() *clientauth.ClientAuth {
+	return p.clientAuth
+}
+
 func (hs Headers) init() {
 	for _, h := range hs {
 		if h.Regexp != "" {
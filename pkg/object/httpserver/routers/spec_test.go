@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/protocols/httpprot"
@@ -186,6 +187,16 @@ func TestPathInit(t *testing.T) {
 	assert.NotNil(path.Queries[0].re)
 	assert.Equal("foo", path.GetBackend())
 	assert.EqualValues(1000, path.GetClientMaxBodySize())
+	assert.Zero(path.GetTimeout())
+
+	path.Timeout = "300ms"
+	path.RetryPolicy = "retry"
+	path.CircuitBreakerPolicy = "circuitBreaker"
+	path.Init(nil)
+	assert.Equal(300*time.Millisecond, path.GetTimeout())
+	retry, circuitBreaker := path.GetResiliencePolicy()
+	assert.Equal("retry", retry)
+	assert.Equal("circuitBreaker", circuitBreaker)
 
 	path.Methods = []string{"GET", "POST"}
 	path.Init(nil)
@@ -212,6 +223,15 @@ func TestPathValidate(t *testing.T) {
 	p.PathRegexp = ""
 	p.RewriteTarget = ""
 	assert.NoError(t, p.Validate())
+
+	p.Timeout = "300ms"
+	assert.NoError(t, p.Validate())
+
+	p.Timeout = "-1s"
+	assert.Error(t, p.Validate())
+
+	p.Timeout = "abc"
+	assert.Error(t, p.Validate())
 }
 
 func TestPathInit2(t *testing.T) {
@@ -20,6 +20,7 @@ package httpserver
 import (
 	"bytes"
 	stdcontext "context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -28,7 +29,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 
 	"github.com/megaease/easegress/pkg/context"
@@ -36,10 +36,12 @@ import (
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/protocols/httpprot/httpstat"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/certprovider"
 	"github.com/megaease/easegress/pkg/util/easemonitor"
 	"github.com/megaease/easegress/pkg/util/filterwriter"
 	"github.com/megaease/easegress/pkg/util/limitlistener"
 	"github.com/megaease/easegress/pkg/util/prometheushelper"
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -84,6 +86,9 @@ type (
 		roundNum  uint64
 		eventChan chan interface{}
 
+		certManager atomic.Pointer[certprovider.Manager]
+		tlsPolicy   *tlspolicy.Policy
+
 		// status
 		state atomic.Value // stateType
 		err   atomic.Value // error
@@ -104,6 +109,8 @@ type (
 
 		*httpstat.Status
 		TopN []*httpstat.Item `json:"topN"`
+
+		Certificates []*certprovider.Status `json:"certificates,omitempty"`
 	}
 )
 
@@ -138,13 +145,21 @@ func (r *runtime) Status() *Status {
 	health := r.getError().Error()
 	status := r.httpStat.Status()
 	r.exportPrometheusMetrics(status)
+
+	var certificates []*certprovider.Status
+	if m := r.certManager.Load(); m != nil {
+		certificates = m.Status()
+	}
+	r.exportCertificateMetrics(certificates)
+
 	return &Status{
-		Name:   r.superSpec.Name(),
-		Health: health,
-		State:  r.getState(),
-		Error:  r.getError().Error(),
-		Status: status,
-		TopN:   r.topN.Status(),
+		Name:         r.superSpec.Name(),
+		Health:       health,
+		State:        r.getState(),
+		Error:        r.getError().Error(),
+		Status:       status,
+		TopN:         r.topN.Status(),
+		Certificates: certificates,
 	}
 }
 
@@ -241,8 +256,20 @@ func (r *runtime) needRestartServer(nextSpec *Spec) bool {
 	x.XForwardedFor, y.XForwardedFor = false, false
 	x.Tracing, y.Tracing = nil, nil
 	x.IPFilter, y.IPFilter = nil, nil
+	x.ClientAuth, y.ClientAuth = nil, nil
+	x.HSTS, y.HSTS = nil, nil
+	// only the max-age of Alt-Svc is changed.
+	if x.altSvcEnabled() == y.altSvcEnabled() {
+		x.AltSvc, y.AltSvc = nil, nil
+	}
 	x.Rules, y.Rules = nil, nil
 
+	// The server must be restarted to request client certificates or not
+	// in TLS handshakes.
+	if r.spec.clientAuthActive() != nextSpec.clientAuthActive() {
+		return true
+	}
+
 	// The update of rules need not to shutdown server.
 	return !reflect.DeepEqual(x, y)
 }
@@ -252,31 +279,52 @@ func (r *runtime) startServer() {
 	r.setState(stateRunning)
 	r.setError(nil)
 
+	// the manager of the previous round is not closed if the server
+	// failed to start.
+	r.closeCertManager()
+	if r.spec.HTTPS && len(r.spec.CertSources) > 0 {
+		m, err := certprovider.NewManager(r.spec.CertSources)
+		if err != nil {
+			r.setState(stateFailed)
+			r.setError(err)
+			return
+		}
+		r.certManager.Store(m)
+	}
+	r.closeTLSPolicy()
+	if r.spec.HTTPS {
+		r.tlsPolicy = tlspolicy.New(r.spec.TLSPolicy, r.superSpec.Name(), r.superSpec.Super().Cluster())
+	}
+
 	if r.spec.HTTP3 {
 		r.startHTTP3Server()
-	} else {
+	}
+	// HTTP/1.1 and HTTP/2 are also served on the TCP port if HTTP/3 is
+	// advertised by Alt-Svc.
+	if !r.spec.HTTP3 || r.spec.altSvcEnabled() {
 		r.startHTTP1And2Server()
 	}
 }
 
 func (r *runtime) startHTTP3Server() {
-	tlsConfig, _ := r.spec.tlsConfig()
+	tlsConfig, _ := r.spec.tlsConfig(r.certManager.Load())
+	r.tlsPolicy.Apply(tlsConfig)
 
 	keepAliveTimeout := defaultKeepAliveTimeout
 	if r.spec.KeepAliveTimeout != "" {
 		keepAliveTimeout, _ = time.ParseDuration(r.spec.KeepAliveTimeout)
 	}
 
-	r.server3 = &http3.Server{
-		Addr:      fmt.Sprintf(":%d", r.spec.Port),
-		Handler:   r.mux,
-		TLSConfig: tlsConfig,
-		QuicConfig: &quic.Config{
-			MaxIdleTimeout: keepAliveTimeout,
-		},
+	var handler http.Handler = r.mux
+	if q := r.spec.QUIC; q != nil && q.Allow0RTT {
+		handler = newEarlyDataHandler(r.mux, q.allow0RTTMethods())
 	}
-	if r.spec.KeepAlive {
-		r.server3.QuicConfig.KeepAlivePeriod = keepAliveTimeout
+
+	r.server3 = &http3.Server{
+		Addr:       fmt.Sprintf(":%d", r.spec.Port),
+		Handler:    handler,
+		TLSConfig:  tlsConfig,
+		QuicConfig: r.spec.quicConfig(keepAliveTimeout),
 	}
 
 	// to avoid data race
@@ -309,6 +357,10 @@ func (r *runtime) startHTTP1And2Server() {
 		ErrorLog:    log.New(fw, "", log.LstdFlags),
 	}
 	r.server.SetKeepAlivesEnabled(r.spec.KeepAlive)
+	if r.spec.HTTPS && r.spec.TLSPolicy.DisablesHTTP2() {
+		// a non-nil TLSNextProto disables HTTP/2.
+		r.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
 
 	listener, err := gnet.Listen("tcp", fmt.Sprintf(":%d", r.spec.Port))
 	if err != nil {
@@ -323,11 +375,17 @@ func (r *runtime) startHTTP1And2Server() {
 	spec := r.spec
 	roundNum := r.roundNum
 	srv := r.server
+	certManager := r.certManager.Load()
+	tlsPolicy := r.tlsPolicy
 
 	go func() {
 		var err error
 		if spec.HTTPS {
-			tlsConfig, _ := spec.tlsConfig()
+			tlsConfig, _ := spec.tlsConfig(certManager)
+			// the protocols are set before the TLS policy is applied,
+			// the handshakes don't use the ones added by ServeTLS.
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h2", "http/1.1")
+			tlsPolicy.Apply(tlsConfig)
 			srv.TLSConfig = tlsConfig
 			err = srv.ServeTLS(limitListener, "", "")
 		} else {
@@ -343,14 +401,19 @@ func (r *runtime) startHTTP1And2Server() {
 }
 
 func (r *runtime) closeServer() {
+	defer r.closeCertManager()
+	defer r.closeTLSPolicy()
+
 	if r.server3 != nil {
 		err := r.server3.Close()
 		if err != nil {
 			logger.Warnf("shutdown http3 server %s failed: %v", r.superSpec.Name(), err)
 		}
-		return
+		r.server3 = nil
 	}
 
+	// the HTTP/1.1 and HTTP/2 server may also be running with the HTTP/3
+	// server if Alt-Svc is enabled.
 	if r.server != nil {
 		// NOTE: It's safe to shutdown serve failed server.
 		ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 30*time.Second)
@@ -360,9 +423,21 @@ func (r *runtime) closeServer() {
 			logger.Warnf("shutdown http1/2 server %s failed: %v",
 				r.superSpec.Name(), err)
 		}
+		r.server = nil
+	}
+}
+
+func (r *runtime) closeCertManager() {
+	if m := r.certManager.Swap(nil); m != nil {
+		m.Close()
 	}
 }
 
+func (r *runtime) closeTLSPolicy() {
+	r.tlsPolicy.Close()
+	r.tlsPolicy = nil
+}
+
 func (r *runtime) checkFailed(timeout time.Duration) {
 	ticker := time.NewTicker(timeout)
 	for range ticker.C {
@@ -458,6 +533,8 @@ type (
 		P999          *prometheus.GaugeVec
 		ReqSize       *prometheus.GaugeVec
 		RespSize      *prometheus.GaugeVec
+
+		CertificateExpiry *prometheus.GaugeVec
 	}
 )
 
@@ -615,6 +692,10 @@ func (r *runtime) newMetrics(name string) *metrics {
 			"httpserver_resp_size",
 			"The total size of the http responses in this statistic window",
 			httpserverLabels[:5]).MustCurryWith(commonLabels),
+		CertificateExpiry: prometheushelper.NewGauge(
+			"httpserver_certificate_expiry_seconds",
+			"the seconds before the certificate of a domain expires",
+			append(httpserverLabels[:5:5], "certSource", "domain")).MustCurryWith(commonLabels),
 	}
 }
 
@@ -649,3 +730,15 @@ func (r *runtime) exportPrometheusMetrics(status *httpstat.Status) {
 	r.metrics.ReqSize.WithLabelValues().Set(float64(status.ReqSize))
 	r.metrics.RespSize.WithLabelValues().Set(float64(status.RespSize))
 }
+
+func (r *runtime) exportCertificateMetrics(statuses []*certprovider.Status) {
+	// remove the metrics of the certificates which have been replaced.
+	r.metrics.CertificateExpiry.DeletePartialMatch(prometheus.Labels{})
+	for _, s := range statuses {
+		for _, cert := range s.Certificates {
+			for _, domain := range cert.DNSNames {
+				r.metrics.CertificateExpiry.WithLabelValues(s.Source, domain).Set(float64(cert.ExpiresIn))
+			}
+		}
+	}
+}
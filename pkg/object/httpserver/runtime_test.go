@@ -18,6 +18,12 @@
 package httpserver
 
 import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -25,6 +31,7 @@ import (
 	"github.com/megaease/easegress/pkg/context/contexttest"
 	"github.com/megaease/easegress/pkg/option"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -99,3 +106,213 @@ https: false
 
 	//
 }
+
+func TestCertSources(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCerts := func(dnsName string) {
+		certs := tlsutiltest.NewCerts(dnsName)
+		assert.NoError(os.WriteFile(certFile+".tmp", certs.ServerCert, 0o600))
+		assert.NoError(os.WriteFile(keyFile+".tmp", certs.ServerKey, 0o600))
+		assert.NoError(os.Rename(certFile+".tmp", certFile))
+		assert.NoError(os.Rename(keyFile+".tmp", keyFile))
+	}
+	writeCerts("a.example.com")
+
+	yamlConfig := fmt.Sprintf(`
+kind: HTTPServer
+name: test
+port: 38090
+keepAlive: true
+https: true
+certSources:
+- name: file
+  file:
+    certFile: %s
+    keyFile: %s
+`, certFile, keyFile)
+	super := supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
+		nil, false, nil, nil)
+	superSpec, err := super.NewSpec(yamlConfig)
+	assert.NoError(err)
+
+	r := newRuntime(superSpec, &contexttest.MockedMuxMapper{})
+	defer r.Close()
+	r.reload(superSpec, &contexttest.MockedMuxMapper{})
+
+	// dial returns the connection if the server responds the certificate
+	// of serverName.
+	dial := func(serverName string) *tls.Conn {
+		conn, err := tls.Dial("tcp", "127.0.0.1:38090", &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return nil
+		}
+		if conn.ConnectionState().PeerCertificates[0].VerifyHostname(serverName) != nil {
+			conn.Close()
+			return nil
+		}
+		return conn
+	}
+
+	var conn *tls.Conn
+	assert.Eventually(func() bool {
+		conn = dial("a.example.com")
+		return conn != nil
+	}, 3*time.Second, 50*time.Millisecond)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	writeCerts("b.example.com")
+	assert.Eventually(func() bool {
+		c := dial("b.example.com")
+		if c == nil {
+			return false
+		}
+		c.Close()
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the connection established before the reload still works.
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"))
+	assert.NoError(err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if assert.NoError(err) {
+		resp.Body.Close()
+	}
+
+	status := r.Status()
+	if assert.Len(status.Certificates, 1) {
+		assert.Equal("file", status.Certificates[0].Source)
+		assert.Contains(status.Certificates[0].Certificates[0].DNSNames, "b.example.com")
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	certs := tlsutiltest.NewCerts("public.example.com", "internal.example.com")
+	yamlConfig := fmt.Sprintf(`
+kind: HTTPServer
+name: test
+port: 38091
+keepAlive: true
+https: true
+certBase64: %s
+keyBase64: %s
+tlsPolicy:
+  minVersion: TLS1.2
+  alpn: [http/1.1]
+  sessionTickets:
+    rotationInterval: 1h
+  sni:
+  - serverNames: [internal.example.com]
+    minVersion: TLS1.3
+hsts:
+  maxAge: 8760h
+  includeSubdomains: true
+`, tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ServerKey))
+	super := supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
+		nil, false, nil, nil)
+	superSpec, err := super.NewSpec(yamlConfig)
+	assert.NoError(err)
+
+	r := newRuntime(superSpec, &contexttest.MockedMuxMapper{})
+	defer r.Close()
+	r.reload(superSpec, &contexttest.MockedMuxMapper{})
+
+	dial := func(serverName string, maxVersion uint16) (*tls.Conn, error) {
+		return tls.Dial("tcp", "127.0.0.1:38091", &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			MaxVersion:         maxVersion,
+			NextProtos:         []string{"h2", "http/1.1"},
+		})
+	}
+
+	var conn *tls.Conn
+	assert.Eventually(func() bool {
+		conn, err = dial("public.example.com", tls.VersionTLS12)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+	// HTTP/2 is disabled by the ALPN protocols.
+	assert.Equal("http/1.1", conn.ConnectionState().NegotiatedProtocol)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: public.example.com\r\n\r\n"))
+	assert.NoError(err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal("max-age=31536000; includeSubDomains", resp.Header.Get("Strict-Transport-Security"))
+	}
+
+	// TLS 1.3 is required for the internal server name.
+	_, err = dial("internal.example.com", tls.VersionTLS12)
+	assert.Error(err)
+	c, err := dial("internal.example.com", tls.VersionTLS13)
+	if assert.NoError(err) {
+		assert.Equal(uint16(tls.VersionTLS13), c.ConnectionState().Version)
+		c.Close()
+	}
+}
+
+func TestAltSvc(t *testing.T) {
+	assert := assert.New(t)
+
+	certs := tlsutiltest.NewCerts()
+	yamlConfig := fmt.Sprintf(`
+kind: HTTPServer
+name: test
+port: 38092
+keepAlive: true
+https: true
+http3: true
+certBase64: %s
+keyBase64: %s
+altSvc:
+  maxAge: 1h
+quic:
+  maxIncomingStreams: 10
+`, tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ServerKey))
+	super := supervisor.NewMock(option.New(), nil, sync.Map{}, sync.Map{}, nil,
+		nil, false, nil, nil)
+	superSpec, err := super.NewSpec(yamlConfig)
+	assert.NoError(err)
+
+	r := newRuntime(superSpec, &contexttest.MockedMuxMapper{})
+	defer r.Close()
+	r.reload(superSpec, &contexttest.MockedMuxMapper{})
+
+	// HTTP/1.1 and HTTP/2 are served on the TCP port with HTTP/3, and
+	// HTTP/3 is advertised in the responses.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	var resp *http.Response
+	assert.Eventually(func() bool {
+		resp, err = client.Get("https://127.0.0.1:38092/")
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	if resp == nil {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	assert.Equal(`h3=":38092"; ma=3600`, resp.Header.Get("Alt-Svc"))
+
+	// the server is restarted only if Alt-Svc is enabled or disabled.
+	spec := *r.spec
+	spec.AltSvc = nil
+	assert.False(r.needRestartServer(&spec))
+	spec.AltSvc = &AltSvcSpec{Disabled: true}
+	assert.True(r.needRestartServer(&spec))
+}
@@ -22,11 +22,17 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/megaease/easegress/pkg/object/autocertmanager"
 	"github.com/megaease/easegress/pkg/object/httpserver/routers"
 	"github.com/megaease/easegress/pkg/tracing"
+	"github.com/megaease/easegress/pkg/util/certprovider"
+	"github.com/megaease/easegress/pkg/util/clientauth"
 	"github.com/megaease/easegress/pkg/util/ipfilter"
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
+	"github.com/megaease/easegress/pkg/util/tlsutil"
 )
 
 type (
@@ -45,6 +51,10 @@ type (
 		Tracing           *tracing.Spec `json:"tracing,omitempty" jsonschema:"omitempty"`
 		CaCertBase64      string        `json:"caCertBase64" jsonschema:"omitempty,format=base64"`
 
+		// ClientAuth is the default client certificate authentication of
+		// all routes, which could be overridden by rules and paths.
+		ClientAuth *clientauth.Spec `json:"clientAuth,omitempty" jsonschema:"omitempty"`
+
 		// Support multiple certs, preserve the certbase64 and keybase64
 		// for backward compatibility
 		CertBase64 string `json:"certBase64" jsonschema:"omitempty,format=base64"`
@@ -55,6 +65,21 @@ type (
 		// Keys saved as map, key is domain name, value is secret
 		Keys map[string]string `json:"keys" jsonschema:"omitempty"`
 
+		// CertSources are the external sources of certificates, which are
+		// reloaded without restarting the server when they are updated.
+		CertSources []*certprovider.Spec `json:"certSources,omitempty" jsonschema:"omitempty"`
+
+		// TLSPolicy controls the TLS versions, cipher suites, curves,
+		// ALPN protocols, session tickets and OCSP stapling.
+		TLSPolicy *tlspolicy.Spec `json:"tlsPolicy,omitempty" jsonschema:"omitempty"`
+		HSTS      *HSTSSpec       `json:"hsts,omitempty" jsonschema:"omitempty"`
+
+		// HTTP/1.1 and HTTP/2 are also served on the TCP port when HTTP/3
+		// is enabled, and their responses advertise HTTP/3 by Alt-Svc,
+		// AltSvc overrides the max-age or disables it.
+		AltSvc *AltSvcSpec `json:"altSvc,omitempty" jsonschema:"omitempty"`
+		QUIC   *QUICSpec   `json:"quic,omitempty" jsonschema:"omitempty"`
+
 		RouterKind string `json:"routerKind,omitempty" jsonschema:"omitempty,enum=,enum=Ordered,enum=RadixTree"`
 
 		IPFilter *ipfilter.Spec `json:"ipFilter,omitempty" jsonschema:"omitempty"`
@@ -64,65 +89,193 @@ type (
 
 		AccessLogFormat string `json:"accessLogFormat" jsonshema:"omitempty"`
 	}
+
+	// AltSvcSpec describes the Alt-Svc header which advertises HTTP/3 in
+	// the HTTP/1.1 and HTTP/2 responses, only HTTP/3 is served if it is
+	// disabled.
+	AltSvcSpec struct {
+		Disabled bool   `json:"disabled,omitempty" jsonschema:"omitempty"`
+		MaxAge   string `json:"maxAge,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+
+	// QUICSpec describes the QUIC settings of HTTP/3, the window sizes are
+	// in bytes, and zero values mean the defaults of quic-go.
+	QUICSpec struct {
+		MaxIncomingStreams             int64  `json:"maxIncomingStreams,omitempty" jsonschema:"omitempty,minimum=1"`
+		MaxIncomingUniStreams          int64  `json:"maxIncomingUniStreams,omitempty" jsonschema:"omitempty,minimum=1"`
+		InitialStreamReceiveWindow     uint64 `json:"initialStreamReceiveWindow,omitempty" jsonschema:"omitempty"`
+		MaxStreamReceiveWindow         uint64 `json:"maxStreamReceiveWindow,omitempty" jsonschema:"omitempty"`
+		InitialConnectionReceiveWindow uint64 `json:"initialConnectionReceiveWindow,omitempty" jsonschema:"omitempty"`
+		MaxConnectionReceiveWindow     uint64 `json:"maxConnectionReceiveWindow,omitempty" jsonschema:"omitempty"`
+
+		// Allow0RTT accepts 0-RTT early data, requests in early data could
+		// be replayed, so only the requests of Allow0RTTMethods are handled
+		// and others are rejected with 425 (Too Early).
+		Allow0RTT        bool     `json:"allow0RTT,omitempty" jsonschema:"omitempty"`
+		Allow0RTTMethods []string `json:"allow0RTTMethods,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+	}
+
+	// HSTSSpec describes the Strict-Transport-Security header of the HTTPS
+	// responses.
+	HSTSSpec struct {
+		MaxAge            string `json:"maxAge" jsonschema:"required,format=duration"`
+		IncludeSubdomains bool   `json:"includeSubdomains,omitempty" jsonschema:"omitempty"`
+		Preload           bool   `json:"preload,omitempty" jsonschema:"omitempty"`
+	}
 )
 
+// hstsPreloadMinMaxAge is the minimum max-age required by the HSTS preload
+// list.
+const hstsPreloadMinMaxAge = 365 * 24 * time.Hour
+
+// defaultAltSvcMaxAge is the default max-age of the Alt-Svc header.
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// defaultAllow0RTTMethods are the methods allowed in 0-RTT early data by
+// default.
+var defaultAllow0RTTMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// Validate validates HSTSSpec.
+func (h *HSTSSpec) Validate() error {
+	maxAge, err := time.ParseDuration(h.MaxAge)
+	if err != nil {
+		return fmt.Errorf("invalid hsts maxAge: %v", err)
+	}
+	if h.Preload && (maxAge < hstsPreloadMinMaxAge || !h.IncludeSubdomains) {
+		return fmt.Errorf("hsts preload requires maxAge of at least 8760h and includeSubdomains")
+	}
+	return nil
+}
+
+// headerValue returns the value of the Strict-Transport-Security header.
+func (h *HSTSSpec) headerValue() string {
+	maxAge, _ := time.ParseDuration(h.MaxAge)
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if h.IncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if h.Preload {
+		value += "; preload"
+	}
+	return value
+}
+
+// Validate validates AltSvcSpec.
+func (a *AltSvcSpec) Validate() error {
+	if a.MaxAge == "" {
+		return nil
+	}
+	if _, err := time.ParseDuration(a.MaxAge); err != nil {
+		return fmt.Errorf("invalid altSvc maxAge: %v", err)
+	}
+	return nil
+}
+
+// headerValue returns the value of the Alt-Svc header, a nil AltSvcSpec
+// means the default one.
+func (a *AltSvcSpec) headerValue(port uint16) string {
+	maxAge := defaultAltSvcMaxAge
+	if a != nil && a.MaxAge != "" {
+		maxAge, _ = time.ParseDuration(a.MaxAge)
+	}
+	return fmt.Sprintf(`h3=":%d"; ma=%d`, port, int64(maxAge.Seconds()))
+}
+
+// Validate validates QUICSpec.
+func (q *QUICSpec) Validate() error {
+	if q.InitialStreamReceiveWindow > 0 && q.MaxStreamReceiveWindow > 0 &&
+		q.InitialStreamReceiveWindow > q.MaxStreamReceiveWindow {
+		return fmt.Errorf("initialStreamReceiveWindow is greater than maxStreamReceiveWindow")
+	}
+	if q.InitialConnectionReceiveWindow > 0 && q.MaxConnectionReceiveWindow > 0 &&
+		q.InitialConnectionReceiveWindow > q.MaxConnectionReceiveWindow {
+		return fmt.Errorf("initialConnectionReceiveWindow is greater than maxConnectionReceiveWindow")
+	}
+
+	if len(q.Allow0RTTMethods) > 0 && !q.Allow0RTT {
+		return fmt.Errorf("allow0RTTMethods is configured but allow0RTT is disabled")
+	}
+	// only safe methods are allowed as requests in early data could be
+	// replayed, see RFC 8470.
+	for _, m := range q.Allow0RTTMethods {
+		switch m {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		default:
+			return fmt.Errorf("method %s is not safe for 0-RTT", m)
+		}
+	}
+	return nil
+}
+
+// allow0RTTMethods returns the methods allowed in 0-RTT early data.
+func (q *QUICSpec) allow0RTTMethods() []string {
+	if len(q.Allow0RTTMethods) > 0 {
+		return q.Allow0RTTMethods
+	}
+	return defaultAllow0RTTMethods
+}
+
 // Validate validates HTTPServerSpec.
 func (spec *Spec) Validate() error {
+	if !spec.HTTP3 && (spec.AltSvc != nil || spec.QUIC != nil) {
+		return fmt.Errorf("http3 is disabled when altSvc or quic configured")
+	}
+
 	if !spec.HTTPS {
 		if spec.HTTP3 {
 			return fmt.Errorf("https is disabled when http3 enabled")
 		}
+		if spec.clientAuthActive() {
+			return fmt.Errorf("https is disabled when clientAuth enabled")
+		}
+		if spec.TLSPolicy != nil || spec.HSTS != nil {
+			return fmt.Errorf("https is disabled when tlsPolicy or hsts configured")
+		}
 		return nil
 	}
 
-	if spec.CertBase64 == "" && spec.KeyBase64 == "" && len(spec.Certs) == 0 && len(spec.Keys) == 0 && !spec.AutoCert {
-		return fmt.Errorf("certBase64/keyBase64, certs/keys are both empty and autocert is disabled when https enabled")
+	if spec.CertBase64 == "" && spec.KeyBase64 == "" && len(spec.Certs) == 0 && len(spec.Keys) == 0 &&
+		len(spec.CertSources) == 0 && !spec.AutoCert {
+		return fmt.Errorf("certBase64/keyBase64, certs/keys, certSources are all empty and autocert is disabled when https enabled")
 	}
-	_, err := spec.tlsConfig()
-	return err
-}
 
-func tryDecodeBase64Pem(pem string) []byte {
-	// The pem could in base64 encoding or plain text. It starts with '-' if it is
-	// in plain text, and '-' is not a valid character in standard base64 encoding.
-	// We first try to decode it as base64, and fallback to plain text if failed.
-	d, err := base64.StdEncoding.DecodeString(pem)
-	if err == nil {
-		return d
+	names := map[string]struct{}{}
+	for _, cs := range spec.CertSources {
+		if _, ok := names[cs.Name]; ok {
+			return fmt.Errorf("duplicated certSource name %s", cs.Name)
+		}
+		names[cs.Name] = struct{}{}
 	}
-	return []byte(pem)
-}
-
-func (spec *Spec) tlsConfig() (*tls.Config, error) {
-	var certificates []tls.Certificate
 
-	if spec.CertBase64 != "" && spec.KeyBase64 != "" {
-		// Prefer add CertBase64 and KeyBase64
-		certPem, _ := base64.StdEncoding.DecodeString(spec.CertBase64)
-		keyPem, _ := base64.StdEncoding.DecodeString(spec.KeyBase64)
-		cert, err := tls.X509KeyPair(certPem, keyPem)
-		if err != nil {
-			return nil, fmt.Errorf("generate x509 key pair failed: %v", err)
+	if p := spec.TLSPolicy; p != nil {
+		if spec.HTTP3 && p.MaxVersion != "" && p.MaxVersion != "TLS1.3" {
+			return fmt.Errorf("http3 requires TLS 1.3, but maxVersion of tlsPolicy is %s", p.MaxVersion)
+		}
+		// HTTP/2 is served on the TCP port when Alt-Svc is enabled.
+		if !spec.HTTP3 || spec.altSvcEnabled() {
+			if err := p.ValidateHTTP2(); err != nil {
+				return err
+			}
+		}
+		// 0-RTT resumes sessions with session tickets.
+		if spec.QUIC != nil && spec.QUIC.Allow0RTT && p.SessionTickets != nil && p.SessionTickets.Disabled {
+			return fmt.Errorf("allow0RTT requires session tickets, but they are disabled by tlsPolicy")
 		}
-		certificates = append(certificates, cert)
 	}
 
-	for k, v := range spec.Certs {
-		secret, exists := spec.Keys[k]
-		if !exists {
-			return nil, fmt.Errorf("certs %s hasn't secret corresponded to it", k)
-		}
+	_, err := spec.tlsConfig(nil)
+	return err
+}
 
-		certPem := tryDecodeBase64Pem(v)
-		keyPem := tryDecodeBase64Pem(secret)
-		cert, err := tls.X509KeyPair(certPem, keyPem)
-		if err != nil {
-			return nil, fmt.Errorf("generate x509 key pair for %s failed: %s ", k, err)
-		}
-		certificates = append(certificates, cert)
+// tlsConfig creates the TLS config, the certificates of certManager are
+// preferred if it is not nil.
+func (spec *Spec) tlsConfig(certManager *certprovider.Manager) (*tls.Config, error) {
+	certificates, err := tlsutil.LoadCertificates(spec.CertBase64, spec.KeyBase64, spec.Certs, spec.Keys)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(certificates) == 0 && !spec.AutoCert {
+	if len(certificates) == 0 && len(spec.CertSources) == 0 && !spec.AutoCert {
 		return nil, fmt.Errorf("none valid certs and secret")
 	}
 
@@ -136,6 +289,14 @@ func (spec *Spec) tlsConfig() (*tls.Config, error) {
 		NextProtos:   []string{"acme-tls/1"},
 	}
 	tlsConf.GetCertificate = func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// falls back to AutoCert and then the static certificates if
+		// none of the cert sources has a certificate for the server name.
+		if certManager != nil && !isACMEChallenge(chi) {
+			cert, err := certManager.GetCertificate(chi)
+			if cert != nil || err != nil {
+				return cert, err
+			}
+		}
 		return autocertmanager.GetCertificate(chi, !spec.AutoCert /* tokenOnly */)
 	}
 
@@ -148,7 +309,29 @@ func (spec *Spec) tlsConfig() (*tls.Config, error) {
 
 		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
 		tlsConf.ClientCAs = certPool
+	} else if spec.clientAuthActive() {
+		// the route is unknown in the TLS handshake, so the client
+		// certificates are verified for each request by its route.
+		tlsConf.ClientAuth = tls.RequestClientCert
 	}
 
 	return tlsConf, nil
 }
+
+// clientAuthActive returns whether the server or any of its routes
+// requires client certificates.
+func (spec *Spec) clientAuthActive() bool {
+	return spec.ClientAuth.Active() || spec.Rules.ClientAuthActive()
+}
+
+// altSvcEnabled returns whether HTTP/3 is advertised by Alt-Svc, and so
+// HTTP/1.1 and HTTP/2 are also served on the TCP port.
+func (spec *Spec) altSvcEnabled() bool {
+	return spec.HTTP3 && (spec.AltSvc == nil || !spec.AltSvc.Disabled)
+}
+
+// isACMEChallenge returns whether the TLS handshake is for a TLS-ALPN-01
+// challenge.
+func isACMEChallenge(chi *tls.ClientHelloInfo) bool {
+	return len(chi.SupportedProtos) == 1 && chi.SupportedProtos[0] == "acme-tls/1"
+}
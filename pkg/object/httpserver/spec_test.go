@@ -25,6 +25,7 @@ import (
 
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -234,7 +235,7 @@ rules: []`, validSpec: true, mTLSExpected: true,
 			}
 			assert.Nil(err)
 			spec := superSpec.ObjectSpec().(*Spec)
-			tlsConf, err := spec.tlsConfig()
+			tlsConf, err := spec.tlsConfig(nil)
 			assert.Nil(err)
 			assert.Equal(len(tlsConf.Certificates), 1)
 
@@ -248,3 +249,261 @@ rules: []`, validSpec: true, mTLSExpected: true,
 		})
 	}
 }
+
+func TestCertSourcesValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlConfig := `
+name: http-server-test
+kind: HTTPServer
+port: 10080
+https: true
+certSources:
+- name: file
+  file:
+    certFile: /etc/easegress/tls.crt
+    keyFile: /etc/easegress/tls.key
+- name: vault
+  vault:
+    address: http://127.0.0.1:8200
+    token: root
+    kvPath: secret/data/tls
+`
+	_, err := supervisor.NewSpec(yamlConfig)
+	assert.NoError(err)
+
+	_, err = supervisor.NewSpec(yamlConfig + `
+- name: file
+  kubernetesSecret:
+    namespace: default
+    name: tls
+`)
+	assert.ErrorContains(err, "duplicated certSource name file")
+
+	yamlConfig = `
+name: http-server-test
+kind: HTTPServer
+port: 10080
+https: true
+certSources:
+- name: file
+  file:
+    certFile: /etc/easegress/tls.crt
+`
+	_, err = supervisor.NewSpec(yamlConfig)
+	assert.Error(err)
+}
+
+func TestClientAuthSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	certs := tlsutiltest.NewCerts()
+	ca := tlsutiltest.Base64(certs.CACert)
+	yamlConfig := `
+name: http-server-test
+kind: HTTPServer
+port: 10080
+rules:
+- paths:
+  - path: /api
+    backend: api
+    clientAuth:
+      mode: required
+      caCerts: [` + ca + `]
+`
+	_, err := supervisor.NewSpec(yamlConfig)
+	assert.ErrorContains(err, "https is disabled when clientAuth enabled")
+
+	yamlConfig = fmt.Sprintf(`
+name: http-server-test
+kind: HTTPServer
+port: 10080
+https: true
+certBase64: %s
+keyBase64: %s
+rules:
+- paths:
+  - path: /api
+    backend: api
+`, tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ServerKey))
+	superSpec, err := supervisor.NewSpec(yamlConfig)
+	assert.NoError(err)
+	spec := superSpec.ObjectSpec().(*Spec)
+	tlsConf, err := spec.tlsConfig(nil)
+	assert.NoError(err)
+	assert.Equal(tls.NoClientCert, tlsConf.ClientAuth)
+
+	superSpec, err = supervisor.NewSpec(yamlConfig + `
+    clientAuth:
+      mode: verifyIfGiven
+      caCerts: [` + ca + `]
+`)
+	assert.NoError(err)
+	nextSpec := superSpec.ObjectSpec().(*Spec)
+	tlsConf, err = nextSpec.tlsConfig(nil)
+	assert.NoError(err)
+	assert.Equal(tls.RequestClientCert, tlsConf.ClientAuth)
+
+	r := &runtime{spec: spec}
+	assert.True(r.needRestartServer(nextSpec))
+
+	// the server needs not to be restarted if client certificates are
+	// still requested.
+	superSpec, err = supervisor.NewSpec(yamlConfig + `
+    clientAuth:
+      mode: required
+      caCerts: [` + ca + `]
+`)
+	assert.NoError(err)
+	r.spec = nextSpec
+	assert.False(r.needRestartServer(superSpec.ObjectSpec().(*Spec)))
+}
+
+func TestTLSPolicySpec(t *testing.T) {
+	assert := assert.New(t)
+
+	certs := tlsutiltest.NewCerts()
+	yamlConfig := fmt.Sprintf(`
+name: http-server-test
+kind: HTTPServer
+port: 10080
+https: true
+certBase64: %s
+keyBase64: %s
+`, tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ServerKey))
+
+	_, err := supervisor.NewSpec(yamlConfig + `
+tlsPolicy:
+  minVersion: TLS1.2
+  cipherSuites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]
+hsts:
+  maxAge: 8760h
+  includeSubdomains: true
+  preload: true
+`)
+	assert.NoError(err)
+
+	// HTTP/2 requires an AES-128-GCM cipher suite.
+	_, err = supervisor.NewSpec(yamlConfig + `
+tlsPolicy:
+  cipherSuites: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]
+`)
+	assert.ErrorContains(err, "HTTP/2 requires")
+
+	_, err = supervisor.NewSpec(yamlConfig + `
+http3: true
+tlsPolicy:
+  maxVersion: TLS1.2
+`)
+	assert.ErrorContains(err, "http3 requires TLS 1.3")
+
+	_, err = supervisor.NewSpec(yamlConfig + `
+hsts:
+  maxAge: 1h
+  preload: true
+`)
+	assert.ErrorContains(err, "hsts preload requires")
+
+	_, err = supervisor.NewSpec(strings.Replace(yamlConfig, "https: true", "https: false", 1) + `
+hsts:
+  maxAge: 1h
+`)
+	assert.ErrorContains(err, "https is disabled when tlsPolicy or hsts configured")
+
+	hsts := &HSTSSpec{MaxAge: "1h"}
+	assert.Equal("max-age=3600", hsts.headerValue())
+	hsts = &HSTSSpec{MaxAge: "8760h", IncludeSubdomains: true, Preload: true}
+	assert.Equal("max-age=31536000; includeSubDomains; preload", hsts.headerValue())
+}
+
+func TestHTTP3Spec(t *testing.T) {
+	assert := assert.New(t)
+
+	certs := tlsutiltest.NewCerts()
+	yamlConfig := fmt.Sprintf(`
+name: http-server-test
+kind: HTTPServer
+port: 10080
+https: true
+certBase64: %s
+keyBase64: %s
+`, tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ServerKey))
+
+	_, err := supervisor.NewSpec(yamlConfig + `
+http3: true
+altSvc:
+  maxAge: 1h
+quic:
+  maxIncomingStreams: 200
+  initialStreamReceiveWindow: 524288
+  maxStreamReceiveWindow: 6291456
+  allow0RTT: true
+  allow0RTTMethods: [GET, HEAD]
+`)
+	assert.NoError(err)
+
+	_, err = supervisor.NewSpec(yamlConfig + `
+altSvc:
+  maxAge: 1h
+`)
+	assert.ErrorContains(err, "http3 is disabled")
+
+	_, err = supervisor.NewSpec(yamlConfig + `
+http3: true
+quic:
+  initialConnectionReceiveWindow: 2048
+  maxConnectionReceiveWindow: 1024
+`)
+	assert.ErrorContains(err, "initialConnectionReceiveWindow is greater")
+
+	_, err = supervisor.NewSpec(yamlConfig + `
+http3: true
+quic:
+  allow0RTT: true
+  allow0RTTMethods: [GET, POST]
+`)
+	assert.ErrorContains(err, "method POST is not safe for 0-RTT")
+
+	_, err = supervisor.NewSpec(yamlConfig + `
+http3: true
+quic:
+  allow0RTT: true
+tlsPolicy:
+  sessionTickets:
+    disabled: true
+`)
+	assert.ErrorContains(err, "allow0RTT requires session tickets")
+
+	// HTTP/2 is served on the TCP port with Alt-Svc, which is enabled by
+	// default.
+	_, err = supervisor.NewSpec(yamlConfig + `
+http3: true
+tlsPolicy:
+  cipherSuites: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]
+`)
+	assert.ErrorContains(err, "HTTP/2 requires")
+
+	// only HTTP/3 is served if Alt-Svc is disabled.
+	_, err = supervisor.NewSpec(yamlConfig + `
+http3: true
+altSvc:
+  disabled: true
+tlsPolicy:
+  cipherSuites: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]
+`)
+	assert.NoError(err)
+
+	assert.True((&Spec{HTTP3: true}).altSvcEnabled())
+	assert.True((&Spec{HTTP3: true, AltSvc: &AltSvcSpec{MaxAge: "1m"}}).altSvcEnabled())
+	assert.False((&Spec{HTTP3: true, AltSvc: &AltSvcSpec{Disabled: true}}).altSvcEnabled())
+	assert.False((&Spec{}).altSvcEnabled())
+
+	assert.Equal(`h3=":443"; ma=86400`, (*AltSvcSpec)(nil).headerValue(443))
+	assert.Equal(`h3=":443"; ma=86400`, (&AltSvcSpec{}).headerValue(443))
+	assert.Equal(`h3=":8443"; ma=60`, (&AltSvcSpec{MaxAge: "1m"}).headerValue(8443))
+
+	q := &QUICSpec{Allow0RTT: true}
+	assert.Equal([]string{"GET", "HEAD", "OPTIONS"}, q.allow0RTTMethods())
+	q.Allow0RTTMethods = []string{"GET"}
+	assert.Equal([]string{"GET"}, q.allow0RTTMethods())
+}
@@ -0,0 +1,361 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkaconsumer
+
+import (
+	stdcontext "context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/protocols/mqttprot"
+	"github.com/megaease/easegress/pkg/tracing"
+)
+
+const (
+	headerTopic     = "X-Kafka-Topic"
+	headerPartition = "X-Kafka-Partition"
+	headerOffset    = "X-Kafka-Offset"
+	headerKey       = "X-Kafka-Key"
+
+	// headers of the dead letters.
+	headerDeadLetterTopic     = "dead-letter-topic"
+	headerDeadLetterPartition = "dead-letter-partition"
+	headerDeadLetterOffset    = "dead-letter-offset"
+	headerDeadLetterError     = "dead-letter-error"
+)
+
+type (
+	// groupHandler handles the messages of the partitions claimed by the
+	// consumer group.
+	groupHandler struct {
+		consumer *KafkaConsumer
+	}
+
+	// offsetTracker marks the offsets of a partition in order when the
+	// messages are processed concurrently, an offset is marked only after
+	// all the messages before it are processed.
+	offsetTracker struct {
+		sync.Mutex
+		session sarama.ConsumerGroupSession
+		pending []*trackedMessage
+	}
+
+	trackedMessage struct {
+		msg  *sarama.ConsumerMessage
+		done bool
+	}
+
+	// client is the MQTT client of the publish packets converted from
+	// Kafka messages.
+	client struct {
+		clientID string
+		kvMap    sync.Map
+	}
+)
+
+var _ sarama.ConsumerGroupHandler = (*groupHandler)(nil)
+
+// Setup is run at the beginning of a new session.
+func (h *groupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is run at the end of a session.
+func (h *groupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim processes the messages of a partition, at most concurrency
+// messages are processed at the same time.
+func (h *groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	concurrency := h.consumer.spec.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	tracker := &offsetTracker{session: session}
+	ctx := session.Context()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case sem <- struct{}{}:
+			}
+
+			tm := tracker.add(msg)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if h.consumer.handleMessage(ctx, msg) {
+					tracker.done(tm)
+				}
+				<-sem
+			}()
+		}
+	}
+}
+
+func (t *offsetTracker) add(msg *sarama.ConsumerMessage) *trackedMessage {
+	t.Lock()
+	defer t.Unlock()
+	tm := &trackedMessage{msg: msg}
+	t.pending = append(t.pending, tm)
+	return tm
+}
+
+func (t *offsetTracker) done(tm *trackedMessage) {
+	t.Lock()
+	defer t.Unlock()
+	tm.done = true
+
+	var last *sarama.ConsumerMessage
+	for len(t.pending) > 0 && t.pending[0].done {
+		last = t.pending[0].msg
+		t.pending = t.pending[1:]
+	}
+	if last != nil {
+		t.session.MarkMessage(last, "")
+	}
+}
+
+// handleMessage handles the message with the pipeline, and retries with
+// backoff if failed. The message is sent to the dead letter topic if all
+// the retries failed. It returns true if the offset of the message can be
+// committed.
+func (c *KafkaConsumer) handleMessage(ctx stdcontext.Context, msg *sarama.ConsumerMessage) bool {
+	atomic.AddUint64(&c.consumed, 1)
+
+	backoff := c.backoff
+	var err error
+	for i := 0; ; i++ {
+		if err = c.runPipeline(msg); err == nil {
+			return true
+		}
+		if i >= c.maxRetries {
+			break
+		}
+		logger.Warnf("%s handle message %s/%d/%d failed, retry in %v: %v",
+			c.superSpec.Name(), msg.Topic, msg.Partition, msg.Offset, backoff, err)
+		if !sleep(ctx, backoff) {
+			return false
+		}
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+
+	atomic.AddUint64(&c.failed, 1)
+	logger.Errorf("%s handle message %s/%d/%d failed: %v", c.superSpec.Name(), msg.Topic, msg.Partition, msg.Offset, err)
+	if c.spec.DeadLetterTopic == "" {
+		return true
+	}
+
+	// dead letters must not be lost, so the message is not committed
+	// until it is sent to the dead letter topic.
+	for {
+		dlErr := c.sendDeadLetter(msg, err)
+		if dlErr == nil {
+			atomic.AddUint64(&c.deadLettered, 1)
+			return true
+		}
+		logger.Errorf("%s send message %s/%d/%d to dead letter topic %s failed: %v",
+			c.superSpec.Name(), msg.Topic, msg.Partition, msg.Offset, c.spec.DeadLetterTopic, dlErr)
+		if !sleep(ctx, c.maxBackoff) {
+			return false
+		}
+	}
+}
+
+func sleep(ctx stdcontext.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (c *KafkaConsumer) sendDeadLetter(msg *sarama.ConsumerMessage, cause error) error {
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+4)
+	for _, h := range msg.Headers {
+		headers = append(headers, *h)
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte(headerDeadLetterTopic), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte(headerDeadLetterPartition), Value: []byte(strconv.Itoa(int(msg.Partition)))},
+		sarama.RecordHeader{Key: []byte(headerDeadLetterOffset), Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		sarama.RecordHeader{Key: []byte(headerDeadLetterError), Value: []byte(cause.Error())},
+	)
+
+	dl := &sarama.ProducerMessage{
+		Topic:   c.spec.DeadLetterTopic,
+		Headers: headers,
+		Value:   sarama.ByteEncoder(msg.Value),
+	}
+	if msg.Key != nil {
+		dl.Key = sarama.ByteEncoder(msg.Key)
+	}
+	_, _, err := c.producer.SendMessage(dl)
+	return err
+}
+
+// runPipeline converts the message to a request, and handles it with the
+// pipeline, a non-empty result of the pipeline is a failure.
+func (c *KafkaConsumer) runPipeline(msg *sarama.ConsumerMessage) error {
+	pipeline, ok := getPipeline(c.superSpec.Super(), c.spec.Pipeline)
+	if !ok {
+		return fmt.Errorf("pipeline %s not found", c.spec.Pipeline)
+	}
+
+	if c.spec.Protocol == protocolMQTT {
+		return c.runMQTTPipeline(pipeline, msg)
+	}
+	return c.runHTTPPipeline(pipeline, msg)
+}
+
+func (c *KafkaConsumer) runHTTPPipeline(pipeline context.Handler, msg *sarama.ConsumerMessage) error {
+	method, path := http.MethodPost, "/"
+	if c.spec.HTTP != nil {
+		if c.spec.HTTP.Method != "" {
+			method = c.spec.HTTP.Method
+		}
+		if c.spec.HTTP.Path != "" {
+			path = c.spec.HTTP.Path
+		}
+	}
+
+	stdr, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return err
+	}
+	for _, h := range msg.Headers {
+		stdr.Header.Add(string(h.Key), string(h.Value))
+	}
+	stdr.Header.Set(headerTopic, msg.Topic)
+	stdr.Header.Set(headerPartition, strconv.Itoa(int(msg.Partition)))
+	stdr.Header.Set(headerOffset, strconv.FormatInt(msg.Offset, 10))
+	if msg.Key != nil {
+		stdr.Header.Set(headerKey, string(msg.Key))
+	}
+
+	req, err := httpprot.NewRequest(stdr)
+	if err != nil {
+		return err
+	}
+	req.SetPayload(msg.Value)
+
+	ctx := context.New(tracing.NoopSpan)
+	defer ctx.Finish()
+	ctx.SetInputRequest(req)
+
+	if result := pipeline.Handle(ctx); result != "" {
+		return fmt.Errorf("pipeline result %s", result)
+	}
+	if resp, ok := ctx.GetOutputResponse().(*httpprot.Response); ok && resp.StatusCode() >= 400 {
+		return fmt.Errorf("pipeline status code %d", resp.StatusCode())
+	}
+	return nil
+}
+
+func (c *KafkaConsumer) runMQTTPipeline(pipeline context.Handler, msg *sarama.ConsumerMessage) error {
+	publisher, ok := getMQTTPublisher(c.superSpec.Super(), c.spec.MQTT.MQTTProxy)
+	if !ok {
+		return fmt.Errorf("mqtt proxy %s not found", c.spec.MQTT.MQTTProxy)
+	}
+
+	packet := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	packet.TopicName = c.spec.MQTT.Topic
+	if packet.TopicName == "" {
+		packet.TopicName = msg.Topic
+	}
+	packet.Qos = c.spec.MQTT.QoS
+	packet.Payload = msg.Value
+
+	clientID := c.superSpec.Name()
+	req := mqttprot.NewRequest(packet, &client{clientID: clientID})
+	props := make([]mqttprot.UserProperty, 0, len(msg.Headers))
+	for _, h := range msg.Headers {
+		props = append(props, mqttprot.UserProperty{Key: string(h.Key), Value: string(h.Value)})
+	}
+	req.SetUserProperties(props)
+
+	ctx := context.New(tracing.NoopSpan)
+	defer ctx.Finish()
+	ctx.SetInputRequest(req)
+	resp := mqttprot.NewResponse()
+	ctx.SetOutputResponse(resp)
+
+	if result := pipeline.Handle(ctx); result != "" {
+		return fmt.Errorf("pipeline result %s", result)
+	}
+	// the message is dropped by the pipeline on purpose, it is not a
+	// failure.
+	if resp.Drop() {
+		return nil
+	}
+
+	packet = req.PublishPacket()
+	publisher.Publish(clientID, packet.TopicName, packet.Payload, packet.Qos, req.UserProperties())
+	return nil
+}
+
+var _ mqttprot.Client = (*client)(nil)
+
+// ClientID returns the client ID.
+func (c *client) ClientID() string {
+	return c.clientID
+}
+
+// UserName returns the user name, which is empty.
+func (c *client) UserName() string {
+	return ""
+}
+
+// Load loads the value of the key.
+func (c *client) Load(key interface{}) (interface{}, bool) {
+	return c.kvMap.Load(key)
+}
+
+// Store stores the key value pair.
+func (c *client) Store(key interface{}, value interface{}) {
+	c.kvMap.Store(key, value)
+}
+
+// Delete deletes the key.
+func (c *client) Delete(key interface{}) {
+	c.kvMap.Delete(key)
+}
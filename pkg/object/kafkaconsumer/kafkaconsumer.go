@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kafkaconsumer implements the KafkaConsumer, which consumes Kafka
+// messages and handles them with a pipeline.
+package kafkaconsumer
+
+import (
+	stdcontext "context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/megaease/easegress/pkg/api"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/object/mqttproxy"
+	"github.com/megaease/easegress/pkg/object/trafficcontroller"
+	"github.com/megaease/easegress/pkg/protocols/mqttprot"
+	"github.com/megaease/easegress/pkg/supervisor"
+)
+
+const (
+	// Category is the category of KafkaConsumer.
+	Category = supervisor.CategoryBusinessController
+
+	// Kind is the kind of KafkaConsumer.
+	Kind = "KafkaConsumer"
+
+	// namespace is the namespace of the pipelines and MQTTProxies.
+	namespace = "default"
+
+	reconnectInterval = 5 * time.Second
+)
+
+func init() {
+	supervisor.Register(&KafkaConsumer{})
+	api.RegisterObject(&api.APIResource{
+		Kind:    Kind,
+		Name:    strings.ToLower(Kind),
+		Aliases: []string{"kc"},
+	})
+}
+
+type (
+	// KafkaConsumer is Object KafkaConsumer.
+	KafkaConsumer struct {
+		superSpec *supervisor.Spec
+		spec      *Spec
+
+		backoff    time.Duration
+		maxBackoff time.Duration
+		maxRetries int
+
+		producer sarama.SyncProducer
+
+		cancel stdcontext.CancelFunc
+		wg     sync.WaitGroup
+
+		consumed     uint64
+		failed       uint64
+		deadLettered uint64
+	}
+
+	// Status is the status of KafkaConsumer.
+	Status struct {
+		Consumed     uint64 `json:"consumed"`
+		Failed       uint64 `json:"failed"`
+		DeadLettered uint64 `json:"deadLettered"`
+	}
+
+	// mqttPublisher publishes messages to MQTT clients, it is implemented
+	// by MQTTProxy.
+	mqttPublisher interface {
+		Publish(clientID, topic string, payload []byte, qos byte, userProperties []mqttprot.UserProperty)
+	}
+)
+
+var (
+	newConsumerGroup = sarama.NewConsumerGroup
+	newSyncProducer  = sarama.NewSyncProducer
+)
+
+var getPipeline = func(super *supervisor.Supervisor, name string) (context.Handler, bool) {
+	tc, ok := getTrafficController(super)
+	if !ok {
+		return nil, false
+	}
+	entity, ok := tc.GetPipeline(namespace, name)
+	if !ok {
+		return nil, false
+	}
+	handler, ok := entity.Instance().(context.Handler)
+	return handler, ok
+}
+
+var getMQTTPublisher = func(super *supervisor.Supervisor, name string) (mqttPublisher, bool) {
+	tc, ok := getTrafficController(super)
+	if !ok {
+		return nil, false
+	}
+	entity, ok := tc.GetTrafficGate(namespace, name)
+	if !ok {
+		return nil, false
+	}
+	publisher, ok := entity.Instance().(*mqttproxy.MQTTProxy)
+	return publisher, ok
+}
+
+func getTrafficController(super *supervisor.Supervisor) (*trafficcontroller.TrafficController, bool) {
+	entity, ok := super.GetSystemController(trafficcontroller.Kind)
+	if !ok {
+		return nil, false
+	}
+	tc, ok := entity.Instance().(*trafficcontroller.TrafficController)
+	return tc, ok
+}
+
+// Category returns the category of KafkaConsumer.
+func (c *KafkaConsumer) Category() supervisor.ObjectCategory {
+	return Category
+}
+
+// Kind returns the kind of KafkaConsumer.
+func (c *KafkaConsumer) Kind() string {
+	return Kind
+}
+
+// DefaultSpec returns the default spec of KafkaConsumer.
+func (c *KafkaConsumer) DefaultSpec() interface{} {
+	return &Spec{
+		Protocol:      protocolHTTP,
+		InitialOffset: initialOffsetNewest,
+		Concurrency:   1,
+		Retry: &RetrySpec{
+			MaxRetries: 3,
+			Backoff:    "1s",
+			MaxBackoff: "30s",
+		},
+	}
+}
+
+// Init initializes KafkaConsumer.
+func (c *KafkaConsumer) Init(superSpec *supervisor.Spec) {
+	c.superSpec, c.spec = superSpec, superSpec.ObjectSpec().(*Spec)
+	c.reload()
+}
+
+// Inherit inherits previous generation of KafkaConsumer.
+func (c *KafkaConsumer) Inherit(superSpec *supervisor.Spec, previousGeneration supervisor.Object) {
+	previousGeneration.Close()
+	c.Init(superSpec)
+}
+
+func (c *KafkaConsumer) reload() {
+	c.backoff, c.maxBackoff = time.Second, 30*time.Second
+	if c.spec.Retry != nil {
+		c.maxRetries = c.spec.Retry.MaxRetries
+		c.backoff, c.maxBackoff, _ = c.spec.Retry.backoff()
+	}
+
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	c.cancel = cancel
+	c.wg.Add(1)
+	go c.run(ctx)
+}
+
+func (c *KafkaConsumer) newConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = c.superSpec.Name()
+	if err := c.spec.ClientSpec.Apply(config); err != nil {
+		return nil, err
+	}
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	if c.spec.InitialOffset == initialOffsetOldest {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+	// dead letters are sent synchronously, and must not be lost.
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	return config, nil
+}
+
+// connect creates the consumer group, and the producer of dead letters,
+// it retries until succeeded or the KafkaConsumer is closed.
+func (c *KafkaConsumer) connect(ctx stdcontext.Context) sarama.ConsumerGroup {
+	for {
+		group, err := c.newConsumerGroup()
+		if err == nil {
+			return group
+		}
+		logger.Errorf("%s connect to kafka %v failed: %v", c.superSpec.Name(), c.spec.Backend, err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+func (c *KafkaConsumer) newConsumerGroup() (sarama.ConsumerGroup, error) {
+	config, err := c.newConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.spec.DeadLetterTopic != "" && c.producer == nil {
+		producer, err := newSyncProducer(c.spec.Backend, config)
+		if err != nil {
+			return nil, err
+		}
+		c.producer = producer
+	}
+
+	return newConsumerGroup(c.spec.Backend, c.spec.GroupID, config)
+}
+
+func (c *KafkaConsumer) run(ctx stdcontext.Context) {
+	defer c.wg.Done()
+
+	group := c.connect(ctx)
+	if group == nil {
+		return
+	}
+	defer func() {
+		if err := group.Close(); err != nil {
+			logger.Errorf("%s close consumer group failed: %v", c.superSpec.Name(), err)
+		}
+	}()
+
+	go func() {
+		for err := range group.Errors() {
+			logger.Errorf("%s consume failed: %v", c.superSpec.Name(), err)
+		}
+	}()
+
+	handler := &groupHandler{consumer: c}
+	for {
+		// Consume returns when the partitions are rebalanced, so it is
+		// called in a loop to join the group again.
+		err := group.Consume(ctx, c.spec.Topics, handler)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Errorf("%s consume topics %v failed: %v", c.superSpec.Name(), c.spec.Topics, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(reconnectInterval):
+			}
+		}
+	}
+}
+
+// Status returns the status of KafkaConsumer.
+func (c *KafkaConsumer) Status() *supervisor.Status {
+	return &supervisor.Status{
+		ObjectStatus: &Status{
+			Consumed:     atomic.LoadUint64(&c.consumed),
+			Failed:       atomic.LoadUint64(&c.failed),
+			DeadLettered: atomic.LoadUint64(&c.deadLettered),
+		},
+	}
+}
+
+// Close closes KafkaConsumer.
+func (c *KafkaConsumer) Close() {
+	c.cancel()
+	c.wg.Wait()
+	if c.producer != nil {
+		if err := c.producer.Close(); err != nil {
+			logger.Errorf("%s close producer failed: %v", c.superSpec.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkaconsumer
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/httpprot"
+	"github.com/megaease/easegress/pkg/protocols/mqttprot"
+	"github.com/megaease/easegress/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	logger.InitNop()
+}
+
+type handlerFunc func(ctx *context.Context) string
+
+func (f handlerFunc) Handle(ctx *context.Context) string {
+	return f(ctx)
+}
+
+type mockPublisher struct {
+	sync.Mutex
+	topics   []string
+	payloads []string
+	props    [][]mqttprot.UserProperty
+}
+
+func (p *mockPublisher) Publish(clientID, topic string, payload []byte, qos byte, userProperties []mqttprot.UserProperty) {
+	p.Lock()
+	defer p.Unlock()
+	p.topics = append(p.topics, topic)
+	p.payloads = append(p.payloads, string(payload))
+	p.props = append(p.props, userProperties)
+}
+
+type mockSession struct {
+	sarama.ConsumerGroupSession
+	sync.Mutex
+	marked []int64
+}
+
+func (s *mockSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.Lock()
+	defer s.Unlock()
+	s.marked = append(s.marked, msg.Offset)
+}
+
+func setPipeline(handler handlerFunc) {
+	getPipeline = func(super *supervisor.Supervisor, name string) (context.Handler, bool) {
+		if handler == nil {
+			return nil, false
+		}
+		return handler, true
+	}
+}
+
+func newConsumer(t *testing.T, yamlConfig string) *KafkaConsumer {
+	superSpec, err := supervisor.NewSpec(yamlConfig)
+	assert.Nil(t, err)
+	c := &KafkaConsumer{superSpec: superSpec, spec: superSpec.ObjectSpec().(*Spec)}
+	c.backoff, c.maxBackoff, _ = c.spec.Retry.backoff()
+	c.maxRetries = c.spec.Retry.MaxRetries
+	return c
+}
+
+func TestSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &KafkaConsumer{}
+	assert.EqualValues(Category, c.Category())
+	assert.Equal(Kind, c.Kind())
+
+	valid := []*Spec{
+		{},
+		{Protocol: protocolHTTP, HTTP: &HTTPSpec{Method: http.MethodPut}},
+		{Protocol: protocolMQTT, MQTT: &MQTTSpec{MQTTProxy: "mqtt-proxy", QoS: 1}},
+		{Retry: &RetrySpec{Backoff: "100ms", MaxBackoff: "1s"}},
+	}
+	for _, spec := range valid {
+		assert.Nil(spec.Validate(), "%+v", spec)
+	}
+
+	invalid := []*Spec{
+		{Protocol: "amqp"},
+		{HTTP: &HTTPSpec{Method: "FETCH"}},
+		{Protocol: protocolMQTT},
+		{Protocol: protocolMQTT, MQTT: &MQTTSpec{MQTTProxy: "mqtt-proxy", QoS: 3}},
+		{Retry: &RetrySpec{Backoff: "1"}},
+	}
+	for _, spec := range invalid {
+		assert.NotNil(spec.Validate(), "%+v", spec)
+	}
+
+	backoff, maxBackoff, err := (&RetrySpec{Backoff: "2s", MaxBackoff: "1s"}).backoff()
+	assert.Nil(err)
+	assert.Equal(2*time.Second, backoff)
+	assert.Equal(2*time.Second, maxBackoff)
+}
+
+func TestOffsetTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	session := &mockSession{}
+	tracker := &offsetTracker{session: session}
+	var tms []*trackedMessage
+	for i := 0; i < 4; i++ {
+		tms = append(tms, tracker.add(&sarama.ConsumerMessage{Offset: int64(i)}))
+	}
+
+	tracker.done(tms[1])
+	assert.Empty(session.marked)
+	tracker.done(tms[0])
+	assert.Equal([]int64{1}, session.marked)
+	tracker.done(tms[3])
+	assert.Equal([]int64{1}, session.marked)
+	tracker.done(tms[2])
+	assert.Equal([]int64{1, 3}, session.marked)
+}
+
+func TestHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newConsumer(t, `
+kind: KafkaConsumer
+name: kafka-consumer
+backend: ["127.0.0.1:9092"]
+groupID: group
+topics: [topic]
+pipeline: pipeline
+http:
+  method: PUT
+  path: /events
+retry:
+  maxRetries: 2
+  backoff: 10ms
+`)
+
+	var body string
+	var header http.Header
+	status := http.StatusOK
+	setPipeline(func(ctx *context.Context) string {
+		req := ctx.GetInputRequest().(*httpprot.Request)
+		assert.Equal(http.MethodPut, req.Method())
+		assert.Equal("/events", req.Path())
+		data, _ := io.ReadAll(req.GetPayload())
+		body, header = string(data), req.Std().Header
+
+		resp, _ := httpprot.NewResponse(nil)
+		resp.SetStatusCode(status)
+		ctx.SetOutputResponse(resp)
+		return ""
+	})
+
+	msg := &sarama.ConsumerMessage{
+		Topic:     "topic",
+		Partition: 1,
+		Offset:    10,
+		Key:       []byte("key"),
+		Value:     []byte("value"),
+		Headers:   []*sarama.RecordHeader{{Key: []byte("X-Trace"), Value: []byte("trace")}},
+	}
+	assert.Nil(c.runPipeline(msg))
+	assert.Equal("value", body)
+	assert.Equal("topic", header.Get(headerTopic))
+	assert.Equal("1", header.Get(headerPartition))
+	assert.Equal("10", header.Get(headerOffset))
+	assert.Equal("key", header.Get(headerKey))
+	assert.Equal("trace", header.Get("X-Trace"))
+
+	status = http.StatusServiceUnavailable
+	assert.NotNil(c.runPipeline(msg))
+
+	// failed after retries, and committed without dead letter topic
+	start := time.Now()
+	assert.True(c.handleMessage(stdcontext.Background(), msg))
+	assert.True(time.Since(start) >= 30*time.Millisecond)
+	assert.Equal(uint64(1), c.Status().ObjectStatus.(*Status).Failed)
+
+	setPipeline(func(ctx *context.Context) string {
+		return "failed"
+	})
+	assert.NotNil(c.runPipeline(msg))
+
+	setPipeline(nil)
+	assert.NotNil(c.runPipeline(msg))
+}
+
+func TestMQTT(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newConsumer(t, `
+kind: KafkaConsumer
+name: kafka-consumer
+backend: ["127.0.0.1:9092"]
+groupID: group
+topics: [topic]
+pipeline: pipeline
+protocol: mqtt
+mqtt:
+  mqttProxy: mqtt-proxy
+  topic: devices/events
+  qos: 1
+`)
+
+	publisher := &mockPublisher{}
+	getMQTTPublisher = func(super *supervisor.Supervisor, name string) (mqttPublisher, bool) {
+		return publisher, name == "mqtt-proxy"
+	}
+
+	drop := false
+	setPipeline(func(ctx *context.Context) string {
+		req := ctx.GetInputRequest().(*mqttprot.Request)
+		assert.Equal("kafka-consumer", req.Client().ClientID())
+		assert.Equal("devices/events", req.PublishPacket().TopicName)
+		assert.Equal(byte(1), req.PublishPacket().Qos)
+		req.PublishPacket().TopicName = "devices/1/events"
+		req.SetPayload([]byte("new value"))
+		if drop {
+			ctx.GetOutputResponse().(*mqttprot.Response).SetDrop()
+		}
+		return ""
+	})
+
+	msg := &sarama.ConsumerMessage{
+		Topic:   "topic",
+		Value:   []byte("value"),
+		Headers: []*sarama.RecordHeader{{Key: []byte("k"), Value: []byte("v")}},
+	}
+	assert.Nil(c.runPipeline(msg))
+	assert.Equal([]string{"devices/1/events"}, publisher.topics)
+	assert.Equal([]string{"new value"}, publisher.payloads)
+	assert.Equal([]mqttprot.UserProperty{{Key: "k", Value: "v"}}, publisher.props[0])
+
+	// dropped by the pipeline
+	drop = true
+	assert.Nil(c.runPipeline(msg))
+	assert.Equal(1, len(publisher.topics))
+
+	c.spec.MQTT.MQTTProxy = "not-exist"
+	assert.NotNil(c.runPipeline(msg))
+}
+
+func TestConsume(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := sarama.NewMockBroker(t, 0)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("topic", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("topic", 0, sarama.OffsetOldest, 0).
+			SetOffset("topic", 0, sarama.OffsetNewest, 4),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"HeartbeatRequest": sarama.NewMockHeartbeatResponse(t),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).SetGroupProtocol(sarama.RangeBalanceStrategyName),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).SetMemberAssignment(
+			&sarama.ConsumerGroupMemberAssignment{
+				Topics: map[string][]int32{"topic": {0}},
+			}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "topic", 0, 0, "", sarama.ErrNoError).
+			SetError(sarama.ErrNoError),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 4).
+			SetMessage("topic", 0, 0, sarama.StringEncoder("m0")).
+			SetMessage("topic", 0, 1, sarama.StringEncoder("poison")).
+			SetMessage("topic", 0, 2, sarama.StringEncoder("m2")).
+			SetMessage("topic", 0, 3, sarama.StringEncoder("m3")),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+	})
+
+	var producer *mocks.SyncProducer
+	newSyncProducer = func(addrs []string, config *sarama.Config) (sarama.SyncProducer, error) {
+		producer = mocks.NewSyncProducer(t, config)
+		producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+			if string(val) != "poison" {
+				return fmt.Errorf("unexpected dead letter %s", val)
+			}
+			return nil
+		})
+		return producer, nil
+	}
+	defer func() { newSyncProducer = sarama.NewSyncProducer }()
+
+	var mutex sync.Mutex
+	var handled []string
+	setPipeline(func(ctx *context.Context) string {
+		data, _ := io.ReadAll(ctx.GetInputRequest().GetPayload())
+		mutex.Lock()
+		defer mutex.Unlock()
+		handled = append(handled, string(data))
+		if string(data) == "poison" {
+			return "failed"
+		}
+		return ""
+	})
+
+	superSpec, err := supervisor.NewSpec(fmt.Sprintf(`
+kind: KafkaConsumer
+name: kafka-consumer
+kafkaVersion: 2.0.0
+backend: [%q]
+groupID: group
+topics: [topic]
+initialOffset: oldest
+pipeline: pipeline
+concurrency: 4
+deadLetterTopic: dead-letters
+retry:
+  maxRetries: 1
+  backoff: 10ms
+`, broker.Addr()))
+	assert.Nil(err)
+	c := &KafkaConsumer{}
+	c.Init(superSpec)
+
+	assert.Eventually(func() bool {
+		status := c.Status().ObjectStatus.(*Status)
+		return status.DeadLettered == 1 && status.Consumed == 4
+	}, 10*time.Second, 10*time.Millisecond)
+	c.Close()
+	assert.Nil(producer.Close())
+
+	mutex.Lock()
+	assert.ElementsMatch([]string{"m0", "poison", "poison", "m2", "m3"}, handled)
+	mutex.Unlock()
+
+	// all the offsets are committed, including the poison message.
+	var committed int64 = -1
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			if offset, _, err := req.Offset("topic", 0); err == nil {
+				committed = offset
+			}
+		}
+	}
+	assert.Equal(int64(4), committed)
+}
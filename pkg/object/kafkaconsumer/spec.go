@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkaconsumer
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/kafkahelper"
+)
+
+const (
+	protocolHTTP = "http"
+	protocolMQTT = "mqtt"
+
+	initialOffsetNewest = "newest"
+	initialOffsetOldest = "oldest"
+)
+
+type (
+	// Spec describes the KafkaConsumer.
+	Spec struct {
+		kafkahelper.ClientSpec `json:",inline"`
+
+		Backend       []string `json:"backend" jsonschema:"required,uniqueItems=true"`
+		GroupID       string   `json:"groupID" jsonschema:"required"`
+		Topics        []string `json:"topics" jsonschema:"required,uniqueItems=true"`
+		InitialOffset string   `json:"initialOffset,omitempty" jsonschema:"omitempty,enum=,enum=newest,enum=oldest"`
+
+		Pipeline string    `json:"pipeline" jsonschema:"required"`
+		Protocol string    `json:"protocol,omitempty" jsonschema:"omitempty,enum=,enum=http,enum=mqtt"`
+		HTTP     *HTTPSpec `json:"http,omitempty" jsonschema:"omitempty"`
+		MQTT     *MQTTSpec `json:"mqtt,omitempty" jsonschema:"omitempty"`
+
+		// Concurrency is the max number of messages of a partition which
+		// are processed at the same time, offsets are always committed in
+		// order.
+		Concurrency     int        `json:"concurrency,omitempty" jsonschema:"omitempty,minimum=1"`
+		Retry           *RetrySpec `json:"retry,omitempty" jsonschema:"omitempty"`
+		DeadLetterTopic string     `json:"deadLetterTopic,omitempty" jsonschema:"omitempty"`
+	}
+
+	// HTTPSpec describes the HTTP requests converted from Kafka messages.
+	HTTPSpec struct {
+		Method string `json:"method,omitempty" jsonschema:"omitempty"`
+		Path   string `json:"path,omitempty" jsonschema:"omitempty"`
+	}
+
+	// MQTTSpec describes the MQTT publish packets converted from Kafka
+	// messages, the packets are sent to the clients of the MQTTProxy
+	// after the pipeline succeeds.
+	MQTTSpec struct {
+		MQTTProxy string `json:"mqttProxy" jsonschema:"required"`
+		// Topic is the MQTT topic, default is the Kafka topic.
+		Topic string `json:"topic,omitempty" jsonschema:"omitempty"`
+		QoS   byte   `json:"qos,omitempty" jsonschema:"omitempty,minimum=0,maximum=2"`
+	}
+
+	// RetrySpec describes the retry of failed messages, the backoff is
+	// doubled after each retry, and is capped by maxBackoff.
+	RetrySpec struct {
+		MaxRetries int    `json:"maxRetries" jsonschema:"omitempty,minimum=0"`
+		Backoff    string `json:"backoff,omitempty" jsonschema:"omitempty,format=duration"`
+		MaxBackoff string `json:"maxBackoff,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+)
+
+// Validate validates Spec itself.
+func (spec *Spec) Validate() error {
+	if err := spec.ClientSpec.Validate(); err != nil {
+		return err
+	}
+
+	switch spec.Protocol {
+	case "", protocolHTTP:
+		if spec.HTTP != nil && spec.HTTP.Method != "" {
+			if _, ok := httpMethods[spec.HTTP.Method]; !ok {
+				return fmt.Errorf("invalid http method %s", spec.HTTP.Method)
+			}
+		}
+	case protocolMQTT:
+		if spec.MQTT == nil || spec.MQTT.MQTTProxy == "" {
+			return fmt.Errorf("mqttProxy is required for protocol mqtt")
+		}
+		if spec.MQTT.QoS > 2 {
+			return fmt.Errorf("invalid mqtt qos %d", spec.MQTT.QoS)
+		}
+	default:
+		return fmt.Errorf("unsupported protocol %s", spec.Protocol)
+	}
+
+	if spec.Retry != nil {
+		if _, _, err := spec.Retry.backoff(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var httpMethods = map[string]struct{}{
+	http.MethodGet:    {},
+	http.MethodHead:   {},
+	http.MethodPost:   {},
+	http.MethodPut:    {},
+	http.MethodPatch:  {},
+	http.MethodDelete: {},
+}
+
+func (spec *RetrySpec) backoff() (time.Duration, time.Duration, error) {
+	backoff, maxBackoff := time.Second, 30*time.Second
+	var err error
+	if spec.Backoff != "" {
+		if backoff, err = time.ParseDuration(spec.Backoff); err != nil {
+			return 0, 0, err
+		}
+	}
+	if spec.MaxBackoff != "" {
+		if maxBackoff, err = time.ParseDuration(spec.MaxBackoff); err != nil {
+			return 0, 0, err
+		}
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	return backoff, maxBackoff, nil
+}
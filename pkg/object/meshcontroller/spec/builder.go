@@ -21,6 +21,7 @@ import (
 	"fmt"
 
 	"github.com/megaease/easegress/pkg/filters"
+	"github.com/megaease/easegress/pkg/filters/faultinjection"
 	"github.com/megaease/easegress/pkg/filters/meshadaptor"
 	"github.com/megaease/easegress/pkg/filters/mock"
 	"github.com/megaease/easegress/pkg/filters/proxies"
@@ -41,6 +42,7 @@ type (
 		Name string `json:"name"`
 
 		mockName           string
+		faultInjectionName string
 		rateLimiterName    string
 		circuitBreakerName string
 		retryName          string
@@ -69,6 +71,7 @@ func newPipelineSpecBuilder(name string) *pipelineSpecBuilder {
 		Name: name,
 
 		mockName:           "mock",
+		faultInjectionName: "faultInjection",
 		rateLimiterName:    "rateLimiter",
 		circuitBreakerName: "circuitBreaker",
 		retryName:          "retry",
@@ -193,6 +196,50 @@ func (b *pipelineSpecBuilder) appendMock(rules []*mock.Rule) *pipelineSpecBuilde
 	return b
 }
 
+func (b *pipelineSpecBuilder) appendFaultInjection(rules []*faultinjection.Rule) *pipelineSpecBuilder {
+	if len(rules) == 0 {
+		return b
+	}
+
+	spec := &faultinjection.Spec{
+		BaseSpec: filters.BaseSpec{
+			MetaSpec: supervisor.MetaSpec{
+				Name: b.faultInjectionName,
+				Kind: faultinjection.Kind,
+			},
+		},
+		Rules: rules,
+	}
+
+	m, err := codectool.StructToMap(spec)
+	if err != nil {
+		logger.Errorf("BUG: convert %#v to map failed: %v", spec, err)
+		return b
+	}
+
+	b.Flow = append(b.Flow, pipeline.FlowNode{FilterName: b.faultInjectionName})
+	b.Filters = append(b.Filters, m)
+
+	return b
+}
+
+// appendFaultInjectionOnResponse references the fault injection filter
+// again after the proxy, so that the faults on the response, i.e. throttle
+// and reset, can be injected. It must be called after appendFaultInjection.
+func (b *pipelineSpecBuilder) appendFaultInjectionOnResponse(rules []*faultinjection.Rule) *pipelineSpecBuilder {
+	for _, r := range rules {
+		if r.HasResponseFaults() {
+			b.Flow = append(b.Flow, pipeline.FlowNode{
+				FilterName:  b.faultInjectionName,
+				FilterAlias: b.faultInjectionName + "OnResponse",
+			})
+			break
+		}
+	}
+
+	return b
+}
+
 func (b *pipelineSpecBuilder) appendProxyWithCanary(param *proxyParam) *pipelineSpecBuilder {
 	if param.lb == nil {
 		param.lb = &proxy.LoadBalanceSpec{}
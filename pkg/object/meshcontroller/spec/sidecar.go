@@ -20,6 +20,7 @@ package spec
 import (
 	"fmt"
 
+	"github.com/megaease/easegress/pkg/filters/faultinjection"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/supervisor"
 )
@@ -102,7 +103,10 @@ func (s *Service) SidecarEgressPipelineSpec(instanceSpecs []*ServiceInstanceSpec
 	var retryPolicy string
 	var circuitBreakerPolicy string
 	var failureCodes []int
+	var faultInjection []*faultinjection.Rule
 	if s.Resilience != nil {
+		faultInjection = s.Resilience.FaultInjection
+		pipelineSpecBuilder.appendFaultInjection(faultInjection)
 		pipelineSpecBuilder.appendRetry(s.Resilience.Retry)
 		pipelineSpecBuilder.appendCircuitBreaker(s.Resilience.CircuitBreaker)
 		if s.Resilience.TimeLimiter != nil {
@@ -130,6 +134,8 @@ func (s *Service) SidecarEgressPipelineSpec(instanceSpecs []*ServiceInstanceSpec
 		failureCodes:         failureCodes,
 	})
 
+	pipelineSpecBuilder.appendFaultInjectionOnResponse(faultInjection)
+
 	jsonConfig := pipelineSpecBuilder.jsonConfig()
 	superSpec, err := supervisor.NewSpec(jsonConfig)
 	if err != nil {
@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/megaease/easegress/pkg/cluster/customdata"
+	"github.com/megaease/easegress/pkg/filters/faultinjection"
 	"github.com/megaease/easegress/pkg/filters/mock"
 	proxy "github.com/megaease/easegress/pkg/filters/proxies/httpproxy"
 	"github.com/megaease/easegress/pkg/filters/ratelimiter"
@@ -222,6 +223,7 @@ type (
 		Retry          *resilience.RetryRule          `json:"retry,omitempty" jsonschema:"omitempty"`
 		TimeLimiter    *TimeLimiterRule               `json:"timeLimiter,omitempty" jsonschema:"omitempty"`
 		FailureCodes   []int                          `json:"failureCodes,omitempty" jsonschema:"omitempty,uniqueItems=true"`
+		FaultInjection []*faultinjection.Rule         `json:"faultInjection,omitempty" jsonschema:"omitempty"`
 	}
 
 	// TimeLimiterRule is the spec of TimeLimiter.
@@ -20,13 +20,16 @@ package spec
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/megaease/easegress/pkg/filters/faultinjection"
 	"github.com/megaease/easegress/pkg/filters/mock"
 	"github.com/megaease/easegress/pkg/filters/proxies"
 	"github.com/megaease/easegress/pkg/filters/ratelimiter"
 	"github.com/megaease/easegress/pkg/logger"
 	_ "github.com/megaease/easegress/pkg/object/httpserver"
+	"github.com/megaease/easegress/pkg/object/pipeline"
 	"github.com/megaease/easegress/pkg/resilience"
 	"github.com/megaease/easegress/pkg/util/codectool"
 	"github.com/megaease/easegress/pkg/util/stringtool"
@@ -688,6 +691,56 @@ func TestSidecarEgressResiliencePipelineSpec(t *testing.T) {
 	fmt.Println(superSpec.JSONConfig())
 }
 
+func TestSidecarEgressFaultInjectionPipelineSpec(t *testing.T) {
+	s := &Service{
+		Name: "order-001",
+		Sidecar: &Sidecar{
+			Address:         "127.0.0.1",
+			IngressPort:     8080,
+			IngressProtocol: "http",
+			EgressPort:      9090,
+			EgressProtocol:  "http",
+		},
+		Resilience: &Resilience{
+			FaultInjection: []*faultinjection.Rule{{
+				Match: faultinjection.MatchRule{PathPrefix: "/orders"},
+				Delay: &faultinjection.DelaySpec{Duration: "100ms"},
+			}},
+		},
+	}
+
+	instanceSpecs := []*ServiceInstanceSpec{{
+		ServiceName: "order-001",
+		InstanceID:  "xxx-89757",
+		IP:          "192.168.0.110",
+		Port:        80,
+		Status:      "UP",
+	}}
+
+	flow := func() string {
+		superSpec, err := s.SidecarEgressPipelineSpec(instanceSpecs, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("egress pipeline spec failed: %v", err)
+		}
+		var names []string
+		for _, node := range superSpec.ObjectSpec().(*pipeline.Spec).Flow {
+			names = append(names, node.FilterName+"/"+node.FilterAlias)
+		}
+		return strings.Join(names, ",")
+	}
+
+	expected := "faultInjection/,proxy/"
+	if got := flow(); got != expected {
+		t.Errorf("expected flow %s, got %s", expected, got)
+	}
+
+	s.Resilience.FaultInjection[0].Throttle = &faultinjection.ThrottleSpec{BytesPerSecond: 1024}
+	expected = "faultInjection/,proxy/,faultInjection/faultInjectionOnResponse"
+	if got := flow(); got != expected {
+		t.Errorf("expected flow %s, got %s", expected, got)
+	}
+}
+
 func TestPipelineBuilderFailed(t *testing.T) {
 	builder := newPipelineSpecBuilder("abc")
 
@@ -25,19 +25,23 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	packetsv5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/google/uuid"
 	"github.com/megaease/easegress/pkg/api"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/protocols/mqttprot"
 	"github.com/megaease/easegress/pkg/tracing"
 	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
 	"github.com/openzipkin/zipkin-go/model"
 	"github.com/openzipkin/zipkin-go/propagation/b3"
 )
@@ -50,18 +54,25 @@ type (
 		name   string
 		spec   *Spec
 
-		listener  net.Listener
-		clients   map[string]*Client
-		tlsCfg    *tls.Config
-		pipelines map[PacketType]string
-		muxMapper context.MuxMapper
+		listener   net.Listener
+		wsListener net.Listener
+		wsServer   *http.Server
+		clients    map[string]*Client
+		tlsCfg     *tls.Config
+		tlsPolicy  *tlspolicy.Policy
+		pipelines  map[PacketType]string
+		muxMapper  context.MuxMapper
 
 		sessMgr           *SessionManager
 		topicMgr          TopicManager
 		sessionCacheMgr   SessionCacheManager
+		retainMgr         *retainManager
 		connectionLimiter *Limiter
 		memberURL         func(string, string) (map[string]string, error)
 
+		// sharedIndex is the round robin index of share groups, map[group]*uint64
+		sharedIndex sync.Map
+
 		// done is the channel for shutdowning this proxy.
 		done      chan struct{}
 		closeFlag int32
@@ -74,6 +85,11 @@ type (
 		Payload     string `json:"payload"`
 		Base64      bool   `json:"base64"`
 		Distributed bool   `json:"distributed"`
+
+		Properties *MessageProperties `json:"properties,omitempty"`
+		// SharedSubscribers is the members of share groups picked to receive
+		// the message on broker mode
+		SharedSubscribers []string `json:"sharedSubscribers,omitempty"`
 	}
 
 	// HTTPSessions is json data used for session related operations, like get all sessions and delete some sessions
@@ -111,10 +127,16 @@ func getPipelineMap(spec *Spec) (map[PacketType]string, error) {
 	return ans, nil
 }
 
-func newBroker(spec *Spec, store storage, muxMapper context.MuxMapper, memberURL func(string, string) (map[string]string, error)) *Broker {
+func newBroker(spec *Spec, tlsPolicy *tlspolicy.Policy, store storage, muxMapper context.MuxMapper, memberURL func(string, string) (map[string]string, error)) *Broker {
 	if spec.RetryInterval <= 0 {
 		spec.RetryInterval = 30
 	}
+	if spec.OfflineQueueSize <= 0 {
+		spec.OfflineQueueSize = 1000
+	}
+	if spec.OfflineMessageTTL <= 0 {
+		spec.OfflineMessageTTL = 3600
+	}
 
 	broker := &Broker{
 		egName:    spec.EGName,
@@ -124,6 +146,7 @@ func newBroker(spec *Spec, store storage, muxMapper context.MuxMapper, memberURL
 		memberURL: memberURL,
 		done:      make(chan struct{}),
 		muxMapper: muxMapper,
+		tlsPolicy: tlsPolicy,
 	}
 	pipelines, err := getPipelineMap(spec)
 	if err != nil {
@@ -134,6 +157,7 @@ func newBroker(spec *Spec, store storage, muxMapper context.MuxMapper, memberURL
 	err = broker.setListener()
 	if err != nil {
 		logger.SpanErrorf(nil, "mqtt broker set listener failed: %v", err)
+		tlsPolicy.Close()
 		return nil
 	}
 
@@ -143,6 +167,9 @@ func newBroker(spec *Spec, store storage, muxMapper context.MuxMapper, memberURL
 	broker.topicMgr = newTopicManager(spec)
 	broker.sessMgr = newSessionManager(broker, store)
 	broker.connectionLimiter = newLimiter(spec.ConnectionLimit)
+	if spec.BrokerMode {
+		broker.retainMgr = newRetainManager(spec.Name, store)
+	}
 	go broker.run()
 
 	if spec.BrokerMode {
@@ -162,6 +189,7 @@ func (b *Broker) setListener() error {
 		if err != nil {
 			return fmt.Errorf("invalid tls config for mqtt proxy: %v", err)
 		}
+		b.tlsPolicy.Apply(cfg)
 		l, err = tls.Listen("tcp", addr, cfg)
 		if err != nil {
 			return fmt.Errorf("gen mqtt tls tcp listener with addr %v and cfg %v failed: %v", addr, cfg, err)
@@ -172,9 +200,13 @@ func (b *Broker) setListener() error {
 			return fmt.Errorf("gen mqtt tcp listener with addr %s failed: %v", addr, err)
 		}
 	}
+	if err = b.setWebSocketListener(cfg); err != nil {
+		l.Close()
+		return err
+	}
 	b.tlsCfg = cfg
 	b.listener = l
-	return err
+	return nil
 }
 
 func (b *Broker) connectWatcher() {
@@ -291,7 +323,7 @@ func (b *Broker) processWatcherEvent(event map[string]*string, sync bool) {
 // processNewSession
 func (b *Broker) handleNewSessionInCluster(clientID string, v *string, sessionInfo *SessionInfo) {
 	c := b.getClient(clientID)
-	if c == nil {
+	if c == nil && b.sessMgr.local(clientID) == nil {
 		// The current broker doesn't contain the new session, just ignore it.
 		return
 	}
@@ -318,6 +350,20 @@ func (b *Broker) handleNewSessionInCluster(clientID string, v *string, sessionIn
 		return
 	}
 
+	if c == nil {
+		// The persistent session of a disconnected client was taken over
+		// by the different broker, which receives the messages now. On
+		// broker mode, the subscriptions are kept to route messages to it.
+		logger.Infof("the offline session of client: %s was taken over by the broker: %s", clientID, info.EGName)
+		sess := b.sessMgr.local(clientID)
+		b.sessMgr.delLocal(clientID)
+		if sess != nil && !b.spec.BrokerMode {
+			topics, _, _ := sess.allSubscribes()
+			b.topicMgr.unsubscribe(topics, clientID)
+		}
+		return
+	}
+
 	// The new session was established on the different broker,
 	// we should disconnect the connection in the current broker,
 	// but we should not delete session information in the global
@@ -342,6 +388,9 @@ func (b *Broker) deleteSession(clientID string) {
 }
 
 func (b *Broker) run() {
+	if b.wsServer != nil {
+		go b.runWebSocket()
+	}
 	for {
 		conn, err := b.listener.Accept()
 		if err != nil {
@@ -375,12 +424,13 @@ func (b *Broker) checkConnectPermission(connect *packets.ConnectPacket) bool {
 	return true
 }
 
-func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.Conn) (*Client, *packets.ConnackPacket, bool) {
+func (b *Broker) connectionValidation(connect *packets.ConnectPacket, v5 *packetV5, conn net.Conn) (*Client, *packets.ConnackPacket, bool) {
 	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
 	connack.SessionPresent = connect.CleanSession
-	connack.ReturnCode = connect.Validate()
+	connack.ReturnCode = validateConnect(connect)
+	version := connect.ProtocolVersion
 	if connack.ReturnCode != packets.Accepted {
-		err := connack.Write(conn)
+		err := writePacket(conn, connack, version)
 		logger.SpanErrorf(nil, "invalid connection %v, write connack failed: %s", connack.ReturnCode, err)
 		return nil, nil, false
 	}
@@ -388,14 +438,25 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 	if !b.checkConnectPermission(connect) {
 		logger.SpanDebugf(nil, "client %v not get connect permission from rate limiter", connect.ClientIdentifier)
 		connack.ReturnCode = packets.ErrRefusedServerUnavailable
-		err := connack.Write(conn)
+		err := writePacket(conn, connack, version)
 		if err != nil {
 			logger.SpanErrorf(nil, "connack back to client %s failed: %s", connect.ClientIdentifier, err)
 		}
 		return nil, nil, false
 	}
 
+	// MQTT 5 client could connect with empty client id, and the broker
+	// assigns one for it.
+	assignedCID := false
+	if v5 != nil && connect.ClientIdentifier == "" {
+		connect.ClientIdentifier = uuid.NewString()
+		assignedCID = true
+	}
 	client := newClient(connect, b, conn, b.spec.ClientPublishLimit)
+	if v5 != nil {
+		client.setConnectProperties(v5)
+		client.info.assignedCID = assignedCID
+	}
 	// check auth
 	authFail := false
 
@@ -406,7 +467,11 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 			logger.SpanErrorf(nil, "get pipeline %v failed", authPipeline)
 			authFail = true
 		} else {
-			ctx := newContext(connect, client)
+			var packet packets.ControlPacket = connect
+			if v5 != nil {
+				packet = v5
+			}
+			ctx := newContext(packet, client)
 			pipe.Handle(ctx)
 			res := ctx.GetResponse(context.DefaultNamespace).(*mqttprot.Response)
 			if res.Disconnect() {
@@ -417,7 +482,7 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 	}
 	if authFail {
 		connack.ReturnCode = packets.ErrRefusedNotAuthorised
-		err := connack.Write(conn)
+		err := writePacket(conn, connack, version)
 		if err != nil {
 			logger.SpanErrorf(nil, "connack back to client %s failed: %s", connect.ClientIdentifier, err)
 		}
@@ -429,11 +494,15 @@ func (b *Broker) connectionValidation(connect *packets.ConnectPacket, conn net.C
 
 func (b *Broker) handleConn(conn net.Conn) {
 	defer conn.Close()
-	packet, err := packets.ReadPacket(conn)
+	packet, err := readConnectPacket(conn)
 	if err != nil {
 		logger.SpanErrorf(nil, "read connect packet failed: %s", err)
 		return
 	}
+	v5, ok := packet.(*packetV5)
+	if ok {
+		packet = v5.ControlPacket
+	}
 	connect, ok := packet.(*packets.ConnectPacket)
 	if !ok {
 		logger.SpanErrorf(nil, "first packet received %s that was not Connect", packet.String())
@@ -441,7 +510,7 @@ func (b *Broker) handleConn(conn net.Conn) {
 	}
 	logger.SpanDebugf(nil, "connection from client %s", connect.ClientIdentifier)
 
-	client, connack, valid := b.connectionValidation(connect, conn)
+	client, connack, valid := b.connectionValidation(connect, v5, conn)
 	if !valid {
 		return
 	}
@@ -460,7 +529,7 @@ func (b *Broker) handleConn(conn net.Conn) {
 			if len(b.clients) >= b.spec.MaxAllowedConnection {
 				logger.Errorf("client %v not get connect permission from rate limiter", connect.ClientIdentifier)
 				connack.ReturnCode = packets.ErrRefusedServerUnavailable
-				err = connack.Write(conn)
+				err = writePacket(conn, connack, client.version)
 				if err != nil {
 					logger.Errorf("connack back to client %s failed: %s", connect.ClientIdentifier, err)
 				}
@@ -478,12 +547,20 @@ func (b *Broker) handleConn(conn net.Conn) {
 
 	if oldClient != nil {
 		// delete old client
-		go oldClient.close()
+		go func() {
+			oldClient.disconnectV5(packetsv5.DisconnectSessionTakenOver)
+			oldClient.close()
+		}()
 	}
 
 	b.setSession(client, connect)
+	inflight, offline := client.session.resumeMessages()
 
-	err = connack.Write(conn)
+	var ack packets.ControlPacket = connack
+	if client.version == mqttVersion5 {
+		ack = &packetV5{ControlPacket: connack, props: b.connackProperties(client)}
+	}
+	err = writePacket(conn, ack, client.version)
 	if err != nil {
 		logger.SpanErrorf(nil, "send connack to client %s failed: %s", connect.ClientIdentifier, err)
 		// Don't clean client, dely to writeLoop or readLoop when error
@@ -499,6 +576,7 @@ func (b *Broker) handleConn(conn net.Conn) {
 		}
 	}
 	go client.writeLoop()
+	go client.session.resume(client, inflight, offline)
 	client.readLoop()
 }
 
@@ -511,9 +589,38 @@ func (b *Broker) setSession(client *Client, connect *packets.ConnectPacket) {
 	} else {
 		if prevSess != nil {
 			prevSess.close()
+			// the subscriptions of the previous session are not inherited
+			topics, _, _ := prevSess.allSubscribes()
+			b.topicMgr.unsubscribe(topics, connect.ClientIdentifier)
 		}
 		client.session = b.sessMgr.newSessionFromConn(connect)
 	}
+	b.sessMgr.cancelExpiry(connect.ClientIdentifier)
+	if client.version == mqttVersion5 {
+		client.session.setExpiryInterval(client.info.sessionExpiry)
+	}
+}
+
+// connackProperties returns the properties of connack packet of MQTT 5,
+// which tell the client the features supported by the broker.
+func (b *Broker) connackProperties(client *Client) *packetsv5.Properties {
+	aliasMaximum := topicAliasMaximum
+	retainAvailable := byte(0)
+	if b.spec.BrokerMode {
+		retainAvailable = 1
+	}
+	subIDAvailable := byte(0)
+	sharedSubAvailable := byte(1)
+	props := &packetsv5.Properties{
+		TopicAliasMaximum:  &aliasMaximum,
+		RetainAvailable:    &retainAvailable,
+		SubIDAvailable:     &subIDAvailable,
+		SharedSubAvailable: &sharedSubAvailable,
+	}
+	if client.info.assignedCID {
+		props.AssignedClientID = client.info.cid
+	}
+	return props
 }
 
 func (b *Broker) requestTransfer(span *model.SpanContext, egName, name string, data HTTPJsonData, header http.Header) {
@@ -544,44 +651,110 @@ func (b *Broker) requestTransfer(span *model.SpanContext, egName, name string, d
 	logger.SpanDebugf(span, "eg %v http transfer data %v to %v", b.egName, data, urls)
 }
 
-func (b *Broker) sendMsgToClient(span *model.SpanContext, topic string, payload []byte, qos byte) {
+// sendMsgToClient sends the message to the subscribers connected to the
+// broker, shared is the members of share groups picked to receive the
+// message, they are picked by the broker if shared is nil.
+func (b *Broker) sendMsgToClient(span *model.SpanContext, topic string, payload []byte, qos byte, props *MessageProperties, shared []string) {
 	subscribers, _ := b.topicMgr.findSubscribers(topic)
 	logger.SpanDebugf(span, "eg %v send topic %v to client %v", b.egName, topic, subscribers)
 	if subscribers == nil {
 		logger.SpanErrorf(span, "eg %v not find subscribers for topic %s", b.egName, topic)
 		return
 	}
+	if shared == nil {
+		b.pickSharedSubscribers(subscribers)
+	} else {
+		keepSharedSubscribers(subscribers, shared)
+	}
 
-	for clientID, subQoS := range subscribers {
+	for id, subQoS := range subscribers {
 		if subQoS < qos {
 			continue
 		}
+		clientID := subscriberClientID(id)
 		if b.spec.BrokerMode {
 			egName := b.sessionCacheMgr.getEGName(clientID)
 			if egName != b.egName {
 				continue
 			}
 		}
-		client := b.getClient(clientID)
-		if client == nil {
-			logger.SpanDebugf(span, "client %v not on broker %v in eg %v", clientID, b.name, b.egName)
-		} else {
-			client.session.publish(span, client, topic, payload, qos)
+		b.publishToClient(span, clientID, topic, payload, qos, props)
+	}
+}
+
+// publishToClient publishes the message to the client, or queues it if the
+// client of the persistent session on this broker is disconnected.
+func (b *Broker) publishToClient(span *model.SpanContext, clientID string, topic string, payload []byte, qos byte, props *MessageProperties) {
+	// the session of a connecting client is not set yet, the message is
+	// queued in the local session and sent after the session is set.
+	if client := b.getClient(clientID); client != nil && client.session != nil {
+		client.session.publish(span, client, topic, payload, qos, props)
+		return
+	}
+	if sess := b.sessMgr.local(clientID); sess != nil {
+		sess.enqueue(span, topic, payload, qos, props)
+		return
+	}
+	logger.SpanDebugf(span, "client %v not on broker %v in eg %v", clientID, b.name, b.egName)
+}
+
+// pickSharedSubscribers picks a member of each share group in subscribers by
+// round robin, the members not picked are removed from subscribers, and the
+// picked ones are returned.
+func (b *Broker) pickSharedSubscribers(subscribers map[string]byte) []string {
+	groups := make(map[string][]string)
+	for id := range subscribers {
+		if group, _, ok := splitSharedTopic(id); ok {
+			groups[group] = append(groups[group], id)
+		}
+	}
+
+	picked := []string{}
+	for group, members := range groups {
+		sort.Strings(members)
+		index, _ := b.sharedIndex.LoadOrStore(group, new(uint64))
+		i := atomic.AddUint64(index.(*uint64), 1)
+		pick := members[i%uint64(len(members))]
+		for _, id := range members {
+			if id != pick {
+				delete(subscribers, id)
+			}
+		}
+		picked = append(picked, pick)
+	}
+	return picked
+}
+
+// keepSharedSubscribers removes the members of share groups not picked.
+func keepSharedSubscribers(subscribers map[string]byte, picked []string) {
+	keep := make(map[string]struct{}, len(picked))
+	for _, id := range picked {
+		keep[id] = struct{}{}
+	}
+	for id := range subscribers {
+		if _, _, ok := splitSharedTopic(id); !ok {
+			continue
+		}
+		if _, ok := keep[id]; !ok {
+			delete(subscribers, id)
 		}
 	}
 }
 
 // splitSubscribers split subscribers to local and remote on broker mode and return
-// client ids of local subscribers and eg names of remote subscribers
-func (b *Broker) splitSubscribers(publish *packets.PublishPacket) ([]string, map[string]struct{}) {
+// client ids of local subscribers, eg names of remote subscribers and the picked
+// members of share groups
+func (b *Broker) splitSubscribers(publish *packets.PublishPacket) ([]string, map[string]struct{}, []string) {
 	egNames := make(map[string]struct{})
 	clients := []string{}
 
 	subscribers, _ := b.topicMgr.findSubscribers(publish.TopicName)
-	for clientID, subQos := range subscribers {
+	shared := b.pickSharedSubscribers(subscribers)
+	for id, subQos := range subscribers {
 		if subQos < publish.Qos {
 			continue
 		}
+		clientID := subscriberClientID(id)
 		egName := b.sessionCacheMgr.getEGName(clientID)
 		if egName != b.egName {
 			egNames[egName] = struct{}{}
@@ -589,23 +762,18 @@ func (b *Broker) splitSubscribers(publish *packets.PublishPacket) ([]string, map
 		}
 		clients = append(clients, clientID)
 	}
-	return clients, egNames
+	return clients, egNames, shared
 }
 
-func (b *Broker) sendMsgToLocalClient(span *model.SpanContext, publish *packets.PublishPacket, clients []string) {
+func (b *Broker) sendMsgToLocalClient(span *model.SpanContext, publish *packets.PublishPacket, props *MessageProperties, clients []string) {
 	for _, clientID := range clients {
-		client := b.getClient(clientID)
-		if client == nil {
-			logger.SpanDebugf(span, "client %v not on broker %v in eg %v", clientID, b.name, b.egName)
-		} else {
-			client.session.publish(span, client, publish.TopicName, publish.Payload, publish.Qos)
-		}
+		b.publishToClient(span, clientID, publish.TopicName, publish.Payload, publish.Qos, props)
 	}
 }
 
-func (b *Broker) requestTransferToCertainInstances(span *model.SpanContext, publish *packets.PublishPacket, remoteEgs map[string]struct{}) {
+func (b *Broker) requestTransferToCertainInstances(span *model.SpanContext, publish *packets.PublishPacket, props *MessageProperties, shared []string, remoteEgs map[string]struct{}) {
 	data := &HTTPJsonData{}
-	data.init(publish)
+	data.init(publish, props, shared)
 	urls, err := b.memberURL(b.egName, b.name)
 	if err != nil {
 		logger.SpanErrorf(span, "eg %v find urls for other egs failed: %v", b.egName, err)
@@ -642,21 +810,49 @@ func (b *Broker) requestTransferToCertainInstances(span *model.SpanContext, publ
 
 }
 
-func (b *Broker) processBrokerModePublish(clientID string, publish *packets.PublishPacket) {
+func (b *Broker) processBrokerModePublish(clientID string, publish *packets.PublishPacket, props *MessageProperties) {
 	if !b.spec.BrokerMode {
 		return
 	}
-	localClients, remoteEgs := b.splitSubscribers(publish)
+	localClients, remoteEgs, shared := b.splitSubscribers(publish)
 	if len(localClients) == 0 && len(remoteEgs) == 0 {
 		return
 	}
 
 	span := generateNewSpanContext(clientID, publish.TopicName)
 	if len(localClients) > 0 {
-		b.sendMsgToLocalClient(span, publish, localClients)
+		b.sendMsgToLocalClient(span, publish, props, localClients)
 	}
 	if len(remoteEgs) > 0 {
-		b.requestTransferToCertainInstances(span, publish, remoteEgs)
+		b.requestTransferToCertainInstances(span, publish, props, shared, remoteEgs)
+	}
+}
+
+// retain stores the retained message on broker mode.
+func (b *Broker) retain(publish *packets.PublishPacket, props *MessageProperties) {
+	if !b.spec.BrokerMode || !publish.Retain {
+		return
+	}
+	b.retainMgr.retain(publish, props)
+}
+
+// sendRetainedMsgToClient sends the retained messages which match the
+// topics newly subscribed by the client on broker mode, retained messages
+// are not sent for shared subscriptions.
+func (b *Broker) sendRetainedMsgToClient(client *Client, topics []string, qoss []byte) {
+	if !b.spec.BrokerMode {
+		return
+	}
+	var subTopics []string
+	var subQoss []byte
+	for i, topic := range topics {
+		if _, _, ok := splitSharedTopic(topic); !ok {
+			subTopics = append(subTopics, topic)
+			subQoss = append(subQoss, qoss[i])
+		}
+	}
+	for _, msg := range b.retainMgr.match(subTopics, subQoss) {
+		client.session.publishRetained(nil, client, msg.topic, msg.payload, msg.qos, msg.props)
 	}
 }
 
@@ -707,12 +903,44 @@ func (b *Broker) httpTopicsPublishHandler(w http.ResponseWriter, r *http.Request
 
 	span, _ := b3.ExtractHTTP(r)()
 	logger.SpanDebugf(span, "http endpoint received json data: %v", data)
+	// on broker mode, the members of share groups are picked by the broker
+	// received the message, and other brokers send the message to them only.
+	shared := data.SharedSubscribers
 	if !data.Distributed {
 		data.Distributed = true
+		if b.spec.BrokerMode {
+			subscribers, _ := b.topicMgr.findSubscribers(data.Topic)
+			data.SharedSubscribers = b.pickSharedSubscribers(subscribers)
+			shared = data.SharedSubscribers
+		}
 		headers := r.Header.Clone()
 		b.requestTransfer(span, b.egName, b.name, data, headers)
 	}
-	go b.sendMsgToClient(span, data.Topic, payload, byte(data.QoS))
+	if !b.spec.BrokerMode {
+		shared = nil
+	} else if shared == nil {
+		shared = []string{}
+	}
+	go b.sendMsgToClient(span, data.Topic, payload, byte(data.QoS), data.Properties, shared)
+}
+
+// publish publishes the message to the subscribers in the cluster, it is
+// the same as the message published by the HTTP API.
+func (b *Broker) publish(clientID string, topic string, payload []byte, qos byte, props *MessageProperties) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Payload = payload
+	publish.Qos = qos
+	if b.spec.BrokerMode {
+		b.processBrokerModePublish(clientID, publish, props)
+		return
+	}
+
+	span := generateNewSpanContext(clientID, topic)
+	data := HTTPJsonData{}
+	data.init(publish, props, nil)
+	b.requestTransfer(span, b.egName, b.name, data, http.Header{})
+	go b.sendMsgToClient(span, topic, payload, qos, props, nil)
 }
 
 func (b *Broker) mqttAPIPrefix(path string) string {
@@ -872,10 +1100,15 @@ func (b *Broker) close() {
 	b.setClose()
 	close(b.done)
 	b.listener.Close()
+	if b.wsServer != nil {
+		b.wsServer.Close()
+	}
+	b.tlsPolicy.Close()
 	b.sessMgr.close()
 	b.topicMgr.close()
 	if b.spec.BrokerMode {
 		b.sessionCacheMgr.close()
+		b.retainMgr.close()
 	}
 
 	b.Lock()
@@ -888,7 +1121,15 @@ func (b *Broker) close() {
 
 func newContext(packet packets.ControlPacket, client mqttprot.Client) *context.Context {
 	ctx := context.New(tracing.NoopSpan)
-	req := mqttprot.NewRequest(packet, client)
+	var req *mqttprot.Request
+	if p, ok := packet.(*packetV5); ok {
+		req = mqttprot.NewRequest(p.ControlPacket, client)
+		if p.props != nil {
+			req.SetUserProperties(newUserProperties(p.props.User))
+		}
+	} else {
+		req = mqttprot.NewRequest(packet, client)
+	}
 	ctx.SetRequest(context.DefaultNamespace, req)
 	resp := mqttprot.NewResponse()
 	ctx.SetResponse(context.DefaultNamespace, resp)
@@ -904,10 +1145,12 @@ func generateNewSpanContext(clientID string, topic string) *model.SpanContext {
 	return span
 }
 
-func (d *HTTPJsonData) init(packet *packets.PublishPacket) {
+func (d *HTTPJsonData) init(packet *packets.PublishPacket, props *MessageProperties, shared []string) {
 	d.Topic = packet.TopicName
 	d.QoS = int(packet.Qos)
 	d.Payload = base64.StdEncoding.EncodeToString(packet.Payload)
 	d.Base64 = true
 	d.Distributed = true
+	d.Properties = props
+	d.SharedSubscribers = shared
 }
@@ -72,53 +72,71 @@ func (mgr *cachedTopicManager) findSubscribers(topic string) (map[string]byte, e
 }
 
 func (mgr *cachedTopicManager) subscribe(topics []string, qoss []byte, clientID string) error {
-	allLevels, err := mgr.levelCache.getAll(topics)
-	if err != nil {
-		return err
-	}
-
-	mgr.writeCh <- &topicOp{
-		opType: subscribe,
-		subscribeOp: &subscribeOp{
-			allLevels: allLevels,
-			qoss:      qoss,
-			clientID:  clientID,
-		},
+	ops := []*topicOp{}
+	for id, st := range groupBySubscriber(topics, qoss, clientID) {
+		allLevels, err := mgr.levelCache.getAll(st.topics)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, &topicOp{
+			opType: subscribe,
+			subscribeOp: &subscribeOp{
+				allLevels: allLevels,
+				qoss:      st.qoss,
+				clientID:  id,
+			},
+		})
 	}
+	mgr.sendOps(ops)
 	return nil
 }
 
 func (mgr *cachedTopicManager) unsubscribe(topics []string, clientID string) error {
-	allLevels, err := mgr.levelCache.getAll(topics)
-	if err != nil {
-		return err
-	}
-
-	mgr.writeCh <- &topicOp{
-		opType: unsubscribe,
-		unsubscribeOp: &unsubscribeOp{
-			allLevels: allLevels,
-			clientID:  clientID,
-		},
+	ops := []*topicOp{}
+	for id, st := range groupBySubscriber(topics, nil, clientID) {
+		allLevels, err := mgr.levelCache.getAll(st.topics)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, &topicOp{
+			opType: unsubscribe,
+			unsubscribeOp: &unsubscribeOp{
+				allLevels: allLevels,
+				clientID:  id,
+			},
+		})
 	}
+	mgr.sendOps(ops)
 	return nil
 }
 
 func (mgr *cachedTopicManager) disconnect(topics []string, clientID string) error {
-	allLevels, err := mgr.levelCache.getAll(topics)
-	if err != nil {
-		return err
-	}
-	mgr.writeCh <- &topicOp{
-		opType: disconnect,
-		disconnectOp: &disconnectOp{
-			allLevels: allLevels,
-			clientID:  clientID,
-		},
+	ops := []*topicOp{}
+	for id, st := range groupBySubscriber(topics, nil, clientID) {
+		allLevels, err := mgr.levelCache.getAll(st.topics)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, &topicOp{
+			opType: disconnect,
+			disconnectOp: &disconnectOp{
+				allLevels: allLevels,
+				clientID:  id,
+			},
+		})
 	}
+	mgr.sendOps(ops)
 	return nil
 }
 
+// sendOps sends the ops after all of them are created, so the topics are
+// either all processed or none of them are processed.
+func (mgr *cachedTopicManager) sendOps(ops []*topicOp) {
+	for _, op := range ops {
+		mgr.writeCh <- op
+	}
+}
+
 func (mgr *cachedTopicManager) processSubscribe(op *subscribeOp) {
 	mgr.topicMgr.subscribe(op.allLevels, op.qoss, op.clientID)
 	matchTopics := []string{}
@@ -18,13 +18,16 @@
 package mqttproxy
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"net"
 	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	packetsv5 "github.com/eclipse/paho.golang/packets"
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
@@ -45,15 +48,17 @@ const (
 	QoS2 byte = 2
 )
 
-type processFn func(*Client, packets.ControlPacket)
-type processFnWithErr func(*Client, packets.ControlPacket) error
+// processFn processes the packet, v5 is the packet itself wrapped with the
+// parts of MQTT 5 if the client connects with MQTT 5, otherwise it is nil.
+type processFn func(c *Client, packet packets.ControlPacket, v5 *packetV5)
+type processFnWithErr func(c *Client, packet packets.ControlPacket, v5 *packetV5) error
 
 var processPacketMap = map[string]processFnWithErr{
 	"*packets.ConnectPacket":     errorWrapper("double connect"),
 	"*packets.ConnackPacket":     errorWrapper("client should not send connack"),
-	"*packets.PubrecPacket":      errorWrapper("qos2 not support now"),
-	"*packets.PubrelPacket":      errorWrapper("qos2 not support now"),
-	"*packets.PubcompPacket":     errorWrapper("qos2 not support now"),
+	"*packets.PubrecPacket":      nilErrWrapper(processPubrec),
+	"*packets.PubrelPacket":      nilErrWrapper(processPubrel),
+	"*packets.PubcompPacket":     nilErrWrapper(processPubcomp),
 	"*packets.SubackPacket":      errorWrapper("broker not subscribe"),
 	"*packets.UnsubackPacket":    errorWrapper("broker not unsubscribe"),
 	"*packets.PingrespPacket":    errorWrapper("broker not ping"),
@@ -61,14 +66,27 @@ var processPacketMap = map[string]processFnWithErr{
 	"*packets.UnsubscribePacket": pipelineWrapper(processUnsubscribe, Unsubscribe),
 	"*packets.PingreqPacket":     nilErrWrapper(processPingreq),
 	"*packets.PubackPacket":      nilErrWrapper(processPuback),
-	"*packets.PublishPacket": func(c *Client, packet packets.ControlPacket) error {
+	"*packets.PublishPacket": func(c *Client, packet packets.ControlPacket, v5 *packetV5) error {
 		publish := packet.(*packets.PublishPacket)
+		if v5 != nil {
+			if err := c.resolveTopicAlias(publish, v5.props); err != nil {
+				c.disconnectV5(packetsv5.DisconnectTopicAliasInvalid)
+				return err
+			}
+		}
 		logger.SpanDebugf(nil, "client %s process publish %v", c.info.cid, publish.TopicName)
+		if publish.Qos == QoS2 && !c.session.receive(publish.MessageID) {
+			// the client resends the message since PUBREC is lost, the
+			// message is processed only once.
+			c.writePacket(newPubrec(publish.MessageID))
+			return nil
+		}
 		if !c.checkPublishLimit(publish) {
 			logger.SpanErrorf(nil, "client %v publish limiter drop packet %v", c.info.cid, publish.TopicName)
+			c.releaseDropped(publish)
 			return nil
 		}
-		return pipelineWrapper(processPublish, Publish)(c, packet)
+		return pipelineWrapper(processPublish, Publish)(c, packet, v5)
 	},
 }
 
@@ -80,6 +98,11 @@ type (
 		password  string
 		keepalive uint16
 		will      *packets.PublishPacket
+
+		// fields below are for MQTT 5 only
+		willProps     *packetsv5.Properties
+		sessionExpiry uint32
+		assignedCID   bool
 	}
 
 	// Client represents a MQTT client connection in Broker
@@ -95,6 +118,12 @@ type (
 		statusFlag int32
 		writeCh    chan packets.ControlPacket
 		done       chan struct{}
+		// version is the protocol level of the connection
+		version byte
+		// writeLock avoids packets written to conn at the same time
+		writeLock sync.Mutex
+		// topicAliases is the topic aliases of MQTT 5, only used in readLoop
+		topicAliases map[uint16]string
 
 		// kv map is used for pipeline to share messages among filters during whole connection
 		kvMap sync.Map
@@ -153,15 +182,38 @@ func newClient(connect *packets.ConnectPacket, broker *Broker, conn net.Conn, li
 		statusFlag:   Connected,
 		writeCh:      make(chan packets.ControlPacket, 50),
 		done:         make(chan struct{}),
+		version:      connect.ProtocolVersion,
 		publishLimit: newLimiter(limitSpec),
 	}
 	return client
 }
 
+// setConnectProperties sets the properties of connect packet of MQTT 5.
+func (c *Client) setConnectProperties(v5 *packetV5) {
+	c.info.willProps = v5.willProps
+	if v5.props != nil && v5.props.SessionExpiryInterval != nil {
+		c.info.sessionExpiry = *v5.props.SessionExpiryInterval
+	}
+	c.topicAliases = make(map[uint16]string)
+}
+
 func (c *Client) readLoop() {
 	defer func() {
 		if c.info.will != nil {
-			c.runPipeline(c.info.will, Publish)
+			var will packets.ControlPacket = c.info.will
+			var willV5 *packetV5
+			if c.version == mqttVersion5 {
+				willV5 = &packetV5{ControlPacket: c.info.will, props: c.info.willProps}
+				will = willV5
+			}
+			if err := c.runPipeline(will, Publish); err == nil {
+				var props *MessageProperties
+				if willV5 != nil {
+					props = newMessageProperties(willV5.props, time.Now())
+				}
+				c.broker.retain(c.info.will, props)
+				go c.broker.processBrokerModePublish(c.info.cid, c.info.will, props)
+			}
 		}
 		c.closeAndDelSession()
 		c.broker.removeClient(c.info.cid)
@@ -182,12 +234,17 @@ func (c *Client) readLoop() {
 		}
 
 		logger.SpanDebugf(nil, "client %s readLoop read packet", c.info.cid)
-		packet, err := packets.ReadPacket(c.conn)
+		packet, err := c.readPacket()
 		if err != nil {
 			logger.SpanErrorf(nil, "client %s read packet failed: %v", c.info.cid, err)
 			return
 		}
-		if _, ok := packet.(*packets.DisconnectPacket); ok {
+		if p, ok := packet.(*packetV5); ok {
+			if _, ok := p.ControlPacket.(*packets.DisconnectPacket); ok {
+				c.processDisconnectV5(p)
+				return
+			}
+		} else if _, ok := packet.(*packets.DisconnectPacket); ok {
 			c.info.will = nil
 			return
 		}
@@ -199,13 +256,60 @@ func (c *Client) readLoop() {
 	}
 }
 
+func (c *Client) readPacket() (packets.ControlPacket, error) {
+	if c.version == mqttVersion5 {
+		return readPacketV5(c.conn)
+	}
+	return packets.ReadPacket(c.conn)
+}
+
 func (c *Client) processPacket(packet packets.ControlPacket) error {
+	v5, ok := packet.(*packetV5)
+	if ok {
+		packet = v5.ControlPacket
+	}
 	packetType := reflect.TypeOf(packet).String()
 	fn, ok := processPacketMap[packetType]
 	if !ok {
 		return errors.New("unknown packet")
 	}
-	return fn(c, packet)
+	return fn(c, packet, v5)
+}
+
+// processDisconnectV5 processes disconnect packet of MQTT 5, the will message
+// is still published if the client asks to, and the session expiry interval
+// could be updated unless it was zero.
+func (c *Client) processDisconnectV5(p *packetV5) {
+	if len(p.reasonCodes) == 0 || p.reasonCodes[0] != packetsv5.DisconnectDisconnectWithWillMessage {
+		c.info.will = nil
+	}
+	if p.props != nil && p.props.SessionExpiryInterval != nil && c.info.sessionExpiry != 0 {
+		c.info.sessionExpiry = *p.props.SessionExpiryInterval
+		c.session.setExpiryInterval(c.info.sessionExpiry)
+	}
+}
+
+// resolveTopicAlias sets the topic of the publish packet by the topic alias
+// of MQTT 5, or records the topic alias for the later packets.
+func (c *Client) resolveTopicAlias(publish *packets.PublishPacket, props *packetsv5.Properties) error {
+	if props == nil || props.TopicAlias == nil {
+		return nil
+	}
+	alias := *props.TopicAlias
+	if alias == 0 || alias > topicAliasMaximum {
+		return fmt.Errorf("invalid topic alias %d", alias)
+	}
+	if publish.TopicName == "" {
+		topic, ok := c.topicAliases[alias]
+		if !ok {
+			return fmt.Errorf("unknown topic alias %d", alias)
+		}
+		publish.TopicName = topic
+	} else {
+		c.topicAliases[alias] = publish.TopicName
+	}
+	props.TopicAlias = nil
+	return nil
 }
 
 func (c *Client) checkPublishLimit(publish *packets.PublishPacket) bool {
@@ -229,6 +333,14 @@ func (c *Client) runPipeline(packet packets.ControlPacket, packetType PacketType
 
 	ctx := newContext(packet, c)
 	pipe.Handle(ctx)
+	if p, ok := packet.(*packetV5); ok {
+		// user properties may be changed by filters
+		req := ctx.GetRequest(context.DefaultNamespace).(*mqttprot.Request)
+		if p.props == nil {
+			p.props = &packetsv5.Properties{}
+		}
+		p.props.User = newUsersV5(req.UserProperties())
+	}
 	resp := ctx.GetResponse(context.DefaultNamespace).(*mqttprot.Response)
 	if resp.Disconnect() {
 		c.close()
@@ -248,11 +360,48 @@ func (c *Client) writePacket(packet packets.ControlPacket) {
 	}
 }
 
+// writePacketWait waits until the packet is put into the write channel, it
+// returns false if the client is closed.
+func (c *Client) writePacketWait(packet packets.ControlPacket) bool {
+	select {
+	case c.writeCh <- packet:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// publishPacket returns the publish packet to write to the client, the
+// message properties are only sent to MQTT 5 clients.
+func (c *Client) publishPacket(p *packets.PublishPacket, props *MessageProperties) packets.ControlPacket {
+	if c.version != mqttVersion5 || props == nil {
+		return p
+	}
+	return &packetV5{ControlPacket: p, props: props.propertiesV5(time.Now())}
+}
+
+// disconnectV5 sends disconnect packet with the reason code to MQTT 5
+// client, it is used before the broker closes the connection.
+func (c *Client) disconnectV5(reasonCode byte) {
+	if c.version != mqttVersion5 {
+		return
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	err := writePacketV5(c.conn, newDisconnectV5(reasonCode))
+	if err != nil {
+		logger.SpanDebugf(nil, "write disconnect to client %s failed: %s", c.info.cid, err)
+	}
+}
+
 func (c *Client) writeLoop() {
 	for {
 		select {
 		case p := <-c.writeCh:
-			err := p.Write(c.conn)
+			c.writeLock.Lock()
+			err := writePacket(c.conn, p, c.version)
+			c.writeLock.Unlock()
 			if err != nil {
 				logger.SpanErrorf(nil, "write packet %v to client %s failed: %s", p.String(), c.info.cid, err)
 				c.closeAndDelSession()
@@ -295,14 +444,33 @@ func (c *Client) disconnected() bool {
 }
 
 func (c *Client) closeAndDelSession() {
+	// the client is taken over by a new connection to this broker, which
+	// owns the session now.
+	if current := c.broker.getClient(c.info.cid); current != nil && current != c {
+		c.close()
+		return
+	}
+
+	// the persistent session is kept on this broker with its subscriptions,
+	// so the messages are queued until the client connects again or the
+	// session expires.
+	sessMgr := c.broker.sessMgr
+	if !c.session.cleanSession() && sessMgr.local(c.info.cid) == c.session {
+		if c.version == mqttVersion5 && c.info.sessionExpiry != sessionExpiryNever {
+			sessMgr.expireLater(c.info.cid, c.info.sessionExpiry)
+		}
+		c.close()
+		return
+	}
+
 	// session can be delete by kickOUt or closeAndDelSession
 	// only when session was delete by closeAndDelSession we should clean
 	// global store, otherwise it means that the device reconnect to
 	// the another broker, the current broker just disconnect connection.
 	// and clean local session information.
-	deleted := c.broker.sessMgr.delLocal(c.info.cid)
+	deleted := sessMgr.delLocal(c.info.cid)
 	if c.session.cleanSession() && deleted {
-		c.broker.sessMgr.delDB(c.info.cid)
+		sessMgr.delDB(c.info.cid)
 	}
 
 	topics, _, _ := c.session.allSubscribes()
@@ -311,33 +479,84 @@ func (c *Client) closeAndDelSession() {
 }
 
 func errorWrapper(errMsg string) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
+	return func(c *Client, p packets.ControlPacket, v5 *packetV5) error {
 		return errors.New(errMsg)
 	}
 }
 
 func nilErrWrapper(fn processFn) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
-		fn(c, p)
+	return func(c *Client, p packets.ControlPacket, v5 *packetV5) error {
+		fn(c, p, v5)
 		return nil
 	}
 }
 
 func pipelineWrapper(fn processFn, packetType PacketType) processFnWithErr {
-	return func(c *Client, p packets.ControlPacket) error {
-		err := c.runPipeline(p, packetType)
+	return func(c *Client, p packets.ControlPacket, v5 *packetV5) error {
+		var packet packets.ControlPacket = p
+		if v5 != nil {
+			packet = v5
+		}
+		err := c.runPipeline(packet, packetType)
 		if err != nil {
 			logger.SpanDebugf(nil, "client process pipeline failed, %v", c.info.cid, err)
+			if publish, ok := p.(*packets.PublishPacket); ok {
+				c.releaseDropped(publish)
+			}
+			if v5 != nil {
+				c.rejectV5(p)
+			}
 			return nil
 		}
-		fn(c, p)
+		fn(c, p, v5)
 		return nil
 	}
 }
 
-func processPublish(c *Client, packet packets.ControlPacket) {
+// releaseDropped releases the packet id of the dropped QoS 2 message, so
+// the message resent by the client is processed instead of being taken as
+// a duplicate.
+func (c *Client) releaseDropped(publish *packets.PublishPacket) {
+	if publish.Qos == QoS2 {
+		c.session.release(publish.MessageID)
+	}
+}
+
+// rejectV5 sends the acknowledgement with the reason code of not authorized
+// to MQTT 5 client when the packet is dropped by the pipeline.
+func (c *Client) rejectV5(packet packets.ControlPacket) {
+	switch p := packet.(type) {
+	case *packets.PublishPacket:
+		switch p.Qos {
+		case QoS1:
+			puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+			puback.MessageID = p.MessageID
+			c.writePacket(&packetV5{ControlPacket: puback, reasonCodes: []byte{packetsv5.PubackNotAuthorized}})
+		case QoS2:
+			// the QoS 2 flow ends with the failed PUBREC
+			c.writePacket(&packetV5{ControlPacket: newPubrec(p.MessageID), reasonCodes: []byte{packetsv5.PubrecNotAuthorized}})
+		}
+	case *packets.SubscribePacket:
+		suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+		suback.MessageID = p.MessageID
+		suback.ReturnCodes = bytes.Repeat([]byte{packetsv5.SubackNotauthorized}, len(p.Topics))
+		c.writePacket(suback)
+	case *packets.UnsubscribePacket:
+		unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+		unsuback.MessageID = p.MessageID
+		reasonCodes := bytes.Repeat([]byte{packetsv5.UnsubackNotAuthorized}, len(p.Topics))
+		c.writePacket(&packetV5{ControlPacket: unsuback, reasonCodes: reasonCodes})
+	}
+}
+
+func processPublish(c *Client, packet packets.ControlPacket, v5 *packetV5) {
 	publish := packet.(*packets.PublishPacket)
-	go c.broker.processBrokerModePublish(c.info.cid, publish)
+	var props *MessageProperties
+	if v5 != nil {
+		props = newMessageProperties(v5.props, time.Now())
+	}
+	c.broker.retain(publish, props)
+	go c.broker.processBrokerModePublish(c.info.cid, publish, props)
 	switch publish.Qos {
 	case QoS0:
 		// do nothing
@@ -346,40 +565,112 @@ func processPublish(c *Client, packet packets.ControlPacket) {
 		puback.MessageID = publish.MessageID
 		c.writePacket(puback)
 	case QoS2:
-		// not support yet
+		c.writePacket(newPubrec(publish.MessageID))
 	}
 }
 
-func processPuback(c *Client, packet packets.ControlPacket) {
+func newPubrec(id uint16) *packets.PubrecPacket {
+	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubrec.MessageID = id
+	return pubrec
+}
+
+func processPuback(c *Client, packet packets.ControlPacket, v5 *packetV5) {
 	puback := packet.(*packets.PubackPacket)
 	c.session.puback(puback)
 }
 
-func processSubscribe(c *Client, p packets.ControlPacket) {
+func processPubrec(c *Client, packet packets.ControlPacket, v5 *packetV5) {
+	pubrec := packet.(*packets.PubrecPacket)
+	// the QoS 2 flow ends with the failed PUBREC of MQTT 5
+	if v5 != nil && len(v5.reasonCodes) > 0 && v5.reasonCodes[0] >= packetsv5.PubrecUnspecifiedError {
+		c.session.pubcomp(pubrec.MessageID)
+		return
+	}
+	c.session.pubrec(pubrec.MessageID)
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = pubrec.MessageID
+	c.writePacket(pubrel)
+}
+
+func processPubrel(c *Client, packet packets.ControlPacket, v5 *packetV5) {
+	pubrel := packet.(*packets.PubrelPacket)
+	found := c.session.release(pubrel.MessageID)
+	pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+	pubcomp.MessageID = pubrel.MessageID
+	if v5 != nil && !found {
+		c.writePacket(&packetV5{ControlPacket: pubcomp, reasonCodes: []byte{packetsv5.PubcompPacketIdentifierNotFound}})
+		return
+	}
+	c.writePacket(pubcomp)
+}
+
+func processPubcomp(c *Client, packet packets.ControlPacket, v5 *packetV5) {
+	pubcomp := packet.(*packets.PubcompPacket)
+	c.session.pubcomp(pubcomp.MessageID)
+}
+
+func processSubscribe(c *Client, p packets.ControlPacket, v5 *packetV5) {
 	packet := p.(*packets.SubscribePacket)
 	logger.SpanDebugf(nil, "client %s subscribe %v with qos %v", c.info.cid, packet.Topics, packet.Qoss)
 
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = packet.MessageID
+	suback.ReturnCodes = make([]byte, len(packet.Topics))
+
+	// the retained messages are sent by the retain handling options of MQTT 5,
+	// 0 for always, 1 for new subscriptions only and 2 for never.
+	retainTopics, retainQoss := packet.Topics, packet.Qoss
+	if v5 != nil {
+		retainTopics, retainQoss = nil, nil
+		for i, opts := range v5.subOptions {
+			if opts.RetainHandling == 2 || (opts.RetainHandling == 1 && c.session.subscribed(packet.Topics[i])) {
+				continue
+			}
+			retainTopics = append(retainTopics, packet.Topics[i])
+			retainQoss = append(retainQoss, packet.Qoss[i])
+		}
+	}
+
 	err := c.broker.topicMgr.subscribe(packet.Topics, packet.Qoss, c.info.cid)
 	if err != nil {
 		logger.SpanErrorf(nil, "client %v subscribe %v failed: %v", c.info.cid, packet.Topics, err)
+		if v5 != nil {
+			for i := range suback.ReturnCodes {
+				suback.ReturnCodes[i] = packetsv5.SubackTopicFilterinvalid
+			}
+			c.writePacket(suback)
+		}
 		return
 	}
 	c.session.subscribe(packet.Topics, packet.Qoss)
 
-	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
-	suback.MessageID = packet.MessageID
-	suback.ReturnCodes = make([]byte, len(packet.Topics))
 	for i := range packet.Topics {
 		suback.ReturnCodes[i] = packet.Qos
+		// MQTT 5 requires the granted QoS
+		if v5 != nil {
+			suback.ReturnCodes[i] = packet.Qoss[i]
+		}
 	}
 	c.writePacket(suback)
+	c.broker.sendRetainedMsgToClient(c, retainTopics, retainQoss)
 }
 
-func processUnsubscribe(c *Client, p packets.ControlPacket) {
+func processUnsubscribe(c *Client, p packets.ControlPacket, v5 *packetV5) {
 	packet := p.(*packets.UnsubscribePacket)
 
 	logger.SpanDebugf(nil, "client %s processUnsubscribe %v", c.info.cid, packet.Topics)
 
+	var reasonCodes []byte
+	if v5 != nil {
+		reasonCodes = make([]byte, len(packet.Topics))
+		for i, topic := range packet.Topics {
+			if !c.session.subscribed(topic) {
+				reasonCodes[i] = packetsv5.UnsubackNoSubscriptionFound
+			}
+		}
+	}
+
 	err := c.broker.topicMgr.unsubscribe(packet.Topics, c.info.cid)
 	if err != nil {
 		logger.SpanErrorf(nil, "client %v unsubscribe %v failed: %v", c.info.cid, packet.Topics, err)
@@ -388,10 +679,14 @@ func processUnsubscribe(c *Client, p packets.ControlPacket) {
 
 	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
 	unsuback.MessageID = packet.MessageID
+	if v5 != nil {
+		c.writePacket(&packetV5{ControlPacket: unsuback, reasonCodes: reasonCodes})
+		return
+	}
 	c.writePacket(unsuback)
 }
 
-func processPingreq(c *Client, packet packets.ControlPacket) {
+func processPingreq(c *Client, packet packets.ControlPacket, v5 *packetV5) {
 	resp := packets.NewControlPacket(packets.Pingresp).(*packets.PingrespPacket)
 	c.writePacket(resp)
 }
@@ -406,6 +701,7 @@ func (c *Client) kickOut() {
 	// clean local session information, unsubscribe topic
 	// in the current broker
 	c.sessionCleanLocal()
+	c.disconnectV5(packetsv5.DisconnectSessionTakenOver)
 
 	// close connection, but don't schedule Disconnect Pipeline
 	c.Lock()
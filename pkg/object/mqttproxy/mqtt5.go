@@ -0,0 +1,502 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	packetsv5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/protocols/mqttprot"
+)
+
+// MQTT 5 is supported by converting the packets of MQTT 5 clients to the
+// MQTT 3.1.1 packets of paho, so they are processed in the same way as
+// the packets of MQTT 3.1.1 clients, the parts only available in MQTT 5,
+// like properties and reason codes, are carried by packetV5.
+
+const (
+	// mqttVersion311 is the protocol level of MQTT 3.1.1
+	mqttVersion311 byte = 4
+	// mqttVersion5 is the protocol level of MQTT 5
+	mqttVersion5 byte = 5
+
+	// topicAliasMaximum is the maximum topic alias accepted from MQTT 5 clients
+	topicAliasMaximum uint16 = 1024
+
+	// sessionExpiryNever is the session expiry interval of sessions never expire
+	sessionExpiryNever uint32 = 0xFFFFFFFF
+)
+
+type (
+	// packetV5 wraps a MQTT 3.1.1 packet with the parts of MQTT 5.
+	packetV5 struct {
+		packets.ControlPacket
+
+		props *packetsv5.Properties
+		// willProps is the will properties of connect packet
+		willProps *packetsv5.Properties
+		// subOptions is the subscription options of subscribe packet
+		subOptions []packetsv5.SubOptions
+		// reasonCodes is the reason codes of puback, unsuback and disconnect packets
+		reasonCodes []byte
+	}
+
+	// MessageProperties is the properties of MQTT 5 application message,
+	// they are forwarded to subscribers connected with MQTT 5.
+	MessageProperties struct {
+		PayloadFormat *byte `json:"payloadFormat,omitempty"`
+		// ExpireAt is unix time in milliseconds, zero means never expire.
+		ExpireAt        int64                   `json:"expireAt,omitempty"`
+		ContentType     string                  `json:"contentType,omitempty"`
+		ResponseTopic   string                  `json:"responseTopic,omitempty"`
+		CorrelationData []byte                  `json:"correlationData,omitempty"`
+		UserProperties  []mqttprot.UserProperty `json:"userProperties,omitempty"`
+	}
+)
+
+// readRawPacket reads a whole control packet, including the fixed header.
+func readRawPacket(r io.Reader) ([]byte, error) {
+	buf := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	length := 0
+	b := make([]byte, 1)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed remaining length")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+		length |= int(b[0]&0x7f) << (7 * i)
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	headerLen := len(buf)
+	buf = append(buf, make([]byte, length)...)
+	if _, err := io.ReadFull(r, buf[headerLen:]); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// packetContent returns the variable header and payload of a raw packet.
+func packetContent(raw []byte) []byte {
+	i := 1
+	for i < len(raw) && raw[i]&0x80 != 0 {
+		i++
+	}
+	return raw[i+1:]
+}
+
+// connectProtocolLevel returns the protocol level of a raw connect packet.
+func connectProtocolLevel(raw []byte) byte {
+	content := packetContent(raw)
+	if len(content) < 2 {
+		return 0
+	}
+	i := 2 + int(binary.BigEndian.Uint16(content))
+	if i >= len(content) {
+		return 0
+	}
+	return content[i]
+}
+
+// readConnectPacket reads the first packet of a connection, connect packet
+// of MQTT 5 is converted to a packetV5.
+func readConnectPacket(r io.Reader) (packets.ControlPacket, error) {
+	raw, err := readRawPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if raw[0]>>4 != packets.Connect || connectProtocolLevel(raw) != mqttVersion5 {
+		return packets.ReadPacket(bytes.NewReader(raw))
+	}
+
+	cp, err := packetsv5.ReadPacket(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	c := cp.Content.(*packetsv5.Connect)
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = c.ProtocolName
+	connect.ProtocolVersion = c.ProtocolVersion
+	connect.CleanSession = c.CleanStart
+	connect.WillFlag = c.WillFlag
+	connect.WillQos = c.WillQOS
+	connect.WillRetain = c.WillRetain
+	connect.UsernameFlag = c.UsernameFlag
+	connect.PasswordFlag = c.PasswordFlag
+	connect.Keepalive = c.KeepAlive
+	connect.ClientIdentifier = c.ClientID
+	connect.WillTopic = c.WillTopic
+	connect.WillMessage = c.WillMessage
+	connect.Username = c.Username
+	connect.Password = c.Password
+	connect.RemainingLength = len(packetContent(raw))
+	return &packetV5{ControlPacket: connect, props: c.Properties, willProps: c.WillProperties}, nil
+}
+
+// validateConnect validates the connect packet, the checks of MQTT 3.1.1
+// apply to MQTT 5 too, except that the client id could be empty.
+func validateConnect(connect *packets.ConnectPacket) byte {
+	if connect.ProtocolVersion != mqttVersion5 {
+		return connect.Validate()
+	}
+	c := *connect
+	c.ProtocolVersion = mqttVersion311
+	if c.ClientIdentifier == "" {
+		c.CleanSession = true
+	}
+	return c.Validate()
+}
+
+// readPacketV5 reads a packet of MQTT 5 and converts it to a packetV5.
+func readPacketV5(r io.Reader) (packets.ControlPacket, error) {
+	raw, err := readRawPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if raw[0]>>4 == packets.Subscribe {
+		return unpackSubscribeV5(raw)
+	}
+
+	cp, err := packetsv5.ReadPacket(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	switch p := cp.Content.(type) {
+	case *packetsv5.Publish:
+		publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		publish.Qos = p.QoS
+		publish.Retain = p.Retain
+		publish.Dup = p.Duplicate
+		publish.TopicName = p.Topic
+		publish.MessageID = p.PacketID
+		publish.Payload = p.Payload
+		publish.RemainingLength = len(packetContent(raw))
+		return &packetV5{ControlPacket: publish, props: p.Properties}, nil
+	case *packetsv5.Puback:
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.PacketID
+		return &packetV5{ControlPacket: puback, props: p.Properties, reasonCodes: []byte{p.ReasonCode}}, nil
+	case *packetsv5.Pubrec:
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.PacketID
+		return &packetV5{ControlPacket: pubrec, props: p.Properties, reasonCodes: []byte{p.ReasonCode}}, nil
+	case *packetsv5.Pubrel:
+		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubrel.MessageID = p.PacketID
+		return &packetV5{ControlPacket: pubrel, props: p.Properties, reasonCodes: []byte{p.ReasonCode}}, nil
+	case *packetsv5.Pubcomp:
+		pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pubcomp.MessageID = p.PacketID
+		return &packetV5{ControlPacket: pubcomp, props: p.Properties, reasonCodes: []byte{p.ReasonCode}}, nil
+	case *packetsv5.Unsubscribe:
+		unsubscribe := packets.NewControlPacket(packets.Unsubscribe).(*packets.UnsubscribePacket)
+		unsubscribe.MessageID = p.PacketID
+		unsubscribe.Topics = p.Topics
+		return &packetV5{ControlPacket: unsubscribe, props: p.Properties}, nil
+	case *packetsv5.Pingreq:
+		return &packetV5{ControlPacket: packets.NewControlPacket(packets.Pingreq)}, nil
+	case *packetsv5.Disconnect:
+		disconnect := packets.NewControlPacket(packets.Disconnect)
+		return &packetV5{ControlPacket: disconnect, props: p.Properties, reasonCodes: []byte{p.ReasonCode}}, nil
+	case *packetsv5.Auth:
+		return nil, errors.New("enhanced authentication not support")
+	}
+
+	// other packets are not expected from clients, they are converted to
+	// MQTT 3.1.1 packets only to be rejected in the same way.
+	if cp.Type > packets.Disconnect {
+		return nil, fmt.Errorf("unknown packet type %d", cp.Type)
+	}
+	return &packetV5{ControlPacket: packets.NewControlPacket(cp.Type)}, nil
+}
+
+// unpackSubscribeV5 unpacks subscribe packet of MQTT 5, which is not
+// unpacked by paho, since paho puts the subscriptions into a map and the
+// order of the subscriptions is lost.
+func unpackSubscribeV5(raw []byte) (packets.ControlPacket, error) {
+	buf := bytes.NewBuffer(packetContent(raw))
+	if buf.Len() < 2 {
+		return nil, errors.New("malformed subscribe packet")
+	}
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subscribe.MessageID = binary.BigEndian.Uint16(buf.Next(2))
+
+	props := &packetsv5.Properties{}
+	if err := props.Unpack(buf, packetsv5.SUBSCRIBE); err != nil {
+		return nil, err
+	}
+
+	p := &packetV5{ControlPacket: subscribe, props: props}
+	for buf.Len() > 0 {
+		if buf.Len() < 2 {
+			return nil, errors.New("malformed subscribe packet")
+		}
+		length := int(binary.BigEndian.Uint16(buf.Next(2)))
+		if buf.Len() < length {
+			return nil, errors.New("malformed subscribe packet")
+		}
+		topic := string(buf.Next(length))
+
+		// the options are not unpacked by paho, which doesn't shift the
+		// retain handling option.
+		b, err := buf.ReadByte()
+		if err != nil {
+			return nil, errors.New("malformed subscribe packet")
+		}
+		opts := packetsv5.SubOptions{
+			QoS:               b & 0x03,
+			NoLocal:           b&0x04 != 0,
+			RetainAsPublished: b&0x08 != 0,
+			RetainHandling:    (b >> 4) & 0x03,
+		}
+		subscribe.Topics = append(subscribe.Topics, topic)
+		subscribe.Qoss = append(subscribe.Qoss, opts.QoS)
+		p.subOptions = append(p.subOptions, opts)
+	}
+	if len(subscribe.Topics) == 0 {
+		return nil, errors.New("subscribe packet without topic filter")
+	}
+	return p, nil
+}
+
+// writePacket writes the packet in the protocol of the given version.
+func writePacket(w io.Writer, p packets.ControlPacket, version byte) error {
+	if version == mqttVersion5 {
+		return writePacketV5(w, p)
+	}
+	return p.Write(w)
+}
+
+// writePacketV5 converts the packet to MQTT 5 and writes it.
+func writePacketV5(w io.Writer, packet packets.ControlPacket) error {
+	v5, ok := packet.(*packetV5)
+	if ok {
+		packet = v5.ControlPacket
+	} else {
+		v5 = &packetV5{}
+	}
+	props := v5.props
+	if props == nil {
+		props = &packetsv5.Properties{}
+	}
+	reasonCode := func(i int, defaultCode byte) byte {
+		if i < len(v5.reasonCodes) {
+			return v5.reasonCodes[i]
+		}
+		return defaultCode
+	}
+
+	var cp *packetsv5.ControlPacket
+	switch p := packet.(type) {
+	case *packets.ConnackPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.CONNACK)
+		cp.Content = &packetsv5.Connack{
+			Properties:     props,
+			ReasonCode:     connackReasonCode(p.ReturnCode),
+			SessionPresent: p.SessionPresent,
+		}
+	case *packets.PublishPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.PUBLISH)
+		cp.Flags = p.Qos << 1
+		if p.Dup {
+			cp.Flags |= 1 << 3
+		}
+		if p.Retain {
+			cp.Flags |= 1
+		}
+		cp.Content = &packetsv5.Publish{
+			Payload:    p.Payload,
+			Topic:      p.TopicName,
+			Properties: props,
+			PacketID:   p.MessageID,
+			QoS:        p.Qos,
+			Duplicate:  p.Dup,
+			Retain:     p.Retain,
+		}
+	case *packets.PubackPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.PUBACK)
+		cp.Content = &packetsv5.Puback{
+			Properties: props,
+			PacketID:   p.MessageID,
+			ReasonCode: reasonCode(0, packetsv5.PubackSuccess),
+		}
+	case *packets.PubrecPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.PUBREC)
+		cp.Content = &packetsv5.Pubrec{
+			Properties: props,
+			PacketID:   p.MessageID,
+			ReasonCode: reasonCode(0, packetsv5.PubrecSuccess),
+		}
+	case *packets.PubrelPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.PUBREL)
+		cp.Content = &packetsv5.Pubrel{
+			Properties: props,
+			PacketID:   p.MessageID,
+			// paho defines no reason code constant for PUBREL, 0 is success
+			ReasonCode: reasonCode(0, 0),
+		}
+	case *packets.PubcompPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.PUBCOMP)
+		cp.Content = &packetsv5.Pubcomp{
+			Properties: props,
+			PacketID:   p.MessageID,
+			ReasonCode: reasonCode(0, packetsv5.PubcompSuccess),
+		}
+	case *packets.SubackPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.SUBACK)
+		cp.Content = &packetsv5.Suback{
+			Properties: props,
+			Reasons:    p.ReturnCodes,
+			PacketID:   p.MessageID,
+		}
+	case *packets.UnsubackPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.UNSUBACK)
+		cp.Content = &packetsv5.Unsuback{
+			Reasons:    v5.reasonCodes,
+			Properties: props,
+			PacketID:   p.MessageID,
+		}
+	case *packets.PingrespPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.PINGRESP)
+	case *packets.DisconnectPacket:
+		cp = packetsv5.NewControlPacket(packetsv5.DISCONNECT)
+		cp.Content = &packetsv5.Disconnect{
+			Properties: props,
+			ReasonCode: reasonCode(0, packetsv5.DisconnectNormalDisconnection),
+		}
+	default:
+		return fmt.Errorf("packet %s not support in MQTT 5", packet.String())
+	}
+
+	_, err := cp.WriteTo(w)
+	return err
+}
+
+// connackReasonCode converts the connack return code of MQTT 3.1.1 to
+// the reason code of MQTT 5.
+func connackReasonCode(code byte) byte {
+	switch code {
+	case packets.Accepted:
+		return packetsv5.ConnackSuccess
+	case packets.ErrRefusedBadProtocolVersion:
+		return packetsv5.ConnackUnsupportedProtocolVersion
+	case packets.ErrRefusedIDRejected:
+		return packetsv5.ConnackInvalidClientID
+	case packets.ErrRefusedServerUnavailable:
+		return packetsv5.ConnackServerUnavailable
+	case packets.ErrRefusedBadUsernameOrPassword:
+		return packetsv5.ConnackBadUsernameOrPassword
+	case packets.ErrRefusedNotAuthorised:
+		return packetsv5.ConnackNotAuthorized
+	case packets.ErrProtocolViolation:
+		return packetsv5.ConnackProtocolError
+	}
+	return packetsv5.ConnackUnspecifiedError
+}
+
+// newDisconnectV5 creates a disconnect packet of MQTT 5 with the reason code.
+func newDisconnectV5(reasonCode byte) *packetV5 {
+	return &packetV5{
+		ControlPacket: packets.NewControlPacket(packets.Disconnect),
+		reasonCodes:   []byte{reasonCode},
+	}
+}
+
+func newUserProperties(users []packetsv5.User) []mqttprot.UserProperty {
+	if len(users) == 0 {
+		return nil
+	}
+	props := make([]mqttprot.UserProperty, len(users))
+	for i, u := range users {
+		props[i] = mqttprot.UserProperty{Key: u.Key, Value: u.Value}
+	}
+	return props
+}
+
+func newUsersV5(props []mqttprot.UserProperty) []packetsv5.User {
+	if len(props) == 0 {
+		return nil
+	}
+	users := make([]packetsv5.User, len(props))
+	for i, p := range props {
+		users[i] = packetsv5.User{Key: p.Key, Value: p.Value}
+	}
+	return users
+}
+
+// newMessageProperties returns the properties of an application message
+// received at now, it returns nil if there's no such properties.
+func newMessageProperties(props *packetsv5.Properties, now time.Time) *MessageProperties {
+	if props == nil {
+		return nil
+	}
+	mp := &MessageProperties{
+		PayloadFormat:   props.PayloadFormat,
+		ContentType:     props.ContentType,
+		ResponseTopic:   props.ResponseTopic,
+		CorrelationData: props.CorrelationData,
+		UserProperties:  newUserProperties(props.User),
+	}
+	if props.MessageExpiry != nil {
+		mp.ExpireAt = now.Add(time.Duration(*props.MessageExpiry) * time.Second).UnixMilli()
+	}
+	if mp.PayloadFormat == nil && mp.ExpireAt == 0 && mp.ContentType == "" &&
+		mp.ResponseTopic == "" && mp.CorrelationData == nil && mp.UserProperties == nil {
+		return nil
+	}
+	return mp
+}
+
+func (mp *MessageProperties) expired(now time.Time) bool {
+	return mp != nil && mp.ExpireAt > 0 && now.UnixMilli() >= mp.ExpireAt
+}
+
+// propertiesV5 returns the properties of MQTT 5 publish packet sent at now,
+// the message expiry is the lifetime left.
+func (mp *MessageProperties) propertiesV5(now time.Time) *packetsv5.Properties {
+	if mp == nil {
+		return nil
+	}
+	props := &packetsv5.Properties{
+		PayloadFormat:   mp.PayloadFormat,
+		ContentType:     mp.ContentType,
+		ResponseTopic:   mp.ResponseTopic,
+		CorrelationData: mp.CorrelationData,
+		User:            newUsersV5(mp.UserProperties),
+	}
+	if mp.ExpireAt > 0 {
+		left := uint32((mp.ExpireAt - now.UnixMilli() + 999) / 1000)
+		props.MessageExpiry = &left
+	}
+	return props
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	packetsv5 "github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/protocols/mqttprot"
+	"github.com/stretchr/testify/assert"
+)
+
+func packV5(t *testing.T, cp *packetsv5.ControlPacket) []byte {
+	buf := &bytes.Buffer{}
+	_, err := cp.WriteTo(buf)
+	assert.Nil(t, err)
+	return buf.Bytes()
+}
+
+func newPublishV5(topic string, qos byte, packetID uint16) *packetsv5.ControlPacket {
+	cp := packetsv5.NewControlPacket(packetsv5.PUBLISH)
+	cp.Flags = qos << 1
+	publish := cp.Content.(*packetsv5.Publish)
+	publish.Topic = topic
+	publish.QoS = qos
+	publish.PacketID = packetID
+	return cp
+}
+
+func TestMQTT5Codec(t *testing.T) {
+	assert := assert.New(t)
+
+	// connect
+	expiry := uint32(60)
+	cp := packetsv5.NewControlPacket(packetsv5.CONNECT)
+	connect := cp.Content.(*packetsv5.Connect)
+	connect.ClientID = "client"
+	connect.KeepAlive = 30
+	connect.CleanStart = true
+	connect.UsernameFlag = true
+	connect.Username = "user"
+	connect.Properties.SessionExpiryInterval = &expiry
+	packet, err := readConnectPacket(bytes.NewReader(packV5(t, cp)))
+	assert.Nil(err)
+	v5 := packet.(*packetV5)
+	c := v5.ControlPacket.(*packets.ConnectPacket)
+	assert.Equal(mqttVersion5, c.ProtocolVersion)
+	assert.Equal("client", c.ClientIdentifier)
+	assert.Equal("user", c.Username)
+	assert.True(c.CleanSession)
+	assert.Equal(uint16(30), c.Keepalive)
+	assert.Equal(expiry, *v5.props.SessionExpiryInterval)
+	assert.Equal(byte(packets.Accepted), validateConnect(c))
+	c.ClientIdentifier = ""
+	c.CleanSession = false
+	assert.Equal(byte(packets.Accepted), validateConnect(c))
+
+	// connect of MQTT 3.1.1
+	connect311 := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect311.ProtocolName = "MQTT"
+	connect311.ProtocolVersion = mqttVersion311
+	connect311.ClientIdentifier = "client"
+	buf := &bytes.Buffer{}
+	assert.Nil(connect311.Write(buf))
+	packet, err = readConnectPacket(buf)
+	assert.Nil(err)
+	assert.Equal("client", packet.(*packets.ConnectPacket).ClientIdentifier)
+
+	// subscriptions keep the order and options
+	raw := []byte{packetsv5.SUBSCRIBE<<4 | 2, 0, 0, 1, 0}
+	for _, sub := range []struct {
+		topic string
+		opts  byte
+	}{{"b", 0x21}, {"a/#", 0x10}, {"$share/g/c", 0x00}} {
+		raw = append(raw, 0, byte(len(sub.topic)))
+		raw = append(raw, sub.topic...)
+		raw = append(raw, sub.opts)
+	}
+	raw[1] = byte(len(raw) - 2)
+	packet, err = readPacketV5(bytes.NewReader(raw))
+	assert.Nil(err)
+	v5 = packet.(*packetV5)
+	subscribe := v5.ControlPacket.(*packets.SubscribePacket)
+	assert.Equal(uint16(1), subscribe.MessageID)
+	assert.Equal([]string{"b", "a/#", "$share/g/c"}, subscribe.Topics)
+	assert.Equal([]byte{QoS1, QoS0, QoS0}, subscribe.Qoss)
+	assert.Equal(byte(2), v5.subOptions[0].RetainHandling)
+	assert.Equal(byte(1), v5.subOptions[1].RetainHandling)
+
+	// publish with properties
+	cp = newPublishV5("a/b", QoS1, 10)
+	publish := cp.Content.(*packetsv5.Publish)
+	publish.Payload = []byte("hello")
+	publish.Properties.User = []packetsv5.User{{Key: "k", Value: "v"}}
+	publish.Properties.MessageExpiry = &expiry
+	packet, err = readPacketV5(bytes.NewReader(packV5(t, cp)))
+	assert.Nil(err)
+	v5 = packet.(*packetV5)
+	p := v5.ControlPacket.(*packets.PublishPacket)
+	assert.Equal("a/b", p.TopicName)
+	assert.Equal(QoS1, p.Qos)
+	assert.Equal(uint16(10), p.MessageID)
+	assert.Equal([]byte("hello"), p.Payload)
+
+	now := time.Now()
+	props := newMessageProperties(v5.props, now)
+	assert.Equal([]mqttprot.UserProperty{{Key: "k", Value: "v"}}, props.UserProperties)
+	assert.False(props.expired(now))
+	assert.True(props.expired(now.Add(time.Minute)))
+	assert.Equal(uint32(30), *props.propertiesV5(now.Add(30 * time.Second)).MessageExpiry)
+	assert.Nil(newMessageProperties(&packetsv5.Properties{}, now))
+
+	// publish to MQTT 5 client
+	buf.Reset()
+	assert.Nil(writePacket(buf, &packetV5{ControlPacket: p, props: props.propertiesV5(now)}, mqttVersion5))
+	cp, err = packetsv5.ReadPacket(buf)
+	assert.Nil(err)
+	publish = cp.Content.(*packetsv5.Publish)
+	assert.Equal("a/b", publish.Topic)
+	assert.Equal(QoS1, publish.QoS)
+	assert.Equal([]packetsv5.User{{Key: "k", Value: "v"}}, publish.Properties.User)
+
+	// acks with reason codes
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = packets.ErrRefusedNotAuthorised
+	buf.Reset()
+	assert.Nil(writePacket(buf, connack, mqttVersion5))
+	cp, err = packetsv5.ReadPacket(buf)
+	assert.Nil(err)
+	assert.Equal(byte(packetsv5.ConnackNotAuthorized), cp.Content.(*packetsv5.Connack).ReasonCode)
+
+	unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+	unsuback.MessageID = 3
+	buf.Reset()
+	assert.Nil(writePacket(buf, &packetV5{ControlPacket: unsuback, reasonCodes: []byte{0, packetsv5.UnsubackNoSubscriptionFound}}, mqttVersion5))
+	cp, err = packetsv5.ReadPacket(buf)
+	assert.Nil(err)
+	assert.Equal([]byte{0, packetsv5.UnsubackNoSubscriptionFound}, cp.Content.(*packetsv5.Unsuback).Reasons)
+
+	buf.Reset()
+	assert.Nil(writePacket(buf, newDisconnectV5(packetsv5.DisconnectSessionTakenOver), mqttVersion5))
+	cp, err = packetsv5.ReadPacket(buf)
+	assert.Nil(err)
+	assert.Equal(byte(packetsv5.DisconnectSessionTakenOver), cp.Content.(*packetsv5.Disconnect).ReasonCode)
+}
+
+func TestSharedTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	group, filter, ok := splitSharedTopic("$share/g1/a/+/c")
+	assert.True(ok)
+	assert.Equal("g1", group)
+	assert.Equal("a/+/c", filter)
+	for _, topic := range []string{"a/b", "$share/g1", "$share/g1/", "$share//a", "$share/g+/a"} {
+		_, _, ok = splitSharedTopic(topic)
+		assert.False(ok, topic)
+	}
+
+	id := sharedSubscriberID("g1", "client/1")
+	assert.Equal("client/1", subscriberClientID(id))
+	assert.Equal("client", subscriberClientID("client"))
+
+	groups := groupBySubscriber([]string{"a", "$share/g1/b", "c", "$share/g1/d/#"}, []byte{0, 1, 1, 0}, "client")
+	assert.Equal(2, len(groups))
+	assert.Equal([]string{"a", "c"}, groups["client"].topics)
+	assert.Equal([]byte{0, 1}, groups["client"].qoss)
+	assert.Equal([]string{"b", "d/#"}, groups[sharedSubscriberID("g1", "client")].topics)
+
+	mgr := newNoCacheTopicManager(100)
+	mgr.subscribe([]string{"$share/g1/a/+"}, []byte{QoS1}, "c1")
+	mgr.subscribe([]string{"$share/g1/a/+", "a/b"}, []byte{QoS1, QoS1}, "c2")
+	subscribers, _ := mgr.findSubscribers("a/b")
+	assert.Equal(map[string]byte{
+		sharedSubscriberID("g1", "c1"): QoS1,
+		sharedSubscriberID("g1", "c2"): QoS1,
+		"c2":                           QoS1,
+	}, subscribers)
+
+	b := &Broker{}
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		subscribers, _ := mgr.findSubscribers("a/b")
+		picked := b.pickSharedSubscribers(subscribers)
+		assert.Equal(1, len(picked))
+		assert.Equal(2, len(subscribers))
+		counts[picked[0]]++
+	}
+	assert.Equal(5, counts[sharedSubscriberID("g1", "c1")])
+	assert.Equal(5, counts[sharedSubscriberID("g1", "c2")])
+
+	subscribers, _ = mgr.findSubscribers("a/b")
+	keepSharedSubscribers(subscribers, []string{sharedSubscriberID("g1", "c1")})
+	assert.Equal(map[string]byte{sharedSubscriberID("g1", "c1"): QoS1, "c2": QoS1}, subscribers)
+
+	mgr.unsubscribe([]string{"$share/g1/a/+"}, "c1")
+	subscribers, _ = mgr.findSubscribers("a/b")
+	assert.Equal(2, len(subscribers))
+}
+
+type clientV5 struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func newClientV5(t *testing.T, clientID string) (*clientV5, *packetsv5.Connack) {
+	conn, err := net.Dial("tcp", "localhost:1883")
+	assert.Nil(t, err)
+	c := &clientV5{t: t, conn: conn}
+
+	cp := packetsv5.NewControlPacket(packetsv5.CONNECT)
+	connect := cp.Content.(*packetsv5.Connect)
+	connect.ClientID = clientID
+	connect.CleanStart = true
+	c.write(cp)
+	return c, c.read(time.Second).Content.(*packetsv5.Connack)
+}
+
+func (c *clientV5) write(cp *packetsv5.ControlPacket) {
+	_, err := cp.WriteTo(c.conn)
+	assert.Nil(c.t, err)
+}
+
+func (c *clientV5) read(timeout time.Duration) *packetsv5.ControlPacket {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	cp, err := packetsv5.ReadPacket(c.conn)
+	if err != nil {
+		return nil
+	}
+	return cp
+}
+
+func (c *clientV5) subscribe(topic string, qos byte) *packetsv5.Suback {
+	cp := packetsv5.NewControlPacket(packetsv5.SUBSCRIBE)
+	subscribe := cp.Content.(*packetsv5.Subscribe)
+	subscribe.PacketID = 1
+	subscribe.Subscriptions[topic] = packetsv5.SubOptions{QoS: qos}
+	c.write(cp)
+	return c.read(time.Second).Content.(*packetsv5.Suback)
+}
+
+// receive returns the messages received in the duration.
+func (c *clientV5) receive(d time.Duration) []*packetsv5.Publish {
+	var ans []*packetsv5.Publish
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		cp := c.read(time.Until(deadline))
+		if cp == nil {
+			break
+		}
+		if publish, ok := cp.Content.(*packetsv5.Publish); ok {
+			ans = append(ans, publish)
+		}
+	}
+	return ans
+}
+
+func TestMQTT5Broker(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.BrokerMode = true
+	broker := newBroker(spec, nil, newStorage(nil), &mockMuxMapper{}, func(s, ss string) (map[string]string, error) {
+		return map[string]string{}, nil
+	})
+	defer broker.close()
+
+	// client id is assigned if it is empty
+	publisher, connack := newClientV5(t, "")
+	defer publisher.conn.Close()
+	assert.Equal(byte(packetsv5.ConnackSuccess), connack.ReasonCode)
+	assert.NotEmpty(connack.Properties.AssignedClientID)
+	assert.Equal(topicAliasMaximum, *connack.Properties.TopicAliasMaximum)
+	assert.Equal(byte(1), *connack.Properties.SharedSubAvailable)
+
+	subscriber, _ := newClientV5(t, "subscriber")
+	defer subscriber.conn.Close()
+	suback := subscriber.subscribe("device/+", QoS1)
+	assert.Equal([]byte{QoS1}, suback.Reasons)
+
+	members := []*clientV5{}
+	for _, id := range []string{"member1", "member2"} {
+		member, _ := newClientV5(t, id)
+		defer member.conn.Close()
+		suback = member.subscribe("$share/group/device/#", QoS1)
+		assert.Equal([]byte{QoS1}, suback.Reasons)
+		members = append(members, member)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the topic of the later messages is set by topic alias
+	alias := uint16(1)
+	for i := 0; i < 4; i++ {
+		topic := ""
+		if i == 0 {
+			topic = "device/1"
+		}
+		cp := newPublishV5(topic, QoS1, uint16(i+1))
+		publish := cp.Content.(*packetsv5.Publish)
+		publish.Payload = []byte("on")
+		publish.Properties.TopicAlias = &alias
+		publish.Properties.User = []packetsv5.User{{Key: "index", Value: string(rune('0' + i))}}
+		publisher.write(cp)
+
+		puback := publisher.read(time.Second).Content.(*packetsv5.Puback)
+		assert.Equal(uint16(i+1), puback.PacketID)
+		assert.Equal(byte(packetsv5.PubackSuccess), puback.ReasonCode)
+	}
+
+	msgs := subscriber.receive(500 * time.Millisecond)
+	assert.Equal(4, len(msgs))
+	for _, msg := range msgs {
+		assert.Equal("device/1", msg.Topic)
+		assert.Equal(1, len(msg.Properties.User))
+		assert.Nil(msg.Properties.TopicAlias)
+	}
+
+	// messages are load balanced among the members of share group
+	for _, member := range members {
+		msgs := member.receive(500 * time.Millisecond)
+		assert.Equal(2, len(msgs))
+	}
+
+	// unsubscribe with reason codes
+	cp := packetsv5.NewControlPacket(packetsv5.UNSUBSCRIBE)
+	unsubscribe := cp.Content.(*packetsv5.Unsubscribe)
+	unsubscribe.PacketID = 2
+	unsubscribe.Topics = []string{"device/+", "unknown"}
+	subscriber.write(cp)
+	unsuback := subscriber.read(time.Second).Content.(*packetsv5.Unsuback)
+	assert.Equal([]byte{packetsv5.UnsubackSuccess, packetsv5.UnsubackNoSubscriptionFound}, unsuback.Reasons)
+
+	// unknown topic alias
+	cp = newPublishV5("", QoS0, 0)
+	publish := cp.Content.(*packetsv5.Publish)
+	alias = 2
+	publish.Properties.TopicAlias = &alias
+	publisher.write(cp)
+	disconnect := publisher.read(time.Second).Content.(*packetsv5.Disconnect)
+	assert.Equal(byte(packetsv5.DisconnectTopicAliasInvalid), disconnect.ReasonCode)
+
+	// session taken over
+	takeover, _ := newClientV5(t, "subscriber")
+	defer takeover.conn.Close()
+	disconnect = subscriber.read(time.Second).Content.(*packetsv5.Disconnect)
+	assert.Equal(byte(packetsv5.DisconnectSessionTakenOver), disconnect.ReasonCode)
+}
@@ -20,6 +20,7 @@ package mqttproxy
 import (
 	"bytes"
 	stdcontext "context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -41,8 +42,10 @@ import (
 	"github.com/megaease/easegress/pkg/logger"
 	"github.com/megaease/easegress/pkg/object/pipeline"
 	"github.com/megaease/easegress/pkg/option"
+	"github.com/megaease/easegress/pkg/protocols/mqttprot"
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
 	"github.com/openzipkin/zipkin-go/propagation/b3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -120,7 +123,7 @@ func getDefaultSpec() *Spec {
 
 func getBrokerFromSpec(spec *Spec, mapper context.MuxMapper) *Broker {
 	store := newStorage(nil)
-	broker := newBroker(spec, store, mapper, func(s, ss string) (map[string]string, error) {
+	broker := newBroker(spec, nil, store, mapper, func(s, ss string) (map[string]string, error) {
 		m := map[string]string{
 			"test":  "http://localhost:8888/mqtt",
 			"test1": "http://localhost:8889/mqtt",
@@ -373,12 +376,13 @@ func TestCleanSession(t *testing.T) {
 	if c != nil {
 		c.closeAndDelSession()
 	}
+	// subscriptions of persistent session are kept to queue messages
 	subscribers, err = broker.topicMgr.findSubscribers("test/cleanSession/0")
 	if err != nil {
 		t.Errorf("findSubscribers for topic test/cleanSession/0 failed, %v", err)
 	}
-	if _, ok := subscribers[cid]; ok {
-		t.Errorf("topicMgr is not cleaned when client %v close connection", subscribers)
+	if _, ok := subscribers[cid]; !ok {
+		t.Errorf("topicMgr is cleaned when client of persistent session close connection, got %v", subscribers)
 	}
 	_, err = broker.sessMgr.store.get(sessionStoreKey(cid))
 	if err != nil {
@@ -617,7 +621,7 @@ func TestSendMsgBack(t *testing.T) {
 			for j := 0; j < msgNum; j++ {
 				topic := r.ClientID()
 				text := fmt.Sprintf("sub %d", j)
-				broker.sendMsgToClient(nil, topic, []byte(text), QoS1)
+				broker.sendMsgToClient(nil, topic, []byte(text), QoS1, nil, nil)
 			}
 		}(clients[i])
 	}
@@ -943,6 +947,28 @@ func TestHTTPPublish(t *testing.T) {
 	close(done)
 }
 
+func TestMQTTProxyPublish(t *testing.T) {
+	assert := assert.New(t)
+	broker := getDefaultBroker(&mockMuxMapper{})
+	defer broker.close()
+	mp := &MQTTProxy{broker: broker}
+
+	ch := make(chan CheckMsg, 10)
+	client := getMQTTClient(t, "test", "test", "test", true)
+	defer client.Disconnect(200)
+	token := client.Subscribe("test", 1, getMQTTSubscribeHandler(ch))
+	token.Wait()
+	assert.Nil(token.Error())
+
+	mp.Publish("publisher", "test", []byte("hello"), 1, []mqttprot.UserProperty{{Key: "k", Value: "v"}})
+	select {
+	case msg := <-ch:
+		assert.Equal(CheckMsg{topic: "test", payload: "hello", qos: 1}, msg)
+	case <-time.After(5 * time.Second):
+		assert.Fail("message not received")
+	}
+}
+
 func TestHTTPTransfer(t *testing.T) {
 	mapper := &mockMuxMapper{}
 	broker0 := getDefaultBroker(mapper)
@@ -1252,12 +1278,6 @@ func TestClient(t *testing.T) {
 		t.Errorf("client should not send connack")
 	}
 
-	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
-	err = client.processPacket(pubrec)
-	if err == nil {
-		t.Errorf("qos2 not support now")
-	}
-
 	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
 	err = client.processPacket(suback)
 	if err == nil {
@@ -1957,7 +1977,7 @@ func TestSingleNodeBrokerMode(t *testing.T) {
 	spec.BrokerMode = true
 	store := newStorage(nil)
 	mapper := &mockMuxMapper{}
-	broker := newBroker(spec, store, mapper, func(s, ss string) (map[string]string, error) {
+	broker := newBroker(spec, nil, store, mapper, func(s, ss string) (map[string]string, error) {
 		return map[string]string{}, nil
 	})
 	defer broker.close()
@@ -2031,7 +2051,7 @@ func TestBrokerModeWatch(t *testing.T) {
 	spec.BrokerMode = true
 	store := newStorage(nil)
 	mapper := &mockMuxMapper{}
-	broker := newBroker(spec, store, mapper, func(s, ss string) (map[string]string, error) {
+	broker := newBroker(spec, nil, store, mapper, func(s, ss string) (map[string]string, error) {
 		return map[string]string{
 			eg2: "http://localhost:8888/mqtt",
 		}, nil
@@ -2102,7 +2122,7 @@ func TestBrokerModeWatch(t *testing.T) {
 	publish.TopicName = topicOnEg2
 	publish.Payload = []byte("hello")
 	publish.Qos = 1
-	broker.processBrokerModePublish("clientOnEg1", publish)
+	broker.processBrokerModePublish("clientOnEg1", publish, nil)
 
 	var res *httpRes
 	select {
@@ -2120,3 +2140,46 @@ func TestBrokerModeWatch(t *testing.T) {
 	assert.True(data.Distributed)
 	assert.Equal(1, data.QoS)
 }
+
+func TestBrokerTLSPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &Spec{
+		Name:   "test-1",
+		EGName: "test-1",
+		Port:   1886,
+		UseTLS: true,
+		Certificate: []Certificate{
+			{"demo", certPem, keyPem},
+		},
+		TLSPolicy: &tlspolicy.Spec{
+			Options: tlspolicy.Options{MinVersion: "TLS1.3"},
+		},
+	}
+	assert.NoError(spec.Validate())
+
+	policy := tlspolicy.New(spec.TLSPolicy, spec.Name, nil)
+	broker := newBroker(spec, policy, newStorage(nil), &mockMuxMapper{}, func(s, ss string) (map[string]string, error) {
+		return map[string]string{}, nil
+	})
+	if !assert.NotNil(broker) {
+		return
+	}
+	defer broker.close()
+
+	dial := func(maxVersion uint16) error {
+		conn, err := tls.Dial("tcp", "127.0.0.1:1886", &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         maxVersion,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	assert.Error(dial(tls.VersionTLS12))
+	assert.NoError(dial(tls.VersionTLS13))
+
+	spec.UseTLS = false
+	assert.Error(spec.Validate())
+}
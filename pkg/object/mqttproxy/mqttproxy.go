@@ -28,8 +28,10 @@ import (
 	"github.com/megaease/easegress/pkg/cluster"
 	"github.com/megaease/easegress/pkg/context"
 	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/protocols/mqttprot"
 	"github.com/megaease/easegress/pkg/supervisor"
 	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
 )
 
 const (
@@ -149,8 +151,12 @@ func (mp *MQTTProxy) Init(superSpec *supervisor.Spec, muxMapper context.MuxMappe
 	spec.EGName = superSpec.Super().Options().Name
 	mp.superSpec, mp.spec = superSpec, spec
 
+	var tlsPolicy *tlspolicy.Policy
+	if spec.UseTLS {
+		tlsPolicy = tlspolicy.New(spec.TLSPolicy, superSpec.Name(), superSpec.Super().Cluster())
+	}
 	store := newStorage(superSpec.Super().Cluster())
-	mp.broker = newBroker(spec, store, muxMapper, memberURLFunc(superSpec))
+	mp.broker = newBroker(spec, tlsPolicy, store, muxMapper, memberURLFunc(superSpec))
 	if mp.broker == nil {
 		panic(fmt.Sprintf("broker %v start failed", spec.Name))
 	}
@@ -163,6 +169,17 @@ func (mp *MQTTProxy) Inherit(superSpec *supervisor.Spec, previousGeneration supe
 	mp.Init(superSpec, muxMapper)
 }
 
+// Publish publishes a message to the MQTT clients subscribing the topic,
+// the message is sent to the clients connected to other members of the
+// cluster too. clientID is the publisher used for tracing.
+func (mp *MQTTProxy) Publish(clientID, topic string, payload []byte, qos byte, userProperties []mqttprot.UserProperty) {
+	var props *MessageProperties
+	if len(userProperties) > 0 {
+		props = &MessageProperties{UserProperties: userProperties}
+	}
+	mp.broker.publish(clientID, topic, payload, qos, props)
+}
+
 // Close closes MQTTProxy.
 func (mp *MQTTProxy) Close() {
 	mp.broker.close()
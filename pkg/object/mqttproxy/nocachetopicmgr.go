@@ -40,20 +40,34 @@ func (mgr *noCacheTopicManager) findSubscribers(topic string) (map[string]byte,
 }
 
 func (mgr *noCacheTopicManager) subscribe(topics []string, qoss []byte, clientID string) error {
-	allLevels, err := mgr.topicCache.getAll(topics)
-	if err != nil {
-		return err
+	groups := groupBySubscriber(topics, qoss, clientID)
+	allLevels := make(map[string][][]string, len(groups))
+	for id, st := range groups {
+		levels, err := mgr.topicCache.getAll(st.topics)
+		if err != nil {
+			return err
+		}
+		allLevels[id] = levels
+	}
+	for id, levels := range allLevels {
+		mgr.topicMgr.subscribe(levels, groups[id].qoss, id)
 	}
-	mgr.topicMgr.subscribe(allLevels, qoss, clientID)
 	return nil
 }
 
 func (mgr *noCacheTopicManager) unsubscribe(topics []string, clientID string) error {
-	allLevels, err := mgr.topicCache.getAll(topics)
-	if err != nil {
-		return err
+	groups := groupBySubscriber(topics, nil, clientID)
+	allLevels := make(map[string][][]string, len(groups))
+	for id, st := range groups {
+		levels, err := mgr.topicCache.getAll(st.topics)
+		if err != nil {
+			return err
+		}
+		allLevels[id] = levels
+	}
+	for id, levels := range allLevels {
+		mgr.topicMgr.unsubscribe(levels, id)
 	}
-	mgr.topicMgr.unsubscribe(allLevels, clientID)
 	return nil
 }
 
@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/codectool"
+)
+
+type (
+	// retainManager manages the retained messages of a broker. The messages
+	// are persisted in the storage, so they survive restarts and are shared
+	// among the members of the cluster, and cached locally to serve new
+	// subscriptions.
+	retainManager struct {
+		sync.RWMutex
+		name     string
+		store    storage
+		messages map[string]*retainedMessage
+		storeCh  chan *retainStore
+		done     chan struct{}
+	}
+
+	retainedMessage struct {
+		topic   string
+		levels  []string
+		payload []byte
+		qos     byte
+		props   *MessageProperties
+	}
+
+	// retainStore is a pending write of a retained message, value is nil
+	// if the retained message is cleared.
+	retainStore struct {
+		topic string
+		value *string
+	}
+)
+
+func newRetainManager(name string, store storage) *retainManager {
+	rm := &retainManager{
+		name:     name,
+		store:    store,
+		messages: make(map[string]*retainedMessage),
+		storeCh:  make(chan *retainStore, 1024),
+		done:     make(chan struct{}),
+	}
+	go rm.doStore()
+	go rm.connectWatcher()
+	return rm
+}
+
+func (rm *retainManager) closed() bool {
+	select {
+	case <-rm.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rm *retainManager) close() {
+	close(rm.done)
+}
+
+// retain stores the message as the retained message of its topic, it
+// replaces the previous one, and clears it if the payload is empty.
+func (rm *retainManager) retain(publish *packets.PublishPacket, props *MessageProperties) {
+	topic := publish.TopicName
+	levels, valid := splitTopic(topic)
+	if !valid || strings.ContainsAny(topic, "+#") {
+		logger.SpanErrorf(nil, "ignored retained message of invalid topic %s", topic)
+		return
+	}
+
+	rs := &retainStore{topic: topic}
+	rm.Lock()
+	if len(publish.Payload) == 0 {
+		delete(rm.messages, topic)
+	} else {
+		rm.messages[topic] = &retainedMessage{
+			topic:   topic,
+			levels:  levels,
+			payload: publish.Payload,
+			qos:     publish.Qos,
+			props:   props,
+		}
+		msg := newMsg(topic, publish.Payload, publish.Qos)
+		msg.Properties = props
+		value, err := codectool.MarshalJSON(msg)
+		if err != nil {
+			rm.Unlock()
+			logger.SpanErrorf(nil, "encode retained message of topic %s failed: %v", topic, err)
+			return
+		}
+		str := string(value)
+		rs.value = &str
+	}
+	rm.Unlock()
+
+	select {
+	case rm.storeCh <- rs:
+	case <-rm.done:
+	}
+}
+
+func (rm *retainManager) doStore() {
+	for {
+		select {
+		case <-rm.done:
+			return
+		case rs := <-rm.storeCh:
+			var err error
+			if rs.value == nil {
+				err = rm.store.delete(retainStoreKey(rm.name, rs.topic))
+			} else {
+				err = rm.store.put(retainStoreKey(rm.name, rs.topic), *rs.value)
+			}
+			if err != nil {
+				logger.SpanErrorf(nil, "store retained message of topic %s failed: %v", rs.topic, err)
+			}
+		}
+	}
+}
+
+// match returns the retained messages which match the subscribed topics,
+// the QoS of the returned messages are downgraded to the subscribed QoS,
+// and the expired messages are ignored.
+func (rm *retainManager) match(topics []string, qoss []byte) []*retainedMessage {
+	// the subscribed topics are inserted into a levelTopicManager, with
+	// themselves as the client ids, so the wildcard matching is the same
+	// as the one used to find subscribers.
+	mgr := newLevelTopicManager()
+	for i, topic := range topics {
+		levels, valid := splitTopic(topic)
+		if !valid {
+			continue
+		}
+		mgr.insert(levels, qoss[i], topic)
+	}
+
+	rm.RLock()
+	defer rm.RUnlock()
+
+	now := time.Now()
+	var ans []*retainedMessage
+	for _, msg := range rm.messages {
+		if msg.props.expired(now) {
+			continue
+		}
+		subscribers := mgr.findSubscribers(msg.levels)
+		if len(subscribers) == 0 {
+			continue
+		}
+
+		qos := QoS0
+		for _, subQoS := range subscribers {
+			if subQoS > qos {
+				qos = subQoS
+			}
+		}
+		if msg.qos < qos {
+			qos = msg.qos
+		}
+		ans = append(ans, &retainedMessage{
+			topic:   msg.topic,
+			levels:  msg.levels,
+			payload: msg.payload,
+			qos:     qos,
+			props:   msg.props,
+		})
+	}
+	return ans
+}
+
+func (rm *retainManager) connectWatcher() {
+	prefix := retainStoreKey(rm.name, "")
+
+	var ch <-chan map[string]*string
+	var cancelFunc func()
+	var err error
+	for {
+		if rm.closed() {
+			return
+		}
+
+		ch, cancelFunc, err = rm.store.watch(prefix)
+		if err == nil {
+			break
+		}
+		logger.SpanErrorf(nil, "get watcher for retained messages failed, %v", err)
+		time.Sleep(10 * time.Second)
+	}
+
+	messages, err := rm.store.getPrefix(prefix, false)
+	if err != nil {
+		logger.SpanErrorf(nil, "get all retained messages failed, %v", err)
+	} else {
+		event := make(map[string]*string)
+		for k, v := range messages {
+			v := v
+			event[k] = &v
+		}
+		rm.processWatcherEvent(event, true)
+	}
+
+	go rm.watch(ch, cancelFunc)
+}
+
+func (rm *retainManager) watch(ch <-chan map[string]*string, closeFunc func()) {
+	defer closeFunc()
+	for {
+		select {
+		case <-rm.done:
+			return
+		case m := <-ch:
+			if m == nil {
+				go rm.connectWatcher()
+				return
+			}
+			rm.processWatcherEvent(m, false)
+		}
+	}
+}
+
+// processWatcherEvent updates the local retained messages by the events of
+// the storage, all the local messages are replaced if sync is true.
+func (rm *retainManager) processWatcherEvent(event map[string]*string, sync bool) {
+	prefix := retainStoreKey(rm.name, "")
+	messages := make(map[string]*retainedMessage)
+	for k, v := range event {
+		topic := strings.TrimPrefix(k, prefix)
+		if v == nil {
+			messages[topic] = nil
+			continue
+		}
+
+		msg := &Message{}
+		err := codectool.UnmarshalJSON([]byte(*v), msg)
+		if err != nil {
+			logger.Warnf("ignored decode retained message %s failed: %s", *v, err)
+			continue
+		}
+		payload, err := base64.StdEncoding.DecodeString(msg.B64Payload)
+		if err != nil {
+			logger.Warnf("ignored decode payload of retained message %s failed: %s", *v, err)
+			continue
+		}
+		levels, valid := splitTopic(msg.Topic)
+		if !valid {
+			logger.Warnf("ignored retained message of invalid topic %s", msg.Topic)
+			continue
+		}
+		messages[topic] = &retainedMessage{
+			topic:   msg.Topic,
+			levels:  levels,
+			payload: payload,
+			qos:     byte(msg.QoS),
+			props:   msg.Properties,
+		}
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+	if sync {
+		rm.messages = make(map[string]*retainedMessage)
+	}
+	for topic, msg := range messages {
+		if msg == nil {
+			delete(rm.messages, topic)
+		} else {
+			rm.messages[topic] = msg
+		}
+	}
+}
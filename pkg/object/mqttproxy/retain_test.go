@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/util/codectool"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRetainPublish(topic, payload string, qos byte) *packets.PublishPacket {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	p.Qos = qos
+	p.Retain = true
+	return p
+}
+
+func matchedTopics(msgs []*retainedMessage) []string {
+	topics := []string{}
+	for _, m := range msgs {
+		topics = append(topics, m.topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func TestRetainManager(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStorage(nil)
+	rm := newRetainManager("test", store)
+	defer rm.close()
+
+	rm.retain(newRetainPublish("home/room1/temp", "20", QoS1), nil)
+	rm.retain(newRetainPublish("home/room2/temp", "21", QoS0), nil)
+	rm.retain(newRetainPublish("home/room1/humidity", "40", QoS1), nil)
+	rm.retain(newRetainPublish("home/+/temp", "invalid", QoS1), nil)
+
+	assert.Equal([]string{"home/room1/temp", "home/room2/temp"}, matchedTopics(rm.match([]string{"home/+/temp"}, []byte{QoS1})))
+	assert.Equal([]string{"home/room1/humidity", "home/room1/temp", "home/room2/temp"}, matchedTopics(rm.match([]string{"home/#"}, []byte{QoS1})))
+	assert.Equal([]string{"home/room1/humidity", "home/room1/temp"}, matchedTopics(rm.match([]string{"home/room1/#", "home/room1/temp"}, []byte{QoS0, QoS1})))
+	assert.Empty(rm.match([]string{"office/#"}, []byte{QoS1}))
+
+	// qos is downgraded to the subscribed one
+	msgs := rm.match([]string{"home/room1/temp"}, []byte{QoS0})
+	assert.Equal(1, len(msgs))
+	assert.Equal(QoS0, msgs[0].qos)
+	assert.Equal([]byte("20"), msgs[0].payload)
+
+	// replace and clear
+	rm.retain(newRetainPublish("home/room1/temp", "22", QoS1), nil)
+	rm.retain(newRetainPublish("home/room2/temp", "", QoS0), nil)
+	msgs = rm.match([]string{"home/+/temp"}, []byte{QoS1})
+	assert.Equal(1, len(msgs))
+	assert.Equal([]byte("22"), msgs[0].payload)
+	assert.Equal(QoS1, msgs[0].qos)
+
+	// the messages are persisted
+	var stored map[string]string
+	for i := 0; i < 100; i++ {
+		stored, _ = store.getPrefix(retainStoreKey("test", ""), false)
+		if len(stored) == 2 {
+			if v, ok := stored[retainStoreKey("test", "home/room1/temp")]; ok && v == string(codectool.MustMarshalJSON(newMsg("home/room1/temp", []byte("22"), QoS1))) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(2, len(stored))
+	assert.Contains(stored, retainStoreKey("test", "home/room1/temp"))
+	assert.Contains(stored, retainStoreKey("test", "home/room1/humidity"))
+
+	// messages retained by other members are loaded on start and synced by watching
+	rm2 := newRetainManager("test", store)
+	defer rm2.close()
+	store.put(retainStoreKey("test", "home/room3/temp"), string(codectool.MustMarshalJSON(newMsg("home/room3/temp", []byte("23"), QoS1))))
+	want := []string{"home/room1/humidity", "home/room1/temp", "home/room3/temp"}
+	var got []string
+	for i := 0; i < 100; i++ {
+		got = matchedTopics(rm2.match([]string{"#"}, []byte{QoS1}))
+		if reflect.DeepEqual(want, got) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(want, got)
+}
+
+func TestBrokerModeRetain(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.BrokerMode = true
+	store := newStorage(nil)
+	mapper := &mockMuxMapper{}
+	broker := newBroker(spec, nil, store, mapper, func(s, ss string) (map[string]string, error) {
+		return map[string]string{}, nil
+	})
+	defer broker.close()
+
+	publisher := getMQTTClient(t, "publisher", "test", "test", true)
+	defer publisher.Disconnect(200)
+	for _, msg := range []struct {
+		topic   string
+		payload string
+	}{
+		{"device/1/state", "on"},
+		{"device/2/state", "off"},
+		{"device/2/state", "on"},
+		{"device/3/state", "on"},
+		{"device/3/state", ""},
+	} {
+		token := publisher.Publish(msg.topic, 1, true, msg.payload)
+		token.Wait()
+		assert.Nil(token.Error())
+	}
+	token := publisher.Publish("device/4/state", 1, false, "on")
+	token.Wait()
+	assert.Nil(token.Error())
+
+	type retainedMsg struct {
+		topic    string
+		payload  string
+		retained bool
+	}
+	ch := make(chan retainedMsg, 10)
+	subscriber := getMQTTClient(t, "subscriber", "test", "test", true)
+	defer subscriber.Disconnect(200)
+	token = subscriber.Subscribe("device/+/state", 1, func(c paho.Client, m paho.Message) {
+		ch <- retainedMsg{topic: m.Topic(), payload: string(m.Payload()), retained: m.Retained()}
+	})
+	token.Wait()
+	assert.Nil(token.Error())
+
+	got := map[string]retainedMsg{}
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-ch:
+			got[m.topic] = m
+		case <-time.After(5 * time.Second):
+			assert.Fail("retained messages not received")
+		}
+	}
+	assert.Equal(map[string]retainedMsg{
+		"device/1/state": {topic: "device/1/state", payload: "on", retained: true},
+		"device/2/state": {topic: "device/2/state", payload: "on", retained: true},
+	}, got)
+
+	select {
+	case m := <-ch:
+		assert.Fail("unexpected message", "%v", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// messages forwarded to existing subscribers are not marked as retained
+	token = publisher.Publish("device/1/state", 1, true, "off")
+	token.Wait()
+	assert.Nil(token.Error())
+	select {
+	case m := <-ch:
+		assert.Equal(retainedMsg{topic: "device/1/state", payload: "off", retained: false}, m)
+	case <-time.After(5 * time.Second):
+		assert.Fail("message not received")
+	}
+}
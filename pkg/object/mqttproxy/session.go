@@ -19,6 +19,7 @@ package mqttproxy
 
 import (
 	"encoding/base64"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -41,6 +42,20 @@ type (
 		Topics    map[string]int `json:"topics"`
 		ClientID  string         `json:"clientID"`
 		CleanFlag bool           `json:"cleanFlag"`
+		// ExpiryInterval is the session expiry interval of MQTT 5 in seconds
+		ExpiryInterval uint32 `json:"expiryInterval,omitempty"`
+
+		// fields below persist the message states of the session, so the
+		// client receives what it missed after connecting to any member.
+		// Inflight is the QoS 1 and QoS 2 messages sent to the client but
+		// not acknowledged, in the order of sending.
+		Inflight []*Message `json:"inflight,omitempty"`
+		// Offline is the messages queued when the client is disconnected.
+		Offline []*Message `json:"offline,omitempty"`
+		// Received is the packet ids of QoS 2 messages received from the
+		// client and waiting for PUBREL.
+		Received []uint16 `json:"received,omitempty"`
+		NextID   uint16   `json:"nextID,omitempty"`
 	}
 
 	// Session includes the information about the connect between client and broker,
@@ -54,6 +69,10 @@ type (
 		pending      map[uint16]*Message
 		pendingQueue []uint16
 		nextID       uint16
+		// offline is the queue of messages for the disconnected client
+		offline []*Message
+		// received is the packet ids of QoS 2 messages waiting for PUBREL
+		received map[uint16]struct{}
 		// retry Qos1 packet
 		retryInterval time.Duration
 		refreshStore  atomic.Value
@@ -64,6 +83,16 @@ type (
 		Topic      string `json:"topic"`
 		B64Payload string `json:"b64Payload"`
 		QoS        int    `json:"qos"`
+
+		Properties *MessageProperties `json:"properties,omitempty"`
+
+		// fields below are used by the messages of sessions only
+		ID uint16 `json:"id,omitempty"`
+		// Released is true if PUBREC of the QoS 2 message is received
+		Released bool `json:"released,omitempty"`
+		// QueuedAt is the time in unix milliseconds when the message is
+		// queued for the disconnected client
+		QueuedAt int64 `json:"queuedAt,omitempty"`
 	}
 )
 
@@ -80,6 +109,10 @@ func (s *Session) store() {
 	if swapped := s.refreshStore.CompareAndSwap(true, false); !swapped {
 		return
 	}
+	if s.broker.getClient(s.info.ClientID) == nil && s.takenOver() {
+		logger.Infof("session %s was taken over by another member, not stored", s.info.ClientID)
+		return
+	}
 
 	ss := func() *SessionStore {
 		s.Lock()
@@ -112,8 +145,38 @@ func (s *Session) store() {
 	}
 }
 
+// takenOver returns true if the stored session belongs to another member
+// of the cluster, the persistent session of a disconnected client must not
+// overwrite it.
+func (s *Session) takenOver() bool {
+	str, err := s.broker.sessMgr.store.get(sessionStoreKey(s.info.ClientID))
+	if err != nil || str == nil {
+		return false
+	}
+	stored := &Session{}
+	if err := stored.decode(*str); err != nil {
+		return false
+	}
+	return stored.info.EGName != s.broker.egName
+}
+
 func (s *Session) encode() (string, error) {
+	s.info.Inflight = nil
+	for _, id := range s.pendingQueue {
+		if msg, ok := s.pending[id]; ok {
+			s.info.Inflight = append(s.info.Inflight, msg)
+		}
+	}
+	s.info.Offline = s.offline
+	s.info.Received = nil
+	for id := range s.received {
+		s.info.Received = append(s.info.Received, id)
+	}
+	sort.Slice(s.info.Received, func(i, j int) bool { return s.info.Received[i] < s.info.Received[j] })
+	s.info.NextID = s.nextID
+
 	b, err := codectool.MarshalJSON(s.info)
+	s.info.Inflight, s.info.Offline, s.info.Received = nil, nil, nil
 	if err != nil {
 		return "", err
 	}
@@ -127,12 +190,30 @@ func (s *Session) decode(str string) error {
 	return codectool.UnmarshalJSON([]byte(str), s.info)
 }
 
+// restore restores the message states from the decoded session info.
+func (s *Session) restore() {
+	s.pending = make(map[uint16]*Message)
+	s.pendingQueue = []uint16{}
+	for _, msg := range s.info.Inflight {
+		s.pending[msg.ID] = msg
+		s.pendingQueue = append(s.pendingQueue, msg.ID)
+	}
+	s.offline = s.info.Offline
+	s.received = make(map[uint16]struct{})
+	for _, id := range s.info.Received {
+		s.received[id] = struct{}{}
+	}
+	s.nextID = s.info.NextID
+	s.info.Inflight, s.info.Offline, s.info.Received = nil, nil, nil
+}
+
 func (s *Session) init(sm *SessionManager, b *Broker, connect *packets.ConnectPacket) error {
 	s.broker = b
 	s.storeCh = sm.storeCh
 	s.done = make(chan struct{})
 	s.pending = make(map[uint16]*Message)
 	s.pendingQueue = []uint16{}
+	s.received = make(map[uint16]struct{})
 	s.retryInterval = time.Second * time.Duration(b.spec.RetryInterval)
 
 	s.info = &SessionInfo{}
@@ -153,6 +234,16 @@ func (s *Session) updateEGName(egName, name string) {
 	s.Unlock()
 }
 
+// setExpiryInterval sets the session expiry interval of MQTT 5, the session
+// is cleaned when the client disconnects if the interval is zero.
+func (s *Session) setExpiryInterval(interval uint32) {
+	s.Lock()
+	s.info.CleanFlag = interval == 0
+	s.info.ExpiryInterval = interval
+	s.refreshStore.Store(true)
+	s.Unlock()
+}
+
 func (s *Session) subscribe(topics []string, qoss []byte) error {
 	logger.SpanDebugf(nil, "session %s sub %v", s.info.ClientID, topics)
 	s.Lock()
@@ -177,6 +268,13 @@ func (s *Session) unsubscribe(topics []string) error {
 	return nil
 }
 
+func (s *Session) subscribed(topic string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.info.Topics[topic]
+	return ok
+}
+
 func (s *Session) allSubscribes() ([]string, []byte, error) {
 	s.Lock()
 
@@ -195,87 +293,266 @@ func (s *Session) getPacketFromMsg(topic string, payload []byte, qos byte) *pack
 	p.Qos = qos
 	p.TopicName = topic
 	p.Payload = payload
-	p.MessageID = s.nextID
 	// the overflow is okay here
-	// the session will give unique id from 0 to 65535 and do this again and again
+	// the session will give unique id from 1 to 65535 and do this again and again,
+	// 0 is not a valid packet id.
 	s.nextID++
+	if s.nextID == 0 {
+		s.nextID++
+	}
+	p.MessageID = s.nextID
 	return p
 }
 
-func (s *Session) publish(span *model.SpanContext, client *Client, topic string, payload []byte, qos byte) {
-	p := func() packets.ControlPacket {
-		s.Lock()
-		defer s.Unlock()
-		logger.SpanDebugf(span, "session %v publish %v", s.info.ClientID, topic)
-		p := s.getPacketFromMsg(topic, payload, qos)
-		if qos == QoS1 {
-			msg := newMsg(topic, payload, qos)
-			s.pending[p.MessageID] = msg
-			s.pendingQueue = append(s.pendingQueue, p.MessageID)
-		}
-		return p
-	}()
+func (s *Session) publish(span *model.SpanContext, client *Client, topic string, payload []byte, qos byte, props *MessageProperties) {
+	if p := s.newPublish(span, topic, payload, qos, props, false); p != nil {
+		client.writePacket(client.publishPacket(p, props))
+	}
+}
 
-	if qos == QoS2 {
-		logger.SpanErrorf(span, "publish message with qos=2 is not supported currently")
-		return
+// publishRetained publishes a retained message to the client, the retain flag
+// is set since the message is sent because of a new subscription.
+func (s *Session) publishRetained(span *model.SpanContext, client *Client, topic string, payload []byte, qos byte, props *MessageProperties) {
+	if p := s.newPublish(span, topic, payload, qos, props, true); p != nil {
+		client.writePacket(client.publishPacket(p, props))
+	}
+}
+
+// newPublish returns the publish packet of the message, and records the
+// message as in-flight if its QoS is 1 or 2. It returns nil if the message
+// is expired.
+func (s *Session) newPublish(span *model.SpanContext, topic string, payload []byte, qos byte, props *MessageProperties, retain bool) *packets.PublishPacket {
+	if props.expired(time.Now()) {
+		logger.SpanDebugf(span, "session %v drop expired message of topic %v", s.info.ClientID, topic)
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	logger.SpanDebugf(span, "session %v publish %v", s.info.ClientID, topic)
+	p := s.getPacketFromMsg(topic, payload, qos)
+	p.Retain = retain
+	if qos != QoS0 {
+		msg := newMsg(topic, payload, qos)
+		msg.Properties = props
+		msg.ID = p.MessageID
+		s.pending[p.MessageID] = msg
+		s.pendingQueue = append(s.pendingQueue, p.MessageID)
+		s.refreshStore.Store(true)
 	}
-	client.writePacket(p)
+	return p
 }
 
 func (s *Session) puback(p *packets.PubackPacket) {
 	s.Lock()
 	delete(s.pending, p.MessageID)
+	s.refreshStore.Store(true)
 	s.Unlock()
 }
 
+// pubrec marks the QoS 2 message as released when PUBREC is received, then
+// PUBREL is resent instead of the message.
+func (s *Session) pubrec(id uint16) {
+	s.Lock()
+	if msg, ok := s.pending[id]; ok && msg.QoS == int(QoS2) && !msg.Released {
+		msg.Released = true
+		s.refreshStore.Store(true)
+	}
+	s.Unlock()
+}
+
+// pubcomp completes the QoS 2 message when PUBCOMP is received.
+func (s *Session) pubcomp(id uint16) {
+	s.Lock()
+	delete(s.pending, id)
+	s.refreshStore.Store(true)
+	s.Unlock()
+}
+
+// receive records the packet id of the QoS 2 message received from the
+// client, it returns false if the message was received before, which means
+// the client resends it and it must not be processed again.
+func (s *Session) receive(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.received[id]; ok {
+		return false
+	}
+	s.received[id] = struct{}{}
+	s.refreshStore.Store(true)
+	return true
+}
+
+// release releases the packet id of the QoS 2 message received from the
+// client when PUBREL is received, it returns false if the id is not found.
+func (s *Session) release(id uint16) bool {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.received[id]; !ok {
+		return false
+	}
+	delete(s.received, id)
+	s.refreshStore.Store(true)
+	return true
+}
+
+// enqueue queues the message for the disconnected client of the persistent
+// session, QoS 0 messages are not queued, and the oldest message is dropped
+// if the queue is full.
+func (s *Session) enqueue(span *model.SpanContext, topic string, payload []byte, qos byte, props *MessageProperties) {
+	now := time.Now()
+	if qos == QoS0 || props.expired(now) {
+		return
+	}
+	msg := newMsg(topic, payload, qos)
+	msg.Properties = props
+	msg.QueuedAt = now.UnixMilli()
+
+	s.Lock()
+	defer s.Unlock()
+	s.offline = s.liveOffline(now)
+	if size := s.broker.spec.OfflineQueueSize; len(s.offline) >= size {
+		logger.SpanDebugf(span, "session %v offline queue is full, drop the oldest message", s.info.ClientID)
+		s.offline = s.offline[len(s.offline)-size+1:]
+	}
+	s.offline = append(s.offline, msg)
+	s.refreshStore.Store(true)
+}
+
+// liveOffline returns the offline messages not expired, the caller must
+// hold the lock.
+func (s *Session) liveOffline(now time.Time) []*Message {
+	deadline := now.Add(-time.Duration(s.broker.spec.OfflineMessageTTL) * time.Second).UnixMilli()
+	var live []*Message
+	for _, msg := range s.offline {
+		if msg.QueuedAt > deadline && !msg.Properties.expired(now) {
+			live = append(live, msg)
+		}
+	}
+	return live
+}
+
+// resumeMessages returns the in-flight messages and takes the offline
+// messages to send to the client which connects with the persistent session.
+func (s *Session) resumeMessages() (inflight, offline []*Message) {
+	s.Lock()
+	defer s.Unlock()
+	for _, id := range s.pendingQueue {
+		if msg, ok := s.pending[id]; ok {
+			inflight = append(inflight, msg)
+		}
+	}
+	offline = s.liveOffline(time.Now())
+	if len(s.offline) > 0 {
+		s.offline = nil
+		s.refreshStore.Store(true)
+	}
+	return inflight, offline
+}
+
+// resume sends the in-flight messages and then the offline messages to the
+// client.
+func (s *Session) resume(client *Client, inflight, offline []*Message) {
+	for _, msg := range inflight {
+		if p := s.resendPacket(client, msg); p != nil && !client.writePacketWait(p) {
+			break
+		}
+	}
+	for i, msg := range offline {
+		payload, err := base64.StdEncoding.DecodeString(msg.B64Payload)
+		if err != nil {
+			logger.Errorf("client:%s, base64 decode error for Message B64Payload %s ", s.info.ClientID, err)
+			continue
+		}
+		p := s.newPublish(nil, msg.Topic, payload, byte(msg.QoS), msg.Properties, false)
+		if p != nil && !client.writePacketWait(client.publishPacket(p, msg.Properties)) {
+			// the client is disconnected again, queue the rest messages back
+			s.Lock()
+			s.offline = append(offline[i+1:], s.offline...)
+			s.refreshStore.Store(true)
+			s.Unlock()
+			return
+		}
+	}
+}
+
 func (s *Session) cleanSession() bool {
 	return s.info.CleanFlag
 }
 
 func (s *Session) close() {
-	close(s.done)
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+// resendPacket returns the packet to resend the in-flight message, which is
+// PUBREL if the QoS 2 message is released, or nil if the message expires.
+func (s *Session) resendPacket(client *Client, msg *Message) packets.ControlPacket {
+	s.Lock()
+	released := msg.Released
+	s.Unlock()
+	if released {
+		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubrel.MessageID = msg.ID
+		return pubrel
+	}
+	if msg.Properties.expired(time.Now()) {
+		s.Lock()
+		delete(s.pending, msg.ID)
+		s.refreshStore.Store(true)
+		s.Unlock()
+		return nil
+	}
+
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.Qos = byte(msg.QoS)
+	p.TopicName = msg.Topic
+	payload, err := base64.StdEncoding.DecodeString(msg.B64Payload)
+	if err != nil {
+		logger.Errorf("client:%s, base64 decode error for Message B64Payload %s ", s.info.ClientID, err)
+		return nil
+	}
+	p.Payload = payload
+	p.MessageID = msg.ID
+	p.Dup = true
+	return client.publishPacket(p, msg.Properties)
 }
 
 func (s *Session) doResend() {
 	client := s.broker.getClient(s.info.ClientID)
-	msg, messageID := func() (msg *Message, messageID uint16) {
+	msg := func() *Message {
 		s.Lock()
 		defer s.Unlock()
 		if len(s.pending) == 0 {
 			s.pendingQueue = []uint16{}
-			return
+			return nil
 		}
 		for i, idx := range s.pendingQueue {
 			if val, ok := s.pending[idx]; ok {
 				// find first msg need to resend
 				s.pendingQueue = s.pendingQueue[i:]
-				msg = val
-				messageID = idx
-				break
+				return val
 			}
 		}
-		return
+		return nil
 	}()
 
 	if msg == nil {
 		return
 	}
-
-	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
-	p.Qos = byte(msg.QoS)
-	p.TopicName = msg.Topic
-	payload, err := base64.StdEncoding.DecodeString(msg.B64Payload)
-	if err != nil {
-		logger.Errorf("client:%s, base64 decode error for Message B64Payload %s ", s.info.ClientID, err)
+	if client == nil {
+		// the client of the persistent session is disconnected, the
+		// messages are resent when it connects again.
+		logger.SpanDebugf(nil, "client %v do resend but client is nil, ignored", s.info.ClientID)
 		return
 	}
-	p.Payload = payload
-	p.MessageID = messageID
-	if client != nil {
+	if p := s.resendPacket(client, msg); p != nil {
 		client.writePacket(p)
-	} else {
-		logger.Warnf("client %v do resend but client is nil, ignored", s.info.ClientID)
 	}
 }
 
@@ -19,6 +19,7 @@ package mqttproxy
 
 import (
 	"sync"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/megaease/easegress/pkg/logger"
@@ -32,6 +33,11 @@ type (
 		store      storage
 		storeCh    chan SessionStore
 		done       chan struct{}
+
+		// expiryTimers are the timers to delete sessions of MQTT 5 when
+		// they expire
+		expiryLock   sync.Mutex
+		expiryTimers map[string]*time.Timer
 	}
 
 	// SessionStore for session store, key is session clientID, value is session json marshal value
@@ -47,6 +53,8 @@ func newSessionManager(b *Broker, store storage) *SessionManager {
 		store:   store,
 		storeCh: make(chan SessionStore, 1024), // change to unbounded buffer, due to avoiding to block write operation
 		done:    make(chan struct{}),
+
+		expiryTimers: make(map[string]*time.Timer),
 	}
 	go sm.doStore()
 	return sm
@@ -54,6 +62,10 @@ func newSessionManager(b *Broker, store storage) *SessionManager {
 
 func (sm *SessionManager) close() {
 	close(sm.done)
+	sm.sessionMap.Range(func(key, value any) bool {
+		value.(*Session).close()
+		return true
+	})
 }
 
 func (sm *SessionManager) doStore() {
@@ -84,14 +96,14 @@ func (sm *SessionManager) newSessionFromJSON(str *string) *Session {
 	sess.broker = sm.broker
 	sess.storeCh = sm.storeCh
 	sess.done = make(chan struct{})
-	sess.pending = make(map[uint16]*Message)
-	sess.pendingQueue = []uint16{}
+	sess.retryInterval = time.Second * time.Duration(sm.broker.spec.RetryInterval)
 
 	sess.info = &SessionInfo{}
 	err := sess.decode(*str)
 	if err != nil {
 		return nil
 	}
+	sess.restore()
 	go sess.backgroundSessionTask()
 	return sess
 }
@@ -113,6 +125,15 @@ func (sm *SessionManager) get(clientID string) *Session {
 	return sess
 }
 
+// local returns the session on this broker, which is either the session of a
+// connected client or the persistent session of a disconnected client.
+func (sm *SessionManager) local(clientID string) *Session {
+	if val, ok := sm.sessionMap.Load(clientID); ok {
+		return val.(*Session)
+	}
+	return nil
+}
+
 func (sm *SessionManager) delLocal(clientID string) bool {
 	if val, ok := sm.sessionMap.LoadAndDelete(clientID); ok {
 		sess := val.(*Session)
@@ -128,3 +149,68 @@ func (sm *SessionManager) delDB(clientID string) {
 		logger.SpanErrorf(nil, "delete session %v failed, %v", err)
 	}
 }
+
+// expireLater deletes the session from the storage when the session expiry
+// interval of MQTT 5 passes, unless the client connects again before that.
+func (sm *SessionManager) expireLater(clientID string, interval uint32) {
+	sm.expiryLock.Lock()
+	defer sm.expiryLock.Unlock()
+
+	if timer, ok := sm.expiryTimers[clientID]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(interval)*time.Second, func() {
+		sm.expiryLock.Lock()
+		if sm.expiryTimers[clientID] != timer {
+			sm.expiryLock.Unlock()
+			return
+		}
+		delete(sm.expiryTimers, clientID)
+		sm.expiryLock.Unlock()
+		sm.expire(clientID)
+	})
+	sm.expiryTimers[clientID] = timer
+}
+
+func (sm *SessionManager) cancelExpiry(clientID string) {
+	sm.expiryLock.Lock()
+	defer sm.expiryLock.Unlock()
+
+	if timer, ok := sm.expiryTimers[clientID]; ok {
+		timer.Stop()
+		delete(sm.expiryTimers, clientID)
+	}
+}
+
+func (sm *SessionManager) expire(clientID string) {
+	select {
+	case <-sm.done:
+		return
+	default:
+	}
+
+	// the client connects again to this broker
+	if sm.broker.getClient(clientID) != nil {
+		return
+	}
+	str, err := sm.store.get(sessionStoreKey(clientID))
+	if err != nil || str == nil {
+		return
+	}
+	sess := &Session{}
+	if err := sess.decode(*str); err != nil {
+		return
+	}
+	// the client connects again to another broker of the cluster
+	if sess.info.EGName != sm.broker.egName {
+		return
+	}
+	logger.SpanDebugf(nil, "session %v expired", clientID)
+	if local := sm.local(clientID); local != nil {
+		sm.delLocal(clientID)
+		topics, _, _ := local.allSubscribes()
+		sm.broker.topicMgr.unsubscribe(topics, clientID)
+	}
+	sm.delDB(clientID)
+}
@@ -19,9 +19,13 @@ package mqttproxy
 
 import (
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/megaease/easegress/pkg/context"
+	"github.com/megaease/easegress/pkg/protocols/mqttprot"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,7 +57,7 @@ func TestSessionDoResend(t *testing.T) {
 
 	// publish packet and recevie it
 	go func() {
-		sess.publish(nil, client, "topic1", []byte("payload1"), 1)
+		sess.publish(nil, client, "topic1", []byte("payload1"), 1, nil)
 	}()
 	p, err := packets.ReadPacket(testConn)
 	assert.Nil(err)
@@ -74,3 +78,255 @@ func TestSessionDoResend(t *testing.T) {
 	assert.Equal("topic1", pub.TopicName)
 	assert.Equal([]byte("payload1"), pub.Payload)
 }
+
+func connectRaw(t *testing.T, broker *Broker, clientID string, cleanSession bool) net.Conn {
+	clientConn, serverConn := net.Pipe()
+	go broker.handleConn(serverConn)
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = clientID
+	connect.CleanSession = cleanSession
+	assert.Nil(t, connect.Write(clientConn))
+	connack := readRaw(t, clientConn).(*packets.ConnackPacket)
+	assert.Equal(t, byte(packets.Accepted), connack.ReturnCode)
+	return clientConn
+}
+
+func readRaw(t *testing.T, conn net.Conn) packets.ControlPacket {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, err := packets.ReadPacket(conn)
+	assert.Nil(t, err)
+	return p
+}
+
+func subscribeRaw(t *testing.T, conn net.Conn, topic string, qos byte) {
+	subscribe := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	subscribe.MessageID = 1
+	subscribe.Topics = []string{topic}
+	subscribe.Qoss = []byte{qos}
+	assert.Nil(t, subscribe.Write(conn))
+	_, ok := readRaw(t, conn).(*packets.SubackPacket)
+	assert.True(t, ok)
+}
+
+func TestSessionQoS2(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.BrokerMode = true
+	broker := getBrokerFromSpec(spec, &mockMuxMapper{})
+	defer broker.close()
+
+	conn := connectRaw(t, broker, "qos2", true)
+	defer conn.Close()
+	subscribeRaw(t, conn, "qos2/topic", QoS2)
+
+	// the message resent by the client is processed only once
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.Qos = QoS2
+	publish.TopicName = "qos2/topic"
+	publish.Payload = []byte("exactly once")
+	publish.MessageID = 5
+	assert.Nil(publish.Write(conn))
+	publish.Dup = true
+	assert.Nil(publish.Write(conn))
+
+	var pubrecs []uint16
+	var received []*packets.PublishPacket
+	for i := 0; i < 3; i++ {
+		switch p := readRaw(t, conn).(type) {
+		case *packets.PubrecPacket:
+			pubrecs = append(pubrecs, p.MessageID)
+		case *packets.PublishPacket:
+			received = append(received, p)
+		default:
+			assert.Fail("unexpected packet", p.String())
+		}
+	}
+	assert.Equal([]uint16{5, 5}, pubrecs)
+	assert.Equal(1, len(received))
+	assert.Equal(QoS2, received[0].Qos)
+	assert.Equal([]byte("exactly once"), received[0].Payload)
+
+	pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+	pubrel.MessageID = 5
+	assert.Nil(pubrel.Write(conn))
+	pubcomp := readRaw(t, conn).(*packets.PubcompPacket)
+	assert.Equal(uint16(5), pubcomp.MessageID)
+
+	// the QoS 2 message sent to the client
+	sess := broker.getClient("qos2").session
+	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubrec.MessageID = received[0].MessageID
+	assert.Nil(pubrec.Write(conn))
+	pubrel = readRaw(t, conn).(*packets.PubrelPacket)
+	assert.Equal(received[0].MessageID, pubrel.MessageID)
+
+	// PUBREL is resent instead of the message
+	go sess.doResend()
+	pubrel = readRaw(t, conn).(*packets.PubrelPacket)
+	assert.Equal(received[0].MessageID, pubrel.MessageID)
+
+	pubcomp.MessageID = received[0].MessageID
+	assert.Nil(pubcomp.Write(conn))
+	for i := 0; i < 100; i++ {
+		sess.Lock()
+		n := len(sess.pending)
+		sess.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sess.Lock()
+	assert.Empty(sess.pending)
+	assert.Empty(sess.received)
+	sess.Unlock()
+}
+
+func TestSessionOfflineQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.OfflineQueueSize = 2
+	broker := getBrokerFromSpec(spec, &mockMuxMapper{})
+	defer broker.close()
+
+	cid := "offline"
+	conn := connectRaw(t, broker, cid, false)
+	subscribeRaw(t, conn, "offline/topic", QoS1)
+	conn.Close()
+	for i := 0; i < 100 && broker.getClient(cid) != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(broker.getClient(cid))
+
+	// QoS 0 messages are not queued, and the oldest message is dropped
+	for _, payload := range []string{"1", "2", "3"} {
+		broker.sendMsgToClient(nil, "offline/topic", []byte(payload), QoS1, nil, nil)
+	}
+	broker.sendMsgToClient(nil, "offline/topic", []byte("4"), QoS0, nil, nil)
+
+	// the queue is persisted with the session
+	var info *SessionInfo
+	for i := 0; i < 300; i++ {
+		str, err := broker.sessMgr.store.get(sessionStoreKey(cid))
+		if err == nil {
+			sess := &Session{}
+			sess.decode(*str)
+			info = sess.info
+			if len(info.Offline) == 2 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(2, len(info.Offline))
+
+	conn = connectRaw(t, broker, cid, false)
+	defer conn.Close()
+	for _, payload := range []string{"2", "3"} {
+		publish := readRaw(t, conn).(*packets.PublishPacket)
+		assert.Equal("offline/topic", publish.TopicName)
+		assert.Equal([]byte(payload), publish.Payload)
+	}
+	sess := broker.getClient(cid).session
+	sess.Lock()
+	assert.Empty(sess.offline)
+	assert.Equal(2, len(sess.pending))
+	sess.Unlock()
+}
+
+func TestSessionRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := getDefaultBroker(&mockMuxMapper{})
+	defer broker.close()
+
+	now := time.Now()
+	sess := &Session{}
+	connect := &packets.ConnectPacket{ClientIdentifier: "restore"}
+	sess.init(broker.sessMgr, broker, connect)
+	sess.newPublish(nil, "topic", []byte("inflight"), QoS2, nil, false)
+	sess.pubrec(1)
+	sess.newPublish(nil, "topic", []byte("inflight"), QoS1, nil, false)
+	sess.receive(7)
+	sess.enqueue(nil, "topic", []byte("offline"), QoS1, nil)
+	sess.offline = append(sess.offline, &Message{Topic: "topic", QoS: 1, QueuedAt: now.Add(-2 * time.Hour).UnixMilli()})
+
+	sess.Lock()
+	str, err := sess.encode()
+	sess.Unlock()
+	assert.Nil(err)
+	restored := broker.sessMgr.newSessionFromJSON(&str)
+	defer restored.close()
+
+	assert.Equal([]uint16{1, 2}, restored.pendingQueue)
+	assert.True(restored.pending[1].Released)
+	assert.Equal(int(QoS1), restored.pending[2].QoS)
+	assert.Contains(restored.received, uint16(7))
+	assert.Equal(uint16(2), restored.nextID)
+	// the message queued for too long is expired
+	assert.Equal(2, len(restored.offline))
+	assert.Equal(1, len(restored.liveOffline(now)))
+}
+
+// dropFirstHandler drops the first packet.
+type dropFirstHandler struct {
+	count int32
+}
+
+func (h *dropFirstHandler) Handle(ctx *context.Context) string {
+	if atomic.AddInt32(&h.count, 1) == 1 {
+		ctx.GetResponse(context.DefaultNamespace).(*mqttprot.Response).SetDrop()
+	}
+	return ""
+}
+
+func TestSessionQoS2Dropped(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.BrokerMode = true
+	handler := &dropFirstHandler{}
+	broker := getBrokerFromSpec(spec, &mockMuxMapper{
+		MockFunc: func(name string) (context.Handler, bool) {
+			return handler, true
+		},
+	})
+	broker.pipelines[Publish] = "publish-pipeline"
+	defer broker.close()
+
+	conn := connectRaw(t, broker, "qos2", true)
+	defer conn.Close()
+	subscribeRaw(t, conn, "qos2/topic", QoS2)
+
+	// the message dropped by the pipeline is processed when it is resent.
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.Qos = QoS2
+	publish.TopicName = "qos2/topic"
+	publish.Payload = []byte("resent")
+	publish.MessageID = 7
+	assert.Nil(publish.Write(conn))
+	publish.Dup = true
+	assert.Nil(publish.Write(conn))
+
+	var pubrecs []uint16
+	var received []*packets.PublishPacket
+	for i := 0; i < 2; i++ {
+		switch p := readRaw(t, conn).(type) {
+		case *packets.PubrecPacket:
+			pubrecs = append(pubrecs, p.MessageID)
+		case *packets.PublishPacket:
+			received = append(received, p)
+		default:
+			assert.Fail("unexpected packet", p.String())
+		}
+	}
+	assert.Equal([]uint16{7}, pubrecs)
+	assert.Equal(1, len(received))
+	assert.Equal([]byte("resent"), received[0].Payload)
+	assert.Equal(int32(2), atomic.LoadInt32(&handler.count))
+}
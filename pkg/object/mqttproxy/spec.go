@@ -20,11 +20,14 @@ package mqttproxy
 import (
 	"crypto/tls"
 	"fmt"
+
+	"github.com/megaease/easegress/pkg/util/tlspolicy"
 )
 
 const (
 	sessionPrefix              = "/mqtt/sessionMgr/clientID/%s"
 	topicPrefix                = "/mqtt/topicMgr/topic/%s"
+	retainPrefix               = "/mqtt/retainMgr/%s/topic/%s"
 	mqttAPITopicPublishPrefix  = "/mqttproxy/%s/topics/publish"
 	mqttAPISessionQueryPrefix  = "/mqttproxy/%s/session/query"
 	mqttAPISessionDeletePrefix = "/mqttproxy/%s/sessions"
@@ -61,19 +64,28 @@ var pipelinePacketTypes = map[PacketType]struct{}{
 type (
 	// Spec describes the MQTTProxy.
 	Spec struct {
-		EGName               string        `json:"-"`
-		Name                 string        `json:"-"`
-		Port                 uint16        `json:"port" jsonschema:"required"`
-		UseTLS               bool          `json:"useTLS" jsonschema:"omitempty"`
-		Certificate          []Certificate `json:"certificate" jsonschema:"omitempty"`
-		TopicCacheSize       int           `json:"topicCacheSize" jsonschema:"omitempty"`
-		MaxAllowedConnection int           `json:"maxAllowedConnection" jsonschema:"omitempty"`
-		ConnectionLimit      *RateLimit    `json:"connectionLimit" jsonschema:"omitempty"`
-		ClientPublishLimit   *RateLimit    `json:"clientPublishLimit" jsonschema:"omitempty"`
-		Rules                []*Rule       `json:"rules" jsonschema:"omitempty"`
-		BrokerMode           bool          `json:"brokerMode" jsonschema:"omitempty"`
+		EGName      string        `json:"-"`
+		Name        string        `json:"-"`
+		Port        uint16        `json:"port" jsonschema:"required"`
+		UseTLS      bool          `json:"useTLS" jsonschema:"omitempty"`
+		Certificate []Certificate `json:"certificate" jsonschema:"omitempty"`
+		// TLSPolicy controls the TLS versions, cipher suites, curves,
+		// ALPN protocols, session tickets and OCSP stapling.
+		TLSPolicy            *tlspolicy.Spec `json:"tlsPolicy,omitempty" jsonschema:"omitempty"`
+		TopicCacheSize       int             `json:"topicCacheSize" jsonschema:"omitempty"`
+		MaxAllowedConnection int             `json:"maxAllowedConnection" jsonschema:"omitempty"`
+		ConnectionLimit      *RateLimit      `json:"connectionLimit" jsonschema:"omitempty"`
+		ClientPublishLimit   *RateLimit      `json:"clientPublishLimit" jsonschema:"omitempty"`
+		Rules                []*Rule         `json:"rules" jsonschema:"omitempty"`
+		BrokerMode           bool            `json:"brokerMode" jsonschema:"omitempty"`
+		WebSocket            *WebSocket      `json:"webSocket,omitempty" jsonschema:"omitempty"`
 		// unit is second, default is 30s
 		RetryInterval int `yaml:"retryInterval" jsonschema:"omitempty"`
+		// max number of QoS 1 and QoS 2 messages queued for a disconnected
+		// client of persistent session, default is 1000
+		OfflineQueueSize int `json:"offlineQueueSize" jsonschema:"omitempty"`
+		// unit is second, default is 3600s
+		OfflineMessageTTL int `json:"offlineMessageTTL" jsonschema:"omitempty"`
 	}
 
 	// Rule used to route MQTT packets to different pipelines
@@ -97,6 +109,17 @@ type (
 		TimePeriod  int `json:"timePeriod" jsonschema:"omitempty"`
 	}
 
+	// WebSocket describes the MQTT over WebSocket listener, it shares the
+	// TLS config, auth pipelines and rate limits with the TCP listener.
+	WebSocket struct {
+		Port uint16 `json:"port" jsonschema:"required"`
+		// default is /mqtt
+		Path string `json:"path,omitempty" jsonschema:"omitempty"`
+		// OriginPatterns are the host patterns of the allowed origins
+		// besides the request host, for example, *.example.com.
+		OriginPatterns []string `json:"originPatterns,omitempty" jsonschema:"omitempty"`
+	}
+
 	// Certificate describes TLS certifications.
 	Certificate struct {
 		Name string `json:"name" jsonschema:"required"`
@@ -105,6 +128,14 @@ type (
 	}
 )
 
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	if !spec.UseTLS && spec.TLSPolicy != nil {
+		return fmt.Errorf("tls is disabled when tlsPolicy configured")
+	}
+	return nil
+}
+
 func (spec *Spec) tlsConfig() (*tls.Config, error) {
 	var certificates []tls.Certificate
 
@@ -125,3 +156,7 @@ func (spec *Spec) tlsConfig() (*tls.Config, error) {
 func sessionStoreKey(clientID string) string {
 	return fmt.Sprintf(sessionPrefix, clientID)
 }
+
+func retainStoreKey(name, topic string) string {
+	return fmt.Sprintf(retainPrefix, name, topic)
+}
@@ -20,7 +20,6 @@ package mqttproxy
 import (
 	"strings"
 	"sync"
-	"sync/atomic"
 
 	"github.com/megaease/easegress/pkg/cluster"
 	etcderror "go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
@@ -36,10 +35,9 @@ type (
 	}
 
 	mockStorage struct {
-		mu        sync.RWMutex
-		store     map[string]string
-		watchCh   chan map[string]*string
-		watchFlag int32
+		mu       sync.RWMutex
+		store    map[string]string
+		watchChs map[string]chan map[string]*string
 	}
 
 	clusterStorage struct {
@@ -57,8 +55,8 @@ func newStorage(cls cluster.Cluster) storage {
 		}
 	}
 	return &mockStorage{
-		store:   make(map[string]string),
-		watchCh: make(chan map[string]*string),
+		store:    make(map[string]string),
+		watchChs: make(map[string]chan map[string]*string),
 	}
 }
 
@@ -90,13 +88,7 @@ func (m *mockStorage) getPrefix(prefix string, keysOnly bool) (map[string]string
 func (m *mockStorage) put(key, value string) error {
 	m.mu.Lock()
 	m.store[key] = value
-	if m.watched() {
-		go func() {
-			res := make(map[string]*string)
-			res[key] = &value
-			m.watchCh <- res
-		}()
-	}
+	m.notify(key, &value)
 	m.mu.Unlock()
 	return nil
 }
@@ -104,24 +96,39 @@ func (m *mockStorage) put(key, value string) error {
 func (m *mockStorage) delete(key string) error {
 	m.mu.Lock()
 	delete(m.store, key)
-	if m.watched() {
-		go func() {
-			ans := make(map[string]*string)
-			ans[key] = nil
-			m.watchCh <- ans
-		}()
-	}
+	m.notify(key, nil)
 	m.mu.Unlock()
 	return nil
 }
 
+// notify sends the change of key to the watchers of its prefix,
+// the caller must hold the lock.
+func (m *mockStorage) notify(key string, value *string) {
+	for prefix, ch := range m.watchChs {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		go func(ch chan map[string]*string) {
+			ch <- map[string]*string{key: value}
+		}(ch)
+	}
+}
+
 func (m *mockStorage) watched() bool {
-	return atomic.LoadInt32(&m.watchFlag) != 0
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.watchChs) != 0
 }
 
 func (m *mockStorage) watch(prefix string) (<-chan map[string]*string, func(), error) {
-	atomic.StoreInt32(&m.watchFlag, 1)
-	return m.watchCh, func() {}, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, ok := m.watchChs[prefix]
+	if !ok {
+		ch = make(chan map[string]*string)
+		m.watchChs[prefix] = ch
+	}
+	return ch, func() {}, nil
 }
 
 func (cs *clusterStorage) get(key string) (*string, error) {
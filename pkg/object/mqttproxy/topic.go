@@ -17,6 +17,12 @@
 
 package mqttproxy
 
+import "strings"
+
+// sharePrefix is the prefix of shared subscriptions of MQTT 5, which are in
+// the form of "$share/{ShareName}/{filter}".
+const sharePrefix = "$share/"
+
 type topicOpType int
 
 const (
@@ -75,3 +81,61 @@ func isTopicMatch(topicLevels []string, subLevels []string) bool {
 	}
 	return true
 }
+
+// splitSharedTopic splits a shared subscription into the share name and the
+// topic filter, ok is false if the topic is not a shared subscription.
+func splitSharedTopic(topic string) (group string, filter string, ok bool) {
+	if !strings.HasPrefix(topic, sharePrefix) {
+		return "", "", false
+	}
+	rest := topic[len(sharePrefix):]
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 || strings.ContainsAny(rest[:i], "+#") {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// sharedSubscriberID returns the subscriber id of a member of a share group,
+// the subscriptions of a share group are managed by topic managers with the
+// subscriber ids of members, rather than the client ids.
+func sharedSubscriberID(group, clientID string) string {
+	return sharePrefix + group + "/" + clientID
+}
+
+// subscriberClientID returns the client id of a subscriber id.
+func subscriberClientID(id string) string {
+	if _, clientID, ok := splitSharedTopic(id); ok {
+		return clientID
+	}
+	return id
+}
+
+type subscriberTopics struct {
+	topics []string
+	qoss   []byte
+}
+
+// groupBySubscriber groups the topics by subscriber ids, topics of shared
+// subscriptions are grouped into the subscriber ids of share groups with
+// the share prefix removed. qoss could be nil.
+func groupBySubscriber(topics []string, qoss []byte, clientID string) map[string]*subscriberTopics {
+	ans := map[string]*subscriberTopics{clientID: {}}
+	for i, topic := range topics {
+		id := clientID
+		if group, filter, ok := splitSharedTopic(topic); ok {
+			id = sharedSubscriberID(group, clientID)
+			topic = filter
+		}
+		st, ok := ans[id]
+		if !ok {
+			st = &subscriberTopics{}
+			ans[id] = st
+		}
+		st.topics = append(st.topics, topic)
+		if qoss != nil {
+			st.qoss = append(st.qoss, qoss[i])
+		}
+	}
+	return ans
+}
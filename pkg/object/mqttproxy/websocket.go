@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"nhooyr.io/websocket"
+)
+
+const (
+	// webSocketSubprotocol is the WebSocket subprotocol of MQTT.
+	webSocketSubprotocol = "mqtt"
+
+	defaultWebSocketPath = "/mqtt"
+
+	// maxPacketSize is the max size of a MQTT packet, which is the max
+	// remaining length plus the max size of the fixed header.
+	maxPacketSize = 268435455 + 5
+)
+
+// setWebSocketListener listens on the WebSocket port, the connections are
+// handled by handleConn after the WebSocket handshake, the same as the
+// connections of the TCP listener.
+func (b *Broker) setWebSocketListener(cfg *tls.Config) error {
+	ws := b.spec.WebSocket
+	if ws == nil {
+		return nil
+	}
+	if ws.Port == b.spec.Port {
+		return fmt.Errorf("webSocket port %d conflicts with the tcp port", ws.Port)
+	}
+
+	var l net.Listener
+	var err error
+	addr := fmt.Sprintf(":%d", ws.Port)
+	if cfg != nil {
+		l, err = tls.Listen("tcp", addr, cfg)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("gen mqtt websocket listener with addr %s failed: %v", addr, err)
+	}
+
+	path := ws.Path
+	if path == "" {
+		path = defaultWebSocketPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, b.handleWebSocket)
+	b.wsListener = l
+	b.wsServer = &http.Server{Handler: mux}
+	return nil
+}
+
+func (b *Broker) runWebSocket() {
+	err := b.wsServer.Serve(b.wsListener)
+	if err != nil && err != http.ErrServerClosed {
+		logger.SpanErrorf(nil, "mqtt websocket server %s serve failed: %v", b.name, err)
+	}
+}
+
+func (b *Broker) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:   []string{webSocketSubprotocol},
+		OriginPatterns: b.spec.WebSocket.OriginPatterns,
+	})
+	if err != nil {
+		logger.SpanErrorf(nil, "accept mqtt websocket connection from %s failed: %v", r.RemoteAddr, err)
+		return
+	}
+	if c.Subprotocol() != webSocketSubprotocol {
+		logger.SpanErrorf(nil, "mqtt websocket connection from %s without subprotocol %s", r.RemoteAddr, webSocketSubprotocol)
+		c.Close(websocket.StatusPolicyViolation, "subprotocol mqtt is required")
+		return
+	}
+
+	c.SetReadLimit(maxPacketSize)
+	conn := websocket.NetConn(stdcontext.Background(), c, websocket.MessageBinary)
+	b.handleConn(conn)
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqttproxy
+
+import (
+	stdcontext "context"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"nhooyr.io/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := getDefaultSpec()
+	spec.BrokerMode = true
+	spec.WebSocket = &WebSocket{Port: 8083}
+	store := newStorage(nil)
+	broker := newBroker(spec, nil, store, &mockMuxMapper{}, func(s, ss string) (map[string]string, error) {
+		return map[string]string{}, nil
+	})
+	assert.NotNil(broker)
+	defer broker.close()
+
+	opts := paho.NewClientOptions().AddBroker("ws://127.0.0.1:8083/mqtt").SetClientID("wsClient").SetUsername("test").SetPassword("test")
+	wsClient := paho.NewClient(opts)
+	token := wsClient.Connect()
+	token.Wait()
+	assert.Nil(token.Error())
+	defer wsClient.Disconnect(200)
+
+	ch := make(chan CheckMsg, 10)
+	token = wsClient.Subscribe("ws/test", 1, getMQTTSubscribeHandler(ch))
+	token.Wait()
+	assert.Nil(token.Error())
+
+	// messages are exchanged between websocket and tcp clients
+	tcpClient := getMQTTClient(t, "tcpClient", "test", "test", true)
+	defer tcpClient.Disconnect(200)
+	token = tcpClient.Publish("ws/test", 1, false, "hello")
+	token.Wait()
+	assert.Nil(token.Error())
+
+	select {
+	case msg := <-ch:
+		assert.Equal(CheckMsg{topic: "ws/test", payload: "hello", qos: 1}, msg)
+	case <-time.After(5 * time.Second):
+		assert.Fail("message not received by websocket client")
+	}
+
+	// connections without mqtt subprotocol are rejected
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 5*time.Second)
+	defer cancel()
+	c, _, err := websocket.Dial(ctx, "ws://127.0.0.1:8083/mqtt", nil)
+	assert.Nil(err)
+	_, _, err = c.Read(ctx)
+	assert.Equal(websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+
+	// port conflicts with the tcp port
+	spec2 := getDefaultSpec()
+	spec2.Port = 1884
+	spec2.WebSocket = &WebSocket{Port: 1884}
+	assert.NotNil((&Broker{spec: spec2}).setListener())
+}
@@ -415,6 +415,17 @@ func (p *Pipeline) Status() *supervisor.Status {
 	}
 }
 
+// Healthy returns whether all filters of the pipeline are healthy, filters
+// which don't report their health are considered healthy.
+func (p *Pipeline) Healthy() bool {
+	for _, filter := range p.filters {
+		if hc, ok := filter.(interface{ Healthy() bool }); ok && !hc.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
 // Close closes Pipeline.
 func (p *Pipeline) Close() {
 	for _, filter := range p.filters {
@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package grpcstat implements the statistics tool for gRPC traffic.
+package grpcstat
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/protocols/httpprot/httpstat"
+	"github.com/megaease/easegress/pkg/util/codecounter"
+	"github.com/megaease/easegress/pkg/util/easemonitor"
+	"google.golang.org/grpc/codes"
+)
+
+type (
+	// GRPCStat is the statistics tool for gRPC traffic.
+	GRPCStat struct {
+		// the request metrics are the same as HTTP, so httpstat is
+		// reused, but status codes are counted separately.
+		stat *httpstat.HTTPStat
+		cc   *codecounter.HTTPStatusCodeCounter
+	}
+
+	// Metric is the package of statistics at once.
+	Metric struct {
+		Code     codes.Code
+		Duration time.Duration
+		ReqSize  uint64
+		RespSize uint64
+	}
+
+	// StatusCodeMetric is the metrics of gRPC status code.
+	StatusCodeMetric struct {
+		Code  string `json:"code"`
+		Count uint64 `json:"cnt"`
+	}
+
+	// Status contains all status generated by GRPCStat.
+	Status struct {
+		httpstat.RequestMetric
+		// Codes is the count of each gRPC status code, the key is the
+		// name of the code, like 'OK' and 'Unavailable'.
+		Codes map[string]uint64 `json:"codes"`
+	}
+
+	// TopN is the statistics tool for gRPC methods.
+	TopN struct {
+		m sync.Map
+		n int
+	}
+
+	// Item is the item of TopN status.
+	Item struct {
+		Method string `json:"method"`
+		*Status
+	}
+)
+
+// New creates a GRPCStat.
+func New() *GRPCStat {
+	return &GRPCStat{
+		stat: httpstat.New(),
+		cc:   codecounter.New(),
+	}
+}
+
+// Stat stats the metric.
+func (gs *GRPCStat) Stat(m *Metric) {
+	// only whether the request succeeded matters to httpstat.
+	statusCode := http.StatusOK
+	if m.Code != codes.OK {
+		statusCode = http.StatusInternalServerError
+	}
+	gs.stat.Stat(&httpstat.Metric{
+		StatusCode: statusCode,
+		Duration:   m.Duration,
+		ReqSize:    m.ReqSize,
+		RespSize:   m.RespSize,
+	})
+	gs.cc.Count(int(m.Code))
+}
+
+// Status returns GRPCStat Status, it assumes it is called every five
+// seconds, like httpstat.HTTPStat.
+func (gs *GRPCStat) Status() *Status {
+	status := &Status{
+		RequestMetric: gs.stat.Status().RequestMetric,
+		Codes:         map[string]uint64{},
+	}
+	for code, count := range gs.cc.Codes() {
+		status.Codes[codes.Code(code).String()] = count
+	}
+	gs.cc.Reset()
+	return status
+}
+
+// ToMetrics implements easemonitor.Metricer.
+func (s *Status) ToMetrics(service string) []*easemonitor.Metrics {
+	results := make([]*easemonitor.Metrics, 0, len(s.Codes)+1)
+
+	results = append(results, &easemonitor.Metrics{
+		CommonFields: easemonitor.CommonFields{
+			Service: service,
+			Type:    "eg-grpc-request",
+		},
+		OtherFields: &s.RequestMetric,
+	})
+
+	for code, count := range s.Codes {
+		results = append(results, &easemonitor.Metrics{
+			CommonFields: easemonitor.CommonFields{
+				Service: service,
+				Type:    "eg-grpc-status-code",
+			},
+			OtherFields: &StatusCodeMetric{
+				Code:  code,
+				Count: count,
+			},
+		})
+	}
+
+	return results
+}
+
+// NewTopN creates a TopN.
+func NewTopN(n int) *TopN {
+	return &TopN{n: n}
+}
+
+// Stat returns the GRPCStat of the method.
+func (t *TopN) Stat(method string) *GRPCStat {
+	if v, ok := t.m.Load(method); ok {
+		return v.(*GRPCStat)
+	}
+	v, _ := t.m.LoadOrStore(method, New())
+	return v.(*GRPCStat)
+}
+
+// Status returns TopN Status, and resets all metrics.
+func (t *TopN) Status() []*Item {
+	status := make([]*Item, 0)
+	t.m.Range(func(key, value interface{}) bool {
+		status = append(status, &Item{
+			Method: key.(string),
+			Status: value.(*GRPCStat).Status(),
+		})
+		return true
+	})
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Count > status[j].Count
+	})
+	n := len(status)
+	if n > t.n {
+		n = t.n
+	}
+
+	return status[0:n]
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpcstat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestGRPCStat(t *testing.T) {
+	at := assert.New(t)
+
+	gs := New()
+	gs.Stat(&Metric{Code: codes.OK, Duration: 10 * time.Millisecond, ReqSize: 10, RespSize: 20})
+	gs.Stat(&Metric{Code: codes.OK, Duration: 30 * time.Millisecond, ReqSize: 10, RespSize: 20})
+	gs.Stat(&Metric{Code: codes.Unavailable, Duration: 20 * time.Millisecond, ReqSize: 10})
+
+	s := gs.Status()
+	at.Equal(uint64(3), s.Count)
+	at.Equal(uint64(1), s.ErrCount)
+	at.Equal(uint64(10), s.Min)
+	at.Equal(uint64(30), s.Max)
+	at.Equal(uint64(30), s.ReqSize)
+	at.Equal(uint64(40), s.RespSize)
+	at.Equal(map[string]uint64{"OK": 2, "Unavailable": 1}, s.Codes)
+
+	metrics := s.ToMetrics("test")
+	at.Len(metrics, 3)
+	at.Equal("eg-grpc-request", metrics[0].Type)
+
+	// codes are reset after Status.
+	at.Empty(gs.Status().Codes)
+}
+
+func TestTopN(t *testing.T) {
+	at := assert.New(t)
+
+	topN := NewTopN(2)
+	for i, method := range []string{"/a.A/A", "/b.B/B", "/c.C/C"} {
+		for j := 0; j <= i; j++ {
+			topN.Stat(method).Stat(&Metric{Code: codes.OK})
+		}
+	}
+
+	items := topN.Status()
+	at.Len(items, 2)
+	at.Equal("/c.C/C", items[0].Method)
+	at.Equal(uint64(3), items[0].Count)
+	at.Equal("/b.B/B", items[1].Method)
+}
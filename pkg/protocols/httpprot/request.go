@@ -335,6 +335,11 @@ func (r *Request) Context() context.Context {
 	return r.Std().Context()
 }
 
+// SetContext replaces the request context with ctx.
+func (r *Request) SetContext(ctx context.Context) {
+	r.Request = r.Request.WithContext(ctx)
+}
+
 // SetMethod sets the request method.
 func (r *Request) SetMethod(method string) {
 	r.Std().Method = method
@@ -90,6 +90,9 @@ func TestRequest(t *testing.T) {
 	cancel()
 	assert.Equal(context.Canceled, request.Context().Err())
 
+	request.SetContext(context.Background())
+	assert.Nil(request.Context().Err())
+
 	request.SetMethod(http.MethodPost)
 	assert.Equal(http.MethodPost, request.Method())
 
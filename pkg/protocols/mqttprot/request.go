@@ -29,10 +29,17 @@ import (
 type (
 	// Request contains MQTT packet.
 	Request struct {
-		client     Client
-		packet     packets.ControlPacket
-		packetType PacketType
-		payload    []byte
+		client         Client
+		packet         packets.ControlPacket
+		packetType     PacketType
+		payload        []byte
+		userProperties []UserProperty
+	}
+
+	// UserProperty is a user property of MQTT 5 packet.
+	UserProperty struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
 	}
 
 	// Client contains MQTT client info that send this packet
@@ -134,6 +141,19 @@ func (r *Request) UnsubscribePacket() *packets.UnsubscribePacket {
 	return r.packet.(*packets.UnsubscribePacket)
 }
 
+// UserProperties returns the user properties of the packet, they are
+// only available when the client connects with MQTT 5.
+func (r *Request) UserProperties() []UserProperty {
+	return r.userProperties
+}
+
+// SetUserProperties sets the user properties of the packet, the user
+// properties of a publish packet are forwarded to the subscribers which
+// connect with MQTT 5.
+func (r *Request) SetUserProperties(props []UserProperty) {
+	r.userProperties = props
+}
+
 // Header return MQTT request header
 func (r *Request) Header() protocols.Header {
 	// TODO: what header to return?
@@ -20,25 +20,34 @@ package registry
 
 import (
 	// Filters
+	_ "github.com/megaease/easegress/pkg/filters/amqpbackend"
 	_ "github.com/megaease/easegress/pkg/filters/builder"
 	_ "github.com/megaease/easegress/pkg/filters/certextractor"
 	_ "github.com/megaease/easegress/pkg/filters/connectcontrol"
 	_ "github.com/megaease/easegress/pkg/filters/corsadaptor"
 	_ "github.com/megaease/easegress/pkg/filters/fallback"
+	_ "github.com/megaease/easegress/pkg/filters/faultinjection"
+	_ "github.com/megaease/easegress/pkg/filters/grpctranscoder"
 	_ "github.com/megaease/easegress/pkg/filters/headerlookup"
 	_ "github.com/megaease/easegress/pkg/filters/headertojson"
 	_ "github.com/megaease/easegress/pkg/filters/kafka"
 	_ "github.com/megaease/easegress/pkg/filters/kafkabackend"
 	_ "github.com/megaease/easegress/pkg/filters/meshadaptor"
+	_ "github.com/megaease/easegress/pkg/filters/mirror"
 	_ "github.com/megaease/easegress/pkg/filters/mock"
 	_ "github.com/megaease/easegress/pkg/filters/mqttclientauth"
+	_ "github.com/megaease/easegress/pkg/filters/natsbackend"
 	_ "github.com/megaease/easegress/pkg/filters/oidcadaptor"
 	_ "github.com/megaease/easegress/pkg/filters/opafilter"
+	_ "github.com/megaease/easegress/pkg/filters/openapivalidator"
 	_ "github.com/megaease/easegress/pkg/filters/proxies/grpcproxy"
 	_ "github.com/megaease/easegress/pkg/filters/proxies/httpproxy"
 	_ "github.com/megaease/easegress/pkg/filters/ratelimiter"
+	_ "github.com/megaease/easegress/pkg/filters/recorder"
 	_ "github.com/megaease/easegress/pkg/filters/redirector"
+	_ "github.com/megaease/easegress/pkg/filters/redisbackend"
 	_ "github.com/megaease/easegress/pkg/filters/remotefilter"
+	_ "github.com/megaease/easegress/pkg/filters/script"
 	_ "github.com/megaease/easegress/pkg/filters/topicmapper"
 	_ "github.com/megaease/easegress/pkg/filters/validator"
 	_ "github.com/megaease/easegress/pkg/filters/wasmhost"
@@ -54,6 +63,7 @@ import (
 	_ "github.com/megaease/easegress/pkg/object/grpcserver"
 	_ "github.com/megaease/easegress/pkg/object/httpserver"
 	_ "github.com/megaease/easegress/pkg/object/ingresscontroller"
+	_ "github.com/megaease/easegress/pkg/object/kafkaconsumer"
 	_ "github.com/megaease/easegress/pkg/object/meshcontroller"
 	_ "github.com/megaease/easegress/pkg/object/mqttproxy"
 	_ "github.com/megaease/easegress/pkg/object/nacosserviceregistry"
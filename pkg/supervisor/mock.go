@@ -45,3 +45,9 @@ func NewMock(options *option.Options, cls cluster.Cluster, businessControllers s
 func NewDefaultMock() *Supervisor {
 	return &Supervisor{}
 }
+
+// MockSystemController stores the entity as a system controller for
+// testing purpose.
+func (s *Supervisor) MockSystemController(entity *ObjectEntity) {
+	s.systemControllers.Store(entity.Spec().Kind(), entity)
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package certprovider provides certificates from external sources, like
+// PEM files, HashiCorp Vault and Kubernetes secrets. The certificates are
+// reloaded when they are changed in the sources.
+package certprovider
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+const defaultRefreshInterval = 5 * time.Minute
+
+type (
+	// Provider provides certificates from a source.
+	Provider interface {
+		// Fetch fetches the certificates from the source.
+		Fetch(ctx context.Context) ([]*tls.Certificate, error)
+		// Changes returns a channel which receives a value when the
+		// certificates may have been changed, it returns nil if the
+		// source can't be watched, and the provider is only polled.
+		Changes() <-chan struct{}
+		// Close closes the provider.
+		Close()
+	}
+
+	// Spec describes a certificate source, exactly one of File, Vault
+	// and KubernetesSecret must be configured.
+	Spec struct {
+		Name string `json:"name" jsonschema:"required"`
+		// RefreshInterval is the interval to poll the source, the
+		// default value is 5 minutes.
+		RefreshInterval  string                `json:"refreshInterval,omitempty" jsonschema:"omitempty,format=duration"`
+		File             *FileSpec             `json:"file,omitempty" jsonschema:"omitempty"`
+		Vault            *VaultSpec            `json:"vault,omitempty" jsonschema:"omitempty"`
+		KubernetesSecret *KubernetesSecretSpec `json:"kubernetesSecret,omitempty" jsonschema:"omitempty"`
+	}
+)
+
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	if spec.RefreshInterval != "" {
+		d, err := time.ParseDuration(spec.RefreshInterval)
+		if err != nil {
+			return fmt.Errorf("invalid refreshInterval: %v", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("refreshInterval must be positive")
+		}
+	}
+
+	n := 0
+	var err error
+	if spec.File != nil {
+		n++
+		err = spec.File.Validate()
+	}
+	if spec.Vault != nil {
+		n++
+		err = spec.Vault.Validate()
+	}
+	if spec.KubernetesSecret != nil {
+		n++
+		err = spec.KubernetesSecret.Validate()
+	}
+	if n != 1 {
+		return fmt.Errorf("exactly one of file, vault and kubernetesSecret must be configured")
+	}
+	return err
+}
+
+func (spec *Spec) refreshInterval() time.Duration {
+	if d, err := time.ParseDuration(spec.RefreshInterval); err == nil && d > 0 {
+		return d
+	}
+	return defaultRefreshInterval
+}
+
+// New creates a provider from the spec.
+func New(spec *Spec) (Provider, error) {
+	switch {
+	case spec.File != nil:
+		return newFileProvider(spec.File)
+	case spec.Vault != nil:
+		return newVaultProvider(spec.Vault)
+	case spec.KubernetesSecret != nil:
+		return newKubernetesSecretProvider(spec.KubernetesSecret)
+	}
+	return nil, fmt.Errorf("no certificate source is configured")
+}
+
+// parseKeyPair parses a certificate and its private key in PEM, and the
+// leaf certificate is parsed too.
+func parseKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &cert, nil
+}
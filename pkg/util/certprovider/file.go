@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certprovider
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+type (
+	// FileSpec describes the PEM files of a certificate.
+	FileSpec struct {
+		CertFile string `json:"certFile" jsonschema:"required"`
+		KeyFile  string `json:"keyFile" jsonschema:"required"`
+	}
+
+	fileProvider struct {
+		spec    *FileSpec
+		watcher *fsnotify.Watcher
+		changes chan struct{}
+		done    chan struct{}
+	}
+)
+
+// Validate validates FileSpec.
+func (spec *FileSpec) Validate() error {
+	if spec.CertFile == "" || spec.KeyFile == "" {
+		return fmt.Errorf("both certFile and keyFile are required")
+	}
+	return nil
+}
+
+func newFileProvider(spec *FileSpec) (*fileProvider, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// watch the directories instead of the files, because files are
+	// usually replaced by renaming, and Kubernetes updates mounted
+	// secrets by swapping symbolic links.
+	dirs := map[string]bool{
+		filepath.Dir(spec.CertFile): true,
+		filepath.Dir(spec.KeyFile):  true,
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("watch %s failed: %v", dir, err)
+		}
+	}
+
+	p := &fileProvider{
+		spec:    spec,
+		watcher: watcher,
+		changes: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go p.watch()
+	return p, nil
+}
+
+func (p *fileProvider) watch() {
+	defer close(p.done)
+	for {
+		select {
+		case _, ok := <-p.watcher.Events:
+			if !ok {
+				return
+			}
+			select {
+			case p.changes <- struct{}{}:
+			default:
+			}
+		case err, ok := <-p.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Errorf("watch certificate files failed: %v", err)
+		}
+	}
+}
+
+// Fetch implements Provider.
+func (p *fileProvider) Fetch(ctx context.Context) ([]*tls.Certificate, error) {
+	certPEM, err := os.ReadFile(p.spec.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(p.spec.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return []*tls.Certificate{cert}, nil
+}
+
+// Changes implements Provider.
+func (p *fileProvider) Changes() <-chan struct{} {
+	return p.changes
+}
+
+// Close implements Provider.
+func (p *fileProvider) Close() {
+	p.watcher.Close()
+	<-p.done
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certprovider
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// rewatchDelay is the delay before watching the secret again after the
+// watch is closed.
+const rewatchDelay = 5 * time.Second
+
+type (
+	// KubernetesSecretSpec describes a Kubernetes secret of type
+	// 'kubernetes.io/tls', the certificate and the private key are in
+	// 'tls.crt' and 'tls.key'. The in-cluster config is used if both
+	// KubeConfig and MasterURL are empty.
+	KubernetesSecretSpec struct {
+		Namespace  string `json:"namespace" jsonschema:"required"`
+		Name       string `json:"name" jsonschema:"required"`
+		KubeConfig string `json:"kubeConfig,omitempty" jsonschema:"omitempty"`
+		MasterURL  string `json:"masterURL,omitempty" jsonschema:"omitempty"`
+	}
+
+	kubernetesSecretProvider struct {
+		spec    *KubernetesSecretSpec
+		client  kubernetes.Interface
+		changes chan struct{}
+		cancel  context.CancelFunc
+		done    chan struct{}
+	}
+)
+
+// Validate validates KubernetesSecretSpec.
+func (spec *KubernetesSecretSpec) Validate() error {
+	if spec.Namespace == "" || spec.Name == "" {
+		return fmt.Errorf("both namespace and name are required")
+	}
+	return nil
+}
+
+func newKubernetesSecretProvider(spec *KubernetesSecretSpec) (*kubernetesSecretProvider, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags(spec.MasterURL, spec.KubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("build kubeconfig failed: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("build kubernetes client failed: %v", err)
+	}
+	return newKubernetesSecretProviderWithClient(spec, client), nil
+}
+
+func newKubernetesSecretProviderWithClient(spec *KubernetesSecretSpec, client kubernetes.Interface) *kubernetesSecretProvider {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &kubernetesSecretProvider{
+		spec:    spec,
+		client:  client,
+		changes: make(chan struct{}, 1),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go p.watch(ctx)
+	return p
+}
+
+// watch watches the secret, and watches it again when the watch is closed
+// by the API server.
+func (p *kubernetesSecretProvider) watch(ctx context.Context) {
+	defer close(p.done)
+
+	opts := metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", p.spec.Name).String(),
+	}
+	for {
+		w, err := p.client.CoreV1().Secrets(p.spec.Namespace).Watch(ctx, opts)
+		if err != nil {
+			logger.Errorf("watch secret %s/%s failed: %v", p.spec.Namespace, p.spec.Name, err)
+		} else {
+			p.consume(ctx, w.ResultChan())
+			w.Stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(rewatchDelay):
+		}
+	}
+}
+
+func (p *kubernetesSecretProvider) consume(ctx context.Context, events <-chan watch.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			select {
+			case p.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Fetch implements Provider.
+func (p *kubernetesSecretProvider) Fetch(ctx context.Context) ([]*tls.Certificate, error) {
+	secret, err := p.client.CoreV1().Secrets(p.spec.Namespace).Get(ctx, p.spec.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return nil, fmt.Errorf("%s or %s not found in secret %s/%s",
+			corev1.TLSCertKey, corev1.TLSPrivateKeyKey, p.spec.Namespace, p.spec.Name)
+	}
+	cert, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return []*tls.Certificate{cert}, nil
+}
+
+// Changes implements Provider.
+func (p *kubernetesSecretProvider) Changes() <-chan struct{} {
+	return p.changes
+}
+
+// Close implements Provider.
+func (p *kubernetesSecretProvider) Close() {
+	p.cancel()
+	<-p.done
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certprovider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubernetesSecretProvider(t *testing.T) {
+	at := assert.New(t)
+	ctx := context.Background()
+
+	spec := &KubernetesSecretSpec{Namespace: "default"}
+	at.Error(spec.Validate())
+	spec.Name = "tls"
+	at.NoError(spec.Validate())
+
+	client := fake.NewSimpleClientset()
+	p := newKubernetesSecretProviderWithClient(spec, client)
+	defer p.Close()
+
+	_, err := p.Fetch(ctx)
+	at.Error(err)
+
+	newSecret := func(dnsName string) *corev1.Secret {
+		certs := tlsutiltest.NewCerts(dnsName)
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls"},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       certs.ServerCert,
+				corev1.TLSPrivateKeyKey: certs.ServerKey,
+			},
+		}
+	}
+	secrets := client.CoreV1().Secrets("default")
+
+	_, err = secrets.Create(ctx, newSecret("a.example.com"), metav1.CreateOptions{})
+	at.NoError(err)
+	certs, err := p.Fetch(ctx)
+	at.NoError(err)
+	at.Contains(certs[0].Leaf.DNSNames, "a.example.com")
+
+	// the watch is started asynchronously, so keep updating the secret
+	// until a change is received.
+	at.Eventually(func() bool {
+		_, err := secrets.Update(ctx, newSecret("b.example.com"), metav1.UpdateOptions{})
+		at.NoError(err)
+		select {
+		case <-p.Changes():
+			return true
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}, 3*time.Second, 10*time.Millisecond)
+
+	certs, err = p.Fetch(ctx)
+	at.NoError(err)
+	at.Contains(certs[0].Leaf.DNSNames, "b.example.com")
+
+	secret := newSecret("c.example.com")
+	delete(secret.Data, corev1.TLSPrivateKeyKey)
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	at.NoError(err)
+	_, err = p.Fetch(ctx)
+	at.Error(err)
+}
@@ -0,0 +1,302 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certprovider
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+)
+
+const (
+	// fetchTimeout is the timeout to fetch certificates from a source.
+	fetchTimeout = 30 * time.Second
+	// debounceDelay is the delay before reloading the certificates after a
+	// change, as a change is usually followed by others, e.g. the key file
+	// is written after the certificate file.
+	debounceDelay = 200 * time.Millisecond
+)
+
+type (
+	// Manager manages the certificates of several sources, and picks a
+	// certificate by the server name of the TLS handshake.
+	Manager struct {
+		sources []*source
+		names   atomic.Pointer[map[string]*tls.Certificate]
+
+		mu     sync.Mutex
+		ctx    context.Context
+		cancel context.CancelFunc
+		wg     sync.WaitGroup
+	}
+
+	source struct {
+		name     string
+		provider Provider
+		interval time.Duration
+
+		mu        sync.Mutex
+		certs     []*tls.Certificate
+		err       error
+		updatedAt time.Time
+	}
+
+	// Status is the status of a certificate source.
+	Status struct {
+		Source       string             `json:"source"`
+		UpdatedAt    string             `json:"updatedAt,omitempty"`
+		Error        string             `json:"error,omitempty"`
+		Certificates []*CertificateInfo `json:"certificates"`
+	}
+
+	// CertificateInfo is the information of a certificate.
+	CertificateInfo struct {
+		Subject  string    `json:"subject"`
+		DNSNames []string  `json:"dnsNames,omitempty"`
+		NotAfter time.Time `json:"notAfter"`
+		// ExpiresIn is the seconds before the certificate expires.
+		ExpiresIn int64 `json:"expiresIn"`
+	}
+)
+
+// NewManager creates a manager of the certificate sources, certificates
+// are loaded asynchronously.
+func NewManager(specs []*Spec) (*Manager, error) {
+	providers := make(map[string]Provider, len(specs))
+	for _, spec := range specs {
+		p, err := New(spec)
+		if err != nil {
+			for _, p := range providers {
+				p.Close()
+			}
+			return nil, err
+		}
+		providers[spec.Name] = p
+	}
+
+	m := newManager()
+	for _, spec := range specs {
+		m.addSource(spec.Name, providers[spec.Name], spec.refreshInterval())
+	}
+	m.start()
+	return m, nil
+}
+
+func newManager() *Manager {
+	m := &Manager{}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.names.Store(&map[string]*tls.Certificate{})
+	return m
+}
+
+func (m *Manager) addSource(name string, p Provider, interval time.Duration) {
+	m.sources = append(m.sources, &source{name: name, provider: p, interval: interval})
+}
+
+func (m *Manager) start() {
+	for _, s := range m.sources {
+		m.wg.Add(1)
+		go m.run(s)
+	}
+}
+
+// run keeps the certificates of the source up to date.
+func (m *Manager) run(s *source) {
+	defer m.wg.Done()
+
+	for {
+		m.reload(s)
+
+		timer := time.NewTimer(s.nextRefresh(time.Now()))
+		select {
+		case <-m.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-s.provider.Changes():
+			timer.Stop()
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-time.After(debounceDelay):
+			}
+			// drain the changes during the delay.
+			for drained := false; !drained; {
+				select {
+				case <-s.provider.Changes():
+				default:
+					drained = true
+				}
+			}
+		}
+	}
+}
+
+// nextRefresh returns the duration before the next refresh, it is the
+// refresh interval or the time when a certificate reaches 2/3 of its
+// lifetime, whichever comes first.
+func (s *source) nextRefresh(now time.Time) time.Duration {
+	d := s.interval
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cert := range s.certs {
+		leaf := cert.Leaf
+		renewAt := leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+		if r := renewAt.Sub(now); r < d {
+			d = r
+		}
+	}
+
+	// avoid a busy loop for certificates which have expired.
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+func (m *Manager) reload(s *source) {
+	ctx, cancel := context.WithTimeout(m.ctx, fetchTimeout)
+	defer cancel()
+
+	certs, err := s.provider.Fetch(ctx)
+	if m.ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	if err != nil {
+		// keep the previous certificates if failed.
+		logger.Errorf("load certificates from %s failed: %v", s.name, err)
+		s.err = err
+	} else {
+		s.certs, s.err = certs, nil
+		s.updatedAt = time.Now()
+	}
+	s.mu.Unlock()
+
+	if err == nil {
+		m.rebuild()
+	}
+}
+
+// rebuild rebuilds the map from server names to certificates, if a name
+// is served by more than one sources, the first source wins. The empty
+// name maps to the first certificate, which is the default one for the
+// handshakes without a server name.
+func (m *Manager) rebuild() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := map[string]*tls.Certificate{}
+	for _, s := range m.sources {
+		s.mu.Lock()
+		if _, ok := names[""]; !ok && len(s.certs) > 0 {
+			names[""] = s.certs[0]
+		}
+		for _, cert := range s.certs {
+			for _, name := range certNames(cert) {
+				if _, ok := names[name]; !ok {
+					names[name] = cert
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+	m.names.Store(&names)
+}
+
+func certNames(cert *tls.Certificate) []string {
+	leaf := cert.Leaf
+	names := make([]string, 0, len(leaf.DNSNames)+len(leaf.IPAddresses)+1)
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return names
+}
+
+// GetCertificate returns the certificate for the server name of the
+// handshake, the exact name is preferred over the wildcard one. It
+// returns nil if no certificate matches the server name. If there's no
+// server name, the first certificate of the sources is returned.
+func (m *Manager) GetCertificate(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(chi.ServerName, "."))
+
+	names := *m.names.Load()
+	if cert := names[name]; cert != nil {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert := names["*"+name[i:]]; cert != nil {
+			return cert, nil
+		}
+	}
+	return nil, nil
+}
+
+// Status returns the status of all the sources.
+func (m *Manager) Status() []*Status {
+	now := time.Now()
+	result := make([]*Status, 0, len(m.sources))
+	for _, s := range m.sources {
+		s.mu.Lock()
+		status := &Status{Source: s.name, Certificates: []*CertificateInfo{}}
+		if !s.updatedAt.IsZero() {
+			status.UpdatedAt = s.updatedAt.Format(time.RFC3339)
+		}
+		if s.err != nil {
+			status.Error = s.err.Error()
+		}
+		for _, cert := range s.certs {
+			status.Certificates = append(status.Certificates, newCertificateInfo(cert, now))
+		}
+		s.mu.Unlock()
+		result = append(result, status)
+	}
+	return result
+}
+
+func newCertificateInfo(cert *tls.Certificate, now time.Time) *CertificateInfo {
+	leaf := cert.Leaf
+	return &CertificateInfo{
+		Subject:   leaf.Subject.String(),
+		DNSNames:  leaf.DNSNames,
+		NotAfter:  leaf.NotAfter,
+		ExpiresIn: int64(leaf.NotAfter.Sub(now).Seconds()),
+	}
+}
+
+// Close closes the manager and all the providers.
+func (m *Manager) Close() {
+	m.cancel()
+	m.wg.Wait()
+	for _, s := range m.sources {
+		s.provider.Close()
+	}
+}
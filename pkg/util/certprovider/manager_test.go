@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certprovider
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+type fakeProvider struct {
+	certs   []*tls.Certificate
+	err     error
+	changes chan struct{}
+}
+
+func (p *fakeProvider) Fetch(ctx context.Context) ([]*tls.Certificate, error) {
+	return p.certs, p.err
+}
+
+func (p *fakeProvider) Changes() <-chan struct{} {
+	return p.changes
+}
+
+func (p *fakeProvider) Close() {
+}
+
+func newTestCert(at *assert.Assertions, dnsNames ...string) *tls.Certificate {
+	certs := tlsutiltest.NewCerts(dnsNames...)
+	cert, err := parseKeyPair(certs.ServerCert, certs.ServerKey)
+	at.NoError(err)
+	return cert
+}
+
+func getCert(m *Manager, name string) *tls.Certificate {
+	cert, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+	return cert
+}
+
+func TestSpecValidate(t *testing.T) {
+	at := assert.New(t)
+
+	spec := &Spec{Name: "test"}
+	at.Error(spec.Validate())
+
+	spec.File = &FileSpec{CertFile: "cert.pem", KeyFile: "key.pem"}
+	at.NoError(spec.Validate())
+
+	spec.KubernetesSecret = &KubernetesSecretSpec{Namespace: "default", Name: "tls"}
+	at.Error(spec.Validate())
+
+	spec.KubernetesSecret = nil
+	spec.RefreshInterval = "invalid"
+	at.Error(spec.Validate())
+	spec.RefreshInterval = "1m"
+	at.NoError(spec.Validate())
+	at.Equal(time.Minute, spec.refreshInterval())
+
+	spec.File.KeyFile = ""
+	at.Error(spec.Validate())
+}
+
+func TestManagerSNI(t *testing.T) {
+	at := assert.New(t)
+
+	exact := newTestCert(at, "www.example.com")
+	wildcard := newTestCert(at, "*.example.com")
+	other := newTestCert(at, "www.example.com", "api.example.org")
+
+	m := newManager()
+	m.addSource("first", &fakeProvider{certs: []*tls.Certificate{exact, wildcard}}, time.Hour)
+	failed := &fakeProvider{err: os.ErrNotExist}
+	m.addSource("second", failed, time.Hour)
+	m.addSource("third", &fakeProvider{certs: []*tls.Certificate{other}}, time.Hour)
+	for _, s := range m.sources {
+		m.reload(s)
+	}
+
+	at.Equal(exact, getCert(m, "www.example.com"))
+	at.Equal(exact, getCert(m, "WWW.example.com."))
+	at.Equal(wildcard, getCert(m, "foo.example.com"))
+	at.Nil(getCert(m, "foo.bar.example.com"))
+	at.Equal(other, getCert(m, "api.example.org"))
+	// the first certificate is used if there's no server name.
+	at.Equal(exact, getCert(m, ""))
+
+	status := m.Status()
+	at.Len(status, 3)
+	at.Len(status[0].Certificates, 2)
+	at.NotEmpty(status[0].UpdatedAt)
+	at.Greater(status[0].Certificates[0].ExpiresIn, int64(0))
+	at.NotEmpty(status[1].Error)
+	at.Empty(status[1].Certificates)
+
+	// previous certificates are kept if failed to reload.
+	first := m.sources[0].provider.(*fakeProvider)
+	first.err = os.ErrPermission
+	m.reload(m.sources[0])
+	at.Equal(exact, getCert(m, "www.example.com"))
+	at.NotEmpty(m.Status()[0].Error)
+
+	m.Close()
+}
+
+func TestNextRefresh(t *testing.T) {
+	at := assert.New(t)
+
+	s := &source{interval: time.Hour}
+	now := time.Now()
+	at.Equal(time.Hour, s.nextRefresh(now))
+
+	// the test certificate is valid for 25 hours, it should be renewed
+	// after 2/3 of its lifetime.
+	s.certs = []*tls.Certificate{newTestCert(at)}
+	s.interval = 24 * time.Hour
+	d := s.nextRefresh(s.certs[0].Leaf.NotBefore.Add(time.Hour))
+	at.Equal(15*time.Hour+40*time.Minute, d)
+
+	at.Equal(time.Second, s.nextRefresh(now.Add(48*time.Hour)))
+}
+
+func TestFileProvider(t *testing.T) {
+	at := assert.New(t)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCerts := func(dnsName string) {
+		certs := tlsutiltest.NewCerts(dnsName)
+		// replace the files by renaming, like most tools do.
+		at.NoError(os.WriteFile(certFile+".tmp", certs.ServerCert, 0o600))
+		at.NoError(os.WriteFile(keyFile+".tmp", certs.ServerKey, 0o600))
+		at.NoError(os.Rename(certFile+".tmp", certFile))
+		at.NoError(os.Rename(keyFile+".tmp", keyFile))
+	}
+	writeCerts("a.example.com")
+
+	m, err := NewManager([]*Spec{{
+		Name: "file",
+		File: &FileSpec{CertFile: certFile, KeyFile: keyFile},
+	}})
+	at.NoError(err)
+	defer m.Close()
+
+	at.Eventually(func() bool {
+		return getCert(m, "a.example.com") != nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	writeCerts("b.example.com")
+	at.Eventually(func() bool {
+		return getCert(m, "b.example.com") != nil && getCert(m, "a.example.com") == nil
+	}, 3*time.Second, 50*time.Millisecond)
+
+	_, err = NewManager([]*Spec{{
+		Name: "file",
+		File: &FileSpec{CertFile: "/not/exist/tls.crt", KeyFile: keyFile},
+	}})
+	at.Error(err)
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certprovider
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/tlsutil"
+)
+
+type (
+	// VaultSpec describes a certificate in HashiCorp Vault, which is
+	// read from a KV secret or issued by a PKI secrets engine. Exactly one
+	// of KVPath and PKIPath must be configured.
+	VaultSpec struct {
+		Address string `json:"address" jsonschema:"required,format=uri"`
+		// Token is the token to access Vault, it is read from TokenFile
+		// if empty, so that it can be rotated by other tools.
+		Token     string `json:"token,omitempty" jsonschema:"omitempty"`
+		TokenFile string `json:"tokenFile,omitempty" jsonschema:"omitempty"`
+		Namespace string `json:"namespace,omitempty" jsonschema:"omitempty"`
+		// CACertBase64 is the CA to verify the certificate of Vault.
+		CACertBase64 string `json:"caCertBase64,omitempty" jsonschema:"omitempty,format=base64"`
+
+		// KVPath is the path of a KV secret, e.g. 'secret/data/web' for
+		// a KV version 2 secret. CertField and KeyField are the fields of
+		// the certificate and the private key, 'certificate' and
+		// 'private_key' by default.
+		KVPath    string `json:"kvPath,omitempty" jsonschema:"omitempty"`
+		CertField string `json:"certField,omitempty" jsonschema:"omitempty"`
+		KeyField  string `json:"keyField,omitempty" jsonschema:"omitempty"`
+
+		// PKIPath is the path to issue certificates, e.g. 'pki/issue/web'.
+		PKIPath    string   `json:"pkiPath,omitempty" jsonschema:"omitempty"`
+		CommonName string   `json:"commonName,omitempty" jsonschema:"omitempty"`
+		AltNames   []string `json:"altNames,omitempty" jsonschema:"omitempty"`
+		TTL        string   `json:"ttl,omitempty" jsonschema:"omitempty"`
+	}
+
+	vaultProvider struct {
+		spec   *VaultSpec
+		client *http.Client
+
+		// issued is the certificate issued by the PKI secrets engine,
+		// which is reused until it needs to be renewed.
+		mu     sync.Mutex
+		issued *tls.Certificate
+	}
+
+	vaultResponse struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+)
+
+// Validate validates VaultSpec.
+func (spec *VaultSpec) Validate() error {
+	if _, err := url.Parse(spec.Address); err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+	if spec.Token == "" && spec.TokenFile == "" {
+		return fmt.Errorf("one of token and tokenFile is required")
+	}
+	if (spec.KVPath == "") == (spec.PKIPath == "") {
+		return fmt.Errorf("exactly one of kvPath and pkiPath must be configured")
+	}
+	if spec.PKIPath != "" && spec.CommonName == "" {
+		return fmt.Errorf("commonName is required to issue certificates")
+	}
+	if spec.CACertBase64 != "" {
+		if _, err := tlsutil.CertPool(spec.CACertBase64); err != nil {
+			return fmt.Errorf("invalid caCertBase64: %v", err)
+		}
+	}
+	return nil
+}
+
+func newVaultProvider(spec *VaultSpec) (*vaultProvider, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if spec.CACertBase64 != "" {
+		pool, err := tlsutil.CertPool(spec.CACertBase64)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &vaultProvider{
+		spec:   spec,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (p *vaultProvider) token() (string, error) {
+	if p.spec.Token != "" {
+		return p.spec.Token, nil
+	}
+	data, err := os.ReadFile(p.spec.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// request sends a request to Vault and returns the data of the response.
+func (p *vaultProvider) request(ctx context.Context, method, path string, body interface{}) (json.RawMessage, error) {
+	token, err := p.token()
+	if err != nil {
+		return nil, fmt.Errorf("read vault token failed: %v", err)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	u := strings.TrimSuffix(p.spec.Address, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if p.spec.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.spec.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	vr := &vaultResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(vr); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("decode vault response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault responds %d: %s", resp.StatusCode, strings.Join(vr.Errors, "; "))
+	}
+	return vr.Data, nil
+}
+
+// Fetch implements Provider.
+func (p *vaultProvider) Fetch(ctx context.Context) ([]*tls.Certificate, error) {
+	var cert *tls.Certificate
+	var err error
+	if p.spec.KVPath != "" {
+		cert, err = p.readKV(ctx)
+	} else {
+		cert, err = p.issue(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*tls.Certificate{cert}, nil
+}
+
+func (p *vaultProvider) readKV(ctx context.Context) (*tls.Certificate, error) {
+	raw, err := p.request(ctx, http.MethodGet, p.spec.KVPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("invalid kv secret: %v", err)
+	}
+	// the secret is wrapped in 'data' in KV version 2.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	certField, keyField := p.spec.CertField, p.spec.KeyField
+	if certField == "" {
+		certField = "certificate"
+	}
+	if keyField == "" {
+		keyField = "private_key"
+	}
+	certPEM, _ := data[certField].(string)
+	keyPEM, _ := data[keyField].(string)
+	if certPEM == "" || keyPEM == "" {
+		return nil, fmt.Errorf("field %s or %s not found in kv secret", certField, keyField)
+	}
+	return parseKeyPair(tlsutil.DecodePEM(certPEM), tlsutil.DecodePEM(keyPEM))
+}
+
+// issue issues a certificate from the PKI secrets engine, the previous
+// one is reused if it doesn't reach 2/3 of its lifetime.
+func (p *vaultProvider) issue(ctx context.Context) (*tls.Certificate, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.issued != nil {
+		leaf := p.issued.Leaf
+		renewAt := leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3)
+		if time.Now().Before(renewAt) {
+			return p.issued, nil
+		}
+	}
+
+	body := map[string]string{"common_name": p.spec.CommonName}
+	if len(p.spec.AltNames) > 0 {
+		body["alt_names"] = strings.Join(p.spec.AltNames, ",")
+	}
+	if p.spec.TTL != "" {
+		body["ttl"] = p.spec.TTL
+	}
+	raw, err := p.request(ctx, http.MethodPost, p.spec.PKIPath, body)
+	if err != nil {
+		return nil, err
+	}
+
+	data := struct {
+		Certificate string   `json:"certificate"`
+		PrivateKey  string   `json:"private_key"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+	}{}
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("invalid issued certificate: %v", err)
+	}
+
+	// the certificate is followed by its chain.
+	chain := []string{data.Certificate}
+	if len(data.CAChain) > 0 {
+		chain = append(chain, data.CAChain...)
+	} else if data.IssuingCA != "" {
+		chain = append(chain, data.IssuingCA)
+	}
+	cert, err := parseKeyPair([]byte(strings.Join(chain, "\n")), []byte(data.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	p.issued = cert
+	return cert, nil
+}
+
+// Changes implements Provider, Vault can't be watched.
+func (p *vaultProvider) Changes() <-chan struct{} {
+	return nil
+}
+
+// Close implements Provider.
+func (p *vaultProvider) Close() {
+	p.client.CloseIdleConnections()
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certprovider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeVault simulates the KV version 2 and the PKI secrets engines.
+func fakeVault(at *assert.Assertions, issued *int) *httptest.Server {
+	certs := tlsutiltest.NewCerts("www.example.com")
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		at.Equal("ns1", r.Header.Get("X-Vault-Namespace"))
+
+		var data interface{}
+		switch r.URL.Path {
+		case "/v1/secret/data/tls":
+			at.Equal(http.MethodGet, r.Method)
+			data = map[string]interface{}{
+				"data": map[string]string{
+					"certificate": string(certs.ServerCert),
+					"private_key": string(certs.ServerKey),
+				},
+				"metadata": map[string]interface{}{"version": 1},
+			}
+		case "/v1/pki/issue/easegress":
+			at.Equal(http.MethodPost, r.Method)
+			body := map[string]string{}
+			at.NoError(json.NewDecoder(r.Body).Decode(&body))
+			at.Equal("www.example.com", body["common_name"])
+			at.Equal("a.example.com,b.example.com", body["alt_names"])
+			*issued++
+			data = map[string]interface{}{
+				"certificate": string(certs.ServerCert),
+				"private_key": string(certs.ServerKey),
+				"issuing_ca":  string(certs.CACert),
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+}
+
+func TestVaultProvider(t *testing.T) {
+	at := assert.New(t)
+
+	issued := 0
+	server := fakeVault(at, &issued)
+	defer server.Close()
+
+	spec := &VaultSpec{
+		Address:   server.URL,
+		Token:     "root",
+		Namespace: "ns1",
+		KVPath:    "secret/data/tls",
+	}
+	at.NoError(spec.Validate())
+	p, err := newVaultProvider(spec)
+	at.NoError(err)
+	certs, err := p.Fetch(context.Background())
+	at.NoError(err)
+	at.Len(certs, 1)
+	at.Equal([]string{"localhost", "www.example.com"}, certs[0].Leaf.DNSNames)
+	at.Nil(p.Changes())
+	p.Close()
+
+	spec.KeyField = "key"
+	_, err = p.Fetch(context.Background())
+	at.Error(err)
+
+	spec.KVPath = "secret/data/notexist"
+	_, err = p.Fetch(context.Background())
+	at.Error(err)
+
+	spec.KVPath = ""
+	spec.PKIPath = "pki/issue/easegress"
+	at.Error(spec.Validate())
+	spec.CommonName = "www.example.com"
+	spec.AltNames = []string{"a.example.com", "b.example.com"}
+	at.NoError(spec.Validate())
+
+	p, err = newVaultProvider(spec)
+	at.NoError(err)
+	certs, err = p.Fetch(context.Background())
+	at.NoError(err)
+	at.Len(certs[0].Certificate, 2)
+
+	// the certificate is reused until 2/3 of its lifetime.
+	_, err = p.Fetch(context.Background())
+	at.NoError(err)
+	at.Equal(1, issued)
+
+	spec.Token = "invalid"
+	p.issued = nil
+	_, err = p.Fetch(context.Background())
+	at.ErrorContains(err, "permission denied")
+}
+
+// TestVaultDevServer runs against a Vault dev server, for example:
+//
+//	vault server -dev -dev-root-token-id=root
+//	VAULT_ADDR=http://127.0.0.1:8200 VAULT_TOKEN=root go test -run TestVaultDevServer
+func TestVaultDevServer(t *testing.T) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		t.Skip("VAULT_ADDR and VAULT_TOKEN are required")
+	}
+	at := assert.New(t)
+
+	p, err := newVaultProvider(&VaultSpec{Address: addr, Token: token})
+	at.NoError(err)
+	defer p.Close()
+	ctx := context.Background()
+	mustRequest := func(method, path string, body interface{}) {
+		_, err := p.request(ctx, method, path, body)
+		if !at.NoError(err) {
+			t.FailNow()
+		}
+	}
+
+	// KV version 2 is mounted at 'secret/' in dev mode.
+	certs := tlsutiltest.NewCerts("kv.example.com")
+	mustRequest(http.MethodPost, "secret/data/easegress-certprovider-test", map[string]interface{}{
+		"data": map[string]string{
+			"certificate": string(certs.ServerCert),
+			"private_key": string(certs.ServerKey),
+		},
+	})
+	defer p.request(ctx, http.MethodDelete, "secret/metadata/easegress-certprovider-test", nil)
+
+	p.spec.KVPath = "secret/data/easegress-certprovider-test"
+	result, err := p.Fetch(ctx)
+	at.NoError(err)
+	if at.Len(result, 1) {
+		at.Contains(result[0].Leaf.DNSNames, "kv.example.com")
+	}
+
+	mount := fmt.Sprintf("pki-easegress-test-%d", time.Now().UnixNano())
+	mustRequest(http.MethodPost, "sys/mounts/"+mount, map[string]string{"type": "pki"})
+	defer p.request(ctx, http.MethodDelete, "sys/mounts/"+mount, nil)
+	mustRequest(http.MethodPost, mount+"/root/generate/internal", map[string]string{
+		"common_name": "Easegress Test CA",
+		"ttl":         "24h",
+	})
+	mustRequest(http.MethodPost, mount+"/roles/easegress", map[string]interface{}{
+		"allowed_domains":  "example.com",
+		"allow_subdomains": true,
+		"max_ttl":          "1h",
+	})
+
+	p.spec.KVPath = ""
+	p.spec.PKIPath = mount + "/issue/easegress"
+	p.spec.CommonName = "pki.example.com"
+	p.spec.AltNames = []string{"alt.example.com"}
+	p.spec.TTL = "10m"
+	result, err = p.Fetch(ctx)
+	at.NoError(err)
+	if at.Len(result, 1) {
+		leaf := result[0].Leaf
+		at.Equal("pki.example.com", leaf.Subject.CommonName)
+		at.Contains(strings.Join(leaf.DNSNames, ","), "alt.example.com")
+		at.InDelta(10*time.Minute, leaf.NotAfter.Sub(leaf.NotBefore), float64(time.Minute))
+	}
+}
@@ -0,0 +1,339 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package clientauth provides the authentication and authorization of
+// clients by their TLS certificates.
+package clientauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/tlsutil"
+)
+
+const (
+	// ModeNone disables client certificate authentication.
+	ModeNone = "none"
+	// ModeOptional verifies the client certificate if it is given, but
+	// never rejects a request, the identity is only set if the
+	// certificate is verified and authorized.
+	ModeOptional = "optional"
+	// ModeVerifyIfGiven rejects a request if its client certificate is
+	// given but can't be verified or authorized.
+	ModeVerifyIfGiven = "verifyIfGiven"
+	// ModeRequired rejects a request if it doesn't have a client
+	// certificate, or the certificate can't be verified or authorized.
+	ModeRequired = "required"
+
+	// cacheSize is the max number of client certificates whose
+	// verification results are cached.
+	cacheSize = 1024
+	// cacheTTL is the max duration to cache a verification result.
+	cacheTTL = 5 * time.Minute
+)
+
+var (
+	// ErrNoCertificate means the client doesn't present a certificate.
+	ErrNoCertificate = errors.New("client certificate is required")
+	// ErrRevoked means the client certificate has been revoked.
+	ErrRevoked = errors.New("client certificate has been revoked")
+	// ErrUnauthorized means the client certificate doesn't match any rule.
+	ErrUnauthorized = errors.New("client certificate is not authorized")
+)
+
+type (
+	// Spec describes the client certificate authentication.
+	Spec struct {
+		Mode string `json:"mode" jsonschema:"required,enum=none,enum=optional,enum=verifyIfGiven,enum=required"`
+		// CACerts are the CA certificates in PEM to verify the client
+		// certificates, the PEM could be base64 encoded or in plain text.
+		CACerts []string `json:"caCerts,omitempty" jsonschema:"omitempty"`
+		// CRLs are the certificate revocation lists in PEM or DER, which
+		// could be base64 encoded.
+		CRLs []string  `json:"crls,omitempty" jsonschema:"omitempty"`
+		OCSP *OCSPSpec `json:"ocsp,omitempty" jsonschema:"omitempty"`
+		// Rules authorize the clients, a client is authorized if any of
+		// the rules matches its certificate, or if there are no rules.
+		Rules []*Rule `json:"rules,omitempty" jsonschema:"omitempty"`
+	}
+
+	// OCSPSpec describes the OCSP checking of the client certificates,
+	// the responders in the certificates are queried.
+	OCSPSpec struct {
+		// SoftFail accepts the certificate if the status can't be
+		// determined, e.g. the responder is unavailable.
+		SoftFail bool   `json:"softFail,omitempty" jsonschema:"omitempty"`
+		Timeout  string `json:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+
+	// ClientAuth authenticates and authorizes clients by their TLS
+	// certificates.
+	ClientAuth struct {
+		spec    *Spec
+		roots   *x509.CertPool
+		revoked map[string]map[string]struct{}
+		ocsp    *ocspChecker
+		rules   []*Rule
+		cache   *lru.Cache
+	}
+
+	// Identity is the identity of a verified client.
+	Identity struct {
+		Subject      string   `json:"subject"`
+		Issuer       string   `json:"issuer"`
+		CommonName   string   `json:"commonName"`
+		SerialNumber string   `json:"serialNumber"`
+		DNSNames     []string `json:"dnsNames,omitempty"`
+		URIs         []string `json:"uris,omitempty"`
+		SPIFFEID     string   `json:"spiffeID,omitempty"`
+		// Fingerprint is the hex encoded SHA-256 of the certificate.
+		Fingerprint string `json:"fingerprint"`
+	}
+
+	cacheEntry struct {
+		err      error
+		expireAt time.Time
+	}
+)
+
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	if spec.Mode == ModeNone {
+		return nil
+	}
+
+	if len(spec.CACerts) == 0 {
+		return fmt.Errorf("caCerts is required when mode is %s", spec.Mode)
+	}
+	if _, err := certPool(spec.CACerts); err != nil {
+		return err
+	}
+	if _, err := parseCRLs(spec.CRLs); err != nil {
+		return err
+	}
+	if spec.OCSP != nil && spec.OCSP.Timeout != "" {
+		if _, err := time.ParseDuration(spec.OCSP.Timeout); err != nil {
+			return fmt.Errorf("invalid ocsp timeout: %v", err)
+		}
+	}
+	return nil
+}
+
+// Active returns whether client certificates should be requested.
+func (spec *Spec) Active() bool {
+	return spec != nil && spec.Mode != ModeNone
+}
+
+// New creates a ClientAuth, it returns nil if spec is nil.
+func New(spec *Spec) *ClientAuth {
+	if spec == nil {
+		return nil
+	}
+
+	ca := &ClientAuth{spec: spec, rules: spec.Rules}
+	if spec.Mode == ModeNone {
+		return ca
+	}
+
+	// errors have been checked in Validate.
+	ca.roots, _ = certPool(spec.CACerts)
+	ca.revoked, _ = parseCRLs(spec.CRLs)
+	if spec.OCSP != nil {
+		ca.ocsp = newOCSPChecker(spec.OCSP)
+	}
+	for _, r := range ca.rules {
+		r.init()
+	}
+	ca.cache, _ = lru.New(cacheSize)
+	return ca
+}
+
+func certPool(certs []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for i, c := range certs {
+		if !pool.AppendCertsFromPEM(tlsutil.DecodePEM(c)) {
+			return nil, fmt.Errorf("invalid CA certificate at index %d", i)
+		}
+	}
+	return pool, nil
+}
+
+// parseCRLs parses the CRLs, and returns the serial numbers of the revoked
+// certificates grouped by the raw issuer.
+func parseCRLs(crls []string) (map[string]map[string]struct{}, error) {
+	revoked := map[string]map[string]struct{}{}
+	for i, c := range crls {
+		data := tlsutil.DecodePEM(c)
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CRL at index %d: %v", i, err)
+		}
+
+		issuer := string(crl.RawIssuer)
+		serials := revoked[issuer]
+		if serials == nil {
+			serials = map[string]struct{}{}
+			revoked[issuer] = serials
+		}
+		for _, rc := range crl.RevokedCertificates {
+			serials[rc.SerialNumber.String()] = struct{}{}
+		}
+	}
+	return revoked, nil
+}
+
+// Authenticate authenticates and authorizes the client of a TLS connection.
+// It returns the identity of the client if it is verified, or an error if
+// the request should be rejected.
+func (ca *ClientAuth) Authenticate(ctx context.Context, state *tls.ConnectionState) (*Identity, error) {
+	if ca == nil || ca.spec.Mode == ModeNone {
+		return nil, nil
+	}
+
+	var certs []*x509.Certificate
+	if state != nil {
+		certs = state.PeerCertificates
+	}
+	if len(certs) == 0 {
+		if ca.spec.Mode == ModeRequired {
+			return nil, ErrNoCertificate
+		}
+		return nil, nil
+	}
+
+	leaf := certs[0]
+	sum := sha256.Sum256(leaf.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	err := ca.verify(ctx, certs, fingerprint)
+	if err == nil {
+		err = ca.authorize(leaf, fingerprint)
+	}
+	if err != nil {
+		if ca.spec.Mode == ModeOptional {
+			logger.Debugf("ignore invalid client certificate %s: %v", leaf.Subject, err)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return newIdentity(leaf, fingerprint), nil
+}
+
+// verify verifies the certificate chain and the revocation status of the
+// client certificate, the result is cached by the fingerprint.
+func (ca *ClientAuth) verify(ctx context.Context, certs []*x509.Certificate, fingerprint string) error {
+	now := time.Now()
+	if v, ok := ca.cache.Get(fingerprint); ok {
+		entry := v.(*cacheEntry)
+		if now.Before(entry.expireAt) {
+			return entry.err
+		}
+		ca.cache.Remove(fingerprint)
+	}
+
+	leaf := certs[0]
+	opts := x509.VerifyOptions{
+		Roots:         ca.roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	expireAt := now.Add(cacheTTL)
+	if leaf.NotAfter.Before(expireAt) {
+		expireAt = leaf.NotAfter
+	}
+
+	chains, err := leaf.Verify(opts)
+	if err == nil {
+		err = ca.checkCRL(chains[0])
+	}
+	if err == nil && ca.ocsp != nil && len(chains[0]) > 1 {
+		var nextUpdate time.Time
+		nextUpdate, err = ca.ocsp.check(ctx, leaf, chains[0][1])
+		// don't cache the result if the status can't be determined.
+		if err != nil && err != ErrRevoked {
+			return err
+		}
+		if !nextUpdate.IsZero() && nextUpdate.Before(expireAt) {
+			expireAt = nextUpdate
+		}
+	}
+
+	ca.cache.Add(fingerprint, &cacheEntry{err: err, expireAt: expireAt})
+	return err
+}
+
+// checkCRL checks all certificates in the chain except the root.
+func (ca *ClientAuth) checkCRL(chain []*x509.Certificate) error {
+	for _, c := range chain[:len(chain)-1] {
+		if serials := ca.revoked[string(c.RawIssuer)]; serials != nil {
+			if _, ok := serials[c.SerialNumber.String()]; ok {
+				return ErrRevoked
+			}
+		}
+	}
+	return nil
+}
+
+func (ca *ClientAuth) authorize(leaf *x509.Certificate, fingerprint string) error {
+	if len(ca.rules) == 0 {
+		return nil
+	}
+	for _, r := range ca.rules {
+		if r.match(leaf, fingerprint) {
+			return nil
+		}
+	}
+	return ErrUnauthorized
+}
+
+func newIdentity(leaf *x509.Certificate, fingerprint string) *Identity {
+	id := &Identity{
+		Subject:      leaf.Subject.String(),
+		Issuer:       leaf.Issuer.String(),
+		CommonName:   leaf.Subject.CommonName,
+		SerialNumber: leaf.SerialNumber.String(),
+		DNSNames:     leaf.DNSNames,
+		Fingerprint:  fingerprint,
+	}
+	for _, u := range leaf.URIs {
+		id.URIs = append(id.URIs, u.String())
+		if id.SPIFFEID == "" && u.Scheme == "spiffe" {
+			id.SPIFFEID = u.String()
+		}
+	}
+	return id
+}
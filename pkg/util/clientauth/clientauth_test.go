@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clientauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func issueClientCert(ca *tlsutiltest.CA, cn string, modify func(tmpl *x509.Certificate)) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if modify != nil {
+		modify(tmpl)
+	}
+	cert, _, _ := ca.Issue(tmpl)
+	return cert
+}
+
+func connState(certs ...*x509.Certificate) *tls.ConnectionState {
+	return &tls.ConnectionState{PeerCertificates: certs}
+}
+
+func TestSpecValidate(t *testing.T) {
+	at := assert.New(t)
+
+	ca := tlsutiltest.NewCA("test")
+	spec := &Spec{Mode: ModeNone}
+	at.NoError(spec.Validate())
+	at.False(spec.Active())
+	at.False((*Spec)(nil).Active())
+
+	spec.Mode = ModeRequired
+	at.True(spec.Active())
+	at.Error(spec.Validate())
+
+	spec.CACerts = []string{"invalid"}
+	at.Error(spec.Validate())
+	spec.CACerts = []string{tlsutiltest.Base64(ca.CertPEM())}
+	at.NoError(spec.Validate())
+	spec.CACerts = []string{string(ca.CertPEM())}
+	at.NoError(spec.Validate())
+
+	spec.CRLs = []string{"invalid"}
+	at.Error(spec.Validate())
+	spec.CRLs = []string{string(ca.NewCRL())}
+	at.NoError(spec.Validate())
+
+	spec.OCSP = &OCSPSpec{Timeout: "invalid"}
+	at.Error(spec.Validate())
+	spec.OCSP.Timeout = "1s"
+	at.NoError(spec.Validate())
+}
+
+func TestAuthenticate(t *testing.T) {
+	at := assert.New(t)
+	ctx := context.Background()
+
+	ca := tlsutiltest.NewCA("test")
+	other := tlsutiltest.NewCA("other")
+	valid := issueClientCert(ca, "client", func(tmpl *x509.Certificate) {
+		u, _ := url.Parse("spiffe://example.org/ns/default/sa/web")
+		tmpl.URIs = []*url.URL{u}
+		tmpl.DNSNames = []string{"web.example.org"}
+	})
+	untrusted := issueClientCert(other, "client", nil)
+	serverOnly := issueClientCert(ca, "server", func(tmpl *x509.Certificate) {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+
+	var nilAuth *ClientAuth
+	id, err := nilAuth.Authenticate(ctx, connState(valid))
+	at.Nil(id)
+	at.NoError(err)
+
+	id, err = New(&Spec{Mode: ModeNone}).Authenticate(ctx, connState(valid))
+	at.Nil(id)
+	at.NoError(err)
+
+	newAuth := func(mode string) *ClientAuth {
+		return New(&Spec{Mode: mode, CACerts: []string{string(ca.CertPEM())}})
+	}
+
+	cases := []struct {
+		mode     string
+		state    *tls.ConnectionState
+		err      bool
+		identity bool
+	}{
+		{ModeOptional, nil, false, false},
+		{ModeOptional, connState(valid), false, true},
+		{ModeOptional, connState(untrusted), false, false},
+		{ModeVerifyIfGiven, connState(), false, false},
+		{ModeVerifyIfGiven, connState(valid), false, true},
+		{ModeVerifyIfGiven, connState(untrusted), true, false},
+		{ModeRequired, connState(), true, false},
+		{ModeRequired, connState(valid), false, true},
+		{ModeRequired, connState(untrusted), true, false},
+		{ModeRequired, connState(serverOnly), true, false},
+	}
+	for i, c := range cases {
+		id, err := newAuth(c.mode).Authenticate(ctx, c.state)
+		at.Equal(c.err, err != nil, "case %d", i)
+		at.Equal(c.identity, id != nil, "case %d", i)
+	}
+
+	_, err = newAuth(ModeRequired).Authenticate(ctx, nil)
+	at.Equal(ErrNoCertificate, err)
+
+	id, err = newAuth(ModeRequired).Authenticate(ctx, connState(valid))
+	at.NoError(err)
+	at.Equal("client", id.CommonName)
+	at.Equal("spiffe://example.org/ns/default/sa/web", id.SPIFFEID)
+	at.Equal([]string{"web.example.org"}, id.DNSNames)
+	at.Len(id.Fingerprint, 64)
+
+	// authorization
+	auth := New(&Spec{
+		Mode:    ModeRequired,
+		CACerts: []string{string(ca.CertPEM())},
+		Rules: []*Rule{
+			{SPIFFEIDs: []string{"spiffe://example.org/ns/prod/*"}},
+			{CommonNames: []string{"admin"}},
+		},
+	})
+	_, err = auth.Authenticate(ctx, connState(valid))
+	at.Equal(ErrUnauthorized, err)
+	auth.rules[0].SPIFFEIDs = []string{"spiffe://example.org/ns/default/*"}
+	_, err = auth.Authenticate(ctx, connState(valid))
+	at.NoError(err)
+}
+
+func TestCRL(t *testing.T) {
+	at := assert.New(t)
+	ctx := context.Background()
+
+	root := tlsutiltest.NewCA("root")
+	good := issueClientCert(root, "good", nil)
+	revoked := issueClientCert(root, "revoked", nil)
+
+	auth := New(&Spec{
+		Mode:    ModeRequired,
+		CACerts: []string{string(root.CertPEM())},
+		CRLs:    []string{tlsutiltest.Base64(root.NewCRL(revoked))},
+	})
+	_, err := auth.Authenticate(ctx, connState(good))
+	at.NoError(err)
+	_, err = auth.Authenticate(ctx, connState(revoked))
+	at.Equal(ErrRevoked, err)
+
+	// the result is cached.
+	_, err = auth.Authenticate(ctx, connState(revoked))
+	at.Equal(ErrRevoked, err)
+	at.Equal(2, auth.cache.Len())
+}
+
+func TestOCSP(t *testing.T) {
+	at := assert.New(t)
+	ctx := context.Background()
+
+	ca := tlsutiltest.NewCA("test")
+	var requests int32
+	var revokedSerial string
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if !at.NoError(err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		status := ocsp.Good
+		if req.SerialNumber.String() == revokedSerial {
+			status = ocsp.Revoked
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(ca.Cert(), ca.Cert(), ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now.Add(-time.Minute),
+			NextUpdate:   now.Add(time.Hour),
+			RevokedAt:    now.Add(-time.Minute),
+		}, ca.Key())
+		at.NoError(err)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+
+	withOCSP := func(url string) func(tmpl *x509.Certificate) {
+		return func(tmpl *x509.Certificate) {
+			tmpl.OCSPServer = []string{url}
+		}
+	}
+	good := issueClientCert(ca, "good", withOCSP(responder.URL))
+	revoked := issueClientCert(ca, "revoked", withOCSP(responder.URL))
+	revokedSerial = revoked.SerialNumber.String()
+	noResponder := issueClientCert(ca, "noResponder", nil)
+
+	spec := &Spec{
+		Mode:    ModeRequired,
+		CACerts: []string{string(ca.CertPEM())},
+		OCSP:    &OCSPSpec{},
+	}
+	auth := New(spec)
+	_, err := auth.Authenticate(ctx, connState(good))
+	at.NoError(err)
+	_, err = auth.Authenticate(ctx, connState(good))
+	at.NoError(err)
+	at.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	_, err = auth.Authenticate(ctx, connState(revoked))
+	at.Equal(ErrRevoked, err)
+	_, err = auth.Authenticate(ctx, connState(noResponder))
+	at.Error(err)
+
+	responder.Close()
+	offline := issueClientCert(ca, "offline", withOCSP(responder.URL))
+	_, err = auth.Authenticate(ctx, connState(offline))
+	at.Error(err)
+
+	spec.OCSP.SoftFail = true
+	auth = New(spec)
+	_, err = auth.Authenticate(ctx, connState(offline))
+	at.NoError(err)
+	_, err = auth.Authenticate(ctx, connState(noResponder))
+	at.NoError(err)
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clientauth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/megaease/easegress/pkg/util/tlsutil"
+	"golang.org/x/crypto/ocsp"
+)
+
+const defaultOCSPTimeout = 3 * time.Second
+
+type ocspChecker struct {
+	softFail bool
+	timeout  time.Duration
+	client   *http.Client
+}
+
+func newOCSPChecker(spec *OCSPSpec) *ocspChecker {
+	c := &ocspChecker{
+		softFail: spec.SoftFail,
+		timeout:  defaultOCSPTimeout,
+		client:   &http.Client{},
+	}
+	if spec.Timeout != "" {
+		c.timeout, _ = time.ParseDuration(spec.Timeout)
+	}
+	return c
+}
+
+// check checks the status of cert, and returns the time of the next update
+// of the status. Errors other than ErrRevoked are ignored in soft fail mode.
+func (c *ocspChecker) check(ctx context.Context, cert, issuer *x509.Certificate) (time.Time, error) {
+	nextUpdate, err := c.query(ctx, cert, issuer)
+	if err != nil && err != ErrRevoked && c.softFail {
+		return time.Time{}, nil
+	}
+	return nextUpdate, err
+}
+
+func (c *ocspChecker) query(ctx context.Context, cert, issuer *x509.Certificate) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	result, err := tlsutil.QueryOCSP(ctx, c.client, cert, issuer)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch result.Status {
+	case ocsp.Good:
+		return result.NextUpdate, nil
+	case ocsp.Revoked:
+		return result.NextUpdate, ErrRevoked
+	default:
+		return time.Time{}, fmt.Errorf("OCSP status of the client certificate is unknown")
+	}
+}
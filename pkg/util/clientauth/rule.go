@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clientauth
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/megaease/easegress/pkg/util/stringtool"
+)
+
+// Rule matches a client certificate, all of the non-empty fields must
+// match, and a field matches if any of its values matches.
+type Rule struct {
+	// DNSNames match the DNS names in the SAN, a value could be a
+	// wildcard like '*.example.com' which matches one label.
+	DNSNames []string `json:"dnsNames,omitempty" jsonschema:"omitempty"`
+	// URIs match the URIs in the SAN, a value ending with '*' matches
+	// by prefix.
+	URIs []string `json:"uris,omitempty" jsonschema:"omitempty"`
+	// SPIFFEIDs are like URIs, but only match the SPIFFE IDs, e.g.
+	// 'spiffe://example.org/ns/default/*'.
+	SPIFFEIDs []string `json:"spiffeIDs,omitempty" jsonschema:"omitempty"`
+
+	CommonNames         []string `json:"commonNames,omitempty" jsonschema:"omitempty"`
+	Organizations       []string `json:"organizations,omitempty" jsonschema:"omitempty"`
+	OrganizationalUnits []string `json:"organizationalUnits,omitempty" jsonschema:"omitempty"`
+
+	// Fingerprints are the hex encoded SHA-256 of the certificates, the
+	// bytes could be separated by ':'.
+	Fingerprints []string `json:"fingerprints,omitempty" jsonschema:"omitempty"`
+
+	fingerprints []string
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+}
+
+// Validate validates Rule.
+func (r *Rule) Validate() error {
+	if len(r.DNSNames) == 0 && len(r.URIs) == 0 && len(r.SPIFFEIDs) == 0 &&
+		len(r.CommonNames) == 0 && len(r.Organizations) == 0 &&
+		len(r.OrganizationalUnits) == 0 && len(r.Fingerprints) == 0 {
+		return fmt.Errorf("empty rule")
+	}
+	for _, id := range r.SPIFFEIDs {
+		if !strings.HasPrefix(id, "spiffe://") {
+			return fmt.Errorf("invalid SPIFFE ID %s", id)
+		}
+	}
+	for _, fp := range r.Fingerprints {
+		fp = normalizeFingerprint(fp)
+		if len(fp) != 64 || strings.Trim(fp, "0123456789abcdef") != "" {
+			return fmt.Errorf("invalid SHA-256 fingerprint %s", fp)
+		}
+	}
+	return nil
+}
+
+func (r *Rule) init() {
+	r.fingerprints = make([]string, len(r.Fingerprints))
+	for i, fp := range r.Fingerprints {
+		r.fingerprints[i] = normalizeFingerprint(fp)
+	}
+}
+
+func (r *Rule) match(leaf *x509.Certificate, fingerprint string) bool {
+	if len(r.DNSNames) > 0 && !anyMatch(r.DNSNames, leaf.DNSNames, matchDNSName) {
+		return false
+	}
+
+	if len(r.URIs) > 0 || len(r.SPIFFEIDs) > 0 {
+		var uris, spiffeIDs []string
+		for _, u := range leaf.URIs {
+			uris = append(uris, u.String())
+			if u.Scheme == "spiffe" {
+				spiffeIDs = append(spiffeIDs, u.String())
+			}
+		}
+		if len(r.URIs) > 0 && !anyMatch(r.URIs, uris, matchURI) {
+			return false
+		}
+		if len(r.SPIFFEIDs) > 0 && !anyMatch(r.SPIFFEIDs, spiffeIDs, matchURI) {
+			return false
+		}
+	}
+
+	subject := leaf.Subject
+	if len(r.CommonNames) > 0 && !stringtool.StrInSlice(subject.CommonName, r.CommonNames) {
+		return false
+	}
+	if len(r.Organizations) > 0 && !anyMatch(r.Organizations, subject.Organization, matchExact) {
+		return false
+	}
+	if len(r.OrganizationalUnits) > 0 && !anyMatch(r.OrganizationalUnits, subject.OrganizationalUnit, matchExact) {
+		return false
+	}
+
+	if len(r.fingerprints) > 0 && !stringtool.StrInSlice(fingerprint, r.fingerprints) {
+		return false
+	}
+
+	return true
+}
+
+func anyMatch(patterns, values []string, match func(pattern, value string) bool) bool {
+	for _, p := range patterns {
+		for _, v := range values {
+			if match(p, v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchExact(pattern, value string) bool {
+	return pattern == value
+}
+
+func matchDNSName(pattern, value string) bool {
+	pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == value
+	}
+	i := strings.IndexByte(value, '.')
+	return i > 0 && value[i:] == pattern[1:]
+}
+
+func matchURI(pattern, value string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, pattern[:len(pattern)-1])
+	}
+	return pattern == value
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clientauth
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleValidate(t *testing.T) {
+	at := assert.New(t)
+
+	r := &Rule{}
+	at.Error(r.Validate())
+
+	r.SPIFFEIDs = []string{"https://example.org"}
+	at.Error(r.Validate())
+	r.SPIFFEIDs = []string{"spiffe://example.org/*"}
+	at.NoError(r.Validate())
+
+	r.Fingerprints = []string{"abc"}
+	at.Error(r.Validate())
+	r.Fingerprints = []string{strings.Repeat("AB:", 31) + "AB"}
+	at.NoError(r.Validate())
+}
+
+func TestRuleMatch(t *testing.T) {
+	at := assert.New(t)
+
+	spiffe, _ := url.Parse("spiffe://example.org/ns/default/sa/web")
+	other, _ := url.Parse("https://partner.example.com/id/42")
+	cert := &x509.Certificate{
+		Raw: []byte("certificate"),
+		Subject: pkix.Name{
+			CommonName:         "web",
+			Organization:       []string{"MegaEase"},
+			OrganizationalUnit: []string{"Dev", "Ops"},
+		},
+		DNSNames: []string{"web.example.org"},
+		URIs:     []*url.URL{other, spiffe},
+	}
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	cases := []struct {
+		rule  *Rule
+		match bool
+	}{
+		{&Rule{DNSNames: []string{"web.example.org"}}, true},
+		{&Rule{DNSNames: []string{"*.EXAMPLE.org"}}, true},
+		{&Rule{DNSNames: []string{"*.org"}}, false},
+		{&Rule{URIs: []string{"https://partner.example.com/id/*"}}, true},
+		{&Rule{URIs: []string{"https://partner.example.com/id/4"}}, false},
+		{&Rule{SPIFFEIDs: []string{"spiffe://example.org/ns/default/sa/web"}}, true},
+		{&Rule{SPIFFEIDs: []string{"spiffe://example.org/*"}}, true},
+		{&Rule{SPIFFEIDs: []string{"spiffe://partner.example.com/*"}}, false},
+		{&Rule{CommonNames: []string{"api", "web"}}, true},
+		{&Rule{CommonNames: []string{"api"}}, false},
+		{&Rule{Organizations: []string{"MegaEase"}, OrganizationalUnits: []string{"Ops"}}, true},
+		{&Rule{Organizations: []string{"MegaEase"}, OrganizationalUnits: []string{"QA"}}, false},
+		{&Rule{Fingerprints: []string{strings.ToUpper(fingerprint)}}, true},
+		{&Rule{Fingerprints: []string{strings.Repeat("0", 64)}}, false},
+		{&Rule{CommonNames: []string{"web"}, Fingerprints: []string{strings.Repeat("0", 64)}}, false},
+	}
+	for i, c := range cases {
+		c.rule.init()
+		at.Equal(c.match, c.rule.match(cert, fingerprint), "case %d", i)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kafkahelper provides the common configurations of Kafka clients.
+package kafkahelper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+type (
+	// ClientSpec is the spec of the connection to Kafka, which is shared
+	// by producers and consumers.
+	ClientSpec struct {
+		// KafkaVersion is the version of Kafka, default is 1.0.0
+		KafkaVersion string `json:"kafkaVersion,omitempty" jsonschema:"omitempty"`
+		TLS          *TLS   `json:"tls,omitempty" jsonschema:"omitempty"`
+		SASL         *SASL  `json:"sasl,omitempty" jsonschema:"omitempty"`
+	}
+
+	// TLS is the TLS configuration of the connection to Kafka.
+	TLS struct {
+		CACertBase64       string `json:"caCertBase64,omitempty" jsonschema:"omitempty,format=base64"`
+		CertBase64         string `json:"certBase64,omitempty" jsonschema:"omitempty,format=base64"`
+		KeyBase64          string `json:"keyBase64,omitempty" jsonschema:"omitempty,format=base64"`
+		InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty" jsonschema:"omitempty"`
+	}
+
+	// SASL is the SASL authentication of the connection to Kafka.
+	SASL struct {
+		Mechanism string `json:"mechanism" jsonschema:"required,enum=PLAIN,enum=SCRAM-SHA-256,enum=SCRAM-SHA-512"`
+		Username  string `json:"username" jsonschema:"required"`
+		Password  string `json:"password" jsonschema:"required"`
+	}
+
+	// ProducerSpec is the spec of Kafka producers.
+	ProducerSpec struct {
+		ClientSpec `json:",inline"`
+
+		Compression  string `json:"compression,omitempty" jsonschema:"omitempty,enum=,enum=none,enum=gzip,enum=snappy,enum=lz4,enum=zstd"`
+		RequiredAcks string `json:"requiredAcks,omitempty" jsonschema:"omitempty,enum=,enum=none,enum=leader,enum=all"`
+		// Idempotent makes sure a message is written exactly once, it
+		// requires all acks and Kafka 0.11.0 or later.
+		Idempotent  bool   `json:"idempotent,omitempty" jsonschema:"omitempty"`
+		Partitioner string `json:"partitioner,omitempty" jsonschema:"omitempty,enum=,enum=hash,enum=random,enum=roundRobin"`
+		// Sync waits for the acks of messages, and the failures are returned
+		// to the pipeline.
+		Sync bool `json:"sync,omitempty" jsonschema:"omitempty"`
+		// Timeout is the max time to wait for the acks, default is 10s
+		Timeout string `json:"timeout,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+)
+
+var compressionCodecs = map[string]sarama.CompressionCodec{
+	"":       sarama.CompressionNone,
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+var requiredAcks = map[string]sarama.RequiredAcks{
+	"":       sarama.WaitForLocal,
+	"none":   sarama.NoResponse,
+	"leader": sarama.WaitForLocal,
+	"all":    sarama.WaitForAll,
+}
+
+var partitioners = map[string]sarama.PartitionerConstructor{
+	"":           sarama.NewHashPartitioner,
+	"hash":       sarama.NewHashPartitioner,
+	"random":     sarama.NewRandomPartitioner,
+	"roundRobin": sarama.NewRoundRobinPartitioner,
+}
+
+// Validate validates the ClientSpec.
+func (spec *ClientSpec) Validate() error {
+	if spec.KafkaVersion != "" {
+		if _, err := sarama.ParseKafkaVersion(spec.KafkaVersion); err != nil {
+			return err
+		}
+	}
+	if spec.TLS != nil {
+		if _, err := spec.TLS.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	if spec.SASL != nil {
+		switch spec.SASL.Mechanism {
+		case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		default:
+			return fmt.Errorf("unsupported sasl mechanism %s", spec.SASL.Mechanism)
+		}
+	}
+	return nil
+}
+
+// Validate validates the ProducerSpec.
+func (spec *ProducerSpec) Validate() error {
+	if err := spec.ClientSpec.Validate(); err != nil {
+		return err
+	}
+	if _, ok := compressionCodecs[spec.Compression]; !ok {
+		return fmt.Errorf("unsupported compression %s", spec.Compression)
+	}
+	if _, ok := requiredAcks[spec.RequiredAcks]; !ok {
+		return fmt.Errorf("unsupported requiredAcks %s", spec.RequiredAcks)
+	}
+	if spec.Idempotent && spec.RequiredAcks != "" && spec.RequiredAcks != "all" {
+		return fmt.Errorf("idempotent producer requires all acks")
+	}
+	if _, ok := partitioners[spec.Partitioner]; !ok {
+		return fmt.Errorf("unsupported partitioner %s", spec.Partitioner)
+	}
+	if spec.Timeout != "" {
+		if _, err := time.ParseDuration(spec.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TLS) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CACertBase64 != "" {
+		caCert, err := base64.StdEncoding.DecodeString(t.CACertBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ca cert: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("invalid ca cert: no certificate found")
+		}
+		config.RootCAs = pool
+	}
+	if t.CertBase64 != "" || t.KeyBase64 != "" {
+		cert, err := base64.StdEncoding.DecodeString(t.CertBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert: %v", err)
+		}
+		key, err := base64.StdEncoding.DecodeString(t.KeyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key: %v", err)
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert and key: %v", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// Apply applies the ClientSpec to the sarama config.
+func (spec *ClientSpec) Apply(config *sarama.Config) error {
+	config.Version = sarama.V1_0_0_0
+	if spec.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(spec.KafkaVersion)
+		if err != nil {
+			return err
+		}
+		config.Version = version
+	}
+
+	if spec.TLS != nil {
+		tlsConfig, err := spec.TLS.tlsConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if spec.SASL != nil {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sarama.SASLMechanism(spec.SASL.Mechanism)
+		config.Net.SASL.User = spec.SASL.Username
+		config.Net.SASL.Password = spec.SASL.Password
+		if spec.SASL.Mechanism != sarama.SASLTypePlaintext {
+			config.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClient(spec.SASL.Mechanism)
+		}
+	}
+	return nil
+}
+
+// NewConfig returns the sarama config of the producer.
+func (spec *ProducerSpec) NewConfig(clientID string) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = clientID
+	if err := spec.ClientSpec.Apply(config); err != nil {
+		return nil, err
+	}
+
+	config.Producer.Compression = compressionCodecs[spec.Compression]
+	config.Producer.RequiredAcks = requiredAcks[spec.RequiredAcks]
+	config.Producer.Partitioner = partitioners[spec.Partitioner]
+	if spec.Timeout != "" {
+		timeout, err := time.ParseDuration(spec.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		config.Producer.Timeout = timeout
+	}
+	if spec.Idempotent {
+		config.Producer.Idempotent = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Net.MaxOpenRequests = 1
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+	}
+	if spec.Sync {
+		config.Producer.Return.Successes = true
+	}
+	return config, nil
+}
+
+// JSONField returns the value of the field in the JSON data as a string,
+// the path of nested fields is separated by dots, like "device.id".
+func JSONField(data []byte, path string) (string, bool) {
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", false
+	}
+	for _, field := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = m[field]; !ok {
+			return "", false
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number, bool:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
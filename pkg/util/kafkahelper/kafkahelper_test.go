@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkahelper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProducerSpec(t *testing.T) {
+	assert := assert.New(t)
+
+	spec := &ProducerSpec{}
+	assert.Nil(spec.Validate())
+	config, err := spec.NewConfig("test")
+	assert.Nil(err)
+	assert.Equal("test", config.ClientID)
+	assert.Equal(sarama.V1_0_0_0, config.Version)
+	assert.Equal(sarama.WaitForLocal, config.Producer.RequiredAcks)
+	assert.False(config.Net.TLS.Enable)
+	assert.False(config.Net.SASL.Enable)
+
+	spec = &ProducerSpec{
+		ClientSpec: ClientSpec{
+			KafkaVersion: "2.8.0",
+			TLS:          &TLS{InsecureSkipVerify: true},
+			SASL: &SASL{
+				Mechanism: sarama.SASLTypeSCRAMSHA512,
+				Username:  "user",
+				Password:  "pencil",
+			},
+		},
+		Compression: "zstd",
+		Idempotent:  true,
+		Partitioner: "roundRobin",
+		Sync:        true,
+		Timeout:     "3s",
+	}
+	assert.Nil(spec.Validate())
+	config, err = spec.NewConfig("test")
+	assert.Nil(err)
+	assert.Equal(sarama.V2_8_0_0, config.Version)
+	assert.True(config.Net.TLS.Enable)
+	assert.True(config.Net.TLS.Config.InsecureSkipVerify)
+	assert.True(config.Net.SASL.Enable)
+	assert.Equal(sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA512), config.Net.SASL.Mechanism)
+	assert.NotNil(config.Net.SASL.SCRAMClientGeneratorFunc)
+	assert.Equal(sarama.CompressionZSTD, config.Producer.Compression)
+	assert.Equal(sarama.WaitForAll, config.Producer.RequiredAcks)
+	assert.Equal(1, config.Net.MaxOpenRequests)
+	assert.True(config.Producer.Idempotent)
+	assert.True(config.Producer.Return.Successes)
+	assert.Equal(3*time.Second, config.Producer.Timeout)
+
+	// idempotent producer raises the version
+	spec = &ProducerSpec{ClientSpec: ClientSpec{KafkaVersion: "0.10.2.0"}, Idempotent: true}
+	config, err = spec.NewConfig("test")
+	assert.Nil(err)
+	assert.Equal(sarama.V0_11_0_0, config.Version)
+
+	invalids := []*ProducerSpec{
+		{ClientSpec: ClientSpec{KafkaVersion: "abc"}},
+		{ClientSpec: ClientSpec{TLS: &TLS{CACertBase64: "abc"}}},
+		{ClientSpec: ClientSpec{TLS: &TLS{CertBase64: "YWJj", KeyBase64: "YWJj"}}},
+		{ClientSpec: ClientSpec{SASL: &SASL{Mechanism: "GSSAPI"}}},
+		{Compression: "brotli"},
+		{RequiredAcks: "some"},
+		{RequiredAcks: "leader", Idempotent: true},
+		{Partitioner: "sticky"},
+		{Timeout: "3"},
+	}
+	for _, spec := range invalids {
+		assert.NotNil(spec.Validate(), "%+v", spec)
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	assert := assert.New(t)
+
+	// test vector of RFC 7677
+	c := newSCRAMClient(sarama.SASLTypeSCRAMSHA256)().(*scramClient)
+	assert.Nil(c.Begin("user", "pencil", ""))
+	c.clientNonce = "rOprNGfwEbeRWgbNEkqO"
+
+	msg, err := c.Step("")
+	assert.Nil(err)
+	assert.Equal("n,,n=user,r=rOprNGfwEbeRWgbNEkqO", msg)
+	assert.False(c.Done())
+
+	msg, err = c.Step("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	assert.Nil(err)
+	assert.Equal("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", msg)
+
+	_, err = c.Step("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+	assert.Nil(err)
+	assert.True(c.Done())
+
+	// wrong server signature
+	assert.Nil(c.Begin("user", "pencil", ""))
+	c.clientNonce = "rOprNGfwEbeRWgbNEkqO"
+	c.Step("")
+	c.Step("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	_, err = c.Step("v=AAAA")
+	assert.NotNil(err)
+
+	// server nonce must start with client nonce
+	assert.Nil(c.Begin("user", "pencil", ""))
+	c.Step("")
+	_, err = c.Step("r=abc,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	assert.NotNil(err)
+
+	// server error
+	assert.Nil(c.Begin("user", "pencil", ""))
+	c.Step("")
+	_, err = c.Step("e=unknown-user")
+	assert.NotNil(err)
+}
+
+func TestJSONField(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte(`{"id": "abc", "device": {"id": 12345678901234567890, "online": true, "tags": ["a"]}}`)
+	tests := []struct {
+		path  string
+		value string
+		ok    bool
+	}{
+		{"id", "abc", true},
+		{"device.id", "12345678901234567890", true},
+		{"device.online", "true", true},
+		{"device.tags", "", false},
+		{"device.name", "", false},
+		{"id.name", "", false},
+	}
+	for _, tt := range tests {
+		value, ok := JSONField(data, tt.path)
+		assert.Equal(tt.value, value, tt.path)
+		assert.Equal(tt.ok, ok, tt.path)
+	}
+
+	_, ok := JSONField([]byte("not json"), "id")
+	assert.False(ok)
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kafkahelper
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramClient is the client of SCRAM (RFC 5802) authentication, which is
+// required by sarama to support SASL/SCRAM.
+type scramClient struct {
+	newHash func() hash.Hash
+
+	userName string
+	password string
+	authzID  string
+
+	step            int
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+	done            bool
+}
+
+var _ sarama.SCRAMClient = (*scramClient)(nil)
+
+func newSCRAMClient(mechanism string) func() sarama.SCRAMClient {
+	newHash := sha256.New
+	if mechanism == sarama.SASLTypeSCRAMSHA512 {
+		newHash = sha512.New
+	}
+	return func() sarama.SCRAMClient {
+		return &scramClient{newHash: newHash}
+	}
+}
+
+// Begin prepares the client for the SCRAM exchange.
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	c.userName = userName
+	c.password = password
+	c.authzID = authzID
+	c.clientNonce = base64.RawStdEncoding.EncodeToString(nonce)
+	c.step = 0
+	c.done = false
+	return nil
+}
+
+// Step steps the client through the SCRAM exchange.
+func (c *scramClient) Step(challenge string) (string, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.clientFirst(), nil
+	case 2:
+		return c.clientFinal(challenge)
+	case 3:
+		c.done = true
+		return "", c.verifyServerFinal(challenge)
+	default:
+		return "", fmt.Errorf("unexpected scram step %d", c.step)
+	}
+}
+
+// Done returns true when the SCRAM exchange is over.
+func (c *scramClient) Done() bool {
+	return c.done
+}
+
+func (c *scramClient) gs2Header() string {
+	if c.authzID == "" {
+		return "n,,"
+	}
+	return "n,a=" + escapeSCRAMName(c.authzID) + ","
+}
+
+func (c *scramClient) clientFirst() string {
+	c.clientFirstBare = "n=" + escapeSCRAMName(c.userName) + ",r=" + c.clientNonce
+	return c.gs2Header() + c.clientFirstBare
+}
+
+func (c *scramClient) clientFinal(serverFirst string) (string, error) {
+	attrs := parseSCRAMAttributes(serverFirst)
+	if e, ok := attrs["e"]; ok {
+		return "", fmt.Errorf("scram server error: %s", e)
+	}
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return "", fmt.Errorf("invalid scram server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return "", fmt.Errorf("invalid scram salt")
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return "", fmt.Errorf("invalid scram iteration count")
+	}
+
+	h := c.newHash()
+	saltedPassword := pbkdf2.Key([]byte(c.password), salt, iterations, h.Size(), c.newHash)
+	clientKey := c.hmac(saltedPassword, []byte("Client Key"))
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(c.gs2Header())) + ",r=" + nonce
+	authMessage := []byte(c.clientFirstBare + "," + serverFirst + "," + withoutProof)
+	clientSignature := c.hmac(storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	serverKey := c.hmac(saltedPassword, []byte("Server Key"))
+	c.serverSignature = c.hmac(serverKey, authMessage)
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	attrs := parseSCRAMAttributes(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("scram server error: %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(signature, c.serverSignature) {
+		return fmt.Errorf("invalid scram server signature")
+	}
+	return nil
+}
+
+func (c *scramClient) hmac(key, data []byte) []byte {
+	mac := hmac.New(c.newHash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func escapeSCRAMName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+func parseSCRAMAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attrs[field[:1]] = field[2:]
+		}
+	}
+	return attrs
+}
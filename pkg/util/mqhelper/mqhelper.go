@@ -0,0 +1,149 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package mqhelper provides the common parts of the filters which publish
+// HTTP requests to message queues.
+package mqhelper
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+type (
+	// TopicSpec defines ways to get the topic (or subject, stream, routing
+	// key) of messages, the dynamic one has higher priority.
+	TopicSpec struct {
+		Default string       `json:"default" jsonschema:"required"`
+		Dynamic *DynamicSpec `json:"dynamic,omitempty" jsonschema:"omitempty"`
+	}
+
+	// DynamicSpec defines dynamic ways to get the topic from HTTP requests.
+	DynamicSpec struct {
+		Header string `json:"header" jsonschema:"required"`
+	}
+
+	// Pool shares connections among filter instances, connections are keyed
+	// by their configurations, and are closed when released by all users.
+	Pool struct {
+		mutex sync.Mutex
+		conns map[string]*pooledConn
+	}
+
+	pooledConn struct {
+		conn io.Closer
+		refs int
+		// ready is closed when the connection is created, err is the
+		// error of the creation.
+		ready chan struct{}
+		err   error
+	}
+)
+
+// Topic returns the topic of the HTTP request.
+func (spec *TopicSpec) Topic(header http.Header) string {
+	if spec.Dynamic != nil {
+		if topic := header.Get(spec.Dynamic.Header); topic != "" {
+			return topic
+		}
+	}
+	return spec.Default
+}
+
+// Properties maps the HTTP headers to message properties, keys of the
+// mapping are names of HTTP headers, and values are names of properties.
+// Headers not in the request are ignored.
+func Properties(header http.Header, mapping map[string]string) map[string]string {
+	if len(mapping) == 0 {
+		return nil
+	}
+	props := make(map[string]string, len(mapping))
+	for h, p := range mapping {
+		if v := header.Get(h); v != "" {
+			props[p] = v
+		}
+	}
+	return props
+}
+
+// NewPool creates a Pool.
+func NewPool() *Pool {
+	return &Pool{conns: make(map[string]*pooledConn)}
+}
+
+// Get returns the connection of the key, the connection is created by
+// create if it doesn't exist. Every successful Get should be paired with
+// a Put.
+//
+// create is called without holding the lock of the pool, so creating a
+// connection doesn't block the users of other keys, and concurrent users
+// of the same key wait for the creation.
+func (p *Pool) Get(key string, create func() (io.Closer, error)) (io.Closer, error) {
+	p.mutex.Lock()
+	if pc, ok := p.conns[key]; ok {
+		pc.refs++
+		p.mutex.Unlock()
+
+		<-pc.ready
+		if pc.err != nil {
+			return nil, pc.err
+		}
+		return pc.conn, nil
+	}
+
+	pc := &pooledConn{refs: 1, ready: make(chan struct{})}
+	p.conns[key] = pc
+	p.mutex.Unlock()
+
+	conn, err := create()
+
+	p.mutex.Lock()
+	if err != nil {
+		// the waiters get the error too, and they don't Put the key.
+		delete(p.conns, key)
+	}
+	pc.conn, pc.err = conn, err
+	p.mutex.Unlock()
+	close(pc.ready)
+
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Put releases the connection of the key, the connection is closed if it
+// is not used anymore.
+func (p *Pool) Put(key string) error {
+	p.mutex.Lock()
+	pc, ok := p.conns[key]
+	if !ok {
+		p.mutex.Unlock()
+		return fmt.Errorf("connection not found in pool")
+	}
+	pc.refs--
+	if pc.refs > 0 {
+		p.mutex.Unlock()
+		return nil
+	}
+	delete(p.conns, key)
+	p.mutex.Unlock()
+
+	return pc.conn.Close()
+}
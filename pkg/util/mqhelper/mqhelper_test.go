@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package mqhelper
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockConn struct {
+	closed int
+}
+
+func (c *mockConn) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	header := http.Header{}
+	header.Set("X-Topic", "dynamic")
+
+	spec := &TopicSpec{Default: "default"}
+	assert.Equal("default", spec.Topic(header))
+
+	spec.Dynamic = &DynamicSpec{Header: "x-topic"}
+	assert.Equal("dynamic", spec.Topic(header))
+	assert.Equal("default", spec.Topic(http.Header{}))
+}
+
+func TestProperties(t *testing.T) {
+	assert := assert.New(t)
+
+	header := http.Header{}
+	header.Set("X-Request-Id", "123")
+	header.Set("Content-Type", "application/json")
+
+	assert.Nil(Properties(header, nil))
+	props := Properties(header, map[string]string{
+		"X-Request-Id": "requestID",
+		"Content-Type": "contentType",
+		"X-Not-Exist":  "notExist",
+	})
+	assert.Equal(map[string]string{"requestID": "123", "contentType": "application/json"}, props)
+}
+
+func TestPool(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewPool()
+	created := 0
+	create := func() (io.Closer, error) {
+		created++
+		return &mockConn{}, nil
+	}
+
+	c1, err := pool.Get("a", create)
+	assert.Nil(err)
+	c2, err := pool.Get("a", create)
+	assert.Nil(err)
+	assert.Same(c1, c2)
+	assert.Equal(1, created)
+
+	c3, err := pool.Get("b", create)
+	assert.Nil(err)
+	assert.NotSame(c1, c3)
+	assert.Equal(2, created)
+
+	assert.Nil(pool.Put("a"))
+	assert.Equal(0, c1.(*mockConn).closed)
+	assert.Nil(pool.Put("a"))
+	assert.Equal(1, c1.(*mockConn).closed)
+	assert.NotNil(pool.Put("a"))
+
+	_, err = pool.Get("c", func() (io.Closer, error) {
+		return nil, fmt.Errorf("mock error")
+	})
+	assert.NotNil(err)
+	assert.NotNil(pool.Put("c"))
+}
+
+func TestPoolConcurrentGet(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := NewPool()
+	release := make(chan struct{})
+	created := 0
+	slowCreate := func() (io.Closer, error) {
+		<-release
+		created++
+		return &mockConn{}, nil
+	}
+
+	wg := &sync.WaitGroup{}
+	conns := make([]io.Closer, 3)
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], _ = pool.Get("slow", slowCreate)
+		}(i)
+	}
+
+	// creating the connection of a key doesn't block the other keys.
+	done := make(chan struct{})
+	go func() {
+		pool.Get("fast", func() (io.Closer, error) {
+			return &mockConn{}, nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("Get is blocked by the creation of another key")
+	}
+
+	close(release)
+	wg.Wait()
+	assert.Equal(1, created)
+	for _, c := range conns {
+		assert.Same(conns[0], c)
+	}
+
+	// the waiters get the error of the creation.
+	release = make(chan struct{})
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = pool.Get("error", func() (io.Closer, error) {
+				<-release
+				return nil, fmt.Errorf("mock error")
+			})
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		assert.NotNil(err)
+	}
+	assert.NotNil(pool.Put("error"))
+}
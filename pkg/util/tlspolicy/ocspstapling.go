@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package tlspolicy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/tlsutil"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspQueryTimeout = 10 * time.Second
+	ocspRetryDelay   = time.Minute
+	ocspCheckPeriod  = 10 * time.Second
+	// ocspIdleTimeout is the duration after which the OCSP response of an
+	// unused certificate is removed, e.g. the certificate was replaced.
+	ocspIdleTimeout = 24 * time.Hour
+)
+
+type (
+	// ocspStapler staples OCSP responses to the certificates. The response
+	// of a certificate is fetched in the background on its first use, and
+	// the handshakes before that are not stapled.
+	ocspStapler struct {
+		refreshInterval time.Duration
+		client          *http.Client
+
+		mu      sync.Mutex
+		entries map[[32]byte]*stapleEntry
+		done    chan struct{}
+	}
+
+	stapleEntry struct {
+		cert        *tls.Certificate
+		stapled     *tls.Certificate
+		nextRefresh time.Time
+		lastUsed    time.Time
+		fetching    bool
+	}
+)
+
+func newOCSPStapler(refreshInterval time.Duration) *ocspStapler {
+	s := &ocspStapler{
+		refreshInterval: refreshInterval,
+		client:          &http.Client{Timeout: ocspQueryTimeout},
+		entries:         map[[32]byte]*stapleEntry{},
+		done:            make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// wrap wraps getCertificate to staple the OCSP responses, certs are used
+// if getCertificate is nil or returns nil.
+func (s *ocspStapler) wrap(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error),
+	certs []tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		var cert *tls.Certificate
+		if getCertificate != nil {
+			c, err := getCertificate(chi)
+			if err != nil {
+				return nil, err
+			}
+			cert = c
+		}
+		if cert == nil {
+			cert = pickCertificate(chi, certs)
+		}
+		return s.staple(cert), nil
+	}
+}
+
+// pickCertificate picks the first certificate supporting chi, or the first
+// certificate if none of them supports it.
+func pickCertificate(chi *tls.ClientHelloInfo, certs []tls.Certificate) *tls.Certificate {
+	if len(certs) == 0 {
+		return nil
+	}
+	for i := range certs {
+		if chi.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i]
+		}
+	}
+	return &certs[0]
+}
+
+// staple returns a copy of cert with the OCSP response stapled if it is
+// available, otherwise cert itself.
+func (s *ocspStapler) staple(cert *tls.Certificate) *tls.Certificate {
+	// the issuer is required to query the OCSP responder.
+	if cert == nil || len(cert.Certificate) < 2 || len(cert.OCSPStaple) > 0 {
+		return cert
+	}
+
+	key := sha256.Sum256(cert.Certificate[0])
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entries[key]
+	if e == nil {
+		e = &stapleEntry{cert: cert, fetching: true}
+		s.entries[key] = e
+		go s.fetch(key, cert)
+	}
+	e.lastUsed = now
+	if e.stapled != nil {
+		return e.stapled
+	}
+	return cert
+}
+
+func (s *ocspStapler) fetch(key [32]byte, cert *tls.Certificate) {
+	stapled, nextRefresh, err := s.query(cert)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[key]
+	if e == nil {
+		return
+	}
+	e.fetching = false
+	e.nextRefresh = nextRefresh
+	// keep the current response if it failed to refresh, the response is
+	// still valid as it is refreshed at the half of its validity.
+	if err == nil || (e.stapled != nil && !time.Now().Before(e.stapledExpiry())) {
+		e.stapled = stapled
+	}
+}
+
+func (e *stapleEntry) stapledExpiry() time.Time {
+	resp, err := ocsp.ParseResponse(e.stapled.OCSPStaple, nil)
+	if err != nil || resp.NextUpdate.IsZero() {
+		return time.Time{}
+	}
+	return resp.NextUpdate
+}
+
+// query queries the OCSP response of cert, and returns a copy of cert with
+// the response stapled and the time to refresh the response. The returned
+// certificate is nil if the status of cert is not good, or it has no OCSP
+// responder.
+func (s *ocspStapler) query(cert *tls.Certificate) (*tls.Certificate, time.Time, error) {
+	now := time.Now()
+	retry := now.Add(ocspRetryDelay)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, retry, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		// nothing to staple.
+		return nil, now.Add(s.refreshInterval), nil
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, retry, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ocspQueryTimeout)
+	defer cancel()
+	resp, err := tlsutil.QueryOCSP(ctx, s.client, leaf, issuer)
+	if err != nil {
+		logger.Warnf("query OCSP response of certificate %s failed: %v", leaf.Subject, err)
+		return nil, retry, err
+	}
+	if resp.Status != ocsp.Good {
+		logger.Errorf("OCSP status of certificate %s is not good, it won't be stapled", leaf.Subject)
+		return nil, now.Add(s.refreshInterval), nil
+	}
+
+	nextRefresh := now.Add(s.refreshInterval)
+	if !resp.NextUpdate.IsZero() {
+		half := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+		if half.Before(nextRefresh) {
+			nextRefresh = half
+		}
+		if nextRefresh.Before(retry) {
+			nextRefresh = retry
+		}
+	}
+
+	stapled := *cert
+	stapled.OCSPStaple = resp.Raw
+	return &stapled, nextRefresh, nil
+}
+
+func (s *ocspStapler) run() {
+	ticker := time.NewTicker(ocspCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.refresh(time.Now())
+		}
+	}
+}
+
+// refresh refreshes the expiring OCSP responses and removes the entries
+// which are not used for a long time.
+func (s *ocspStapler) refresh(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, e := range s.entries {
+		if now.Sub(e.lastUsed) > ocspIdleTimeout {
+			delete(s.entries, key)
+			continue
+		}
+		if !e.fetching && !now.Before(e.nextRefresh) {
+			e.fetching = true
+			go s.fetch(key, e.cert)
+		}
+	}
+}
+
+func (s *ocspStapler) close() {
+	close(s.done)
+}
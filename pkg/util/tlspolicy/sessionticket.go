@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package tlspolicy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/megaease/easegress/pkg/cluster"
+	"github.com/megaease/easegress/pkg/logger"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+const ticketSecretSize = 32
+
+// ticketKeys sets the session ticket keys of the TLS configs and rotates
+// them periodically. The keys are derived from the secret, the name and the
+// epoch of the current time, so all members sharing the secret use the same
+// keys without coordination.
+type ticketKeys struct {
+	secret   []byte
+	name     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	configs []*tls.Config
+	done    chan struct{}
+}
+
+// sharedSecret returns the secret shared in the cluster, which is created
+// if it doesn't exist. A local random secret is returned if there's no
+// cluster or it fails to access the cluster.
+func sharedSecret(cls cluster.Cluster) []byte {
+	secret := make([]byte, ticketSecretSize)
+	rand.Read(secret)
+	if cls == nil {
+		return secret
+	}
+
+	key := cls.Layout().TLSSessionTicketSecret()
+	var value string
+	err := cls.STM(func(stm concurrency.STM) error {
+		value = stm.Get(key)
+		if value == "" {
+			value = hex.EncodeToString(secret)
+			stm.Put(key, value)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("get session ticket secret from cluster failed, use a local one: %v", err)
+		return secret
+	}
+
+	shared, err := hex.DecodeString(value)
+	if err != nil || len(shared) != ticketSecretSize {
+		logger.Errorf("invalid session ticket secret in cluster, use a local one")
+		return secret
+	}
+	return shared
+}
+
+func newTicketKeys(secret []byte, name string, interval time.Duration) *ticketKeys {
+	tk := &ticketKeys{
+		secret:   secret,
+		name:     name,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	go tk.run()
+	return tk
+}
+
+// keys returns the keys at now, the first one is used to encrypt new
+// tickets, the keys of the previous two epochs are kept to decrypt the
+// existing tickets, and the key of the next epoch is included in case the
+// clocks of the members are not synchronized.
+func (tk *ticketKeys) keys(now time.Time) [][32]byte {
+	epoch := now.UnixNano() / int64(tk.interval)
+	return [][32]byte{
+		tk.key(epoch),
+		tk.key(epoch - 1),
+		tk.key(epoch - 2),
+		tk.key(epoch + 1),
+	}
+}
+
+func (tk *ticketKeys) key(epoch int64) [32]byte {
+	mac := hmac.New(sha256.New, tk.secret)
+	mac.Write([]byte(tk.name))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(epoch))
+	mac.Write(buf[:])
+
+	var key [32]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+func (tk *ticketKeys) add(conf *tls.Config) {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	conf.SetSessionTicketKeys(tk.keys(time.Now()))
+	tk.configs = append(tk.configs, conf)
+}
+
+func (tk *ticketKeys) rotate(now time.Time) {
+	keys := tk.keys(now)
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	for _, conf := range tk.configs {
+		conf.SetSessionTicketKeys(keys)
+	}
+}
+
+func (tk *ticketKeys) run() {
+	for {
+		epoch := time.Now().UnixNano() / int64(tk.interval)
+		next := time.Unix(0, (epoch+1)*int64(tk.interval))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-tk.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			tk.rotate(time.Now())
+		}
+	}
+}
+
+func (tk *ticketKeys) close() {
+	close(tk.done)
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/cluster/clustertest"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"github.com/stretchr/testify/assert"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+type fakeSTM struct {
+	concurrency.STM
+	data map[string]string
+}
+
+func (stm *fakeSTM) Get(key ...string) string {
+	return stm.data[key[0]]
+}
+
+func (stm *fakeSTM) Put(key, val string, opts ...clientv3.OpOption) {
+	stm.data[key] = val
+}
+
+func newCluster(data map[string]string) *clustertest.MockedCluster {
+	cls := clustertest.NewMockedCluster()
+	cls.MockedSTM = func(apply func(concurrency.STM) error) error {
+		return apply(&fakeSTM{data: data})
+	}
+	return cls
+}
+
+func TestSharedSecret(t *testing.T) {
+	at := assert.New(t)
+
+	at.Len(sharedSecret(nil), ticketSecretSize)
+
+	data := map[string]string{}
+	secret := sharedSecret(newCluster(data))
+	at.Len(secret, ticketSecretSize)
+	at.Len(data, 1)
+	at.Equal(secret, sharedSecret(newCluster(data)))
+
+	// a local secret is used if the cluster fails.
+	cls := clustertest.NewMockedCluster()
+	cls.MockedSTM = func(apply func(concurrency.STM) error) error {
+		return fmt.Errorf("mocked error")
+	}
+	at.NotEqual(secret, sharedSecret(cls))
+}
+
+func TestTicketKeys(t *testing.T) {
+	at := assert.New(t)
+
+	secret := make([]byte, ticketSecretSize)
+	tk := &ticketKeys{secret: secret, name: "test", interval: time.Hour}
+	now := time.Now()
+	keys := tk.keys(now)
+	at.Len(keys, 4)
+	at.Equal(keys, tk.keys(now))
+
+	// the previous key is kept after rotation.
+	next := tk.keys(now.Add(time.Hour))
+	at.Equal(keys[0], next[1])
+	at.Equal(keys[3], next[0])
+
+	other := &ticketKeys{secret: secret, name: "other", interval: time.Hour}
+	at.NotEqual(keys[0], other.keys(now)[0])
+}
+
+func TestSessionResumption(t *testing.T) {
+	at := assert.New(t)
+
+	ca := tlsutiltest.NewCA("test")
+	cert := serverCert(ca, "")
+	data := map[string]string{}
+	spec := &Spec{
+		// tickets of TLS 1.2 are sent in handshakes, which makes the
+		// test simpler.
+		Options:        Options{MaxVersion: "TLS1.2"},
+		SessionTickets: &SessionTicketsSpec{},
+	}
+
+	newServer := func(name string) (*Policy, *tls.Config) {
+		p := New(spec, name, newCluster(data))
+		conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+		p.Apply(conf)
+		return p, conf
+	}
+
+	// servers with the same name on different members share the keys.
+	p1, server1 := newServer("server")
+	defer p1.Close()
+	p2, server2 := newServer("server")
+	defer p2.Close()
+	p3, server3 := newServer("other")
+	defer p3.Close()
+
+	client := clientConfig(ca, "public.example.com")
+	client.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	state, err := handshake(server1, client)
+	at.NoError(err)
+	at.False(state.DidResume)
+
+	state, err = handshake(server2, client)
+	at.NoError(err)
+	at.True(state.DidResume)
+
+	state, err = handshake(server3, client)
+	at.NoError(err)
+	at.False(state.DidResume)
+
+	// session tickets could be disabled.
+	p4 := New(&Spec{SessionTickets: &SessionTicketsSpec{Disabled: true}}, "server", nil)
+	defer p4.Close()
+	conf := &tls.Config{}
+	p4.Apply(conf)
+	at.True(conf.SessionTicketsDisabled)
+}
+
+func TestSessionResumptionAcrossRotation(t *testing.T) {
+	at := assert.New(t)
+
+	ca := tlsutiltest.NewCA("test")
+	p := New(&Spec{
+		SessionTickets: &SessionTicketsSpec{RotationInterval: "1h"},
+		SNI: []*SNISpec{{
+			ServerNames: []string{"internal.example.com"},
+			Options:     Options{MinVersion: "TLS1.3"},
+		}},
+	}, "server", nil)
+	defer p.Close()
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{serverCert(ca, "")},
+		NextProtos:   []string{"h2"},
+	}
+	p.Apply(conf)
+
+	// like the servers, the listener uses a clone of the config.
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf.Clone())
+	at.NoError(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.Write([]byte("hello"))
+				conn.Close()
+			}()
+		}
+	}()
+
+	dial := func(client *tls.Config) tls.ConnectionState {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+		if !at.NoError(err) {
+			return tls.ConnectionState{}
+		}
+		defer conn.Close()
+		// the session tickets of TLS 1.3 are sent after the handshake.
+		io.ReadAll(conn)
+		return conn.ConnectionState()
+	}
+
+	client := clientConfig(ca, "public.example.com")
+	client.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	at.False(dial(client).DidResume)
+	at.True(dial(client).DidResume)
+
+	// the ticket is still valid after the rotation.
+	now := time.Now()
+	p.tickets.rotate(now.Add(time.Hour))
+	at.True(dial(client).DidResume)
+
+	// but expires after more rotations.
+	p.tickets.rotate(now.Add(5 * time.Hour))
+	at.False(dial(client).DidResume)
+	at.True(dial(client).DidResume)
+
+	// the ALPN protocols of the server are kept by the SNI override.
+	client = clientConfig(ca, "internal.example.com")
+	client.NextProtos = []string{"h2"}
+	state := dial(client)
+	at.Equal(uint16(tls.VersionTLS13), state.Version)
+	at.Equal("h2", state.NegotiatedProtocol)
+}
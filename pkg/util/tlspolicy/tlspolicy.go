@@ -0,0 +1,399 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package tlspolicy provides the TLS policy of the listeners, which controls
+// the protocol versions, cipher suites, curves and ALPN protocols, with
+// per-SNI overrides, and also staples OCSP responses and shares the session
+// ticket keys among the members of the cluster.
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/megaease/easegress/pkg/cluster"
+)
+
+const (
+	// alpnACME is the protocol of the ACME TLS-ALPN-01 challenge, which
+	// is kept in the ALPN protocols if it is already there.
+	alpnACME = "acme-tls/1"
+
+	defaultTicketRotationInterval = 12 * time.Hour
+	defaultOCSPRefreshInterval    = time.Hour
+)
+
+var (
+	versions = map[string]uint16{
+		"TLS1.0": tls.VersionTLS10,
+		"TLS1.1": tls.VersionTLS11,
+		"TLS1.2": tls.VersionTLS12,
+		"TLS1.3": tls.VersionTLS13,
+	}
+
+	curves = map[string]tls.CurveID{
+		"X25519": tls.X25519,
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+	}
+)
+
+type (
+	// Spec describes the TLS policy.
+	Spec struct {
+		Options        `json:",inline"`
+		SessionTickets *SessionTicketsSpec `json:"sessionTickets,omitempty" jsonschema:"omitempty"`
+		OCSPStapling   *OCSPStaplingSpec   `json:"ocspStapling,omitempty" jsonschema:"omitempty"`
+		// SNI overrides the options for the given server names, the first
+		// matching override is used.
+		SNI []*SNISpec `json:"sni,omitempty" jsonschema:"omitempty"`
+	}
+
+	// Options are the TLS options which could be overridden per SNI.
+	Options struct {
+		MinVersion string `json:"minVersion,omitempty" jsonschema:"omitempty,enum=,enum=TLS1.0,enum=TLS1.1,enum=TLS1.2,enum=TLS1.3"`
+		MaxVersion string `json:"maxVersion,omitempty" jsonschema:"omitempty,enum=,enum=TLS1.0,enum=TLS1.1,enum=TLS1.2,enum=TLS1.3"`
+		// CipherSuites are the names of the TLS 1.0-1.2 cipher suites,
+		// TLS 1.3 cipher suites are not configurable.
+		CipherSuites []string `json:"cipherSuites,omitempty" jsonschema:"omitempty"`
+		Curves       []string `json:"curves,omitempty" jsonschema:"omitempty"`
+		ALPN         []string `json:"alpn,omitempty" jsonschema:"omitempty"`
+	}
+
+	// SNISpec overrides the options for the server names.
+	SNISpec struct {
+		// ServerNames are exact names or wildcards like *.example.com.
+		ServerNames []string `json:"serverNames" jsonschema:"required,minItems=1"`
+		Options     `json:",inline"`
+	}
+
+	// SessionTicketsSpec describes the session tickets. The ticket keys
+	// are derived from a secret shared in the cluster, so a session could
+	// be resumed on any member.
+	SessionTicketsSpec struct {
+		Disabled         bool   `json:"disabled,omitempty" jsonschema:"omitempty"`
+		RotationInterval string `json:"rotationInterval,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+
+	// OCSPStaplingSpec describes the OCSP stapling. The OCSP responses are
+	// fetched in the background and refreshed at the half of their
+	// validity or at RefreshInterval, whichever comes first.
+	OCSPStaplingSpec struct {
+		RefreshInterval string `json:"refreshInterval,omitempty" jsonschema:"omitempty,format=duration"`
+	}
+
+	// Policy applies the TLS policy to TLS configs.
+	Policy struct {
+		spec    *Spec
+		tickets *ticketKeys
+		stapler *ocspStapler
+	}
+)
+
+// Validate validates Spec.
+func (spec *Spec) Validate() error {
+	if err := spec.Options.validate(); err != nil {
+		return err
+	}
+	for _, s := range spec.SNI {
+		if err := s.Options.validate(); err != nil {
+			return fmt.Errorf("sni %v: %v", s.ServerNames, err)
+		}
+	}
+	if st := spec.SessionTickets; st != nil && st.RotationInterval != "" {
+		d, err := time.ParseDuration(st.RotationInterval)
+		if err != nil {
+			return fmt.Errorf("invalid session ticket rotation interval: %v", err)
+		}
+		if d < time.Minute {
+			return fmt.Errorf("session ticket rotation interval must be at least 1m")
+		}
+	}
+	if stapling := spec.OCSPStapling; stapling != nil && stapling.RefreshInterval != "" {
+		d, err := time.ParseDuration(stapling.RefreshInterval)
+		if err != nil {
+			return fmt.Errorf("invalid ocsp stapling refresh interval: %v", err)
+		}
+		if d < time.Minute {
+			return fmt.Errorf("ocsp stapling refresh interval must be at least 1m")
+		}
+	}
+	return nil
+}
+
+func (o *Options) validate() error {
+	var min, max uint16
+	if o.MinVersion != "" {
+		if min = versions[o.MinVersion]; min == 0 {
+			return fmt.Errorf("unknown TLS version %s", o.MinVersion)
+		}
+	}
+	if o.MaxVersion != "" {
+		if max = versions[o.MaxVersion]; max == 0 {
+			return fmt.Errorf("unknown TLS version %s", o.MaxVersion)
+		}
+	}
+	if min != 0 && max != 0 && min > max {
+		return fmt.Errorf("minVersion %s is greater than maxVersion %s", o.MinVersion, o.MaxVersion)
+	}
+	if _, err := cipherSuites(o.CipherSuites); err != nil {
+		return err
+	}
+	if _, err := curvePreferences(o.Curves); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ValidateHTTP2 validates the policy for HTTP servers. HTTP/2 requires
+// TLS_ECDHE_*_WITH_AES_128_GCM_SHA256 if TLS 1.2 is allowed, and it can't be
+// enabled by the overrides if the default ALPN protocols disable it.
+func (spec *Spec) ValidateHTTP2() error {
+	if err := spec.Options.http2Compatible(); err != nil {
+		return err
+	}
+	for _, s := range spec.SNI {
+		o := s.Options.inherit(&spec.Options)
+		if spec.DisablesHTTP2() && containsString(o.ALPN, "h2") {
+			return fmt.Errorf("sni %v: h2 is disabled by the default alpn", s.ServerNames)
+		}
+		if err := o.http2Compatible(); err != nil {
+			return fmt.Errorf("sni %v: %v", s.ServerNames, err)
+		}
+	}
+	return nil
+}
+
+// DisablesHTTP2 returns whether the default ALPN protocols are set without
+// h2, it returns false if spec is nil.
+func (spec *Spec) DisablesHTTP2() bool {
+	return spec != nil && len(spec.ALPN) > 0 && !containsString(spec.ALPN, "h2")
+}
+
+func (o *Options) http2Compatible() error {
+	if len(o.CipherSuites) == 0 || o.MinVersion == "TLS1.3" {
+		return nil
+	}
+	if len(o.ALPN) > 0 && !containsString(o.ALPN, "h2") {
+		return nil
+	}
+	for _, name := range o.CipherSuites {
+		if name == "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" || name == "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256" {
+			return nil
+		}
+	}
+	return fmt.Errorf("HTTP/2 requires TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 in cipherSuites")
+}
+
+// inherit returns a copy of o whose empty options are inherited from base.
+func (o Options) inherit(base *Options) *Options {
+	if o.MinVersion == "" {
+		o.MinVersion = base.MinVersion
+	}
+	if o.MaxVersion == "" {
+		o.MaxVersion = base.MaxVersion
+	}
+	if len(o.CipherSuites) == 0 {
+		o.CipherSuites = base.CipherSuites
+	}
+	if len(o.Curves) == 0 {
+		o.Curves = base.Curves
+	}
+	if len(o.ALPN) == 0 {
+		o.ALPN = base.ALPN
+	}
+	return &o
+}
+
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	all := map[string]*tls.CipherSuite{}
+	for _, cs := range tls.CipherSuites() {
+		all[cs.Name] = cs
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		all[cs.Name] = cs
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		cs := all[name]
+		if cs == nil {
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		}
+		if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+			return nil, fmt.Errorf("TLS 1.3 cipher suite %s is not configurable", name)
+		}
+		ids = append(ids, cs.ID)
+	}
+	return ids, nil
+}
+
+func curvePreferences(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		id, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// apply applies the options which are set to conf, errors have been
+// checked in Validate.
+func (o *Options) apply(conf *tls.Config) {
+	if o.MinVersion != "" {
+		conf.MinVersion = versions[o.MinVersion]
+	}
+	if o.MaxVersion != "" {
+		conf.MaxVersion = versions[o.MaxVersion]
+	}
+	if len(o.CipherSuites) > 0 {
+		conf.CipherSuites, _ = cipherSuites(o.CipherSuites)
+	}
+	if len(o.Curves) > 0 {
+		conf.CurvePreferences, _ = curvePreferences(o.Curves)
+	}
+	if len(o.ALPN) > 0 {
+		protos := append([]string{}, o.ALPN...)
+		if containsString(conf.NextProtos, alpnACME) && !containsString(protos, alpnACME) {
+			protos = append(protos, alpnACME)
+		}
+		conf.NextProtos = protos
+	}
+}
+
+func (s *SNISpec) match(serverName string) bool {
+	serverName = strings.ToLower(serverName)
+	for _, name := range s.ServerNames {
+		name = strings.ToLower(name)
+		if name == serverName {
+			return true
+		}
+		if strings.HasPrefix(name, "*.") {
+			i := strings.IndexByte(serverName, '.')
+			if i > 0 && serverName[i:] == name[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// New creates a Policy, it returns nil if spec is nil. The name is used
+// to derive the session ticket keys, so the sessions of different servers
+// can't be resumed on each other. The cluster is used to share the secret
+// of the session ticket keys, it could be nil.
+func New(spec *Spec, name string, cls cluster.Cluster) *Policy {
+	if spec == nil {
+		return nil
+	}
+
+	p := &Policy{spec: spec}
+	if st := spec.SessionTickets; st != nil && !st.Disabled {
+		interval := defaultTicketRotationInterval
+		if st.RotationInterval != "" {
+			interval, _ = time.ParseDuration(st.RotationInterval)
+		}
+		p.tickets = newTicketKeys(sharedSecret(cls), name, interval)
+	}
+	if stapling := spec.OCSPStapling; stapling != nil {
+		interval := defaultOCSPRefreshInterval
+		if stapling.RefreshInterval != "" {
+			interval, _ = time.ParseDuration(stapling.RefreshInterval)
+		}
+		p.stapler = newOCSPStapler(interval)
+	}
+	return p
+}
+
+// Apply applies the policy to conf, it does nothing if p is nil. It must
+// be called after the ALPN protocols required by the server are set in
+// conf, and conf must not be modified after that. The servers could use a
+// clone of conf, because the handshakes use a clone of conf made for each
+// connection, which carries the current session ticket keys and the
+// options of the matching SNI override.
+func (p *Policy) Apply(conf *tls.Config) {
+	if p == nil {
+		return
+	}
+
+	p.spec.Options.apply(conf)
+
+	if p.stapler != nil {
+		conf.GetCertificate = p.stapler.wrap(conf.GetCertificate, conf.Certificates)
+	}
+
+	if st := p.spec.SessionTickets; st != nil && st.Disabled {
+		conf.SessionTicketsDisabled = true
+	} else if p.tickets != nil {
+		p.tickets.add(conf)
+	}
+
+	if p.tickets == nil && len(p.spec.SNI) == 0 {
+		return
+	}
+
+	// tls.Config.Clone copies the session ticket keys, so the clones made
+	// by the servers keep the keys at the time they are made, and the
+	// rotated keys are only in conf.
+	conf.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+		c := conf.Clone()
+		c.GetConfigForClient = nil
+		for _, s := range p.spec.SNI {
+			if s.match(chi.ServerName) {
+				s.Options.apply(c)
+				break
+			}
+		}
+		return c, nil
+	}
+}
+
+// Close stops the background tasks of the policy, it does nothing if p is
+// nil.
+func (p *Policy) Close() {
+	if p == nil {
+		return
+	}
+	if p.tickets != nil {
+		p.tickets.close()
+	}
+	if p.stapler != nil {
+		p.stapler.close()
+	}
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package tlspolicy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/megaease/easegress/pkg/logger"
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitNop()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func serverCert(ca *tlsutiltest.CA, ocspServer string) tls.Certificate {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		DNSNames:    []string{"public.example.com", "internal.example.com"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ocspServer != "" {
+		tmpl.OCSPServer = []string{ocspServer}
+	}
+	_, certPEM, keyPEM := ca.Issue(tmpl)
+	cert, err := tls.X509KeyPair(append(certPEM, ca.CertPEM()...), keyPEM)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+func clientConfig(ca *tlsutiltest.CA, serverName string) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert())
+	return &tls.Config{RootCAs: pool, ServerName: serverName}
+}
+
+// handshake performs a handshake between the server and the client, and
+// returns the connection state of the client.
+func handshake(server, client *tls.Config) (tls.ConnectionState, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		conn := tls.Server(c1, server)
+		if conn.Handshake() != nil {
+			c1.Close()
+		}
+	}()
+
+	conn := tls.Client(c2, client)
+	err := conn.Handshake()
+	return conn.ConnectionState(), err
+}
+
+func TestSpecValidate(t *testing.T) {
+	at := assert.New(t)
+
+	spec := &Spec{
+		Options: Options{
+			MinVersion:   "TLS1.2",
+			MaxVersion:   "TLS1.3",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			Curves:       []string{"X25519", "P256"},
+			ALPN:         []string{"h2", "http/1.1"},
+		},
+		SessionTickets: &SessionTicketsSpec{RotationInterval: "1h"},
+		OCSPStapling:   &OCSPStaplingSpec{RefreshInterval: "30m"},
+		SNI: []*SNISpec{{
+			ServerNames: []string{"*.internal.example.com"},
+			Options:     Options{MinVersion: "TLS1.3"},
+		}},
+	}
+	at.NoError(spec.Validate())
+
+	spec.MinVersion = "TLS1.4"
+	at.Error(spec.Validate())
+	spec.MinVersion = "TLS1.3"
+	spec.MaxVersion = "TLS1.2"
+	at.Error(spec.Validate())
+	spec.MinVersion = "TLS1.2"
+
+	spec.CipherSuites = []string{"TLS_UNKNOWN"}
+	at.Error(spec.Validate())
+	spec.CipherSuites = []string{"TLS_AES_128_GCM_SHA256"}
+	at.Error(spec.Validate())
+	spec.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+	at.NoError(spec.Validate())
+
+	spec.Curves = []string{"P224"}
+	at.Error(spec.Validate())
+	spec.Curves = nil
+
+	spec.SNI[0].CipherSuites = []string{"TLS_UNKNOWN"}
+	at.Error(spec.Validate())
+	spec.SNI[0].CipherSuites = nil
+
+	spec.SessionTickets.RotationInterval = "1s"
+	at.Error(spec.Validate())
+	spec.SessionTickets.RotationInterval = "1h"
+
+	spec.OCSPStapling.RefreshInterval = "invalid"
+	at.Error(spec.Validate())
+	spec.OCSPStapling.RefreshInterval = ""
+	at.NoError(spec.Validate())
+}
+
+func TestValidateHTTP2(t *testing.T) {
+	at := assert.New(t)
+
+	spec := &Spec{Options: Options{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}}}
+	at.Error(spec.ValidateHTTP2())
+	spec.ALPN = []string{"http/1.1"}
+	at.NoError(spec.ValidateHTTP2())
+	at.True(spec.DisablesHTTP2())
+	spec.ALPN = nil
+	spec.MinVersion = "TLS1.3"
+	at.NoError(spec.ValidateHTTP2())
+	spec.MinVersion = ""
+	spec.CipherSuites = append(spec.CipherSuites, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	at.NoError(spec.ValidateHTTP2())
+	at.False(spec.DisablesHTTP2())
+
+	// overrides inherit the default options.
+	spec.SNI = []*SNISpec{{
+		ServerNames: []string{"example.com"},
+		Options:     Options{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}},
+	}}
+	at.Error(spec.ValidateHTTP2())
+	spec.SNI[0].MinVersion = "TLS1.3"
+	at.NoError(spec.ValidateHTTP2())
+
+	spec.ALPN = []string{"http/1.1"}
+	spec.SNI[0].ALPN = []string{"h2"}
+	at.Error(spec.ValidateHTTP2())
+
+	spec = nil
+	at.False(spec.DisablesHTTP2())
+}
+
+func TestApply(t *testing.T) {
+	at := assert.New(t)
+
+	var p *Policy
+	conf := &tls.Config{}
+	p.Apply(conf)
+	p.Close()
+	at.Equal(&tls.Config{}, conf)
+
+	p = New(&Spec{Options: Options{
+		MinVersion:   "TLS1.2",
+		MaxVersion:   "TLS1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Curves:       []string{"X25519"},
+		ALPN:         []string{"h2"},
+	}}, "test", nil)
+	defer p.Close()
+
+	conf = &tls.Config{NextProtos: []string{"acme-tls/1"}}
+	p.Apply(conf)
+	at.Equal(uint16(tls.VersionTLS12), conf.MinVersion)
+	at.Equal(uint16(tls.VersionTLS12), conf.MaxVersion)
+	at.Equal([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, conf.CipherSuites)
+	at.Equal([]tls.CurveID{tls.X25519}, conf.CurvePreferences)
+	at.Equal([]string{"h2", "acme-tls/1"}, conf.NextProtos)
+	at.Nil(conf.GetConfigForClient)
+}
+
+func TestSNIOverride(t *testing.T) {
+	at := assert.New(t)
+
+	ca := tlsutiltest.NewCA("test")
+	p := New(&Spec{
+		Options: Options{MinVersion: "TLS1.2", MaxVersion: "TLS1.2"},
+		SNI: []*SNISpec{{
+			ServerNames: []string{"*.example.com", "other.test"},
+			Options:     Options{MinVersion: "TLS1.3", MaxVersion: "TLS1.3"},
+		}},
+	}, "test", nil)
+	defer p.Close()
+
+	// the first matching override is used.
+	p.spec.SNI = append([]*SNISpec{{
+		ServerNames: []string{"Public.Example.com"},
+		Options:     Options{ALPN: []string{"http/1.1"}},
+	}}, p.spec.SNI...)
+
+	conf := &tls.Config{Certificates: []tls.Certificate{serverCert(ca, "")}}
+	p.Apply(conf)
+
+	state, err := handshake(conf, clientConfig(ca, "public.example.com"))
+	at.NoError(err)
+	at.Equal(uint16(tls.VersionTLS12), state.Version)
+
+	state, err = handshake(conf, clientConfig(ca, "internal.example.com"))
+	at.NoError(err)
+	at.Equal(uint16(tls.VersionTLS13), state.Version)
+
+	client := clientConfig(ca, "internal.example.com")
+	client.MaxVersion = tls.VersionTLS12
+	_, err = handshake(conf, client)
+	at.Error(err)
+
+	// the base config is not modified by the overrides.
+	at.Equal(uint16(tls.VersionTLS12), conf.MaxVersion)
+	at.Nil(conf.NextProtos)
+}
+
+func TestOCSPStapling(t *testing.T) {
+	at := assert.New(t)
+
+	ca := tlsutiltest.NewCA("test")
+	var requests int32
+	var status int32 = ocsp.Good
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if !at.NoError(err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		resp, err := ocsp.CreateResponse(ca.Cert(), ca.Cert(), ocsp.Response{
+			Status:       int(atomic.LoadInt32(&status)),
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now.Add(-time.Minute),
+			NextUpdate:   now.Add(time.Hour),
+			RevokedAt:    now.Add(-time.Minute),
+		}, ca.Key())
+		at.NoError(err)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	p := New(&Spec{OCSPStapling: &OCSPStaplingSpec{}}, "test", nil)
+	defer p.Close()
+
+	cert := serverCert(ca, responder.URL)
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	p.Apply(conf)
+
+	// the first handshake triggers the query.
+	_, err := handshake(conf, clientConfig(ca, "public.example.com"))
+	at.NoError(err)
+
+	var state tls.ConnectionState
+	at.Eventually(func() bool {
+		state, err = handshake(conf, clientConfig(ca, "public.example.com"))
+		return err == nil && len(state.OCSPResponse) > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	resp, err := ocsp.ParseResponse(state.OCSPResponse, ca.Cert())
+	at.NoError(err)
+	at.Equal(ocsp.Good, resp.Status)
+	at.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	// the response is refreshed at the half of its validity or at the
+	// refresh interval, and it is not stapled if the certificate is
+	// revoked.
+	atomic.StoreInt32(&status, ocsp.Revoked)
+	s := p.stapler
+	s.refresh(time.Now())
+	at.Equal(int32(1), atomic.LoadInt32(&requests))
+	s.refresh(time.Now().Add(30 * time.Minute))
+	at.Eventually(func() bool {
+		state, err = handshake(conf, clientConfig(ca, "public.example.com"))
+		return err == nil && len(state.OCSPResponse) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+	at.Equal(int32(2), atomic.LoadInt32(&requests))
+
+	// unused entries are removed.
+	s.refresh(time.Now().Add(48 * time.Hour))
+	s.mu.Lock()
+	at.Empty(s.entries)
+	s.mu.Unlock()
+
+	// certificates without issuer are not stapled.
+	single := &tls.Certificate{Certificate: cert.Certificate[:1]}
+	at.Same(single, s.staple(single))
+}
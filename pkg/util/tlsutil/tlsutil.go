@@ -0,0 +1,83 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tlsutil provides the utilities to build TLS configurations from
+// the certificates in object specs.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// DecodePEM decodes a PEM which could be in base64 encoding or plain text.
+// It starts with '-' if it is in plain text, and '-' is not a valid
+// character in standard base64 encoding. So we first try to decode it as
+// base64, and fallback to plain text if failed.
+func DecodePEM(pem string) []byte {
+	d, err := base64.StdEncoding.DecodeString(pem)
+	if err == nil {
+		return d
+	}
+	return []byte(pem)
+}
+
+// LoadCertificates loads the certificates of a server. certBase64 and
+// keyBase64 are the base64 encoded certificate and key, which are
+// preserved for backward compatibility. certs and keys are maps of which
+// the key is the domain name, and values are the certificates and the
+// keys in PEM, the PEM could be base64 encoded or in plain text.
+func LoadCertificates(certBase64, keyBase64 string, certs, keys map[string]string) ([]tls.Certificate, error) {
+	var certificates []tls.Certificate
+
+	if certBase64 != "" && keyBase64 != "" {
+		certPem, _ := base64.StdEncoding.DecodeString(certBase64)
+		keyPem, _ := base64.StdEncoding.DecodeString(keyBase64)
+		cert, err := tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return nil, fmt.Errorf("generate x509 key pair failed: %v", err)
+		}
+		certificates = append(certificates, cert)
+	}
+
+	for k, v := range certs {
+		secret, exists := keys[k]
+		if !exists {
+			return nil, fmt.Errorf("certs %s hasn't secret corresponded to it", k)
+		}
+
+		cert, err := tls.X509KeyPair(DecodePEM(v), DecodePEM(secret))
+		if err != nil {
+			return nil, fmt.Errorf("generate x509 key pair for %s failed: %s ", k, err)
+		}
+		certificates = append(certificates, cert)
+	}
+
+	return certificates, nil
+}
+
+// CertPool creates a certificate pool from the PEM encoded certificates,
+// which could be base64 encoded or in plain text.
+func CertPool(pem string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(DecodePEM(pem)) {
+		return nil, fmt.Errorf("no valid certificate found")
+	}
+	return pool, nil
+}
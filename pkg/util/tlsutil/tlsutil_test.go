@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tlsutil
+
+import (
+	"testing"
+
+	"github.com/megaease/easegress/pkg/util/tlsutil/tlsutiltest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodePEM(t *testing.T) {
+	assert := assert.New(t)
+	certs := tlsutiltest.NewCerts()
+
+	assert.Equal(certs.CACert, DecodePEM(string(certs.CACert)))
+	assert.Equal(certs.CACert, DecodePEM(tlsutiltest.Base64(certs.CACert)))
+}
+
+func TestLoadCertificates(t *testing.T) {
+	assert := assert.New(t)
+	certs := tlsutiltest.NewCerts()
+
+	result, err := LoadCertificates(tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ServerKey),
+		map[string]string{"client": string(certs.ClientCert)},
+		map[string]string{"client": tlsutiltest.Base64(certs.ClientKey)})
+	assert.NoError(err)
+	assert.Len(result, 2)
+
+	_, err = LoadCertificates("", "", map[string]string{"client": string(certs.ClientCert)}, nil)
+	assert.Error(err)
+
+	_, err = LoadCertificates(tlsutiltest.Base64(certs.ServerCert), tlsutiltest.Base64(certs.ClientKey), nil, nil)
+	assert.Error(err)
+}
+
+func TestCertPool(t *testing.T) {
+	assert := assert.New(t)
+	certs := tlsutiltest.NewCerts()
+
+	pool, err := CertPool(tlsutiltest.Base64(certs.CACert))
+	assert.NoError(err)
+	assert.NotNil(pool)
+
+	_, err = CertPool("invalid")
+	assert.Error(err)
+}
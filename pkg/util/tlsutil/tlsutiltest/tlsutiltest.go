@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tlsutiltest provides utilities for testing TLS.
+package tlsutiltest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+)
+
+type (
+	// Certs contains a CA, and a server certificate and a client
+	// certificate issued by the CA, all of them are PEM encoded.
+	Certs struct {
+		CACert     []byte
+		ServerCert []byte
+		ServerKey  []byte
+		ClientCert []byte
+		ClientKey  []byte
+	}
+
+	// CA is a certificate authority which issues certificates with
+	// custom templates, and signs CRLs.
+	CA struct {
+		kp *keyPair
+	}
+
+	keyPair struct {
+		cert *x509.Certificate
+		key  *ecdsa.PrivateKey
+		der  []byte
+	}
+)
+
+// NewCerts creates the certificates, the server certificate is valid for
+// the DNS names and 127.0.0.1.
+func NewCerts(dnsNames ...string) *Certs {
+	ca := newKeyPair(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Easegress Test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}, nil)
+	server := newKeyPair(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		DNSNames:    append([]string{"localhost"}, dnsNames...),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newKeyPair(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	return &Certs{
+		CACert:     ca.certPEM(),
+		ServerCert: server.certPEM(),
+		ServerKey:  server.keyPEM(),
+		ClientCert: client.certPEM(),
+		ClientKey:  client.keyPEM(),
+	}
+}
+
+// NewCA creates a self-signed CA.
+func NewCA(commonName string) *CA {
+	return &CA{kp: newKeyPair(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}, nil)}
+}
+
+// Cert returns the certificate of the CA.
+func (ca *CA) Cert() *x509.Certificate {
+	return ca.kp.cert
+}
+
+// CertPEM returns the PEM encoded certificate of the CA.
+func (ca *CA) CertPEM() []byte {
+	return ca.kp.certPEM()
+}
+
+// Key returns the private key of the CA.
+func (ca *CA) Key() crypto.Signer {
+	return ca.kp.key
+}
+
+// Issue issues a certificate from tmpl, the serial number and the validity
+// period of tmpl are overwritten. It returns the certificate, and the PEM
+// encoded certificate and private key.
+func (ca *CA) Issue(tmpl *x509.Certificate) (*x509.Certificate, []byte, []byte) {
+	kp := newKeyPair(tmpl, ca.kp)
+	return kp.cert, kp.certPEM(), kp.keyPEM()
+}
+
+// NewCRL creates a PEM encoded CRL which revokes the certificates.
+func (ca *CA) NewCRL(revoked ...*x509.Certificate) []byte {
+	now := time.Now()
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now.Add(-time.Hour),
+		NextUpdate: now.Add(24 * time.Hour),
+	}
+	for _, cert := range revoked {
+		tmpl.RevokedCertificates = append(tmpl.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: now.Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.kp.cert, ca.kp.key)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+// Base64 returns the base64 encoding of a PEM.
+func Base64(pem []byte) string {
+	return base64.StdEncoding.EncodeToString(pem)
+}
+
+var serialNumber int64
+
+func newKeyPair(tmpl *x509.Certificate, issuer *keyPair) *keyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	serialNumber++
+	tmpl.SerialNumber = big.NewInt(serialNumber)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(24 * time.Hour)
+
+	parent, parentKey := tmpl, key
+	if issuer != nil {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return &keyPair{cert: cert, key: key, der: der}
+}
+
+func (kp *keyPair) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kp.der})
+}
+
+func (kp *keyPair) keyPEM() []byte {
+	der, err := x509.MarshalECPrivateKey(kp.key)
+	if err != nil {
+		panic(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
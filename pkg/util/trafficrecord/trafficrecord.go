@@ -0,0 +1,356 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package trafficrecord defines the records of request/response exchanges
+// and their file formats, which are shared by the Recorder filter, the
+// traffic API and egctl.
+package trafficrecord
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/megaease/easegress/pkg/version"
+)
+
+const (
+	// FormatNDJSON is the newline delimited JSON format, one record per line.
+	FormatNDJSON = "ndjson"
+	// FormatHAR is the HTTP Archive format.
+	FormatHAR = "har"
+
+	// HARFooter is the footer of a HAR file.
+	HARFooter = "\n]}}\n"
+
+	// RedactedValue is the value which replaces redacted headers and body
+	// fields.
+	RedactedValue = "[REDACTED]"
+
+	harHeader = `{"log":{"version":"1.2","creator":{"name":"Easegress","version":%q},"entries":[` + "\n"
+)
+
+type (
+	// Record is a recorded request/response exchange.
+	Record struct {
+		StartedAt time.Time `json:"startedAt"`
+		// Duration is the time spent on processing the request, in
+		// milliseconds.
+		Duration float64   `json:"duration"`
+		Request  *Request  `json:"request"`
+		Response *Response `json:"response,omitempty"`
+	}
+
+	// Request is a recorded request.
+	Request struct {
+		Method string      `json:"method"`
+		URL    string      `json:"url"`
+		Proto  string      `json:"proto"`
+		Header http.Header `json:"header"`
+		Body   []byte      `json:"body,omitempty"`
+	}
+
+	// Response is a recorded response.
+	Response struct {
+		StatusCode int         `json:"statusCode"`
+		Header     http.Header `json:"header"`
+		Body       []byte      `json:"body,omitempty"`
+		// BodyOmitted is true if the body is a stream or is too large
+		// to record.
+		BodyOmitted bool `json:"bodyOmitted,omitempty"`
+	}
+)
+
+// Latency returns the duration of the record as a time.Duration.
+func (r *Record) Latency() time.Duration {
+	return time.Duration(r.Duration * float64(time.Millisecond))
+}
+
+// The HAR types below only define the fields used by Easegress, see
+// http://www.softwareishard.com/blog/har-12-spec/ for the full spec.
+type (
+	harLog struct {
+		Log struct {
+			Entries []*harEntry `json:"entries"`
+		} `json:"log"`
+	}
+
+	harEntry struct {
+		StartedDateTime time.Time    `json:"startedDateTime"`
+		Time            float64      `json:"time"`
+		Request         *harRequest  `json:"request"`
+		Response        *harResponse `json:"response"`
+		Cache           struct{}     `json:"cache"`
+		Timings         harTimings   `json:"timings"`
+	}
+
+	harRequest struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		PostData    *harContent    `json:"postData,omitempty"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int            `json:"bodySize"`
+	}
+
+	harResponse struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Cookies     []harNameValue `json:"cookies"`
+		Headers     []harNameValue `json:"headers"`
+		Content     harContent     `json:"content"`
+		RedirectURL string         `json:"redirectURL"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int            `json:"bodySize"`
+	}
+
+	harNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	harContent struct {
+		Size     int    `json:"size"`
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text,omitempty"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+
+	harTimings struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
+
+func toHARHeader(h http.Header) []harNameValue {
+	nvs := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			nvs = append(nvs, harNameValue{Name: name, Value: v})
+		}
+	}
+	return nvs
+}
+
+func fromHARHeader(nvs []harNameValue) http.Header {
+	h := http.Header{}
+	for _, nv := range nvs {
+		h.Add(nv.Name, nv.Value)
+	}
+	return h
+}
+
+// toHARContent encodes body as text if it is valid UTF-8, otherwise, it
+// is encoded in base64.
+func toHARContent(body []byte, mimeType string) *harContent {
+	c := &harContent{Size: len(body), MimeType: mimeType}
+	if utf8.Valid(body) {
+		c.Text = string(body)
+	} else {
+		c.Text = base64.StdEncoding.EncodeToString(body)
+		c.Encoding = "base64"
+	}
+	return c
+}
+
+func fromHARContent(c *harContent) ([]byte, error) {
+	if c == nil || c.Text == "" {
+		return nil, nil
+	}
+	if c.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(c.Text)
+	}
+	return []byte(c.Text), nil
+}
+
+func (r *Record) toHAR() *harEntry {
+	e := &harEntry{
+		StartedDateTime: r.StartedAt,
+		Time:            r.Duration,
+		Timings:         harTimings{Wait: r.Duration},
+	}
+
+	e.Request = &harRequest{
+		Method:      r.Request.Method,
+		URL:         r.Request.URL,
+		HTTPVersion: r.Request.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     toHARHeader(r.Request.Header),
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    len(r.Request.Body),
+	}
+	if u, err := url.Parse(r.Request.URL); err == nil {
+		for k, values := range u.Query() {
+			for _, v := range values {
+				e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: k, Value: v})
+			}
+		}
+	}
+	if len(r.Request.Body) > 0 {
+		e.Request.PostData = toHARContent(r.Request.Body, r.Request.Header.Get("Content-Type"))
+	}
+
+	e.Response = &harResponse{
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		HTTPVersion: r.Request.Proto,
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	if resp := r.Response; resp != nil {
+		e.Response.Status = resp.StatusCode
+		e.Response.StatusText = http.StatusText(resp.StatusCode)
+		e.Response.Headers = toHARHeader(resp.Header)
+		e.Response.Content = *toHARContent(resp.Body, resp.Header.Get("Content-Type"))
+		if !resp.BodyOmitted {
+			e.Response.BodySize = len(resp.Body)
+		}
+	}
+
+	return e
+}
+
+func fromHAR(e *harEntry) (*Record, error) {
+	if e.Request == nil {
+		return nil, fmt.Errorf("request is missing")
+	}
+
+	r := &Record{
+		StartedAt: e.StartedDateTime,
+		Duration:  e.Time,
+		Request: &Request{
+			Method: e.Request.Method,
+			URL:    e.Request.URL,
+			Proto:  e.Request.HTTPVersion,
+			Header: fromHARHeader(e.Request.Headers),
+		},
+	}
+
+	body, err := fromHARContent(e.Request.PostData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode request body: %v", err)
+	}
+	r.Request.Body = body
+
+	if e.Response != nil && e.Response.Status != 0 {
+		r.Response = &Response{
+			StatusCode:  e.Response.Status,
+			Header:      fromHARHeader(e.Response.Headers),
+			BodyOmitted: e.Response.BodySize < 0,
+		}
+		body, err = fromHARContent(&e.Response.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode response body: %v", err)
+		}
+		r.Response.Body = body
+	}
+
+	return r, nil
+}
+
+// Marshal marshals a record to a single line in the given format.
+func Marshal(r *Record, format string) ([]byte, error) {
+	if format == FormatHAR {
+		return json.Marshal(r.toHAR())
+	}
+	return json.Marshal(r)
+}
+
+// HARHeader returns the header of a HAR file.
+func HARHeader() string {
+	return fmt.Sprintf(harHeader, version.RELEASE)
+}
+
+// ReadRecords reads all records from r in the given format. A HAR file
+// which is still being written, that's, without the closing brackets, is
+// also accepted.
+func ReadRecords(r io.Reader, format string) ([]*Record, error) {
+	switch format {
+	case FormatHAR:
+		return readHAR(r)
+	case FormatNDJSON, "":
+		return readNDJSON(r)
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+}
+
+func readNDJSON(r io.Reader) ([]*Record, error) {
+	var records []*Record
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if rec.Request == nil {
+			return nil, fmt.Errorf("line %d: request is missing", line)
+		}
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func readHAR(r io.Reader) ([]*Record, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	log := &harLog{}
+	if err = json.Unmarshal(data, log); err != nil {
+		// the recorder writes the footer when the file is closed, try to
+		// complete the file in case it is still being written.
+		data = append(bytes.TrimRight(bytes.TrimSpace(data), ","), HARFooter...)
+		if json.Unmarshal(data, log) != nil {
+			return nil, err
+		}
+	}
+
+	records := make([]*Record, 0, len(log.Log.Entries))
+	for i, e := range log.Log.Entries {
+		rec, err := fromHAR(e)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
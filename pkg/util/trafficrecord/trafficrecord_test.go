@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2017, MegaEase
+ * All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trafficrecord
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ReadRecords(strings.NewReader(""), "xml")
+	assert.Error(err)
+
+	_, err = ReadRecords(strings.NewReader("{}"), FormatNDJSON)
+	assert.Error(err)
+
+	_, err = ReadRecords(strings.NewReader("not json"), FormatHAR)
+	assert.Error(err)
+
+	rec := &Record{
+		Duration: 12.5,
+		Request: &Request{
+			Method: http.MethodPut,
+			URL:    "http://127.0.0.1/",
+			Header: http.Header{},
+			Body:   []byte{0xff, 0xfe},
+		},
+		Response: &Response{StatusCode: http.StatusOK, Header: http.Header{}, BodyOmitted: true},
+	}
+	data, err := Marshal(rec, FormatHAR)
+	assert.NoError(err)
+
+	records, err := ReadRecords(strings.NewReader(HARHeader()+string(data)+HARFooter), FormatHAR)
+	assert.NoError(err)
+	assert.Len(records, 1)
+	assert.Equal(rec.Request.Body, records[0].Request.Body)
+	assert.Equal(rec.Latency(), records[0].Latency())
+	assert.True(records[0].Response.BodyOmitted)
+}